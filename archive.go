@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	--tar encrypts a directory tree as one file, a tar of it written in
+	the streamed format, and with -d extracts one into a directory again
+
+		encryptor --tar --keyfile=backup.key /home/me/projects projects.enc
+		encryptor -d --keyfile=backup.key projects.enc /restore/projects
+
+	The header says when a file is a directory archive, so decrypting a
+	local file needs no --tar - decrypting it to stdout writes the tar,
+	for tools that want it. Stdin and cloud storage sources are read
+	once, so they need --tar to be extracted
+*/
+
+// Archive jobs are worked out before the job, a directory archive is recognized by its header
+func checkArchive(options *EncryptorOptions) error {
+	local := options.SourceFilename != "" && options.SourceFilename != StdioFilename && !isObjectURL(options.SourceFilename)
+
+	if !options.Tar && local && options.Operation == encryptor.Decryption && !options.OpenPGP && options.JWE == "" && options.TargetFilename != StdioFilename && !isObjectURL(options.TargetFilename) {
+		header, err := encryptor.ReadHeader(options.SourceFilename)
+		options.Tar = err == nil && header.Content == encryptor.ContentTar
+	}
+
+	if options.Symlinks != "" && !(options.Tar && options.Operation == encryptor.Encryption) {
+		return errors.New("--follow-symlinks, --preserve-symlinks, and --skip-symlinks are for encrypting a directory with --tar")
+	}
+
+	if options.ZstdDictionary && !(options.Tar && options.Operation == encryptor.Encryption && options.Compression == encryptor.CompressionZstd) {
+		return errors.New("--dictionary is for encrypting a directory with --tar --compress=zstd")
+	}
+
+	if !options.Tar {
+		if stats, err := os.Stat(options.SourceFilename); err == nil && stats.IsDir() && local && options.Operation == encryptor.Encryption {
+			return fmt.Errorf("%s is a directory, give --tar to encrypt it as one file", options.SourceFilename)
+		}
+
+		return nil
+	}
+
+	if (options.Operation != encryptor.Encryption && options.Operation != encryptor.Decryption) || options.OpenPGP || options.JWE != "" || options.HeadFirst || options.MerkleTreeHash {
+		return errors.New("--tar encrypts a directory or decrypts one with -d, not with other commands, --openpgp, --jwe, --head-first, or --tree-hash")
+	}
+
+	if options.Operation == encryptor.Decryption {
+		if options.TargetFilename == "" || options.TargetFilename == StdioFilename || isObjectURL(options.TargetFilename) {
+			return errors.New("--tar -d extracts into a directory, give its name as the target (decrypt to - for the tar itself)")
+		}
+
+		return nil
+	}
+
+	stats, err := os.Stat(options.SourceFilename)
+	if !local || err != nil || !stats.IsDir() {
+		return fmt.Errorf("--tar encrypts a directory, %s is not one", options.SourceFilename)
+	}
+
+	if options.TargetFilename == "" || encryptor.IsHTTPURL(options.TargetFilename) {
+		return errors.New("--tar needs a target file, -, gs:// object, or Azure blob to write the encrypted directory to")
+	}
+
+	// The archive would grow as it archives itself
+	if options.TargetFilename != StdioFilename && !isObjectURL(options.TargetFilename) && isWithin(options.TargetFilename, options.SourceFilename) {
+		return fmt.Errorf("the target %s is inside the directory being encrypted", options.TargetFilename)
+	}
+
+	return nil
+}
+
+// Whether path is directory or somewhere beneath it, by name
+func isWithin(path string, directory string) bool {
+	path, pathErr := filepath.Abs(path)
+	directory, directoryErr := filepath.Abs(directory)
+	if pathErr != nil || directoryErr != nil {
+		return false
+	}
+
+	relative, err := filepath.Rel(directory, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+func runArchiveJob(options *EncryptorOptions) (err error) {
+	if options.Operation == encryptor.Decryption {
+		var source io.Reader = os.Stdin
+
+		if isObjectURL(options.SourceFilename) {
+			source, err = openObjectReader(options.SourceFilename, &options.Options)
+			if err != nil {
+				return err
+			}
+		} else if options.SourceFilename != StdioFilename {
+			file, err := os.Open(options.SourceFilename)
+			if err != nil {
+				return fmt.Errorf("could not open source file: %w", err)
+			}
+
+			defer func(file *os.File) {
+				_ = file.Close()
+			}(file)
+
+			source = file
+		}
+
+		err = encryptor.DecryptDirectory(source, options.TargetFilename, &options.Options)
+		if err == nil {
+			gLoggerInfo.Println("Extracted", options.SourceFilename, "into", options.TargetFilename)
+		}
+
+		return err
+	}
+
+	if options.TargetFilename == StdioFilename {
+		return encryptor.EncryptDirectory(options.SourceFilename, os.Stdout, &options.Options)
+	}
+
+	if isObjectURL(options.TargetFilename) {
+		writer, err := openObjectWriter(options.TargetFilename, &options.Options)
+		if err != nil {
+			return err
+		}
+
+		// The object only appears if the job succeeds
+		defer func(writer objectWriter) {
+			if err != nil {
+				_ = writer.Abort()
+			} else {
+				err = writer.Close()
+			}
+		}(writer)
+
+		return encryptor.EncryptDirectory(options.SourceFilename, writer, &options.Options)
+	}
+
+	_, statErr := os.Stat(options.TargetFilename)
+	if statErr == nil && !options.ForceOperation {
+		return encryptor.ErrTargetExists
+	}
+
+	file, err := os.Create(options.TargetFilename)
+	if err != nil {
+		return fmt.Errorf("could not open file for writing: %w", err)
+	}
+
+	err = encryptor.EncryptDirectory(options.SourceFilename, file, &options.Options)
+
+	// Because the close is for a file we are writing to, it can fail the job
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing file we were writing to: %w", closeErr)
+	}
+
+	// Half an archive is no use to anyone
+	if err != nil {
+		_ = os.Remove(options.TargetFilename)
+	}
+
+	return err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	encryptor hash dir prints the tree hash of every file under dir, and
+	encryptor hash --manifest=SHA256SUMS dir writes a checksum manifest of
+	them as well (--manifest=- to stdout, in place of the tree hash).
+	encryptor hash --check SHA256SUMS checks a manifest as sha256sum -c
+	does - a line per file, OK or FAILED, and a failing exit when any file
+	fails. All of them only hash files changed since they were last
+	hashed, unless --no-cache is given
+*/
+
+// Files whose checksums did not match, or could not be read
+var errChecksumsFailed = errors.New("checksums did not match")
+
+func runChecksumManifest(options *EncryptorOptions) error {
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename {
+		return errors.New("give the file or directory to hash into the manifest")
+	}
+
+	cache := openHashCache(options)
+
+	entries, err := encryptor.HashTree(options.SourceFilename, uint(options.Readers), cache)
+	if err != nil {
+		return err
+	}
+
+	saveHashCache(cache)
+
+	if options.ChecksumManifest == StdioFilename {
+		return encryptor.WriteChecksumManifest(os.Stdout, entries, options.ManifestFormat)
+	} else if options.ChecksumManifest == "" {
+		return printTreeHash(options.SourceFilename, entries)
+	}
+
+	// A manifest inside the tree it describes does not describe itself
+	if manifestStats, err := os.Stat(options.ChecksumManifest); err == nil {
+		if !options.ForceOperation {
+			return encryptor.ErrTargetExists
+		}
+
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entryStats, err := os.Stat(entry.Path); err != nil || !os.SameFile(entryStats, manifestStats) {
+				kept = append(kept, entry)
+			}
+		}
+
+		entries = kept
+	}
+
+	file, err := os.Create(options.ChecksumManifest)
+	if err != nil {
+		return fmt.Errorf("could not create manifest: %w", err)
+	}
+
+	err = encryptor.WriteChecksumManifest(file, entries, options.ManifestFormat)
+
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing manifest: %w", closeErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if hashesTree(options) {
+		return printTreeHash(options.SourceFilename, entries)
+	}
+
+	return nil
+}
+
+// A directory is hashed as a tree, a file (or stdin) on its own
+func hashesTree(options *EncryptorOptions) bool {
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename {
+		return false
+	}
+
+	stats, err := os.Stat(options.SourceFilename)
+	return err == nil && stats.IsDir()
+}
+
+func printTreeHash(root string, entries []encryptor.ChecksumEntry) error {
+	hash, err := encryptor.TreeHash(root, entries)
+	if err != nil {
+		return err
+	}
+
+	// Use fmt.Print because the output is a contract, as for a file's hash
+	fmt.Print(hash)
+	return nil
+}
+
+// The manifest is --manifest, or the source as sha256sum -c takes it
+func runChecksumCheck(options *EncryptorOptions) error {
+	manifestName := options.ChecksumManifest
+	if manifestName == "" {
+		manifestName = options.SourceFilename
+	}
+
+	var manifest io.Reader = os.Stdin
+
+	if manifestName == "" {
+		return errors.New("give the manifest to check with --manifest")
+	} else if manifestName != StdioFilename {
+		file, err := os.Open(manifestName)
+		if err != nil {
+			return fmt.Errorf("could not open manifest: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		manifest = file
+	}
+
+	entries, err := encryptor.ReadChecksumManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	cache := openHashCache(options)
+	results := encryptor.CheckChecksums(entries, uint(options.Readers), cache)
+	saveHashCache(cache)
+
+	failed, unreadable := 0, 0
+
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			unreadable++
+			fmt.Println(result.Path + ": FAILED open or read")
+		case !result.OK:
+			failed++
+			fmt.Println(result.Path + ": FAILED")
+		default:
+			fmt.Println(result.Path + ": OK")
+		}
+	}
+
+	if unreadable > 0 {
+		gLoggerInfo.Printf("Warning: %d listed files could not be read\n", unreadable)
+	}
+
+	if failed > 0 {
+		gLoggerInfo.Printf("Warning: %d computed checksums did NOT match\n", failed)
+	}
+
+	if failed > 0 || unreadable > 0 {
+		return fmt.Errorf("%w, %d of %d files failed", errChecksumsFailed, failed+unreadable, len(entries))
+	}
+
+	return nil
+}
+
+// nil with --no-cache, or when the cache cannot be read - hashing goes ahead without it
+func openHashCache(options *EncryptorOptions) *encryptor.HashCache {
+	if options.NoHashCache {
+		return nil
+	}
+
+	cache, err := encryptor.OpenHashCache("")
+	if err != nil {
+		gLoggerInfo.Println("Warning: hashing every file,", err.Error())
+		return nil
+	}
+
+	return cache
+}
+
+func saveHashCache(cache *encryptor.HashCache) {
+	if cache == nil {
+		return
+	}
+
+	if err := encryptor.SaveHashCache(cache); err != nil {
+		gLoggerInfo.Println("Warning: the hash cache was not saved,", err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"encryptor/pkg/encryptor"
+	"os"
+)
+
+// A crash report bundle, everything in it is safe to attach to a bug report
+type crashBundle struct {
+	Version   string
+	GitCommit string
+	encryptor.CrashReport
+}
+
+/*
+	Saved to the temporary directory (--temp-dir's, outside any session so
+	it is kept), readable only by the user, as
+	encryptor-crash-<time>-<random>.json. The directory is often shared,
+	so the file is created new (never through a link someone planted at a
+	name they could guess) and crashes in the same second do not replace
+	each other's reports
+*/
+func writeCrashReport(crash *encryptor.CrashError) (string, error) {
+	bundle := crashBundle{gVersion, gGitCommit, crash.Report}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(encryptor.TempDir(), "encryptor-crash-"+crash.Report.Time.Format("20060102-150405")+"-*.json")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
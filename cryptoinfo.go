@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"encryptor/pkg/encryptor"
+	"fmt"
+	"os"
+)
+
+/*
+	encryptor --crypto-info says whether Go's crypto takes its hardware
+	paths on this machine, so a slow job can be told from a slow disk.
+	AES without hardware is many times slower than XChaCha20-Poly1305,
+	which needs no special instructions - encrypting with an AES cipher
+	there is warned about, with the suggestion unless FIPS rules it out
+*/
+
+func printCryptoInfo(options *EncryptorOptions) error {
+	acceleration := encryptor.GetCryptoAcceleration()
+
+	if options.JSONOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(acceleration)
+	}
+
+	vectorUnit := acceleration.VectorUnit
+	if vectorUnit == "" {
+		vectorUnit = "none"
+	}
+
+	fmt.Println("architecture:", acceleration.Architecture)
+	fmt.Println("AES instructions:", yesNo(acceleration.AES))
+	fmt.Println("carry-less multiply:", yesNo(acceleration.CarrylessMultiply))
+	fmt.Println("AES-GCM in hardware:", yesNo(acceleration.AESGCMHardware))
+	fmt.Println("vector unit for ChaCha20-Poly1305:", vectorUnit)
+
+	if warning := cipherWarning(acceleration, options.Cipher, options); warning != "" {
+		gLoggerInfo.Println("Warning:", warning)
+	}
+
+	return nil
+}
+
+// A warning when the cipher would run in software, empty when it would not
+func cipherWarning(acceleration encryptor.CryptoAcceleration, cipher string, options *EncryptorOptions) string {
+	if !acceleration.SoftwareFallback(cipher) {
+		return ""
+	}
+
+	if cipher == "" {
+		cipher = encryptor.DefaultCipher
+	}
+
+	warning := fmt.Sprintf("this machine has no AES hardware Go can use, %s runs in much slower software", cipher)
+	if !options.FIPS && !encryptor.FIPSBuild() {
+		warning += ", --cipher=XChaCha20-Poly1305 is fast without it"
+	}
+
+	return warning
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+
+	return "no"
+}
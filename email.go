@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// encryptor wrap-email report.pdf report.eml writes a draft email with report.pdf.enc attached
+func runEmailWrapping(options *EncryptorOptions) (err error) {
+	if options.TargetFilename == "" {
+		return errors.New("wrap-email needs a target filename for the email (e.g. message.eml), or - for stdout")
+	}
+
+	var source io.Reader = os.Stdin
+	var target io.Writer = os.Stdout
+
+	email := encryptor.EmailOptions{
+		To:             options.EmailTo,
+		Subject:        options.EmailSubject,
+		AttachmentName: encryptor.DefaultAttachmentName,
+	}
+
+	if options.SourceFilename != StdioFilename {
+		file, err := os.Open(options.SourceFilename)
+		if err != nil {
+			return fmt.Errorf("could not open source file: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		source = file
+		email.AttachmentName = filepath.Base(options.SourceFilename) + ".enc"
+	}
+
+	if options.TargetFilename != StdioFilename {
+		_, statErr := os.Stat(options.TargetFilename)
+		if statErr == nil && !options.ForceOperation {
+			return encryptor.ErrTargetExists
+		}
+
+		file, err := os.Create(options.TargetFilename)
+		if err != nil {
+			return fmt.Errorf("could not open file for writing: %w", err)
+		}
+
+		// Because the close is for a file we are writing to, it can fail the job
+		defer func(file *os.File) {
+			closeErr := file.Close()
+			if err == nil && closeErr != nil {
+				err = fmt.Errorf("error closing file we were writing to: %w", closeErr)
+			}
+		}(file)
+
+		target = file
+	}
+
+	return encryptor.WrapEmail(source, target, &email, &options.Options)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"encryptor/pkg/encryptor"
 	"errors"
 	"fmt"
+	"golang.org/x/term"
 	"log"
 	"os"
-	"runtime"
 	"strings"
+	"time"
 )
 
 // Tie to a make/CI system (including build number) and version convention in the future
@@ -15,6 +18,9 @@ var gVersion = "0"
 var gGitCommit = "0"
 var gLoggerStdout = log.New(os.Stdout, "", 0)
 var gLoggerStderr = log.New(os.Stderr, "", log.Lshortfile)
+
+// Stdout is reserved for contract output (hashes, results, streamed data), so informational output goes to stderr
+var gLoggerInfo = log.New(os.Stderr, "", 0)
 var gOptions EncryptorOptions
 
 func main() {
@@ -23,28 +29,199 @@ func main() {
 		gLoggerStderr.Println("Could not initialize encryptor: ", err.Error())
 	}
 
+	// Before anything else runs, so nothing is ever attempted offline only to fail
+	if err := checkOffline(&gOptions); err != nil {
+		gLoggerStderr.Println("An error was encountered validating our configuration during startup: ", err.Error())
+		printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+		os.Exit(1)
+	}
+
+	// Before anything makes a temporary file, and clearing away what crashed runs left
+	if err := setupTempDir(&gOptions); err != nil {
+		gLoggerStderr.Println("An error was encountered validating our configuration during startup: ", err.Error())
+		os.Exit(1)
+	}
+
+	// Before anything draws random data, which would otherwise block unexplained on an unseeded generator
+	if err := checkEntropy(&gOptions); err != nil {
+		gLoggerStderr.Println("An error was encountered validating our configuration during startup: ", err.Error())
+		printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+		os.Exit(1)
+	}
+
+	// Listing capabilities needs no configuration, and must work even where policy would stop a job
+	if gOptions.Operation == encryptor.CapabilitiesListing {
+		err := printCapabilities(gOptions.JSONOutput)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered listing capabilities: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Checking the binary comes before trusting it with anything, keys included
+	if gOptions.Operation == encryptor.BinaryVerification {
+		err := runBinaryVerification(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered verifying the binary: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Updates are only ever checked for or installed when asked for
+	if gOptions.Operation == encryptor.UpdateChecking || gOptions.Operation == encryptor.SelfUpdating {
+		run := runUpdateCheck
+		if gOptions.Operation == encryptor.SelfUpdating {
+			run = runSelfUpdate
+		}
+
+		err := run(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered updating: ", err.Error())
+			printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Storing a password in the keyring runs no job
+	if gOptions.Operation == encryptor.PasswordStoring {
+		err := runPasswordStoring(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered storing a password: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Generating a keypair runs no job either
+	if gOptions.Operation == encryptor.KeyGenerating {
+		err := runKeyGeneration(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered generating a key: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Inspecting reads only the header, it needs no key and writes nothing
+	if gOptions.Operation == encryptor.Inspecting {
+		err := runInspection(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered inspecting a file: ", err.Error())
+			printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Verifying a proof needs only the proof and the root, no key
+	if gOptions.Operation == encryptor.ProofVerifying {
+		err := runProofVerification(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered verifying a proof: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
 	/*
 		GOMAXPROCS now defaults to the value of runtime.NumCPU, so we do
 		not need to increase it - Pre 1.15 (2020?) this was something
 		we would have increased to n >= 2 (in case this code is backported)
 	*/
+	// Each of several sources is a job of its own, validated as it comes
+	if len(gOptions.SourceFilenames) > 0 {
+		os.Exit(runMultipleFiles(&gOptions))
+	}
+
 	err := validateOpts(&gOptions)
 	if err != nil {
 		gLoggerStderr.Println("An error was encountered validating our configuration during startup: ", err.Error())
+		printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+		os.Exit(1)
+	}
+
+	// Once the filenames are final, so the same job is recognized however it was named
+	if gOptions.SingleInstance {
+		lockFilename := instanceLockFilename(&gOptions)
+
+		gInstanceLock, err = acquireInstanceLock(lockFilename)
+		if errors.Is(err, errAlreadyRunning) {
+			gLoggerInfo.Println("Skipped, the same job is already running (it holds", lockFilename+")")
+			os.Exit(exitAlreadyRunning)
+		}
+
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered checking for another instance of the job: ", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Before anything reads the source, the hook may be what puts it there
+	err = runPreCommand(&gOptions)
+	if err != nil {
+		gLoggerStderr.Println("An error was encountered running --pre-cmd, the job was not started: ", err.Error())
 		os.Exit(1)
 	}
 
 	/*
 		There are three basic operations we are capable of: encryption,
-		decryption, and hashing
+		decryption, and hashing - plus scrubbing of encrypted archives
 
 		Encryption and decryption are pipeline operations, hashing
-		is a direct operation
+		and scrubbing are direct operations - all of them are carried
+		out by the encryptor package, we only handle the command line
 	*/
-	if gOptions.Operation == FileHashing {
-		hash, err := hashFile(gOptions.SourceFilename)
+	if gOptions.Operation == encryptor.FileHashing && (gOptions.ChecksumManifest != "" || gOptions.CheckChecksums || hashesTree(&gOptions)) {
+		if gOptions.CheckChecksums {
+			err = runChecksumCheck(&gOptions)
+		} else {
+			err = runChecksumManifest(&gOptions)
+		}
+
+		if err != nil {
+			if !errors.Is(err, errChecksumsFailed) {
+				gLoggerStderr.Println("An error was encountered hashing files: ", err.Error())
+				printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+			}
+
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if gOptions.Operation == encryptor.FileHashing && gOptions.MerkleTreeHash {
+		err = runMerkleTreeHash(&gOptions)
 		if err != nil {
 			gLoggerStderr.Println("An error was encountered hashing a file: ", err.Error())
+			printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if gOptions.Operation == encryptor.FileHashing {
+		var hash string
+		if gOptions.SourceFilename == StdioFilename {
+			hash, err = encryptor.HashReader(os.Stdin)
+		} else {
+			hash, err = encryptor.Hash(gOptions.SourceFilename)
+		}
+
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered hashing a file: ", err.Error())
+			printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
 			os.Exit(1)
 		}
 
@@ -53,19 +230,202 @@ func main() {
 		os.Exit(0)
 	}
 
-	job, err := pipelineJobFromOpts(&gOptions)
+	if gOptions.Operation == encryptor.Scrubbing {
+		scrubOptions := encryptor.ScrubOptions{
+			StateFilename: gOptions.ScrubStateFilename,
+			MaxRuntime:    gOptions.ScrubMaxRuntime,
+			MaxBytes:      gOptions.ScrubMaxBytes,
+			SamplePercent: gOptions.ScrubSamplePercent,
+			RandomOrder:   gOptions.ScrubRandomOrder,
+		}
+
+		report, err := encryptor.Scrub(gOptions.SourceFilename, &scrubOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered scrubbing: ", err.Error())
+			os.Exit(1)
+		}
+
+		printScrubReport(report)
+
+		if len(report.Failed) > 0 {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if gOptions.Operation == encryptor.Reporting {
+		err = runReport(&gOptions)
+		if err != nil {
+			if !errors.Is(err, errReportFailed) {
+				gLoggerStderr.Println("An error was encountered with the report: ", err.Error())
+				printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+			}
+
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if gOptions.Operation == encryptor.Shredding {
+		err = runShred(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered shredding: ", err.Error())
+			printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if gOptions.Operation == encryptor.Soaking {
+		err = runSoak(&gOptions)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered soaking: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Warnings only, the job runs regardless
+	encrypting := gOptions.Operation == encryptor.Encryption || gOptions.Operation == encryptor.EmailWrapping
+	if encrypting && !gOptions.NoHeuristics && gOptions.SourceFilename != StdioFilename {
+		for _, warning := range sourceWarnings(gOptions.SourceFilename) {
+			gLoggerInfo.Println("Warning:", warning)
+		}
+	}
+
+	// OpenPGP and JWE choose their own ciphers
+	if encrypting && !gOptions.OpenPGP && gOptions.JWE == "" {
+		if warning := cipherWarning(encryptor.GetCryptoAcceleration(), gOptions.Cipher, &gOptions); warning != "" {
+			gLoggerInfo.Println("Warning:", warning)
+		}
+	}
+
+	/*
+		Seen before the job starts, a mistyped password or the wrong key
+		file is caught by eye. Only shown to a person at a terminal, stderr
+		captured by cron, CI, or the journal would keep a password's
+		fingerprint to guess it from (and it is not derived for nothing)
+	*/
+	showFingerprint := term.IsTerminal(int(os.Stderr.Fd()))
+	if showFingerprint && encrypting && !gOptions.OpenPGP && gOptions.JWE == "" && (gOptions.KeyHex != "" || gOptions.Password != "") && !encryptor.UsesRecipients(gOptions.Operation, gOptions.SourceFilename, &gOptions.Options) {
+		fingerprint, err := encryptor.KeyFingerprint(&gOptions.Options)
+		if err == nil {
+			gLoggerInfo.Println("Key fingerprint:", fingerprint)
+		}
+	}
+
+	// The signature is checked regardless, but only --signer says who it must be from
+	decrypting := gOptions.Operation == encryptor.Decryption || gOptions.Operation == encryptor.Verification
+	if decrypting && len(gOptions.SignerKeys) == 0 && gOptions.SourceFilename != StdioFilename {
+		if header, err := encryptor.ReadHeader(gOptions.SourceFilename); err == nil && header.Signature != "" {
+			gLoggerInfo.Println("Signed by", header.SignerKey, "- give --signer to require a signature from someone you trust")
+		}
+	}
+
+	// Bounded jobs report how close they came to the bound, --mem-stats reports in detail
+	var memoryReport encryptor.MemoryReport
+	if gOptions.MaxMemoryMB > 0 || gOptions.MemStats || gOptions.MemStatsFilename != "" {
+		gOptions.MemoryReport = &memoryReport
+	}
+
+	if gOptions.MemStatsFilename != "" {
+		gOptions.MemorySampleInterval = memStatsSampleInterval
+	}
+
+	var stageReport encryptor.StageReport
+	if gOptions.Stats {
+		gOptions.StageReport = &stageReport
+	}
+
+	var merkleTree encryptor.MerkleTree
+	if gOptions.MerkleTreeHash {
+		gOptions.TreeHash = &merkleTree
+	}
+
+	transcript := startTranscript(&gOptions)
+
+	err = runJob(&gOptions)
+
+	// Before the hook, which may ship it with the target
+	transcriptErr := finishTranscript(transcript, &gOptions, err)
+	if transcriptErr != nil {
+		gLoggerStderr.Println("An error was encountered writing the transcript: ", transcriptErr.Error())
+	}
+
+	// Whether or not the job succeeded, the hook is told which
+	hookErr := runPostCommand(&gOptions, err)
+	if hookErr != nil {
+		gLoggerStderr.Println("An error was encountered running --post-cmd: ", hookErr.Error())
+	}
+
 	if err != nil {
-		gLoggerStderr.Println("An error was encountered creating pipeline job from configuration: ", err.Error())
+		gLoggerStderr.Println("An error was encountered executing the pipeline job\nThe error was: ", err)
+
+		var crash *encryptor.CrashError
+		if errors.As(err, &crash) {
+			if fileName, writeErr := writeCrashReport(crash); writeErr == nil {
+				gLoggerInfo.Println("A crash report was saved to", fileName, "- it holds no keys or passwords, please attach it to a bug report (after checking you are happy to share the file names in it)")
+			} else {
+				gLoggerInfo.Println("A crash report could not be saved: ", writeErr.Error())
+			}
+		}
+
+		printErrorHints(gLoggerInfo.Writer(), err, &gOptions)
+		os.Exit(1)
+	}
+
+	if gOptions.MerkleTreeHash {
+		gLoggerInfo.Println("Tree hash of the plaintext:", merkleTree.Root)
+	}
+
+	if hookErr != nil || transcriptErr != nil {
 		os.Exit(1)
 	}
 
-	err = runPipelineJob(&job)
+	reportStages(&gOptions, &stageReport)
+
+	err = reportMemory(&gOptions, &memoryReport)
 	if err != nil {
-		gLoggerStderr.Println("An error was encountered executing the pipeline job\nThe error was: ", err)
+		gLoggerStderr.Println("An error was encountered writing memory statistics: ", err.Error())
 		os.Exit(1)
 	}
 }
 
+// The job itself, once the options are validated - everything around it (hooks, the transcript) is left to the caller
+func runJob(options *EncryptorOptions) error {
+	if options.Operation == encryptor.Verification {
+		return runVerification(options)
+	} else if options.Operation == encryptor.Previewing {
+		return runPreview(options)
+	} else if options.Operation == encryptor.Recovering {
+		return runRecovery(options)
+	} else if options.Operation == encryptor.RangeProving {
+		return runRangeProof(options)
+	} else if options.Operation == encryptor.EmailWrapping {
+		return runEmailWrapping(options)
+	} else if options.Operation == encryptor.FileServing {
+		return runFileServing(options)
+	} else if options.OpenPGP {
+		return runOpenPGPJob(options)
+	} else if options.JWE != "" {
+		return runJWEJob(options)
+	} else if options.Tar {
+		return runArchiveJob(options)
+	} else if options.HeadFirst && options.TargetFilename == StdioFilename {
+		return encryptor.DecryptToFile(options.SourceFilename, os.Stdout, &options.Options)
+	} else if usesStdio(options) || usesObjectStorage(options) {
+		return runStdioJob(options)
+	} else if options.Operation == encryptor.Decryption {
+		return encryptor.Decrypt(options.SourceFilename, options.TargetFilename, &options.Options)
+	}
+
+	return encryptor.Encrypt(options.SourceFilename, options.TargetFilename, &options.Options)
+}
+
 func validateOpts(options *EncryptorOptions) error {
 	if options == nil {
 		return errors.New("options passed in are nil")
@@ -73,12 +433,34 @@ func validateOpts(options *EncryptorOptions) error {
 
 	var err error = nil
 
+	// Sanitized below like a password given with --password, so both give the same key
+	err = loadPasswordFile(options)
+	if err != nil {
+		return err
+	}
+
+	err = loadKeyringPassword(options)
+	if err != nil {
+		return err
+	}
+
 	// Sanitize input
 	options.SourceFilename = strings.TrimSpace(options.SourceFilename)
 	options.TargetFilename = strings.TrimSpace(options.TargetFilename)
 	options.KeyHex = strings.TrimSpace(options.KeyHex)
 	options.Password = strings.TrimSpace(options.Password)
 
+	err = loadKeyFile(options)
+	if err != nil {
+		return err
+	}
+
+	// remote:path filenames from an rclone configuration
+	err = resolveRemoteFilenames(options)
+	if err != nil {
+		return err
+	}
+
 	/*
 		TBD: With more time this could be useful and informative to a
 		user experiencing difficulties (which should be rare)
@@ -88,45 +470,479 @@ func validateOpts(options *EncryptorOptions) error {
 		and write the resulting data to file 2
 	*/
 
-	// Should we prompt for password? Empty or blank passwords not supported
-	if options.Operation == Encryption || options.Operation == Decryption {
-		if options.KeyHex == "" && options.Password == "" {
-			options.Password, err = promptUserForPassword()
-			if err != nil {
-				return fmt.Errorf("could not obtain password")
+	// Before stdout becomes the target of a decryption given no target
+	err = checkStoredName(options)
+	if err != nil {
+		return err
+	}
+
+	// Pipelines may leave the filenames off entirely
+	if options.Operation != encryptor.Scrubbing {
+		defaultStdioFilenames(options)
+	}
+
+	// Verifying only reads, there is nothing to write to
+	if options.Operation == encryptor.Verification && options.TargetFilename != "" {
+		return errors.New("verification does not write the plaintext, a target filename cannot be given")
+	}
+
+	// Sequential verification is a way of verifying, the progress and certificate files only belong to it
+	if options.ProgressFilename != "" || options.CertificateFilename != "" {
+		options.Sequential = true
+	}
+
+	if options.Sequential && options.Operation != encryptor.Verification {
+		return errors.New("--sequential, --progress-file, and --certificate can only be used with --verify")
+	}
+
+	if options.Sequential && options.SourceFilename == StdioFilename {
+		return errors.New("stdin is always read sequentially, --sequential verifies a file")
+	}
+
+	// The pipeline reads chunks out of order, a pipe cannot be
+	if options.HeadFirst && (options.Operation != encryptor.Decryption || options.OpenPGP || options.JWE != "" || options.SourceFilename == StdioFilename || isObjectURL(options.SourceFilename)) {
+		return errors.New("--head-first decrypts a file with -d, not stdin, gs://, az://, or http(s):// sources, --openpgp, or --jwe")
+	}
+
+	if options.HeadFirst && isObjectURL(options.TargetFilename) {
+		return errors.New("--head-first writes a file or stdout, an upload only appears once it is complete")
+	}
+
+	if options.Compression != "" {
+		compressions := encryptor.GetCapabilities().Compressions
+		supported := false
+		for _, compression := range compressions {
+			supported = supported || compression == options.Compression
+		}
+
+		if !supported {
+			return fmt.Errorf("--compress=%s is not supported, use one of %s", options.Compression, strings.Join(compressions, ", "))
+		}
+	}
+
+	// Decrypting decompresses whatever the header says, compressing is chosen when encrypting
+	if options.Compression != "" && (options.Operation != encryptor.Encryption || options.OpenPGP || options.JWE != "" || options.MerkleTreeHash) {
+		return errors.New("--compress encrypts a file in our format, not with other commands, --openpgp, --jwe, or --tree-hash (decrypting decompresses by itself)")
+	}
+
+	err = checkArchive(options)
+	if err != nil {
+		return err
+	}
+
+	err = checkFileServing(options)
+	if err != nil {
+		return err
+	}
+
+	err = checkReport(options)
+	if err != nil {
+		return err
+	}
+
+	err = checkShred(options)
+	if err != nil {
+		return err
+	}
+
+	err = checkSoak(options)
+	if err != nil {
+		return err
+	}
+
+	// Objects are streamed, by the jobs that can stream
+	streams := options.Operation == encryptor.Encryption || options.Operation == encryptor.Decryption || options.Operation == encryptor.Verification
+	if usesObjectStorage(options) && (!streams || options.OpenPGP || options.JWE != "" || options.Sequential) {
+		return errors.New("gs:// objects, Azure blobs, and http(s):// URLs can be encrypted, decrypted, and verified, not used with other commands, --openpgp, --jwe, or --sequential")
+	}
+
+	// Servers are read from, there is no one way to upload to them
+	if encryptor.IsHTTPURL(options.TargetFilename) {
+		return errors.New("http(s):// URLs can only be a source, write the target to a file, gs://, or an Azure blob")
+	}
+
+	// OpenPGP messages are whole files, there are no chunks to verify or preview on their own
+	if options.OpenPGP && options.Operation != encryptor.Encryption && options.Operation != encryptor.Decryption {
+		return errors.New("--openpgp can only be used to encrypt or decrypt")
+	}
+
+	// JWEs are whole messages too, and a file is written in one format
+	if options.JWE != "" && options.Operation != encryptor.Encryption && options.Operation != encryptor.Decryption {
+		return errors.New("--jwe can only be used to encrypt or decrypt")
+	}
+
+	if options.JWE != "" && options.OpenPGP {
+		return errors.New("a file can be written as an OpenPGP message or a JWE, not both")
+	}
+
+	if options.JWE != "" && options.JWE != encryptor.JWECompact && options.JWE != encryptor.JWEJSON {
+		return fmt.Errorf("unknown --jwe serialization %q, use --jwe=%s or --jwe=%s", options.JWE, encryptor.JWECompact, encryptor.JWEJSON)
+	}
+
+	// Only file jobs of our format see every chunk, and a directory is hashed by its files
+	if options.MerkleTreeHash {
+		pipelineJob := options.Operation == encryptor.Encryption || options.Operation == encryptor.Decryption
+		if !(pipelineJob || options.Operation == encryptor.FileHashing) || options.OpenPGP || options.JWE != "" || options.CheckChecksums || options.ChecksumManifest != "" ||
+			options.SourceFilename == StdioFilename || (pipelineJob && options.TargetFilename == StdioFilename) || usesObjectStorage(options) {
+			return errors.New("--tree-hash is for hash, encryption, and decryption of files, not --openpgp, --jwe, manifests, stdio, or cloud storage")
+		}
+
+		if stats, err := os.Stat(options.SourceFilename); err == nil && stats.IsDir() {
+			return errors.New("--tree-hash hashes a file's chunks, a directory is hashed as a tree of its files without it")
+		}
+	}
+
+	if options.Operation == encryptor.RangeProving {
+		if options.TreeProofRange == "" {
+			return errors.New("prove needs the bytes to prove, give them with --tree-proof=START-END")
+		}
+
+		if options.SourceFilename == "" || options.SourceFilename == StdioFilename {
+			return errors.New("prove decrypts an encrypted file, give its name")
+		}
+	} else if options.TreeProofRange != "" && (!options.MerkleTreeHash || options.Operation != encryptor.FileHashing) {
+		return errors.New("--tree-proof proves a range against the root of hash --tree-hash, give both (or use prove)")
+	}
+
+	// Hooks run around a file job, hashing and scrubbing cover many files at once
+	if options.PreCommand != "" || options.PostCommand != "" {
+		if options.Operation == encryptor.FileHashing || options.Operation == encryptor.Scrubbing || options.Operation == encryptor.Reporting || options.Operation == encryptor.Shredding || options.Operation == encryptor.Soaking {
+			return errors.New("--pre-cmd and --post-cmd run around file jobs such as encryption, decryption, and verification, not hash, scrub, report, shred, or soak")
+		}
+
+		if err = checkHookCommand("pre-cmd", options.PreCommand); err != nil {
+			return err
+		}
+
+		if err = checkHookCommand("post-cmd", options.PostCommand); err != nil {
+			return err
+		}
+	}
+
+	if options.HookTimeout < 0 {
+		return errors.New("--hook-timeout cannot be negative, 0 lets hooks run for as long as they take")
+	}
+
+	err = checkTranscript(options)
+	if err != nil {
+		return err
+	}
+
+	if options.TPMPCRs != "" && !options.TPMSeal {
+		return errors.New("--tpm-pcrs binds the TPM seal, give --tpm as well")
+	}
+
+	// Signatures are part of our format, OpenPGP messages and JWEs have none
+	signing := options.SigningKey != "" || len(options.SignerKeys) > 0 || options.DetachedSignature != ""
+	if signing && (options.OpenPGP || options.JWE != "") {
+		return errors.New("--sign, --signer, and --detached-signature cannot be combined with --openpgp or --jwe")
+	}
+
+	// Manifests are the hash command's
+	if options.Operation != encryptor.FileHashing && options.NoHashCache {
+		return errors.New("--no-cache is for checksum manifests, use it with encryptor hash")
+	}
+
+	// report --check checks the signature of a report
+	if options.Operation != encryptor.FileHashing && options.Operation != encryptor.Reporting && options.CheckChecksums {
+		return errors.New("--check is for checksum manifests and signed reports, use it with encryptor hash or report")
+	}
+
+	if options.ManifestFormat != encryptor.ManifestFormatGNU && options.ManifestFormat != encryptor.ManifestFormatBSD {
+		return fmt.Errorf("unknown --manifest-format %q, use %s or %s", options.ManifestFormat, encryptor.ManifestFormatGNU, encryptor.ManifestFormatBSD)
+	}
+
+	// Only the file format's jobs know their output size before writing
+	if options.MaxOutputBytes > 0 && (options.OpenPGP || options.JWE != "" || (options.Operation != encryptor.Encryption && options.Operation != encryptor.Decryption)) {
+		return errors.New("--max-output-size limits encryption and decryption, not --openpgp, --jwe, or other commands")
+	}
+
+	if options.SigningKey != "" {
+		if options.Operation != encryptor.Encryption && options.Operation != encryptor.EmailWrapping && options.Operation != encryptor.Reporting {
+			return errors.New("--sign signs what is encrypted, or a report, give --signer to check a signature when decrypting")
+		}
+
+		warnIfReadableByOthers("signing key", options.SigningKey)
+	}
+
+	// A preview never touches a target, so nothing can be overwritten by one
+	if options.Operation == encryptor.Previewing && options.TargetFilename != "" && options.TargetFilename != StdioFilename {
+		return errors.New("a preview is written to stdout or a temporary file, a target filename cannot be given")
+	}
+
+	// Should we prompt for password? Empty or blank passwords not supported, recipients need none
+	if options.Operation == encryptor.Encryption || options.Operation == encryptor.Decryption || options.Operation == encryptor.Verification || options.Operation == encryptor.Previewing || options.Operation == encryptor.EmailWrapping || options.Operation == encryptor.Recovering || options.Operation == encryptor.RangeProving || options.Operation == encryptor.FileServing {
+		if options.KeyHex == "" && options.Password == "" && !encryptor.UsesRecipients(options.Operation, options.SourceFilename, &options.Options) {
+			if options.SourceFilename != StdioFilename {
+				// A mistyped password would leave an archive nobody can decrypt, so encryption asks twice
+				encrypting := options.Operation == encryptor.Encryption || options.Operation == encryptor.EmailWrapping
+				options.Password, err = promptUserForPassword(encrypting)
+				if err != nil {
+					return fmt.Errorf("could not obtain password: %w", err)
+				}
+			} else if options.Operation == encryptor.Encryption || options.Operation == encryptor.EmailWrapping {
+				// Stdin carries the data, so there is nothing to prompt with (a stream being decrypted may still name recipients)
+				return errors.New("a password, key, or recipients must be supplied when the source is stdin")
 			}
 		}
 	}
 
-	return err
+	// A sealed name needs the key, so the target is only known now
+	err = restoreName(options)
+	if err != nil {
+		return err
+	}
+
+	return enforcePolicies(options)
 }
 
-func PrintMemUsage() {
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
+func promptUserForPassword(confirm bool) (string, error) {
+	password, err := promptUserForSecret("Please supply a password: ")
+	if err != nil || !confirm {
+		return password, err
+	}
+
+	confirmation, err := promptUserForSecret("Please supply the password again: ")
+	if err != nil {
+		return "", err
+	}
+
+	if confirmation != password {
+		return "", errors.New("the passwords do not match, nothing was encrypted")
+	}
 
-	fmt.Printf("\nCurrent Heap Alloc = %v MiB", (memStats.Alloc/1024)/1024)
-	fmt.Printf("\nTotal Alloc Cumulative = %v MiB", (memStats.TotalAlloc/1024)/1024)
-	fmt.Printf("\nVirtual Address Space Reserved (Sys) = %v MiB", (memStats.Sys/1024)/1024)
+	return password, nil
 }
 
-func promptUserForPassword() (string, error) {
-	password := ""
+// Shared, so answers piped in one per line are not lost to a scanner's buffer between prompts
+var gStdinScanner = bufio.NewScanner(os.Stdin)
 
-	// Blank/Empty password not allowed
-	for password == "" {
-		gLoggerStdout.Println("Please supply a password: ")
+func promptUserForSecret(prompt string) (string, error) {
+	secret := ""
 
-		// We ignore error here because it is an EOF/unexpected newline message
-		scanner := bufio.NewScanner(os.Stdin)
-		if scanner.Scan() {
-			password = scanner.Text()
+	// Blank/Empty secrets not allowed
+	for secret == "" {
+		_, _ = fmt.Fprint(gLoggerInfo.Writer(), prompt)
+
+		// Typed secrets are not echoed, piped ones are read a line at a time
+		var err error
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			var typed []byte
+			typed, err = term.ReadPassword(int(os.Stdin.Fd()))
+			secret = string(typed)
+		} else if gStdinScanner.Scan() {
+			secret = gStdinScanner.Text()
+		} else {
+			err = errors.New("stdin ended before a secret was given")
+		}
+
+		// Neither echoes the newline that ended the input
+		_, _ = fmt.Fprintln(gLoggerInfo.Writer())
+		if err != nil {
+			return "", err
 		}
 
-		if password == "" {
-			gLoggerStdout.Println("Password cannot be empty or blank")
+		if strings.TrimSpace(secret) == "" {
+			secret = ""
+			gLoggerInfo.Println("Input cannot be empty or blank")
 		}
 	}
 
-	return password, nil
+	return secret, nil
+}
+
+func warnUser(warning string) {
+	gLoggerInfo.Println("Warning:", warning)
+}
+
+func printCapabilities(asJSON bool) error {
+	capabilities := encryptor.GetCapabilities()
+	capabilities.FIPSMode = capabilities.FIPSMode || gOptions.FIPS
+
+	if asJSON {
+		output := struct {
+			Version   string
+			GitCommit string
+			Entropy   string
+			encryptor.Capabilities
+		}{gVersion, gGitCommit, entropyDescription(), capabilities}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+
+	fmt.Println("version:", gVersion, "commit:", gGitCommit, "fips:", fipsStatus(&gOptions))
+	fmt.Println("formats:", strings.Join(capabilities.FormatVersions, ", "))
+	fmt.Println("entropy:", entropyDescription())
+
+	for _, cipher := range capabilities.Ciphers {
+		fmt.Printf("cipher: %s (%d bit key, %d byte nonce, %d byte tag)%s\n", cipher.Name, cipher.KeySizeBits, cipher.NonceSizeBytes, cipher.TagSizeBytes, fipsNote(cipher.FIPSApproved))
+	}
+
+	for _, kdf := range capabilities.KDFs {
+		fmt.Printf("kdf: %s-%s (%d iterations, %d byte salt)%s\n", kdf.Name, kdf.Hash, kdf.Iterations, kdf.SaltSizeBytes, fipsNote(kdf.FIPSApproved))
+	}
+
+	fmt.Println("hashes:", strings.Join(capabilities.Hashes, ", "))
+	fmt.Println("chunk checksums:", strings.Join(capabilities.ChunkChecksums, ", "))
+	fmt.Println("compressions:", strings.Join(capabilities.Compressions, ", "))
+
+	for _, provider := range capabilities.KeyProviders {
+		fmt.Printf("key provider: %s - %s%s\n", provider.Name, provider.Description, fipsNote(provider.FIPSApproved))
+	}
+
+	limits := capabilities.Limits
+	fmt.Printf("limits: chunk size %d-%d MB, readers %d, executors %d, writers %d, batch chunks %d, part size %d-%d MB\n",
+		limits.ChunkSizeMinMB, limits.ChunkSizeMaxMB, limits.ReadersMax, limits.ExecutorsMax, limits.WritersMax,
+		limits.BatchChunksMax, limits.PartSizeMinMB, limits.PartSizeMaxMB)
+
+	return nil
+}
+
+func fipsNote(approved bool) string {
+	if approved {
+		return " [FIPS approved]"
+	}
+
+	return ""
+}
+
+func runInspection(options *EncryptorOptions) error {
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename {
+		return errors.New("inspect needs the filename of an encrypted file")
+	}
+
+	if options.TargetFilename != "" {
+		return errors.New("inspect only reads, a target filename cannot be given")
+	}
+
+	inspection, err := encryptor.Inspect(options.SourceFilename)
+	if err != nil {
+		return err
+	}
+
+	printInspection(inspection, options.JSONOutput)
+	return nil
+}
+
+func printInspection(inspection encryptor.FileInspection, asJSON bool) {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(inspection)
+		return
+	}
+
+	supported := ""
+	if !inspection.Supported {
+		supported = " (not supported by this version of encryptor)"
+	}
+
+	cipher := inspection.Cipher
+	if cipher == "" {
+		cipher = inspection.Algorithm + "-" + inspection.Mode + " (not supported by this version of encryptor)"
+	}
+
+	fmt.Println("file:", inspection.FileName)
+	fmt.Println("format:", inspection.FormatVersion+supported)
+	fmt.Printf("cipher: %s (%d bit key)\n", cipher, inspection.KeySizeBits)
+
+	if inspection.KeySource == encryptor.KeySourcePassword {
+		fmt.Printf("key: %s (%s, %d iterations)\n", inspection.KeySource, inspection.KDF, inspection.KDFIterations)
+	} else {
+		fmt.Println("key:", inspection.KeySource)
+	}
+
+	for _, recipient := range inspection.Recipients {
+		fmt.Println("recipient:", recipient)
+	}
+
+	chunks := fmt.Sprintf("%d of %d bytes", inspection.NumChunks, inspection.ChunkSizeBytes)
+	if inspection.Streamed {
+		chunks += ", streamed"
+	}
+
+	if inspection.ChunkChecksum != "" {
+		chunks += ", " + inspection.ChunkChecksum + " checksums"
+	}
+
+	fmt.Println("chunks:", chunks)
+
+	if inspection.Content == encryptor.ContentTar {
+		fmt.Println("content: a directory, as a tar (decrypt extracts it)")
+	}
+
+	if inspection.Name != "" {
+		fmt.Printf("name: %q (-d --restore-name decrypts to it)\n", inspection.Name)
+	} else if inspection.NameSealed {
+		fmt.Println("name: sealed with the key (-d --restore-name decrypts to it)")
+	}
+
+	if inspection.NonceScheme != "" {
+		fmt.Println("nonces:", inspection.NonceScheme)
+	} else {
+		fmt.Println("nonces: random")
+	}
+
+	plaintext := "plaintext"
+	if inspection.Compression != "" {
+		plaintext = inspection.Compression + " compressed plaintext"
+	}
+
+	if inspection.Dictionary {
+		plaintext = inspection.Compression + " compressed plaintext (with a sealed dictionary)"
+	}
+
+	// Older files are sized from their chunks, which comes to the same unless the last one was cut short
+	if inspection.PlaintextRecorded {
+		plaintext += " (recorded in the header)"
+	}
+
+	fmt.Printf("payload: %d bytes, %d bytes of %s\n", inspection.PayloadBytes, inspection.PlaintextBytes, plaintext)
+	fmt.Printf("header: %d bytes\n", inspection.HeaderBytes)
+
+	if inspection.HeaderFromCopy {
+		fmt.Printf("header copy: %s, %d bytes - the header is damaged, this was read from the copy\n", inspection.HeaderCopy, inspection.HeaderCopyBytes)
+	} else if inspection.HeaderCopy != "" {
+		fmt.Printf("header copy: %s, %d bytes\n", inspection.HeaderCopy, inspection.HeaderCopyBytes)
+	}
+
+	if inspection.Footer != "" {
+		fmt.Printf("footer: %s, %d bytes\n", inspection.Footer, inspection.FooterBytes)
+	} else {
+		fmt.Println("footer: none")
+	}
+
+	if inspection.Signature != "" {
+		fmt.Printf("signature: %s, %d bytes, by %s (checked when decrypting)\n", inspection.Signature, inspection.SignatureBytes, inspection.SignerKey)
+	} else {
+		fmt.Println("signature: none")
+	}
+
+	if inspection.PlaintextHash {
+		fmt.Println("plaintext hash: sealed in the header")
+	} else {
+		fmt.Println("plaintext hash: none")
+	}
+
+	if inspection.KeyCheck {
+		fmt.Println("key check: stored in the header")
+	} else {
+		fmt.Println("key check: none")
+	}
+}
+
+func printScrubReport(report encryptor.ScrubReport) {
+	for _, name := range report.NewlyFailing {
+		fmt.Println("NEWLY FAILING", name)
+	}
+
+	for _, failure := range report.Failed {
+		fmt.Println("FAILED", failure)
+	}
+
+	fmt.Printf("scrubbed %d files: %d passed, %d failed, %d newly failing, %d skipped, %d deferred, %d bytes read in %s\n",
+		len(report.Passed)+len(report.Failed), len(report.Passed), len(report.Failed), len(report.NewlyFailing),
+		len(report.Skipped), len(report.Deferred), report.BytesRead, report.Elapsed.Round(time.Millisecond))
 }
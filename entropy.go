@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+	A job that draws random data - encrypting, generating a key, shredding,
+	serving a file with a token - checks at startup that the system's
+	random number generator is seeded. Early in boot, or in a new VM
+	without an entropy device, it may not be, and the job would block on
+	its first key or nonce without a word. Unseeded is a warning, the job
+	still waits for the generator as it always did; with --wait-for-entropy
+	the wait is up front and has a limit, after which the job fails before
+	touching anything
+
+	Reads that fail once a job is running are retried with backoff rather
+	than failing the job (see entropy.go in the encryptor package)
+*/
+
+const defaultEntropyWait = 5 * time.Minute
+
+func drawsRandomData(operation encryptor.OperationEnum) bool {
+	switch operation {
+	case encryptor.Encryption, encryptor.EmailWrapping, encryptor.KeyGenerating, encryptor.Shredding, encryptor.FileServing, encryptor.Soaking:
+		return true
+	}
+
+	return false
+}
+
+func checkEntropy(options *EncryptorOptions) error {
+	if options.WaitForEntropy < 0 {
+		return errors.New("--wait-for-entropy cannot be negative")
+	}
+
+	if !drawsRandomData(options.Operation) && options.WaitForEntropy == 0 {
+		return nil
+	}
+
+	status, err := encryptor.CheckEntropy(options.WaitForEntropy)
+	if status.Waited >= time.Second {
+		gLoggerInfo.Printf("Waited %v for the system's random number generator to be seeded\n", status.Waited.Round(time.Second))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !status.Ready {
+		gLoggerInfo.Println("Warning: the system's random number generator is not seeded yet" + entropyEstimate(status) + ", the job will wait until it is (--wait-for-entropy sets a limit)")
+	}
+
+	return nil
+}
+
+func entropyEstimate(status encryptor.EntropyStatus) string {
+	if status.Available < 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (the kernel estimates %d bits of entropy)", status.Available)
+}
+
+// For capabilities, which is where what this machine can do is asked about
+func entropyDescription() string {
+	status, err := encryptor.CheckEntropy(0)
+	switch {
+	case err != nil:
+		return "failing: " + err.Error()
+	case !status.Known:
+		return "assumed ready, the system cannot say" + entropyEstimate(status)
+	case !status.Ready:
+		return "not seeded yet" + entropyEstimate(status)
+	}
+
+	return "ready" + entropyEstimate(status)
+}
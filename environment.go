@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"os"
+)
+
+/*
+	CI jobs and containers cannot answer a password prompt, and anything
+	on the command line is visible to every process on the machine, so
+	key material can come from the environment instead. Key material on
+	the command line (or in files named on it) always wins, the
+	environment is only a default
+
+	The variables are removed from our environment once read, so the
+	processes we start (e.g. gpg) do not inherit them
+*/
+
+const passwordEnvironmentVariable = "ENCRYPTOR_PASSWORD"
+const keyHexEnvironmentVariable = "ENCRYPTOR_KEYHEX"
+
+// The PIN of PKCS#11 tokens, it is not key material and applies whatever else is given
+const pkcs11PINEnvironmentVariable = "ENCRYPTOR_PKCS11_PIN"
+
+func loadKeyMaterialFromEnvironment(options *EncryptorOptions) error {
+	password := os.Getenv(passwordEnvironmentVariable)
+	keyHex := os.Getenv(keyHexEnvironmentVariable)
+
+	if pin := os.Getenv(pkcs11PINEnvironmentVariable); pin != "" {
+		options.PKCS11PIN = pin
+	}
+
+	_ = os.Unsetenv(passwordEnvironmentVariable)
+	_ = os.Unsetenv(keyHexEnvironmentVariable)
+	_ = os.Unsetenv(pkcs11PINEnvironmentVariable)
+
+	if password == "" && keyHex == "" {
+		return nil
+	}
+
+	if hasKeyMaterialOptions(options) {
+		return nil
+	}
+
+	if password != "" && keyHex != "" {
+		return errors.New(passwordEnvironmentVariable + " and " + keyHexEnvironmentVariable + " cannot both be set")
+	}
+
+	options.Password = password
+	options.KeyHex = keyHex
+	return nil
+}
+
+// Keys, passwords, or recipients given on the command line - store-password names a profile to store in, not one to read
+func hasKeyMaterialOptions(options *EncryptorOptions) bool {
+	readsKeyring := options.KeyringProfile != "" && options.Operation != encryptor.PasswordStoring
+
+	return options.KeyHex != "" || options.KeyFilename != "" ||
+		options.Password != "" || options.PasswordFilename != "" || readsKeyring ||
+		len(options.GPGRecipients) > 0 || len(options.SSHRecipients) > 0 || len(options.RecipientsFiles) > 0 ||
+		len(options.X25519Recipients) > 0 || len(options.RSARecipients) > 0 || len(options.GCPKMSKeys) > 0 || len(options.AzureKeyVaultKeys) > 0 || len(options.PKCS11Keys) > 0 || options.TPMSeal || len(options.PluginRecipients) > 0
+}
@@ -5,11 +5,12 @@ go 1.17
 require (
 	github.com/pborman/getopt/v2 v2.1.0
 	golang.org/x/crypto v0.1.0
+	golang.org/x/sys v0.1.0
+	golang.org/x/term v0.1.0
 )
 
 require (
 	github.com/yuin/goldmark v1.4.13 // indirect
 	golang.org/x/mod v0.6.0 // indirect
-	golang.org/x/sys v0.1.0 // indirect
 	golang.org/x/tools v0.2.0 // indirect
 )
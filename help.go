@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+	--help is every flag at once, which stopped being useful a while ago,
+	so help is also split into topics (encryptor help keys). Topic pages
+	are built when shown from what this build supports - ciphers, key
+	providers, limits, defaults - so they cannot drift from the code the
+	way prose does, and every topic ends with examples that run as shown
+*/
+
+type helpExample struct {
+	Description string
+	Command     string
+}
+
+type helpTopic struct {
+	Name     string
+	Summary  string
+	Body     func() []string // Paragraphs, built when the topic is shown
+	Examples []helpExample
+}
+
+var helpTopics = []helpTopic{
+	{
+		Name:    "formats",
+		Summary: "the encrypted file format, its versions, ciphers, and checksums",
+		Body:    helpFormatsBody,
+		Examples: []helpExample{
+			{"Encrypt with a cipher other than the default", "encryptor --cipher=XChaCha20-Poly1305 source destination.enc"},
+			{"See whether AES runs in hardware here, or XChaCha20-Poly1305 would be faster", "encryptor --crypto-info"},
+			{"Store a checksum per chunk so scrub can verify the file without the key", "encryptor --chunk-crc source destination.enc"},
+			{"Describe an encrypted file from its header, no key needed", "encryptor inspect destination.enc"},
+			{"Salvage the chunks that still authenticate from a file with a damaged header", "encryptor recover --keyfile=backup.key --chunksize=8 damaged.enc salvaged"},
+			{"Give an auditor who holds only the tree hash a sample they can check", "encryptor prove --tree-proof=0-16MB --keyfile=backup.key destination.enc proof.json"},
+			{"List everything this build supports as JSON", "encryptor capabilities --json"},
+		},
+	},
+	{
+		Name:    "keys",
+		Summary: "passwords, keys, recipients, and how key material is derived",
+		Body:    helpKeysBody,
+		Examples: []helpExample{
+			{"Encrypt with a password (prompted for when left off)", "encryptor --password='some password' source destination.enc"},
+			{"Encrypt with a 256 bit key given as hexadecimal", "encryptor --keyhex=e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6 source destination.enc"},
+			{"Encrypt with a key kept in a file, out of shell history", "encryptor --keyfile=backup.key source destination.enc"},
+			{"Encrypt with a password kept in a file, for unattended backups", "encryptor --password-file=backup.pass --force source destination.enc"},
+			{"Encrypt with a password kept in the platform keyring (stored with store-password)", "encryptor --keyring=nightly-backups source destination.enc"},
+			{"Encrypt to everyone in a recipients file", "encryptor --recipients-file=team.keys source destination.enc"},
+			{"Encrypt for someone with only gpg, who decrypts it with gpg -d and the password", "encryptor --openpgp --password='some password' source destination.gpg"},
+			{"Encrypt a small payload as a JWE that JOSE libraries decrypt with the password", "encryptor --jwe --password='some password' token.json token.jwe"},
+			{"Encrypt on an air-gapped machine, refusing anything that would touch the network", "encryptor --offline --gpg-recipient=alice@example.com source destination.enc"},
+			{"Decrypt with an SSH private key", "encryptor -d --ssh-identity=$HOME/.ssh/id_ed25519 destination.enc restored"},
+			{"Generate an X25519 keypair, keeping the public key to give out", "encryptor keygen alice.key > alice.pub"},
+			{"Encrypt to two X25519 public keys, either of which can decrypt", "encryptor --recipient=alice.pub --recipient=bob.pub source destination.enc"},
+			{"Decrypt with an X25519 identity", "encryptor -d --identity=alice.key destination.enc restored"},
+			{"Generate a hybrid ML-KEM-768 + X25519 keypair for long-term archives", "encryptor keygen --post-quantum vault.key > vault.pub"},
+			{"Sign a file as you encrypt it, with a key from keygen --signing", "encryptor --sign=alice-signing.key --recipient=bob.pub source destination.enc"},
+			{"Decrypt only if the file was signed by someone you trust", "encryptor -d --signer=alice-signing.pub --identity=bob.key destination.enc restored"},
+			{"Encrypt to the RSA key in a certificate your PKI issued", "encryptor --rsa-recipient=alice.crt source destination.enc"},
+			{"Decrypt with an RSA private key", "encryptor -d --rsa-identity=alice.key destination.enc restored"},
+			{"Encrypt to a Cloud KMS key, on GKE with workload identity rather than a password", "encryptor --gcp-kms-key=projects/acme/locations/global/keyRings/backups/cryptoKeys/nightly source destination.enc"},
+			{"Encrypt to an Azure Key Vault key, with the pipeline's managed identity", "encryptor --azure-key-vault-key=https://acme-backups.vault.azure.net/keys/nightly source destination.enc"},
+			{"Encrypt a staging file only this machine can decrypt, while its firmware and Secure Boot state are unchanged", "encryptor --tpm --tpm-pcrs=0,7 source destination.enc"},
+			{"Encrypt to an RSA key kept on a smartcard or HSM", "encryptor --pkcs11-key='pkcs11:token=backups;object=nightly' source destination.enc"},
+		},
+	},
+	{
+		Name:    "performance",
+		Summary: "workers, chunk size, memory, and tuning for slow storage",
+		Body:    helpPerformanceBody,
+		Examples: []helpExample{
+			{"More execute workers and larger chunks for a fast disk", "encryptor --executors=16 --chunksize=32 source destination.enc"},
+			{"Keep reads in flight ahead of the executors on a network filesystem", "encryptor --prefetch=8 /mnt/nfs/source destination.enc"},
+			{"Let one pool of workers read and execute as needed", "encryptor --pool=16 source destination.enc"},
+			{"Add and park executors as a long job runs, and see why", "encryptor --scale-executors --executors=32 --mem-stats source destination.enc"},
+			{"Stay under 512MB and report how memory was used", "encryptor --max-memory=512 --mem-stats source destination.enc"},
+			{"Verify a disc in one pass without seeking, resumable, with a certificate to keep", "encryptor --verify --sequential --progress-file=disc1.progress --certificate=disc1.json /media/cdrom/backup.enc"},
+		},
+	},
+}
+
+func helpFormatsBody() []string {
+	capabilities := encryptor.GetCapabilities()
+
+	var ciphers []string
+	for _, cipher := range capabilities.Ciphers {
+		ciphers = append(ciphers, fmt.Sprintf("%s (%d byte nonce, %d byte tag)", cipher.Name, cipher.NonceSizeBytes, cipher.TagSizeBytes))
+	}
+
+	return []string{
+		"An encrypted file is a 2 byte little endian header length, a JSON header, and the chunks. Each chunk is a nonce, the ciphertext, and a tag, optionally followed by a 4 byte checksum. The header records everything needed to decrypt but the key - the cipher, chunk size, chunk count, salt, KDF parameters, and recipients",
+		"Files are written with the lowest format version that describes what they use, so older releases can read them whenever possible. This build reads format versions " + strings.Join(capabilities.FormatVersions, ", "),
+		"Ciphers: " + strings.Join(ciphers, ", ") + ". The default is " + encryptor.DefaultCipher + ", and the header decides when decrypting",
+		"Chunk checksums: " + strings.Join(capabilities.ChunkChecksums, ", "),
+		"Since 1.9 a file ends with a " + encryptor.FooterHMACSHA256 + " footer over the header and every chunk tag, so a file cut short on a chunk boundary fails to decrypt rather than decrypting to less than was encrypted",
+		"Since 1.10 the header carries the SHA256 of the plaintext, sealed with the file's key, and decryption checks what it wrote against it (--no-source-hash leaves it out)",
+		"Since 1.11 the header may carry a key check (--key-check), so a wrong key fails before any chunk is read and a right key that fails later is reported as a corrupt file",
+		"Since 1.12 a file may end with a copy of its header (--header-copy), so a damaged first sector does not lose the whole file - decryption reads the copy when the header is damaged, and scrub reports files whose header and copy differ",
+		"Since 1.13 each chunk may start with a marker holding its chunk ID (--chunk-markers), so recover finds chunks again after damage that added or lost bytes instead of losing everything after it",
+		"Since 1.15 the plaintext may be compressed before it is chunked (--compress=" + strings.Join(capabilities.Compressions, ", ") + "), as one stream so chunks keep their size, and decryption decompresses what the chunks hold - the header names the codec, so codecs are added without a new version",
+		"Since 1.17 a directory compressed with zstd may carry a dictionary trained from its files (--tar --compress=zstd --dictionary), sealed in the header with the file's key - every entry of the tar is a zstd frame of its own compressed with it",
+		"The header may record the source's name (--store-name), sealed with the file's key or in the clear with --store-name=plain, for -d --restore-name to decrypt to. It needs no new version, older releases ignore it",
+	}
+}
+
+func helpKeysBody() []string {
+	capabilities := encryptor.GetCapabilities()
+
+	var providers []string
+	for _, provider := range capabilities.KeyProviders {
+		providers = append(providers, provider.Name+" - "+provider.Description)
+	}
+
+	var kdfs []string
+	for _, kdf := range capabilities.KDFs {
+		kdfs = append(kdfs, fmt.Sprintf("%s-%s, %d iterations, a %d byte random salt per file", kdf.Name, kdf.Hash, kdf.Iterations, kdf.SaltSizeBytes))
+	}
+
+	return []string{
+		"Key material comes from recipients, a key, or a password - in that order. Key providers: " + strings.Join(providers, "; "),
+		"Passwords are derived with " + strings.Join(kdfs, "; ") + ". The KDF and its parameters are stored in the header, so older files keep decrypting as the defaults change",
+		fmt.Sprintf("Recipients wrap a random %d bit file key, so a file can be decrypted by any one of them. When decrypting, the SSH identities given (or ~/.ssh/id_ed25519 and ~/.ssh/id_rsa) and the X25519 and RSA identities given are tried against every stanza in the header", capabilities.Limits.FileKeySizeBits),
+		"With no key material on the command line, " + passwordEnvironmentVariable + " or " + keyHexEnvironmentVariable + " is used if set (for CI and containers, where nothing can be prompted for and the command line is visible to other processes)",
+	}
+}
+
+func helpPerformanceBody() []string {
+	limits := encryptor.GetCapabilities().Limits
+
+	return []string{
+		"Files are processed as a pipeline - read workers, execute workers (encryption and decryption), and one writer - with chunks flowing through in order",
+		fmt.Sprintf("Read workers: %d to %d, %d on this machine by default (1 for spinning disks). Execute workers: %d to %d, %d on this machine by default", 1, limits.ReadersMax, encryptor.DefaultReaders(), 1, limits.ExecutorsMax, encryptor.DefaultExecutors()),
+		fmt.Sprintf("Chunk size: %d to %d MB, %d MB by default. Larger chunks mean less overhead, smaller chunks mean less memory and smoother progress", limits.ChunkSizeMinMB, limits.ChunkSizeMaxMB, encryptor.DefaultChunkSizeMB),
+		fmt.Sprintf("Slow sources (network filesystems, cloud mounts) do better with --prefetch, up to %d reads in flight, adapting to read latency. --pool replaces the read and execute workers with up to %d workers that take whichever task is ready", limits.PrefetchDepthMax, limits.PoolWorkersMax),
+		"--scale-executors makes --executors a cap, starting half of them and adding or parking one at a time as reads wait on executors or executors wait on reads or the writer. --mem-stats lists each decision and what it was made on",
+		"Without --max-memory, readers run ahead of the writer and memory grows with the file's read speed. With it, chunk size and workers are fitted to the bound, and --mem-stats reports the peak heap and GC pauses",
+		helpMemoryLimit(encryptor.GetMemoryLimit()),
+		fmt.Sprintf("The writer hands each chunk to the kernel with one vectored write (writev) where the platform has them, or buffers %d KB at a time where it does not. --write-buffer chooses a buffer of up to %d KB instead. Writes are flushed when the buffer fills, not after every chunk, and --fsync=end syncs the finished file to disk", encryptor.DefaultWriteBufferKB, limits.WriteBufferMaxKB),
+	}
+}
+
+// Containers and GOMEMLIMIT stand in for --max-memory when it is not given
+func helpMemoryLimit(limit encryptor.MemoryLimit) string {
+	if limit.Bytes == 0 {
+		return "No container memory limit or GOMEMLIMIT below this machine's memory was found, so jobs without --max-memory are unbounded"
+	}
+
+	return fmt.Sprintf("Memory is limited to %d MiB here (%s), so jobs without --max-memory are bounded to 75%% of it and the default workers are capped to what it can hold", limit.Bytes/1024/1024, limit.Source)
+}
+
+func findHelpTopic(name string) (helpTopic, bool) {
+	for _, topic := range helpTopics {
+		if strings.EqualFold(topic.Name, name) {
+			return topic, true
+		}
+	}
+
+	return helpTopic{}, false
+}
+
+func helpTopicNames() []string {
+	var names []string
+	for _, topic := range helpTopics {
+		names = append(names, topic.Name)
+	}
+
+	return names
+}
+
+// encryptor help lists the topics, encryptor help <topic> shows one
+func showHelpTopic(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(w, "Help topics, shown with encryptor help <topic>:")
+		fmt.Fprintln(w, "")
+
+		for _, topic := range helpTopics {
+			fmt.Fprintf(w, "\t%-12s %s\n", topic.Name, topic.Summary)
+		}
+
+		fmt.Fprintln(w, "\nEvery flag is listed by encryptor --help")
+		return nil
+	}
+
+	if len(args) > 1 {
+		return fmt.Errorf("only one help topic can be shown at a time, choose from %s", strings.Join(helpTopicNames(), ", "))
+	}
+
+	topic, ok := findHelpTopic(args[0])
+	if !ok {
+		return fmt.Errorf("there is no help topic %q, choose from %s", args[0], strings.Join(helpTopicNames(), ", "))
+	}
+
+	fmt.Fprintf(w, "encryptor help %s - %s\n", topic.Name, topic.Summary)
+
+	for _, paragraph := range topic.Body() {
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, paragraph)
+	}
+
+	fmt.Fprintln(w, "\nExamples:")
+
+	for _, example := range topic.Examples {
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "\t# "+example.Description)
+		fmt.Fprintln(w, "\t"+example.Command)
+	}
+
+	return nil
+}
+
+// Help topics take a topic rather than filenames, so they are handled before the flags are parsed
+func handleHelpCommand(args []string) {
+	if len(args) < 2 || args[1] != "help" {
+		return
+	}
+
+	err := showHelpTopic(os.Stdout, args[2:])
+	if err != nil {
+		gLoggerStderr.Println(err.Error())
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
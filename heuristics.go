@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Before encrypting, a quick look at the source for signs it is already
+	encrypted - an encryptor header, a .enc name, another tool's signature,
+	or bytes as random as ciphertext. Encrypting twice costs a full pass
+	and usually means the wrong file was picked (the .enc instead of the
+	original, or -d forgotten), so it is worth a warning, never an error
+
+	Only a few samples are read, and compressed files are as random as
+	ciphertext, so the formats people routinely encrypt (archives, images,
+	video) are recognized by their signature and pass quietly. Warnings go
+	to stderr and --no-heuristics silences them
+*/
+
+const heuristicSampleBytes = 64 * 1024
+const heuristicSamples = 3
+const heuristicMinimumBytes = 16 * 1024 // Smaller samples of random bytes fall short of 8 bits per byte
+
+// Shannon entropy of the samples, ciphertext is within a hair of 8
+const heuristicEntropyBitsPerByte = 7.95
+
+type fileSignature struct {
+	Name   string
+	Offset int
+	Magic  []byte
+}
+
+// Random looking but expected, compression and media formats
+var compressedSignatures = []fileSignature{
+	{"gzip", 0, []byte{0x1f, 0x8b}},
+	{"bzip2", 0, []byte("BZh")},
+	{"xz", 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", 0, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"zip", 0, []byte("PK\x03\x04")},
+	{"7z", 0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}},
+	{"rar", 0, []byte("Rar!\x1a\x07")},
+	{"jpeg", 0, []byte{0xff, 0xd8, 0xff}},
+	{"png", 0, []byte("\x89PNG")},
+	{"mp4", 4, []byte("ftyp")},
+	{"webm/mkv", 0, []byte{0x1a, 0x45, 0xdf, 0xa3}},
+}
+
+// Output of other encryption tools
+var encryptedSignatures = []fileSignature{
+	{"age", 0, []byte("age-encryption.org/")},
+	{"OpenSSL", 0, []byte("Salted__")},
+	{"OpenPGP (ASCII armored)", 0, []byte("-----BEGIN PGP MESSAGE-----")},
+}
+
+func (signature fileSignature) matches(data []byte) bool {
+	return len(data) >= signature.Offset+len(signature.Magic) && bytes.Equal(data[signature.Offset:signature.Offset+len(signature.Magic)], signature.Magic)
+}
+
+// Warnings about encrypting fileName, none when it looks like plaintext
+func sourceWarnings(fileName string) []string {
+	name := filepath.Base(fileName)
+
+	header, err := encryptor.ReadHeader(fileName)
+	if err == nil {
+		return []string{fmt.Sprintf("%s is already encrypted by encryptor (format %s), use -d to decrypt it", name, header.FormatVersion)}
+	}
+
+	var warnings []string
+
+	if strings.EqualFold(filepath.Ext(fileName), ".enc") {
+		warnings = append(warnings, fmt.Sprintf("%s is named like an encrypted file, check that it is the file you meant to encrypt", name))
+	}
+
+	samples, err := readSamples(fileName)
+	if err != nil || len(samples) < heuristicMinimumBytes {
+		return warnings
+	}
+
+	for _, signature := range encryptedSignatures {
+		if signature.matches(samples) {
+			return append(warnings, fmt.Sprintf("%s looks already encrypted with %s, encrypting it again is rarely what was meant", name, signature.Name))
+		}
+	}
+
+	for _, signature := range compressedSignatures {
+		if signature.matches(samples) {
+			return warnings
+		}
+	}
+
+	if entropy := shannonEntropy(samples); entropy >= heuristicEntropyBitsPerByte {
+		warnings = append(warnings, fmt.Sprintf("%s looks already encrypted (%.2f bits of entropy per byte, in no compressed format we recognize), encrypting it again is rarely what was meant", name, entropy))
+	}
+
+	return warnings
+}
+
+// The start, middle, and end of the file, the start first so signatures can be matched
+func readSamples(fileName string) ([]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil || !stats.Mode().IsRegular() {
+		return nil, err
+	}
+
+	size := stats.Size()
+	if size <= heuristicSampleBytes*heuristicSamples {
+		samples := make([]byte, size)
+		read, err := file.ReadAt(samples, 0)
+		return samples[:read], ignoreEOF(err)
+	}
+
+	var samples []byte
+	for i := int64(0); i < heuristicSamples; i++ {
+		sample := make([]byte, heuristicSampleBytes)
+		offset := (size - heuristicSampleBytes) * i / (heuristicSamples - 1)
+
+		read, err := file.ReadAt(sample, offset)
+		if ignoreEOF(err) != nil {
+			return nil, err
+		}
+
+		samples = append(samples, sample[:read]...)
+	}
+
+	return samples, nil
+}
+
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+func shannonEntropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(data))
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return entropy
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"io"
+	"os"
+)
+
+/*
+	The most common failures are rarely bugs - a target left over from the
+	last run, a file encrypted with a key being decrypted with a password,
+	the original being decrypted instead of the .enc - so after an error a
+	hint says what to try next. Hints are chosen by the typed error the
+	package returns, never by matching error text, and a hint may apply
+	only to some command lines (whether a password or a key was given)
+*/
+
+type errorHint struct {
+	Err  error                                // Matched with errors.Is
+	When func(options *EncryptorOptions) bool // nil always applies
+	Hint string
+}
+
+var errorHints = []errorHint{
+	{
+		Err:  encryptor.ErrTargetExists,
+		Hint: "use --force to overwrite the target, or choose another target filename",
+	},
+	{
+		Err:  encryptor.ErrAuthenticationFailed,
+		When: func(options *EncryptorOptions) bool { return options.Password != "" && !options.OpenPGP },
+		Hint: "if the file was encrypted with a key, check that you used --keyhex not --password",
+	},
+	{
+		Err:  encryptor.ErrAuthenticationFailed,
+		When: func(options *EncryptorOptions) bool { return options.KeyHex != "" },
+		Hint: "if the file was encrypted with a password, check that you used --password not --keyhex",
+	},
+	{
+		Err:  encryptor.ErrAuthenticationFailed,
+		When: func(options *EncryptorOptions) bool { return options.Password == "" && options.KeyHex == "" },
+		Hint: "check the password, or pass the key the file was encrypted with using --keyhex",
+	},
+	{
+		Err:  encryptor.ErrAuthenticationFailed,
+		When: func(options *EncryptorOptions) bool { return options.OpenPGP },
+		Hint: "check the password, it must be the one the message was encrypted with (gpg --symmetric asks for it twice)",
+	},
+	{
+		Err:  encryptor.ErrFileCorrupt,
+		Hint: "the key is right but the file is damaged, restore it from a backup (scrub finds damaged files before they are needed)",
+	},
+	{
+		Err:  encryptor.ErrNothingRecovered,
+		Hint: "check the key, and that --chunksize, --cipher, and --chunk-crc are what the file was encrypted with - files encrypted with a password (format 1.4 on) or to recipients need their header",
+	},
+	{
+		Err:  encryptor.ErrCrashed,
+		Hint: "the target may be incomplete, delete it before running the job again",
+	},
+	{
+		Err:  encryptor.ErrNotInKeyring,
+		Hint: "store the password first with encryptor store-password --keyring=<profile>, profiles are per user",
+	},
+	{
+		Err:  encryptor.ErrOffline,
+		Hint: "copy what is needed (e.g. a recipients file) onto this machine and give the local file instead, or drop --offline",
+	},
+	{
+		Err:  encryptor.ErrEntropyUnavailable,
+		When: func(options *EncryptorOptions) bool { return options.WaitForEntropy > 0 },
+		Hint: "check that the machine (or VM) has a source of entropy, e.g. a virtio-rng device or rng-tools, or raise --wait-for-entropy",
+	},
+	{
+		Err:  encryptor.ErrEntropyUnavailable,
+		When: func(options *EncryptorOptions) bool { return options.WaitForEntropy == 0 },
+		Hint: "run the job again once the system has settled, check dmesg for errors from its random number generator",
+	},
+	{
+		Err:  encryptor.ErrOutputTooLarge,
+		Hint: "check the source is the one you meant, then raise --max-output-size if it is",
+	},
+	{
+		Err:  encryptor.ErrInsufficientSpace,
+		Hint: "free up space on the target's filesystem (df -h shows how much there is), or decrypt to another one",
+	},
+	{
+		Err:  encryptor.ErrNotSigned,
+		Hint: "ask the sender to encrypt with --sign, or leave off --signer to decrypt a file whose sender you cannot check",
+	},
+	{
+		Err:  encryptor.ErrSignatureInvalid,
+		Hint: "do not trust the file - check that --signer is the sender's public key, and get the file from them again",
+	},
+	{
+		Err:  os.ErrPermission,
+		Hint: "check that you can read the source and write to the target's directory (ls -l shows both)",
+	},
+	{
+		Err: encryptor.ErrNotEncryptedFile,
+		When: func(options *EncryptorOptions) bool {
+			return options.Operation == encryptor.Decryption && !options.OpenPGP && encryptor.IsOpenPGPMessage(options.SourceFilename)
+		},
+		Hint: "the source is an OpenPGP message (e.g. from gpg --symmetric), decrypt it with --openpgp",
+	},
+	{
+		Err: encryptor.ErrNotEncryptedFile,
+		When: func(options *EncryptorOptions) bool {
+			return options.Operation == encryptor.Decryption && options.JWE == "" && encryptor.IsJWE(options.SourceFilename)
+		},
+		Hint: "the source is a JWE, decrypt it with --jwe",
+	},
+	{
+		Err:  encryptor.ErrNotEncryptedFile,
+		When: func(options *EncryptorOptions) bool { return options.Operation == encryptor.Decryption },
+		Hint: "the source was not written by encryptor - check that it is the encrypted file and not the original, or leave off -d to encrypt it",
+	},
+	{
+		Err:  encryptor.ErrNotEncryptedFile,
+		When: func(options *EncryptorOptions) bool { return options.Operation != encryptor.Decryption },
+		Hint: "the source was not written by encryptor, only files it encrypted can be read",
+	},
+}
+
+func errorHintsFor(err error, options *EncryptorOptions) []string {
+	var hints []string
+
+	for _, hint := range errorHints {
+		if errors.Is(err, hint.Err) && (hint.When == nil || hint.When(options)) {
+			hints = append(hints, hint.Hint)
+		}
+	}
+
+	return hints
+}
+
+// Hints follow the error on stderr, without the file and line the error is logged with
+func printErrorHints(w io.Writer, err error, options *EncryptorOptions) {
+	for _, hint := range errorHintsFor(err, options) {
+		_, _ = io.WriteString(w, "Hint: "+hint+"\n")
+	}
+}
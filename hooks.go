@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+	--pre-cmd and --post-cmd run a command before and after a file job,
+	so an upload, a notification, or a database update can follow each
+	file without a wrapper script. The command is split into arguments
+	as a shell splits them (quotes, and backslashes before a space, a
+	quote, or a backslash) but is run directly, not by a shell, so a
+	filename with spaces or quotes in it is passed on as one argument
+	and never run. These are replaced in every argument
+
+		{source}  the source filename
+		{target}  the target filename, empty when verifying
+		{hash}    the target's SHA256, after a job that wrote a file
+		{status}  started before the job, ok or failed after it
+
+	A hook's stdout and stderr go to the job log, stderr, a line at a
+	time after the hook's flag - stdout is the job's contract output. A
+	--pre-cmd that fails stops the job before it starts, a --post-cmd
+	that fails fails the run, and either is killed once it has run for
+	--hook-timeout
+*/
+
+const defaultHookTimeout = 10 * time.Minute
+
+const (
+	hookStatusStarted = "started"
+	hookStatusOK      = "ok"
+	hookStatusFailed  = "failed"
+)
+
+// Nil for no command, or one that splits into arguments
+func checkHookCommand(flag string, command string) error {
+	if command == "" {
+		return nil
+	}
+
+	_, err := splitHookCommand(command)
+	if err != nil {
+		return fmt.Errorf("--%s %q: %w", flag, command, err)
+	}
+
+	return nil
+}
+
+func splitHookCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	quote := rune(0)
+	runes := []rune(command)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\\' && quote != '\'' && i+1 < len(runes) && strings.ContainsRune("\\\"' ", runes[i+1]):
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("a quote is not closed")
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	if len(args) == 0 {
+		return nil, errors.New("there is no command to run")
+	}
+
+	return args, nil
+}
+
+func runPreCommand(options *EncryptorOptions) error {
+	return runHook("pre-cmd", options.PreCommand, hookValues(options, hookStatusStarted, ""), options.HookTimeout)
+}
+
+// Told by jobErr whether the job succeeded
+func runPostCommand(options *EncryptorOptions, jobErr error) error {
+	if options.PostCommand == "" {
+		return nil
+	}
+
+	status, hash := hookStatusFailed, ""
+
+	if jobErr == nil {
+		status = hookStatusOK
+
+		// Only when asked for, it reads the whole target again
+		if strings.Contains(options.PostCommand, "{hash}") && writesTargetFile(options) {
+			var err error
+			if hash, err = encryptor.Hash(options.TargetFilename); err != nil {
+				return fmt.Errorf("could not hash the target for --post-cmd: %w", err)
+			}
+		}
+	}
+
+	return runHook("post-cmd", options.PostCommand, hookValues(options, status, hash), options.HookTimeout)
+}
+
+// Stdout, cloud storage, and the temporary files of previews have no file left to hash
+func writesTargetFile(options *EncryptorOptions) bool {
+	if options.TargetFilename == "" || options.TargetFilename == StdioFilename || isObjectURL(options.TargetFilename) {
+		return false
+	}
+
+	stats, err := os.Stat(options.TargetFilename)
+	return err == nil && stats.Mode().IsRegular()
+}
+
+func hookValues(options *EncryptorOptions, status string, hash string) *strings.Replacer {
+	return strings.NewReplacer("{source}", options.SourceFilename, "{target}", options.TargetFilename, "{hash}", hash, "{status}", status)
+}
+
+// A timeout of 0 lets the hook run for as long as it takes
+func runHook(flag string, command string, values *strings.Replacer, timeout time.Duration) error {
+	if command == "" {
+		return nil
+	}
+
+	args, err := splitHookCommand(command)
+	if err != nil {
+		return fmt.Errorf("--%s %q: %w", flag, command, err)
+	}
+
+	for i := range args {
+		args[i] = values.Replace(args[i])
+	}
+
+	ctx, cancel := context.Background(), func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	defer cancel()
+
+	// One writer for both, so their lines are logged in the order they were written
+	output := &hookLog{prefix: flag + ": "}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Run()
+	output.flush()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("--%s was killed after running for %s", flag, timeout)
+	}
+
+	if err != nil {
+		return fmt.Errorf("--%s %s failed: %w", flag, args[0], err)
+	}
+
+	return nil
+}
+
+// Logs a hook's output a line at a time, holding back a line until it is complete
+type hookLog struct {
+	prefix  string
+	pending []byte
+}
+
+func (hook *hookLog) Write(data []byte) (int, error) {
+	hook.pending = append(hook.pending, data...)
+
+	for {
+		end := bytes.IndexByte(hook.pending, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+
+		gLoggerInfo.Println(hook.prefix + strings.TrimRight(string(hook.pending[:end]), "\r"))
+		hook.pending = hook.pending[end+1:]
+	}
+}
+
+func (hook *hookLog) flush() {
+	if len(hook.pending) > 0 {
+		gLoggerInfo.Println(hook.prefix + string(hook.pending))
+		hook.pending = nil
+	}
+}
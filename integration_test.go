@@ -1,222 +1,1111 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
-type FilesTest struct {
-	TestName      string
-	FileName      string
-	ChunkSizeMB   uint
-	Readers       uint8
-	Executors     uint8
-	Writers       uint8
-	KeyHex        string
-	Password      string
-	Data          string
-	expectSuccess bool
-}
-
-//[5]int{10, 20, 30, 40, 50}
-var hashFiles = []FilesTest{
-	{"Known hash", "hashtarget.txt", 8, 6, 12, 1, "", "some_password_here", "c55395f0f5b1d610b01b145d6d39c68c8aee22160c63afdecd4e3c1cadc36674", true},
-	{"Different hashes/blank hash", "hashtarget.txt", 8, 6, 12, 1, "", "some_password_here", "", false},
-}
-
-var e2eFiles = []FilesTest{
-	// Default concurrency
-	{"Tiny File", "tiny.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
-	{"Small File", "small.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
-	{"Medium File", "medium.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
-	{"Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
-	{"Zero Byte File", "zero.txt", 8, 6, 12, 1, "", "some_password_here", "", false},
-	// Default concurrency using key instead of password - TBD: Pass invalid keys
-	{"Tiny File", "tiny.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
-	{"Small File", "small.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
-	{"Medium File", "medium.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
-	{"Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
-	{"Zero Byte File", "zero.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", false},
-	// Restricted concurrency
-	{"Restricted Concurrency - Tiny File", "tiny.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Small File", "small.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Medium File", "medium.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Zero Byte File", "zero.txt", 8, 1, 1, 1, "", "some_password_here", "", false},
-	// Expanded concurrency
-	{"Expanded Concurrency - Tiny File", "tiny.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Small File", "small.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Medium File", "medium.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Zero Byte File", "zero.txt", 8, 32, 64, 4, "", "some_password_here", "", false},
-	// All concurrencies with small chunk sizes
-	{"Tiny File - Small Chunk", "tiny.txt", 1, 6, 12, 1, "", "some_password_here", "", true},
-	{"Small File - Small Chunk", "small.txt", 1, 6, 12, 1, "", "some_password_here", "", true},
-	{"Medium File - Small Chunk", "medium.txt", 1, 6, 12, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Tiny File - Small Chunk", "tiny.txt", 1, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Small File - Small Chunk", "small.txt", 1, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Medium File - Small Chunk", "medium.txt", 1, 1, 1, 1, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Tiny File - Small Chunk", "tiny.txt", 1, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Small File - Small Chunk", "small.txt", 1, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Medium File - Small Chunk", "medium.txt", 1, 32, 64, 4, "", "some_password_here", "", true},
-	// All concurrencies with large chunk sizes
-	{"Tiny File - Large Chunk", "tiny.txt", 32, 6, 12, 1, "", "some_password_here", "", true},
-	{"Small File - Large Chunk", "small.txt", 32, 6, 12, 1, "", "some_password_here", "", true},
-	{"Medium File - Large Chunk", "medium.txt", 32, 6, 12, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Tiny File - Large Chunk", "tiny.txt", 32, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Small File - Large Chunk", "small.txt", 32, 1, 1, 1, "", "some_password_here", "", true},
-	{"Restricted Concurrency - Medium File - Large Chunk", "medium.txt", 32, 1, 1, 1, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Tiny File - Large Chunk", "tiny.txt", 32, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Small File - Large Chunk", "small.txt", 32, 32, 64, 4, "", "some_password_here", "", true},
-	{"Expanded Concurrency - Medium File - Large Chunk", "medium.txt", 32, 32, 64, 4, "", "some_password_here", "", true},
-}
-
-// Pipeline Integration tests
-func Test_EndToEnd_Files(t *testing.T) {
-	filesDir := getTestFilesDirectory()
-	encrypted := filesDir + string(os.PathSeparator) + "temp.enc"
-	decrypted := filesDir + string(os.PathSeparator) + "temp.dec"
-
-	// Cleanup at end of test, use force option during test to overwrite
-	defer func(name string) {
-		_ = os.Remove(name)
-	}(encrypted)
-	defer func(name string) {
-		_ = os.Remove(name)
-	}(decrypted)
-
-	// Let's test a series of files that differ in size and their chunk boundary qualities
-	for _, testTable := range e2eFiles {
-
-		t.Run(testTable.TestName, func(t *testing.T) {
-
-			// We will encrypt, decrypt, and hash the source and the decrypted
-			original := filesDir + string(os.PathSeparator) + testTable.FileName
-
-			// Encrypt the file
-			encryptOptions := EncryptorOptions{
-				SourceFilename: original,
-				TargetFilename: encrypted,
-				Operation:      Encryption,
-				KeyHex:         testTable.KeyHex,
-				ChunkSizeMB:    testTable.ChunkSizeMB,
-				Readers:        testTable.Readers,
-				Executors:      testTable.Executors,
-				Writers:        testTable.Writers,
-				Password:       testTable.Password,
-				ForceOperation: true,
-			}
+// The key tests encrypt with, when which key does not matter
+const testKeyHex = "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6"
 
-			job, err := pipelineJobFromOpts(&encryptOptions)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
-			}
+func Test_RcloneRemotes(t *testing.T) {
+	configFilename := filepath.Join(t.TempDir(), "rclone.conf")
+	config := "[disk]\ntype = local\n\n[backups]\ntype = alias\nremote = disk:/srv/backups\n\n[nested]\ntype = alias\nremote = backups:\n\n[bucket]\ntype = s3\nprovider = AWS\n"
 
-			err = runPipelineJob(&job)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
-			}
+	err := os.WriteFile(configFilename, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			// Decrypt the encrypted file - Note that chunksize will be ignored by pipeline
-			decryptOptions := EncryptorOptions{
-				SourceFilename: encrypted,
-				TargetFilename: decrypted,
-				Operation:      Decryption,
-				KeyHex:         testTable.KeyHex,
-				ChunkSizeMB:    testTable.ChunkSizeMB,
-				Readers:        testTable.Readers,
-				Executors:      testTable.Executors,
-				Writers:        testTable.Writers,
-				Password:       testTable.Password,
-				ForceOperation: true,
-			}
+	remotes, err := loadRcloneConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			job, err = pipelineJobFromOpts(&decryptOptions)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
-			}
+	resolutions := map[string]string{
+		"disk:/tmp/file.enc":  "/tmp/file.enc",
+		"backups:file.enc":    "/srv/backups/file.enc",
+		"nested:day/file.enc": "/srv/backups/day/file.enc",
+		"unknown:file.enc":    "unknown:file.enc",
+		"C:\\data\\file.enc":  "C:\\data\\file.enc",
+		"plain.enc":           "plain.enc",
+	}
 
-			err = runPipelineJob(&job)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
-			}
+	for path, expected := range resolutions {
+		resolved, env, err := resolveRemotePath(path, remotes)
+		if err != nil || resolved != expected || len(env) != 0 {
+			t.Error("resolving ", path, " expected ", expected, " got ", resolved, " ", env, " ", err)
+		}
+	}
 
-			// Hash the original and the decrypted
-			hashOriginal, err := hashFile(original)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
-			}
+	_, _, err = resolveRemotePath("bucket:file.enc", remotes)
+	if err == nil {
+		t.Error("expected an error for an unsupported remote type")
+	}
+
+	// rclone's own configuration may be one we cannot read, that is not ours to fail on
+	encryptedFilename := filepath.Join(t.TempDir(), "rclone.conf")
+	err = os.WriteFile(encryptedFilename, []byte("# Encrypted rclone configuration File\n\nRCLONE_ENCRYPT_V0:\nc2VjcmV0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("RCLONE_CONFIG", encryptedFilename)
+
+	implicit := EncryptorOptions{SourceFilename: "backups:file.enc", TargetFilename: "plain.txt"}
+	if err := resolveRemoteFilenames(&implicit); err != nil || implicit.SourceFilename != "backups:file.enc" {
+		t.Error("expected an unreadable implicit configuration to leave filenames as they are, got ", implicit.SourceFilename, " ", err)
+	}
+
+	explicit := EncryptorOptions{SourceFilename: "backups:file.enc", TargetFilename: "plain.txt", RcloneConfigFilename: encryptedFilename}
+	if err := resolveRemoteFilenames(&explicit); err == nil {
+		t.Error("expected an unreadable --rclone-config to fail")
+	}
+
+	// Without a filename that could name a remote the configuration is never read
+	plain := EncryptorOptions{SourceFilename: "plain.txt", TargetFilename: "C:\\data\\file.enc", RcloneConfigFilename: encryptedFilename}
+	if err := resolveRemoteFilenames(&plain); err != nil {
+		t.Error("expected no configuration to be read for plain filenames, got ", err)
+	}
+
+	explicit = EncryptorOptions{SourceFilename: "backups:file.enc", RcloneConfigFilename: configFilename}
+	if err := resolveRemoteFilenames(&explicit); err != nil || explicit.SourceFilename != "/srv/backups/file.enc" {
+		t.Error("expected backups:file.enc to resolve, got ", explicit.SourceFilename, " ", err)
+	}
+}
+
+func Test_RcloneObjectStoreRemotes(t *testing.T) {
+	configFilename := filepath.Join(t.TempDir(), "rclone.conf")
+	config := `
+[gcs]
+type = google cloud storage
+service_account_file = /etc/rclone/sa.json
+bucket_policy_only = true
+
+[gcs-bucket]
+type = google cloud storage
+bucket = acme-backups
+
+[gcs-adc]
+type = google cloud storage
+env_auth = true
+
+[nightly]
+type = alias
+remote = gcs:acme-backups/nightly
+
+[gcs-inline]
+type = google cloud storage
+service_account_credentials = {"type": "service_account"}
+
+[azure-key]
+type = azureblob
+account = acmebackups
+key = c2VjcmV0IGtleQ==
+
+[azure-sas]
+type = azureblob
+sas_url = https://acmesas.blob.core.windows.net/nightly?sv=2021-08-06&sr=c&sp=racwl&sig=c2ln
+
+[azure-sp]
+type = azureblob
+account = acmebackups
+tenant = tenant-id
+client_id = client-id
+client_secret = client-secret
+
+[azure-none]
+type = azureblob
+
+[azure-emulator]
+type = azureblob
+account = devstoreaccount1
+use_emulator = true
+
+[azure-bad-key]
+type = azureblob
+account = acmebackups
+key = not base64!
+`
+
+	if err := os.WriteFile(configFilename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	remotes, err := loadRcloneConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolutions := []struct {
+		path     string
+		expected string
+		env      map[string]string
+	}{
+		{"gcs:acme-backups/day/file.enc", "gs://acme-backups/day/file.enc", map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": "/etc/rclone/sa.json"}},
+		{"gcs-bucket:day/file.enc", "gs://acme-backups/day/file.enc", map[string]string{}},
+		{"gcs-adc:acme-backups/file.enc", "gs://acme-backups/file.enc", map[string]string{}},
+		{"nightly:file.enc", "gs://acme-backups/nightly/file.enc", map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": "/etc/rclone/sa.json"}},
+		{"azure-sas:nightly/file.enc", "az://acmesas/nightly/file.enc", map[string]string{"AZURE_STORAGE_SAS_TOKEN": "sv=2021-08-06&sr=c&sp=racwl&sig=c2ln"}},
+		{"azure-sp:nightly/day/file.enc", "az://acmebackups/nightly/day/file.enc", map[string]string{"AZURE_TENANT_ID": "tenant-id", "AZURE_CLIENT_ID": "client-id", "AZURE_CLIENT_SECRET": "client-secret"}},
+	}
+
+	for _, resolution := range resolutions {
+		resolved, env, err := resolveRemotePath(resolution.path, remotes)
+		if err != nil || resolved != resolution.expected || !reflect.DeepEqual(env, resolution.env) {
+			t.Error("resolving ", resolution.path, " expected ", resolution.expected, " ", resolution.env, " got ", resolved, " ", env, " ", err)
+		}
+	}
+
+	// The account key signs a SAS token, it is never handed on itself
+	resolved, env, err := resolveRemotePath("azure-key:nightly/file.enc", remotes)
+	if err != nil || resolved != "az://acmebackups/nightly/file.enc" {
+		t.Fatal("expected the keyed remote to resolve, got ", resolved, " ", err)
+	}
+
+	sas, err := url.ParseQuery(env["AZURE_STORAGE_SAS_TOKEN"])
+	if err != nil || sas.Get("sig") == "" || sas.Get("ss") != "b" || sas.Get("spr") != "https" || strings.Contains(env["AZURE_STORAGE_SAS_TOKEN"], "c2VjcmV0IGtleQ") {
+		t.Error("expected an account SAS signed with the key, got ", env, " ", err)
+	}
+
+	for _, path := range []string{"gcs:acme-backups", "gcs-inline:acme-backups/file.enc", "azure-key:nightly", "azure-none:nightly/file.enc", "azure-emulator:nightly/file.enc", "azure-bad-key:nightly/file.enc"} {
+		if resolved, _, err := resolveRemotePath(path, remotes); err == nil {
+			t.Error("expected ", path, " to be refused, got ", resolved)
+		}
+	}
+
+	// One environment holds both remotes' credentials, they must agree
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "")
+
+	options := EncryptorOptions{SourceFilename: "nightly:file.enc", TargetFilename: "azure-sas:nightly/file.enc", RcloneConfigFilename: configFilename}
+	if err := resolveRemoteFilenames(&options); err != nil || os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "/etc/rclone/sa.json" || os.Getenv("AZURE_STORAGE_SAS_TOKEN") == "" {
+		t.Error("expected both remotes' credentials in the environment: ", err)
+	}
+
+	options = EncryptorOptions{SourceFilename: "azure-sas:nightly/a.enc", TargetFilename: "azure-key:nightly/b.enc", RcloneConfigFilename: configFilename}
+	if err := resolveRemoteFilenames(&options); err == nil {
+		t.Error("expected remotes needing different credentials to be refused")
+	}
+}
+
+func Test_HelpTopics(t *testing.T) {
+	var listing bytes.Buffer
+
+	err := showHelpTopic(&listing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			hashDecrypted, err := hashFile(decrypted)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
+	for _, topic := range helpTopics {
+		if !strings.Contains(listing.String(), topic.Name) {
+			t.Error("topic ", topic.Name, " is missing from the listing")
+		}
+
+		if topic.Summary == "" || len(topic.Examples) == 0 {
+			t.Error("topic ", topic.Name, " needs a summary and examples")
+		}
+
+		// Topic names are matched without regard to case
+		var page bytes.Buffer
+
+		err = showHelpTopic(&page, []string{strings.ToUpper(topic.Name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, example := range topic.Examples {
+			if !strings.HasPrefix(example.Command, "encryptor ") || !strings.Contains(page.String(), example.Command) {
+				t.Error("example ", example.Command, " in topic ", topic.Name, " is not shown or does not run encryptor")
 			}
+		}
+	}
+
+	// Pages follow the build, every cipher it supports is on the formats page
+	var formats bytes.Buffer
+
+	err = showHelpTopic(&formats, []string{"formats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cipher := range encryptor.GetCapabilities().Ciphers {
+		if !strings.Contains(formats.String(), cipher.Name) {
+			t.Error("cipher ", cipher.Name, " is missing from the formats topic")
+		}
+	}
+
+	if err = showHelpTopic(&formats, []string{"nonexistent"}); err == nil {
+		t.Error("expected an error for an unknown topic")
+	}
+}
+
+func Test_ErrorHints(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join("test_files", "small.txt")
+	encrypted := filepath.Join(tempDir, "small.txt.enc")
+	decrypted := filepath.Join(tempDir, "small.txt")
 
-			if hashOriginal != hashDecrypted {
-				if testTable.expectSuccess {
-					t.Error("Hashes of the original and the decrypted file do not match")
-				}
-				return
+	options := EncryptorOptions{}
+	options.KeyHex = testKeyHex
+	options.ChunkSizeMB = 1
+
+	hasHint := func(err error, options *EncryptorOptions, contains string) bool {
+		for _, hint := range errorHintsFor(err, options) {
+			if strings.Contains(hint, contains) {
+				return true
 			}
-		})
+		}
+
+		return false
+	}
+
+	err := encryptor.Encrypt(original, encrypted, &options.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encryptor.Encrypt(original, encrypted, &options.Options)
+	if !errors.Is(err, encryptor.ErrTargetExists) || !hasHint(err, &options, "--force") {
+		t.Error("an existing target did not hint at --force: ", err)
+	}
+
+	// A key-encrypted file decrypted with a password points at the key flag
+	passwordOptions := EncryptorOptions{}
+	passwordOptions.Password = "not the key"
+	passwordOptions.Operation = encryptor.Decryption
+
+	err = encryptor.Decrypt(encrypted, decrypted, &passwordOptions.Options)
+	if !errors.Is(err, encryptor.ErrAuthenticationFailed) || !hasHint(err, &passwordOptions, "--keyhex not --password") {
+		t.Error("a failed decryption with a password did not hint at --keyhex: ", err)
+	}
+
+	if hasHint(err, &options, "--keyhex not --password") {
+		t.Error("a hint about --password was given without one")
+	}
+
+	options.Operation = encryptor.Decryption
+
+	err = encryptor.Decrypt(original, decrypted, &options.Options)
+	if !errors.Is(err, encryptor.ErrNotEncryptedFile) || !hasHint(err, &options, "leave off -d") {
+		t.Error("decrypting a plaintext file did not hint at the encrypted file: ", err)
+	}
+
+	if hints := errorHintsFor(fmt.Errorf("could not open file for writing: %w", os.ErrPermission), &options); len(hints) != 1 {
+		t.Error("expected one hint for a permission error: ", hints)
+	}
+
+	if hints := errorHintsFor(errors.New("something unexpected"), &options); len(hints) != 0 {
+		t.Error("expected no hints for an untyped error: ", hints)
 	}
 }
 
-// Non-pipeline Feature tests
-func Test_Hashing(t *testing.T) {
-	filesDir := getTestFilesDirectory()
+func Test_SourceHeuristics(t *testing.T) {
+	tempDir := t.TempDir()
+	plaintext := filepath.Join("test_files", "small.txt")
 
-	for _, testTable := range hashFiles {
+	random := make([]byte, 256*1024)
+	_, _ = rand.Read(random)
 
-		t.Run(testTable.TestName, func(t *testing.T) {
+	write := func(name string, data []byte) string {
+		fileName := filepath.Join(tempDir, name)
+		if err := os.WriteFile(fileName, data, 0600); err != nil {
+			t.Fatal(err)
+		}
 
-			// Hash the file and compare to the expected test result
-			fileName := filesDir + string(os.PathSeparator) + testTable.FileName
-			expectedHash := testTable.Data
+		return fileName
+	}
 
-			fileHash, err := hashFile(fileName)
-			if err != nil {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-				return
+	hasWarning := func(fileName string, contains string) bool {
+		for _, warning := range sourceWarnings(fileName) {
+			if strings.Contains(warning, contains) {
+				return true
 			}
+		}
 
-			if expectedHash != fileHash {
-				if testTable.expectSuccess {
-					t.Error(err)
-				}
-			}
-		})
+		return false
+	}
+
+	if warnings := sourceWarnings(plaintext); len(warnings) != 0 {
+		t.Error("expected no warnings for plaintext: ", warnings)
+	}
+
+	encrypted := filepath.Join(tempDir, "small.txt.enc")
+
+	err := encryptor.Encrypt(plaintext, encrypted, &encryptor.Options{KeyHex: strings.Repeat("ab", 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasWarning(encrypted, "already encrypted by encryptor") {
+		t.Error("encrypting an encrypted file did not warn: ", sourceWarnings(encrypted))
+	}
+
+	if !hasWarning(write("random", random), "bits of entropy per byte") {
+		t.Error("random bytes did not warn: ", sourceWarnings(filepath.Join(tempDir, "random")))
+	}
+
+	if !hasWarning(write("random.age", append([]byte("age-encryption.org/v1\n"), random...)), "encrypted with age") {
+		t.Error("an age file did not warn")
+	}
+
+	// Compressed files are as random, and routinely encrypted
+	if warnings := sourceWarnings(write("random.gz", append([]byte{0x1f, 0x8b}, random...))); len(warnings) != 0 {
+		t.Error("expected no warnings for a compressed file: ", warnings)
+	}
+
+	if !hasWarning(write("plain.enc", []byte("only named like one")), "named like an encrypted file") {
+		t.Error("a .enc name did not warn")
+	}
+}
+
+func Test_EnvironmentKeyMaterial(t *testing.T) {
+	t.Setenv(passwordEnvironmentVariable, "some password")
+	options := EncryptorOptions{}
+
+	err := loadKeyMaterialFromEnvironment(&options)
+	if err != nil || options.Password != "some password" {
+		t.Error("the password was not read from the environment: ", err)
+	}
+
+	if os.Getenv(passwordEnvironmentVariable) != "" {
+		t.Error("the password was left in the environment for child processes")
+	}
+
+	// The command line wins
+	t.Setenv(keyHexEnvironmentVariable, testKeyHex)
+	options = EncryptorOptions{}
+	options.Password = "another password"
+
+	err = loadKeyMaterialFromEnvironment(&options)
+	if err != nil || options.Password != "another password" || options.KeyHex != "" {
+		t.Error("key material on the command line did not win over the environment: ", err)
+	}
+
+	t.Setenv(keyHexEnvironmentVariable, testKeyHex)
+	options = EncryptorOptions{}
+	options.RecipientsFiles = []string{"team.keys"}
+
+	err = loadKeyMaterialFromEnvironment(&options)
+	if err != nil || options.KeyHex != "" {
+		t.Error("recipients on the command line did not win over the environment: ", err)
+	}
+
+	t.Setenv(passwordEnvironmentVariable, "some password")
+	t.Setenv(keyHexEnvironmentVariable, testKeyHex)
+
+	err = loadKeyMaterialFromEnvironment(&EncryptorOptions{})
+	if err == nil {
+		t.Error("expected an error when both a password and a key are in the environment")
 	}
 }
 
-// TBD: Replace 'encryptor' with environment var(s)
-func getTestFilesDirectory() string {
-	workDir, _ := os.Getwd()
-	for !strings.HasSuffix(workDir, "encryptor") {
-		workDir = filepath.Dir(workDir)
+func Test_CompareVersions(t *testing.T) {
+	comparisons := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2", "1.2.1", -1},
+		{"v1.3.0", "1.2.9", 1},
+		{"1.2.0", "1.2", 0},
+		{"1.2.0-rc1", "1.2.0-rc2", -1},
+	}
+
+	for _, comparison := range comparisons {
+		if compared := compareVersions(comparison.a, comparison.b); compared != comparison.expected {
+			t.Error("comparing ", comparison.a, " with ", comparison.b, " gave ", compared, ", expected ", comparison.expected)
+		}
 	}
+}
+
+func Test_PasswordConfirmation(t *testing.T) {
+	defaultScanner := gStdinScanner
+	defer func() {
+		gStdinScanner = defaultScanner
+	}()
+
+	prompt := func(input string, confirm bool) (string, error) {
+		gStdinScanner = bufio.NewScanner(strings.NewReader(input))
+		return promptUserForPassword(confirm)
+	}
+
+	if password, err := prompt("some password\nsome password\n", true); err != nil || password != "some password" {
+		t.Error("a confirmed password was not accepted: ", password, err)
+	}
+
+	if _, err := prompt("some password\nsome pasword\n", true); err == nil {
+		t.Error("expected a mistyped confirmation to be refused")
+	}
+
+	// Blank answers are asked again, running out of input is an error rather than asking forever
+	if password, err := prompt("  \nsome password\n", false); err != nil || password != "some password" {
+		t.Error("a blank answer was not asked again: ", password, err)
+	}
+
+	if _, err := prompt("some password\n", true); err == nil {
+		t.Error("expected input ending before the confirmation to be an error")
+	}
+}
+
+func Test_StdioFilenames(t *testing.T) {
+	original := filepath.Join("test_files", "small.txt")
+	encrypted := filepath.Join(t.TempDir(), "stdin.enc")
+	decrypted := filepath.Join(t.TempDir(), "stdout.dec")
 
-	return workDir + string(os.PathSeparator) + "test_files"
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() {
+		os.Stdin, os.Stdout = stdin, stdout
+	}()
+
+	source, err := os.Open(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(source)
+
+	target, err := os.Create(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(target)
+
+	options := EncryptorOptions{
+		SourceFilename: StdioFilename,
+		TargetFilename: encrypted,
+		Operation:      encryptor.Encryption,
+		Options:        encryptor.Options{KeyHex: testKeyHex},
+	}
+
+	// Encrypt stdin to a file, then decrypt that file to stdout
+	os.Stdin = source
+	err = runStdioJob(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options.SourceFilename = encrypted
+	options.TargetFilename = StdioFilename
+	options.Operation = encryptor.Decryption
+
+	os.Stdout = target
+	err = runStdioJob(&options)
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalData, err := os.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decryptedData, err := os.ReadFile(decrypted)
+	if err != nil || !bytes.Equal(originalData, decryptedData) {
+		t.Fatal("data did not survive stdin and stdout: ", err)
+	}
+
+	// A target file cut short by the output limit is removed
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limited := filepath.Join(t.TempDir(), "limited.enc")
+
+	options.SourceFilename = StdioFilename
+	options.TargetFilename = limited
+	options.Operation = encryptor.Encryption
+	options.MaxOutputBytes = int64(len(originalData)) / 2
+
+	err = runStdioJob(&options)
+	if !errors.Is(err, encryptor.ErrOutputTooLarge) {
+		t.Error("expected a stream over the limit to fail: ", err)
+	}
+
+	if _, err := os.Stat(limited); !os.IsNotExist(err) {
+		t.Error("expected the target cut short by the limit to be removed: ", err)
+	}
+}
+
+func Test_SingleInstance(t *testing.T) {
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := EncryptorOptions{SourceFilename: "source", TargetFilename: "target.enc", Operation: encryptor.Encryption}
+	absolute := EncryptorOptions{SourceFilename: filepath.Join(workDir, "source"), TargetFilename: filepath.Join(workDir, ".", "target.enc"), Operation: encryptor.Encryption}
+
+	// However the paths were written, the same job has the same identity
+	if jobIdentity(&options) != jobIdentity(&absolute) {
+		t.Error("the same job written with absolute paths has another identity")
+	}
+
+	for _, other := range []EncryptorOptions{
+		{SourceFilename: "source", TargetFilename: "target.enc", Operation: encryptor.Decryption},
+		{SourceFilename: "source", TargetFilename: "other.enc", Operation: encryptor.Encryption},
+		{SourceFilename: "target.enc", TargetFilename: "source", Operation: encryptor.Encryption},
+	} {
+		if jobIdentity(&options) == jobIdentity(&other) {
+			t.Error("another job has the same identity: ", other)
+		}
+	}
+
+	lockFilename := filepath.Join(t.TempDir(), "locks", jobIdentity(&options)+".lock")
+
+	lock, err := acquireInstanceLock(lockFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Locks are per open file, so a second open in this process contends like another process would
+	if _, err := acquireInstanceLock(lockFilename); !errors.Is(err, errAlreadyRunning) {
+		t.Fatal("expected a held lock to report the job as running: ", err)
+	}
+
+	// Released when the holder goes away, the file left behind is no obstacle
+	_ = lock.Close()
+
+	lock, err = acquireInstanceLock(lockFilename)
+	if err != nil {
+		t.Fatal("could not take a released lock: ", err)
+	}
+
+	_ = lock.Close()
+}
+
+func Test_Hooks(t *testing.T) {
+	for command, expected := range map[string][]string{
+		`upload {target}`:                         {"upload", "{target}"},
+		`  notify --to "ops team"   {status} `:    {"notify", "--to", "ops team", "{status}"},
+		`echo 'it''s' a\ b "say \"hi\"" C:\dir\f`: {"echo", "its", "a b", `say "hi"`, `C:\dir\f`},
+		`printf '%s\n' ""`:                        {"printf", `%s\n`, ""},
+	} {
+		args, err := splitHookCommand(command)
+		if err != nil || strings.Join(args, "|") != strings.Join(expected, "|") || len(args) != len(expected) {
+			t.Errorf("%s split into %q, expected %q: %v", command, args, expected, err)
+		}
+	}
+
+	for _, command := range []string{"", "   ", `echo "unclosed`, `echo 'unclosed`} {
+		if _, err := splitHookCommand(command); err == nil {
+			t.Errorf("expected %q to be refused", command)
+		}
+	}
+
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run hooks with")
+	}
+
+	var log bytes.Buffer
+	gLoggerInfo.SetOutput(&log)
+	defer gLoggerInfo.SetOutput(os.Stderr)
+
+	target := filepath.Join(t.TempDir(), "my file.enc")
+	if err := os.WriteFile(target, []byte("encrypted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	options := EncryptorOptions{SourceFilename: "my file", TargetFilename: target, HookTimeout: defaultHookTimeout}
+
+	// Values are replaced inside arguments, each reaching the hook whole
+	options.PostCommand = shell + ` -c 'echo "$1 $2 $3"; echo done >&2' hook {status}:{hash} "{target}" {source}`
+	if err := runPostCommand(&options, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, _ := encryptor.Hash(target)
+	expected := "post-cmd: ok:" + hash + " " + target + " my file\npost-cmd: done\n"
+	if log.String() != expected {
+		t.Errorf("unexpected hook log %q, expected %q", log.String(), expected)
+	}
+
+	// A failed job is reported without hashing what it left behind
+	log.Reset()
+	if err := runPostCommand(&options, errors.New("job failed")); err != nil || !strings.HasPrefix(log.String(), "post-cmd: failed: ") {
+		t.Error("expected the hook to be told the job failed: ", log.String(), err)
+	}
+
+	// A failing hook fails, with its output in the log
+	log.Reset()
+	options.PreCommand = shell + ` -c 'printf "no space left"; exit 3'`
+	if err := runPreCommand(&options); err == nil || log.String() != "pre-cmd: no space left\n" {
+		t.Error("expected a failing hook to fail: ", log.String(), err)
+	}
+
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		return
+	}
+
+	options.PreCommand = sleep + " 10"
+	options.HookTimeout = 100 * time.Millisecond
+
+	started := time.Now()
+	if err := runPreCommand(&options); err == nil || !strings.Contains(err.Error(), "killed") || time.Since(started) > 5*time.Second {
+		t.Error("expected a hook that runs too long to be killed: ", err)
+	}
+}
+
+func Test_Transcript(t *testing.T) {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "source")
+	target := filepath.Join(tempDir, "source.enc")
+	transcriptFilename := filepath.Join(tempDir, "source.enc.json")
+
+	if err := os.WriteFile(source, bytes.Repeat([]byte("transcript "), 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var options EncryptorOptions
+	if err := initializeOptions(&options); err != nil {
+		t.Fatal(err)
+	}
+
+	options.SourceFilename = source
+	options.TargetFilename = target
+	options.Password = "correct horse battery staple"
+	options.HookTimeout = 90 * time.Second
+	options.TranscriptFilename = transcriptFilename
+
+	if err := checkTranscript(&options); err != nil {
+		t.Fatal(err)
+	}
+
+	transcript := startTranscript(&options)
+	jobErr := encryptor.Encrypt(source, target, &options.Options)
+	if err := finishTranscript(transcript, &options, jobErr); err != nil || jobErr != nil {
+		t.Fatal(err, jobErr)
+	}
+
+	data, err := os.ReadFile(transcriptFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte(options.Password)) {
+		t.Error("the transcript holds the password")
+	}
+
+	var written Transcript
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	header, _ := encryptor.ReadHeader(target)
+	if written.Operation != "encrypt" || written.Source != source || !written.Succeeded || written.HeaderWritten == nil || !bytes.Equal(written.HeaderWritten.FileID, header.FileID) {
+		t.Errorf("unexpected transcript of an encryption: %+v", written)
+	}
+
+	// Passwords can be guessed from their fingerprints
+	if written.KeyFingerprint != "" {
+		t.Error("the transcript holds the password's fingerprint")
+	}
+
+	for option, expected := range map[string]interface{}{"Password": transcriptRedacted, "KeyHex": "", "HookTimeout": "1m30s", "ChunkSizeMB": float64(options.ChunkSizeMB), "Cipher": encryptor.DefaultCipher} {
+		if written.Options[option] != expected {
+			t.Errorf("option %s was recorded as %v, expected %v", option, written.Options[option], expected)
+		}
+	}
+
+	if _, recorded := written.Options["PromptSecret"]; recorded {
+		t.Error("a callback was recorded as an option")
+	}
+
+	// An existing transcript is kept unless forced
+	if err := checkTranscript(&options); !errors.Is(err, encryptor.ErrTargetExists) {
+		t.Error("expected an existing transcript to be refused: ", err)
+	}
+
+	// A failed decryption is recorded with the header it read
+	options.Operation = encryptor.Decryption
+	options.SourceFilename, options.TargetFilename = target, filepath.Join(tempDir, "decrypted")
+	options.Password = "wrong"
+	options.ForceOperation = true
+
+	transcript = startTranscript(&options)
+	jobErr = encryptor.Decrypt(options.SourceFilename, options.TargetFilename, &options.Options)
+	if err := finishTranscript(transcript, &options, jobErr); err != nil || jobErr == nil {
+		t.Fatal(err, jobErr)
+	}
+
+	data, err = os.ReadFile(transcriptFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written = Transcript{}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	if written.Operation != "decrypt" || written.Succeeded || written.Error == "" || written.HeaderRead == nil || !bytes.Equal(written.HeaderRead.FileID, header.FileID) || written.HeaderWritten != nil {
+		t.Errorf("unexpected transcript of a failed decryption: %+v", written)
+	}
+
+	options.Operation = encryptor.Scrubbing
+	if err := checkTranscript(&options); err == nil {
+		t.Error("expected --transcript to be refused for scrub")
+	}
+}
+
+func Test_ServeFile(t *testing.T) {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "movie.mkv")
+	encrypted := filepath.Join(tempDir, "movie.mkv.enc")
+
+	data := make([]byte, 3<<20+500)
+	_, _ = rand.Read(data)
+
+	if err := os.WriteFile(source, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	options := encryptor.Options{KeyHex: testKeyHex, ChunkSizeMB: 1}
+	if err := encryptor.Encrypt(source, encrypted, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := encryptor.OpenFileReader(encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(reader *encryptor.FileReader) {
+		_ = reader.Close()
+	}(reader)
+
+	server := httptest.NewServer(fileServingHandler(reader, servedName(encrypted), time.Now(), "secret"))
+	defer server.Close()
+
+	get := func(url string, header http.Header) (*http.Response, []byte) {
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, values := range header {
+			request.Header[name] = values
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer func(body io.ReadCloser) {
+			_ = body.Close()
+		}(response.Body)
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return response, body
+	}
+
+	for _, url := range []string{server.URL + "/movie.mkv", server.URL + "/movie.mkv?token=wrong"} {
+		if response, _ := get(url, nil); response.StatusCode != http.StatusUnauthorized {
+			t.Error("expected ", url, " to be refused, got ", response.Status)
+		}
+	}
+
+	response, body := get(server.URL+"/movie.mkv?token=secret", nil)
+	if response.StatusCode != http.StatusOK || !bytes.Equal(body, data) || response.Header.Get("Content-Type") != "video/x-matroska" {
+		t.Error("expected the whole plaintext, got ", response.Status, " ", response.Header.Get("Content-Type"))
+	}
+
+	response, body = get(server.URL+"/movie.mkv", http.Header{"Authorization": {"Bearer secret"}, "Range": {"bytes=1048570-2097200"}})
+	if response.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[1048570:2097201]) {
+		t.Error("expected the range across a chunk boundary, got ", response.Status)
+	}
+
+	if displayAddress("[::]:8080") != "localhost:8080" || displayAddress("10.0.0.1:80") != "10.0.0.1:80" {
+		t.Error("expected unspecified addresses to be shown as localhost")
+	}
+}
+
+func Test_MultipleFiles(t *testing.T) {
+	tempDir := t.TempDir()
+
+	keyFilename := filepath.Join(tempDir, "backup.key")
+	if err := os.WriteFile(keyFilename, []byte("e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var sources []string
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		fileName := filepath.Join(tempDir, name)
+		if err := os.WriteFile(fileName, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		sources = append(sources, fileName)
+	}
+
+	var options EncryptorOptions
+	if err := initializeOptions(&options); err != nil {
+		t.Fatal(err)
+	}
+
+	options.SourceFilenames = sources
+	options.KeyFilename = keyFilename
+
+	// The key file is read for the first file, and its key used for the rest
+	if code := runMultipleFiles(&options); code != 0 {
+		t.Fatal("expected every file to be encrypted, exit code ", code)
+	}
+
+	var encrypted []string
+	for _, fileName := range sources {
+		if _, err := os.Stat(fileName + ".enc"); err != nil {
+			t.Error("expected ", fileName, " to be encrypted beside it: ", err)
+		}
+
+		encrypted = append(encrypted, fileName+".enc")
+		_ = os.Remove(fileName)
+	}
+
+	// A file that fails does not stop the others
+	encrypted = append(encrypted, filepath.Join(tempDir, "missing.log.enc"))
+
+	options.Operation = encryptor.Decryption
+	options.SourceFilenames = encrypted
+	if code := runMultipleFiles(&options); code != 1 {
+		t.Error("expected the missing file to fail the run, exit code ", code)
+	}
+
+	for _, fileName := range sources {
+		if data, err := os.ReadFile(fileName); err != nil || string(data) != filepath.Base(fileName) {
+			t.Error("expected ", fileName, " to be decrypted to its name without .enc: ", err)
+		}
+	}
+
+	if _, err := multipleFileTarget(&options, sources[0]); err == nil {
+		t.Error("expected decrypting a file without .enc to need a target of its own")
+	}
+
+	options.Operation = encryptor.Shredding
+	if err := checkMultipleFiles(&options); err == nil {
+		t.Error("expected only encryption, decryption, and verification to take several files")
+	}
+
+	options.Operation = encryptor.Encryption
+	options.TranscriptFilename = filepath.Join(tempDir, "transcript.json")
+	if err := checkMultipleFiles(&options); err == nil {
+		t.Error("expected a transcript to be refused for several files")
+	}
+}
+
+func Test_MultipleFileHooks(t *testing.T) {
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run hooks with")
+	}
+
+	tempDir := t.TempDir()
+
+	var sources []string
+	for _, name := range []string{"a.log", "b.log"} {
+		fileName := filepath.Join(tempDir, name)
+		if err := os.WriteFile(fileName, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		sources = append(sources, fileName)
+	}
+
+	var log bytes.Buffer
+	gLoggerInfo.SetOutput(&log)
+	defer gLoggerInfo.SetOutput(os.Stderr)
+
+	var options EncryptorOptions
+	if err := initializeOptions(&options); err != nil {
+		t.Fatal(err)
+	}
+
+	options.SourceFilenames = append(sources, filepath.Join(tempDir, "missing.log"))
+	options.KeyHex = testKeyHex
+	options.PreCommand = shell + ` -c 'echo "$1 $2"' hook {status} {source}`
+	options.PostCommand = shell + ` -c 'echo "$1 $2 $3"' hook {status}:{hash} {source} {target}`
+
+	// Each file's job runs between hooks of its own, the missing file's post-cmd is told it failed
+	if code := runMultipleFiles(&options); code != 1 {
+		t.Fatal("expected the missing file to fail the run, exit code ", code)
+	}
+
+	var expected string
+	for _, fileName := range sources {
+		hash, _ := encryptor.Hash(fileName + ".enc")
+		expected += "pre-cmd: started " + fileName + "\n" + "post-cmd: ok:" + hash + " " + fileName + " " + fileName + ".enc\n"
+	}
+
+	missing := options.SourceFilenames[2]
+	expected += "pre-cmd: started " + missing + "\n" + "post-cmd: failed: " + missing + " " + missing + ".enc\n"
+
+	var hookLines string
+	for _, line := range strings.SplitAfter(log.String(), "\n") {
+		if strings.HasPrefix(line, "pre-cmd: ") || strings.HasPrefix(line, "post-cmd: ") {
+			hookLines += line
+		}
+	}
+
+	if hookLines != expected {
+		t.Errorf("unexpected hook log %q, expected %q", hookLines, expected)
+	}
+
+	// A file whose pre-cmd fails is skipped, the others still run
+	for _, fileName := range sources {
+		_ = os.Remove(fileName + ".enc")
+	}
+
+	options.SourceFilenames = sources
+	options.PreCommand = shell + ` -c 'test "$1" != "` + sources[0] + `"' hook {source}`
+	options.PostCommand = ""
+	if code := runMultipleFiles(&options); code != 1 {
+		t.Error("expected the failed pre-cmd to fail the run, exit code ", code)
+	}
+
+	if _, err := os.Stat(sources[0] + ".enc"); !os.IsNotExist(err) {
+		t.Error("expected the file whose pre-cmd failed to be skipped: ", err)
+	}
+
+	if _, err := os.Stat(sources[1] + ".enc"); err != nil {
+		t.Error("expected the other file to be encrypted: ", err)
+	}
+}
+
+func Test_ShredPolicy(t *testing.T) {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "payroll.csv")
+	policyFilename := filepath.Join(tempDir, "policy.json")
+
+	if err := os.WriteFile(source, []byte("name,salary\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(policyFilename, []byte(`{"ForbidUnverifiedDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var options EncryptorOptions
+	if err := initializeOptions(&options); err != nil {
+		t.Fatal(err)
+	}
+
+	options.Operation = encryptor.Shredding
+	options.SourceFilename = source
+	options.PolicyFilename = policyFilename
+	options.KeyHex = testKeyHex
+
+	if err := checkShred(&options); err == nil {
+		t.Error("expected a file without an encrypted copy to be held back")
+	}
+
+	if err := encryptor.Encrypt(source, source+".enc", &encryptor.Options{KeyHex: options.KeyHex}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkShred(&options); err != nil {
+		t.Error("expected a file whose copy decrypts to it to be shredded: ", err)
+	}
+
+	// The copy must be of the file as it is now
+	if err := os.WriteFile(source, []byte("name,salary,bonus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkShred(&options); err == nil {
+		t.Error("expected a file changed since it was encrypted to be held back")
+	}
+
+	// Encrypted files are not plaintext
+	options.SourceFilename = source + ".enc"
+	if err := checkShred(&options); err != nil {
+		t.Error("expected an encrypted file to be shredded: ", err)
+	}
+
+	// Nothing is held back without the rule
+	options.SourceFilename = source
+	options.PolicyFilename = ""
+	if err := checkShred(&options); err != nil {
+		t.Error("expected shred to go ahead without a policy: ", err)
+	}
+}
+
+func Test_CrashReport(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := encryptor.SetTempDir(tempDir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = encryptor.SetTempDir("")
+	}()
+
+	crash := encryptor.CrashError{Report: encryptor.CrashReport{Time: time.Now(), Worker: "execute worker 1", Panic: "test"}}
+
+	// A link planted where a report named by the time alone would go is never written through
+	victim := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(victim, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	planted := filepath.Join(tempDir, "encryptor-crash-"+crash.Report.Time.Format("20060102-150405")+".json")
+	if err := os.Symlink(victim, planted); err != nil {
+		t.Skip("symbolic links are not available: ", err)
+	}
+
+	first, err := writeCrashReport(&crash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := writeCrashReport(&crash)
+	if err != nil || first == second {
+		t.Fatal("expected crashes in the same second to keep separate reports: ", first, second, err)
+	}
+
+	if data, err := os.ReadFile(victim); err != nil || string(data) != "keep" {
+		t.Error("a planted link was written through: ", string(data), err)
+	}
+
+	var bundle crashBundle
+	data, err := os.ReadFile(first)
+	if err == nil {
+		err = json.Unmarshal(data, &bundle)
+	}
+	if err != nil || bundle.Worker != "execute worker 1" {
+		t.Error("unexpected crash report: ", bundle, err)
+	}
+
+	if info, err := os.Stat(first); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("expected a report only the user can read: ", info, err)
+	}
 }
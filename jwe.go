@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"io"
+)
+
+// encryptor --jwe=json source source.jwe writes a JWE for JOSE libraries to decrypt, -d --jwe reads one back
+func runJWEJob(options *EncryptorOptions) error {
+	return runMessageJob(options, func(source io.Reader, target io.Writer) error {
+		if options.Operation == encryptor.Decryption {
+			return encryptor.DecryptJWE(source, target, &options.Options)
+		}
+
+		return encryptor.EncryptJWE(source, target, options.JWE, &options.Options)
+	})
+}
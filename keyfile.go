@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+	Secrets on the command line end up in shell history and ps output, so
+	keys and passwords can be read from files (or passwords from the
+	platform keyring) instead - once loaded they are used exactly as if
+	they had been given on the command line
+*/
+
+// --keyfile is an alternative to --keyhex, once loaded the key is used exactly as if it had been given with it
+func loadKeyFile(options *EncryptorOptions) error {
+	if options.KeyFilename == "" {
+		return nil
+	}
+
+	if options.KeyHex != "" {
+		return errors.New("a key can be given with --keyhex or --keyfile, not both")
+	}
+
+	keyHex, err := encryptor.LoadKeyFile(options.KeyFilename)
+	if err != nil {
+		return err
+	}
+
+	warnIfReadableByOthers("key file", options.KeyFilename)
+
+	options.KeyHex = keyHex
+	return nil
+}
+
+// --password-file is an alternative to --password, for scripts that must not put a password on the command line
+func loadPasswordFile(options *EncryptorOptions) error {
+	if options.PasswordFilename == "" {
+		return nil
+	}
+
+	if options.Password != "" {
+		return errors.New("a password can be given with --password or --password-file, not both")
+	}
+
+	password, err := encryptor.LoadPasswordFile(options.PasswordFilename)
+	if err != nil {
+		return err
+	}
+
+	warnIfReadableByOthers("password file", options.PasswordFilename)
+
+	options.Password = password
+	return nil
+}
+
+// --keyring is an alternative to --password, the password is read from the platform keyring by profile name
+func loadKeyringPassword(options *EncryptorOptions) error {
+	if options.KeyringProfile == "" {
+		return nil
+	}
+
+	if options.Password != "" {
+		return errors.New("a password can be given with only one of --password, --password-file, and --keyring")
+	}
+
+	password, err := encryptor.KeyringPassword(options.KeyringProfile)
+	if err != nil {
+		return err
+	}
+
+	options.Password = password
+	return nil
+}
+
+// encryptor store-password --keyring=<profile> puts a password in the platform keyring for --keyring to read back
+func runPasswordStoring(options *EncryptorOptions) error {
+	if options.KeyringProfile == "" {
+		return errors.New("give the profile to store the password under with --keyring")
+	}
+
+	err := loadPasswordFile(options)
+	if err != nil {
+		return err
+	}
+
+	password := strings.TrimSpace(options.Password)
+	if password == "" {
+		password, err = promptUserForPassword(true)
+		if err != nil {
+			return fmt.Errorf("could not obtain password: %w", err)
+		}
+	}
+
+	err = encryptor.StoreKeyringPassword(options.KeyringProfile, password)
+	if err != nil {
+		return err
+	}
+
+	gLoggerInfo.Println("The password was stored in the keyring, use it with --keyring=" + options.KeyringProfile)
+	return nil
+}
+
+func warnIfReadableByOthers(description string, fileName string) {
+	// Windows does not have meaningful permission bits
+	if info, err := os.Stat(fileName); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		gLoggerInfo.Println("Warning:", description, fileName, "can be read by others, restrict it with chmod 600")
+	}
+}
+
+/*
+	encryptor keygen alice.key writes a new X25519 identity for --identity
+	and prints its public key, the --recipient others encrypt to - with no
+	filename (or -) the identity itself is printed. --post-quantum makes
+	it a hybrid ML-KEM-768 + X25519 identity, --signing an Ed25519 key
+	for --sign whose public key is given to others as --signer
+*/
+func runKeyGeneration(options *EncryptorOptions) error {
+	if options.TargetFilename != "" {
+		return errors.New("keygen writes one identity file, give only its name")
+	}
+
+	if options.Signing && options.PostQuantum {
+		return errors.New("--signing and --post-quantum cannot be combined, signing keys are Ed25519")
+	}
+
+	generate := encryptor.GenerateX25519Identity
+	if options.PostQuantum {
+		generate = encryptor.GenerateMLKEMX25519Identity
+	} else if options.Signing {
+		generate = encryptor.GenerateSigningKey
+	}
+
+	privateKey, publicKey, err := generate()
+	if err != nil {
+		return err
+	}
+
+	identity := "# created: " + time.Now().Format(time.RFC3339) + "\n# public key: " + publicKey + "\n" + privateKey + "\n"
+
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename {
+		fmt.Print(identity)
+		return nil
+	}
+
+	if _, err := os.Stat(options.SourceFilename); err == nil && !options.ForceOperation {
+		return fmt.Errorf("identity %s: %w", options.SourceFilename, encryptor.ErrTargetExists)
+	}
+
+	err = os.WriteFile(options.SourceFilename, []byte(identity), 0600)
+	if err != nil {
+		return fmt.Errorf("could not write identity: %w", err)
+	}
+
+	fmt.Println(publicKey)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"encryptor/pkg/encryptor"
+	"fmt"
+	"os"
+	"time"
+)
+
+// encryptor --verify --sequential disc.enc reads the file once front to back and prints a certificate of verification
+func runMediaVerification(options *EncryptorOptions) error {
+	// Found out before hours of reading, not after
+	if _, err := os.Stat(options.CertificateFilename); options.CertificateFilename != "" && err == nil && !options.ForceOperation {
+		return fmt.Errorf("certificate %s: %w", options.CertificateFilename, encryptor.ErrTargetExists)
+	}
+
+	media := encryptor.MediaVerificationOptions{ProgressFilename: options.ProgressFilename}
+
+	certificate, err := encryptor.VerifyMedia(options.SourceFilename, &media, &options.Options)
+	certificate.Verifier = "encryptor " + gVersion + " (commit " + gGitCommit + ")"
+
+	printCertificate(&certificate)
+
+	// The certificate is the record of a failure as much as of a success
+	if options.CertificateFilename != "" {
+		writeErr := writeCertificate(options.CertificateFilename, &certificate)
+		if writeErr != nil && err == nil {
+			err = writeErr
+		} else if writeErr != nil {
+			gLoggerInfo.Println("The certificate could not be written: ", writeErr.Error())
+		}
+	}
+
+	// A failed read keeps the position saved, a failed check starts over
+	if err != nil && options.ProgressFilename != "" {
+		if _, statErr := os.Stat(options.ProgressFilename); statErr == nil {
+			gLoggerInfo.Println("Progress was saved to", options.ProgressFilename, "- run the same command again to resume")
+		}
+	}
+
+	return err
+}
+
+func printCertificate(certificate *encryptor.VerificationCertificate) {
+	fmt.Println("file:", certificate.FileName)
+	fmt.Println("size:", certificate.FileSizeBytes)
+
+	if certificate.SHA256 != "" {
+		fmt.Println("sha256:", certificate.SHA256)
+	}
+
+	fmt.Println("file id:", certificate.FileID, "format:", certificate.FormatVersion, "cipher:", certificate.Cipher)
+	fmt.Println("chunks:", certificate.NumChunks, "footer:", certificate.Footer, "plaintext digest:", certificate.PlaintextDigest)
+	fmt.Println("started:", certificate.Started.UTC().Format(time.RFC3339), "finished:", certificate.Finished.UTC().Format(time.RFC3339), "runs:", certificate.Runs)
+	fmt.Println("host:", certificate.Hostname, "verifier:", certificate.Verifier)
+
+	if certificate.Verified {
+		fmt.Println("Verified: every chunk of", certificate.FileName, "authenticated")
+	} else {
+		fmt.Println("NOT verified:", certificate.Error)
+	}
+}
+
+func writeCertificate(fileName string, certificate *encryptor.VerificationCertificate) error {
+	data, err := json.MarshalIndent(certificate, "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not serialize certificate: %w", err)
+	}
+
+	err = os.WriteFile(fileName, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write certificate: %w", err)
+	}
+
+	return nil
+}
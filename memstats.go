@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"encryptor/pkg/encryptor"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const memStatsSampleInterval = 250 * time.Millisecond
+
+/*
+	Memory statistics are informational, so they go to stderr, while the
+	time series goes to the file the user asked for - reports are only
+	produced by file jobs (streams run a chunk at a time)
+*/
+func reportMemory(options *EncryptorOptions, report *encryptor.MemoryReport) error {
+	if report.Elapsed == 0 {
+		return nil
+	}
+
+	if report.BoundBytes > 0 {
+		gLoggerInfo.Printf("Peak memory %d MiB of a %d MiB bound (%d MB chunks, %d readers, %d executors)",
+			report.PeakHeapBytes/1024/1024, report.BoundBytes/1024/1024, report.ChunkSizeMB, report.Readers, report.Executors)
+	}
+
+	if options.MemStats || options.MemStatsFilename != "" {
+		gLoggerInfo.Printf("Peak heap %d MiB, %d MiB allocated, %d GCs pausing %s (%.2f%% of %s) - %d MB chunks, %d readers, %d executors",
+			report.PeakHeapBytes/1024/1024, report.TotalAllocBytes/1024/1024, report.NumGC, report.GCPauseTotal.Round(time.Microsecond),
+			report.GCPauseFraction()*100, report.Elapsed.Round(time.Millisecond), report.ChunkSizeMB, report.Readers, report.Executors)
+
+		// What the collector was working to, so GC counts and pauses can be read against it
+		if report.Runtime.SoftLimitBytes > 0 {
+			gLoggerInfo.Printf("Runtime soft memory limit %d MiB, GOGC %d", report.Runtime.SoftLimitBytes/1024/1024, report.Runtime.GCPercent)
+		} else if report.BoundBytes > 0 {
+			gLoggerInfo.Printf("Runtime GOGC %d, no soft memory limit before Go 1.19", report.Runtime.GCPercent)
+		}
+
+		// With --scale-executors, how the executors followed the bottleneck
+		for _, decision := range report.Scaling {
+			if decision.Elapsed == 0 {
+				gLoggerInfo.Printf("Executors %d: %s", decision.Executors, decision.Reason)
+				continue
+			}
+
+			gLoggerInfo.Printf("Executors %d at %s: %s (%.1f chunks/s, %d read and waiting, %d executed and waiting)",
+				decision.Executors, decision.Elapsed.Round(time.Millisecond), decision.Reason, decision.ChunksPerSecond, decision.ReadQueue, decision.WriteQueue)
+		}
+	}
+
+	if options.MemStatsFilename == "" {
+		return nil
+	}
+
+	return writeMemorySamples(options.MemStatsFilename, report.Samples)
+}
+
+// With --stats, a line per stage - the bottleneck is the one busy nearest 100% of the time
+func reportStages(options *EncryptorOptions, report *encryptor.StageReport) {
+	if !options.Stats {
+		return
+	}
+
+	if len(report.Stages) == 0 {
+		gLoggerInfo.Println("No stages to report, --stats reports jobs encrypted with --compress")
+		return
+	}
+
+	for _, stage := range report.Stages {
+		gLoggerInfo.Printf("Stage %s: %d MB with %d workers at %.1f MB/s, busy %.0f%% of %s",
+			stage.Name, stage.Bytes/1000/1000, stage.Workers, stage.Throughput(), stage.Utilization(report.Elapsed)*100, report.Elapsed.Round(time.Millisecond))
+	}
+}
+
+func writeMemorySamples(fileName string, samples []encryptor.MemorySample) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("could not create memory statistics file: %w", err)
+	}
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"elapsed_ms", "heap_alloc_bytes", "total_alloc_bytes", "num_gc"})
+
+	for _, sample := range samples {
+		_ = writer.Write([]string{
+			strconv.FormatInt(sample.Elapsed.Milliseconds(), 10),
+			strconv.FormatUint(sample.HeapAllocBytes, 10),
+			strconv.FormatUint(sample.TotalAllocBytes, 10),
+			strconv.FormatUint(uint64(sample.NumGC), 10),
+		})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("could not write memory statistics file: %w", err)
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"fmt"
+	"io"
+	"os"
+)
+
+// OpenPGP messages and JWEs are whole messages in another format, read from the source and written to the target (or stdio) in one go
+func runMessageJob(options *EncryptorOptions, job func(source io.Reader, target io.Writer) error) (err error) {
+	var source io.Reader = os.Stdin
+	var target io.Writer = os.Stdout
+
+	if options.SourceFilename != StdioFilename {
+		file, err := os.Open(options.SourceFilename)
+		if err != nil {
+			return fmt.Errorf("could not open source file: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		source = file
+	}
+
+	if options.TargetFilename != StdioFilename {
+		_, statErr := os.Stat(options.TargetFilename)
+		if statErr == nil && !options.ForceOperation {
+			return encryptor.ErrTargetExists
+		}
+
+		file, createErr := os.Create(options.TargetFilename)
+		if createErr != nil {
+			return fmt.Errorf("could not open file for writing: %w", createErr)
+		}
+
+		// A message is only checked once all of it is read, so a target written before a failure is not kept
+		defer func(file *os.File) {
+			closeErr := file.Close()
+			if err == nil && closeErr != nil {
+				err = fmt.Errorf("error closing file we were writing to: %w", closeErr)
+			}
+
+			if err != nil {
+				_ = os.Remove(file.Name())
+			}
+		}(file)
+
+		target = file
+	}
+
+	return job(source, target)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"github.com/pborman/getopt/v2"
+	"strings"
+	"time"
+)
+
+/*
+	More than two unflagged arguments, or --source given more than once,
+	are all sources, each encrypted, decrypted, or verified as a job of
+	its own
+
+		encryptor -p pw *.log
+		encryptor -d -p pw *.log.enc
+
+	Encrypting writes <name>.enc beside each file, decrypting writes each
+	file to its name without the .enc (or with --restore-name, the name
+	it stored). The key or password is asked for, or read, once for every
+	file. A file that fails does not stop the others, the exit code is 1
+	if any failed
+
+	Options that describe one job's output - transcripts, memory
+	statistics files, certificates - are refused, they would be written
+	over by each file in turn. --pre-cmd and --post-cmd run around each
+	file's job, with that file's {source}, {target}, {hash}, and {status}:
+	a --pre-cmd that fails skips its file, a --post-cmd that fails fails
+	its file, and either way the rest go on
+*/
+
+const encryptedSuffix = ".enc"
+
+// Every --source, where a string flag would keep only the last
+type filenameList []string
+
+func (list *filenameList) Set(value string, _ getopt.Option) error {
+	// Resetting the flag sets it to its default, nothing
+	if value == "" {
+		*list = nil
+		return nil
+	}
+
+	*list = append(*list, value)
+	return nil
+}
+
+func (list *filenameList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func checkMultipleFiles(options *EncryptorOptions) error {
+	switch options.Operation {
+	case encryptor.Encryption, encryptor.Decryption, encryptor.Verification:
+	default:
+		return errors.New("only two filenames can be passed, a source and a target - several sources can only be encrypted, decrypted (-d), or verified (--verify)")
+	}
+
+	if options.SingleInstance || options.TranscriptFilename != "" || options.MemStatsFilename != "" || options.ProgressFilename != "" || options.CertificateFilename != "" || options.HeadFirst {
+		return errors.New("--single-instance, --transcript, --mem-stats-file, --progress-file, --certificate, and --head-first are for one file at a time")
+	}
+
+	for _, fileName := range options.SourceFilenames {
+		if fileName == StdioFilename || isObjectURL(fileName) {
+			return fmt.Errorf("%s: several sources must all be local files, stdin and cloud storage are read one at a time", fileName)
+		}
+	}
+
+	return nil
+}
+
+func multipleFileTarget(options *EncryptorOptions, fileName string) (string, error) {
+	switch {
+	case options.Operation == encryptor.Encryption:
+		return fileName + encryptedSuffix, nil
+	case options.Operation == encryptor.Decryption && !options.RestoreName:
+		if !strings.HasSuffix(fileName, encryptedSuffix) || fileName == encryptedSuffix {
+			return "", fmt.Errorf("%s does not end in %s, decrypt it on its own to name its target (or give --restore-name)", fileName, encryptedSuffix)
+		}
+
+		return strings.TrimSuffix(fileName, encryptedSuffix), nil
+	}
+
+	return "", nil
+}
+
+// Runs a job for each source in turn, returning the exit code
+func runMultipleFiles(options *EncryptorOptions) int {
+	err := checkMultipleFiles(options)
+	if err != nil {
+		gLoggerStderr.Println("An error was encountered validating our configuration during startup: ", err.Error())
+		return 1
+	}
+
+	template := *options
+	failed := 0
+	started := time.Now()
+
+	for _, fileName := range options.SourceFilenames {
+		jobOptions := template
+		jobOptions.SourceFilenames = nil
+		jobOptions.SourceFilename = fileName
+
+		err = runMultipleFileJob(&jobOptions)
+
+		// The key is asked for or read once, later files use what the first one found
+		if template.KeyHex == "" && template.Password == "" && (jobOptions.KeyHex != "" || jobOptions.Password != "") {
+			template.KeyHex, template.Password = jobOptions.KeyHex, jobOptions.Password
+			template.KeyFilename, template.PasswordFilename, template.KeyringProfile = "", "", ""
+		}
+
+		if err != nil {
+			failed++
+			gLoggerStderr.Println("An error was encountered with", fileName+": ", err.Error())
+			printErrorHints(gLoggerInfo.Writer(), err, &jobOptions)
+		}
+	}
+
+	gLoggerInfo.Printf("%d of %d files done in %v, %d failed\n", len(options.SourceFilenames)-failed, len(options.SourceFilenames), time.Since(started).Round(time.Millisecond), failed)
+
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func runMultipleFileJob(options *EncryptorOptions) error {
+	targetFilename, err := multipleFileTarget(options, options.SourceFilename)
+	if err != nil {
+		return err
+	}
+
+	options.TargetFilename = targetFilename
+
+	err = validateOpts(options)
+	if err != nil {
+		return err
+	}
+
+	if options.Operation == encryptor.Encryption && !options.NoHeuristics {
+		for _, warning := range sourceWarnings(options.SourceFilename) {
+			gLoggerInfo.Println("Warning:", warning)
+		}
+	}
+
+	// Before anything reads the source, the hook may be what puts it there
+	err = runPreCommand(options)
+	if err != nil {
+		return fmt.Errorf("--pre-cmd failed, the file was skipped: %w", err)
+	}
+
+	err = runJob(options)
+
+	// Whether or not the job succeeded, the hook is told which
+	hookErr := runPostCommand(options, err)
+	if err != nil {
+		if hookErr != nil {
+			gLoggerStderr.Println("An error was encountered running --post-cmd: ", hookErr.Error())
+		}
+
+		return err
+	}
+
+	if hookErr != nil {
+		return hookErr
+	}
+
+	if options.Operation != encryptor.Verification {
+		gLoggerInfo.Println(options.SourceFilename, "->", options.TargetFilename)
+	}
+
+	return nil
+}
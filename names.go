@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+/*
+	--store-name records the source's name in the header, sealed with the
+	file's key unless --store-name=plain asks for it in the clear (where
+	inspect shows it without the key), and -d --restore-name decrypts to
+	that name - beside the encrypted file, or in the directory given as
+	the target - so nobody has to remember what temp.enc was. A file
+	already there is only replaced with --force, as any target is
+*/
+
+func checkStoredName(options *EncryptorOptions) error {
+	if options.StoreName != "" {
+		if options.StoreName != encryptor.NameStorePlain && options.StoreName != encryptor.NameStoreSealed {
+			return fmt.Errorf("unknown --store-name=%s, use --store-name (sealed with the key) or --store-name=%s", options.StoreName, encryptor.NameStorePlain)
+		}
+
+		if options.Operation != encryptor.Encryption || options.OpenPGP || options.JWE != "" {
+			return errors.New("--store-name records the name when encrypting a file in our format, not with other commands, --openpgp, or --jwe")
+		}
+
+		if options.SourceFilename == "" || options.SourceFilename == StdioFilename {
+			return errors.New("--store-name stores the source's name, stdin has none")
+		}
+
+		options.OriginalName = sourceName(options.SourceFilename)
+	}
+
+	if !options.RestoreName {
+		return nil
+	}
+
+	if options.Operation != encryptor.Decryption || options.OpenPGP || options.JWE != "" {
+		return errors.New("--restore-name is for decrypting a file in our format with -d, not with other commands, --openpgp, or --jwe")
+	}
+
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename || isObjectURL(options.SourceFilename) {
+		return errors.New("--restore-name reads the name from an encrypted file's header, give the file")
+	}
+
+	// Where the restored file goes, its name comes once the key is known
+	if options.TargetFilename == "" {
+		options.TargetFilename = filepath.Dir(options.SourceFilename)
+		return nil
+	}
+
+	if stats, err := os.Stat(options.TargetFilename); err != nil || !stats.IsDir() {
+		return errors.New("--restore-name names the target, give a directory to decrypt into or no target at all")
+	}
+
+	return nil
+}
+
+// Object URLs are named by the last element of their path
+func sourceName(sourceFilename string) string {
+	if isObjectURL(sourceFilename) {
+		if parsed, err := url.Parse(sourceFilename); err == nil {
+			return path.Base(parsed.Path)
+		}
+	}
+
+	if absolute, err := filepath.Abs(sourceFilename); err == nil {
+		sourceFilename = absolute
+	}
+
+	return filepath.Base(sourceFilename)
+}
+
+func restoreName(options *EncryptorOptions) error {
+	if !options.RestoreName {
+		return nil
+	}
+
+	name, err := encryptor.OriginalName(options.SourceFilename, &options.Options)
+	if errors.Is(err, encryptor.ErrNoStoredName) {
+		return fmt.Errorf("%s does not record its original name (it was not encrypted with --store-name), give a target filename", options.SourceFilename)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not read the original name: %w", err)
+	}
+
+	target := filepath.Join(options.TargetFilename, name)
+
+	// --force would have the decryption write over what it reads
+	sourceStats, sourceErr := os.Stat(options.SourceFilename)
+	if targetStats, err := os.Stat(target); err == nil && sourceErr == nil && os.SameFile(sourceStats, targetStats) {
+		return fmt.Errorf("the original name is %s, the encrypted file's own, give a target directory elsewhere", name)
+	}
+
+	options.TargetFilename = target
+	gLoggerInfo.Println("Restoring the original name:", options.TargetFilename)
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"fmt"
+	"strings"
+)
+
+// --offline refuses every option that could touch the network, whatever the operation
+func checkOffline(options *EncryptorOptions) error {
+	if !options.Offline {
+		return nil
+	}
+
+	manifestName := releaseManifestName(options)
+	lower := strings.ToLower(manifestName)
+	if strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://") {
+		return fmt.Errorf("release manifest %s is fetched over the network: %w", manifestName, encryptor.ErrOffline)
+	}
+
+	for _, fileName := range []string{options.SourceFilename, options.TargetFilename} {
+		if isObjectURL(fileName) {
+			return fmt.Errorf("%s is reached over the network: %w", fileName, encryptor.ErrOffline)
+		}
+	}
+
+	return encryptor.CheckOffline(&options.Options)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"io"
+)
+
+// encryptor --openpgp source source.gpg writes a message gpg -d can read, -d reads one gpg --symmetric wrote
+func runOpenPGPJob(options *EncryptorOptions) error {
+	return runMessageJob(options, func(source io.Reader, target io.Writer) error {
+		if options.Operation == encryptor.Decryption {
+			return encryptor.DecryptOpenPGP(source, target, &options.Options)
+		}
+
+		return encryptor.EncryptOpenPGP(source, target, &options.Options)
+	})
+}
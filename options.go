@@ -1,38 +1,120 @@
 package main
 
 import (
+	"encryptor/pkg/encryptor"
 	"errors"
 	"github.com/pborman/getopt/v2"
 	"math"
 	"os"
+	"strings"
+	"time"
 )
 
+// The library options plus what only the command line needs
 type EncryptorOptions struct {
-	SourceFilename string
-	TargetFilename string
-	Operation      OperationEnum
-	KeyHex         string
-	Password       string
-	ChunkSizeMB    uint
-	Readers        uint8
-	Executors      uint8
-	Writers        uint8
-	ForceOperation bool
-}
+	SourceFilename  string
+	TargetFilename  string
+	SourceFilenames []string // More than one source, each a job of its own with a target named for it (see multifile.go)
+	Operation       encryptor.OperationEnum
+	encryptor.Options
 
-type OperationEnum uint8
+	KeyFilename          string // Loaded into KeyHex, keeping the key out of shell history and ps
+	PasswordFilename     string // Loaded into Password, the first line of the file
+	KeyringProfile       string // Loaded into Password from the platform keyring, or where store-password puts it
+	RcloneConfigFilename string
+	PolicyFilename       string // Enforced in addition to the system policy
+	JSONOutput           bool
+	MemStats             bool
+	MemStatsFilename     string
+	Stats                bool   // Report each stage's throughput as a compressed encryption finishes
+	PreviewBytes         int64  // Decrypt only this much of the source, 0 decrypts all of it
+	NoHeuristics         bool   // No warnings about sources that look already encrypted
+	OpenPGP              bool   // Encrypt to, or decrypt, an OpenPGP message gpg can read instead of our format
+	JWE                  string // Encrypt to a JWE in this serialization (compact or json) instead of our format, or decrypt one
+	SingleInstance       bool   // Skip the job, exiting with exitAlreadyRunning, while the same job runs elsewhere
+	MerkleTreeHash       bool   // A Merkle root over the file's chunks, hashing - or over the plaintext, encrypting and decrypting
+	TranscriptFilename   string // A record of the job, its options, and the header it wrote or read, as JSON (see transcript.go)
+	Tar                  bool   // The source is a directory encrypted as a tar of it, or the target a directory it is extracted into (see archive.go)
+	TempDirectory        string // Where temporary files are made, the system's temporary directory when empty (see tempdir.go)
+	RestoreName          bool   // Decrypt to the name stored in the header, beside the source or in the target directory (see names.go)
 
-const (
-	Encryption OperationEnum = iota
-	Decryption
-	FileHashing
-)
+	// Startup, see entropy.go
+	WaitForEntropy time.Duration // How long to wait for the system's random number generator to be seeded, 0 does not wait
+
+	// File jobs only, see hooks.go
+	PreCommand  string        // Run before the job, which does not start if it fails
+	PostCommand string        // Run after the job, told whether it succeeded
+	HookTimeout time.Duration // A hook still running after this long is killed, 0 is unlimited
+
+	// Email wrapping only
+	EmailTo      []string
+	EmailSubject string
+
+	// Sequential verification only
+	Sequential          bool   // One pass front to back, for optical and write-once media
+	ProgressFilename    string // The position is saved here so an interrupted verification resumes
+	CertificateFilename string // The certificate of verification is written here as JSON
+
+	// Binary verification only
+	ReleaseManifest string // A file or https URL, its signature is <manifest>.sig
+	ReleaseKey      string // Overrides the release key built in
+
+	// Hashing only
+	ChecksumManifest string // --manifest for the hash command, written for a tree or read by --check
+	ManifestFormat   string // encryptor.ManifestFormatGNU or ManifestFormatBSD, --check reads either
+	CheckChecksums   bool
+	NoHashCache      bool   // Hash every file, not only those changed since they were last hashed
+	TreeProofRange   string // --tree-proof, START-END of the bytes to prove against the Merkle root, for hash and prove
+	TreeRoot         string // verify-proof, the Merkle root the file is known by
+
+	// File serving only, see servefile.go
+	ListenAddress string // host:port, :port listens on every interface
+	TokenFilename string // The first line is the token requests must carry, a random one is made up without it
+
+	// Report only, see report.go
+	ReportFormat string // encryptor.ReportFormatJSON or ReportFormatHTML, empty chooses by the target's extension
+
+	// Shred only, see shred.go
+	ShredPasses  uint
+	ShredInclude []string // filepath.Match patterns of the names shredded in a directory
+	ShredExclude []string
+	DryRun       bool
+
+	// Soak only, see soak.go
+	SoakSizeBytes int64   // Synthetic data written each round
+	SoakHours     float64 // Rounds start until this many hours have passed, 0 runs one round
 
-const ReadersLimit uint8 = 30
-const ExecutorsLimit uint8 = 60
-const WritersLimit uint8 = 1 // Still researching concurrent file writing in Golang
-const ChunkSizeMin uint = 1
-const ChunkSizeMax uint = 64
+	// Scrub only
+	ScrubMaxRuntime    time.Duration
+	ScrubMaxBytes      int64
+	ScrubStateFilename string
+	ScrubSamplePercent uint
+	ScrubRandomOrder   bool
+
+	// Key generation only
+	PostQuantum bool // A hybrid ML-KEM-768 + X25519 keypair rather than X25519 alone
+	Signing     bool // An Ed25519 signing key for --sign rather than an identity
+}
+
+// Operations that are subcommands rather than flags, e.g. encryptor scrub /archive
+var subcommands = map[string]encryptor.OperationEnum{
+	"scrub":          encryptor.Scrubbing,
+	"hash":           encryptor.FileHashing,
+	"capabilities":   encryptor.CapabilitiesListing,
+	"inspect":        encryptor.Inspecting,
+	"wrap-email":     encryptor.EmailWrapping,
+	"verify-binary":  encryptor.BinaryVerification,
+	"self-update":    encryptor.SelfUpdating,
+	"store-password": encryptor.PasswordStoring,
+	"recover":        encryptor.Recovering,
+	"keygen":         encryptor.KeyGenerating,
+	"prove":          encryptor.RangeProving,
+	"verify-proof":   encryptor.ProofVerifying,
+	"serve-file":     encryptor.FileServing,
+	"report":         encryptor.Reporting,
+	"shred":          encryptor.Shredding,
+	"soak":           encryptor.Soaking,
+}
 
 func initializeOptions(options *EncryptorOptions) error {
 	if options == nil {
@@ -41,14 +123,115 @@ func initializeOptions(options *EncryptorOptions) error {
 
 	options.SourceFilename = ""
 	options.TargetFilename = ""
-	options.Operation = Encryption
+	options.SourceFilenames = nil
+	options.Operation = encryptor.Encryption
 	options.KeyHex = ""
+	options.KeyFilename = ""
+	options.PasswordFilename = ""
+	options.KeyringProfile = ""
 	options.Password = ""
-	options.ChunkSizeMB = 8
-	options.Readers = 6
-	options.Executors = 12
+	options.Cipher = encryptor.DefaultCipher
+	options.ChunkSizeMB = encryptor.DefaultChunkSizeMB
+	options.Readers = encryptor.DefaultReaders()
+	options.Executors = encryptor.DefaultExecutors()
 	options.Writers = 1
+	options.PoolWorkers = 0
+	options.BatchChunks = 0
+	options.PrefetchChunks = 0
+	options.ScaleExecutors = false
+	options.HeadFirst = false
+	options.Compression = ""
+	options.Compressors = 0
+	options.ZstdDictionary = false
+	options.StoreName = ""
+	options.OriginalName = ""
+	options.ChunkChecksum = false
+	options.SkipSourceHash = false
+	options.StoreKeyCheck = false
+	options.HeaderCopy = false
+	options.ChunkMarkers = false
+	options.CloudChecksums = false
+	options.PartSizeMB = encryptor.DefaultPartSizeMB
+	options.MaxMemoryMB = 0
+	options.WriteBufferKB = 0
+	options.Fsync = encryptor.FsyncNever
+	options.MemoryReport = nil
+	options.RcloneConfigFilename = ""
+	options.PolicyFilename = ""
+	options.JSONOutput = false
+	options.MemStats = false
+	options.MemStatsFilename = ""
+	options.Stats = false
+	options.StageReport = nil
+	options.NoHeuristics = false
+	options.OpenPGP = false
+	options.JWE = ""
+	options.SingleInstance = false
+	options.ChecksumManifest = ""
+	options.ManifestFormat = encryptor.ManifestFormatGNU
+	options.CheckChecksums = false
+	options.NoHashCache = false
+	options.MerkleTreeHash = false
+	options.TreeProofRange = ""
+	options.TreeRoot = ""
+	options.ListenAddress = defaultListenAddress
+	options.TokenFilename = ""
+	options.PreCommand = ""
+	options.PostCommand = ""
+	options.HookTimeout = defaultHookTimeout
+	options.TranscriptFilename = ""
+	options.Tar = false
+	options.Symlinks = ""
+	options.TempDirectory = ""
+	options.RestoreName = false
+	options.WaitForEntropy = 0
+	options.MaxOutputBytes = 0
+	options.EmailTo = nil
+	options.EmailSubject = ""
+	options.Sequential = false
+	options.ProgressFilename = ""
+	options.CertificateFilename = ""
+	options.ReleaseManifest = ""
+	options.ReleaseKey = ""
+	options.GPGRecipients = nil
+	options.SSHRecipients = nil
+	options.RecipientsFiles = nil
+	options.SSHIdentities = nil
+	options.X25519Recipients = nil
+	options.X25519Identities = nil
+	options.RSARecipients = nil
+	options.RSAIdentities = nil
+	options.GCPKMSKeys = nil
+	options.AzureKeyVaultKeys = nil
+	options.PKCS11Keys = nil
+	options.PKCS11Module = ""
+	options.PKCS11PIN = ""
+	options.TPMSeal = false
+	options.TPMPCRs = ""
+	options.PluginRecipients = nil
+	options.PromptSecret = promptUserForSecret
+	options.Warn = warnUser
 	options.ForceOperation = false
+	options.FIPS = false
+	options.Offline = false
+	options.ScrubMaxRuntime = 0
+	options.ScrubMaxBytes = 0
+	options.PreviewBytes = 0
+	options.ScrubStateFilename = ""
+	options.ScrubSamplePercent = 100
+	options.ScrubRandomOrder = false
+	options.ReportFormat = ""
+	options.ShredPasses = encryptor.DefaultShredPasses
+	options.ShredInclude = nil
+	options.ShredExclude = nil
+	options.DryRun = false
+	options.SoakSizeBytes = 0
+	options.SoakHours = 0
+	options.PostQuantum = false
+	options.Signing = false
+	options.SigningKey = ""
+	options.SignerKeys = nil
+	options.DetachedSignature = ""
 
 	return nil
 }
@@ -64,23 +247,148 @@ func processOpts(options *EncryptorOptions) error {
 	}
 
 	decrypting := false
+	verifying := false
 	help := false
 	version := false
 	hashing := false
+	checkingUpdate := false
+	cryptoInfo := false
+	var sourceFilenames filenameList
+	targetFilename := ""
+	bandwidthSchedule := ""
+	maxOutputSize := ""
+	soakSize := ""
+	followSymlinks := false
+	preserveSymlinks := false
+	skipSymlinks := false
 
 	getopt.FlagLong(&help, "help", '?', "Display help")
 	getopt.FlagLong(&version, "version", 0, "display version information")
+	getopt.FlagLong(&cryptoInfo, "crypto-info", 0, "Report whether AES and vector instructions are used by the crypto on this machine, and warn if AES runs in software")
 	getopt.FlagLong(&decrypting, "decrypt", 'd', "Decrypt the source file instead of encrypt")
-	getopt.FlagLong(&hashing, "hash", 'h', "SHA256 hash a file")
+	getopt.FlagLong(&options.PreviewBytes, "preview", 0, "Decrypt only the first this many bytes, to stdout when it is not a terminal or a temporary file that is deleted afterwards")
+	getopt.FlagLong(&verifying, "verify", 0, "Decrypt the source file without writing the plaintext, succeeding only if all of it authenticates")
+	getopt.FlagLong(&hashing, "hash", 'h', "SHA256 hash a file, or a directory as a tree")
+	getopt.FlagLong(&checkingUpdate, "check-update", 0, "Say whether a newer release than this binary exists (reads the latest release's signed manifest, nothing is installed)")
 	getopt.FlagLong(&options.KeyHex, "keyhex", 'k', "Hexadecimal string representing the key material")
+	getopt.FlagLong(&options.KeyFilename, "keyfile", 0, "A file holding the key material, as 32 raw bytes or 64 hex digits (keeps it out of shell history and ps)")
 	getopt.FlagLong(&options.Password, "password", 'p', "The password from which we should derive key material")
+	getopt.FlagLong(&options.PasswordFilename, "password-file", 0, "A file whose first line is the password (keeps it out of shell history and ps)")
+	getopt.FlagLong(&options.KeyringProfile, "keyring", 0, "The password stored in the platform keyring under this profile name (see store-password)")
+	getopt.FlagLong(&options.GPGRecipients, "gpg-recipient", 0, "Encrypt to an OpenPGP recipient in your gpg keyring (repeatable, or comma separated)")
+	getopt.FlagLong(&options.SSHRecipients, "ssh-recipient", 0, "Encrypt to an SSH public key, or a file of them (ssh-ed25519 or ssh-rsa, repeatable)")
+	getopt.FlagLong(&options.RecipientsFiles, "recipients-file", 0, "Encrypt to every SSH public key in a file or an https:// URL (e.g. https://github.com/username.keys, repeatable)")
+	getopt.FlagLong(&options.SSHIdentities, "ssh-identity", 0, "An SSH private key to decrypt with (repeatable, defaults to ~/.ssh/id_ed25519 and ~/.ssh/id_rsa)")
+	getopt.FlagLong(&options.X25519Recipients, "recipient", 0, "Encrypt to an X25519 (or hybrid ML-KEM-768 + X25519) public key, or a file of them (repeatable, see keygen)")
+	getopt.FlagLong(&options.X25519Identities, "identity", 0, "An X25519 identity file to decrypt with, as written by keygen (repeatable)")
+	getopt.FlagLong(&options.RSARecipients, "rsa-recipient", 0, "Encrypt to the RSA key in a certificate or public key file, PEM or DER (RSA-OAEP, repeatable)")
+	getopt.FlagLong(&options.RSAIdentities, "rsa-identity", 0, "An RSA private key file to decrypt with, PKCS#1 or PKCS#8, PEM or DER (repeatable)")
+	getopt.FlagLong(&options.GCPKMSKeys, "gcp-kms-key", 0, "Encrypt to a Google Cloud KMS key, projects/.../locations/.../keyRings/.../cryptoKeys/... (repeatable, uses Application Default Credentials)")
+	getopt.FlagLong(&options.AzureKeyVaultKeys, "azure-key-vault-key", 0, "Encrypt to an Azure Key Vault RSA key, https://<vault>.vault.azure.net/keys/<key> (repeatable, uses a managed identity or AZURE_CLIENT_SECRET)")
+	getopt.FlagLong(&options.PKCS11Keys, "pkcs11-key", 0, "Encrypt to an RSA key in an HSM or smartcard, a pkcs11: URI or the key's label (repeatable, uses pkcs11-tool)")
+	getopt.FlagLong(&options.TPMSeal, "tpm", 0, "Seal the file key to this machine's TPM 2.0, so only this machine can decrypt (uses tpm2-tools)")
+	getopt.FlagLong(&options.TPMPCRs, "tpm-pcrs", 0, "Bind the TPM seal to the current values of these SHA-256 PCRs, e.g. 0,7 (with --tpm)")
+	getopt.FlagLong(&options.PluginRecipients, "plugin-recipient", 0, "Encrypt to a recipient of a plugin, <plugin>:<recipient>, wrapped by the encryptor-plugin-<plugin> binary on the PATH (repeatable)")
+	getopt.FlagLong(&options.PKCS11Module, "pkcs11-module", 0, "The PKCS#11 module for pkcs11-tool to load, encrypting or decrypting (defaults to OpenSC's)")
+	getopt.FlagLong(&options.Cipher, "cipher", 0, "The cipher to encrypt with, "+encryptor.DefaultCipher+" (default), XChaCha20-Poly1305, AES-256-GCM-SIV, or a plugin's <plugin>:<cipher>")
 	getopt.FlagLong(&options.ChunkSizeMB, "chunksize", 'c', "The maximum size, in MB, of a file before it is chunked")
-	getopt.FlagLong(&options.Readers, "readers", 'r', "The number of read workers to utilize")
+	readersOpt := getopt.FlagLong(&options.Readers, "readers", 'r', "The number of read workers to utilize")
 	getopt.FlagLong(&options.Executors, "executors", 'e', "The number of execute workers to utilize")
 	getopt.FlagLong(&options.Writers, "writers", 'w', "The number of write workers to utilize")
+	getopt.FlagLong(&options.PoolWorkers, "pool", 0, "Workers that both read and execute, taking whichever task is ready (readers and executors become caps, 0 keeps separate workers)")
+	getopt.FlagLong(&options.BatchChunks, "batch-chunks", 'b', "The number of consecutive chunks an execute worker processes per task (0 chooses automatically)")
+	getopt.FlagLong(&options.PrefetchChunks, "prefetch", 0, "Read this many chunks ahead of the executors, adapting to read latency, for slow sources (0 uses read workers)")
+	getopt.FlagLong(&options.ScaleExecutors, "scale-executors", 0, "Add and park execute workers as the job runs to follow the bottleneck (executors becomes the cap, --mem-stats shows each decision)")
+	getopt.FlagLong(&options.HeadFirst, "head-first", 0, "-d: decrypt the earliest chunks first and write each as soon as it is ready, for a consumer reading the target (or stdout) as it grows")
+	getopt.FlagLong(&options.MaxMemoryMB, "max-memory", 0, "Keep peak memory, in MB, under this bound by fitting chunk size and workers to it (0 is unbounded, or 75% of a container's memory limit or GOMEMLIMIT)")
+	getopt.FlagLong(&options.WriteBufferKB, "write-buffer", 0, "Buffer the target's writes this many KB at a time (0 writes each chunk with one vectored write where supported)")
+	getopt.FlagLong(&options.Fsync, "fsync", 0, "When the target is synced to disk: never (left to the OS, default), end (once it is complete), or flush (after every buffered write)")
+	getopt.FlagLong(&options.MemStats, "mem-stats", 0, "Report peak heap, total allocations, and GC pauses when the job finishes")
+	getopt.FlagLong(&options.MemStatsFilename, "mem-stats-file", 0, "Write a CSV time series of heap and allocations during the job to this file (implies --mem-stats)")
+	getopt.FlagLong(&options.Stats, "stats", 0, "Report the throughput of each stage - read, compress, seal - when a --compress job finishes")
+	getopt.FlagLong(&options.ChunkChecksum, "chunk-crc", 0, "Store a CRC32C of each encrypted chunk for fast corruption scans")
+	storeNameOpt := getopt.FlagLong(&options.StoreName, "store-name", 0, "Record the source's name in the header for -d --restore-name, sealed with the file's key (the default) or --store-name=plain for inspect to show").SetOptional()
+	getopt.FlagLong(&options.RestoreName, "restore-name", 0, "Decrypt to the name the file recorded with --store-name, beside the encrypted file or in the directory given as the target")
+	getopt.FlagLong(&options.Compression, "compress", 0, "Compress the plaintext before encrypting it with zstd, gzip, lz4, or none (recorded in the header, decrypting decompresses)")
+	getopt.FlagLong(&options.Compressors, "compressors", 0, "The number of compression workers, between reading and encrypting, with --compress (0 uses as many as executors)")
+	getopt.FlagLong(&options.SkipSourceHash, "no-source-hash", 0, "Do not store the source's SHA256 for decryption to verify, saving a second read of the source")
+	getopt.FlagLong(&options.StoreKeyCheck, "key-check", 0, "Store a key check in the header, so decryption can tell a wrong key from a corrupt file before reading a chunk")
+	getopt.FlagLong(&options.HeaderCopy, "header-copy", 0, "Keep a copy of the header at the end of the file, read in its place when the header is damaged")
+	getopt.FlagLong(&options.ChunkMarkers, "chunk-markers", 0, "Start each chunk with a marker, so recover can find chunks again after damage that added or lost bytes")
+	getopt.FlagLong(&options.CloudChecksums, "cloud-checksums", 0, "Write object store checksums (S3/GCS) of the target to <target>"+encryptor.CloudChecksumsSuffix)
+	getopt.FlagLong(&options.PartSizeMB, "part-size", 0, "The multipart upload part size, in MB, used for per part cloud checksums, and for gs:// and az:// uploads and gs://, az://, and http(s):// ranged reads")
+	getopt.FlagLong(&sourceFilenames, "source", 0, "The source filename or remote:path (instead of the first unflagged argument, repeatable to encrypt, decrypt, or verify several files)")
+	getopt.FlagLong(&targetFilename, "target", 0, "The target filename or remote:path (instead of the second unflagged argument)")
+	getopt.FlagLong(&options.RcloneConfigFilename, "rclone-config", 0, "The rclone configuration remotes are read from (defaults to $RCLONE_CONFIG or rclone's own default)")
+	getopt.FlagLong(&bandwidthSchedule, "bandwidth", 0, "Limit the rate the target is written at by time of day, e.g. 0:00-6:00=unlimited,10MB")
+	getopt.FlagLong(&options.FIPS, "fips", 0, "Only allow FIPS approved algorithms (AES-GCM, SHA-2, PBKDF2, RSA-OAEP)")
+	getopt.FlagLong(&options.Offline, "offline", 0, "Refuse anything that could touch the network (recipients URLs, release manifest URLs, gpg key lookups)")
+	getopt.FlagLong(&options.PolicyFilename, "policy", 0, "A policy file to enforce in addition to the system policy ("+encryptor.SystemPolicyFilename+")")
+	getopt.FlagLong(&options.OpenPGP, "openpgp", 0, "Encrypt to an OpenPGP message for recipients with only gpg (gpg -d reads it), or decrypt one written by gpg --symmetric, password only")
+	jweOpt := getopt.FlagLong(&options.JWE, "jwe", 0, "Encrypt a small payload to a JWE for JOSE libraries, --jwe=compact (the default) or --jwe=json, or decrypt one with -d --jwe").SetOptional()
+	getopt.FlagLong(&options.NoHeuristics, "no-heuristics", 0, "Do not warn when the source of an encryption looks already encrypted")
+	getopt.FlagLong(&options.SingleInstance, "single-instance", 0, "Skip the job (exit code 75) if the same job - operation, source, and target - is already running, for cron")
+	getopt.FlagLong(&maxOutputSize, "max-output-size", 0, "Fail, writing nothing, if the target would be larger than this, e.g. 500MB or 2TB")
+	getopt.FlagLong(&options.PreCommand, "pre-cmd", 0, "Run this command before the job, which does not start if it fails ({source} and {target} are replaced)")
+	getopt.FlagLong(&options.PostCommand, "post-cmd", 0, "Run this command after the job, replacing {source}, {target}, {hash} (the target's SHA256), and {status} (ok or failed)")
+	getopt.FlagLong(&options.HookTimeout, "hook-timeout", 0, "Kill a --pre-cmd or --post-cmd still running after this long (e.g. 30s, 0 is unlimited, default 10m)")
+	getopt.FlagLong(&options.Tar, "tar", 0, "Encrypt a directory tree as one file (a tar of it, keeping paths and modes), or with -d extract one into a directory")
+	waitForEntropyOpt := getopt.FlagLong(&options.WaitForEntropy, "wait-for-entropy", 0, "Wait this long (default 5m) for the system's random number generator to be seeded, for jobs run early in boot or in new VMs, failing if it is not").SetOptional()
+	getopt.FlagLong(&followSymlinks, "follow-symlinks", 0, "--tar: archive what symbolic links point to, under the link's name (links that point nowhere or back up the tree stay links)")
+	getopt.FlagLong(&preserveSymlinks, "preserve-symlinks", 0, "--tar: archive symbolic links as links, their targets as they read (the default)")
+	getopt.FlagLong(&skipSymlinks, "skip-symlinks", 0, "--tar: leave symbolic links out of the archive")
+	getopt.FlagLong(&options.ZstdDictionary, "dictionary", 0, "--tar --compress=zstd: compress every entry as a frame of its own, with a dictionary trained from the directory's files (format 1.17)")
+	getopt.FlagLong(&options.TempDirectory, "temp-dir", 0, "Make temporary files (previews, files for the TPM and PKCS#11 tools) in this directory, e.g. one on an encrypted volume, instead of the system's")
+	getopt.FlagLong(&options.TranscriptFilename, "transcript", 0, "Write a record of the job to this file as JSON - its effective options, the header it wrote or read, versions, timings, and the machine - never keys or passwords")
 	getopt.FlagLong(&options.ForceOperation, "force", 'f', "Should optional operations (e.g. file overwriting) be forced")
+	getopt.FlagLong(&options.JSONOutput, "json", 0, "capabilities and inspect: write structured JSON instead of text")
+	getopt.FlagLong(&options.EmailTo, "email-to", 0, "wrap-email: an address the draft email is to (repeatable, or comma separated)")
+	getopt.FlagLong(&options.EmailSubject, "email-subject", 0, "wrap-email: the subject of the draft email (defaults to the attachment's name)")
+	getopt.FlagLong(&options.Sequential, "sequential", 0, "--verify: read the file once front to back without seeking, for optical and write-once media")
+	getopt.FlagLong(&options.ProgressFilename, "progress-file", 0, "--verify --sequential: save the position here so an interrupted verification resumes (implies --sequential)")
+	getopt.FlagLong(&options.CertificateFilename, "certificate", 0, "--verify --sequential: write a certificate of verification to this file as JSON (implies --sequential)")
+	getopt.FlagLong(&options.ReleaseManifest, "manifest", 0, "verify-binary, self-update, and --check-update: the signed release manifest, a file or https URL (its signature is <manifest>.sig) - hash: the checksum manifest to write, or to --check")
+	getopt.FlagLong(&options.ManifestFormat, "manifest-format", 0, "hash: write the manifest as gnu (sha256sum) or bsd (SHA256 (file) = ...) lines, --check reads either")
+	getopt.FlagLong(&options.CheckChecksums, "check", 0, "hash: check the files a checksum manifest lists, as sha256sum -c does - report: check a report's signature against --signer")
+	getopt.FlagLong(&options.NoHashCache, "no-cache", 0, "hash: hash every file for --manifest and --check, not only those whose size, modification time, or inode changed")
+	getopt.FlagLong(&options.MerkleTreeHash, "tree-hash", 0, "Print a Merkle root over --chunksize chunks, of a file with hash, or of the plaintext as it is encrypted or decrypted")
+	getopt.FlagLong(&options.TreeProofRange, "tree-proof", 0, "hash --tree-hash and prove: write a JSON proof of bytes START-END (offsets, or sizes such as 1GB-1100MB), prove's carries the plaintext of those chunks")
+	getopt.FlagLong(&options.TreeRoot, "tree-root", 0, "verify-proof: the Merkle root the file is known by, the proof is checked against it")
+	getopt.FlagLong(&options.ListenAddress, "listen", 0, "serve-file: the address to serve the plaintext on, host:port or :port for every interface (defaults to "+defaultListenAddress+")")
+	getopt.FlagLong(&options.TokenFilename, "token-file", 0, "serve-file: a file whose first line is the token requests must carry (or $"+serveTokenEnvironmentVariable+", a random token is printed without either)")
+	getopt.FlagLong(&options.ReleaseKey, "release-key", 0, "verify-binary, self-update, and --check-update: the release public key, base64 or ssh-ed25519 (defaults to the key built into release binaries)")
+	getopt.FlagLong(&options.SigningKey, "sign", 0, "Sign the encrypted file (or with report, the report) with this Ed25519 private key file (see keygen --signing), or an OpenSSH ed25519 key")
+	getopt.FlagLong(&options.SignerKeys, "signer", 0, "Decrypt only files signed by this Ed25519 public key (base64 or ssh-ed25519), or a file of them (repeatable) - report --check: the key the report must be signed with")
+	getopt.FlagLong(&options.DetachedSignature, "detached-signature", 0, "Write the signature to this file rather than into the encrypted one, or read it from here when decrypting (report: where the report's signature goes, defaults to <target>.sig)")
+	getopt.FlagLong(&options.Signing, "signing", 0, "keygen: generate an Ed25519 signing key for --sign rather than an identity")
+	getopt.FlagLong(&options.PostQuantum, "post-quantum", 0, "keygen: generate a hybrid ML-KEM-768 + X25519 keypair, for archives that must stay secret for decades")
+	getopt.FlagLong(&options.ScrubMaxRuntime, "max-runtime", 0, "scrub: stop starting new work after this long (e.g. 30m, 0 is unlimited)")
+	getopt.FlagLong(&options.ScrubMaxBytes, "max-bytes", 0, "scrub: stop starting new work after reading this many bytes (0 is unlimited)")
+	getopt.FlagLong(&options.ScrubStateFilename, "state-file", 0, "scrub: the file verification history is kept in (defaults to "+encryptor.DefaultScrubStateFilename+" in the directory)")
+	getopt.FlagLong(&options.ScrubSamplePercent, "sample", 0, "scrub and report: the percentage of checksummed chunks to verify in each file")
+	getopt.FlagLong(&options.ReportFormat, "report-format", 0, "report: write the report as json or html (ready to print or save as PDF), defaults to html for a .html target and json otherwise")
+	getopt.FlagLong(&options.ShredPasses, "passes", 0, "shred: overwrite with random data this many times before unlinking (1 is enough for any drive made this century)")
+	getopt.FlagLong(&options.ShredInclude, "include", 0, "shred: in a directory, only shred files whose names match this pattern, e.g. '*.csv' (repeatable, or comma separated)")
+	getopt.FlagLong(&options.ShredExclude, "exclude", 0, "shred: in a directory, leave files whose names match this pattern alone, e.g. '*.enc' (repeatable, or comma separated)")
+	getopt.FlagLong(&options.DryRun, "dry-run", 0, "shred: list what would be shredded and change nothing")
+	getopt.FlagLong(&soakSize, "size", 0, "soak: write, encrypt, and verify this much synthetic data each round, e.g. 100G (the device needs twice as much free)")
+	getopt.FlagLong(&options.SoakHours, "hours", 0, "soak: keep starting rounds until this many hours have passed, e.g. 4 or 0.5 (0 runs one round)")
+	getopt.FlagLong(&options.ScrubRandomOrder, "random-order", 0, "scrub: verify each file's chunks in a shuffled order rather than front to back")
+
+	handleHelpCommand(os.Args)
 
-	getopt.Parse()
+	// A leading subcommand selects the operation and is not passed to the parser
+	args := os.Args
+	subcommand := ""
+
+	if len(args) > 1 {
+		if _, ok := subcommands[args[1]]; ok {
+			subcommand = args[1]
+			args = append([]string{args[0]}, args[2:]...)
+		}
+	}
+
+	getopt.CommandLine.Parse(args)
 
 	if true == help {
 		showHelp()
@@ -92,39 +400,179 @@ func processOpts(options *EncryptorOptions) error {
 		os.Exit(0)
 	}
 
+	if true == cryptoInfo {
+		err := printCryptoInfo(options)
+		if err != nil {
+			gLoggerStderr.Println("An error was encountered reporting crypto acceleration: ", err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
 	// Default operational behavior is encryption
-	options.Operation = Encryption
+	options.Operation = encryptor.Encryption
 
 	if decrypting == true && hashing == true {
 		gLoggerStderr.Println("Hashing and decryption cannot be specified simultaneously")
 		os.Exit(1)
+	} else if verifying == true && (decrypting == true || hashing == true) {
+		gLoggerStderr.Println("Verification cannot be combined with hashing or decryption")
+		os.Exit(1)
 	} else if decrypting == true {
-		options.Operation = Decryption
+		options.Operation = encryptor.Decryption
 	} else if hashing == true {
-		options.Operation = FileHashing
+		options.Operation = encryptor.FileHashing
+	} else if verifying == true {
+		options.Operation = encryptor.Verification
+	}
+
+	// A preview is a partial decryption, so -d is allowed but not needed
+	if options.PreviewBytes != 0 {
+		if hashing == true || verifying == true {
+			gLoggerStderr.Println("A preview cannot be combined with hashing or verification")
+			os.Exit(1)
+		}
+
+		if options.PreviewBytes < 0 {
+			gLoggerInfo.Println("Preview bytes must be at least 1")
+			options.PreviewBytes = 1
+		}
+
+		options.Operation = encryptor.Previewing
+	}
+
+	if checkingUpdate == true {
+		if decrypting == true || hashing == true || verifying == true || options.PreviewBytes != 0 || subcommand != "" {
+			gLoggerStderr.Println("Checking for an update cannot be combined with other operations")
+			os.Exit(1)
+		}
+
+		options.Operation = encryptor.UpdateChecking
+	}
+
+	if subcommand != "" {
+		if decrypting == true || hashing == true || verifying == true || options.PreviewBytes != 0 {
+			gLoggerStderr.Println("Hashing, decryption, verification, and previews cannot be combined with the", subcommand, "command")
+			os.Exit(1)
+		}
+
+		options.Operation = subcommands[subcommand]
+	}
+
+	// For the hash command --manifest is a checksum manifest, not a release's
+	if options.Operation == encryptor.FileHashing {
+		options.ChecksumManifest, options.ReleaseManifest = options.ReleaseManifest, ""
+	}
+
+	if bandwidthSchedule != "" {
+		schedule, err := encryptor.ParseBandwidthSchedule(bandwidthSchedule)
+		if err != nil {
+			gLoggerStderr.Println("Invalid bandwidth schedule: ", err.Error())
+			os.Exit(1)
+		}
+
+		options.Bandwidth = schedule
+	}
+
+	for _, symlinks := range []struct {
+		given    bool
+		behavior string
+	}{{followSymlinks, encryptor.SymlinksFollow}, {preserveSymlinks, encryptor.SymlinksPreserve}, {skipSymlinks, encryptor.SymlinksSkip}} {
+		if !symlinks.given {
+			continue
+		}
+
+		if options.Symlinks != "" {
+			gLoggerStderr.Println("Only one of --follow-symlinks, --preserve-symlinks, and --skip-symlinks can be given")
+			os.Exit(1)
+		}
+
+		options.Symlinks = symlinks.behavior
+	}
+
+	if soakSize != "" {
+		soakSizeBytes, err := encryptor.ParseByteSize(soakSize)
+		if err != nil || soakSizeBytes == 0 {
+			gLoggerStderr.Println("Invalid soak size: ", soakSize)
+			os.Exit(1)
+		}
+
+		options.SoakSizeBytes = soakSizeBytes
+	}
+
+	if maxOutputSize != "" {
+		maxOutputBytes, err := encryptor.ParseByteSize(maxOutputSize)
+		if err != nil || maxOutputBytes == 0 {
+			gLoggerStderr.Println("Invalid maximum output size: ", maxOutputSize)
+			os.Exit(1)
+		}
+
+		options.MaxOutputBytes = maxOutputBytes
+	}
+
+	err := loadKeyMaterialFromEnvironment(options)
+	if err != nil {
+		gLoggerStderr.Println("Invalid key material in the environment: ", err.Error())
+		os.Exit(1)
 	}
 
 	// Exercise some constraints on worker
-	if options.Readers < 1 || options.Readers > ReadersLimit {
-		gLoggerStdout.Println("Read workers must be between ", ReadersLimit, " and 1")
-		options.Readers = uint8(math.Max(float64(1), math.Min(float64(options.Readers), float64(ReadersLimit))))
+	if options.Readers < 1 || options.Readers > encryptor.ReadersLimit {
+		gLoggerInfo.Println("Read workers must be between ", encryptor.ReadersLimit, " and 1")
+		options.Readers = uint8(math.Max(float64(1), math.Min(float64(options.Readers), float64(encryptor.ReadersLimit))))
+	}
+	if options.Executors < 1 || options.Executors > encryptor.ExecutorsLimit {
+		gLoggerInfo.Println("Execute workers must be between ", encryptor.ExecutorsLimit, " and 1")
+		options.Executors = uint8(math.Max(float64(1), math.Min(float64(options.Executors), float64(encryptor.ExecutorsLimit))))
+	}
+	if options.Writers < 1 || options.Writers > encryptor.WritersLimit {
+		gLoggerInfo.Println("Write workers is currently restricted to ", encryptor.WritersLimit)
+		options.Writers = uint8(math.Max(float64(1), math.Min(float64(options.Writers), float64(encryptor.WritersLimit))))
+	}
+
+	if options.Compressors > encryptor.CompressorsLimit {
+		gLoggerInfo.Println("Compression workers must be between 0 (as many as executors) and ", encryptor.CompressorsLimit)
+		options.Compressors = encryptor.CompressorsLimit
+	}
+
+	if options.PoolWorkers > encryptor.PoolWorkersLimit {
+		gLoggerInfo.Println("Pool workers must be between 0 (separate workers) and ", encryptor.PoolWorkersLimit)
+		options.PoolWorkers = encryptor.PoolWorkersLimit
 	}
-	if options.Executors < 1 || options.Executors > ExecutorsLimit {
-		gLoggerStdout.Println("Execute workers must be between ", ExecutorsLimit, " and 1")
-		options.Executors = uint8(math.Max(float64(1), math.Min(float64(options.Executors), float64(ExecutorsLimit))))
+
+	if options.ChunkSizeMB < encryptor.ChunkSizeMin || options.ChunkSizeMB > encryptor.ChunkSizeMax {
+		gLoggerInfo.Println("Chunk size (MB) must between ", encryptor.ChunkSizeMin, " and ", encryptor.ChunkSizeMax)
+		options.ChunkSizeMB = uint(math.Max(float64(encryptor.ChunkSizeMin), math.Min(float64(options.ChunkSizeMB), float64(encryptor.ChunkSizeMax))))
+	}
+
+	if options.BatchChunks > encryptor.BatchChunksMax {
+		gLoggerInfo.Println("Batch chunks must be between 0 (automatic) and ", encryptor.BatchChunksMax)
+		options.BatchChunks = encryptor.BatchChunksMax
 	}
-	if options.Writers < 1 || options.Writers > WritersLimit {
-		gLoggerStdout.Println("Write workers is currently restricted to ", WritersLimit)
-		options.Writers = uint8(math.Max(float64(1), math.Min(float64(options.Writers), float64(WritersLimit))))
+
+	if options.PrefetchChunks > encryptor.PrefetchDepthMax {
+		gLoggerInfo.Println("Prefetch chunks must be between 0 (off) and ", encryptor.PrefetchDepthMax)
+		options.PrefetchChunks = encryptor.PrefetchDepthMax
+	}
+
+	if options.PartSizeMB < encryptor.PartSizeMinMB || options.PartSizeMB > encryptor.PartSizeMaxMB {
+		gLoggerInfo.Println("Part size (MB) must be between ", encryptor.PartSizeMinMB, " and ", encryptor.PartSizeMaxMB)
+		options.PartSizeMB = uint(math.Max(float64(encryptor.PartSizeMinMB), math.Min(float64(options.PartSizeMB), float64(encryptor.PartSizeMaxMB))))
+	}
+
+	if options.WriteBufferKB > encryptor.WriteBufferMaxKB {
+		gLoggerInfo.Println("Write buffer (KB) must be between 0 (vectored writes) and ", encryptor.WriteBufferMaxKB)
+		options.WriteBufferKB = encryptor.WriteBufferMaxKB
 	}
 
-	if options.ChunkSizeMB < ChunkSizeMin || options.ChunkSizeMB > ChunkSizeMax {
-		gLoggerStdout.Println("Chunk size (MB) must between ", ChunkSizeMin, " and ", ChunkSizeMax)
-		options.ChunkSizeMB = uint(math.Max(float64(ChunkSizeMin), math.Min(float64(options.ChunkSizeMB), float64(ChunkSizeMax))))
+	if options.ScrubSamplePercent < 1 || options.ScrubSamplePercent > 100 {
+		gLoggerInfo.Println("Sample percentage must be between 1 and 100")
+		options.ScrubSamplePercent = uint(math.Max(float64(1), math.Min(float64(options.ScrubSamplePercent), float64(100))))
 	}
 
-	// We have two filenames leftover possibly
-	args := getopt.Args()
+	// We have two filenames leftover possibly, or more sources than one
+	args = getopt.Args()
 	length := len(args)
 
 	if length >= 1 {
@@ -135,10 +583,61 @@ func processOpts(options *EncryptorOptions) error {
 		options.TargetFilename = args[1]
 	}
 
+	// encryptor -p pw *.log encrypts each file to <name>.enc
 	if length > 2 {
-		gLoggerStderr.Println("Only two unspecified arguments can be passed - source filename and target filename\n", length, "unspecified arguments were passed")
-		gLoggerStderr.Println(args)
-		os.Exit(1)
+		if len(sourceFilenames) > 0 || targetFilename != "" {
+			gLoggerStderr.Println("Several source filenames can be passed with --source or as unflagged arguments, not both, and then no target filename")
+			os.Exit(1)
+		}
+
+		options.SourceFilenames = args
+		options.SourceFilename, options.TargetFilename = "", ""
+	}
+
+	// Flagged filenames and unflagged filenames are alternatives, not additions
+	if len(sourceFilenames) > 1 {
+		if length >= 1 || targetFilename != "" {
+			gLoggerStderr.Println("Several source filenames can be passed with --source or as unflagged arguments, not both, and then no target filename")
+			os.Exit(1)
+		}
+
+		options.SourceFilenames = sourceFilenames
+	} else if len(sourceFilenames) == 1 {
+		if length >= 1 {
+			gLoggerStderr.Println("A source filename cannot be passed both with --source and as an unflagged argument")
+			os.Exit(1)
+		}
+
+		options.SourceFilename = sourceFilenames[0]
+	}
+
+	if targetFilename != "" {
+		if length >= 2 || (length == 1 && len(sourceFilenames) == 0) {
+			gLoggerStderr.Println("A target filename cannot be passed both with --target and as an unflagged argument")
+			os.Exit(1)
+		}
+
+		options.TargetFilename = targetFilename
+	}
+
+	// --store-name alone seals the name, a name in the clear says something of the file to anyone who has it
+	if storeNameOpt.Seen() && options.StoreName == "" {
+		options.StoreName = encryptor.NameStoreSealed
+	}
+
+	// --wait-for-entropy alone waits long enough for any VM to finish booting, a limit given is kept to
+	if waitForEntropyOpt.Seen() && options.WaitForEntropy == 0 {
+		options.WaitForEntropy = defaultEntropyWait
+	}
+
+	// --jwe alone is the compact serialization, the one most JOSE libraries parse by default
+	if jweOpt.Seen() && options.JWE == "" {
+		options.JWE = encryptor.JWECompact
+	}
+
+	// Concurrent readers hurt rather than help on spinning disks
+	if !readersOpt.Seen() && options.SourceFilename != "" {
+		options.Readers = encryptor.TuneReadersForStorage(options.SourceFilename, options.Readers)
 	}
 
 	return nil
@@ -147,12 +646,64 @@ func processOpts(options *EncryptorOptions) error {
 func showHelp() {
 	gLoggerStdout.Println("\nExample: encryptor [flagged options][source filename][target filename]")
 	gLoggerStdout.Println("\nencryptor -d -f --password=\"my password\" my_encrypted_file.enc my_decrypted_file")
+	gLoggerStdout.Println("\nencryptor scrub --max-runtime=30m --sample=10 /archive/directory")
+	gLoggerStdout.Println("\nencryptor --single-instance --keyfile=backup.key source destination.enc")
+	gLoggerStdout.Println("\nencryptor --wait-for-entropy=2m --keyfile=/etc/backup.key /srv/data.tar /backups/data.tar.enc")
+	gLoggerStdout.Println("\nencryptor -d --preview=4096 --temp-dir=/mnt/secure/tmp --keyfile=backup.key backup.enc")
+	gLoggerStdout.Println("\nencryptor --store-name --keyfile=backup.key quarterly-report.pdf temp.enc")
+	gLoggerStdout.Println("\nencryptor -d --restore-name --keyfile=backup.key temp.enc")
+	gLoggerStdout.Println("\nencryptor --max-output-size=50GB --keyfile=backup.key source destination.enc")
+	gLoggerStdout.Println("\nencryptor --keyfile=backup.key --post-cmd=\"aws s3 cp {target} s3://backups/\" source destination.enc")
+	gLoggerStdout.Println("\nencryptor --keyfile=backup.key --transcript=destination.enc.json source destination.enc")
+	gLoggerStdout.Println("\nencryptor --keyfile=backup.key big.iso gs://bucket/big.iso.enc")
+	gLoggerStdout.Println("\nencryptor --compress=zstd --keyfile=backup.key database.sql database.sql.enc")
+	gLoggerStdout.Println("\nencryptor --keyfile=backup.key *.log")
+	gLoggerStdout.Println("\nencryptor --tar --keyfile=backup.key /home/me/projects projects.enc")
+	gLoggerStdout.Println("\nencryptor --tar --follow-symlinks --keyfile=backup.key /srv/site site.enc")
+	gLoggerStdout.Println("\nencryptor -d --keyfile=backup.key projects.enc /restore/projects")
+	gLoggerStdout.Println("\nencryptor -d --head-first --keyfile=backup.key movie.mkv.enc - | mpv -")
+	gLoggerStdout.Println("\nencryptor --plugin-recipient=vault:transit/backups source destination.enc")
+	gLoggerStdout.Println("\nencryptor --verify --sequential --progress-file=disc1.progress --certificate=disc1.json /media/cdrom/backup.enc")
+	gLoggerStdout.Println("\nencryptor hash /archive/directory")
+	gLoggerStdout.Println("\nencryptor hash --manifest=SHA256SUMS /archive/directory")
+	gLoggerStdout.Println("\nencryptor hash --check SHA256SUMS")
+	gLoggerStdout.Println("\nencryptor hash --tree-hash --tree-proof=1GB-1100MB big.iso")
+	gLoggerStdout.Println("\nencryptor prove --tree-proof=1GB-1100MB --keyfile=backup.key big.iso.enc proof.json")
+	gLoggerStdout.Println("\nencryptor verify-proof --tree-root=<root> proof.json")
+	gLoggerStdout.Println("\nencryptor serve-file --keyfile=backup.key --listen=:8080 --token-file=serve.token movie.mkv.enc")
+	gLoggerStdout.Println("\nencryptor report --keyfile=backup.key --sign=audit.key /archive/directory report.html")
+	gLoggerStdout.Println("\nencryptor --keyfile=backup.key payroll.csv payroll.csv.enc && encryptor shred payroll.csv")
+	gLoggerStdout.Println("\nencryptor soak --size=100G --hours=4 /mnt/new-backup-disk")
+	gLoggerStdout.Println("\nencryptor capabilities --json")
+	gLoggerStdout.Println("\nencryptor --crypto-info")
+	gLoggerStdout.Println("\nencryptor inspect my_encrypted_file.enc")
+	gLoggerStdout.Println("\nencryptor recover --keyhex=<key> damaged_file.enc salvaged_file")
+	gLoggerStdout.Println("\nencryptor verify-binary --manifest=https://example.com/releases/1.2.0/manifest.json")
+	gLoggerStdout.Println("\nencryptor store-password --keyring=nightly-backups")
+	gLoggerStdout.Println("\nencryptor keygen alice.key")
+	gLoggerStdout.Println("\nencryptor --check-update")
+	gLoggerStdout.Println("\nencryptor self-update")
+	gLoggerStdout.Println("\nencryptor --openpgp --password=\"my password\" my_document.pdf my_document.pdf.gpg")
+	gLoggerStdout.Println("\nencryptor wrap-email --email-to=someone@example.com my_document.pdf my_document.eml")
 	gLoggerStdout.Println("\n\tOptions are parsed gnu style, e.g. --option=value or -ovalue and must be BEFORE unflagged arguments")
+	gLoggerStdout.Println("\n\tMore on " + strings.Join(helpTopicNames(), ", ") + " with examples: encryptor help <topic>")
 	gLoggerStdout.Println("")
-	getopt.Usage()
+
+	// Help was explicitly requested, so it is the contract output and belongs on stdout
+	getopt.PrintUsage(os.Stdout)
 }
 
 func showVersionInfo() {
-	versionInfo := "version: " + gVersion + " commit: " + gGitCommit
+	versionInfo := "version: " + gVersion + " commit: " + gGitCommit + " fips: " + fipsStatus(&gOptions)
 	gLoggerStdout.Println(versionInfo)
 }
+
+func fipsStatus(options *EncryptorOptions) string {
+	if encryptor.FIPSBuild() {
+		return "enabled (build)"
+	} else if options.FIPS {
+		return "enabled"
+	}
+
+	return "disabled"
+}
@@ -0,0 +1,78 @@
+package encryptor
+
+import (
+	"golang.org/x/sys/cpu"
+	"runtime"
+)
+
+/*
+	Whether the Go crypto packages take their hardware paths on this
+	machine (encryptor --crypto-info). AES-GCM is only fast with both AES
+	instructions and a carry-less multiply for GHASH - AES-NI and PCLMULQDQ
+	on x86, the ARMv8 Cryptography Extensions (AES and PMULL) on ARM.
+	Without them Go falls back to constant time software AES, many times
+	slower, where ChaCha20-Poly1305 (XChaCha20-Poly1305 here) is designed
+	to be fast with nothing but ordinary vector instructions
+
+	AES-256-GCM-SIV uses the AES instructions, its POLYVAL is in software
+	either way. The checks follow what the standard library and x/crypto
+	check, they cannot see a runtime that was built with GODEBUG or tags
+	that turn assembly off
+*/
+
+type CryptoAcceleration struct {
+	Architecture      string
+	AES               bool   // AES instructions (AES-NI, ARMv8 AES, CPACF)
+	CarrylessMultiply bool   // PCLMULQDQ or PMULL, for GHASH
+	AESGCMHardware    bool   // AES-GCM runs in hardware, it needs both of the above
+	VectorUnit        string // What ChaCha20-Poly1305 runs on, e.g. AVX2 or NEON, empty for none
+}
+
+func GetCryptoAcceleration() CryptoAcceleration {
+	acceleration := CryptoAcceleration{Architecture: runtime.GOARCH}
+
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		acceleration.AES = cpu.X86.HasAES
+		acceleration.CarrylessMultiply = cpu.X86.HasPCLMULQDQ
+
+		if cpu.X86.HasAVX2 {
+			acceleration.VectorUnit = "AVX2"
+		} else if cpu.X86.HasSSSE3 {
+			acceleration.VectorUnit = "SSSE3"
+		}
+	case "arm64":
+		acceleration.AES = cpu.ARM64.HasAES
+		acceleration.CarrylessMultiply = cpu.ARM64.HasPMULL
+		acceleration.VectorUnit = "NEON" // Every ARMv8 core has it
+	case "s390x":
+		acceleration.AES = cpu.S390X.HasAES && cpu.S390X.HasAESCTR
+		acceleration.CarrylessMultiply = cpu.S390X.HasGHASH
+		if cpu.S390X.HasVX {
+			acceleration.VectorUnit = "VX"
+		}
+	case "ppc64le":
+		// POWER8 and later, the oldest Go supports, all have vector AES and carry-less multiply
+		acceleration.AES = true
+		acceleration.CarrylessMultiply = true
+		acceleration.VectorUnit = "VSX"
+	}
+
+	acceleration.AESGCMHardware = acceleration.AES && acceleration.CarrylessMultiply
+
+	return acceleration
+}
+
+// Does the cipher (empty is DefaultCipher) run in slow software on this machine? Unknown ciphers do not
+func (acceleration CryptoAcceleration) SoftwareFallback(cipher string) bool {
+	suite, err := cipherSuiteByName(cipher)
+	if err != nil || suite.Cipher != AES {
+		return false
+	}
+
+	if suite.Mode == GCM {
+		return !acceleration.AESGCMHardware
+	}
+
+	return !acceleration.AES
+}
@@ -0,0 +1,468 @@
+package encryptor
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	A directory is encrypted as one file by writing a tar of it through
+	an EncryptWriter, so the whole tree is a single portable artifact and
+	its file names and sizes are as secret as its contents. The header
+	says the plaintext is a tar (ContentTar), which encryptor -d uses to
+	extract it again - older versions and other tools just decrypt it to
+	the tar, which any tar can unpack
+
+	Paths are stored relative to the directory (which is ./) with /
+	between elements, with their permission bits and modification times.
+	Regular files, directories, and symbolic links are archived, anything
+	else (devices, sockets, pipes) fails the job rather than being left
+	out silently. Owners are recorded but not restored, and neither are
+	setuid, setgid, or sticky bits
+
+	Options.Symlinks says what a symbolic link is archived as. By default
+	(SymlinksPreserve) it is a link, its target stored as it reads, not
+	resolved, so extracting it makes the same link. SymlinksSkip leaves
+	links out. SymlinksFollow archives what a link points to under the
+	link's name - a file's contents, or a directory and all beneath it -
+	with the link's target kept in a PAX record (paxSymlinkTarget) so the
+	archive still says where it came from. A link that points nowhere,
+	or to a directory it is inside of (which would archive forever), is
+	preserved as a link instead
+
+	Extraction refuses names that are absolute or climb out with .., and
+	never writes through a symbolic link it did not just create in a
+	parent directory, so an archive cannot write outside the directory
+	it is extracted into. A new directory is extracted beside its final
+	name and renamed into place once the archive has authenticated, so
+	a failed or tampered extraction leaves nothing behind
+*/
+
+const ContentTar = "tar"
+
+const (
+	SymlinksPreserve = "preserve"
+	SymlinksFollow   = "follow"
+	SymlinksSkip     = "skip"
+)
+
+// Vendor PAX record holding the target of the link an entry was followed through
+const paxSymlinkTarget = "ENCRYPTOR.symlink"
+
+func checkSymlinks(symlinks string) error {
+	switch symlinks {
+	case "", SymlinksPreserve, SymlinksFollow, SymlinksSkip:
+		return nil
+	}
+
+	return fmt.Errorf("symbolic links are preserved, followed, or skipped, not %q", symlinks)
+}
+
+// Writes an encrypted tar of directory to target
+func encryptDirectory(directory string, target io.Writer, options *Options) error {
+	if target == nil || options == nil {
+		return errors.New("target or options is nil")
+	}
+
+	err := checkSymlinks(options.Symlinks)
+	if err != nil {
+		return err
+	}
+
+	stats, err := os.Stat(directory)
+	if err != nil {
+		return err
+	}
+
+	if !stats.IsDir() {
+		return fmt.Errorf("%s is not a directory", directory)
+	}
+
+	dictionary, err := trainArchiveDictionary(directory, options)
+	if err != nil {
+		return err
+	}
+
+	writer, err := newEncryptWriter(target, withSourceName(options, directory), ContentTar, dictionary)
+	if err != nil {
+		return err
+	}
+
+	walk := archiveWalk{archive: tar.NewWriter(writer), symlinks: options.Symlinks}
+	if dictionary != nil {
+		walk.endEntry = writer.endFrame
+	}
+
+	// The directory itself is ./, so it keeps its permission and time too
+	err = walk.add(directory, ".", stats, "")
+	if err != nil {
+		return err
+	}
+
+	archive := walk.archive
+
+	err = archive.Close()
+	if err != nil {
+		return fmt.Errorf("could not write archive: %w", err)
+	}
+
+	return writer.Close()
+}
+
+type archiveWalk struct {
+	archive   *tar.Writer
+	symlinks  string
+	ancestors []string     // Resolved paths of the directories being archived, when following links
+	endEntry  func() error // Called once each entry is written, padding and all
+}
+
+// Archives path as name, and everything beneath it in lexical order, followed is the link path was reached through
+func (walk *archiveWalk) add(path string, name string, info os.FileInfo, followed string) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch walk.symlinks {
+		case SymlinksSkip:
+			return nil
+		case SymlinksFollow:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			// Dangling and cyclic links are kept as links
+			target, err := os.Stat(path)
+			if err == nil && !(target.IsDir() && walk.isAncestor(path)) {
+				return walk.add(path, name, target, link)
+			}
+		}
+	}
+
+	err := archiveEntry(walk.archive, path, name, info, followed)
+	if err == nil && walk.endEntry != nil {
+		if err = walk.archive.Flush(); err == nil {
+			err = walk.endEntry()
+		}
+	}
+
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	if walk.symlinks == SymlinksFollow {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+
+		walk.ancestors = append(walk.ancestors, resolved)
+		defer func() {
+			walk.ancestors = walk.ancestors[:len(walk.ancestors)-1]
+		}()
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		entryName := entry.Name()
+		if name != "." {
+			entryName = name + "/" + entryName
+		}
+
+		err = walk.add(filepath.Join(path, entry.Name()), entryName, info, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (walk *archiveWalk) isAncestor(path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	for _, ancestor := range walk.ancestors {
+		if ancestor == resolved {
+			return true
+		}
+	}
+
+	return false
+}
+
+func archiveEntry(archive *tar.Writer, path string, name string, info os.FileInfo, followed string) error {
+	link := ""
+
+	switch {
+	case info.Mode().IsRegular(), info.IsDir():
+	case info.Mode()&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s is not a file, directory, or symbolic link and cannot be archived", path)
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("could not archive %s: %w", path, err)
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if followed != "" {
+		header.PAXRecords = map[string]string{paxSymlinkTarget: followed}
+	}
+
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("could not archive %s: %w", path, err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	// A file that grows while it is read is archived as it was when its header was written
+	_, err = io.CopyN(archive, file, header.Size)
+	if err != nil {
+		return fmt.Errorf("could not archive %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Extracts an encrypted tar from source into directory, which must not exist unless overwriting
+func decryptDirectory(source io.Reader, directory string, options *Options) error {
+	if source == nil || options == nil {
+		return errors.New("source or options is nil")
+	}
+
+	reader, err := NewDecryptReader(source, options)
+	if err != nil {
+		return err
+	}
+
+	if reader.header.Content != ContentTar {
+		return errors.New("the encrypted file is not a directory archive")
+	}
+
+	directory = filepath.Clean(directory)
+
+	stats, err := os.Lstat(directory)
+	if err == nil {
+		if !options.ForceOperation {
+			return fmt.Errorf("%s: %w", directory, ErrTargetExists)
+		}
+
+		if !stats.IsDir() {
+			return fmt.Errorf("%s is not a directory", directory)
+		}
+
+		return extractArchive(reader, directory)
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	partial, err := os.MkdirTemp(filepath.Dir(directory), "."+filepath.Base(directory)+".partial-")
+	if err != nil {
+		return err
+	}
+
+	err = extractArchive(reader, partial)
+	if err == nil {
+		err = os.Rename(partial, directory)
+	}
+
+	if err != nil {
+		_ = os.RemoveAll(partial)
+		return err
+	}
+
+	return nil
+}
+
+type extractedDirectory struct {
+	path     string
+	mode     os.FileMode
+	modified time.Time
+}
+
+func extractArchive(reader *DecryptReader, directory string) error {
+	archive := tar.NewReader(reader)
+
+	// Set once everything is in them, writing a file changes a directory's time and may need its permission
+	var directories []extractedDirectory
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("could not read archive: %w", err)
+		}
+
+		path, err := archivePath(directory, header.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if stats, statErr := os.Lstat(path); statErr == nil && !stats.IsDir() {
+				err = os.Remove(path)
+			}
+
+			if err == nil {
+				err = os.MkdirAll(path, 0700)
+			}
+
+			if err == nil {
+				directories = append(directories, extractedDirectory{path, mode, header.ModTime})
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(archive, path, mode, header.ModTime)
+		case tar.TypeSymlink:
+			err = replaceWithLink(path, func() error { return os.Symlink(header.Linkname, path) })
+		case tar.TypeLink:
+			var linked string
+			if linked, err = archivePath(directory, header.Linkname); err == nil {
+				err = replaceWithLink(path, func() error { return os.Link(linked, path) })
+			}
+		default:
+			err = fmt.Errorf("%s is not a file, directory, or link and cannot be extracted", header.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// The tar ends before the stream does, the rest holds what proves the stream authentic
+	_, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		return err
+	}
+
+	for i := len(directories) - 1; i >= 0; i-- {
+		err = os.Chmod(directories[i].path, directories[i].mode)
+		if err == nil {
+			err = os.Chtimes(directories[i].path, directories[i].modified, directories[i].modified)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Where name is extracted to, refused if it would be outside directory or reached through a symbolic link
+func archivePath(directory string, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+
+	if name == "" || filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the archive names %q, which is outside the directory it is extracted into", name)
+	}
+
+	path := directory
+	elements := strings.Split(clean, string(filepath.Separator))
+
+	for _, element := range elements[:len(elements)-1] {
+		path = filepath.Join(path, element)
+
+		stats, err := os.Lstat(path)
+		if err == nil && stats.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("the archive names %q, which is reached through a symbolic link", name)
+		}
+	}
+
+	return filepath.Join(directory, clean), nil
+}
+
+func extractFile(source io.Reader, path string, mode os.FileMode, modified time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Never written through, a link here may point anywhere
+	if stats, err := os.Lstat(path); err == nil && !stats.Mode().IsRegular() {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, source)
+	closeErr := file.Close()
+
+	if err != nil {
+		return fmt.Errorf("could not extract %s: %w", path, err)
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, modified, modified)
+}
+
+func replaceWithLink(path string, link func() error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	if _, err = os.Lstat(path); err == nil {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return link()
+}
@@ -0,0 +1,621 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Azure Blob Storage blobs as sources and targets, named either way
+
+		az://<account>/<container>/<blob>
+		https://<account>.blob.core.windows.net/<container>/<blob>[?<SAS>]
+
+	They are streamed as objects.go describes, and every range is read on
+	condition that the blob's ETag is the one it had when it was opened,
+	so a blob replaced part way through fails the job rather than
+	splicing two blobs together
+
+	Writing stages a block blob a part (Options.PartSizeMB) at a time,
+	each part a block, a few of them staged at once. Blocks are numbered
+	as they are cut, so a block sent again replaces itself, and nothing
+	is visible until Close commits the block list - a failed job commits
+	nothing, and Azure discards blocks that are never committed. A blob
+	holds at most 50,000 blocks, so the part size bounds the blob's size
+	(400GB at the default 8MB). Unless Options.ForceOperation is set an
+	existing blob is refused as the writer opens, and the commit is made
+	on condition that none has appeared since. The blocks are journaled
+	as they are staged, so a run after the process is gone stages only
+	the ones Azure does not already have (see uploadjournal.go)
+
+	Credentials are the Azure credentials of Key Vault keys (see
+	azurekv.go), a client secret or a managed identity, with a token for
+	Azure Storage - or, for an https URL, the SAS token it carries, in
+	which case it is sent as it is and no credentials are looked for. An
+	az:// URL takes the SAS token in AZURE_STORAGE_SAS_TOKEN the same
+	way, as the Azure CLI does, so the token stays out of filenames (and
+	the logs they are written to). Tokens are only sent to the blob
+	endpoints of Azure's clouds, as for Key Vault
+*/
+
+// Blob endpoints of each Azure cloud, an https URL elsewhere is not a blob
+var azureBlobHosts = []string{
+	"blob.core.windows.net",
+	"blob.core.chinacloudapi.cn",
+	"blob.core.usgovcloudapi.net",
+}
+
+// The endpoint of an az:// URL's account, a variable so tests can point it at a server of their own
+var azureBlobEndpoint = "https://%s.blob.core.windows.net/"
+
+const azureStorageResource = "https://storage.azure.com"
+
+// Bearer tokens need 2017-11-09 or later
+const azureBlobAPIVersion = "2021-08-06"
+
+const azureBlobMaxBlocks = 50000
+
+// Blocks being staged at once, each holds a part in memory
+const azureBlobStagesInFlight = 4
+
+type azureBlob struct {
+	name      string // As it was given, less any SAS token, for messages
+	endpoint  string // The account's, ending in a slash
+	container string
+	blob      string
+	sas       string
+}
+
+func isAzureBlobURL(name string) bool {
+	name = strings.TrimSpace(name)
+	if strings.HasPrefix(name, "az://") {
+		return true
+	}
+
+	if !strings.HasPrefix(strings.ToLower(name), "https://") {
+		return false
+	}
+
+	parsed, err := url.Parse(name)
+	return err == nil && isAzureBlobHost(parsed.Hostname())
+}
+
+// <account>.<a blob endpoint>
+func isAzureBlobHost(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+
+	for _, host := range azureBlobHosts {
+		if strings.HasSuffix(hostname, "."+host) && !strings.Contains(strings.TrimSuffix(hostname, "."+host), ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseAzureBlobURL(blobURL string) (azureBlob, error) {
+	blobURL = strings.TrimSpace(blobURL)
+
+	if strings.HasPrefix(blobURL, "az://") {
+		parts := strings.SplitN(strings.TrimPrefix(blobURL, "az://"), "/", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" || !validAzureAccount(parts[0]) {
+			return azureBlob{}, fmt.Errorf("%q must name a blob, az://<account>/<container>/<blob>", blobURL)
+		}
+
+		sas := strings.TrimPrefix(strings.TrimSpace(os.Getenv("AZURE_STORAGE_SAS_TOKEN")), "?")
+		return azureBlob{name: blobURL, endpoint: fmt.Sprintf(azureBlobEndpoint, parts[0]), container: parts[1], blob: parts[2], sas: sas}, nil
+	}
+
+	parsed, err := url.Parse(blobURL)
+	if err != nil || parsed.Scheme != "https" || parsed.User != nil || parsed.Fragment != "" || !isAzureBlobHost(parsed.Hostname()) {
+		return azureBlob{}, errors.New("a blob URL must be https://<account>.blob.core.windows.net/<container>/<blob>")
+	}
+
+	name := "https://" + parsed.Host + parsed.EscapedPath()
+
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return azureBlob{}, fmt.Errorf("%q must name a blob, https://<account>.blob.core.windows.net/<container>/<blob>", name)
+	}
+
+	return azureBlob{name: name, endpoint: "https://" + parsed.Host + "/", container: parts[0], blob: parts[1], sas: parsed.RawQuery}, nil
+}
+
+// Storage account names are 3 to 24 lowercase letters and digits, they become a hostname
+func validAzureAccount(account string) bool {
+	if len(account) < 3 || len(account) > 24 {
+		return false
+	}
+
+	for _, c := range account {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (blob azureBlob) String() string {
+	return blob.name
+}
+
+// The blob's URL with query added, its name escaped a segment at a time
+func (blob azureBlob) url(query string) string {
+	segments := strings.Split(blob.blob, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	address := blob.endpoint + url.PathEscape(blob.container) + "/" + strings.Join(segments, "/")
+
+	for _, parameters := range []string{query, blob.sas} {
+		if parameters == "" {
+			continue
+		} else if strings.Contains(address, "?") {
+			address += "&" + parameters
+		} else {
+			address += "?" + parameters
+		}
+	}
+
+	return address
+}
+
+func checkAzureBlobOffline(blob azureBlob, options *Options) error {
+	if options.Offline {
+		return fmt.Errorf("%s is reached over the network: %w", blob, ErrOffline)
+	}
+
+	return nil
+}
+
+// Made again for every try, with a fresh token unless the URL carries a SAS token
+func azureBlobRequest(blob azureBlob, method string, query string, body []byte, headers map[string]string) (*http.Response, error) {
+	return objectRequest(func() (*http.Request, error) {
+		request, err := http.NewRequest(method, blob.url(query), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("x-ms-version", azureBlobAPIVersion)
+
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+
+		if blob.sas == "" {
+			token, err := azureAccessToken(azureStorageResource)
+			if err != nil {
+				return nil, err
+			}
+
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		return request, nil
+	})
+}
+
+// The message Azure gave with a failure, or its error code when there is no body (as for HEAD)
+func azureBlobError(response *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(response.Body, recipientsFetchLimitBytes))
+
+	var failure struct {
+		Message string `xml:"Message"`
+	}
+
+	// The message's second line is the request's ID
+	if xml.Unmarshal(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), &failure) == nil && failure.Message != "" {
+		return fmt.Errorf("%s: %s", response.Status, strings.SplitN(strings.TrimSpace(failure.Message), "\n", 2)[0])
+	}
+
+	if code := response.Header.Get("x-ms-error-code"); code != "" {
+		return fmt.Errorf("%s: %s", response.Status, code)
+	}
+
+	return errors.New(response.Status)
+}
+
+type AzureBlobReader struct {
+	rangedReader
+	blob azureBlob
+	etag string
+}
+
+func newAzureBlobReader(blobURL string, options *Options) (*AzureBlobReader, error) {
+	if options == nil {
+		return nil, errors.New("options is nil")
+	}
+
+	blob, err := parseAzureBlobURL(blobURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkAzureBlobOffline(blob, options); err != nil {
+		return nil, err
+	}
+
+	response, err := azureBlobRequest(blob, http.MethodHead, "", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", blob, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not read %s: %w", blob, azureBlobError(response))
+	}
+
+	size, err := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+	etag := response.Header.Get("ETag")
+
+	if err != nil || size < 0 || etag == "" {
+		return nil, fmt.Errorf("Azure gave no size or ETag for %s", blob)
+	}
+
+	reader := &AzureBlobReader{blob: blob, etag: etag}
+	reader.rangedReader = newRangedReader(size, options, reader.readRange)
+
+	return reader, nil
+}
+
+// Bytes [start, end) of the blob that was opened
+func (reader *AzureBlobReader) readRange(start int64, end int64) ([]byte, error) {
+	headers := map[string]string{
+		"x-ms-range": fmt.Sprintf("bytes=%d-%d", start, end-1),
+		"If-Match":   reader.etag,
+	}
+
+	response, err := azureBlobRequest(reader.blob, http.MethodGet, "", nil, headers)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.blob, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("%s changed while it was being read", reader.blob)
+	} else if response.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.blob, azureBlobError(response))
+	}
+
+	data := make([]byte, end-start)
+
+	_, err = io.ReadFull(response.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.blob, err)
+	}
+
+	return data, nil
+}
+
+type AzureBlobWriter struct {
+	blob      azureBlob
+	partBytes int
+	force     bool
+	buffer    []byte        // Not yet cut into a block
+	blocks    []string      // The IDs of the blocks staged, in the blob's order
+	inFlight  chan struct{} // A slot per block being staged
+	staging   sync.WaitGroup
+	mutex     sync.Mutex
+	stageErr  error // The first block that could not be staged
+	journal   *uploadJournal
+	resuming  bool // The journal holds blocks an interrupted upload staged
+	reused    bool // The output starts with the interrupted upload's header, written again
+	finished  bool
+	err       error
+}
+
+func newAzureBlobWriter(blobURL string, options *Options) (*AzureBlobWriter, error) {
+	if options == nil {
+		return nil, errors.New("options is nil")
+	}
+
+	blob, err := parseAzureBlobURL(blobURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkAzureBlobOffline(blob, options); err != nil {
+		return nil, err
+	}
+
+	// Refused before the job starts, the commit's condition covers a blob that appears during it
+	if !options.ForceOperation {
+		response, err := azureBlobRequest(blob, http.MethodHead, "", nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not check for %s: %w", blob, err)
+		}
+
+		defer func(body io.ReadCloser) {
+			_ = body.Close()
+		}(response.Body)
+
+		if response.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("%s: %w", blob, ErrTargetExists)
+		} else if response.StatusCode != http.StatusNotFound {
+			return nil, fmt.Errorf("could not check for %s: %w", blob, azureBlobError(response))
+		}
+	}
+
+	writer := &AzureBlobWriter{
+		blob:      blob,
+		partBytes: int(bytesFromMB(objectPartSizeMB(options))),
+		force:     options.ForceOperation,
+		inFlight:  make(chan struct{}, azureBlobStagesInFlight),
+	}
+
+	var found bool
+	writer.journal, found = openUploadJournal(blob.String())
+	writer.resuming = found && writer.journal.PartBytes == writer.partBytes && writer.keepStagedBlocks()
+
+	if !writer.resuming {
+		writer.journal.reset()
+	}
+
+	writer.journal.PartBytes = writer.partBytes
+
+	return writer, nil
+}
+
+func (writer *AzureBlobWriter) Write(p []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	if writer.finished {
+		return 0, errors.New("write to a finished upload")
+	}
+
+	writer.buffer = append(writer.buffer, p...)
+
+	// A block keeps its part of the buffer, appends only ever go after it
+	for len(writer.buffer) >= writer.partBytes {
+		writer.err = writer.stage(writer.buffer[:writer.partBytes:writer.partBytes])
+		if writer.err != nil {
+			return 0, writer.err
+		}
+
+		writer.buffer = writer.buffer[writer.partBytes:]
+	}
+
+	return len(p), nil
+}
+
+// Commits the blocks, the blob appears once this succeeds
+func (writer *AzureBlobWriter) Close() error {
+	if writer.err != nil || writer.finished {
+		return writer.err
+	}
+
+	if len(writer.buffer) > 0 {
+		writer.err = writer.stage(writer.buffer)
+		writer.buffer = nil
+	}
+
+	writer.staging.Wait()
+	writer.finished = true
+
+	if writer.err == nil {
+		writer.err = writer.stagingError()
+	}
+
+	if writer.err == nil {
+		writer.err = writer.commit()
+	}
+
+	// Blocks are gone once committed, a blob that exists stops the next run anyway, and other output starts over
+	if writer.err == nil || errors.Is(writer.err, ErrTargetExists) || errors.Is(writer.err, errUploadDiffers) {
+		writer.journal.remove()
+	}
+
+	return writer.err
+}
+
+/*
+	Stops an unfinished upload, nothing is committed and Azure discards the
+	blocks within a week - unless a block failed to stage (out of
+	retries), when they are left to the journal for the next run
+*/
+func (writer *AzureBlobWriter) Abort() error {
+	if writer.finished {
+		return nil
+	}
+
+	writer.finished = true
+	writer.staging.Wait()
+
+	if err := writer.stagingError(); (writer.err == nil && err == nil) || errors.Is(err, errUploadDiffers) {
+		writer.journal.remove()
+	}
+
+	return nil
+}
+
+func (writer *AzureBlobWriter) stage(part []byte) error {
+	if len(writer.blocks) == azureBlobMaxBlocks {
+		return fmt.Errorf("%s would need more than %d blocks, give a larger --part-size", writer.blob, azureBlobMaxBlocks)
+	}
+
+	// The IDs of a blob's blocks must all be the same length
+	number := len(writer.blocks)
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", number)))
+	writer.blocks = append(writer.blocks, id)
+
+	writer.inFlight <- struct{}{}
+
+	if err := writer.stagingError(); err != nil {
+		<-writer.inFlight
+		return err
+	}
+
+	writer.staging.Add(1)
+
+	go func() {
+		defer func() {
+			<-writer.inFlight
+			writer.staging.Done()
+		}()
+
+		differs, staged := writer.journal.checkBlock(number, id, part)
+		if staged {
+			return
+		}
+
+		var err error
+		if differs && writer.reused {
+			err = fmt.Errorf("%s: %w", writer.blob, errUploadDiffers)
+		} else {
+			writer.journal.recordBlock(number, id, part)
+			err = writer.putBlock(id, part)
+		}
+
+		if err != nil {
+			writer.mutex.Lock()
+			if writer.stageErr == nil {
+				writer.stageErr = err
+			}
+			writer.mutex.Unlock()
+
+			return
+		}
+
+		writer.journal.blockStaged(number, true)
+	}()
+
+	return nil
+}
+
+func (writer *AzureBlobWriter) stagingError() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.stageErr
+}
+
+func (writer *AzureBlobWriter) putBlock(id string, part []byte) error {
+	response, err := azureBlobRequest(writer.blob, http.MethodPut, "comp=block&blockid="+url.QueryEscape(id), part, nil)
+	if err != nil {
+		return fmt.Errorf("could not upload %s: %w", writer.blob, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("could not upload %s: %w", writer.blob, azureBlobError(response))
+	}
+
+	return nil
+}
+
+/*
+	Keeps the journaled blocks that were staged and that Azure still has
+	uncommitted - false when there are none, or it cannot say
+*/
+func (writer *AzureBlobWriter) keepStagedBlocks() bool {
+	response, err := azureBlobRequest(writer.blob, http.MethodGet, "comp=blocklist&blocklisttype=uncommitted", nil, nil)
+	if err != nil {
+		return false
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return false
+	}
+
+	var list struct {
+		Blocks []struct {
+			Name string `xml:"Name"`
+		} `xml:"UncommittedBlocks>Block"`
+	}
+
+	if xml.NewDecoder(response.Body).Decode(&list) != nil {
+		return false
+	}
+
+	staged := map[string]bool{}
+	for _, block := range list.Blocks {
+		staged[block.Name] = true
+	}
+
+	kept := false
+	for number, block := range writer.journal.Blocks {
+		if block.Staged && !staged[block.ID] {
+			writer.journal.Blocks[number].Staged = false
+		} else if block.Staged {
+			kept = true
+		}
+	}
+
+	return kept
+}
+
+func (writer *AzureBlobWriter) resumeHeader() ([]byte, []byte) {
+	if !writer.resuming || len(writer.blocks) > 0 || len(writer.buffer) > 0 {
+		return nil, nil
+	}
+
+	return writer.journal.Header, writer.journal.KeyCheck
+}
+
+func (writer *AzureBlobWriter) recordHeader(header []byte, keyCheck []byte) {
+	previous, previousCheck := writer.resumeHeader()
+	writer.reused = previous != nil && bytes.Equal(previous, header) && bytes.Equal(previousCheck, keyCheck)
+	writer.journal.recordHeader(header, keyCheck)
+}
+
+func (writer *AzureBlobWriter) commit() error {
+	var list bytes.Buffer
+
+	// Base64 IDs need no escaping
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range writer.blocks {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+
+	headers := map[string]string{"x-ms-blob-content-type": "application/octet-stream"}
+	if !writer.force {
+		headers["If-None-Match"] = "*"
+	}
+
+	response, err := azureBlobRequest(writer.blob, http.MethodPut, "comp=blocklist", list.Bytes(), headers)
+	if err != nil {
+		return fmt.Errorf("could not finish uploading %s: %w", writer.blob, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode == http.StatusCreated {
+		return nil
+	}
+
+	if !writer.force && (response.StatusCode == http.StatusPreconditionFailed || response.Header.Get("x-ms-error-code") == "BlobAlreadyExists") {
+		return fmt.Errorf("%s: %w", writer.blob, ErrTargetExists)
+	}
+
+	return fmt.Errorf("could not finish uploading %s: %w", writer.blob, azureBlobError(response))
+}
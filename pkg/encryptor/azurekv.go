@@ -0,0 +1,323 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Azure Key Vault keys as recipients, for pipelines hosted on Azure that
+	are given a key through a managed identity rather than a password. The
+	file key is wrapped by the vault (wrapKey) with an RSA key, and the
+	stanza holds the key's identifier and the wrapped key
+
+		https://<vault>.vault.azure.net/keys/<key>[/<version>]
+
+	Without a version the key's current version wraps, and the stanza keeps
+	the versioned identifier the vault answers with - unwrapKey must be
+	asked of the version that wrapped, so keys can be rotated without
+	touching older files (as long as their old versions stay enabled).
+	Decrypting needs no flag, only an identity allowed to unwrap with it
+
+	The identifier comes from the file when decrypting, and a bearer token
+	is sent to it, so only Key Vault and Managed HSM hosts of Azure's clouds
+	are accepted - a file cannot send our token anywhere else
+
+	Credentials are a service principal's client secret (AZURE_TENANT_ID,
+	AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, as Azure's SDKs read them), or
+	else the managed identity - App Service's identity endpoint when it is
+	set, the instance metadata service otherwise, with AZURE_CLIENT_ID
+	choosing a user-assigned identity. Access tokens are kept in memory for
+	the life of the process, never written anywhere
+*/
+
+const RecipientTypeAzureKeyVault = "azure-key-vault"
+
+const azureKeyVaultAlgorithm = "RSA-OAEP-256"
+
+const azureKeyVaultAPIVersion = "7.4"
+
+// Variables so tests can point them at a server of their own
+var azureAuthorityHost = "https://login.microsoftonline.com/"
+var azureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// Key Vault and Managed HSM hosts of each Azure cloud, a token is only ever scoped to (and sent to) one of these
+var azureKeyVaultHosts = []string{
+	"vault.azure.net",
+	"managedhsm.azure.net",
+	"vault.azure.cn",
+	"managedhsm.azure.cn",
+	"vault.usgovcloudapi.net",
+	"managedhsm.usgovcloudapi.net",
+}
+
+type azureKeyVaultKey struct {
+	id       string // https://<vault>/keys/<key>[/<version>]
+	resource string // What its access token is for, e.g. https://vault.azure.net
+}
+
+// expires_in is a number from Entra ID and a string from the metadata service
+type azureTokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+type azureCachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// One token per resource, a job may use keys in more than one cloud
+var azureTokens = struct {
+	mutex  sync.Mutex
+	tokens map[string]azureCachedToken
+}{}
+
+func parseAzureKeyVaultKey(keyID string) (azureKeyVaultKey, error) {
+	keyID = strings.TrimRight(strings.TrimSpace(keyID), "/")
+
+	invalid := fmt.Errorf("Key Vault key %q must be a key identifier, https://<vault>.vault.azure.net/keys/<key>[/<version>]", keyID)
+
+	parsed, err := url.Parse(keyID)
+	if err != nil || parsed.Scheme != "https" || parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return azureKeyVaultKey{}, invalid
+	}
+
+	path := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if (len(path) != 2 && len(path) != 3) || path[0] != "keys" {
+		return azureKeyVaultKey{}, invalid
+	}
+
+	for _, segment := range path {
+		if segment == "" {
+			return azureKeyVaultKey{}, invalid
+		}
+	}
+
+	hostname := strings.ToLower(parsed.Hostname())
+	for _, host := range azureKeyVaultHosts {
+		if hostname == host || strings.HasSuffix(hostname, "."+host) {
+			return azureKeyVaultKey{id: keyID, resource: "https://" + host}, nil
+		}
+	}
+
+	return azureKeyVaultKey{}, fmt.Errorf("Key Vault key %s is not on a Key Vault or Managed HSM host of Azure", keyID)
+}
+
+func wrapFileKeyAzureKeyVault(fileKey []byte, key azureKeyVaultKey) (RecipientStanza, error) {
+	var response struct {
+		KeyID string `json:"kid"`
+		Value string `json:"value"`
+	}
+
+	err := callAzureKeyVault(key, "wrapkey", base64.RawURLEncoding.EncodeToString(fileKey), &response)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not wrap with Key Vault key %s: %w", key.id, err)
+	}
+
+	wrapped, err := decodeAzureBase64(response.Value)
+	if err != nil || len(wrapped) == 0 {
+		return RecipientStanza{}, fmt.Errorf("Key Vault returned no wrapped key for %s", key.id)
+	}
+
+	// The versioned identifier, so unwrapping asks the version that wrapped
+	versioned, err := parseAzureKeyVaultKey(response.KeyID)
+	if err != nil || versioned.resource != key.resource {
+		return RecipientStanza{}, fmt.Errorf("Key Vault returned an unexpected key identifier %q for %s", response.KeyID, key.id)
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeAzureKeyVault,
+		Args: []string{versioned.id, azureKeyVaultAlgorithm},
+		Body: base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+func unwrapFileKeyAzureKeyVault(stanza RecipientStanza, offline bool) ([]byte, error) {
+	if len(stanza.Args) < 2 {
+		return nil, errors.New("malformed azure-key-vault stanza")
+	}
+
+	key, err := parseAzureKeyVaultKey(stanza.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed azure-key-vault stanza: %w", err)
+	}
+
+	if stanza.Args[1] != azureKeyVaultAlgorithm {
+		return nil, fmt.Errorf("Key Vault algorithm %q is not supported by this version of encryptor", stanza.Args[1])
+	}
+
+	if offline {
+		return nil, fmt.Errorf("Key Vault key %s is reached over the network: %w", key.id, ErrOffline)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, errors.New("malformed azure-key-vault stanza body")
+	}
+
+	var response struct {
+		Value string `json:"value"`
+	}
+
+	err = callAzureKeyVault(key, "unwrapkey", base64.RawURLEncoding.EncodeToString(wrapped), &response)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap with Key Vault key %s: %w", key.id, err)
+	}
+
+	return decodeAzureBase64(response.Value)
+}
+
+func callAzureKeyVault(key azureKeyVaultKey, operation string, value string, response interface{}) error {
+	token, err := azureAccessToken(key.resource)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{"alg": azureKeyVaultAlgorithm, "value": value})
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, key.id+"/"+operation+"?api-version="+azureKeyVaultAPIVersion, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	httpRequest.Header.Set("Authorization", "Bearer "+token)
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	return doKeyServiceRequest(httpRequest, response)
+}
+
+// Key Vault answers in base64url without padding, padding is tolerated anyway
+func decodeAzureBase64(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// A cached token is used until a minute before it expires
+func azureAccessToken(resource string) (string, error) {
+	azureTokens.mutex.Lock()
+	defer azureTokens.mutex.Unlock()
+
+	if cached, ok := azureTokens.tokens[resource]; ok && time.Now().Before(cached.expiry) {
+		return cached.token, nil
+	}
+
+	token, err := newAzureAccessToken(resource)
+	if err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New("Azure returned an empty access token")
+	}
+
+	expiresIn, err := strconv.ParseInt(token.ExpiresIn.String(), 10, 64)
+	if err != nil {
+		expiresIn = 0 // Used for this job and asked for again by the next
+	}
+
+	if azureTokens.tokens == nil {
+		azureTokens.tokens = make(map[string]azureCachedToken)
+	}
+
+	azureTokens.tokens[resource] = azureCachedToken{
+		token:  token.AccessToken,
+		expiry: time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute),
+	}
+
+	return token.AccessToken, nil
+}
+
+func newAzureAccessToken(resource string) (azureTokenResponse, error) {
+	tenantID, clientID, clientSecret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+
+	if clientSecret != "" {
+		if tenantID == "" || clientID == "" {
+			return azureTokenResponse{}, errors.New("AZURE_CLIENT_SECRET needs AZURE_TENANT_ID and AZURE_CLIENT_ID as well")
+		}
+
+		return azureClientSecretToken(tenantID, clientID, clientSecret, resource)
+	}
+
+	token, err := azureManagedIdentityToken(clientID, resource)
+	if err != nil {
+		return azureTokenResponse{}, fmt.Errorf("no Azure credentials were found - set AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, or run with a managed identity (%v)", err)
+	}
+
+	return token, nil
+}
+
+// A service principal's client secret, exchanged with Entra ID (AZURE_AUTHORITY_HOST for other clouds)
+func azureClientSecretToken(tenantID string, clientID string, clientSecret string, resource string) (azureTokenResponse, error) {
+	authorityHost := azureAuthorityHost
+	if override := os.Getenv("AZURE_AUTHORITY_HOST"); override != "" {
+		authorityHost = strings.TrimRight(override, "/") + "/"
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {resource + "/.default"},
+	}
+
+	request, err := http.NewRequest(http.MethodPost, authorityHost+url.PathEscape(tenantID)+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return azureTokenResponse{}, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token azureTokenResponse
+
+	err = doKeyServiceRequest(request, &token)
+	if err != nil {
+		return azureTokenResponse{}, fmt.Errorf("could not get an Azure access token: %w", err)
+	}
+
+	return token, nil
+}
+
+// App Service and Functions set IDENTITY_ENDPOINT and IDENTITY_HEADER, VMs, scale sets and AKS have the metadata service
+func azureManagedIdentityToken(clientID string, resource string) (azureTokenResponse, error) {
+	query := url.Values{"resource": {resource}}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	endpoint, header, value := azureIMDSEndpoint, "Metadata", "true"
+	query.Set("api-version", "2018-02-01")
+
+	if identityEndpoint, identityHeader := os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER"); identityEndpoint != "" && identityHeader != "" {
+		endpoint, header, value = identityEndpoint, "X-IDENTITY-HEADER", identityHeader
+		query.Set("api-version", "2019-08-01")
+	}
+
+	request, err := http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return azureTokenResponse{}, err
+	}
+
+	request.Header.Set(header, value)
+
+	var token azureTokenResponse
+
+	err = doKeyServiceRequest(request, &token)
+	if err != nil {
+		return azureTokenResponse{}, err
+	}
+
+	return token, nil
+}
@@ -0,0 +1,220 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Long running jobs (large archives, scheduled backups) should cooperate
+	with office hours network usage, so the rate the target is written at
+	can be limited by time of day, e.g. full speed overnight and 10MB/s
+	during the day
+
+		0:00-6:00=unlimited,10MB
+
+	Each entry is a window (start inclusive, end exclusive, local time,
+	windows may wrap midnight) and a rate, an entry without a window is
+	the rate outside every window. Rates are bytes per second with an
+	optional KB/MB/GB suffix, 0 or "unlimited" means no limit. The rate is
+	looked up as each chunk is written, so a job that runs into a window
+	changes speed as it goes
+*/
+
+type BandwidthWindow struct {
+	Start          time.Duration // Since midnight
+	End            time.Duration
+	BytesPerSecond int64
+}
+
+type BandwidthSchedule struct {
+	Windows               []BandwidthWindow
+	DefaultBytesPerSecond int64
+}
+
+func ParseBandwidthSchedule(schedule string) (BandwidthSchedule, error) {
+	result := BandwidthSchedule{}
+	defaultSeen := false
+
+	for _, entry := range strings.Split(schedule, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		separator := strings.Index(entry, "=")
+		if separator < 0 {
+			if defaultSeen {
+				return BandwidthSchedule{}, errors.New("bandwidth schedule has more than one default rate")
+			}
+
+			rate, err := parseBandwidthRate(entry)
+			if err != nil {
+				return BandwidthSchedule{}, err
+			}
+
+			result.DefaultBytesPerSecond = rate
+			defaultSeen = true
+			continue
+		}
+
+		window, err := parseBandwidthWindow(entry[:separator])
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+
+		window.BytesPerSecond, err = parseBandwidthRate(entry[separator+1:])
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+
+		result.Windows = append(result.Windows, window)
+	}
+
+	return result, nil
+}
+
+func parseBandwidthWindow(window string) (BandwidthWindow, error) {
+	separator := strings.Index(window, "-")
+	if separator < 0 {
+		return BandwidthWindow{}, fmt.Errorf("bandwidth window %q must be start-end, e.g. 0:00-6:00", window)
+	}
+
+	start, err := parseTimeOfDay(window[:separator])
+	if err != nil {
+		return BandwidthWindow{}, err
+	}
+
+	end, err := parseTimeOfDay(window[separator+1:])
+	if err != nil {
+		return BandwidthWindow{}, err
+	}
+
+	return BandwidthWindow{Start: start, End: end}, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	separator := strings.Index(value, ":")
+	if separator < 0 {
+		return 0, fmt.Errorf("time of day %q must be hours:minutes", value)
+	}
+
+	hours, err := strconv.Atoi(value[:separator])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("time of day %q has invalid hours", value)
+	}
+
+	minutes, err := strconv.Atoi(value[separator+1:])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("time of day %q has invalid minutes", value)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+func parseBandwidthRate(rate string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(rate))
+	value = strings.TrimSuffix(value, "/S")
+
+	if value == "UNLIMITED" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for suffix, size := range map[string]int64{"KB": 1024, "MB": 1024 * 1024, "GB": 1024 * 1024 * 1024} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = size
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "B")), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("bandwidth rate %q is not a number of bytes per second", rate)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
+
+// The rate in effect at a moment, 0 is unlimited
+func (schedule *BandwidthSchedule) rateAt(moment time.Time) int64 {
+	// By the clock on the wall, days that change to or from daylight saving time are not 24 hours long
+	hour, minute, second := moment.Clock()
+	timeOfDay := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+
+	for _, window := range schedule.Windows {
+		inside := false
+		if window.Start <= window.End {
+			inside = timeOfDay >= window.Start && timeOfDay < window.End
+		} else {
+			inside = timeOfDay >= window.Start || timeOfDay < window.End
+		}
+
+		if inside {
+			return window.BytesPerSecond
+		}
+	}
+
+	return schedule.DefaultBytesPerSecond
+}
+
+func (schedule *BandwidthSchedule) unlimited() bool {
+	if schedule.DefaultBytesPerSecond > 0 {
+		return false
+	}
+
+	for _, window := range schedule.Windows {
+		if window.BytesPerSecond > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Paces writes to the schedule, a single chunk may burst but the average follows the rate
+type bandwidthLimiter struct {
+	schedule BandwidthSchedule
+	mutex    sync.Mutex
+	next     time.Time
+}
+
+func newBandwidthLimiter(schedule BandwidthSchedule) *bandwidthLimiter {
+	if schedule.unlimited() {
+		return nil
+	}
+
+	return &bandwidthLimiter{schedule: schedule}
+}
+
+func (limiter *bandwidthLimiter) wait(bytes int) {
+	if limiter == nil {
+		return
+	}
+
+	limiter.mutex.Lock()
+
+	now := time.Now()
+	rate := limiter.schedule.rateAt(now)
+	if rate == 0 || limiter.next.Before(now) {
+		limiter.next = now
+	}
+
+	delay := limiter.next.Sub(now)
+	if rate > 0 {
+		limiter.next = limiter.next.Add(time.Duration(float64(bytes) / float64(rate) * float64(time.Second)))
+	}
+
+	limiter.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
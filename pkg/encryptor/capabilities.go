@@ -0,0 +1,125 @@
+package encryptor
+
+/*
+	An inventory of the cryptography this build supports, with the
+	parameters and limits each piece uses, so compliance tooling and
+	wrappers can check a deployed binary meets their policy before use
+	(encryptor capabilities --json)
+
+	Names match what policies and file headers use, e.g. AES-256-GCM
+*/
+
+type CipherCapability struct {
+	Name           string
+	Algorithm      string
+	Mode           string
+	KeySizeBits    int
+	NonceSizeBytes uint
+	TagSizeBytes   uint
+	FIPSApproved   bool
+}
+
+type KDFCapability struct {
+	Name          string
+	Hash          string
+	Iterations    int
+	SaltSizeBytes uint
+	KeySizeBits   int
+	FIPSApproved  bool
+}
+
+type KeyProviderCapability struct {
+	Name         string
+	Description  string
+	FIPSApproved bool
+}
+
+type Limits struct {
+	ChunkSizeMinMB   uint
+	ChunkSizeMaxMB   uint
+	ReadersMax       uint8
+	ExecutorsMax     uint8
+	WritersMax       uint8
+	BatchChunksMax   uint
+	PrefetchDepthMax uint
+	PoolWorkersMax   uint8
+	PartSizeMinMB    uint
+	PartSizeMaxMB    uint
+	WriteBufferMaxKB uint
+	FileKeySizeBits  int
+}
+
+type Capabilities struct {
+	FIPSMode       bool // Only FIPS approved entries may be used
+	FormatVersions []string
+	Ciphers        []CipherCapability
+	KDFs           []KDFCapability
+	Hashes         []string
+	ChunkChecksums []string
+	Compressions   []string
+	KeyProviders   []KeyProviderCapability
+	Limits         Limits
+}
+
+func GetCapabilities() Capabilities {
+	var ciphers []CipherCapability
+	// Plugin ciphers once their plugin has started
+	for _, suite := range append(append([]cipherSuite{}, cipherSuites...), pluginCipherSuites()...) {
+		ciphers = append(ciphers, CipherCapability{
+			Name:           suite.Name,
+			Algorithm:      suite.Algorithm,
+			Mode:           suite.ModeName,
+			KeySizeBits:    suite.KeySize,
+			NonceSizeBytes: suite.NonceSize,
+			TagSizeBytes:   suite.TagSize,
+			FIPSApproved:   suite.FIPSApproved,
+		})
+	}
+
+	keyProviders := []KeyProviderCapability{
+		{Name: "password", Description: "key derived from a password with PBKDF2", FIPSApproved: true},
+		{Name: "keyhex", Description: "a 256 bit key supplied as hexadecimal", FIPSApproved: true},
+		{Name: RecipientTypeOpenPGP, Description: "random file key wrapped to OpenPGP recipients by gpg"},
+		{Name: RecipientTypeSSHEd25519, Description: "random file key wrapped with X25519, HKDF-SHA-256 and ChaCha20-Poly1305"},
+		{Name: RecipientTypeSSHRSA, Description: "random file key wrapped with RSA-OAEP (SHA-256)", FIPSApproved: true},
+		{Name: RecipientTypeRSAOAEP, Description: "random file key wrapped with RSA-OAEP (SHA-256) to PKI certificates and keys", FIPSApproved: true},
+		{Name: RecipientTypeX25519, Description: "random file key wrapped with X25519, HKDF-SHA-256 and ChaCha20-Poly1305"},
+		{Name: RecipientTypeGCPKMS, Description: "random file key wrapped by a Google Cloud KMS key, with Application Default Credentials", FIPSApproved: true},
+		{Name: RecipientTypeAzureKeyVault, Description: "random file key wrapped by an Azure Key Vault RSA key (RSA-OAEP-256), with a managed identity or client secret", FIPSApproved: true},
+		{Name: RecipientTypePKCS11, Description: "random file key wrapped with RSA-OAEP (SHA-256) to an RSA key in an HSM or smartcard, through pkcs11-tool", FIPSApproved: true},
+		{Name: RecipientTypeTPM2, Description: "random file key sealed to this machine's TPM 2.0, optionally bound to PCR values, through tpm2-tools"},
+		{Name: RecipientTypePlugin, Description: "random file key wrapped by an encryptor-plugin-<name> binary, see --plugin-recipient"},
+	}
+
+	// Only builds with crypto/mlkem (Go 1.24 on) have it
+	if mlkemSupported {
+		keyProviders = append(keyProviders, KeyProviderCapability{Name: RecipientTypeMLKEMX25519, Description: "random file key wrapped with ML-KEM-768 and X25519 together (hybrid post-quantum), HKDF-SHA-256 and ChaCha20-Poly1305"})
+	}
+
+	return Capabilities{
+		FIPSMode:       fipsBuild,
+		FormatVersions: append([]string{}, supportedFormatVersions...),
+		Ciphers:        ciphers,
+		KDFs: []KDFCapability{
+			{Name: "PBKDF2", Hash: "SHA-256", Iterations: PasswordKDFIterations, SaltSizeBytes: PasswordSaltSize, KeySizeBits: 256, FIPSApproved: true},
+		},
+		Hashes:         []string{"SHA-256"},
+		ChunkChecksums: []string{ChecksumCRC32C},
+		Compressions:   codecNames(),
+		KeyProviders:   keyProviders,
+		Limits: Limits{
+			ChunkSizeMinMB:   ChunkSizeMin,
+			ChunkSizeMaxMB:   ChunkSizeMax,
+			ReadersMax:       ReadersLimit,
+			ExecutorsMax:     ExecutorsLimit,
+			WritersMax:       WritersLimit,
+			BatchChunksMax:   BatchChunksMax,
+			PrefetchDepthMax: PrefetchDepthMax,
+			PoolWorkersMax:   PoolWorkersLimit,
+			PartSizeMinMB:    PartSizeMinMB,
+			PartSizeMaxMB:    PartSizeMaxMB,
+			WriteBufferMaxKB: WriteBufferMaxKB,
+			FileKeySizeBits:  FileKeySize * 8,
+		},
+	}
+}
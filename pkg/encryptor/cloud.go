@@ -0,0 +1,160 @@
+package encryptor
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+	Object stores verify uploads against checksums supplied by the client
+	(S3 x-amz-checksum-sha256/crc32c and Content-MD5, GCS x-goog-hash) -
+	computing them here, inline with the write stage, means an upload can
+	be verified end to end without reading the output back from disk
+
+	S3 multipart uploads are verified per part, and the object checksum
+	becomes a checksum of the part checksums suffixed with the part count,
+	so we track parts as well - the default part size matches the AWS CLI
+	default (8MB) so the values line up with `aws s3 cp` uploads
+*/
+
+const CloudChecksumsSuffix = ".checksums.json"
+const PartSizeMinMB uint = 5 // S3 rejects smaller parts (other than the last)
+const PartSizeMaxMB uint = 5120
+
+type CloudPartChecksum struct {
+	PartNumber int
+	Size       int64
+	SHA256     string
+	CRC32C     string
+}
+
+type CloudChecksums struct {
+	Object          string
+	Size            int64
+	SHA256          string
+	CRC32C          string
+	MD5             string
+	PartSizeBytes   int64
+	Parts           []CloudPartChecksum
+	CompositeSHA256 string
+}
+
+// An io.Writer that observes everything written to the target
+type cloudChecksummer struct {
+	partSizeBytes int64
+	size          int64
+	sha256        hash.Hash
+	crc32c        hash.Hash32
+	md5           hash.Hash
+	partSHA256    hash.Hash
+	partCRC32C    hash.Hash32
+	partSize      int64
+	parts         []CloudPartChecksum
+}
+
+func newCloudChecksummer(partSizeBytes int64) *cloudChecksummer {
+	return &cloudChecksummer{
+		partSizeBytes: partSizeBytes,
+		sha256:        sha256.New(),
+		crc32c:        crc32.New(crc32cTable),
+		md5:           md5.New(),
+		partSHA256:    sha256.New(),
+		partCRC32C:    crc32.New(crc32cTable),
+	}
+}
+
+func (checksummer *cloudChecksummer) Write(data []byte) (int, error) {
+	written := len(data)
+
+	checksummer.size += int64(written)
+	checksummer.sha256.Write(data)
+	checksummer.crc32c.Write(data)
+	checksummer.md5.Write(data)
+
+	// Split the data across part boundaries
+	for len(data) > 0 {
+		remaining := checksummer.partSizeBytes - checksummer.partSize
+		portion := data
+		if int64(len(portion)) > remaining {
+			portion = data[:remaining]
+		}
+
+		checksummer.partSHA256.Write(portion)
+		checksummer.partCRC32C.Write(portion)
+		checksummer.partSize += int64(len(portion))
+		data = data[len(portion):]
+
+		if checksummer.partSize == checksummer.partSizeBytes {
+			checksummer.endPart()
+		}
+	}
+
+	return written, nil
+}
+
+func (checksummer *cloudChecksummer) endPart() {
+	checksummer.parts = append(checksummer.parts, CloudPartChecksum{
+		PartNumber: len(checksummer.parts) + 1,
+		Size:       checksummer.partSize,
+		SHA256:     base64.StdEncoding.EncodeToString(checksummer.partSHA256.Sum(nil)),
+		CRC32C:     base64.StdEncoding.EncodeToString(crc32cBytes(checksummer.partCRC32C)),
+	})
+
+	checksummer.partSHA256.Reset()
+	checksummer.partCRC32C.Reset()
+	checksummer.partSize = 0
+}
+
+func (checksummer *cloudChecksummer) checksums(objectName string) CloudChecksums {
+	if checksummer.partSize > 0 {
+		checksummer.endPart()
+	}
+
+	// S3 composite checksum: the SHA256 of the concatenated part digests, suffixed with the part count
+	composite := sha256.New()
+	for _, part := range checksummer.parts {
+		digest, _ := base64.StdEncoding.DecodeString(part.SHA256)
+		composite.Write(digest)
+	}
+
+	return CloudChecksums{
+		Object:          objectName,
+		Size:            checksummer.size,
+		SHA256:          base64.StdEncoding.EncodeToString(checksummer.sha256.Sum(nil)),
+		CRC32C:          base64.StdEncoding.EncodeToString(crc32cBytes(checksummer.crc32c)),
+		MD5:             base64.StdEncoding.EncodeToString(checksummer.md5.Sum(nil)),
+		PartSizeBytes:   checksummer.partSizeBytes,
+		Parts:           checksummer.parts,
+		CompositeSHA256: base64.StdEncoding.EncodeToString(composite.Sum(nil)) + "-" + strconv.Itoa(len(checksummer.parts)),
+	}
+}
+
+// Object stores expect CRC32C values big endian, before base64 encoding
+func crc32cBytes(crc hash.Hash32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, crc.Sum32())
+	return data
+}
+
+func writeCloudChecksums(targetFilename string, checksummer *cloudChecksummer) error {
+	data, err := json.MarshalIndent(checksummer.checksums(filepath.Base(targetFilename)), "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not serialize cloud checksums: %w", err)
+	}
+
+	err = os.WriteFile(targetFilename+CloudChecksumsSuffix, data, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write cloud checksums file: %w", err)
+	}
+
+	return nil
+}
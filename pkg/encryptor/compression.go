@@ -0,0 +1,315 @@
+package encryptor
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+	Options.Compression compresses the plaintext before it is encrypted,
+	so logs, text, and database dumps take less space and less time to
+	move once encrypted - compressing afterwards does nothing, encrypted
+	data looks random. The plaintext is compressed as one stream by a
+	codec and the stream is what is chunked, so chunks stay the fixed
+	size every reader expects, and the header's Compression (format
+	1.15) names the codec decryption decompresses what the chunks hold
+	with
+
+	Codecs are found by that name, so a new one is a new name rather than
+	a new format version. Built in are zstd (see zstd.go), the best ratio
+	at a good speed, gzip, which everything can read, and lz4 (see
+	lz4.go), the fastest. none is no compression at all and is never
+	written to a header - a file is left as it would be without
+	--compress, readable by versions before 1.15 - but a header naming it
+	is read. RegisterCodec adds codecs of the caller's own, which only
+	builds that register them can then decrypt
+
+	Where any chunk's compressed data starts is only known once those
+	before it are compressed, so compressed files are written and read
+	through EncryptWriter and DecryptReader rather than the concurrent
+	pipeline - with compression itself a stage of its own, a pool of
+	workers compressing frames of the stream (see compressstage.go).
+	Otherwise they are streamed files like
+	any other: verifying, inspecting, and scrubbing work on their chunks
+	as usual, and recovery writes the compressed stream the chunks hold.
+	What needs the plaintext's chunks - reading at an offset (see
+	filereader.go), tree hashes, --head-first - does not apply
+
+	How well a file compressed shows in its encrypted size, which says
+	something of the plaintext. Leave compression off for data someone
+	can partly choose and wants to learn the rest of (as the CRIME and
+	BREACH attacks did with compressed HTTPS)
+*/
+
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionLZ4  = "lz4"
+	CompressionNone = "none"
+)
+
+// A compressed stream format, by the name Options.Compression and headers give it
+type Codec interface {
+	Name() string
+	NewWriter(target io.Writer) io.WriteCloser // Close ends the stream, target is left open
+	NewReader(source io.Reader) io.Reader      // Reads until the source ends, failing on anything not of the codec
+}
+
+// Every codec files can be compressed with, built in and registered
+var codecs = struct {
+	mutex sync.Mutex
+	list  []Codec
+}{list: []Codec{zstdCodec{}, gzipCodec{}, lz4Codec{}, noneCodec{}}}
+
+func registerCodec(codec Codec) error {
+	if codec == nil || strings.TrimSpace(codec.Name()) == "" || codec.Name() != strings.TrimSpace(codec.Name()) {
+		return errors.New("a codec needs a name without surrounding spaces")
+	}
+
+	codecs.mutex.Lock()
+	defer codecs.mutex.Unlock()
+
+	for _, registered := range codecs.list {
+		if registered.Name() == codec.Name() {
+			return fmt.Errorf("codec %q is already registered", codec.Name())
+		}
+	}
+
+	codecs.list = append(codecs.list, codec)
+	return nil
+}
+
+func codecByName(name string) (Codec, error) {
+	codecs.mutex.Lock()
+	defer codecs.mutex.Unlock()
+
+	for _, codec := range codecs.list {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+
+	return nil, fmt.Errorf("compression %q is not supported, %s are", name, strings.Join(codecNamesLocked(), ", "))
+}
+
+func codecNames() []string {
+	codecs.mutex.Lock()
+	defer codecs.mutex.Unlock()
+
+	return codecNamesLocked()
+}
+
+func codecNamesLocked() []string {
+	names := make([]string, 0, len(codecs.list))
+	for _, codec := range codecs.list {
+		names = append(names, codec.Name())
+	}
+
+	return names
+}
+
+func checkCompression(compression string) error {
+	if compression == "" {
+		return nil
+	}
+
+	_, err := codecByName(compression)
+	return err
+}
+
+// What the header records for Options.Compression, none is recorded as nothing
+func headerCompression(compression string) string {
+	if compression == CompressionNone {
+		return ""
+	}
+
+	return compression
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return CompressionZstd }
+
+func (zstdCodec) NewWriter(target io.Writer) io.WriteCloser { return newZstdWriter(target) }
+
+func (zstdCodec) NewReader(source io.Reader) io.Reader { return newZstdReader(source) }
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return CompressionLZ4 }
+
+func (lz4Codec) NewWriter(target io.Writer) io.WriteCloser { return newLZ4Writer(target) }
+
+func (lz4Codec) NewReader(source io.Reader) io.Reader { return newLZ4Reader(source) }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CompressionGzip }
+
+func (gzipCodec) NewWriter(target io.Writer) io.WriteCloser { return gzip.NewWriter(target) }
+
+func (gzipCodec) NewReader(source io.Reader) io.Reader { return &gzipReader{source: source} }
+
+// gzip.NewReader reads the stream's header at once, this waits for the first Read as the other codecs do
+type gzipReader struct {
+	source io.Reader
+	reader *gzip.Reader
+	err    error
+}
+
+func (reader *gzipReader) Read(data []byte) (int, error) {
+	if reader.err != nil {
+		return 0, reader.err
+	}
+
+	if reader.reader == nil {
+		reader.reader, reader.err = gzip.NewReader(reader.source)
+		if reader.err == io.EOF {
+			reader.err = fmt.Errorf("gzip data is truncated: %w", io.ErrUnexpectedEOF)
+		}
+
+		if reader.err != nil {
+			return 0, reader.err
+		}
+	}
+
+	return reader.reader.Read(data)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return CompressionNone }
+
+func (noneCodec) NewWriter(target io.Writer) io.WriteCloser { return nopWriteCloser{target} }
+
+func (noneCodec) NewReader(source io.Reader) io.Reader { return source }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Encrypting with compression, or decrypting a compressed file, is done by a stream rather than the pipeline
+func isCompressedJob(operation OperationEnum, sourceFilename string, options *Options) bool {
+	switch operation {
+	case Encryption:
+		return headerCompression(options.Compression) != ""
+	case Decryption:
+		header := peekHeader(sourceFilename)
+		return header != nil && header.Compression != ""
+	}
+
+	return false
+}
+
+// Writes to target when it is not nil (it is left open), otherwise creates targetFilename
+func runCompressedJob(operation OperationEnum, sourceFilename string, targetFilename string, target *os.File, options *Options) (err error) {
+	err = checkCompression(options.Compression)
+	if err != nil {
+		return err
+	}
+
+	if options.TreeHash != nil || options.HeadFirst {
+		return errors.New("tree hashes and --head-first are of the plaintext's chunks, a compressed file's chunks hold compressed data")
+	}
+
+	source, err := os.Open(sourceFilename)
+	if err != nil {
+		return fmt.Errorf("could not open source file: %w", err)
+	}
+
+	defer func(source *os.File) {
+		_ = source.Close()
+	}(source)
+
+	if target == nil {
+		if _, statErr := os.Stat(targetFilename); statErr == nil && !options.ForceOperation {
+			return ErrTargetExists
+		}
+
+		forgetCachedEncryptedFileHeader(targetFilename)
+
+		target, err = os.Create(targetFilename)
+		if err != nil {
+			return fmt.Errorf("could not open file for writing: %w", err)
+		}
+
+		// Because the close is for a file we are writing to, it can fail the job
+		defer func(file *os.File) {
+			closeErr := file.Close()
+			if err == nil && closeErr != nil {
+				err = fmt.Errorf("error closing file we were writing to: %w", closeErr)
+			}
+
+			// Half a compressed stream is no use to anyone
+			if err != nil {
+				_ = os.Remove(targetFilename)
+			}
+		}(target)
+
+		if options.Fsync != "" && options.Fsync != FsyncNever {
+			defer func(file *os.File) {
+				if err == nil {
+					err = file.Sync()
+				}
+			}(target)
+		}
+	}
+
+	if operation == Encryption {
+		reader := &timedReader{source: source}
+
+		err = encryptCompressed(reader, target, withSourceName(options, sourceFilename))
+		if err == nil && options.StageReport != nil {
+			options.StageReport.add(0, StageStats{Name: "read", Workers: 1, Bytes: reader.bytes, Busy: reader.busy})
+		}
+
+		return err
+	}
+
+	reader, err := NewDecryptReader(source, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, reader)
+	return err
+}
+
+func encryptCompressed(source io.Reader, target io.Writer, options *Options) error {
+	writer, err := NewEncryptWriter(target, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, source)
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// What an EncryptWriter's compressor writes, to be chunked
+type compressedChunks struct {
+	writer *EncryptWriter
+}
+
+func (chunks compressedChunks) Write(data []byte) (int, error) {
+	return chunks.writer.writeChunks(data)
+}
+
+// What a DecryptReader's decompressor reads, the chunks' plaintext
+type decryptedChunks struct {
+	reader *DecryptReader
+}
+
+func (chunks decryptedChunks) Read(data []byte) (int, error) {
+	return chunks.reader.readChunks(data)
+}
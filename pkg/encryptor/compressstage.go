@@ -0,0 +1,299 @@
+package encryptor
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Compression is a stage of its own between reading the plaintext and
+	sealing it, with a pool of Options.Compressors workers (Executors when
+	0) so it can be tuned apart from everything else. What is written to
+	an EncryptWriter is cut into blocks of compressBlockBytes, each
+	compressed on a worker as a frame of its own, and the frames are
+	chunked and sealed on the caller's goroutine in the order they were
+	cut, as the single stream was before
+
+	zstd, gzip, and lz4 streams are their frames one after another - their
+	readers read frame after frame - so the file format is unchanged and
+	files written either way decrypt the same. A codec registered by the
+	caller is not known to be read that way, so it still compresses one
+	stream inline. Frames of a MB cost a little ratio against one stream
+	(each starts without history), which buys compressing on every core
+
+	At most two blocks per worker are in flight, so a slow sealer or
+	target holds back the writer rather than growing memory. With
+	Options.StageReport the job reports each stage's throughput, which
+	says which one is the bottleneck - reading (for file jobs, see
+	runCompressedJob), compressing, or sealing and writing
+*/
+
+const compressBlockBytes = 1 << 20
+
+// Filled in as a compressed encryption finishes, when Options.StageReport is not nil - jobs of several files add up
+type StageReport struct {
+	Elapsed time.Duration
+	Stages  []StageStats
+}
+
+type StageStats struct {
+	Name    string // read, compress, or seal (sealing and writing the target)
+	Workers int
+	Bytes   int64         // What the stage took in
+	Busy    time.Duration // Summed over the workers
+}
+
+// In the order data goes through them
+var stageNames = []string{"read", "compress", "seal"}
+
+func (report *StageReport) add(elapsed time.Duration, stages ...StageStats) {
+	report.Elapsed += elapsed
+
+	for _, stage := range stages {
+		found := false
+		for i := range report.Stages {
+			if report.Stages[i].Name == stage.Name {
+				report.Stages[i].Bytes += stage.Bytes
+				report.Stages[i].Busy += stage.Busy
+				found = true
+			}
+		}
+
+		if !found {
+			report.Stages = append(report.Stages, stage)
+		}
+	}
+
+	sort.SliceStable(report.Stages, func(i, j int) bool {
+		return stageOrder(report.Stages[i].Name) < stageOrder(report.Stages[j].Name)
+	})
+}
+
+func stageOrder(name string) int {
+	for i, known := range stageNames {
+		if known == name {
+			return i
+		}
+	}
+
+	return len(stageNames)
+}
+
+// MB per second while the stage's workers were at work, what it can keep up with
+func (stage StageStats) Throughput() float64 {
+	if stage.Busy <= 0 {
+		return 0
+	}
+
+	return float64(stage.Bytes) / 1e6 / (stage.Busy.Seconds() / float64(stage.Workers))
+}
+
+// The fraction of the job its workers were at work, the bottleneck is the stage near 1
+func (stage StageStats) Utilization(elapsed time.Duration) float64 {
+	if elapsed <= 0 || stage.Workers == 0 {
+		return 0
+	}
+
+	return stage.Busy.Seconds() / float64(stage.Workers) / elapsed.Seconds()
+}
+
+// Codecs whose streams can be written as independent frames, one after another
+type framedCodec interface {
+	framed()
+}
+
+func (zstdCodec) framed() {}
+
+func (gzipCodec) framed() {}
+
+func (lz4Codec) framed() {}
+
+type compressBlock struct {
+	plaintext []byte
+	frame     []byte
+	err       error
+	done      chan struct{}
+}
+
+// Takes an EncryptWriter's compressor's place, writing the frames to target in order
+type compressPool struct {
+	compressBusy int64 // Nanoseconds, summed by the workers - first, so 32-bit platforms align them for atomics
+	compressIn   int64
+	codec        Codec
+	target       io.Writer
+	workers      int
+	pending      []byte           // Not yet cut into a block
+	inFlight     []*compressBlock // In the order they were cut
+	blocks       chan *compressBlock
+	started      bool
+	sealBusy     time.Duration
+	sealIn       int64
+	err          error
+}
+
+func newCompressPool(codec Codec, workers int, target io.Writer) *compressPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &compressPool{codec: codec, target: target, workers: workers}
+}
+
+func (pool *compressPool) Write(data []byte) (int, error) {
+	if pool.err != nil {
+		return 0, pool.err
+	}
+
+	pool.pending = append(pool.pending, data...)
+
+	// A block keeps its part of pending, appends only ever go after it
+	for len(pool.pending) >= compressBlockBytes {
+		pool.err = pool.dispatch(pool.pending[:compressBlockBytes:compressBlockBytes])
+		if pool.err != nil {
+			pool.stop()
+			return 0, pool.err
+		}
+
+		pool.pending = pool.pending[compressBlockBytes:]
+	}
+
+	return len(data), nil
+}
+
+// What is pending is a block of its own, so the next write starts a frame
+func (pool *compressPool) endFrame() error {
+	if pool.err != nil || len(pool.pending) == 0 {
+		return pool.err
+	}
+
+	pool.err = pool.dispatch(pool.pending)
+	pool.pending = nil
+
+	if pool.err != nil {
+		pool.stop()
+	}
+
+	return pool.err
+}
+
+// Compresses what is left, and writes every frame - the target is not closed
+func (pool *compressPool) Close() error {
+	defer pool.stop()
+
+	if pool.err != nil {
+		return pool.err
+	}
+
+	// An empty stream is still one frame, readers expect at least one
+	if len(pool.pending) > 0 || !pool.started {
+		pool.err = pool.dispatch(pool.pending)
+		pool.pending = nil
+	}
+
+	for pool.err == nil && len(pool.inFlight) > 0 {
+		pool.err = pool.writeOldest()
+	}
+
+	return pool.err
+}
+
+func (pool *compressPool) dispatch(plaintext []byte) error {
+	if !pool.started {
+		pool.started = true
+		pool.blocks = make(chan *compressBlock, pool.workers)
+
+		for i := 0; i < pool.workers; i++ {
+			go pool.compressWorker()
+		}
+	}
+
+	if len(pool.inFlight) == 2*pool.workers {
+		err := pool.writeOldest()
+		if err != nil {
+			return err
+		}
+	}
+
+	block := &compressBlock{plaintext: plaintext, done: make(chan struct{})}
+	pool.inFlight = append(pool.inFlight, block)
+	pool.blocks <- block
+
+	return nil
+}
+
+func (pool *compressPool) compressWorker() {
+	for block := range pool.blocks {
+		start := time.Now()
+
+		var frame bytes.Buffer
+		compressor := pool.codec.NewWriter(&frame)
+
+		_, block.err = compressor.Write(block.plaintext)
+		if block.err == nil {
+			block.err = compressor.Close()
+		}
+
+		block.frame = frame.Bytes()
+		atomic.AddInt64(&pool.compressIn, int64(len(block.plaintext)))
+		atomic.AddInt64(&pool.compressBusy, int64(time.Since(start)))
+
+		close(block.done)
+	}
+}
+
+func (pool *compressPool) writeOldest() error {
+	block := pool.inFlight[0]
+	pool.inFlight = pool.inFlight[1:]
+
+	<-block.done
+	if block.err != nil {
+		return block.err
+	}
+
+	start := time.Now()
+	_, err := pool.target.Write(block.frame)
+	pool.sealBusy += time.Since(start)
+	pool.sealIn += int64(len(block.frame))
+
+	return err
+}
+
+// The workers finish what they have and end, blocks still in flight are dropped
+func (pool *compressPool) stop() {
+	if pool.blocks != nil {
+		close(pool.blocks)
+		pool.blocks = nil
+	}
+
+	for _, block := range pool.inFlight {
+		<-block.done
+	}
+
+	pool.inFlight = nil
+}
+
+func (pool *compressPool) stages() []StageStats {
+	return []StageStats{
+		{Name: "compress", Workers: pool.workers, Bytes: atomic.LoadInt64(&pool.compressIn), Busy: time.Duration(atomic.LoadInt64(&pool.compressBusy))},
+		{Name: "seal", Workers: 1, Bytes: pool.sealIn, Busy: pool.sealBusy},
+	}
+}
+
+// Times what a file job reads, the read stage of its report
+type timedReader struct {
+	source io.Reader
+	bytes  int64
+	busy   time.Duration
+}
+
+func (reader *timedReader) Read(data []byte) (int, error) {
+	start := time.Now()
+	read, err := reader.source.Read(data)
+	reader.busy += time.Since(start)
+	reader.bytes += int64(read)
+
+	return read, err
+}
@@ -0,0 +1,130 @@
+package encryptor
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+/*
+	A bug that panics in one of the pipeline's goroutines would take the
+	whole process down mid-write, with nothing but a wall of goroutine
+	stacks to show for it. Workers recover instead, and the panic becomes
+	the job's error like any other failure - a *CrashError (matching
+	ErrCrashed) carrying a report worth attaching to a bug report: where
+	it crashed, the stacks, the versions, and the job's parameters. Key
+	material, passwords, and salts are never part of it
+*/
+
+type CrashReport struct {
+	Time       time.Time
+	Worker     string // Where it crashed, e.g. execute worker 3
+	Panic      string
+	Stack      string // The crashed goroutine's
+	Goroutines string // Every goroutine's, as the crash was recovered
+	GoVersion  string
+	Platform   string
+	Job        CrashJobParameters
+}
+
+type CrashJobParameters struct {
+	Operation      OperationEnum
+	SourceFilename string
+	TargetFilename string
+	Cipher         string
+	ChunkSizeMB    uint
+	NumChunks      uint32
+	NumReaders     uint
+	NumExecutors   uint
+	NumWriters     uint
+	PoolWorkers    uint
+	BatchChunks    uint
+	PrefetchChunks uint
+	HeadFirst      bool
+	MaxMemoryMB    uint
+	ChunkChecksum  bool
+	CloudChecksums bool
+	Recipients     int // How many, not who
+	DiscardOutput  bool
+}
+
+type CrashError struct {
+	Report CrashReport
+}
+
+func (crash *CrashError) Error() string {
+	return fmt.Sprintf("%s crashed: %s", crash.Report.Worker, crash.Report.Panic)
+}
+
+func (crash *CrashError) Unwrap() error {
+	return ErrCrashed
+}
+
+// Every goroutine's stack, however many there are, up to a limit
+const crashStacksMaxBytes = 8 * 1024 * 1024
+
+func newCrashError(worker string, recovered interface{}) *CrashError {
+	stacks := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(stacks, true)
+		if n < len(stacks) || len(stacks) >= crashStacksMaxBytes {
+			stacks = stacks[:n]
+			break
+		}
+
+		stacks = make([]byte, len(stacks)*2)
+	}
+
+	return &CrashError{Report: CrashReport{
+		Time:       time.Now().UTC(),
+		Worker:     worker,
+		Panic:      fmt.Sprint(recovered),
+		Stack:      string(debug.Stack()),
+		Goroutines: string(stacks),
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}}
+}
+
+// Deferred by workers that report through err, a panic becomes a *CrashError in it
+func recoverWorkerPanic(worker string, err *error) {
+	if recovered := recover(); recovered != nil {
+		*err = newCrashError(worker, recovered)
+	}
+}
+
+// Runs work, returning a panic in it as a *CrashError
+func runRecovered(worker string, work func() error) (err error) {
+	defer recoverWorkerPanic(worker, &err)
+	return work()
+}
+
+// The job minus its secrets
+func crashJobParameters(job *pipelineJob, header *EncryptedFileHeader) CrashJobParameters {
+	parameters := CrashJobParameters{
+		Operation:      job.Operation,
+		SourceFilename: job.SourceFilename,
+		TargetFilename: job.TargetFilename,
+		ChunkSizeMB:    job.ChunkSizeMB,
+		NumChunks:      header.NumChunks,
+		NumReaders:     job.NumReaders,
+		NumExecutors:   job.NumExecutors,
+		NumWriters:     job.NumWriters,
+		PoolWorkers:    job.PoolWorkers,
+		BatchChunks:    job.BatchChunks,
+		PrefetchChunks: job.PrefetchChunks,
+		HeadFirst:      job.HeadFirst,
+		MaxMemoryMB:    job.MaxMemoryMB,
+		ChunkChecksum:  job.ChunkChecksum,
+		CloudChecksums: job.CloudChecksums,
+		Recipients:     len(job.Recipients),
+		DiscardOutput:  job.DiscardOutput,
+	}
+
+	if suite, err := cipherSuiteForHeader(header); err == nil {
+		parameters.Cipher = suite.Name
+	}
+
+	return parameters
+}
@@ -0,0 +1,439 @@
+package encryptor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+type CipherEnum uint8
+type CipherModeEnum uint8
+
+const (
+	AES CipherEnum = iota
+	XChaCha20
+	Plugin // Modes from pluginModeBase up, see plugin.go
+)
+
+const (
+	GCM CipherModeEnum = iota
+	Poly1305
+	GCMSIV
+)
+
+const AESNonceSize uint = 12
+const AESTagSize uint = 16
+const XChaCha20NonceSize uint = 24
+const Poly1305TagSize uint = 16
+const PasswordSaltSize uint = 16
+const FileIDSize uint = 16
+const KDFPBKDF2SHA256 = "PBKDF2-SHA256"
+
+// OWASP recommends north of 300,000 iterations of hashing if I recall correctly
+const PasswordKDFIterations = 350000
+
+/*
+	New files record the KDF and its iterations in their header, so the
+	iterations above can change between releases without breaking older
+	files - files from before that (format 1.4 and older) were derived
+	with the original PBKDF2-SHA256 parameters, kept here for them
+*/
+const legacyKDFIterations = 350000
+
+// Decrypting never runs more iterations than this, a hostile header should not pin the CPU for hours
+const maximumKDFIterations = 100000000
+
+/*
+	The salt is random per file so the same password never derives the
+	same key twice, files from before the salt (format 1.3 and older)
+	have no salt in their header and are derived with a nil salt
+*/
+func generateKey256FromString(keyMaterial string, salt []byte, iterations int) ([]byte, error) {
+	if iterations < 1 || iterations > maximumKDFIterations {
+		return []byte{}, fmt.Errorf("password key derivation iterations must be between 1 and %d", maximumKDFIterations)
+	}
+
+	key := pbkdf2.Key([]byte(keyMaterial), salt, iterations, 32, sha256.New)
+
+	if len(key) == 32 {
+		return key, nil
+	}
+
+	return []byte{}, errors.New("password key derivation function returned an invalid key length")
+}
+
+func newPasswordSalt() ([]byte, error) {
+	salt := make([]byte, PasswordSaltSize)
+	if err := readRandom(salt); err != nil {
+		return nil, fmt.Errorf("internal crypto error generating password salt: %w", err)
+	}
+
+	return salt, nil
+}
+
+// Random per file, so chunks cannot be moved between files that share a key
+func newFileID() ([]byte, error) {
+	fileID := make([]byte, FileIDSize)
+	if err := readRandom(fileID); err != nil {
+		return nil, fmt.Errorf("internal crypto error generating file ID: %w", err)
+	}
+
+	return fileID, nil
+}
+
+func hashFile(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	if stats, err := file.Stat(); err == nil && stats.Mode().IsRegular() && stats.Size() >= hashReadAheadMinimumBytes {
+		return hashLargeFile(fileName, stats)
+	}
+
+	return hashReader(file)
+}
+
+func hashReader(reader io.Reader) (string, error) {
+	// Use io copy to stream data through the hash algo
+	hashComp := sha256.New()
+	_, err := io.Copy(hashComp, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hashComp.Sum(nil)), nil
+}
+
+/*
+	CRC32C is not a cryptographic check, GCM authentication is, but it is
+	computed in hardware on most CPUs and lets integrity sweeps spot
+	corrupt chunks without the key and without paying for authentication
+*/
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func appendChecksumCRC32C(data []byte) []byte {
+	checksum := make([]byte, CRC32CSize)
+	binary.LittleEndian.PutUint32(checksum, crc32.Checksum(data, crc32cTable))
+
+	return append(data, checksum...)
+}
+
+func stripChecksumCRC32C(data []byte) ([]byte, error) {
+	if len(data) < int(CRC32CSize) {
+		return nil, errors.New("data is too small to contain a CRC32C checksum")
+	}
+
+	payload, checksum := data[:len(data)-int(CRC32CSize)], data[len(data)-int(CRC32CSize):]
+	if crc32.Checksum(payload, crc32cTable) != binary.LittleEndian.Uint32(checksum) {
+		return nil, errors.New("CRC32C checksum mismatch")
+	}
+
+	return payload, nil
+}
+
+/*
+	Every cipher a file can be encrypted with - Name is what --cipher,
+	policies, and capabilities use, Algorithm and Mode are what the file
+	header records
+*/
+type cipherSuite struct {
+	Name         string
+	Cipher       CipherEnum
+	Mode         CipherModeEnum
+	Algorithm    string
+	ModeName     string
+	KeySize      int
+	NonceSize    uint
+	TagSize      uint
+	FIPSApproved bool
+}
+
+const DefaultCipher = "AES-256-GCM"
+
+var cipherSuites = []cipherSuite{
+	{Name: "AES-256-GCM", Cipher: AES, Mode: GCM, Algorithm: "AES", ModeName: "GCM", KeySize: 256, NonceSize: AESNonceSize, TagSize: AESTagSize, FIPSApproved: true},
+	{Name: "XChaCha20-Poly1305", Cipher: XChaCha20, Mode: Poly1305, Algorithm: "XChaCha20", ModeName: "Poly1305", KeySize: 256, NonceSize: XChaCha20NonceSize, TagSize: Poly1305TagSize},
+	{Name: "AES-256-GCM-SIV", Cipher: AES, Mode: GCMSIV, Algorithm: "AES", ModeName: "GCM-SIV", KeySize: 256, NonceSize: gcmSIVNonceSize, TagSize: gcmSIVTagSize},
+}
+
+// An empty name is the default cipher
+func cipherSuiteByName(name string) (cipherSuite, error) {
+	if strings.TrimSpace(name) == "" {
+		name = DefaultCipher
+	}
+
+	for _, suite := range cipherSuites {
+		if strings.EqualFold(suite.Name, strings.TrimSpace(name)) {
+			return suite, nil
+		}
+	}
+
+	if strings.Contains(name, ":") {
+		return pluginCipherSuiteByName(name)
+	}
+
+	return cipherSuite{}, fmt.Errorf("cipher %q is not supported", name)
+}
+
+func cipherSuiteByEnum(cipherEnum CipherEnum, mode CipherModeEnum) cipherSuite {
+	if cipherEnum == Plugin {
+		if cipher, err := pluginCipherByMode(mode); err == nil {
+			return cipher.suite
+		}
+	}
+
+	for _, suite := range cipherSuites {
+		if suite.Cipher == cipherEnum && suite.Mode == mode {
+			return suite
+		}
+	}
+
+	return cipherSuites[0]
+}
+
+func cipherSuiteForHeader(header *EncryptedFileHeader) (cipherSuite, error) {
+	for _, suite := range cipherSuites {
+		if header.Algorithm == suite.Algorithm && header.Mode == suite.ModeName && header.KeySize == suite.KeySize {
+			return suite, nil
+		}
+	}
+
+	if strings.HasPrefix(header.Algorithm, pluginAlgorithmPrefix) {
+		suite, err := pluginCipherSuiteByName(strings.TrimPrefix(header.Algorithm, pluginAlgorithmPrefix) + ":" + header.Mode)
+		if err != nil {
+			return cipherSuite{}, err
+		}
+
+		if suite.KeySize != header.KeySize {
+			return cipherSuite{}, fmt.Errorf("cipher %s takes %d bit keys, the file was encrypted with %d", suite.Name, suite.KeySize, header.KeySize)
+		}
+
+		return suite, nil
+	}
+
+	return cipherSuite{}, fmt.Errorf("cipher %s-%d-%s is not supported by this version of encryptor", header.Algorithm, header.KeySize, header.Mode)
+}
+
+// Nonces start with nonceStart, nil for nonces that are random throughout (see chunkNonceStart)
+func encryptBlob(cipherEnum CipherEnum, mode CipherModeEnum, blob *[]byte, key []byte, additionalData []byte, nonceStart []byte) (*[]byte, error) {
+	if cipherEnum == Plugin {
+		return encryptBlobPlugin(mode, blob, key, additionalData, nonceStart)
+	} else if cipherEnum == XChaCha20 {
+		return encryptBlobXChaCha20Poly1305(blob, key, additionalData, nonceStart)
+	} else if mode == GCMSIV {
+		return encryptBlobAESGCMSIV256(blob, key, additionalData, nonceStart)
+	}
+
+	return encryptBlobAESGCM256(blob, key, additionalData, nonceStart)
+}
+
+func decryptBlob(cipherEnum CipherEnum, mode CipherModeEnum, blob *[]byte, key []byte, additionalData []byte) (*[]byte, error) {
+	if cipherEnum == Plugin {
+		return decryptBlobPlugin(mode, blob, key, additionalData)
+	} else if cipherEnum == XChaCha20 {
+		return decryptBlobXChaCha20Poly1305(blob, key, additionalData)
+	} else if mode == GCMSIV {
+		return decryptBlobAESGCMSIV256(blob, key, additionalData)
+	}
+
+	return decryptBlobAESGCM256(blob, key, additionalData)
+}
+
+func encryptBlobAESGCM256(blob *[]byte, key []byte, additionalData []byte, nonceStart []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("invalid key size supplied - this function takes 256 bits of key material")
+	}
+
+	/*
+		AES is fundamentally a block cipher, but we can use it in GCM mode as a streaming cipher
+		which is desirable because we don't want to manipulate our input sizes for crypto reasons,
+		nor introduce padding into the output (making our ability to chunk data on large files
+		simpler) while keeping very strong protection AND authentication
+	*/
+	blockAES, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	/*
+		Nonces are a critical aspect of the AES-GCM combination.  Important considerations include
+		ensuring that you never re-use the same nonce with the same key - for a given piece of
+		content using a non ephemeral key we can come up with a careful iterative paradigm, or we
+		can generate a random nonce if we accept the size of the likely collision space
+
+		The nonce is a 12 byte value (technically you can supply a larger nonce but anything larger
+		than 12 bytes will be internally hashed back into 12) meaning we should limit ourselves
+		to 2^32 uses of nonce randomization for a given key (the collision space is 2^96)
+
+		For this type of encryption/decryption tool this should be deemed safe - and with a
+		nonce prefix chunks take counted nonces, unique within a file, see nonce.go
+	*/
+	nonce, err := newChunkNonce(nonceStart, int(AESNonceSize), len(*blob)+int(AESTagSize))
+	if err != nil {
+		return nil, err
+	}
+
+	blockAESGCM, err := cipher.NewGCM(blockAES)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error creating mode block for cipher: %w", err)
+	}
+
+	/*
+		The additional authenticated data (AAD) ties the chunk to its place
+		in its file, see chunkAdditionalData - it is nil for files written
+		before format 1.8
+
+		Note: Passing the nonce as the first argument to Seal apparently get Seal to prefix the
+		ciphertext with the nonce (which we want) which did not seem to match the documentation
+		for that argument
+	*/
+	encryptedData := blockAESGCM.Seal(nonce, nonce, *blob, additionalData)
+
+	return &encryptedData, nil
+}
+
+func decryptBlobAESGCM256(blob *[]byte, key []byte, additionalData []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("invalid key size supplied - this function takes 256 bits of key material")
+	}
+
+	blockAES, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	blockAESGCM, err := cipher.NewGCM(blockAES)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error creating mode block for cipher: %w", err)
+	}
+
+	// Extract the nonce - which we expect to be prepended to the encrypted data
+	nonceSize := blockAESGCM.NonceSize()
+	nonce, ciphertext := (*blob)[:nonceSize], (*blob)[nonceSize:]
+
+	plaintext, err := blockAESGCM.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data using the provided key material: %w", err)
+	}
+
+	return &plaintext, nil
+}
+
+/*
+	XChaCha20-Poly1305 has a 24 byte nonce, so random nonces are safe for
+	practically unlimited uses of a key (the 2^32 limit above does not
+	apply), and it is fast in software on machines without AES-NI
+
+	Chunks are laid out like AES-GCM chunks - nonce, ciphertext, tag
+*/
+func encryptBlobXChaCha20Poly1305(blob *[]byte, key []byte, additionalData []byte, nonceStart []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	nonce, err := newChunkNonce(nonceStart, aead.NonceSize(), len(*blob)+aead.Overhead())
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedData := aead.Seal(nonce, nonce, *blob, additionalData)
+
+	return &encryptedData, nil
+}
+
+func decryptBlobXChaCha20Poly1305(blob *[]byte, key []byte, additionalData []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	if len(*blob) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is shorter than its nonce")
+	}
+
+	nonce, ciphertext := (*blob)[:aead.NonceSize()], (*blob)[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data using the provided key material: %w", err)
+	}
+
+	return &plaintext, nil
+}
+
+// Laid out like AES-GCM chunks - nonce, ciphertext, tag
+func encryptBlobAESGCMSIV256(blob *[]byte, key []byte, additionalData []byte, nonceStart []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	aead, err := newAESGCMSIV(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	nonce, err := newChunkNonce(nonceStart, aead.NonceSize(), len(*blob)+aead.Overhead())
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedData := aead.Seal(nonce, nonce, *blob, additionalData)
+
+	return &encryptedData, nil
+}
+
+func decryptBlobAESGCMSIV256(blob *[]byte, key []byte, additionalData []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	aead, err := newAESGCMSIV(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	if len(*blob) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is shorter than its nonce")
+	}
+
+	nonce, ciphertext := (*blob)[:aead.NonceSize()], (*blob)[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data using the provided key material: %w", err)
+	}
+
+	return &plaintext, nil
+}
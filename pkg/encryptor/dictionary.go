@@ -0,0 +1,192 @@
+package encryptor
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Options.ZstdDictionary has a directory compressed with zstd trained
+	a dictionary (see zstddictionary.go) from its files before it is
+	archived, and every entry of the tar compressed with it as a frame of
+	its own, so any entry decompresses without those before it. A small
+	file alone has too little history to compress well, which a
+	dictionary of what the files share makes up for: 300 entries of
+	small JSON records come to 39KB with one and 84KB without. Files that
+	are alike and archived next to each other are still smaller as one
+	stream, each having those before it as history - 2.3MB for 40,000 of
+	those records, against 4.3MB a frame each with a dictionary
+
+	The samples are entries as the tar holds them, header and padding
+	too, of the files no larger than dictionarySampleMaxBytes (larger
+	ones have history enough of their own), taken evenly over the tree
+	up to dictionarySampleBytes - a hundred times the dictionary, as zstd
+	suggests. With fewer than dictionaryMinSamples, or samples sharing
+	nothing, there is no dictionary and the tar is compressed as usual
+
+	A large file's entry is several frames, as any compressed stream is
+	cut into blocks, and every frame names the dictionary's ID in its
+	header - frames naming none are read without it. The dictionary is in
+	the header (format 1.17), sealed with the file's key and bound to the
+	file ID like the plaintext digest, since it is made of the plaintext
+*/
+
+const dictionarySampleMaxBytes = 128 << 10
+const dictionarySampleBytes = 100 * zstdDictionaryMaxBytes
+const dictionaryMinSamples = 8
+
+const dictionaryLabel = "encryptor zstd dictionary"
+
+func dictionaryAdditionalData(fileID []byte) []byte {
+	return append([]byte(dictionaryLabel), fileID...)
+}
+
+// The dictionary a directory's tar is compressed with, nil for none
+func trainArchiveDictionary(directory string, options *Options) ([]byte, error) {
+	if !options.ZstdDictionary {
+		return nil, nil
+	}
+
+	if options.Compression != CompressionZstd {
+		return nil, fmt.Errorf("a dictionary is only trained for %s compression, not %q", CompressionZstd, options.Compression)
+	}
+
+	samples, err := sampleArchiveEntries(directory)
+	if err != nil {
+		return nil, fmt.Errorf("could not sample %s for a dictionary: %w", directory, err)
+	}
+
+	if len(samples) < dictionaryMinSamples {
+		return nil, nil
+	}
+
+	return trainZstdDictionary(samples), nil
+}
+
+// Small files' entries as the tar will hold them, spread over the tree
+func sampleArchiveEntries(directory string) ([][]byte, error) {
+	type candidate struct {
+		path string
+		name string
+		info os.FileInfo
+	}
+
+	var candidates []candidate
+	total := int64(0)
+
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.Size() > dictionarySampleMaxBytes {
+			return err
+		}
+
+		name, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+
+		candidates = append(candidates, candidate{path: path, name: filepath.ToSlash(name), info: info})
+		total += info.Size()
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	stride := int(1 + total/dictionarySampleBytes)
+
+	var samples [][]byte
+	sampled := 0
+
+	for i := 0; i < len(candidates) && sampled < dictionarySampleBytes; i += stride {
+		var entry bytes.Buffer
+
+		archive := tar.NewWriter(&entry)
+		err = archiveEntry(archive, candidates[i].path, candidates[i].name, candidates[i].info, "")
+		if err == nil {
+			err = archive.Flush()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		samples = append(samples, entry.Bytes())
+		sampled += entry.Len()
+	}
+
+	return samples, nil
+}
+
+// Sets the job's dictionary for the header, sealed with its key
+func sealDictionary(job *pipelineJob, dictionary []byte) error {
+	sealed, err := encryptBlob(job.Cipher, job.CipherMode, &dictionary, job.KeyMaterial, dictionaryAdditionalData(job.FileID), nil)
+	if err != nil {
+		return fmt.Errorf("could not seal the dictionary: %w", err)
+	}
+
+	job.Dictionary = *sealed
+	return nil
+}
+
+// The dictionary as it was before it was sealed, the one sealed in header
+func openDictionary(header *EncryptedFileHeader, keyMaterial []byte) ([]byte, error) {
+	suite, err := cipherSuiteForHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := header.Dictionary
+
+	dictionary, err := decryptBlob(suite.Cipher, suite.Mode, &sealed, keyMaterial, dictionaryAdditionalData(header.FileID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, err)
+	}
+
+	return *dictionary, nil
+}
+
+// The codec for a header with a dictionary, which only zstd has
+func dictionaryCodec(header *EncryptedFileHeader, keyMaterial []byte) (Codec, error) {
+	if header.Compression != CompressionZstd {
+		return nil, fmt.Errorf("%w, it has a dictionary for %q compression, which has none", ErrFileCorrupt, header.Compression)
+	}
+
+	data, err := openDictionary(header, keyMaterial)
+	if err != nil {
+		return nil, err
+	}
+
+	dictionary, err := parseZstdDictionary(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w, its dictionary cannot be read: %v", ErrFileCorrupt, err)
+	}
+
+	return zstdDictionaryCodec{dictionary}, nil
+}
+
+type zstdDictionaryCodec struct {
+	dictionary *zstdDictionary
+}
+
+func (zstdDictionaryCodec) Name() string { return CompressionZstd }
+
+func (codec zstdDictionaryCodec) NewWriter(target io.Writer) io.WriteCloser {
+	return newZstdDictionaryWriter(target, codec.dictionary)
+}
+
+func (codec zstdDictionaryCodec) NewReader(source io.Reader) io.Reader {
+	return newZstdDictionaryReader(source, codec.dictionary)
+}
+
+func (zstdDictionaryCodec) framed() {}
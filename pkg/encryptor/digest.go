@@ -0,0 +1,84 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+/*
+	Since format 1.10 the header carries the SHA256 of the plaintext, so
+	decryption can check what it wrote against what was encrypted - the
+	last word after chunk authentication and the footer, and the same hash
+	--hash prints. It is sealed with the file's key (in the clear it would
+	confirm a guess at the contents to anyone holding the file), bound to
+	the file by its file ID
+
+	The header is written before the first chunk, so the source is hashed
+	before it is encrypted - files are read twice, streams are not hashed
+	at all. Decryption hashes as it writes, and costs no extra reads
+*/
+
+const plaintextDigestLabel = "encryptor plaintext sha256"
+
+func plaintextDigestAdditionalData(fileID []byte) []byte {
+	return append([]byte(plaintextDigestLabel), fileID...)
+}
+
+// Hashes the source and seals the digest for the header
+func sealedPlaintextDigest(job *pipelineJob) ([]byte, error) {
+	hash, err := hashFile(job.SourceFilename)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash source file: %w", err)
+	}
+
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := encryptBlob(job.Cipher, job.CipherMode, &digest, job.KeyMaterial, plaintextDigestAdditionalData(job.FileID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not seal plaintext digest: %w", err)
+	}
+
+	return *sealed, nil
+}
+
+// nil for headers without a plaintext digest
+func openPlaintextDigest(header *EncryptedFileHeader, keyMaterial []byte) ([]byte, error) {
+	if len(header.PlaintextHash) == 0 {
+		return nil, nil
+	}
+
+	suite, err := cipherSuiteForHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header.PlaintextHash) != int(suite.NonceSize)+sha256.Size+int(suite.TagSize) {
+		return nil, fmt.Errorf("%w, its plaintext digest is malformed", ErrNotEncryptedFile)
+	}
+
+	sealed := header.PlaintextHash
+
+	digest, err := decryptBlob(suite.Cipher, suite.Mode, &sealed, keyMaterial, plaintextDigestAdditionalData(header.FileID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, err)
+	}
+
+	return *digest, nil
+}
+
+func verifyPlaintextDigest(expected []byte, actual []byte) error {
+	if expected == nil {
+		return nil
+	}
+
+	if !bytes.Equal(expected, actual) {
+		return fmt.Errorf("%w, expected SHA256 %s but decrypted %s", ErrPlaintextMismatch, hex.EncodeToString(expected), hex.EncodeToString(actual))
+	}
+
+	return nil
+}
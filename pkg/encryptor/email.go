@@ -0,0 +1,219 @@
+package encryptor
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/*
+	Mail gateways are unkind to binaries and to filenames - attachments
+	get re-encoded, stripped of bytes, or renamed to ATT00001.bin when
+	their names are not ASCII. Wrapping an encrypted file as an email
+	sidesteps all of it: the ciphertext is armored as 76 column base64
+	(7 bit clean, as mail has always expected), and the attachment name
+	is given both RFC 2231 encoded and as an RFC 2047 encoded word, so old
+	and new clients alike show the name the sender chose
+
+	The message is a draft (X-Unsent), there is no From - mail clients
+	open it ready to send from the user's own account. The attachment is
+	a streamed encrypted file, encryptor -d decrypts it once saved
+*/
+
+type EmailOptions struct {
+	To             []string // Addresses, with or without display names
+	Subject        string   // Defaults to the attachment's name
+	AttachmentName string   // Defaults to DefaultAttachmentName
+}
+
+const DefaultAttachmentName = "encrypted.enc"
+
+const armorLineLength = 76
+
+func wrapEmail(source io.Reader, target io.Writer, email *EmailOptions, options *Options) error {
+	if source == nil || target == nil || email == nil || options == nil {
+		return errors.New("source, target, email options, or options is nil")
+	}
+
+	attachmentName := safeAttachmentName(email.AttachmentName)
+
+	subject := email.Subject
+	if subject == "" {
+		subject = attachmentName
+	}
+
+	var to []string
+	for _, address := range email.To {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("email address %q is not valid: %w", address, err)
+		}
+
+		to = append(to, parsed.String())
+	}
+
+	message := multipart.NewWriter(target)
+
+	headers := "MIME-Version: 1.0\r\n"
+	if len(to) > 0 {
+		headers += "To: " + strings.Join(to, ", ") + "\r\n"
+	}
+
+	headers += "Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n"
+	headers += "Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"
+	headers += "X-Unsent: 1\r\n"
+	headers += "Content-Type: multipart/mixed;\r\n boundary=" + message.Boundary() + "\r\n\r\n"
+
+	_, err := io.WriteString(target, headers)
+	if err != nil {
+		return fmt.Errorf("could not write email headers: %w", err)
+	}
+
+	err = writeEmailInstructions(message, attachmentName)
+	if err != nil {
+		return err
+	}
+
+	err = writeEmailAttachment(message, source, attachmentName, options)
+	if err != nil {
+		return err
+	}
+
+	return message.Close()
+}
+
+func writeEmailInstructions(message *multipart.Writer, attachmentName string) error {
+	part, err := message.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return fmt.Errorf("could not write email body: %w", err)
+	}
+
+	decryptedName := strings.TrimSuffix(attachmentName, ".enc")
+	if decryptedName == attachmentName {
+		decryptedName += ".decrypted"
+	}
+
+	body := quotedprintable.NewWriter(part)
+
+	_, err = fmt.Fprintf(body, "%s is attached, encrypted with encryptor. Save it and decrypt it with:\r\n\r\n    encryptor -d \"%s\" \"%s\"\r\n", attachmentName, attachmentName, decryptedName)
+	if err != nil {
+		return fmt.Errorf("could not write email body: %w", err)
+	}
+
+	return body.Close()
+}
+
+func writeEmailAttachment(message *multipart.Writer, source io.Reader, attachmentName string, options *Options) error {
+	part, err := message.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType("application/octet-stream", map[string]string{"name": mime.BEncoding.Encode("utf-8", attachmentName)})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachmentName})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return fmt.Errorf("could not write email attachment: %w", err)
+	}
+
+	lines := &lineWrapWriter{w: part, width: armorLineLength}
+	armor := base64.NewEncoder(base64.StdEncoding, lines)
+
+	writer, err := NewEncryptWriter(armor, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, source)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	err = armor.Close()
+	if err != nil {
+		return fmt.Errorf("could not write email attachment: %w", err)
+	}
+
+	return lines.finish()
+}
+
+// Attachment names are the last element of a path, without control characters
+func safeAttachmentName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' || r == '\\' {
+			return '_'
+		}
+
+		return r
+	}, strings.TrimSpace(name))
+
+	if name == "" || name == "." || name == ".." {
+		return DefaultAttachmentName
+	}
+
+	return name
+}
+
+// Breaks what is written into CRLF terminated lines of width bytes
+type lineWrapWriter struct {
+	w      io.Writer
+	width  int
+	column int
+}
+
+func (writer *lineWrapWriter) Write(data []byte) (int, error) {
+	written := 0
+
+	for len(data) > 0 {
+		length := writer.width - writer.column
+		if length > len(data) {
+			length = len(data)
+		}
+
+		n, err := writer.w.Write(data[:length])
+		written += n
+		writer.column += n
+
+		if err != nil {
+			return written, err
+		}
+
+		data = data[length:]
+
+		if writer.column == writer.width {
+			_, err = io.WriteString(writer.w, "\r\n")
+			if err != nil {
+				return written, err
+			}
+
+			writer.column = 0
+		}
+	}
+
+	return written, nil
+}
+
+// Ends the last line, if it was not already
+func (writer *lineWrapWriter) finish() error {
+	if writer.column == 0 {
+		return nil
+	}
+
+	writer.column = 0
+
+	_, err := io.WriteString(writer.w, "\r\n")
+	return err
+}
@@ -0,0 +1,710 @@
+package encryptor
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type pipelineJob struct {
+	NumReaders     uint
+	NumExecutors   uint
+	NumWriters     uint
+	BatchChunks    uint
+	ChunkChecksum  bool
+	CloudChecksums bool
+	Recipients     []RecipientStanza
+	Salt           []byte
+	KDF            string
+	KDFIterations  int
+	FileID         []byte
+	NoncePrefix    []byte
+	HashPlaintext  bool   // Store the source's SHA256 when encrypting
+	PlaintextHash  []byte // Sealed, for the header
+	PrefetchChunks uint
+	PoolWorkers    uint
+	ScaleExecutors bool // NumExecutors is a cap, see scaling.go
+	MaxMemoryMB    uint
+	MemoryLimit    string // The limit MaxMemoryMB was taken from (see memlimit.go), empty when the options set it
+	MemoryReport   *MemoryReport
+	TreeHash       *MerkleTree   // Filled in over the plaintext when not nil
+	TreeLeaves     *merkleLeaves // Recorded by the executors for TreeHash
+	MemorySampling time.Duration // The report's time series interval
+	PartSizeMB     uint
+	Bandwidth      BandwidthSchedule
+	WriteBufferKB  uint
+	Fsync          string
+	MaxOutputBytes int64               // 0 is unlimited
+	Signer         *fileSigner         // Encrypting, nil when not signing
+	SignerKeys     []ed25519.PublicKey // Decrypting, a signature by one of them is required
+	SignatureFile  string              // Decrypting, a detached signature to check
+	SourceFilename string
+	TargetFilename string
+	TargetFile     *os.File // Written instead of creating TargetFilename when set, and left open
+	HeadFirst      bool     // See headfirst.go
+	Content        string   // What the plaintext is, see EncryptedFileHeader
+	Name           string   // The source's name in the clear, see names.go
+	PlaintextSize  int64    // Encrypting, recorded in the header (format 1.16)
+	SealedName     []byte   // The source's name sealed with the file's key
+	Dictionary     []byte   // Sealed, for the header, see dictionary.go
+	ForceOperation bool
+	ChunkSizeMB    uint
+	Operation      OperationEnum
+	DiscardOutput  bool // Verifying, a decryption whose plaintext is only checked
+	StoreKeyCheck  bool
+	HeaderCopy     bool
+	ChunkMarkers   bool
+	Cipher         CipherEnum
+	CipherMode     CipherModeEnum
+	KeyMaterial    []byte
+}
+
+type chunkReadRequest struct {
+	ChunkID    uint
+	RangeStart int64
+	RangeEnd   int64
+}
+
+func newPipelineJob(operation OperationEnum, sourceFilename string, targetFilename string, options *Options) (pipelineJob, error) {
+	if options == nil {
+		return pipelineJob{}, errors.New("options is nil")
+	}
+
+	// Verifying is decrypting, everything but the write stage is the same
+	discardOutput := operation == Verification
+	if discardOutput {
+		operation = Decryption
+	}
+
+	/*
+		Note: the options passed in are expected to be validated and
+		non-pipeline jobs (like generating a file hash) are expected
+		to be preempted before arriving here - e.g. either keyhex or
+		password will have been specified
+
+		Some validation happens here because in the future we may want
+		to support other ciphers, modes, and key sizes (e.g. DES, IDEA,
+		Blowfish, RC4/5/6, CBC/CTR/ECB, 128 bits, 512 bits...)
+	*/
+	var header *EncryptedFileHeader
+	if operation == Decryption {
+		header = peekHeader(sourceFilename)
+	}
+
+	key, err := resolveKeyMaterial(operation, header, options)
+	if err != nil {
+		return pipelineJob{}, err
+	}
+
+	err = checkFsyncPolicy(options.Fsync)
+	if err != nil {
+		return pipelineJob{}, err
+	}
+
+	// Both replace the read workers, in different ways
+	if options.PrefetchChunks > 0 && options.PoolWorkers > 0 {
+		return pipelineJob{}, errors.New("the prefetch stage and a worker pool cannot be combined")
+	}
+
+	// A pool already takes whichever task is ready
+	if options.ScaleExecutors && options.PoolWorkers > 0 {
+		return pipelineJob{}, errors.New("scaling executors and a worker pool cannot be combined")
+	}
+
+	// When decrypting the header decides, runPipelineJob replaces this
+	suite := cipherSuites[0]
+	var fileID []byte
+	var noncePrefix []byte
+	var signer *fileSigner
+	var signerKeys []ed25519.PublicKey
+	if operation == Encryption {
+		signer, err = newFileSigner(options)
+		if err != nil {
+			return pipelineJob{}, err
+		}
+
+		suite, err = cipherSuiteByName(options.Cipher)
+		if err != nil {
+			return pipelineJob{}, err
+		}
+
+		fileID, err = newFileID()
+		if err != nil {
+			return pipelineJob{}, err
+		}
+
+		noncePrefix, err = newNoncePrefix()
+		if err != nil {
+			return pipelineJob{}, err
+		}
+	} else {
+		signerKeys, err = parseSignerKeys(options.SignerKeys)
+		if err != nil {
+			return pipelineJob{}, err
+		}
+	}
+
+	// Without a bound of its own a job stays inside the memory we are limited to, if any
+	maxMemoryMB, memoryLimitSource := options.MaxMemoryMB, ""
+	if maxMemoryMB == 0 {
+		limit := GetMemoryLimit()
+		maxMemoryMB, memoryLimitSource = automaticMaxMemoryMB(limit), limit.Source
+	}
+
+	job := pipelineJob{
+		NumReaders:     uint(options.Readers),
+		NumExecutors:   uint(options.Executors),
+		NumWriters:     uint(options.Writers),
+		BatchChunks:    options.BatchChunks,
+		ChunkChecksum:  options.ChunkChecksum,
+		CloudChecksums: options.CloudChecksums,
+		Recipients:     key.Recipients,
+		Salt:           key.Salt,
+		KDF:            key.KDF,
+		KDFIterations:  key.KDFIterations,
+		FileID:         fileID,
+		NoncePrefix:    noncePrefix,
+		HashPlaintext:  operation == Encryption && !options.SkipSourceHash,
+		PartSizeMB:     options.PartSizeMB,
+		Bandwidth:      options.Bandwidth,
+		WriteBufferKB:  options.WriteBufferKB,
+		Fsync:          options.Fsync,
+		MaxOutputBytes: options.MaxOutputBytes,
+		Signer:         signer,
+		SignerKeys:     signerKeys,
+		SignatureFile:  options.DetachedSignature,
+		PrefetchChunks: options.PrefetchChunks,
+		PoolWorkers:    uint(options.PoolWorkers),
+		ScaleExecutors: options.ScaleExecutors,
+		MaxMemoryMB:    maxMemoryMB,
+		MemoryLimit:    memoryLimitSource,
+		MemoryReport:   options.MemoryReport,
+		TreeHash:       options.TreeHash,
+		MemorySampling: options.MemorySampleInterval,
+		SourceFilename: sourceFilename,
+		TargetFilename: targetFilename,
+		ForceOperation: options.ForceOperation,
+		HeadFirst:      options.HeadFirst && operation == Decryption,
+		ChunkSizeMB:    options.ChunkSizeMB,
+		Operation:      operation,
+		DiscardOutput:  discardOutput,
+		StoreKeyCheck:  operation == Encryption && options.StoreKeyCheck,
+		HeaderCopy:     operation == Encryption && options.HeaderCopy,
+		ChunkMarkers:   operation == Encryption && options.ChunkMarkers,
+		Cipher:         suite.Cipher,
+		CipherMode:     suite.Mode,
+		KeyMaterial:    key.Material,
+	}
+
+	if operation == Encryption {
+		name := options.OriginalName
+		if name == "" {
+			name = filepath.Base(sourceFilename)
+		}
+
+		err = setStoredName(&job, options.StoreName, name)
+		if err != nil {
+			return pipelineJob{}, err
+		}
+	}
+
+	return job, nil
+}
+
+// Everything key resolution decides that ends up in the header
+type resolvedKey struct {
+	Material      []byte
+	Recipients    []RecipientStanza
+	Salt          []byte
+	KDF           string
+	KDFIterations int
+}
+
+/*
+	Key material comes from recipients, a key, or a password - in that
+	order - and when decrypting the recipients, salt, and KDF parameters
+	come from the header of the source (nil when encrypting or the header
+	is unreadable)
+*/
+func resolveKeyMaterial(operation OperationEnum, header *EncryptedFileHeader, options *Options) (resolvedKey, error) {
+	var key resolvedKey
+	var err error
+
+	if header == nil {
+		header = &EncryptedFileHeader{}
+	}
+
+	err = checkFIPSOptions(operation, header, options)
+	if err != nil {
+		return resolvedKey{}, err
+	}
+
+	if operation == Encryption && usesRecipients(operation, "", options) {
+		// A random file key, wrapped to each recipient in the header
+		key.Material, key.Recipients, err = newFileKeyForRecipients(options)
+		if err != nil {
+			return resolvedKey{}, fmt.Errorf("error preparing file key for recipients: %w", err)
+		}
+	} else if operation == Decryption && options.KeyHex == "" && len(header.Recipients) > 0 {
+		key.Material, err = unwrapFileKey(header.Recipients, options)
+		if err != nil {
+			return resolvedKey{}, fmt.Errorf("error unwrapping file key: %w", err)
+		}
+	} else if options.KeyHex != "" {
+		key.Material, err = hex.DecodeString(options.KeyHex)
+		if err != nil {
+			return resolvedKey{}, errors.New("error decoding hex string for key material")
+		}
+	} else if options.Password != "" {
+		if operation == Encryption {
+			key.Salt, err = newPasswordSalt()
+			if err != nil {
+				return resolvedKey{}, err
+			}
+
+			key.KDF = KDFPBKDF2SHA256
+			key.KDFIterations = PasswordKDFIterations
+		} else if header.KDF == "" {
+			key.Salt = header.Salt
+			key.KDFIterations = legacyKDFIterations
+		} else if header.KDF == KDFPBKDF2SHA256 {
+			key.Salt = header.Salt
+			key.KDFIterations = header.KDFIterations
+		} else {
+			return resolvedKey{}, fmt.Errorf("password key derivation function %q is not supported by this version of encryptor", header.KDF)
+		}
+
+		// Every password key so far is PBKDF2-SHA256, files before the KDF was recorded included
+		key.Material, err = cachedPasswordKey(options.Password, key.Salt, KDFPBKDF2SHA256, key.KDFIterations)
+		if err != nil {
+			return resolvedKey{}, fmt.Errorf("error generating key material from password: %w", err)
+		}
+	}
+
+	if key.Material == nil {
+		return resolvedKey{}, errors.New("a key, password, or recipients must be supplied")
+	}
+
+	// Currently only working with 256-bit keys
+	if len(key.Material) != 32 {
+		return resolvedKey{}, errors.New("currently only 256 bit (32 byte) keys are supported, key material length is " + strconv.Itoa(len(key.Material)) + " bytes")
+	}
+
+	return key, nil
+}
+
+/*
+	Using an Error group would have been cool, but it's overkill
+	for non-async operations since we don't need context shutdowns
+	we need exit-process shutdowns
+*/
+func runPipelineJob(job *pipelineJob) error {
+	if job == nil {
+		return errors.New("pipeline job is nil")
+	}
+
+	// Make buffered error channel with a capacity of one for each stage of our pipeline (at most 3)
+	pipelineErrors := make(chan error, 3)
+
+	/*
+		If we are encrypting:
+			Collect stat information on the source file
+			Compute the number of chunks we'll be generating
+			Compute the header for our write stage
+
+		If we are decrypting:
+			Collect stat information on the source file
+			Read the header length indicator
+			Consume the header
+			Compute the number of chunks and their size from the header
+	*/
+	stats, err := getStatsFromFile(job.SourceFilename)
+	if err != nil {
+		return fmt.Errorf("failed to obtain stats for source file, error was: %w", err)
+	}
+
+	/*
+		When decrypting the header is read from the source file and drives
+		the read stage, when encrypting it is built from the job and the
+		write stage prefixes the target file with it
+	*/
+	header := EncryptedFileHeader{}
+	endOfHeader := 0
+	numChunks := uint32(0)
+
+	if job.Operation == Encryption {
+		if job.ChunkSizeMB < ChunkSizeMin {
+			return errors.New("chunk size must be specified when encrypting")
+		}
+
+		// The target is never smaller than the source, so a source that is too large fails before it is read
+		err = checkOutputSize(stats.Size(), job.MaxOutputBytes)
+		if err != nil {
+			return err
+		}
+
+		// Sealed into the header, which is written before the first chunk is read
+		if job.HashPlaintext {
+			job.PlaintextHash, err = sealedPlaintextDigest(job)
+			if err != nil {
+				return err
+			}
+		}
+
+		job.PlaintextSize = stats.Size()
+		numChunks = plaintextChunkCount(stats.Size(), bytesFromMB(job.ChunkSizeMB))
+		header = newEncryptedFileHeader(job, numChunks)
+	} else if job.Operation == Decryption {
+		// We're going to make sure it's an encrypted file and modify some values
+		header, endOfHeader, err = getEncryptedFileHeaderFromFile(job.SourceFilename)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve encryption header from file: %w", err)
+		}
+
+		if !isSupportedFormatVersion(header.FormatVersion) {
+			return fmt.Errorf("file format version %q is not supported by this version of encryptor", header.FormatVersion)
+		}
+
+		// Nothing is decrypted until the file is known to come from who it should
+		err = verifyFileSignature(job.SourceFilename, &header, endOfHeader, stats.Size(), job.SignerKeys, job.SignatureFile)
+		if err != nil {
+			return err
+		}
+
+		payloadBytes := stats.Size() - int64(endOfHeader) - footerSizeBytes(&header) - signatureSizeBytes(&header) - headerCopySizeBytes(&header, endOfHeader)
+		if payloadBytes < 0 {
+			return errors.New("file is truncated, its footer is missing")
+		}
+
+		numChunks, err = chunkCount(&header, payloadBytes)
+		if err != nil {
+			return err
+		}
+
+		// A file cut short or grown inside its last chunk is found here, before anything is decrypted
+		_, err = plaintextSizeBytes(&header, payloadBytes, numChunks)
+		if err != nil {
+			return err
+		}
+
+		// The header, not the command line, decides the cipher and whether chunks carry checksums
+		suite, err := cipherSuiteForHeader(&header)
+		if err != nil {
+			return err
+		}
+
+		job.Cipher = suite.Cipher
+		job.CipherMode = suite.Mode
+		job.ChunkChecksum = header.ChunkChecksum == ChecksumCRC32C
+
+		// A wrong key fails here, before any chunk is read
+		err = verifyKeyCheck(&header, job.KeyMaterial)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A bounded job admits chunks against a budget, and starts no more workers than it can feed
+	var budget *memoryBudget
+	prefetchMaxDepth := PrefetchDepthMax
+	if job.MaxMemoryMB > 0 {
+		chunkBudgetBytes, err := fitMemoryBound(job, &header, &numChunks, stats.Size())
+		if err != nil {
+			return err
+		}
+
+		cost := chunkMemoryCost(header.ChunkSizeBytes, chunkOverheadBytes(&header))
+		budget = newMemoryBudget(chunkBudgetBytes, cost)
+
+		// The runtime collects against the bound from here on, and is put back however the job ends
+		restoreRuntimeMemory := tuneRuntimeMemory(bytesFromMB(job.MaxMemoryMB), chunkBudgetBytes)
+		defer restoreRuntimeMemory()
+
+		inFlight := uint(chunkBudgetBytes / cost)
+		if job.NumReaders > inFlight {
+			job.NumReaders = inFlight
+		}
+
+		if job.NumExecutors > inFlight {
+			job.NumExecutors = inFlight
+		}
+
+		if prefetchMaxDepth > inFlight {
+			prefetchMaxDepth = inFlight
+		}
+	}
+
+	// Head first, chunks are admitted in order and only so far ahead of the writer
+	if job.HeadFirst && budget == nil {
+		cost := chunkMemoryCost(header.ChunkSizeBytes, chunkOverheadBytes(&header))
+		budget = newMemoryBudget(int64(headFirstWindow(job))*cost, cost)
+	}
+
+	// Reads kept in flight ahead of the executors, deeper as reads get slower
+	prefetch := newPrefetchWindow(job.PrefetchChunks, prefetchMaxDepth)
+
+	// A pool never needs more workers than its caps let work at once
+	if job.PoolWorkers > job.NumReaders+job.NumExecutors {
+		job.PoolWorkers = job.NumReaders + job.NumExecutors
+	}
+
+	// Every chunk authenticates the header, so it cannot change after this
+	if job.Operation == Encryption {
+		err = setHeaderDigest(&header)
+		if err != nil {
+			return fmt.Errorf("could not create encryption header: %w", err)
+		}
+	}
+
+	// The exact size of the target is known now, and nothing has been written
+	if !job.DiscardOutput {
+		outputBytes, err := pipelineOutputBytes(job, &header, numChunks, stats.Size(), endOfHeader)
+		if err != nil {
+			return err
+		}
+
+		err = checkOutputSize(outputBytes, job.MaxOutputBytes)
+		if err != nil {
+			return err
+		}
+
+		if job.Operation == Decryption && job.TargetFile == nil {
+			err = checkFreeSpace(job.TargetFilename, outputBytes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Chunk tags are recorded as chunks are sealed or opened, nil for files without a footer
+	auth, err := newFileAuthenticator(&header, job.KeyMaterial, numChunks)
+	if err != nil {
+		return err
+	}
+
+	// Leaves are the plaintext chunks, so the tree's chunks are the file's
+	if job.TreeHash != nil {
+		job.TreeLeaves = newMerkleLeaves(numChunks)
+		job.TreeLeaves.keepRange(job.TreeHash.keep, header.ChunkSizeBytes)
+	}
+
+	// Decryption hashes what it writes, to check against the digest sealed in the header
+	var expectedDigest []byte
+	var plaintextHash hash.Hash
+	if job.Operation == Decryption {
+		expectedDigest, err = openPlaintextDigest(&header, job.KeyMaterial)
+		if err != nil {
+			return err
+		}
+
+		if expectedDigest != nil {
+			plaintextHash = sha256.New()
+		}
+	}
+
+	var sampler *memorySampler
+	if job.MaxMemoryMB > 0 || job.MemoryReport != nil {
+		sampler = startMemorySampler(uint64(bytesFromMB(job.MaxMemoryMB)), job.MemorySampling)
+	}
+
+	// Small chunks are batched so executors are not dominated by scheduling and channel overhead
+	batchChunks := job.BatchChunks
+	if batchChunks == 0 {
+		chunkSizeMB := job.ChunkSizeMB
+		if job.Operation == Decryption {
+			chunkSizeMB = uint(header.ChunkSizeBytes / bytesFromMB(1))
+		}
+
+		batchChunks = autoBatchChunks(chunkSizeMB, numChunks, job.NumExecutors)
+	}
+
+	// A batch holds its first chunk back until the last is done
+	if job.HeadFirst {
+		batchChunks = 1
+	}
+
+	// Executors added and parked as the job runs, up to NumExecutors
+	scaler := newExecutorScaler(job.ScaleExecutors && job.PoolWorkers == 0, uint(numChunks), batchChunks, job.NumExecutors)
+
+	/*
+		There are many, many, many ways to solve this problem, we are
+		going to do it by creating, what will effectively be, a sliding
+		window of channels that stream data from our read stage through
+		the executor stage (where data can be operated upon) and finally
+		into the write stage - as data is read, executed, and written,
+		blobs of data in the read and execute stages pass ownership to
+		the write stage which starts writing as soon as possible so that
+		each blob is available to the GC as soon as possible
+
+		Each chunk has an unbuffered channel of size 1 so that each worker
+		can block on the front of the file to help ensure that we do not
+		accumulate too much of a large file in memory as the reader, executor,
+		and writer 'slide' through the file
+
+		The overhead of having many channels is negligible since they are only
+		carrying pointers to []byte
+
+		TBD: determine if golang's IO supports pwrite like capabilities in order
+		to multi-thread writing which would release memory pressure even faster
+		than a linear writing approach
+
+		Compression (--compress, see compression.go) does not run here:
+		decryption reads chunk i at a fixed offset from the header (see
+		chunkReadRange), so the compressed stream is what is chunked, by an
+		EncryptWriter whose compression stage has a worker pool of its own
+		(see compressstage.go). Directories (--tar, see archive.go) go the
+		same way, a tar written through an EncryptWriter - with zstd, its
+		entries can be compressed with a dictionary trained from them (see
+		dictionary.go)
+	*/
+	var readChannelsSlice = make([]chan *chunkReadRequest, numChunks)
+	for i := range readChannelsSlice {
+		readChannelsSlice[i] = make(chan *chunkReadRequest, 1)
+	}
+
+	var executeChannelsSlice = make([]chan *[]byte, numChunks)
+	for i := range executeChannelsSlice {
+		executeChannelsSlice[i] = make(chan *[]byte, 1)
+	}
+
+	var writeChannelsSlice = make([]chan *[]byte, numChunks)
+	for i := range writeChannelsSlice {
+		writeChannelsSlice[i] = make(chan *[]byte, 1)
+	}
+
+	/*
+		Our sub pipelines will generate and share data amongst themselves over
+		n * chunks channels - this could be a lot of channels for a small chunk
+		size and a large file - so enforce some realistic chunk sizes for files
+		(e.g. chunk size is >= (filesize/250))
+
+		If decrypting, read pipeline needs to generate read ranges for workers
+		that are offset by (header length indicator + header length) bytes
+
+		If encrypting, write pipeline needs to generate write ranges (if we
+		parallelize) that are offset by (header length indicator + header length)
+		bytes
+	*/
+	numStages := 3
+
+	// A worker pool reads and executes, taking the place of two stages
+	if job.PoolWorkers > 0 {
+		numStages = 2
+
+		go poolStage(job, stats, header, endOfHeader, budget, auth, pipelineErrors, job.PoolWorkers, writeChannelsSlice)
+	} else {
+		go readStage(job.Operation, job.SourceFilename, job.ChunkSizeMB, stats, header, endOfHeader, budget, prefetch, pipelineErrors, job.NumReaders, readChannelsSlice, executeChannelsSlice)
+		go executeStage(job.Operation, job.Cipher, job.CipherMode, job.KeyMaterial, job.ChunkChecksum, &header, auth, job.TreeLeaves, prefetch, scaler, pipelineErrors, job.NumExecutors, batchChunks, executeChannelsSlice, writeChannelsSlice)
+	}
+
+	// Object store checksums are computed inline as the target is written, 0 disables them
+	cloudPartSizeBytes := int64(0)
+	if job.CloudChecksums {
+		cloudPartSizeBytes = bytesFromMB(job.PartSizeMB)
+	}
+
+	// Decryption writes a partial file that becomes the target once everything below has checked out
+	target := job.TargetFile
+	var partial *os.File
+	if job.Operation == Decryption && target == nil && !job.DiscardOutput {
+		partial, err = createPartialTarget(job.TargetFilename, job.ForceOperation)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if partial != nil {
+				_ = finishPartialTarget(partial, job.TargetFilename, false)
+			}
+		}()
+
+		target = partial
+	}
+
+	if job.DiscardOutput {
+		go discardStage(budget, plaintextHash, pipelineErrors, writeChannelsSlice)
+	} else {
+		go writeStage(job.Operation, job.TargetFilename, target, job.ForceOperation, job.HeadFirst, header, cloudPartSizeBytes, newBandwidthLimiter(job.Bandwidth), budget, auth, plaintextHash, job.WriteBufferKB, job.Fsync, job.Signer, pipelineErrors, job.NumWriters, writeChannelsSlice)
+	}
+
+	// Block on buffered read until every stage returns nil or we get an error
+	for i := 0; i < numStages; i++ {
+		err := <-pipelineErrors
+		if err != nil {
+			// What the job was is only known here, the worker that crashed knew its own part of it
+			var crash *CrashError
+			if errors.As(err, &crash) {
+				crash.Report.Job = crashJobParameters(job, &header)
+			}
+
+			return corruptUnlessWrongKey(&header, fmt.Errorf("error occurred during pipeline process: %w", err))
+		}
+	}
+
+	// Every chunk decrypted, but only the footer says they were all of them
+	if job.Operation == Decryption && auth != nil {
+		err = verifyFileFooter(job.SourceFilename, stats.Size()-signatureSizeBytes(&header)-headerCopySizeBytes(&header, endOfHeader), auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	if plaintextHash != nil {
+		err = verifyPlaintextDigest(expectedDigest, plaintextHash.Sum(nil))
+		if err != nil {
+			return err
+		}
+	}
+
+	if partial != nil {
+		err = finishPartialTarget(partial, job.TargetFilename, true)
+		partial = nil
+		if err != nil {
+			return fmt.Errorf("could not move the decrypted file into place: %w", err)
+		}
+	}
+
+	if job.TreeHash != nil {
+		*job.TreeHash = job.TreeLeaves.tree(header.ChunkSizeBytes)
+	}
+
+	if sampler != nil {
+		report := sampler.finish()
+
+		if job.MemoryReport != nil {
+			report.Readers = job.NumReaders
+			report.Executors = job.NumExecutors
+			report.Scaling = scaler.decisionsMade()
+			report.ChunkSizeMB = uint(header.ChunkSizeBytes / bytesFromMB(1))
+
+			if budget != nil {
+				report.Runtime = currentRuntimeMemorySettings()
+			}
+
+			*job.MemoryReport = report
+		}
+	}
+
+	return nil
+}
+
+// Be wary of a perfect chunk match, if extra bytes leftover add a chunk
+func plaintextChunkCount(sizeBytes int64, chunkSizeBytes int64) uint32 {
+	numChunks := uint32(sizeBytes / chunkSizeBytes)
+	if sizeBytes%chunkSizeBytes != 0 {
+		numChunks++
+	}
+
+	return numChunks
+}
+
+func bytesFromMB(mb uint) int64 {
+	return int64(mb * 1024 * 1024)
+}
@@ -0,0 +1,572 @@
+package encryptor
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	Package encryptor is the chunked, concurrent encryption pipeline behind
+	the encryptor command, usable from any Go program
+
+		err := encryptor.Encrypt("backup.tar", "backup.tar.enc", &encryptor.Options{Password: "..."})
+		err = encryptor.Decrypt("backup.tar.enc", "backup.tar", &encryptor.Options{Password: "..."})
+
+	Zero values in Options mean defaults, so most callers only supply key
+	material - a key, a password, or recipients
+*/
+
+type OperationEnum uint8
+
+const (
+	Encryption OperationEnum = iota
+	Decryption
+	FileHashing
+	Scrubbing
+	CapabilitiesListing
+	Verification
+	Previewing
+	Inspecting
+	EmailWrapping
+	BinaryVerification
+	UpdateChecking
+	SelfUpdating
+	PasswordStoring
+	Recovering
+	KeyGenerating
+	RangeProving
+	ProofVerifying
+	FileServing
+	Reporting
+	Shredding
+	Soaking
+)
+
+type Options struct {
+	KeyHex         string
+	Password       string
+	ChunkSizeMB    uint // Ignored when decrypting, the file header decides
+	Readers        uint8
+	Executors      uint8
+	Writers        uint8
+	PoolWorkers    uint8 // Workers that both read and execute, Readers and Executors become caps, 0 keeps separate stages
+	BatchChunks    uint  // 0 chooses automatically
+	PrefetchChunks uint  // Initial read-ahead depth of the prefetch stage, 0 uses read workers instead
+	ScaleExecutors bool  // Executors becomes a cap, execute workers are added and parked as the job runs, see scaling.go
+	ChunkChecksum  bool
+	CloudChecksums bool
+	PartSizeMB     uint
+	ForceOperation bool // Overwrite an existing target
+	Bandwidth      BandwidthSchedule
+	Cipher         string // e.g. XChaCha20-Poly1305, empty is DefaultCipher, ignored when decrypting
+	FIPS           bool   // Only FIPS approved algorithms, always on in builds tagged fips
+	MaxMemoryMB    uint   // Peak memory bound for file jobs, 0 is unbounded unless memory is limited (see memlimit.go)
+	WriteBufferKB  uint   // The write stage's buffer, 0 gathers each chunk into one vectored write where supported
+	Fsync          string // When the target is synced to disk - FsyncNever (or empty), FsyncEnd, or FsyncFlush
+	SkipSourceHash bool   // Encrypting reads the source twice to store its SHA256 for decryption to check, this reads it once
+	StoreKeyCheck  bool   // A key check in the header, so decryption tells a wrong key from a corrupt file (format 1.11)
+	HeaderCopy     bool   // A copy of the header at the end of the file, read when the header is damaged (format 1.12)
+	ChunkMarkers   bool   // A marker starting each chunk, so recovery can find chunks again after damage (format 1.13)
+	Offline        bool   // Anything that could touch the network fails with ErrOffline rather than being attempted
+	MaxOutputBytes int64  // A job whose target would be larger fails with ErrOutputTooLarge, 0 is unlimited
+	HeadFirst      bool   // Decrypting, the earliest chunks are scheduled first and written as they are, see headfirst.go
+	Compression    string // CompressionZstd compresses the plaintext before it is encrypted, see compression.go (format 1.15)
+	Compressors    uint8  // Workers compressing the plaintext between reading and sealing, 0 is as many as Executors, see compressstage.go
+	ZstdDictionary bool   // A directory compressed with zstd has every entry a frame of its own, compressed with a dictionary trained from its files, see dictionary.go (format 1.17)
+	StoreName      string // NameStorePlain or NameStoreSealed records the source's name in the header, see names.go
+	OriginalName   string // The name StoreName records, the source's base name when empty (streams have none)
+	Symlinks       string // What a directory's symbolic links are archived as, SymlinksPreserve (the default), SymlinksFollow, or SymlinksSkip, see archive.go
+
+	SigningKey        string   // Encrypting signs the file with this Ed25519 private key file (format 1.14)
+	SignerKeys        []string // Decrypting requires a signature by one of these Ed25519 public keys, or files of them
+	DetachedSignature string   // The signature is written to (or read from) this file instead of the encrypted one
+
+	// Filled in as a file job finishes, when not nil
+	MemoryReport         *MemoryReport
+	MemorySampleInterval time.Duration // Records a time series in the report, 0 records none
+	StageReport          *StageReport  // Each stage's throughput, for compressed encryption
+	TreeHash             *MerkleTree   // The plaintext's Merkle tree over the file's chunks, see merkle.go
+
+	GPGRecipients   []string
+	SSHRecipients   []string
+	RecipientsFiles []string // SSH public keys, one per line, from a file or an https:// URL
+	SSHIdentities   []string
+
+	X25519Recipients []string // Base64 public keys (X25519 or ML-KEM-768 + X25519), or files of them
+	X25519Identities []string // Files holding base64 private keys
+	RSARecipients    []string // Certificates or public keys, PEM or DER
+	RSAIdentities    []string // PKCS#1 or PKCS#8 private keys, PEM or DER
+	GCPKMSKeys       []string // Cloud KMS key resource names, decrypting needs only Google credentials
+
+	AzureKeyVaultKeys []string // Key Vault key identifiers, decrypting needs only Azure credentials
+
+	PKCS11Keys   []string // RFC 7512 pkcs11: URIs or key labels of RSA keys in an HSM or smartcard
+	PKCS11Module string   // The PKCS#11 module pkcs11-tool loads, its default when empty
+	PKCS11PIN    string   // Asked for with PromptSecret when empty
+
+	TPMSeal bool   // Seal the file key to this machine's TPM 2.0, decrypting needs only the same TPM
+	TPMPCRs string // Bind the seal to the current values of these SHA-256 PCRs, e.g. 0,7
+
+	PluginRecipients []string // <plugin>:<recipient>, wrapped by the encryptor-plugin-<plugin> binary (see plugin.go)
+
+	// Asked for secrets we cannot do without (e.g. SSH key passphrases), nil means we cannot ask
+	PromptSecret func(prompt string) (string, error)
+
+	// Told what the job carried on despite (e.g. recipients read from the cache), nil tells no one
+	Warn func(warning string)
+}
+
+type ScrubOptions struct {
+	StateFilename string // Defaults to DefaultScrubStateFilename in the scrubbed directory
+	MaxRuntime    time.Duration
+	MaxBytes      int64
+	SamplePercent uint // 0 verifies every checksummed chunk
+	RandomOrder   bool // Each file's chunks are visited in a shuffled order rather than front to back
+}
+
+const ReadersLimit uint8 = 30
+const ExecutorsLimit uint8 = 60
+const CompressorsLimit uint8 = 60
+const WritersLimit uint8 = 1 // Still researching concurrent file writing in Golang
+const PoolWorkersLimit uint8 = ReadersLimit + ExecutorsLimit
+const ChunkSizeMin uint = 1
+const ChunkSizeMax uint = 64
+const BatchChunksMax uint = 64 // 0 means the batch size is chosen automatically
+const DefaultChunkSizeMB uint = 8
+const DefaultPartSizeMB uint = 8
+
+func Encrypt(sourceFilename string, targetFilename string, options *Options) error {
+	return runOperation(Encryption, sourceFilename, targetFilename, options)
+}
+
+func Decrypt(sourceFilename string, targetFilename string, options *Options) error {
+	return runOperation(Decryption, sourceFilename, targetFilename, options)
+}
+
+// Decrypts into an open file such as os.Stdout, written from where it is and left open
+func DecryptToFile(sourceFilename string, target *os.File, options *Options) error {
+	return decryptToFile(sourceFilename, target, options)
+}
+
+// Encrypts a directory tree as one file, a tar of it (see archive.go)
+func EncryptDirectory(directory string, target io.Writer, options *Options) error {
+	return encryptDirectory(directory, target, options)
+}
+
+// Extracts what EncryptDirectory wrote, into a directory that does not exist unless overwriting
+func DecryptDirectory(source io.Reader, directory string, options *Options) error {
+	return decryptDirectory(source, directory, options)
+}
+
+// Reads the plaintext at any offset, decrypting only the chunks read (see filereader.go)
+func OpenFileReader(fileName string, options *Options) (*FileReader, error) {
+	return openFileReader(fileName, options)
+}
+
+// Decrypts without writing the plaintext anywhere, nil only if the whole file authenticates
+func Verify(sourceFilename string, options *Options) error {
+	return runOperation(Verification, sourceFilename, "", options)
+}
+
+// Verify for a stream, everything is read from it
+func VerifyReader(reader io.Reader, options *Options) error {
+	return verifyReader(reader, options)
+}
+
+// Verify in one sequential pass for optical and write-once media, resumable, the certificate is returned even on failure
+func VerifyMedia(fileName string, media *MediaVerificationOptions, options *Options) (VerificationCertificate, error) {
+	return verifyMedia(fileName, media, options)
+}
+
+// Scrubs, audits, and with ReportOptions.Authenticate verifies every encrypted file under path (or path, a file)
+func ReportVerification(path string, report *ReportOptions, options *Options) (VerificationReport, error) {
+	return reportVerification(path, report, options)
+}
+
+// The report as ReportFormatJSON or ReportFormatHTML, and its base64 signature when options.SigningKey is set
+func RenderReport(report *VerificationReport, format string, options *Options) ([]byte, string, error) {
+	return renderReport(report, format, options)
+}
+
+// Checks a report's signature, made by RenderReport, against signers (public keys or files of them)
+func VerifyReportSignature(data []byte, signature string, signers []string) error {
+	return verifyReportSignature(data, signature, signers)
+}
+
+// Decrypts every chunk of a damaged file that still authenticates, even without its header, to where it belongs in target
+func Recover(sourceFilename string, targetFilename string, options *Options) (RecoveryReport, error) {
+	return recoverFile(sourceFilename, targetFilename, options)
+}
+
+// Decrypts at most the first numBytes of the plaintext to target, returning how many were written
+func Preview(source io.Reader, target io.Writer, numBytes int64, options *Options) (int64, error) {
+	return preview(source, target, numBytes, options)
+}
+
+// Encrypts source as the attachment of a draft email written to target, for mail that mangles binaries
+func WrapEmail(source io.Reader, target io.Writer, email *EmailOptions, options *Options) error {
+	return wrapEmail(source, target, email, options)
+}
+
+// Encrypts source as an OpenPGP message with options.Password, one gpg --decrypt can read
+func EncryptOpenPGP(source io.Reader, target io.Writer, options *Options) error {
+	return encryptOpenPGP(source, target, options)
+}
+
+// Decrypts an OpenPGP message encrypted with a password (e.g. by gpg --symmetric), the plaintext is only intact if nil is returned
+func DecryptOpenPGP(source io.Reader, target io.Writer, options *Options) error {
+	return decryptOpenPGP(source, target, options)
+}
+
+// Does the file start like an encrypted OpenPGP message rather than one of ours?
+func IsOpenPGPMessage(fileName string) bool {
+	return isOpenPGPMessage(fileName)
+}
+
+// Encrypts a small source (up to 16MB) as a JWE, serialization is JWECompact or JWEJSON
+func EncryptJWE(source io.Reader, target io.Writer, serialization string, options *Options) error {
+	return encryptJWE(source, target, serialization, options)
+}
+
+// Decrypts a JWE in either serialization, written with a password (PBES2-HS512+A256KW) or a key (dir) and A256GCM
+func DecryptJWE(source io.Reader, target io.Writer, options *Options) error {
+	return decryptJWE(source, target, options)
+}
+
+// Does the file start like a JWE rather than one of ours?
+func IsJWE(fileName string) bool {
+	return isJWE(fileName)
+}
+
+// A short fingerprint of the key or password in options, the same every time they are
+func KeyFingerprint(options *Options) (string, error) {
+	if options == nil {
+		return "", errors.New("options is nil")
+	}
+
+	return keyFingerprint(options)
+}
+
+// The key in a key file (32 raw bytes or 64 hex digits), hex encoded for Options.KeyHex
+func LoadKeyFile(fileName string) (string, error) {
+	return loadKeyFile(fileName)
+}
+
+// A release key given as base64 of its 32 bytes, or as an ssh-ed25519 public key line
+func ParseReleaseKey(key string) (ed25519.PublicKey, error) {
+	return parseReleaseKey(key)
+}
+
+// Checks a signed release manifest (and <manifest>.sig), then that it lists the binary's SHA256
+func VerifyRelease(binaryFilename string, manifestName string, publicKey ed25519.PublicKey) (ReleaseVerification, error) {
+	return verifyRelease(binaryFilename, manifestName, publicKey)
+}
+
+// A signed release manifest (and <manifest>.sig), parsed only once its signature verifies
+func ReadReleaseManifest(manifestName string, publicKey ed25519.PublicKey) (ReleaseManifest, error) {
+	return readReleaseManifest(manifestName, publicKey)
+}
+
+// The manifest's binary for a platform, e.g. runtime.GOOS and runtime.GOARCH
+func ReleaseBinaryFor(manifest *ReleaseManifest, goos string, goarch string) (ReleaseBinary, bool) {
+	return manifest.binaryFor(goos, goarch)
+}
+
+// Downloads a binary a manifest lists and, once its SHA256 matches, replaces binaryFilename with it
+func InstallReleaseBinary(binaryFilename string, manifestName string, binary ReleaseBinary, options *Options) error {
+	return installReleaseBinary(binaryFilename, manifestName, binary, options)
+}
+
+// Fails with ErrOffline if the options ask for anything that could touch the network while Offline is set
+func CheckOffline(options *Options) error {
+	return checkOffline(options)
+}
+
+// The password stored in the platform keyring under a profile name, ErrNotInKeyring if there is none
+func KeyringPassword(profile string) (string, error) {
+	return keyringPassword(profile)
+}
+
+// Stores a password in the platform keyring under a profile name, replacing any stored before
+func StoreKeyringPassword(profile string, password string) error {
+	return storeKeyringPassword(profile, password)
+}
+
+// The password on the first line of a password file, its line ending stripped
+func LoadPasswordFile(fileName string) (string, error) {
+	return loadPasswordFile(fileName)
+}
+
+// A size such as 500MB or 2TB as bytes, for MaxOutputBytes
+func ParseByteSize(size string) (int64, error) {
+	return parseByteSize(size)
+}
+
+// The hex encoded SHA256 of a file
+func Hash(fileName string) (string, error) {
+	return hashFile(fileName)
+}
+
+// The hex encoded SHA256 of everything read from a stream
+func HashReader(reader io.Reader) (string, error) {
+	return hashReader(reader)
+}
+
+// The SHA256 of every regular file under root (or of root, a file), hashed by workers in parallel, cache may be nil
+func HashTree(root string, workers uint, cache *HashCache) ([]ChecksumEntry, error) {
+	return hashTree(root, workers, cache)
+}
+
+// The SHA256 of the tree's GNU checksum manifest with paths relative to root, entries as HashTree returns them
+func TreeHash(root string, entries []ChecksumEntry) (string, error) {
+	return treeHash(root, entries)
+}
+
+// Writes entries as a checksum manifest, format is ManifestFormatGNU (sha256sum) or ManifestFormatBSD
+func WriteChecksumManifest(w io.Writer, entries []ChecksumEntry, format string) error {
+	return writeChecksumManifest(w, entries, format)
+}
+
+// The entries of a checksum manifest, each line in either format
+func ReadChecksumManifest(r io.Reader) ([]ChecksumEntry, error) {
+	return readChecksumManifest(r)
+}
+
+// Hashes every file entries name, by workers in parallel, results are in the order of entries - cache may be nil
+func CheckChecksums(entries []ChecksumEntry, workers uint, cache *HashCache) []ChecksumResult {
+	return checkChecksums(entries, workers, cache)
+}
+
+// The Merkle tree over a file's chunks of chunkSizeBytes, hashed by workers in parallel
+func MerkleTreeHash(fileName string, chunkSizeBytes int64, workers uint) (MerkleTree, error) {
+	return merkleTreeHashFile(fileName, chunkSizeBytes, workers)
+}
+
+// Audit paths for the chunks holding bytes [start, end) of the tree's file
+func ProveMerkleRange(tree *MerkleTree, start int64, end int64) (MerkleRangeProof, error) {
+	return tree.proveRange(start, end)
+}
+
+// Checks a whole chunk of the proof, the bytes at its Offset and Length, against the proof's root
+func VerifyMerkleChunk(proof MerkleRangeProof, chunkProof MerkleChunkProof, chunk []byte) error {
+	return verifyMerkleChunk(proof, chunkProof, chunk)
+}
+
+// A proof of bytes [start, end) of an encrypted file's plaintext that carries those chunks, for auditors without the key
+func ProveEncryptedRange(sourceFilename string, start int64, end int64, options *Options) (MerkleRangeProof, error) {
+	return proveEncryptedRange(sourceFilename, start, end, options)
+}
+
+// Checks every chunk of a proof against root, reading those the proof does not carry from source (which may be nil)
+func VerifyMerkleRangeProof(proof MerkleRangeProof, root string, source io.ReaderAt) error {
+	return verifyMerkleRangeProof(proof, root, source)
+}
+
+// Whether name is a gs:// URL, an object in Google Cloud Storage
+func IsGCSURL(name string) bool {
+	return isGCSURL(name)
+}
+
+// A gs:// object read as a stream, ranged reads of it are kept in flight ahead of the reader
+func NewGCSReader(objectURL string, options *Options) (*GCSReader, error) {
+	return newGCSReader(objectURL, options)
+}
+
+// A gs:// object written by a resumable upload, it appears once Close succeeds and Abort cancels it
+func NewGCSWriter(objectURL string, options *Options) (*GCSWriter, error) {
+	return newGCSWriter(objectURL, options)
+}
+
+// Whether name is an az:// URL or an https:// URL of a blob, a blob in Azure Blob Storage
+func IsAzureBlobURL(name string) bool {
+	return isAzureBlobURL(name)
+}
+
+// A blob read as a stream, ranged reads of it are kept in flight ahead of the reader
+func NewAzureBlobReader(blobURL string, options *Options) (*AzureBlobReader, error) {
+	return newAzureBlobReader(blobURL, options)
+}
+
+// A block blob staged a part at a time, it appears once Close commits it and Abort leaves it uncommitted
+func NewAzureBlobWriter(blobURL string, options *Options) (*AzureBlobWriter, error) {
+	return newAzureBlobWriter(blobURL, options)
+}
+
+// Whether name is an http:// or https:// URL, other than an Azure blob's, to read a source from
+func IsHTTPURL(name string) bool {
+	return isHTTPURL(name)
+}
+
+// A file on an HTTP server read as a stream, ranged GETs of it are kept in flight ahead of the reader
+func NewHTTPReader(location string, options *Options) (*HTTPReader, error) {
+	return newHTTPReader(location, options)
+}
+
+// A hash cache kept in fileName, empty for the user cache directory, it is only written by SaveHashCache
+func OpenHashCache(fileName string) (*HashCache, error) {
+	return openHashCache(fileName)
+}
+
+// Writes what was hashed since the cache was opened, dropping files that no longer exist
+func SaveHashCache(cache *HashCache) error {
+	if cache == nil {
+		return errors.New("hash cache is nil")
+	}
+
+	return cache.save()
+}
+
+// Adds a codec Options.Compression can name, before any job uses it - built in codecs' names are taken
+func RegisterCodec(codec Codec) error {
+	return registerCodec(codec)
+}
+
+// The name the file's source had when it was encrypted with StoreName, ErrNoStoredName when it was not kept
+func OriginalName(fileName string, options *Options) (string, error) {
+	return originalName(fileName, options)
+}
+
+// Where temporary files are made, the system's temporary directory when directory is empty
+func SetTempDir(directory string) error {
+	return setTempDir(directory)
+}
+
+func TempDir() string {
+	return tempDir()
+}
+
+// A file readable only by the user, in this process's session under TempDir (see tempfiles.go)
+func CreateTempFile(pattern string) (*os.File, error) {
+	return createTempFile(pattern)
+}
+
+func RemoveTempFiles() error {
+	return removeTempFiles()
+}
+
+// Removes what crashed runs left under TempDir, returning how many sessions were removed
+func CleanStaleTempFiles() (int, error) {
+	return cleanStaleTempFiles()
+}
+
+// Whether the system's random number generator is seeded, waiting up to wait for it (0 does not wait)
+func CheckEntropy(wait time.Duration) (EntropyStatus, error) {
+	return checkEntropy(wait)
+}
+
+// Reads the header of an encrypted file, no key is needed
+func ReadHeader(fileName string) (EncryptedFileHeader, error) {
+	header, _, err := getEncryptedFileHeaderFromFile(fileName)
+	return header, err
+}
+
+// What the header of an encrypted file says about it and the sizes that follow, no key is needed
+func Inspect(fileName string) (FileInspection, error) {
+	return inspect(fileName)
+}
+
+/*
+Does the operation get its key material from recipients rather than a
+key or password? When decrypting this is decided by the source file
+*/
+func UsesRecipients(operation OperationEnum, sourceFilename string, options *Options) bool {
+	if options == nil {
+		return false
+	}
+
+	return usesRecipients(operation, sourceFilename, options)
+}
+
+// A new X25519 private key and its public key, both base64, for X25519Identities and X25519Recipients
+func GenerateX25519Identity() (string, string, error) {
+	return generateX25519Identity()
+}
+
+// A new Ed25519 signing key and its public key, both base64, for SigningKey and SignerKeys
+func GenerateSigningKey() (string, string, error) {
+	return generateSigningKey()
+}
+
+// A new hybrid ML-KEM-768 + X25519 private key and its public key, for archives that must outlast X25519
+func GenerateMLKEMX25519Identity() (string, string, error) {
+	return generateMLKEMX25519Identity()
+}
+
+func runOperation(operation OperationEnum, sourceFilename string, targetFilename string, options *Options) error {
+	if options == nil {
+		return errors.New("options is nil")
+	}
+
+	err := checkOffline(options)
+	if err != nil {
+		return err
+	}
+
+	if isCompressedJob(operation, strings.TrimSpace(sourceFilename), options) {
+		return runCompressedJob(operation, strings.TrimSpace(sourceFilename), strings.TrimSpace(targetFilename), nil, options)
+	}
+
+	job, err := newPipelineJob(operation, strings.TrimSpace(sourceFilename), strings.TrimSpace(targetFilename), withDefaults(*options, sourceFilename))
+	if err != nil {
+		return err
+	}
+
+	return runPipelineJob(&job)
+}
+
+func decryptToFile(sourceFilename string, target *os.File, options *Options) error {
+	if target == nil || options == nil {
+		return errors.New("target or options is nil")
+	}
+
+	err := checkOffline(options)
+	if err != nil {
+		return err
+	}
+
+	if isCompressedJob(Decryption, strings.TrimSpace(sourceFilename), options) {
+		return runCompressedJob(Decryption, strings.TrimSpace(sourceFilename), target.Name(), target, options)
+	}
+
+	job, err := newPipelineJob(Decryption, strings.TrimSpace(sourceFilename), target.Name(), withDefaults(*options, sourceFilename))
+	if err != nil {
+		return err
+	}
+
+	job.TargetFile = target
+
+	return runPipelineJob(&job)
+}
+
+// Zero values are replaced with the defaults the command line uses
+func withDefaults(options Options, sourceFilename string) *Options {
+	if options.ChunkSizeMB == 0 {
+		options.ChunkSizeMB = DefaultChunkSizeMB
+	}
+
+	if options.Readers == 0 {
+		options.Readers = TuneReadersForStorage(sourceFilename, DefaultReaders())
+	}
+
+	if options.Executors == 0 {
+		options.Executors = DefaultExecutors()
+	}
+
+	if options.Writers == 0 {
+		options.Writers = 1
+	}
+
+	if options.Compressors == 0 {
+		options.Compressors = options.Executors
+	}
+
+	if options.PartSizeMB == 0 {
+		options.PartSizeMB = DefaultPartSizeMB
+	}
+
+	return &options
+}
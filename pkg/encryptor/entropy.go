@@ -0,0 +1,100 @@
+package encryptor
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+	Every key, salt, file ID, and nonce comes from crypto/rand, and each
+	chunk draws its nonce as it is sealed, so one failed read used to fail
+	the job wherever it happened to be - often halfway through a large
+	file, over what was a moment's hiccup (a VM's entropy device stalling,
+	a sandbox briefly refusing the syscall). Random bytes are now read
+	through readRandom, which retries a failed read with backoff, 10ms
+	doubling for entropyRetries retries (about 2.5s in all), and then gives
+	up with ErrEntropyUnavailable. There is no fallback to a weaker
+	generator: a job that cannot get random bytes from the system stops
+
+	A freshly booted machine or VM may not have seeded its generator yet,
+	and on Linux crypto/rand then blocks rather than fails - a job started
+	by early boot scripts hangs without saying why. CheckEntropy says
+	whether the generator is ready without blocking, and given a wait,
+	waits up to that long for it
+*/
+
+const entropyRetries = 8
+const entropyBackoff = 10 * time.Millisecond
+const entropyPollInterval = 100 * time.Millisecond
+
+// Where random bytes are read from, replaced only by tests
+var entropySource io.Reader = rand.Reader
+
+// readRandom as an io.Reader, for the crypto packages that take one
+var randomReader io.Reader = retryingRandomReader{}
+
+type retryingRandomReader struct{}
+
+func (retryingRandomReader) Read(data []byte) (int, error) {
+	err := readRandom(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// Fills data from the system's generator, retrying with backoff before failing with ErrEntropyUnavailable
+func readRandom(data []byte) error {
+	backoff := entropyBackoff
+
+	var err error
+	for retry := 0; ; retry++ {
+		_, err = io.ReadFull(entropySource, data)
+		if err == nil {
+			return nil
+		}
+
+		if retry == entropyRetries {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return fmt.Errorf("%w, reading random data failed %d times: %v", ErrEntropyUnavailable, entropyRetries+1, err)
+}
+
+type EntropyStatus struct {
+	Ready     bool          // Random data can be read without waiting for the generator to be seeded
+	Known     bool          // Whether the system can say, Ready is assumed where it cannot
+	Available int           // The kernel's estimate of its entropy in bits, -1 where there is none
+	Waited    time.Duration // How long was spent waiting for the generator to be ready
+}
+
+func checkEntropy(wait time.Duration) (EntropyStatus, error) {
+	start := time.Now()
+
+	status := entropyStatus()
+	for !status.Ready && time.Since(start) < wait {
+		time.Sleep(entropyPollInterval)
+		status = entropyStatus()
+	}
+
+	if !status.Ready {
+		status.Waited = time.Since(start)
+		if wait > 0 {
+			return status, fmt.Errorf("%w, the system's random number generator was not seeded after %v", ErrEntropyUnavailable, wait)
+		}
+
+		return status, nil
+	}
+
+	status.Waited = time.Since(start)
+
+	// A generator that is failing is found before the job rather than in it
+	return status, readRandom(make([]byte, 32))
+}
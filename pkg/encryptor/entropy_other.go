@@ -0,0 +1,8 @@
+//go:build !linux
+
+package encryptor
+
+// Elsewhere crypto/rand uses generators the system seeds before any process runs (getentropy, arc4random, BCryptGenRandom)
+func entropyStatus() EntropyStatus {
+	return EntropyStatus{Ready: true, Available: -1}
+}
@@ -0,0 +1,30 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	Failures callers commonly need to tell apart - to explain them to a
+	user, retry with other key material, or skip a file - are typed, and
+	returned wrapped so they are matched with errors.Is. Permission
+	failures are not typed here, os.ErrPermission already matches them
+*/
+
+var ErrAuthenticationFailed = errors.New("failed cryptographic transformation, ensure the correct password or key is being used")
+var ErrTargetExists = errors.New("file already exists and overwriting was not specified")
+var ErrNotEncryptedFile = errors.New("not an encrypted file")
+var ErrPlaintextMismatch = errors.New("the decrypted file does not match what was encrypted")
+var ErrWrongKey = fmt.Errorf("%w, the key does not match the file's key check", ErrAuthenticationFailed)
+var ErrFileCorrupt = errors.New("the file is corrupt")
+var ErrOffline = errors.New("offline mode does not allow anything that could touch the network")
+var ErrCrashed = errors.New("encryptor crashed, this is a bug")
+var ErrNotInKeyring = errors.New("no password is stored in the keyring under this profile")
+var ErrNothingRecovered = errors.New("nothing could be recovered")
+var ErrNotSigned = errors.New("the file is not signed, and a signer was required")
+var ErrOutputTooLarge = errors.New("the output would be larger than the limit allows")
+var ErrSignatureInvalid = errors.New("the file's signature does not verify with any of the signers given")
+var ErrNoStoredName = errors.New("the file does not record its original name")
+var ErrEntropyUnavailable = errors.New("the system's random number generator is unavailable")
+var ErrInsufficientSpace = errors.New("there is not enough free space for the target")
@@ -0,0 +1,135 @@
+package encryptor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	Recipients files can be https:// URLs, so encrypting to a teammate is
+	as easy as pointing at their published keys (e.g. GitHub's
+	https://github.com/username.keys)
+
+	Only https is accepted and certificates are verified as usual. Every
+	successful fetch is cached, and if the server cannot be reached later
+	(offline, the server is down) the cached copy is used instead, with a
+	warning naming it and its age. A server that answers with an error
+	(404, 410, 403) is not falling back to anything - the keys may have
+	been withdrawn on purpose - and neither is a recipients file that has
+	never been fetched successfully
+*/
+
+const recipientsFetchLimitBytes int64 = 1024 * 1024
+
+var recipientsHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+func isRecipientsURL(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://")
+}
+
+// The server answered, but not with the recipients
+type recipientsStatusError struct {
+	status string
+}
+
+func (err *recipientsStatusError) Error() string {
+	return "server responded " + err.status
+}
+
+// Reads a recipients file from disk, or from an https URL (falling back to the cache when the server cannot be reached)
+func readRecipientsFile(name string, options *Options) ([]byte, error) {
+	if !isRecipientsURL(name) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read recipients file: %w", err)
+		}
+
+		return data, nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(name), "https://") {
+		return nil, fmt.Errorf("recipients URL %q must use https", name)
+	}
+
+	cacheFilename := recipientsCacheFilename(name)
+
+	data, err := fetchRecipientsURL(name)
+
+	var statusErr *recipientsStatusError
+	if errors.As(err, &statusErr) {
+		return nil, fmt.Errorf("could not fetch recipients from %s: %w", name, err)
+	}
+
+	if err != nil {
+		cached, cacheErr := os.ReadFile(cacheFilename)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("could not fetch recipients from %s and there is no cached copy: %w", name, err)
+		}
+
+		if options.Warn != nil {
+			age := "of unknown age"
+			if info, statErr := os.Stat(cacheFilename); statErr == nil {
+				age = "fetched " + time.Since(info.ModTime()).Round(time.Second).String() + " ago"
+			}
+
+			options.Warn(fmt.Sprintf("could not fetch recipients from %s (%v), using the cached copy %s, %s", name, err, cacheFilename, age))
+		}
+
+		return cached, nil
+	}
+
+	// Failing to cache only costs us the offline fallback
+	if cacheFilename != "" {
+		if os.MkdirAll(filepath.Dir(cacheFilename), 0700) == nil {
+			_ = os.WriteFile(cacheFilename, data, 0600)
+		}
+	}
+
+	return data, nil
+}
+
+func fetchRecipientsURL(url string) ([]byte, error) {
+	response, err := recipientsHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &recipientsStatusError{status: response.Status}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, recipientsFetchLimitBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > recipientsFetchLimitBytes {
+		return nil, fmt.Errorf("recipients file is larger than %d bytes", recipientsFetchLimitBytes)
+	}
+
+	return data, nil
+}
+
+// An empty name means there is nowhere to cache
+func recipientsCacheFilename(url string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	digest := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, "encryptor", "recipients", hex.EncodeToString(digest[:]))
+}
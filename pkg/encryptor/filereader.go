@@ -0,0 +1,234 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+	A FileReader reads an encrypted file's plaintext at any offset,
+	decrypting only the chunks a read touches, so a file can be served
+	or seeked through (a media player skipping ahead, a download tool
+	resuming) without being decrypted whole first
+
+	Every chunk is authenticated as it is decrypted - with chunk AAD
+	(format 1.8 and later) against its place in the file and the header
+	as well, so chunks cannot be moved, dropped from the end, or paired
+	with another header. What needs the whole file is not checked: the
+	footer, the signature, and the plaintext hash are left to
+	encryptor --verify, which can be run first when they matter
+
+	The last few chunks decrypted are kept, reads are mostly small and
+	front to back within a chunk. ReadAt may be called from several
+	goroutines at once
+*/
+
+const fileReaderCachedChunks = 4
+
+type FileReader struct {
+	file            *os.File
+	header          EncryptedFileHeader
+	cipher          CipherEnum
+	mode            CipherModeEnum
+	keyMaterial     []byte
+	endOfHeader     int64
+	payloadBytes    int64
+	numChunks       uint32
+	plaintextBytes  int64
+	encryptedChunk  int64 // A whole chunk's size in the file, overhead included
+	cacheMutex      sync.Mutex
+	cachedChunkIDs  []uint32 // Most recently used last
+	cachedPlaintext map[uint32][]byte
+}
+
+func openFileReader(fileName string, options *Options) (*FileReader, error) {
+	if options == nil {
+		return nil, errors.New("options is nil")
+	}
+
+	inspection, err := inspect(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !inspection.Supported {
+		return nil, fmt.Errorf("file format version %q is not supported by this version of encryptor", inspection.FormatVersion)
+	}
+
+	header, _, err := getEncryptedFileHeaderFromFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve encryption header from file: %w", err)
+	}
+
+	if header.ChunkSizeBytes <= 0 || header.ChunkSizeBytes > bytesFromMB(ChunkSizeMax) {
+		return nil, errors.New("encryption header has an invalid chunk size")
+	}
+
+	// Where an offset's compressed data is depends on everything before it
+	if header.Compression != "" {
+		return nil, errors.New("a compressed file can only be read from the start, decrypt it instead")
+	}
+
+	suite, err := cipherSuiteForHeader(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := resolveKeyMaterial(Decryption, &header, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyKeyCheck(&header, key.Material)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileReader{
+		file:            file,
+		header:          header,
+		cipher:          suite.Cipher,
+		mode:            suite.Mode,
+		keyMaterial:     key.Material,
+		endOfHeader:     inspection.HeaderBytes,
+		payloadBytes:    inspection.PayloadBytes,
+		numChunks:       inspection.NumChunks,
+		plaintextBytes:  inspection.PlaintextBytes,
+		encryptedChunk:  header.ChunkSizeBytes + chunkOverheadBytes(&header),
+		cachedPlaintext: map[uint32][]byte{},
+	}, nil
+}
+
+// The plaintext's size
+func (reader *FileReader) Size() int64 {
+	return reader.plaintextBytes
+}
+
+func (reader *FileReader) Header() EncryptedFileHeader {
+	return reader.header
+}
+
+func (reader *FileReader) ReadAt(data []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("cannot read before the start of the file")
+	}
+
+	read := 0
+	for read < len(data) {
+		position := offset + int64(read)
+		if position >= reader.plaintextBytes {
+			return read, io.EOF
+		}
+
+		chunk, err := reader.chunk(uint32(position/reader.header.ChunkSizeBytes) + 1)
+		if err != nil {
+			return read, err
+		}
+
+		read += copy(data[read:], chunk[position%reader.header.ChunkSizeBytes:])
+	}
+
+	return read, nil
+}
+
+func (reader *FileReader) Close() error {
+	return reader.file.Close()
+}
+
+// A chunk's plaintext, decrypted unless it was recently
+func (reader *FileReader) chunk(chunkID uint32) ([]byte, error) {
+	reader.cacheMutex.Lock()
+	plaintext, cached := reader.cachedPlaintext[chunkID]
+	if cached {
+		reader.useCachedChunk(chunkID)
+	}
+	reader.cacheMutex.Unlock()
+
+	if cached {
+		return plaintext, nil
+	}
+
+	// Decrypted without the lock, so reads of different chunks do not wait on each other
+	plaintext, err := reader.decryptChunk(chunkID)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.cacheMutex.Lock()
+	defer reader.cacheMutex.Unlock()
+
+	if _, cached = reader.cachedPlaintext[chunkID]; !cached {
+		reader.cachedPlaintext[chunkID] = plaintext
+		reader.cachedChunkIDs = append(reader.cachedChunkIDs, chunkID)
+
+		if len(reader.cachedChunkIDs) > fileReaderCachedChunks {
+			delete(reader.cachedPlaintext, reader.cachedChunkIDs[0])
+			reader.cachedChunkIDs = reader.cachedChunkIDs[1:]
+		}
+	}
+
+	return plaintext, nil
+}
+
+// Called with the lock held
+func (reader *FileReader) useCachedChunk(chunkID uint32) {
+	for i, id := range reader.cachedChunkIDs {
+		if id == chunkID {
+			reader.cachedChunkIDs = append(append(reader.cachedChunkIDs[:i:i], reader.cachedChunkIDs[i+1:]...), chunkID)
+			return
+		}
+	}
+}
+
+func (reader *FileReader) decryptChunk(chunkID uint32) ([]byte, error) {
+	start := int64(chunkID-1) * reader.encryptedChunk
+	end := start + reader.encryptedChunk
+	if end > reader.payloadBytes {
+		end = reader.payloadBytes
+	}
+
+	chunkData := make([]byte, end-start)
+
+	_, err := reader.file.ReadAt(chunkData, reader.endOfHeader+start)
+	if err != nil {
+		return nil, fmt.Errorf("could not read chunk %d: %w", chunkID, err)
+	}
+
+	if reader.header.ChunkMarkers != "" {
+		chunkData, err = stripChunkMarker(chunkID, chunkData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A failed checksum is corruption, not a bad key, so check before authenticating
+	if reader.header.ChunkChecksum == ChecksumCRC32C {
+		chunkData, err = stripChecksumCRC32C(chunkData)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d is corrupt: %w", chunkID, err)
+		}
+	}
+
+	final := chunkID == reader.numChunks
+	additionalData := chunkAdditionalData(&reader.header, chunkID, final)
+
+	plaintext, err := decryptBlob(reader.cipher, reader.mode, &chunkData, reader.keyMaterial, additionalData)
+	if err != nil {
+		return nil, corruptUnlessWrongKey(&reader.header, fmt.Errorf("chunk %d: %w: %v", chunkID, ErrAuthenticationFailed, err))
+	}
+
+	// Only the final chunk may be short
+	if !final && int64(len(*plaintext)) != reader.header.ChunkSizeBytes {
+		return nil, fmt.Errorf("chunk %d is the wrong size", chunkID)
+	}
+
+	return *plaintext, nil
+}
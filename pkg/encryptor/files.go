@@ -0,0 +1,562 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+type EncryptedFileHeader struct {
+	FormatVersion  string
+	NumChunks      uint32
+	ChunkSizeBytes int64
+	Algorithm      string
+	Mode           string
+	KeySize        int
+	ChunkChecksum  string            `json:",omitempty"`
+	Recipients     []RecipientStanza `json:",omitempty"`
+	Streamed       bool              `json:",omitempty"` // NumChunks is unknown, see chunkCount
+	Salt           []byte            `json:",omitempty"` // Password key derivation, base64 in JSON
+	KDF            string            `json:",omitempty"` // Password key derivation, empty is the original PBKDF2 parameters
+	KDFIterations  int               `json:",omitempty"`
+	FileID         []byte            `json:",omitempty"` // Random, makes every header (and so every chunk's AAD) unique
+	ChunkAAD       string            `json:",omitempty"` // How chunks are bound to their place, see chunkAdditionalData
+	Footer         string            `json:",omitempty"` // How the whole file is authenticated, see fileAuthenticator
+	PlaintextHash  []byte            `json:",omitempty"` // SHA256 of the plaintext sealed with the file's key, see sealedPlaintextDigest
+	KeyCheck       []byte            `json:",omitempty"` // Tells a wrong key from a corrupt file, see keyCheck
+	HeaderCopy     string            `json:",omitempty"` // Where a copy of the header is kept, see headerCopyBytes
+	ChunkMarkers   string            `json:",omitempty"` // What starts each chunk, see prependChunkMarker
+	Signature      string            `json:",omitempty"` // How the file is signed, see fileSigner
+	SignerKey      string            `json:",omitempty"` // The signer's public key, base64
+	NonceScheme    string            `json:",omitempty"` // How chunk nonces are made, see newChunkNonce
+	NoncePrefix    []byte            `json:",omitempty"` // Random, starts every chunk's nonce
+	Content        string            `json:",omitempty"` // What the plaintext is, ContentTar for a directory (see archive.go), empty for anything
+	Compression    string            `json:",omitempty"` // How the plaintext was compressed before it was chunked, see compression.go
+	Name           string            `json:",omitempty"` // The source's base name, see names.go
+	SealedName     []byte            `json:",omitempty"` // The source's base name sealed with the file's key
+	PlaintextSize  int64             `json:",omitempty"` // Bytes of plaintext, see plaintextSizeBytes - streamed files do not know it up front
+	Dictionary     []byte            `json:",omitempty"` // The zstd dictionary a directory's entries are compressed with, sealed with the file's key, see dictionary.go
+
+	digest   []byte // SHA256 of the header as written, length indicator included
+	fromCopy bool   // Read from the copy at the end of the file, the header at the front is damaged
+}
+
+/*
+	Each format version adds optional features to the previous one, files
+	are written with the lowest version that describes the features they
+	use so that older readers keep working whenever possible
+
+	1.0 - the original format
+	1.1 - optional per-chunk checksums
+	1.2 - optional recipient stanzas wrapping a random file key
+	1.3 - streamed files, written without knowing the chunk count
+	1.4 - a random per-file salt for password key derivation
+	1.5 - the password key derivation function and its parameters
+	1.6 - ciphers other than AES-GCM (XChaCha20-Poly1305)
+	1.7 - AES-GCM-SIV
+	1.8 - chunks authenticate their index, the chunk count, and the header
+	1.9 - a footer authenticating the whole file
+	1.10 - the SHA256 of the plaintext, checked after decryption
+	1.11 - a key check, telling a wrong key from a corrupt file
+	1.12 - a copy of the header at the end of the file
+	1.13 - a marker at the start of each chunk, to resynchronize on
+	1.14 - an Ed25519 signature after the footer
+	1.15 - the plaintext is compressed (by the codec named) before it is chunked
+	1.16 - the plaintext's size, checked against the chunks before decrypting
+	1.17 - a sealed zstd dictionary that the compressed plaintext needs
+
+	Some additions need no new version - a nonce prefix (see nonce.go)
+	changes how nonces are chosen but not how chunks are read, a file's
+	Content only says what its plaintext is (older versions decrypt a
+	directory archive to the tar it is), and its Name or SealedName only
+	what it was called
+*/
+var supportedFormatVersions = []string{"1.0", "1.1", "1.2", "1.3", "1.4", "1.5", "1.6", "1.7", "1.8", "1.9", "1.10", "1.11", "1.12", "1.13", "1.14", "1.15", "1.16", "1.17"}
+
+const ChecksumCRC32C = "CRC32C"
+const ChunkAADHeaderIndex = "HEADER-SHA256-INDEX"
+const CRC32CSize uint = 4
+
+/*
+	Next file steps would be to enforce versioning across all
+	aspects of file persistence, but this is a project, not a
+	product, so I only get about 20 hours or so to work on it
+	- so, for now, we use version info in the file header
+*/
+
+func getEncryptedFileHeaderFromFile(fileName string) (EncryptedFileHeader, int, error) {
+	fileName = strings.TrimSpace(fileName)
+	if fileName == "" {
+		return EncryptedFileHeader{}, 0, errors.New("empty string passed in for filename")
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("file does not exist: %w", err)
+		} else if os.IsPermission(err) {
+			err = fmt.Errorf("could not open file due to insufficient permissions: %w", err)
+		} else {
+			err = fmt.Errorf("could not open file due to unexpected error: %w", err)
+		}
+
+		return EncryptedFileHeader{}, 0, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil {
+		return EncryptedFileHeader{}, 0, fmt.Errorf("could not obtain file stat info: %w", err)
+	}
+
+	// Theoretically an encrypted file could be a header length indicator specifying 0 and a 1 byte file
+	if stats.Size() < int64(3) {
+		return EncryptedFileHeader{}, 0, fmt.Errorf("%w, the file is too small to have a header", ErrNotEncryptedFile)
+	}
+
+	if header, endOfHeader, ok := cachedEncryptedFileHeader(fileName, stats); ok {
+		return header, endOfHeader, nil
+	}
+
+	header, endOfHeader, err := readEncryptedFileHeader(bufio.NewReader(file))
+
+	// A damaged header is read from its copy at the end of the file, when it has one
+	header, endOfHeader, err = preferIntactHeader(file, stats.Size(), header, endOfHeader, err)
+	if err != nil {
+		return EncryptedFileHeader{}, 0, err
+	}
+
+	cacheEncryptedFileHeader(fileName, stats, &header, endOfHeader)
+
+	return header, endOfHeader, nil
+}
+
+// Consumes the header length indicator and the header, the offset returned is the end of the header
+func readEncryptedFileHeader(reader io.Reader) (EncryptedFileHeader, int, error) {
+	// Read the first two bytes for the header length indicator
+	bytesToRead := 2
+	hliBytes := make([]byte, bytesToRead)
+
+	bytesRead, err := io.ReadFull(reader, hliBytes)
+	if err != nil || bytesRead != bytesToRead {
+		return EncryptedFileHeader{}, 0, fmt.Errorf("%w, could not read HLI from file: %v", ErrNotEncryptedFile, err)
+	}
+
+	// We need to know the offset to the end of the header
+	offset := 2
+
+	headerLength, err := uint16FromBytes(&hliBytes)
+	if err != nil {
+		return EncryptedFileHeader{}, 0, fmt.Errorf("could not derive HLI from data")
+	}
+
+	// Read the header
+	headerBytes := make([]byte, headerLength)
+
+	bytesRead, err = io.ReadFull(reader, headerBytes)
+	if err != nil || bytesRead != int(headerLength) {
+		return EncryptedFileHeader{}, 0, fmt.Errorf("%w, could not read header: %v", ErrNotEncryptedFile, err)
+	}
+
+	encryptedFileHeader, err := encryptionHeaderFromBytes(&headerBytes)
+	if err != nil {
+		return EncryptedFileHeader{}, 0, fmt.Errorf("%w, could not read header: %v", ErrNotEncryptedFile, err)
+	}
+
+	// The digest is of the bytes we read, re-serializing could differ
+	digest := sha256.New()
+	digest.Write(hliBytes)
+	digest.Write(headerBytes)
+	encryptedFileHeader.digest = digest.Sum(nil)
+
+	offset += int(headerLength)
+
+	return encryptedFileHeader, offset, nil
+}
+
+func getEncryptedFileHeaderFromBytes(data *[]byte) (*EncryptedFileHeader, int, error) {
+	// Must at least have a header length indicator (theoretically could be header of length 0)
+	if data == nil || len(*data) < 2 {
+		return &EncryptedFileHeader{}, 0, errors.New("nil or too small array passed in as data")
+	}
+
+	// Start computing the length of the HLI and header together (useful as a file offset during reads and writes)
+	var offset int = 0
+
+	// The first two bytes are the HLI (telling us how much header data follows)
+	offset += 2
+	headerLength, err := uint16FromBytes(data)
+	if err != nil {
+		return &EncryptedFileHeader{}, 0, fmt.Errorf("failed to obtain HLI from data")
+	}
+
+	offset += int(headerLength)
+
+	// Get the header from the header bytes (skip over the HLI)
+	subSlice := (*data)[2:]
+	encryptedFileHeader, err := encryptionHeaderFromBytes(&subSlice)
+	if err != nil {
+		return &EncryptedFileHeader{}, 0, fmt.Errorf("failed to derive file encryption header from data")
+	}
+
+	return &encryptedFileHeader, offset, nil
+}
+
+func getCompleteEncryptedFileHeaderAsBytes(header *EncryptedFileHeader) ([]byte, error) {
+	if header == nil {
+		return []byte{}, errors.New("nil passed in for header")
+	}
+
+	// Serialize the structure to a JSON byte array
+	jsonBytes, err := json.Marshal(header)
+	if err != nil {
+		return []byte{}, fmt.Errorf("marshaling header data failed: %w", err)
+	}
+
+	// The length indicator is a uint16, a larger header could be written but never read back
+	if len(jsonBytes) > math.MaxUint16 {
+		return []byte{}, fmt.Errorf("the header would be %d bytes, more than the %d a header can hold - encrypt to fewer recipients", len(jsonBytes), math.MaxUint16)
+	}
+
+	// Now that we can measure the header array, let's generate our header length indicator
+	headerLength := uint16(len(jsonBytes))
+
+	// Use a binary writer on an expandable Buffer
+	headerBuffer := new(bytes.Buffer)
+
+	err = binary.Write(headerBuffer, binary.LittleEndian, headerLength)
+	if err != nil {
+		return []byte{}, fmt.Errorf("failed to binary write header length indicator: %w", err)
+	}
+
+	hliBytes := headerBuffer.Bytes()
+
+	// Concatenate the HLI and the Header JSON into one complete header
+	return append(hliBytes, jsonBytes...), nil
+}
+
+// Must be called once the header is final, every chunk's AAD depends on it
+func setHeaderDigest(header *EncryptedFileHeader) error {
+	headerBytes, err := getCompleteEncryptedFileHeaderAsBytes(header)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(headerBytes)
+	header.digest = digest[:]
+
+	return nil
+}
+
+/*
+	Before format 1.8 chunks were sealed on their own, so chunks could be
+	reordered, duplicated, dropped from the end, or swapped with chunks of
+	another file under the same key and still decrypt. Since then every
+	chunk's AAD is
+
+		header digest (32 bytes) | chunk ID (uint32) | chunk count (uint32) | final (1 byte)
+
+	big endian, chunk IDs starting at 1. The count is 0 for streamed files,
+	which never know it, and the final flag is what stops them from being
+	cut short at a chunk boundary. Headers without ChunkAAD get nil
+*/
+func chunkAdditionalData(header *EncryptedFileHeader, chunkID uint32, final bool) []byte {
+	if header == nil || header.ChunkAAD == "" {
+		return nil
+	}
+
+	additionalData := make([]byte, sha256.Size+9)
+	copy(additionalData, header.digest)
+	binary.BigEndian.PutUint32(additionalData[sha256.Size:], chunkID)
+	binary.BigEndian.PutUint32(additionalData[sha256.Size+4:], header.NumChunks)
+
+	if final {
+		additionalData[sha256.Size+8] = 1
+	}
+
+	return additionalData
+}
+
+func uint16FromBytes(data *[]byte) (uint16, error) {
+	if data == nil || len(*data) < 2 {
+		return 0, errors.New("must supply at least 2 bytes to convert bytes to uint16")
+	}
+	num := binary.LittleEndian.Uint16(*data)
+	return num, nil
+}
+
+func bytesFromUint16(num uint16) ([]byte, error) {
+	headerBuffer := new(bytes.Buffer)
+
+	err := binary.Write(headerBuffer, binary.LittleEndian, num)
+	if err != nil {
+		return []byte{}, fmt.Errorf("binary write failed converting uint16 to bytes: %w", err)
+	}
+
+	return headerBuffer.Bytes(), nil
+}
+
+func bytesFromEncryptionHeader(header *EncryptedFileHeader) ([]byte, error) {
+	jsonBytes, err := json.Marshal(header)
+	if err != nil {
+		return []byte{}, fmt.Errorf("marshaling failed: %w", err)
+	}
+	return jsonBytes, nil
+}
+
+func encryptionHeaderFromBytes(data *[]byte) (EncryptedFileHeader, error) {
+	if data == nil {
+		return EncryptedFileHeader{}, errors.New("nil passed in for data")
+	}
+
+	var header EncryptedFileHeader
+
+	err := json.Unmarshal(*data, &header)
+	if err != nil {
+		return EncryptedFileHeader{}, fmt.Errorf("unmarshaling failed: %w", err)
+	}
+	return header, nil
+}
+
+/*
+	We need to generate an encrypted file header which consists of a uint16
+	indicating the size of the header and the header itself arranged as a
+	byte array with the uint16 leading and encoded in little endian format
+	followed by the header itself - a JSON string of UTF-8 characters that
+	maps to the EncryptedFileHeader structure
+
+	This data prefixes our encrypted files
+*/
+func newEncryptedFileHeader(job *pipelineJob, numChunks uint32) EncryptedFileHeader {
+	suite := cipherSuiteByEnum(job.Cipher, job.CipherMode)
+
+	header := EncryptedFileHeader{
+		NumChunks:      numChunks,
+		ChunkSizeBytes: bytesFromMB(job.ChunkSizeMB),
+		Algorithm:      suite.Algorithm,
+		Mode:           suite.ModeName,
+		KeySize:        suite.KeySize,
+		Recipients:     job.Recipients,
+		Salt:           job.Salt,
+		KDF:            job.KDF,
+		KDFIterations:  job.KDFIterations,
+		FileID:         job.FileID,
+		PlaintextHash:  job.PlaintextHash,
+		NoncePrefix:    job.NoncePrefix,
+		Content:        job.Content,
+		Name:           job.Name,
+		SealedName:     job.SealedName,
+		PlaintextSize:  job.PlaintextSize,
+		Dictionary:     job.Dictionary,
+	}
+
+	if len(job.FileID) > 0 {
+		header.ChunkAAD = ChunkAADHeaderIndex
+		header.Footer = FooterHMACSHA256
+	}
+
+	if len(job.NoncePrefix) > 0 {
+		header.NonceScheme = NonceSchemePrefixCounter
+	}
+
+	if job.ChunkChecksum {
+		header.ChunkChecksum = ChecksumCRC32C
+	}
+
+	if job.StoreKeyCheck && len(job.FileID) > 0 {
+		header.KeyCheck = keyCheck(job.KeyMaterial, job.FileID)
+	}
+
+	// Only a header bound into every chunk's AAD can be trusted from a copy
+	if job.HeaderCopy && len(job.FileID) > 0 {
+		header.HeaderCopy = HeaderCopyTrailer
+	}
+
+	// Markers are trusted through the chunk ID in the AAD, so they need it too
+	if job.ChunkMarkers && len(job.FileID) > 0 {
+		header.ChunkMarkers = ChunkMarkersMagicIndex
+	}
+
+	// The signature follows the footer, a detached one leaves the header as it is
+	if job.Signer.embedded() && len(job.FileID) > 0 {
+		header.Signature = SignatureEd25519
+		header.SignerKey = job.Signer.publicKey()
+	}
+
+	header.FormatVersion = minimumFormatVersion(&header)
+
+	return header
+}
+
+func minimumFormatVersion(header *EncryptedFileHeader) string {
+	if len(header.Dictionary) > 0 {
+		return "1.17"
+	}
+
+	if header.PlaintextSize > 0 {
+		return "1.16"
+	}
+
+	if header.Compression != "" {
+		return "1.15"
+	}
+
+	if header.Signature != "" {
+		return "1.14"
+	}
+
+	if header.ChunkMarkers != "" {
+		return "1.13"
+	}
+
+	if header.HeaderCopy != "" {
+		return "1.12"
+	}
+
+	if len(header.KeyCheck) > 0 {
+		return "1.11"
+	}
+
+	if len(header.PlaintextHash) > 0 {
+		return "1.10"
+	}
+
+	if header.Footer != "" {
+		return "1.9"
+	}
+
+	if header.ChunkAAD != "" {
+		return "1.8"
+	}
+
+	if header.Mode == "GCM-SIV" {
+		return "1.7"
+	}
+
+	if header.Algorithm != "" && header.Algorithm != "AES" {
+		return "1.6"
+	}
+
+	if header.KDF != "" {
+		return "1.5"
+	}
+
+	if len(header.Salt) > 0 {
+		return "1.4"
+	}
+
+	if header.Streamed {
+		return "1.3"
+	}
+
+	if len(header.Recipients) > 0 {
+		return "1.2"
+	}
+
+	if header.ChunkChecksum != "" {
+		return "1.1"
+	}
+
+	return "1.0"
+}
+
+func isSupportedFormatVersion(version string) bool {
+	for _, supported := range supportedFormatVersions {
+		if version == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The number of bytes each encrypted chunk adds on top of its plaintext
+func chunkOverheadBytes(header *EncryptedFileHeader) int64 {
+	// Unrecognized ciphers are rejected before any chunk is read, assume AES-GCM for them here
+	suite, err := cipherSuiteForHeader(header)
+	if err != nil {
+		suite = cipherSuites[0]
+	}
+
+	overhead := int64(suite.NonceSize) + int64(suite.TagSize)
+
+	if header.ChunkChecksum == ChecksumCRC32C {
+		overhead += int64(CRC32CSize)
+	}
+
+	return overhead + chunkMarkerSizeBytes(header)
+}
+
+/*
+	Streamed files do not record their chunk count, instead the last chunk
+	is always short (an empty final chunk follows a full one) so the count
+	follows from the length of the chunk data - a length that ends on a
+	chunk boundary means the file was truncated
+*/
+func chunkCount(header *EncryptedFileHeader, payloadBytes int64) (uint32, error) {
+	if !header.Streamed {
+		return header.NumChunks, nil
+	}
+
+	encryptedChunkSizeBytes := header.ChunkSizeBytes + chunkOverheadBytes(header)
+	if header.ChunkSizeBytes <= 0 || payloadBytes < chunkOverheadBytes(header) || payloadBytes%encryptedChunkSizeBytes == 0 {
+		return 0, errors.New("streamed file is truncated, its final chunk is missing")
+	}
+
+	return uint32(payloadBytes/encryptedChunkSizeBytes) + 1, nil
+}
+
+/*
+	How many bytes the chunks of a payload decrypt to. Older files are
+	sized from the chunks - every one but the last is whole, and the last
+	is whatever remains - so a file cut short or grown inside its last
+	chunk only shows when that chunk fails to authenticate. Since 1.16
+	the header records the size and the payload must agree, so it is
+	found before anything is decrypted, and the size a target is
+	preflighted, truncated, and shown with is the one encrypted. For
+	compressed files it is the compressed stream's size
+*/
+func plaintextSizeBytes(header *EncryptedFileHeader, payloadBytes int64, numChunks uint32) (int64, error) {
+	sizeBytes := payloadBytes - int64(numChunks)*chunkOverheadBytes(header)
+
+	if header.PlaintextSize > 0 && header.PlaintextSize != sizeBytes {
+		return sizeBytes, fmt.Errorf("%w, its chunks hold %d bytes of plaintext where its header records %d", ErrFileCorrupt, sizeBytes, header.PlaintextSize)
+	}
+
+	return sizeBytes, nil
+}
+
+func getStatsFromFile(fileName string) (os.FileInfo, error) {
+	fileName = strings.TrimSpace(fileName)
+	if fileName == "" {
+		return nil, errors.New("empty string passed in for filename to get stats")
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("file does not exist: %w", err)
+		} else if os.IsPermission(err) {
+			return nil, fmt.Errorf("could not retrieve stats for file due to insufficient permissions: %w", err)
+		}
+
+		return nil, fmt.Errorf("could not retrieve stats for file due to unexpected error: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	return file.Stat()
+}
@@ -0,0 +1,108 @@
+package encryptor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	A key fingerprint is a short, stable name for a key or password, shown
+	so a user can see they supplied the same one as last time before hours
+	of work are spent with it. Passwords are derived with a fixed salt for
+	this - every file has its own salt, so its key would give every file
+	its own fingerprint. A fixed salt means one precomputed dictionary
+	serves every user, so a password's fingerprint is much cheaper to
+	guess from than a file. It is never written to transcripts or
+	reports, and the command line only derives and shows one when stderr
+	is a terminal, not when it is captured to a log. A key's is safe
+	anywhere, there is nothing to guess
+
+	A key check is the file's own version, stored in the header since
+	format 1.11 when asked for: an HMAC of the file ID under the file's
+	key, truncated. Decryption checks it before reading a chunk, so a wrong
+	key fails at once with ErrWrongKey, and a right key that fails later
+	means the file is corrupt (ErrFileCorrupt) rather than either. It is
+	per file, so files encrypted with the same key cannot be linked by it
+*/
+
+const keyFingerprintLabel = "encryptor key fingerprint"
+const keyCheckLabel = "encryptor key check"
+
+const KeyFingerprintSize = 8
+const KeyCheckSize = 8
+
+// The fingerprint of the key or password in options, recipients have none (each has its own key)
+func keyFingerprint(options *Options) (string, error) {
+	var keyMaterial []byte
+	var err error
+
+	if options.KeyHex != "" {
+		keyMaterial, err = hex.DecodeString(options.KeyHex)
+		if err != nil {
+			return "", errors.New("error decoding hex string for key material")
+		}
+	} else if options.Password != "" {
+		keyMaterial, err = cachedPasswordKey(options.Password, []byte(keyFingerprintLabel), KDFPBKDF2SHA256, PasswordKDFIterations)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		return "", errors.New("only keys and passwords have fingerprints")
+	}
+
+	mac := hmac.New(sha256.New, keyMaterial)
+	mac.Write([]byte(keyFingerprintLabel))
+
+	return formatFingerprint(mac.Sum(nil)[:KeyFingerprintSize]), nil
+}
+
+// Groups of four hex digits, easier to compare by eye
+func formatFingerprint(fingerprint []byte) string {
+	digits := hex.EncodeToString(fingerprint)
+
+	var groups []string
+	for i := 0; i < len(digits); i += 4 {
+		end := i + 4
+		if end > len(digits) {
+			end = len(digits)
+		}
+
+		groups = append(groups, digits[i:end])
+	}
+
+	return strings.Join(groups, " ")
+}
+
+func keyCheck(keyMaterial []byte, fileID []byte) []byte {
+	mac := hmac.New(sha256.New, keyMaterial)
+	mac.Write([]byte(keyCheckLabel))
+	mac.Write(fileID)
+
+	return mac.Sum(nil)[:KeyCheckSize]
+}
+
+// nil for headers without a key check
+func verifyKeyCheck(header *EncryptedFileHeader, keyMaterial []byte) error {
+	if len(header.KeyCheck) == 0 {
+		return nil
+	}
+
+	if !hmac.Equal(header.KeyCheck, keyCheck(keyMaterial, header.FileID)) {
+		return ErrWrongKey
+	}
+
+	return nil
+}
+
+// Authentication failures past a key check that passed are the file's fault, not the key's
+func corruptUnlessWrongKey(header *EncryptedFileHeader, err error) error {
+	if len(header.KeyCheck) > 0 && errors.Is(err, ErrAuthenticationFailed) && !errors.Is(err, ErrWrongKey) {
+		return fmt.Errorf("%w, the key matches the file's key check: %v", ErrFileCorrupt, err)
+	}
+
+	return err
+}
@@ -0,0 +1,80 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+	FIPS mode restricts jobs to FIPS approved algorithms - AES-256-GCM,
+	SHA-2, PBKDF2, RSA-OAEP key wrapping (PKCS#11 tokens included), Cloud
+	KMS and Azure Key Vault (whose modules are FIPS 140-2 validated) - and
+	refuses anything else rather than quietly falling back. It is switched
+	on per job with Options.FIPS (--fips), or for every job by building
+	with -tags fips
+
+	Refused in FIPS mode:
+
+	XChaCha20-Poly1305 - not approved, for encrypting or decrypting
+	ssh-ed25519, x25519 and mlkem768-x25519 recipients - X25519 and ChaCha20-Poly1305 are not approved
+	OpenPGP recipients - the file key is wrapped by gpg, outside our control
+	TPM 2.0 sealing - the TPM's own key hierarchy and symmetric modes are outside our control
+	Plugin ciphers and recipients - what a plugin does is outside our control
+	OpenPGP messages - CFB mode, and a SHA-1 integrity check
+
+	This restricts the algorithms used, it does not make the Go crypto
+	packages a validated module - for that build with a toolchain backed
+	by a validated module (e.g. BoringCrypto)
+*/
+
+// Was this binary built with -tags fips? If so every job is in FIPS mode
+func FIPSBuild() bool {
+	return fipsBuild
+}
+
+func fipsEnabled(options *Options) bool {
+	return fipsBuild || options.FIPS
+}
+
+func fipsApprovedRecipientType(recipientType string) bool {
+	return recipientType == RecipientTypeSSHRSA || recipientType == RecipientTypeRSAOAEP || recipientType == RecipientTypeGCPKMS || recipientType == RecipientTypeAzureKeyVault || recipientType == RecipientTypePKCS11
+}
+
+func fipsApprovedSSHKey(key ssh.PublicKey) bool {
+	return key.Type() == ssh.KeyAlgoRSA
+}
+
+/*
+	Refuses options FIPS mode does not allow, before any key material is
+	generated - when decrypting the header decides the cipher (an
+	unreadable header is left for the pipeline to report)
+*/
+func checkFIPSOptions(operation OperationEnum, header *EncryptedFileHeader, options *Options) error {
+	if !fipsEnabled(options) {
+		return nil
+	}
+
+	if operation == Encryption && len(options.GPGRecipients) > 0 {
+		return errors.New("FIPS mode: OpenPGP recipients are wrapped by gpg and are not allowed")
+	}
+
+	if operation == Encryption && options.TPMSeal {
+		return errors.New("FIPS mode: sealing to the TPM is not allowed")
+	}
+
+	if operation == Encryption && len(options.PluginRecipients) > 0 {
+		return errors.New("FIPS mode: plugin recipients are not allowed")
+	}
+
+	suite, err := cipherSuiteByName(options.Cipher)
+	if operation == Decryption {
+		suite, err = cipherSuiteForHeader(header)
+	}
+
+	if err == nil && !suite.FIPSApproved {
+		return fmt.Errorf("FIPS mode: the %s cipher is not allowed", suite.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,5 @@
+//go:build !fips
+
+package encryptor
+
+const fipsBuild = false
@@ -0,0 +1,201 @@
+package encryptor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"os"
+)
+
+/*
+	Since format 1.9 a file ends with a footer authenticating the file as
+	a whole - an HMAC-SHA256 over the header digest, the tag of every
+	chunk in order, and the chunk count - keyed with a key derived from
+	the file's key (never the key itself). Chunk AAD already binds each
+	chunk to its place, the footer makes the file one unit: a file cut
+	short on a chunk boundary, or missing its footer, fails as a whole
+	rather than decrypting to a shorter plaintext
+
+	Tags are recorded by whoever seals or opens a chunk, each chunk into
+	its own slot, and the footer is computed once every chunk has been
+	through - by the writer when encrypting, after the pipeline when
+	decrypting
+*/
+
+const FooterHMACSHA256 = "HMAC-SHA256"
+
+const footerKeyLabel = "encryptor footer"
+
+type fileAuthenticator struct {
+	key     []byte
+	digest  []byte
+	tagSize int
+	tags    [][]byte
+}
+
+// nil for headers without a footer, a nil authenticator records and verifies nothing
+func newFileAuthenticator(header *EncryptedFileHeader, keyMaterial []byte, numChunks uint32) (*fileAuthenticator, error) {
+	if header.Footer == "" {
+		return nil, nil
+	}
+
+	if header.Footer != FooterHMACSHA256 {
+		return nil, fmt.Errorf("file footer %q is not supported by this version of encryptor", header.Footer)
+	}
+
+	suite, err := cipherSuiteForHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, keyMaterial, nil, []byte(footerKeyLabel)), key); err != nil {
+		return nil, fmt.Errorf("internal crypto error deriving footer key: %w", err)
+	}
+
+	return &fileAuthenticator{
+		key:     key,
+		digest:  header.digest,
+		tagSize: int(suite.TagSize),
+		tags:    make([][]byte, numChunks),
+	}, nil
+}
+
+/*
+	Records the tag of a sealed chunk (nonce, ciphertext, tag - without
+	its checksum). Pipelines know the chunk count and record concurrently
+	into their own slots, streams do not and record one at a time, so
+	only they grow the slots
+*/
+func (auth *fileAuthenticator) record(chunkID uint32, sealedChunk []byte) {
+	if auth == nil || len(sealedChunk) < auth.tagSize {
+		return
+	}
+
+	for uint32(len(auth.tags)) < chunkID {
+		auth.tags = append(auth.tags, nil)
+	}
+
+	auth.tags[chunkID-1] = append([]byte(nil), sealedChunk[len(sealedChunk)-auth.tagSize:]...)
+}
+
+func (auth *fileAuthenticator) sum() []byte {
+	mac := hmac.New(sha256.New, auth.key)
+	mac.Write(auth.digest)
+
+	for _, tag := range auth.tags {
+		mac.Write(tag)
+	}
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(auth.tags)))
+	mac.Write(count)
+
+	return mac.Sum(nil)
+}
+
+func (auth *fileAuthenticator) verify(footer []byte) error {
+	if auth == nil {
+		return nil
+	}
+
+	for i, tag := range auth.tags {
+		if tag == nil {
+			return fmt.Errorf("file authentication failed, chunk %d was never read", i+1)
+		}
+	}
+
+	if !hmac.Equal(footer, auth.sum()) {
+		return errors.New("file authentication failed, the file is truncated or its chunks were changed")
+	}
+
+	return nil
+}
+
+// Reads the footer from the end of a file and checks it against the recorded tags
+func verifyFileFooter(fileName string, sizeBytes int64, auth *fileAuthenticator) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("could not open file to read its footer: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	footer := make([]byte, sha256.Size)
+
+	_, err = file.ReadAt(footer, sizeBytes-int64(len(footer)))
+	if err != nil {
+		return fmt.Errorf("could not read file footer: %w", err)
+	}
+
+	return auth.verify(footer)
+}
+
+// The bytes a header's footer takes at the end of the file
+func footerSizeBytes(header *EncryptedFileHeader) int64 {
+	if header.Footer == "" {
+		return 0
+	}
+
+	return sha256.Size
+}
+
+/*
+	Streams cannot seek to their footer, so the last bytes read are held
+	back until the source ends, and whatever was held back then is the
+	footer - chunks above never see it
+*/
+type footerHoldbackReader struct {
+	source   io.Reader
+	held     []byte
+	holdSize int
+	ended    bool
+}
+
+func newFooterHoldbackReader(source io.Reader, holdSize int) *footerHoldbackReader {
+	return &footerHoldbackReader{source: source, holdSize: holdSize}
+}
+
+func (reader *footerHoldbackReader) Read(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	for !reader.ended && len(reader.held) < reader.holdSize+len(data) {
+		buffer := make([]byte, reader.holdSize+len(data)-len(reader.held))
+
+		read, err := reader.source.Read(buffer)
+		reader.held = append(reader.held, buffer[:read]...)
+
+		if err == io.EOF {
+			reader.ended = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	available := len(reader.held) - reader.holdSize
+	if available <= 0 {
+		return 0, io.EOF
+	}
+
+	read := copy(data, reader.held[:available])
+	reader.held = reader.held[read:]
+
+	return read, nil
+}
+
+// Only meaningful once Read has returned io.EOF, nil if the source ended too early to have one
+func (reader *footerHoldbackReader) footer() []byte {
+	if len(reader.held) != reader.holdSize {
+		return nil
+	}
+
+	return reader.held
+}
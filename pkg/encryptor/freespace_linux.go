@@ -0,0 +1,19 @@
+//go:build linux
+
+package encryptor
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Bytes an unprivileged writer may still use on directory's filesystem, false when it cannot be told
+func freeSpaceBytes(directory string) (int64, bool) {
+	var stats unix.Statfs_t
+
+	err := unix.Statfs(directory, &stats)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(stats.Bavail) * stats.Bsize, true
+}
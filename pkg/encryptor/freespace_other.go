@@ -0,0 +1,8 @@
+//go:build !linux
+
+package encryptor
+
+// Free space is not looked up here, a target too large for its filesystem fails as it is written
+func freeSpaceBytes(directory string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,255 @@
+package encryptor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	AES-GCM-SIV (RFC 8452) is nonce misuse resistant - a repeated nonce
+	only reveals that the same plaintext was encrypted twice, where a
+	repeated AES-GCM nonce leaks the authentication key. For long lived
+	keys encrypting millions of chunks with random nonces that removes the
+	one catastrophic failure mode left
+
+	Neither the standard library nor x/crypto implement it, so it is built
+	here from AES and POLYVAL. The tag is computed over the plaintext and
+	then used as the CTR counter, and per-nonce keys are derived from the
+	key and nonce before every seal or open
+*/
+
+const gcmSIVNonceSize = 12
+const gcmSIVTagSize = 16
+const gcmSIVMaxPlaintext = 1 << 36
+
+type aesGCMSIV struct {
+	block cipher.Block // Only used to derive the per-nonce keys
+}
+
+func newAESGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES-GCM-SIV takes 256 bits of key material")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesGCMSIV{block: block}, nil
+}
+
+func (siv *aesGCMSIV) NonceSize() int {
+	return gcmSIVNonceSize
+}
+
+func (siv *aesGCMSIV) Overhead() int {
+	return gcmSIVTagSize
+}
+
+func (siv *aesGCMSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("encryptor: incorrect nonce length given to AES-GCM-SIV")
+	}
+
+	if uint64(len(plaintext)) > gcmSIVMaxPlaintext {
+		panic("encryptor: message too large for AES-GCM-SIV")
+	}
+
+	authKey, encryptionBlock := siv.deriveKeys(nonce)
+	tag := gcmSIVTag(authKey, encryptionBlock, nonce, plaintext, additionalData)
+
+	result := append(dst, make([]byte, len(plaintext)+gcmSIVTagSize)...)
+	out := result[len(dst):]
+
+	gcmSIVCTR(encryptionBlock, tag, out[:len(plaintext)], plaintext)
+	copy(out[len(plaintext):], tag[:])
+
+	return result
+}
+
+func (siv *aesGCMSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("encryptor: incorrect nonce length given to AES-GCM-SIV")
+	}
+
+	if len(ciphertext) < gcmSIVTagSize || uint64(len(ciphertext)-gcmSIVTagSize) > gcmSIVMaxPlaintext {
+		return nil, errors.New("message authentication failed")
+	}
+
+	var tag [16]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSIVTagSize]
+
+	authKey, encryptionBlock := siv.deriveKeys(nonce)
+
+	result := append(dst, make([]byte, len(ciphertext))...)
+	plaintext := result[len(dst):]
+
+	gcmSIVCTR(encryptionBlock, tag, plaintext, ciphertext)
+
+	expected := gcmSIVTag(authKey, encryptionBlock, nonce, plaintext, additionalData)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		for i := range plaintext {
+			plaintext[i] = 0
+		}
+
+		return nil, errors.New("message authentication failed")
+	}
+
+	return result, nil
+}
+
+// The per-nonce POLYVAL key and AES-256 encryption key, RFC 8452 section 4
+func (siv *aesGCMSIV) deriveKeys(nonce []byte) ([16]byte, cipher.Block) {
+	var input, output [16]byte
+	var derived [48]byte
+
+	copy(input[4:], nonce)
+
+	for counter := uint32(0); counter < 6; counter++ {
+		binary.LittleEndian.PutUint32(input[:4], counter)
+		siv.block.Encrypt(output[:], input[:])
+		copy(derived[counter*8:], output[:8])
+	}
+
+	var authKey [16]byte
+	copy(authKey[:], derived[:16])
+
+	// A 32 byte key cannot be rejected
+	encryptionBlock, _ := aes.NewCipher(derived[16:48])
+
+	return authKey, encryptionBlock
+}
+
+func gcmSIVTag(authKey [16]byte, encryptionBlock cipher.Block, nonce []byte, plaintext []byte, additionalData []byte) [16]byte {
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+
+	hash := newPolyval(authKey)
+	hash.update(additionalData)
+	hash.update(plaintext)
+	hash.update(lengths[:])
+
+	sum := hash.sum()
+	for i := 0; i < gcmSIVNonceSize; i++ {
+		sum[i] ^= nonce[i]
+	}
+
+	sum[15] &= 0x7f
+
+	var tag [16]byte
+	encryptionBlock.Encrypt(tag[:], sum[:])
+
+	return tag
+}
+
+// The counter is the tag with its top bit set, only the first 32 bits count (little endian, wrapping)
+func gcmSIVCTR(encryptionBlock cipher.Block, tag [16]byte, dst []byte, src []byte) {
+	counterBlock := tag
+	counterBlock[15] |= 0x80
+
+	var keystream [16]byte
+
+	for offset := 0; offset < len(src); offset += 16 {
+		encryptionBlock.Encrypt(keystream[:], counterBlock[:])
+
+		end := offset + 16
+		if end > len(src) {
+			end = len(src)
+		}
+
+		for i := offset; i < end; i++ {
+			dst[i] = src[i] ^ keystream[i-offset]
+		}
+
+		binary.LittleEndian.PutUint32(counterBlock[:4], binary.LittleEndian.Uint32(counterBlock[:4])+1)
+	}
+}
+
+/*
+	POLYVAL is GHASH with its bytes reversed (RFC 8452 appendix A), so it
+	is computed as GHASH over byte reversed blocks with a key of
+	mulX_GHASH(ByteReverse(H)) - slower than a dedicated implementation
+	but short enough to check against the RFC by eye
+*/
+type polyval struct {
+	keyHigh, keyLow uint64
+	high, low       uint64
+}
+
+func newPolyval(key [16]byte) *polyval {
+	reversed := reverseBlock(key[:])
+	high := binary.BigEndian.Uint64(reversed[:8])
+	low := binary.BigEndian.Uint64(reversed[8:])
+
+	high, low = ghashMulX(high, low)
+
+	return &polyval{keyHigh: high, keyLow: low}
+}
+
+// Data is zero padded to a whole number of blocks
+func (hash *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		read := copy(block[:], data)
+		data = data[read:]
+
+		reversed := reverseBlock(block[:])
+		hash.high ^= binary.BigEndian.Uint64(reversed[:8])
+		hash.low ^= binary.BigEndian.Uint64(reversed[8:])
+		hash.high, hash.low = ghashMul(hash.high, hash.low, hash.keyHigh, hash.keyLow)
+	}
+}
+
+func (hash *polyval) sum() [16]byte {
+	var block [16]byte
+	binary.BigEndian.PutUint64(block[:8], hash.high)
+	binary.BigEndian.PutUint64(block[8:], hash.low)
+
+	return reverseBlock(block[:])
+}
+
+func reverseBlock(block []byte) [16]byte {
+	var reversed [16]byte
+	for i := 0; i < 16; i++ {
+		reversed[i] = block[15-i]
+	}
+
+	return reversed
+}
+
+// Multiplication by x in GHASH's bit order, the reduction is masked rather than branched on
+func ghashMulX(high uint64, low uint64) (uint64, uint64) {
+	carry := low & 1
+	low = low>>1 | high<<63
+	high = high>>1 ^ (0xe100000000000000 & -carry)
+
+	return high, low
+}
+
+// NIST SP 800-38D algorithm 1, X times Y in GF(2^128)
+func ghashMul(xHigh uint64, xLow uint64, yHigh uint64, yLow uint64) (uint64, uint64) {
+	var zHigh, zLow uint64
+	vHigh, vLow := yHigh, yLow
+
+	for i := 0; i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = xHigh >> (63 - i) & 1
+		} else {
+			bit = xLow >> (127 - i) & 1
+		}
+
+		zHigh ^= vHigh & -bit
+		zLow ^= vLow & -bit
+
+		vHigh, vLow = ghashMulX(vHigh, vLow)
+	}
+
+	return zHigh, zLow
+}
@@ -0,0 +1,388 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Google Cloud KMS keys as recipients, so a backup job on GKE or Compute
+	Engine is given access to a key through its service account (workload
+	identity) instead of being given a password. The file key is sent to
+	Cloud KMS to be encrypted with a symmetric CryptoKey, and the stanza
+	holds the key's resource name and the ciphertext KMS returned
+
+		projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+
+	Decrypting needs no flag, the stanza names the key - only credentials
+	allowed to decrypt with it. KMS picks the key version itself, so keys
+	can be rotated without touching older files (as long as their old
+	versions are kept enabled). A label of our own is passed as additional
+	authenticated data, so the ciphertext only opens as a file key of ours
+
+	Credentials are found the way Application Default Credentials are -
+	GOOGLE_APPLICATION_CREDENTIALS (a service account key or an authorized
+	user), then the file gcloud auth application-default login writes, and
+	then the metadata server every GCE VM and GKE pod with workload
+	identity has. External account (federation) credentials are not
+	supported. Access tokens are kept in memory for the life of the
+	process, never written anywhere
+*/
+
+const RecipientTypeGCPKMS = "gcp-kms"
+
+const gcpKMSLabel = "encryptor/v1/gcp-kms"
+
+const gcpKMSScope = "https://www.googleapis.com/auth/cloudkms"
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// One token serves Cloud KMS and Cloud Storage (gcs.go)
+var gcpScopes = []string{gcpKMSScope, gcsScope}
+
+// Variables so tests can point them at a server of their own
+var gcpKMSEndpoint = "https://cloudkms.googleapis.com/v1/"
+var gcpMetadataHost = "metadata.google.internal"
+
+// Shared by every cloud key service (Cloud KMS, Azure Key Vault)
+var keyServiceHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+var gcpKMSKeyName = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// The fields of a credentials file we use, for either type
+type gcpCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcpTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+var gcpToken = struct {
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}{}
+
+func parseGCPKMSKeyName(name string) (string, error) {
+	name = strings.Trim(strings.TrimSpace(name), "/")
+	if !gcpKMSKeyName.MatchString(name) {
+		return "", fmt.Errorf("Cloud KMS key %q must be a resource name, projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>", name)
+	}
+
+	return name, nil
+}
+
+func wrapFileKeyGCPKMS(fileKey []byte, keyName string) (RecipientStanza, error) {
+	var response struct {
+		Name       string `json:"name"`
+		Ciphertext string `json:"ciphertext"`
+	}
+
+	err := callGCPKMS(keyName, "encrypt", map[string]string{
+		"plaintext":                   base64.StdEncoding.EncodeToString(fileKey),
+		"additionalAuthenticatedData": base64.StdEncoding.EncodeToString([]byte(gcpKMSLabel)),
+	}, &response)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not encrypt to Cloud KMS key %s: %w", keyName, err)
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(response.Ciphertext); err != nil || response.Ciphertext == "" {
+		return RecipientStanza{}, fmt.Errorf("Cloud KMS returned no ciphertext for %s", keyName)
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeGCPKMS,
+		Args: []string{keyName},
+		Body: response.Ciphertext,
+	}, nil
+}
+
+func unwrapFileKeyGCPKMS(stanza RecipientStanza, offline bool) ([]byte, error) {
+	if len(stanza.Args) < 1 {
+		return nil, errors.New("malformed gcp-kms stanza")
+	}
+
+	keyName, err := parseGCPKMSKeyName(stanza.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed gcp-kms stanza: %w", err)
+	}
+
+	if offline {
+		return nil, fmt.Errorf("Cloud KMS key %s is reached over the network: %w", keyName, ErrOffline)
+	}
+
+	var response struct {
+		Plaintext string `json:"plaintext"`
+	}
+
+	err = callGCPKMS(keyName, "decrypt", map[string]string{
+		"ciphertext":                  stanza.Body,
+		"additionalAuthenticatedData": base64.StdEncoding.EncodeToString([]byte(gcpKMSLabel)),
+	}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt with Cloud KMS key %s: %w", keyName, err)
+	}
+
+	return base64.StdEncoding.DecodeString(response.Plaintext)
+}
+
+func callGCPKMS(keyName string, method string, request interface{}, response interface{}) error {
+	token, err := gcpAccessToken()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, gcpKMSEndpoint+keyName+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	httpRequest.Header.Set("Authorization", "Bearer "+token)
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	return doKeyServiceRequest(httpRequest, response)
+}
+
+// Errors carry the message the service returned, it usually says which permission is missing
+func doKeyServiceRequest(request *http.Request, response interface{}) error {
+	httpResponse, err := keyServiceHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(httpResponse.Body)
+
+	data, err := io.ReadAll(io.LimitReader(httpResponse.Body, recipientsFetchLimitBytes))
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		var failure struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+			Description string `json:"error_description"`
+		}
+
+		message := httpResponse.Status
+		if json.Unmarshal(data, &failure) == nil && failure.Error.Message != "" {
+			message += ": " + failure.Error.Message
+		} else if failure.Description != "" {
+			message += ": " + failure.Description
+		}
+
+		return errors.New(message)
+	}
+
+	return json.Unmarshal(data, response)
+}
+
+// A cached token is used until a minute before it expires
+func gcpAccessToken() (string, error) {
+	gcpToken.mutex.Lock()
+	defer gcpToken.mutex.Unlock()
+
+	if gcpToken.token != "" && time.Now().Before(gcpToken.expiry) {
+		return gcpToken.token, nil
+	}
+
+	token, err := newGCPAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New("Google returned an empty access token")
+	}
+
+	gcpToken.token = token.AccessToken
+	gcpToken.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return gcpToken.token, nil
+}
+
+func newGCPAccessToken() (gcpTokenResponse, error) {
+	fileName := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if fileName == "" {
+		if wellKnown := gcpWellKnownCredentialsFilename(); wellKnown != "" {
+			if _, err := os.Stat(wellKnown); err == nil {
+				fileName = wellKnown
+			}
+		}
+	}
+
+	if fileName == "" {
+		token, err := gcpMetadataToken()
+		if err != nil {
+			return gcpTokenResponse{}, fmt.Errorf("no Google credentials were found - set GOOGLE_APPLICATION_CREDENTIALS, run gcloud auth application-default login, or run with a service account on GCP (the metadata server: %v)", err)
+		}
+
+		return token, nil
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return gcpTokenResponse{}, fmt.Errorf("could not read Google credentials: %w", err)
+	}
+
+	var credentials gcpCredentialsFile
+
+	err = json.Unmarshal(data, &credentials)
+	if err != nil {
+		return gcpTokenResponse{}, fmt.Errorf("could not parse Google credentials %s: %w", fileName, err)
+	}
+
+	switch credentials.Type {
+	case "service_account":
+		return gcpServiceAccountToken(&credentials)
+	case "authorized_user":
+		return gcpTokenRequest("https://oauth2.googleapis.com/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {credentials.ClientID},
+			"client_secret": {credentials.ClientSecret},
+			"refresh_token": {credentials.RefreshToken},
+		})
+	}
+
+	return gcpTokenResponse{}, fmt.Errorf("Google credentials %s are of type %q, only service_account and authorized_user are supported", fileName, credentials.Type)
+}
+
+// Where gcloud auth application-default login writes its credentials
+func gcpWellKnownCredentialsFilename() string {
+	if runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			return filepath.Join(appData, "gcloud", "application_default_credentials.json")
+		}
+
+		return ""
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// A JWT signed with the service account's key is exchanged for a token (RFC 7523)
+func gcpServiceAccountToken(credentials *gcpCredentialsFile) (gcpTokenResponse, error) {
+	block, _ := pem.Decode([]byte(credentials.PrivateKey))
+	if block == nil {
+		return gcpTokenResponse{}, errors.New("the service account's private key is not PEM")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return gcpTokenResponse{}, errors.New("the service account's private key is not an RSA key")
+	}
+
+	tokenURI := credentials.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	now := time.Now().Unix()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   credentials.ClientEmail,
+		"scope": strings.Join(gcpScopes, " "),
+		"aud":   tokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(randomReader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return gcpTokenResponse{}, fmt.Errorf("could not sign service account assertion: %w", err)
+	}
+
+	return gcpTokenRequest(tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+func gcpTokenRequest(tokenURI string, form url.Values) (gcpTokenResponse, error) {
+	request, err := http.NewRequest(http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return gcpTokenResponse{}, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token gcpTokenResponse
+
+	err = doKeyServiceRequest(request, &token)
+	if err != nil {
+		return gcpTokenResponse{}, fmt.Errorf("could not get a Google access token: %w", err)
+	}
+
+	return token, nil
+}
+
+// The instance's service account, on GKE the pod's workload identity - GCE_METADATA_HOST overrides the host as Google's libraries allow
+func gcpMetadataToken() (gcpTokenResponse, error) {
+	host := gcpMetadataHost
+	if override := os.Getenv("GCE_METADATA_HOST"); override != "" {
+		host = override
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(strings.Join(gcpScopes, ",")), nil)
+	if err != nil {
+		return gcpTokenResponse{}, err
+	}
+
+	request.Header.Set("Metadata-Flavor", "Google")
+
+	var token gcpTokenResponse
+
+	err = doKeyServiceRequest(request, &token)
+	if err != nil {
+		return gcpTokenResponse{}, err
+	}
+
+	return token, nil
+}
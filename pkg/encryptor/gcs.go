@@ -0,0 +1,647 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Google Cloud Storage objects as sources and targets, named as gsutil
+	names them
+
+		gs://<bucket>/<object>
+
+	They are streamed as objects.go describes, and every range is read
+	from the generation of the object that was there when it was opened,
+	so an object replaced part way through fails the job rather than
+	splicing two objects together
+
+	Writing is a resumable upload, sent a part (Options.PartSizeMB) at a
+	time. A part that fails on a transient error (a dropped connection,
+	429, 5xx) is not sent again from its start - GCS is asked how much of
+	it arrived, and the upload resumes from there. The object only appears
+	once the upload finishes, so a failed job leaves nothing behind, and
+	unless Options.ForceOperation is set the upload is made on condition
+	that no object of that name exists (the check and the write are one,
+	there is no window between them). The session and what it persisted
+	are journaled as parts land, so a run after the process is gone can
+	carry on with it (see uploadjournal.go)
+
+	Credentials are Application Default Credentials, found as for Cloud
+	KMS (see gcpkms.go) - the same token serves both
+*/
+
+// A variable so tests can point it at a server of their own
+var gcsEndpoint = "https://storage.googleapis.com/"
+
+type gcsObject struct {
+	bucket string
+	name   string
+}
+
+func isGCSURL(name string) bool {
+	return strings.HasPrefix(strings.TrimSpace(name), "gs://")
+}
+
+func parseGCSURL(objectURL string) (gcsObject, error) {
+	path := strings.TrimPrefix(strings.TrimSpace(objectURL), "gs://")
+
+	separator := strings.Index(path, "/")
+	if separator <= 0 || separator == len(path)-1 {
+		return gcsObject{}, fmt.Errorf("%q must name an object, gs://<bucket>/<object>", objectURL)
+	}
+
+	return gcsObject{bucket: path[:separator], name: path[separator+1:]}, nil
+}
+
+func (object gcsObject) String() string {
+	return "gs://" + object.bucket + "/" + object.name
+}
+
+// The JSON API's URL for the object, its name escaped whole (slashes included)
+func (object gcsObject) apiURL() string {
+	return gcsEndpoint + "storage/v1/b/" + url.PathEscape(object.bucket) + "/o/" + url.PathEscape(object.name)
+}
+
+func checkGCSOffline(object gcsObject, options *Options) error {
+	if options.Offline {
+		return fmt.Errorf("%s is reached over the network: %w", object, ErrOffline)
+	}
+
+	return nil
+}
+
+// What newRequest makes, with a token that is fresh for every try
+func gcsRequest(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	return objectRequest(func() (*http.Request, error) {
+		token, err := gcpAccessToken()
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := newRequest()
+		if err == nil {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		return request, err
+	})
+}
+
+// The message GCS gave with a failure, it usually says which permission is missing
+func gcsError(response *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(response.Body, recipientsFetchLimitBytes))
+
+	var failure struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if json.Unmarshal(data, &failure) == nil && failure.Error.Message != "" {
+		return fmt.Errorf("%s: %s", response.Status, failure.Error.Message)
+	}
+
+	return errors.New(response.Status)
+}
+
+type GCSReader struct {
+	rangedReader
+	object     gcsObject
+	generation string
+}
+
+func newGCSReader(objectURL string, options *Options) (*GCSReader, error) {
+	if options == nil {
+		return nil, errors.New("options is nil")
+	}
+
+	object, err := parseGCSURL(objectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkGCSOffline(object, options); err != nil {
+		return nil, err
+	}
+
+	response, err := gcsRequest(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, object.apiURL(), nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", object, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not read %s: %w", object, gcsError(response))
+	}
+
+	// The JSON API gives 64 bit numbers as strings
+	var metadata struct {
+		Size       string `json:"size"`
+		Generation string `json:"generation"`
+	}
+
+	err = json.NewDecoder(io.LimitReader(response.Body, recipientsFetchLimitBytes)).Decode(&metadata)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s's metadata: %w", object, err)
+	}
+
+	size, err := strconv.ParseInt(metadata.Size, 10, 64)
+	if err != nil || size < 0 || metadata.Generation == "" {
+		return nil, fmt.Errorf("GCS gave no size or generation for %s", object)
+	}
+
+	reader := &GCSReader{object: object, generation: metadata.Generation}
+	reader.rangedReader = newRangedReader(size, options, reader.readRange)
+
+	return reader, nil
+}
+
+// Bytes [start, end) of the generation that was opened
+func (reader *GCSReader) readRange(start int64, end int64) ([]byte, error) {
+	response, err := gcsRequest(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodGet, reader.object.apiURL()+"?alt=media&generation="+url.QueryEscape(reader.generation), nil)
+		if err == nil {
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+		}
+
+		return request, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.object, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusPartialContent && !(response.StatusCode == http.StatusOK && start == 0 && end == reader.size) {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.object, gcsError(response))
+	}
+
+	data := make([]byte, end-start)
+
+	_, err = io.ReadFull(response.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.object, err)
+	}
+
+	return data, nil
+}
+
+type GCSWriter struct {
+	object     gcsObject
+	sessionURL string // Where resumable uploads of the object are started
+	force      bool
+	session    string // The resumable upload's URI, it authorizes the upload on its own and is never logged
+	partBytes  int
+	offset     int64  // How much GCS has, buffer holds what follows
+	buffer     []byte // Not yet persisted by GCS
+	journal    *uploadJournal
+	resuming   []uploadSpan // Set while the output is checked against what an interrupted upload sent
+	resumeTo   int64        // What GCS says the interrupted upload persisted, at or past the journal's last span
+	reused     bool         // The output starts with the interrupted upload's header, written again
+	finished   bool
+	err        error
+}
+
+func newGCSWriter(objectURL string, options *Options) (*GCSWriter, error) {
+	if options == nil {
+		return nil, errors.New("options is nil")
+	}
+
+	object, err := parseGCSURL(objectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkGCSOffline(object, options); err != nil {
+		return nil, err
+	}
+
+	sessionURL := gcsEndpoint + "upload/storage/v1/b/" + url.PathEscape(object.bucket) + "/o?uploadType=resumable&name=" + url.QueryEscape(object.name)
+	if !options.ForceOperation {
+		sessionURL += "&ifGenerationMatch=0"
+	}
+
+	writer := &GCSWriter{
+		object:     object,
+		sessionURL: sessionURL,
+		force:      options.ForceOperation,
+		partBytes:  int(bytesFromMB(objectPartSizeMB(options))),
+	}
+
+	var found bool
+	writer.journal, found = openUploadJournal(object.String())
+	if found && writer.resume() {
+		return writer, nil
+	}
+
+	writer.journal.reset()
+
+	err = writer.startSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func (writer *GCSWriter) startSession() error {
+	response, err := gcsRequest(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodPost, writer.sessionURL, nil)
+		if err == nil {
+			request.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+		}
+
+		return request, err
+	})
+	if err != nil {
+		return fmt.Errorf("could not start uploading %s: %w", writer.object, err)
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	if response.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s: %w", writer.object, ErrTargetExists)
+	} else if response.StatusCode != http.StatusOK || response.Header.Get("Location") == "" {
+		return fmt.Errorf("could not start uploading %s: %w", writer.object, gcsError(response))
+	}
+
+	writer.session = response.Header.Get("Location")
+	writer.journal.Session, writer.journal.Forced = writer.session, writer.force
+
+	return nil
+}
+
+// Takes up the journaled session if GCS still has it, false to start a new one
+func (writer *GCSWriter) resume() bool {
+	spans := writer.journal.Spans
+	if writer.journal.Session == "" || len(spans) == 0 || (writer.journal.Forced && !writer.force) {
+		return false
+	}
+
+	writer.session = writer.journal.Session
+
+	response, err := writer.put(nil, false)
+	if err != nil {
+		return false
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	// Finished, expired (404 or 410), or failing - there is nothing to take up
+	if response.StatusCode != http.StatusPermanentRedirect {
+		return false
+	}
+
+	persisted, err := gcsPersistedBytes(response)
+	if err != nil || persisted < spans[len(spans)-1].End {
+		return false
+	}
+
+	writer.resuming, writer.resumeTo = spans, persisted
+
+	// The part that was being sent is checked as well, GCS may have seen more of it than it kept
+	if sending := writer.journal.Sending; sending != nil && sending.Start == spans[len(spans)-1].End {
+		writer.resuming = append(append([]uploadSpan{}, spans...), *sending)
+	}
+
+	return true
+}
+
+func (writer *GCSWriter) Write(p []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	if writer.finished {
+		return 0, errors.New("write to a finished upload")
+	}
+
+	writer.buffer = append(writer.buffer, p...)
+
+	if writer.resuming != nil {
+		writer.err = writer.checkResumed(false)
+		if writer.err != nil {
+			return 0, writer.err
+		} else if writer.resuming != nil {
+			return len(p), nil
+		}
+	}
+
+	for len(writer.buffer) >= writer.partBytes {
+		writer.err = writer.sendPart(false)
+		if writer.err != nil {
+			return 0, writer.err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Finishes the upload, the object appears once this succeeds
+func (writer *GCSWriter) Close() error {
+	if writer.err != nil || writer.finished {
+		return writer.err
+	}
+
+	if writer.resuming != nil {
+		writer.err = writer.checkResumed(true)
+		if writer.err != nil {
+			return writer.err
+		}
+	}
+
+	writer.err = writer.sendPart(true)
+	return writer.err
+}
+
+/*
+	Cancels an unfinished upload, nothing of it is left in the bucket - but
+	one that failed on its own (out of retries) is left to the journal,
+	for the next run to carry on with
+*/
+func (writer *GCSWriter) Abort() error {
+	if writer.finished {
+		return nil
+	}
+
+	writer.finished = true
+
+	if writer.err != nil && len(writer.journal.Spans) > 0 {
+		return nil
+	}
+
+	writer.journal.remove()
+	return writer.cancelSession()
+}
+
+func (writer *GCSWriter) cancelSession() error {
+	request, err := http.NewRequest(http.MethodDelete, writer.session, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := objectHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+/*
+	Checks the output against the spans the interrupted upload sent,
+	passing over the ones GCS persisted rather than sending them again.
+	Once all match, what GCS has past the journal's last span (a part that
+	landed as the process died) is passed over too, and the upload
+	carries on from there
+*/
+func (writer *GCSWriter) checkResumed(final bool) error {
+	for len(writer.resuming) > 0 {
+		span := writer.resuming[0]
+
+		length := int(span.End - span.Start)
+		if len(writer.buffer) < length {
+			if final {
+				return writer.resumeMismatch()
+			}
+
+			return nil
+		}
+
+		digest := sha256.Sum256(writer.buffer[:length])
+		if !bytes.Equal(digest[:], span.SHA256) {
+			return writer.resumeMismatch()
+		}
+
+		writer.resuming = writer.resuming[1:]
+
+		// Only the spans GCS persisted are passed over, the part being sent only checked
+		if span.End <= writer.resumeTo {
+			writer.buffer = writer.buffer[length:]
+			writer.offset = span.End
+		}
+	}
+
+	if writer.offset < writer.resumeTo {
+		length := int(writer.resumeTo - writer.offset)
+		if len(writer.buffer) < length {
+			if final {
+				return writer.resumeMismatch()
+			}
+
+			return nil
+		}
+
+		writer.journal.recordSpan(writer.offset, writer.resumeTo, writer.buffer[:length])
+		writer.buffer = writer.buffer[length:]
+		writer.offset = writer.resumeTo
+	}
+
+	writer.resuming = nil
+	return nil
+}
+
+/*
+	Output that is not what the interrupted upload sent, a new upload -
+	unless some of it was already passed over, or the header was written
+	again and the output must not be sent under it
+*/
+func (writer *GCSWriter) resumeMismatch() error {
+	writer.resuming = nil
+	_ = writer.cancelSession()
+	writer.journal.reset()
+
+	if writer.offset > 0 {
+		writer.journal.remove()
+		return fmt.Errorf("%s: the output is not what the interrupted upload sent, the upload was cancelled and the next run starts over", writer.object)
+	} else if writer.reused {
+		writer.journal.remove()
+		return fmt.Errorf("%s: %w", writer.object, errUploadDiffers)
+	}
+
+	return writer.startSession()
+}
+
+func (writer *GCSWriter) resumeHeader() ([]byte, []byte) {
+	if writer.resuming == nil || writer.offset > 0 || len(writer.buffer) > 0 {
+		return nil, nil
+	}
+
+	return writer.journal.Header, writer.journal.KeyCheck
+}
+
+func (writer *GCSWriter) recordHeader(header []byte, keyCheck []byte) {
+	previous, previousCheck := writer.resumeHeader()
+	writer.reused = previous != nil && bytes.Equal(previous, header) && bytes.Equal(previousCheck, keyCheck)
+	writer.journal.recordHeader(header, keyCheck)
+}
+
+/*
+	Sends the next part, or all that is left when final. After a failure
+	GCS is asked how much it has before anything is sent again, and when
+	it has taken only some of a part the rest goes in the next request -
+	GCS persists parts in multiples of 256KB, as parts are sent, so what
+	is left of one is still a whole number of them
+*/
+func (writer *GCSWriter) sendPart(final bool) error {
+	delay := objectRetryDelay
+	failures := 0
+
+	for !writer.finished && (final || len(writer.buffer) >= writer.partBytes) {
+		length := len(writer.buffer)
+		if !final {
+			length = writer.partBytes
+		}
+
+		if sending := writer.journal.Sending; sending == nil || sending.Start != writer.offset || sending.End != writer.offset+int64(length) {
+			writer.journal.recordSending(writer.offset, writer.buffer[:length])
+		}
+
+		response, err := writer.put(writer.buffer[:length], final)
+		if err == nil {
+			err = writer.persisted(response)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		var permanent *gcsPermanentError
+		if errors.As(err, &permanent) || failures == objectRetries {
+			return fmt.Errorf("could not upload %s: %w", writer.object, err)
+		}
+
+		failures++
+		time.Sleep(delay)
+		delay *= 2
+
+		// Whatever the failed request did, GCS knows how much of it arrived - if it cannot say, the next try fails as well
+		response, err = writer.put(nil, false)
+		if err == nil {
+			_ = writer.persisted(response)
+		}
+	}
+
+	return nil
+}
+
+// A failure that sending again will not fix
+type gcsPermanentError struct {
+	err error
+}
+
+func (e *gcsPermanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *gcsPermanentError) Unwrap() error {
+	return e.err
+}
+
+// Sends data as the bytes from offset on, no data without final asks how much GCS has
+func (writer *GCSWriter) put(data []byte, final bool) (*http.Response, error) {
+	token, err := gcpAccessToken()
+	if err != nil {
+		return nil, &gcsPermanentError{err}
+	}
+
+	request, err := http.NewRequest(http.MethodPut, writer.session, bytes.NewReader(data))
+	if err != nil {
+		return nil, &gcsPermanentError{err}
+	}
+
+	total := "*"
+	if final {
+		total = strconv.FormatInt(writer.offset+int64(len(data)), 10)
+	}
+
+	if len(data) == 0 {
+		request.Header.Set("Content-Range", "bytes */"+total)
+	} else {
+		request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", writer.offset, writer.offset+int64(len(data))-1, total))
+	}
+
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	return objectHTTPClient.Do(request)
+}
+
+// Moves the offset to what GCS says it has (308 Resume Incomplete), or finishes on 200 and 201
+func (writer *GCSWriter) persisted(response *http.Response) error {
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		writer.offset += int64(len(writer.buffer))
+		writer.buffer = nil
+		writer.finished = true
+		writer.journal.remove()
+
+		return nil
+	case http.StatusPermanentRedirect:
+		persisted, err := gcsPersistedBytes(response)
+		if err != nil {
+			return &gcsPermanentError{err}
+		}
+
+		if persisted < writer.offset || persisted > writer.offset+int64(len(writer.buffer)) {
+			return &gcsPermanentError{fmt.Errorf("GCS has %d bytes, we have sent %d to %d", persisted, writer.offset, writer.offset+int64(len(writer.buffer)))}
+		}
+
+		if persisted > writer.offset {
+			writer.journal.recordSpan(writer.offset, persisted, writer.buffer[:persisted-writer.offset])
+		}
+
+		writer.buffer = writer.buffer[persisted-writer.offset:]
+		writer.offset = persisted
+
+		return nil
+	case http.StatusPreconditionFailed:
+		return &gcsPermanentError{ErrTargetExists}
+	}
+
+	err := gcsError(response)
+	if !objectTransient(response.StatusCode) {
+		return &gcsPermanentError{err}
+	}
+
+	return err
+}
+
+// What a 308 says GCS has: bytes=0-<last byte persisted>, no Range when nothing has been
+func gcsPersistedBytes(response *http.Response) (int64, error) {
+	received := response.Header.Get("Range")
+	if received == "" {
+		return 0, nil
+	}
+
+	last, err := strconv.ParseInt(strings.TrimPrefix(received, "bytes=0-"), 10, 64)
+	if err != nil || !strings.HasPrefix(received, "bytes=0-") {
+		return 0, fmt.Errorf("GCS reported an unexpected range %q", received)
+	}
+
+	return last + 1, nil
+}
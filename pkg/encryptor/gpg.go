@@ -0,0 +1,79 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+/*
+	OpenPGP recipients are handled by the gpg binary (as gpgme would) rather
+	than a Go OpenPGP implementation - this way the user's existing keyring,
+	trust model, and modern key types all just work, and private keys never
+	leave gpg-agent, which takes care of passphrases and smartcards
+
+	The file key is encrypted to each recipient as its own OpenPGP message
+
+	Offline, gpg is kept from dirmngr, which would otherwise look up keys
+	missing from the keyring on keyservers and WKD
+*/
+
+var gpgBinary = "gpg"
+
+func wrapFileKeyOpenPGP(fileKey []byte, recipient string, offline bool) (RecipientStanza, error) {
+	if recipient == "" {
+		return RecipientStanza{}, fmt.Errorf("empty OpenPGP recipient")
+	}
+
+	message, err := runGPG(fileKey, gpgArgs(offline, "--encrypt", "--recipient", recipient)...)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not encrypt file key to OpenPGP recipient %q: %w", recipient, err)
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeOpenPGP,
+		Args: []string{recipient},
+		Body: base64.StdEncoding.EncodeToString(message),
+	}, nil
+}
+
+func unwrapFileKeyOpenPGP(stanza RecipientStanza, offline bool) ([]byte, error) {
+	message, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed OpenPGP stanza: %w", err)
+	}
+
+	return runGPG(message, gpgArgs(offline, "--decrypt")...)
+}
+
+func gpgArgs(offline bool, args ...string) []string {
+	if !offline {
+		return args
+	}
+
+	return append([]string{"--disable-dirmngr", "--auto-key-locate", "clear,local", "--no-auto-key-retrieve"}, args...)
+}
+
+func runGPG(input []byte, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(gpgBinary, append([]string{"--batch", "--quiet", "--yes", "--no-tty"}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		detail := strings.TrimSpace(stderr.String())
+		if detail != "" {
+			return nil, fmt.Errorf("%w: %s", err, detail)
+		}
+
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
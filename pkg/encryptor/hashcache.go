@@ -0,0 +1,169 @@
+package encryptor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+	Nightly sweeps of mostly static archives hash the same unchanged files
+	every night. A hash cache keeps each file's SHA256 with what identified
+	the file when it was hashed - its size, modification time, and inode -
+	keyed by its absolute path, so a sweep only hashes files that were
+	replaced, rewritten, or appended to since the last one. Files modified
+	within headerCacheSettleTime of being hashed are not cached, for the
+	reasons given in headercache.go
+
+	A cached hash says the file was not changed through the filesystem, it
+	cannot say the disk still holds what it did - bit rot leaves the size
+	and times alone. Sweeps that are there to find failing media should
+	bypass the cache now and then (e.g. monthly)
+
+	The cache is a JSON file, by default hashes.json in the encryptor
+	directory of the user cache directory, written to a temporary file and
+	renamed like the scrub state. Saving drops entries for files that no
+	longer exist
+*/
+
+const hashCacheVersion = 1
+
+type hashCacheEntry struct {
+	Size    int64
+	ModTime time.Time
+	Inode   uint64 `json:",omitempty"` // 0 where the platform has no inode to record
+	Hash    string
+}
+
+type HashCache struct {
+	mutex    sync.Mutex
+	fileName string
+	entries  map[string]hashCacheEntry
+	changed  bool
+}
+
+type hashCacheFile struct {
+	Version int
+	Files   map[string]hashCacheEntry
+}
+
+// Where the cache is kept when no filename is given, empty if there is no user cache directory
+func defaultHashCacheFilename() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(cacheDir, "encryptor", "hashes.json")
+}
+
+func openHashCache(fileName string) (*HashCache, error) {
+	if fileName == "" {
+		fileName = defaultHashCacheFilename()
+		if fileName == "" {
+			return nil, errors.New("there is no user cache directory to keep a hash cache in, give its filename")
+		}
+	}
+
+	cache := &HashCache{fileName: fileName, entries: map[string]hashCacheEntry{}}
+
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read hash cache: %w", err)
+	}
+
+	var contents hashCacheFile
+
+	// A cache that cannot be read (or is from a later version) is started again rather than failing the sweep
+	if json.Unmarshal(data, &contents) == nil && contents.Version == hashCacheVersion && contents.Files != nil {
+		cache.entries = contents.Files
+	}
+
+	return cache, nil
+}
+
+func hashCacheKey(fileName string) string {
+	return headerCacheKey(fileName)
+}
+
+// The file's hash from the cache if it is unchanged, or hashed (and cached) if not - a nil cache always hashes
+func (cache *HashCache) hashFile(fileName string) (string, error) {
+	if cache == nil {
+		return hashFile(fileName)
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	key := hashCacheKey(fileName)
+	identity := hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Inode: fileInode(info)}
+
+	cache.mutex.Lock()
+	entry, ok := cache.entries[key]
+	cache.mutex.Unlock()
+
+	if ok && entry.Size == identity.Size && entry.ModTime.Equal(identity.ModTime) && entry.Inode == identity.Inode {
+		return entry.Hash, nil
+	}
+
+	identity.Hash, err = hashFile(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if time.Since(identity.ModTime) >= headerCacheSettleTime {
+		cache.entries[key] = identity
+		cache.changed = true
+	} else if ok {
+		delete(cache.entries, key)
+		cache.changed = true
+	}
+
+	return identity.Hash, nil
+}
+
+func (cache *HashCache) save() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for key := range cache.entries {
+		if _, err := os.Stat(key); os.IsNotExist(err) {
+			delete(cache.entries, key)
+			cache.changed = true
+		}
+	}
+
+	if !cache.changed {
+		return nil
+	}
+
+	data, err := json.Marshal(hashCacheFile{Version: hashCacheVersion, Files: cache.entries})
+	if err != nil {
+		return fmt.Errorf("could not serialize hash cache: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(cache.fileName), 0700)
+	if err != nil {
+		return fmt.Errorf("could not create hash cache directory: %w", err)
+	}
+
+	err = writeFileAtomic(cache.fileName, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write hash cache: %w", err)
+	}
+
+	cache.changed = false
+
+	return nil
+}
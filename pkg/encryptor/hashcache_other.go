@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package encryptor
+
+import (
+	"os"
+)
+
+// Windows keeps its file index out of os.FileInfo, cached hashes are checked by size and modification time alone
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,116 @@
+package encryptor
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+	Inspecting, previewing, listing recipients, and decrypting all start
+	by reading the same header, and a caller going back to one file again
+	and again (a range of previews, a file manager listing an archive)
+	would otherwise read and parse it every time. Parsed headers are
+	cached for the life of the process, keyed by the file's path and
+	checked against its identity, size, and modification time - a file
+	that was replaced, rewritten, or appended to is read again
+
+	Modification times are only as fine as the filesystem keeps them, so
+	a file changed twice within one tick without changing size would look
+	unchanged. Files modified within headerCacheSettleTime of being read
+	are not cached, the same way make and git treat racily recent files,
+	so a change made after caching always moves the time. A file changed
+	in place with its old size and modification time put back by hand is
+	the one change this cannot see
+
+	There is no chunk index to cache alongside - chunk offsets follow from
+	the header and the file's size (see chunkCount)
+*/
+
+// Reaching this clears the cache, long running processes should not collect headers forever
+const headerCacheLimit = 256
+
+const headerCacheSettleTime = 2 * time.Second
+
+type headerCacheEntry struct {
+	info        os.FileInfo
+	header      EncryptedFileHeader
+	endOfHeader int
+}
+
+var headerCache = struct {
+	mutex   sync.Mutex
+	entries map[string]*headerCacheEntry
+}{entries: map[string]*headerCacheEntry{}}
+
+func headerCacheKey(fileName string) string {
+	if absolute, err := filepath.Abs(fileName); err == nil {
+		return absolute
+	}
+
+	return fileName
+}
+
+// A copy of the cached header, if the file is still the one it was read from
+func cachedEncryptedFileHeader(fileName string, info os.FileInfo) (EncryptedFileHeader, int, bool) {
+	cacheKey := headerCacheKey(fileName)
+
+	headerCache.mutex.Lock()
+	defer headerCache.mutex.Unlock()
+
+	entry, ok := headerCache.entries[cacheKey]
+	if !ok {
+		return EncryptedFileHeader{}, 0, false
+	}
+
+	if !os.SameFile(entry.info, info) || entry.info.Size() != info.Size() || !entry.info.ModTime().Equal(info.ModTime()) {
+		delete(headerCache.entries, cacheKey)
+		return EncryptedFileHeader{}, 0, false
+	}
+
+	return entry.header.clone(), entry.endOfHeader, true
+}
+
+func cacheEncryptedFileHeader(fileName string, info os.FileInfo, header *EncryptedFileHeader, endOfHeader int) {
+	if time.Since(info.ModTime()) < headerCacheSettleTime {
+		return
+	}
+
+	headerCache.mutex.Lock()
+	defer headerCache.mutex.Unlock()
+
+	if len(headerCache.entries) >= headerCacheLimit {
+		headerCache.entries = map[string]*headerCacheEntry{}
+	}
+
+	headerCache.entries[headerCacheKey(fileName)] = &headerCacheEntry{info: info, header: header.clone(), endOfHeader: endOfHeader}
+}
+
+// Files written by this package are forgotten as they are created, without waiting for a stat to notice
+func forgetCachedEncryptedFileHeader(fileName string) {
+	headerCache.mutex.Lock()
+	delete(headerCache.entries, headerCacheKey(fileName))
+	headerCache.mutex.Unlock()
+}
+
+// Callers change the headers they are given, the cached one is never handed out to be changed
+func (header *EncryptedFileHeader) clone() EncryptedFileHeader {
+	copied := *header
+
+	copied.Recipients = nil
+	for _, stanza := range header.Recipients {
+		stanza.Args = append([]string(nil), stanza.Args...)
+		copied.Recipients = append(copied.Recipients, stanza)
+	}
+
+	copied.Salt = append([]byte(nil), header.Salt...)
+	copied.FileID = append([]byte(nil), header.FileID...)
+	copied.PlaintextHash = append([]byte(nil), header.PlaintextHash...)
+	copied.KeyCheck = append([]byte(nil), header.KeyCheck...)
+	copied.SealedName = append([]byte(nil), header.SealedName...)
+	copied.Dictionary = append([]byte(nil), header.Dictionary...)
+	copied.digest = append([]byte(nil), header.digest...)
+
+	return copied
+}
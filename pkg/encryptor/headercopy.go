@@ -0,0 +1,206 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+	Since format 1.12 a file may end with a copy of its header, so a bad
+	first sector no longer makes the whole archive unreadable. After the
+	footer come the header's bytes exactly as written (length indicator
+	included, so the copy has the same digest and every chunk's AAD still
+	matches it) and a trailer of fixed size that locates them
+
+		header copy | header digest (32 bytes) | chunk count (uint32) | copy length (uint32) | magic (8 bytes)
+
+	big endian like the chunk AAD. The chunk count is the file's chunk
+	index - every chunk is the same size, so where the header ends and how
+	many chunks follow it locates each one - and is the only record of it
+	a streamed file has. The digest tells which of the two is intact
+	without the key: reading a file falls back to the copy when the header
+	cannot be read or no longer matches it, and scrub reports files whose
+	header and copy have diverged. Neither the digest nor the count is
+	authenticated on its own, a copy that was tampered with fails chunk
+	AAD just like a tampered header
+
+	Streams read front to back and never see the copy, only the footer
+	that precedes it - falling back needs a file to seek in
+*/
+
+const HeaderCopyTrailer = "TRAILER"
+
+const headerCopyMagic = "ENCHDRCP"
+
+// The digest, chunk count, copy length, and magic that follow the copy
+const headerCopyTrailerBytes = sha256.Size + 4 + 4 + len(headerCopyMagic)
+
+type headerCopyTrailer struct {
+	digest    []byte
+	numChunks uint32
+	length    uint32
+}
+
+// The copy and its trailer, written after the footer
+func headerCopyBytes(header *EncryptedFileHeader, numChunks uint32) ([]byte, error) {
+	headerBytes, err := getCompleteEncryptedFileHeaderAsBytes(header)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(headerBytes)
+
+	trailer := make([]byte, headerCopyTrailerBytes)
+	copy(trailer, digest[:])
+	binary.BigEndian.PutUint32(trailer[sha256.Size:], numChunks)
+	binary.BigEndian.PutUint32(trailer[sha256.Size+4:], uint32(len(headerBytes)))
+	copy(trailer[sha256.Size+8:], headerCopyMagic)
+
+	return append(headerBytes, trailer...), nil
+}
+
+// The bytes a header's copy takes at the end of the file, after the footer
+func headerCopySizeBytes(header *EncryptedFileHeader, endOfHeader int) int64 {
+	if header.HeaderCopy == "" {
+		return 0
+	}
+
+	return int64(endOfHeader) + int64(headerCopyTrailerBytes)
+}
+
+func readHeaderCopyTrailer(file *os.File, sizeBytes int64) (headerCopyTrailer, error) {
+	if sizeBytes < int64(headerCopyTrailerBytes)+3 {
+		return headerCopyTrailer{}, errors.New("the file is too small to end with a copy of its header")
+	}
+
+	data := make([]byte, headerCopyTrailerBytes)
+
+	_, err := file.ReadAt(data, sizeBytes-int64(len(data)))
+	if err != nil {
+		return headerCopyTrailer{}, fmt.Errorf("could not read the copy of the header: %w", err)
+	}
+
+	if string(data[sha256.Size+8:]) != headerCopyMagic {
+		return headerCopyTrailer{}, errors.New("the file does not end with a copy of its header")
+	}
+
+	trailer := headerCopyTrailer{
+		digest:    data[:sha256.Size],
+		numChunks: binary.BigEndian.Uint32(data[sha256.Size:]),
+		length:    binary.BigEndian.Uint32(data[sha256.Size+4:]),
+	}
+
+	if trailer.length < 2 || int64(trailer.length)+int64(headerCopyTrailerBytes) > sizeBytes {
+		return headerCopyTrailer{}, errors.New("the copy of the header has an invalid length")
+	}
+
+	return trailer, nil
+}
+
+// The raw bytes of the header at the front of the file and of its copy, as long as the trailer says
+func readHeaderAndCopy(file *os.File, sizeBytes int64, trailer headerCopyTrailer) ([]byte, []byte, error) {
+	primary := make([]byte, trailer.length)
+	copied := make([]byte, trailer.length)
+
+	_, err := file.ReadAt(primary, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the header: %w", err)
+	}
+
+	_, err = file.ReadAt(copied, sizeBytes-int64(headerCopyTrailerBytes)-int64(trailer.length))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the copy of the header: %w", err)
+	}
+
+	return primary, copied, nil
+}
+
+/*
+	Called when the header at the front of a file could not be read, or
+	says it has a copy. The header read is kept when it matches the
+	trailer's digest (or there is no usable copy), otherwise the copy is
+	read in its place and readErr no longer matters
+*/
+func preferIntactHeader(file *os.File, sizeBytes int64, header EncryptedFileHeader, endOfHeader int, readErr error) (EncryptedFileHeader, int, error) {
+	if readErr == nil && header.HeaderCopy == "" {
+		return header, endOfHeader, nil
+	}
+
+	trailer, err := readHeaderCopyTrailer(file, sizeBytes)
+	if err != nil {
+		return header, endOfHeader, readErr
+	}
+
+	if readErr == nil && bytes.Equal(header.digest, trailer.digest) {
+		return header, endOfHeader, nil
+	}
+
+	_, copied, err := readHeaderAndCopy(file, sizeBytes, trailer)
+	if err != nil {
+		return header, endOfHeader, readErr
+	}
+
+	digest := sha256.Sum256(copied)
+	if !bytes.Equal(digest[:], trailer.digest) {
+		return header, endOfHeader, readErr
+	}
+
+	copiedHeader, copiedEndOfHeader, err := readEncryptedFileHeader(bytes.NewReader(copied))
+	if err != nil || copiedHeader.HeaderCopy == "" {
+		return header, endOfHeader, readErr
+	}
+
+	copiedHeader.fromCopy = true
+
+	return copiedHeader, copiedEndOfHeader, nil
+}
+
+/*
+	Scrub's check, without the key: the header and its copy must both be
+	intact (matching the trailer's digest, and so each other) and agree
+	with the trailer on the chunk count. A file read from its copy still
+	decrypts, but has lost its redundancy and is reported until replaced
+*/
+func verifyHeaderCopy(fileName string, sizeBytes int64, numChunks uint32) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	trailer, err := readHeaderCopyTrailer(file, sizeBytes)
+	if err != nil {
+		return fmt.Errorf("the copy of the header at the end of the file is damaged: %w", err)
+	}
+
+	primary, copied, err := readHeaderAndCopy(file, sizeBytes, trailer)
+	if err != nil {
+		return err
+	}
+
+	primaryDigest := sha256.Sum256(primary)
+	copiedDigest := sha256.Sum256(copied)
+	primaryIntact := bytes.Equal(primaryDigest[:], trailer.digest)
+	copyIntact := bytes.Equal(copiedDigest[:], trailer.digest)
+
+	if !primaryIntact && copyIntact {
+		return errors.New("the header is damaged, the file is only readable from the copy at its end")
+	} else if primaryIntact && !copyIntact {
+		return errors.New("the copy of the header at the end of the file is damaged")
+	} else if !primaryIntact {
+		return errors.New("the header and its copy at the end of the file have diverged")
+	}
+
+	if trailer.numChunks != numChunks {
+		return fmt.Errorf("the copy of the header at the end of the file records %d chunks, the file has %d", trailer.numChunks, numChunks)
+	}
+
+	return nil
+}
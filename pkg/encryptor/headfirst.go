@@ -0,0 +1,38 @@
+package encryptor
+
+/*
+	Options.HeadFirst is for a consumer that starts on the plaintext as
+	soon as it appears - a video player, or a restore reading a database
+	dump from a pipe - rather than waiting for the whole file. Left to
+	themselves the read workers run as far ahead of the writer as memory
+	allows, so the chunk the consumer is waiting on competes for the
+	disks and cores with chunks it will not want for minutes
+
+	Head first, chunks are admitted to the pipeline strictly in order and
+	only headFirstWindow of them ahead of the writer (a memory bound's
+	budget does the same when there is one), executors take one chunk at
+	a time rather than batches, and the writer hands each chunk on as
+	soon as it is written rather than when its buffer fills. The rest of
+	the file keeps decrypting behind the head at the pipeline's full rate
+
+	Every chunk is authenticated before it is written, but the footer and
+	the plaintext's SHA256 can only be checked once the last chunk has
+	been - a consumer has read everything but that check by then, and the
+	job still fails if it does not pass
+*/
+
+// Chunks in flight per worker, one being worked on and the next ready for it
+const headFirstChunksPerWorker uint = 2
+
+func headFirstWindow(job *pipelineJob) uint {
+	workers := job.NumReaders + job.NumExecutors
+	if job.PoolWorkers > 0 {
+		workers = job.PoolWorkers
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	return workers * headFirstChunksPerWorker
+}
@@ -0,0 +1,199 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+	Sources read straight from an http:// or https:// URL, so a file can
+	be decrypted or verified where an artifact server publishes it rather
+	than downloaded first. They are streamed as objects.go describes,
+	Options.Readers ranged GETs in flight at once, and every range is
+	asked for with If-Range (the ETag, or failing that Last-Modified), so
+	a file replaced part way through fails the job rather than splicing
+	two files together
+
+	The first request is a GET of a single byte, which says how big the
+	file is and whether the server serves ranges at all - a server that
+	does not answers with the whole file, which is then read front to
+	back as it arrives. URLs are used as given, so presigned URLs and
+	user:password@ (basic auth) work, but errors only ever show the
+	scheme, host, and path
+
+	There is no one way to upload to an HTTP server, so URLs are sources
+	only. Azure blob URLs are https:// URLs too, those are read as blobs
+	(see azureblob.go)
+*/
+
+type HTTPReader struct {
+	rangedReader
+	location  string // As given, credentials and all
+	name      string // As shown, see httpDisplayName
+	validator string // For If-Range, empty when the server gave none
+	body      io.Reader
+}
+
+func isHTTPURL(name string) bool {
+	lower := strings.ToLower(strings.TrimSpace(name))
+	return (strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://")) && !isAzureBlobURL(name)
+}
+
+// Without credentials or the query, where presigned URLs keep their signature
+func httpDisplayName(location string) string {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return "the source URL"
+	}
+
+	return parsed.Scheme + "://" + parsed.Host + parsed.EscapedPath()
+}
+
+// Errors from the client quote the URL whole, the error beneath says what went wrong
+func httpClientError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+
+	return err
+}
+
+func newHTTPReader(location string, options *Options) (*HTTPReader, error) {
+	if options == nil {
+		return nil, errors.New("options is nil")
+	}
+
+	location = strings.TrimSpace(location)
+	name := httpDisplayName(location)
+
+	if options.Offline {
+		return nil, fmt.Errorf("%s is reached over the network: %w", name, ErrOffline)
+	}
+
+	response, err := objectRequest(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodGet, location, nil)
+		if err == nil {
+			request.Header.Set("Range", "bytes=0-0")
+		}
+
+		return request, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", name, httpClientError(err))
+	}
+
+	reader := &HTTPReader{location: location, name: name}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		// No ranges, what was sent is the whole file
+		reader.body = response.Body
+		reader.size = response.ContentLength
+		return reader, nil
+	case http.StatusPartialContent:
+		_ = response.Body.Close()
+
+		_, _, size, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", name, err)
+		}
+
+		// Weak ETags cannot be used with If-Range
+		reader.validator = response.Header.Get("ETag")
+		if reader.validator == "" || strings.HasPrefix(reader.validator, "W/") {
+			reader.validator = response.Header.Get("Last-Modified")
+		}
+
+		reader.rangedReader = newRangedReader(size, options, reader.readRange)
+		return reader, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Not even one byte, the file is empty
+		_ = response.Body.Close()
+		reader.rangedReader = newRangedReader(0, options, reader.readRange)
+		return reader, nil
+	}
+
+	_ = response.Body.Close()
+	return nil, fmt.Errorf("could not read %s: %s", name, response.Status)
+}
+
+func (reader *HTTPReader) Read(p []byte) (int, error) {
+	if reader.body != nil {
+		return reader.body.Read(p)
+	}
+
+	return reader.rangedReader.Read(p)
+}
+
+// Bytes [start, end) of the file that was opened
+func (reader *HTTPReader) readRange(start int64, end int64) ([]byte, error) {
+	response, err := objectRequest(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodGet, reader.location, nil)
+		if err == nil {
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+			if reader.validator != "" {
+				request.Header.Set("If-Range", reader.validator)
+			}
+		}
+
+		return request, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.name, httpClientError(err))
+	}
+
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+
+	// If-Range answers with the whole file once it is not the file that was opened
+	if response.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("%s changed while it was being read", reader.name)
+	}
+
+	if response.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %s", start, end, reader.name, response.Status)
+	}
+
+	first, last, size, err := parseContentRange(response.Header.Get("Content-Range"))
+	if err != nil || first != start || last != end-1 || size != reader.size {
+		return nil, fmt.Errorf("%s changed while it was being read, or the server sent other bytes than were asked for", reader.name)
+	}
+
+	data := make([]byte, end-start)
+
+	_, err = io.ReadFull(response.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bytes %d-%d of %s: %w", start, end, reader.name, err)
+	}
+
+	return data, nil
+}
+
+// bytes <first>-<last>/<size>, a size of * (unknown) is no use to a reader that needs one
+func parseContentRange(contentRange string) (int64, int64, int64, error) {
+	invalid := fmt.Errorf("the server answered with a Content-Range of %q, not bytes <first>-<last>/<size>", contentRange)
+
+	span := strings.TrimPrefix(strings.TrimSpace(contentRange), "bytes ")
+	slash := strings.Index(span, "/")
+	dash := strings.Index(span, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, invalid
+	}
+
+	first, firstErr := strconv.ParseInt(span[:dash], 10, 64)
+	last, lastErr := strconv.ParseInt(span[dash+1:slash], 10, 64)
+	size, sizeErr := strconv.ParseInt(span[slash+1:], 10, 64)
+	if firstErr != nil || lastErr != nil || sizeErr != nil || first < 0 || last < first || size <= last {
+		return 0, 0, 0, invalid
+	}
+
+	return first, last, size, nil
+}
@@ -0,0 +1,164 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	Everything the header of an encrypted file says about it, and the
+	sizes that follow from it, without the key. Until now the only way to
+	learn how a file was encrypted was to try decrypting it - inspecting
+	reads the header and the file's size and nothing else, so it is as
+	cheap on a 1TB archive as on a 1KB one, and says nothing about whether
+	the chunks are intact (Verify and scrub do)
+*/
+
+type FileInspection struct {
+	FileName        string
+	FormatVersion   string
+	Supported       bool   // This build can decrypt the format version
+	Cipher          string `json:",omitempty"` // Empty for ciphers this build does not know
+	Algorithm       string
+	Mode            string
+	KeySizeBits     int
+	KeySource       string   // One of the KeySource constants, files encrypted with a key do not say so
+	KDF             string   `json:",omitempty"`
+	KDFIterations   int      `json:",omitempty"`
+	Recipients      []string `json:",omitempty"` // Type and arguments of each stanza, never the wrapped key
+	NumChunks       uint32
+	ChunkSizeBytes  int64
+	ChunkChecksum   string `json:",omitempty"`
+	Streamed        bool
+	ChunkAAD        string `json:",omitempty"`
+	NonceScheme     string `json:",omitempty"` // Empty for nonces that are random throughout
+	Footer          string `json:",omitempty"`
+	PlaintextHash   bool   // The header carries the sealed SHA256 of the plaintext
+	KeyCheck        bool   // A wrong key is told apart from a corrupt file
+	HeaderCopy      string `json:",omitempty"`
+	HeaderFromCopy  bool   // The header is damaged, what is described was read from its copy
+	Signature       string `json:",omitempty"`
+	SignerKey       string `json:",omitempty"` // Who the file says signed it, only checked when decrypting
+	Content         string `json:",omitempty"` // ContentTar for a directory archive, empty for anything else
+	Compression     string `json:",omitempty"` // The codec the plaintext was compressed with, PlaintextBytes is then its compressed size
+	Dictionary      bool   // The plaintext was compressed with a dictionary sealed in the header, see dictionary.go
+	Name            string `json:",omitempty"` // The source's name, when it is stored in the clear
+	NameSealed      bool   // The source's name is stored, sealed with the file's key
+	FileSizeBytes   int64
+	HeaderBytes     int64
+	PayloadBytes    int64 // The chunks, between the header and the footer
+	FooterBytes     int64
+	SignatureBytes  int64
+	HeaderCopyBytes int64 // The copy of the header and its trailer, after the footer
+	PlaintextBytes  int64 // The payload without each chunk's nonce, tag, and checksum
+
+	PlaintextRecorded bool // The header records PlaintextBytes (format 1.16), rather than it following from the chunks
+}
+
+const (
+	KeySourceRecipients    = "recipients"
+	KeySourcePassword      = "password"
+	KeySourceKeyOrPassword = "key or password"
+)
+
+func inspect(fileName string) (FileInspection, error) {
+	stats, err := getStatsFromFile(fileName)
+	if err != nil {
+		return FileInspection{}, err
+	}
+
+	header, endOfHeader, err := getEncryptedFileHeaderFromFile(fileName)
+	if err != nil {
+		return FileInspection{}, fmt.Errorf("failed to retrieve encryption header from file: %w", err)
+	}
+
+	inspection := FileInspection{
+		FileName:        fileName,
+		FormatVersion:   header.FormatVersion,
+		Supported:       isSupportedFormatVersion(header.FormatVersion),
+		Algorithm:       header.Algorithm,
+		Mode:            header.Mode,
+		KeySizeBits:     header.KeySize,
+		KeySource:       keySource(&header),
+		KDF:             header.KDF,
+		KDFIterations:   header.KDFIterations,
+		ChunkSizeBytes:  header.ChunkSizeBytes,
+		ChunkChecksum:   header.ChunkChecksum,
+		Streamed:        header.Streamed,
+		ChunkAAD:        header.ChunkAAD,
+		NonceScheme:     header.NonceScheme,
+		Footer:          header.Footer,
+		PlaintextHash:   len(header.PlaintextHash) > 0,
+		KeyCheck:        len(header.KeyCheck) > 0,
+		HeaderCopy:      header.HeaderCopy,
+		HeaderFromCopy:  header.fromCopy,
+		Signature:       header.Signature,
+		SignerKey:       header.SignerKey,
+		Content:         header.Content,
+		Compression:     header.Compression,
+		Dictionary:      len(header.Dictionary) > 0,
+		Name:            header.Name,
+		NameSealed:      len(header.SealedName) > 0,
+		FileSizeBytes:   stats.Size(),
+		HeaderBytes:     int64(endOfHeader),
+		FooterBytes:     footerSizeBytes(&header),
+		SignatureBytes:  signatureSizeBytes(&header),
+		HeaderCopyBytes: headerCopySizeBytes(&header, endOfHeader),
+	}
+
+	if suite, err := cipherSuiteForHeader(&header); err == nil {
+		inspection.Cipher = suite.Name
+	}
+
+	// Password files before the KDF was recorded were all derived the original way
+	if inspection.KeySource == KeySourcePassword && inspection.KDF == "" {
+		inspection.KDF = KDFPBKDF2SHA256
+		inspection.KDFIterations = legacyKDFIterations
+	}
+
+	for _, stanza := range header.Recipients {
+		inspection.Recipients = append(inspection.Recipients, strings.Join(append([]string{stanza.Type}, stanza.Args...), " "))
+	}
+
+	inspection.PayloadBytes = inspection.FileSizeBytes - inspection.HeaderBytes - inspection.FooterBytes - inspection.SignatureBytes - inspection.HeaderCopyBytes
+	if inspection.PayloadBytes < 0 {
+		return inspection, errors.New("file is truncated, its footer is missing")
+	}
+
+	inspection.NumChunks, err = chunkCount(&header, inspection.PayloadBytes)
+	if err != nil {
+		return inspection, err
+	}
+
+	// Every chunk but the last is whole, and the last holds at least its overhead
+	overheadBytes := chunkOverheadBytes(&header)
+	encryptedChunkSizeBytes := header.ChunkSizeBytes + overheadBytes
+	numChunks := int64(inspection.NumChunks)
+
+	if numChunks > 0 && inspection.PayloadBytes < (numChunks-1)*encryptedChunkSizeBytes+overheadBytes {
+		return inspection, fmt.Errorf("file is truncated, it is too short for its %d chunks", inspection.NumChunks)
+	}
+
+	if inspection.PayloadBytes > numChunks*encryptedChunkSizeBytes {
+		return inspection, fmt.Errorf("file is too long for its %d chunks", inspection.NumChunks)
+	}
+
+	inspection.PlaintextBytes, err = plaintextSizeBytes(&header, inspection.PayloadBytes, inspection.NumChunks)
+	inspection.PlaintextRecorded = header.PlaintextSize > 0
+
+	return inspection, err
+}
+
+// Headers only say how the key was found when it was not a plain key
+func keySource(header *EncryptedFileHeader) string {
+	if len(header.Recipients) > 0 {
+		return KeySourceRecipients
+	}
+
+	if len(header.Salt) > 0 || header.KDF != "" {
+		return KeySourcePassword
+	}
+
+	return KeySourceKeyOrPassword
+}
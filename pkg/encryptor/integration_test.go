@@ -0,0 +1,8406 @@
+package encryptor
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ssh"
+	"html"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type FilesTest struct {
+	TestName      string
+	FileName      string
+	ChunkSizeMB   uint
+	Readers       uint8
+	Executors     uint8
+	Writers       uint8
+	KeyHex        string
+	Password      string
+	Data          string
+	expectSuccess bool
+}
+
+// [5]int{10, 20, 30, 40, 50}
+var hashFiles = []FilesTest{
+	{"Known hash", "hashtarget.txt", 8, 6, 12, 1, "", "some_password_here", "c55395f0f5b1d610b01b145d6d39c68c8aee22160c63afdecd4e3c1cadc36674", true},
+	{"Different hashes/blank hash", "hashtarget.txt", 8, 6, 12, 1, "", "some_password_here", "", false},
+}
+
+var e2eFiles = []FilesTest{
+	// Default concurrency
+	{"Tiny File", "tiny.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
+	{"Small File", "small.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
+	{"Medium File", "medium.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
+	{"Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 6, 12, 1, "", "some_password_here", "", true},
+	{"Zero Byte File", "zero.txt", 8, 6, 12, 1, "", "some_password_here", "", false},
+	// Default concurrency using key instead of password - TBD: Pass invalid keys
+	{"Tiny File", "tiny.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
+	{"Small File", "small.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
+	{"Medium File", "medium.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
+	{"Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", true},
+	{"Zero Byte File", "zero.txt", 8, 6, 12, 1, "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6", "", "", false},
+	// Restricted concurrency
+	{"Restricted Concurrency - Tiny File", "tiny.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Small File", "small.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Medium File", "medium.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Zero Byte File", "zero.txt", 8, 1, 1, 1, "", "some_password_here", "", false},
+	// Expanded concurrency
+	{"Expanded Concurrency - Tiny File", "tiny.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Small File", "small.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Medium File", "medium.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Perfect Chunk Size Multiple File", "chunkmultiple.txt", 8, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Zero Byte File", "zero.txt", 8, 32, 64, 4, "", "some_password_here", "", false},
+	// All concurrencies with small chunk sizes
+	{"Tiny File - Small Chunk", "tiny.txt", 1, 6, 12, 1, "", "some_password_here", "", true},
+	{"Small File - Small Chunk", "small.txt", 1, 6, 12, 1, "", "some_password_here", "", true},
+	{"Medium File - Small Chunk", "medium.txt", 1, 6, 12, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Tiny File - Small Chunk", "tiny.txt", 1, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Small File - Small Chunk", "small.txt", 1, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Medium File - Small Chunk", "medium.txt", 1, 1, 1, 1, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Tiny File - Small Chunk", "tiny.txt", 1, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Small File - Small Chunk", "small.txt", 1, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Medium File - Small Chunk", "medium.txt", 1, 32, 64, 4, "", "some_password_here", "", true},
+	// All concurrencies with large chunk sizes
+	{"Tiny File - Large Chunk", "tiny.txt", 32, 6, 12, 1, "", "some_password_here", "", true},
+	{"Small File - Large Chunk", "small.txt", 32, 6, 12, 1, "", "some_password_here", "", true},
+	{"Medium File - Large Chunk", "medium.txt", 32, 6, 12, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Tiny File - Large Chunk", "tiny.txt", 32, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Small File - Large Chunk", "small.txt", 32, 1, 1, 1, "", "some_password_here", "", true},
+	{"Restricted Concurrency - Medium File - Large Chunk", "medium.txt", 32, 1, 1, 1, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Tiny File - Large Chunk", "tiny.txt", 32, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Small File - Large Chunk", "small.txt", 32, 32, 64, 4, "", "some_password_here", "", true},
+	{"Expanded Concurrency - Medium File - Large Chunk", "medium.txt", 32, 32, 64, 4, "", "some_password_here", "", true},
+}
+
+// Pipeline Integration tests
+func Test_EndToEnd_Files(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	encrypted := filesDir + string(os.PathSeparator) + "temp.enc"
+	decrypted := filesDir + string(os.PathSeparator) + "temp.dec"
+
+	// Cleanup at end of test, use force option during test to overwrite
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(encrypted)
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(decrypted)
+
+	// Let's test a series of files that differ in size and their chunk boundary qualities
+	for _, testTable := range e2eFiles {
+
+		t.Run(testTable.TestName, func(t *testing.T) {
+
+			// We will encrypt, decrypt, and hash the source and the decrypted
+			original := filesDir + string(os.PathSeparator) + testTable.FileName
+
+			// Encrypt the file
+			encryptOptions := Options{
+				KeyHex:         testTable.KeyHex,
+				ChunkSizeMB:    testTable.ChunkSizeMB,
+				Readers:        testTable.Readers,
+				Executors:      testTable.Executors,
+				Writers:        testTable.Writers,
+				Password:       testTable.Password,
+				ForceOperation: true,
+			}
+
+			// Decrypt the encrypted file - Note that chunksize will be ignored by pipeline
+			decryptOptions := encryptOptions
+
+			err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+			if err != nil && testTable.expectSuccess {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func Test_EndToEnd_Batching(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filesDir + string(os.PathSeparator) + "temp_batch.enc"
+	decrypted := filesDir + string(os.PathSeparator) + "temp_batch.dec"
+
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(encrypted)
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(decrypted)
+
+	// 0 is the automatic batch size, the rest exercise partial and oversized batches
+	for _, batchChunks := range []uint{0, 1, 2, 4, 64} {
+		encryptOptions := Options{
+			KeyHex:         testKeyHex,
+			ChunkSizeMB:    1,
+			Readers:        2,
+			Executors:      3,
+			Writers:        1,
+			BatchChunks:    batchChunks,
+			ForceOperation: true,
+		}
+
+		decryptOptions := encryptOptions
+
+		err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+		if err != nil {
+			t.Error("batch size ", batchChunks, ": ", err)
+		}
+	}
+}
+
+func Test_EndToEnd_Ciphers(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+
+	for _, suite := range cipherSuites {
+		t.Run(suite.Name, func(t *testing.T) {
+			encrypted := filepath.Join(t.TempDir(), "cipher.enc")
+			decrypted := filepath.Join(t.TempDir(), "cipher.dec")
+
+			encryptOptions := Options{
+				KeyHex:        testKeyHex,
+				Cipher:        suite.Name,
+				ChunkSizeMB:   1,
+				ChunkChecksum: true,
+			}
+
+			// The header, not the options, decides the cipher when decrypting
+			decryptOptions := Options{KeyHex: encryptOptions.KeyHex}
+
+			err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header, err := ReadHeader(encrypted)
+			if err != nil || header.Algorithm != suite.Algorithm || header.Mode != suite.ModeName {
+				t.Error("unexpected header for ", suite.Name, ": ", header, err)
+			}
+
+			// Streams use the same chunk layout
+			var stream bytes.Buffer
+
+			writer, err := NewEncryptWriter(&stream, &encryptOptions)
+			if err == nil {
+				_, err = writer.Write([]byte("streamed"))
+			}
+			if err == nil {
+				err = writer.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := NewDecryptReader(&stream, &decryptOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plaintext, err := io.ReadAll(reader)
+			if err != nil || string(plaintext) != "streamed" {
+				t.Error("stream did not round trip with ", suite.Name, ": ", err)
+			}
+		})
+	}
+
+	if err := Encrypt(original, "unused", &Options{KeyHex: "00", Cipher: "ROT13"}); err == nil {
+		t.Error("expected an error for an unsupported cipher")
+	}
+}
+
+// Known answers from RFC 8452 appendices A and C.2
+func Test_AESGCMSIV(t *testing.T) {
+	decode := func(value string) []byte {
+		data, err := hex.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return data
+	}
+
+	var polyvalKey [16]byte
+	copy(polyvalKey[:], decode("25629347589242761d31f826ba4b757b"))
+
+	hash := newPolyval(polyvalKey)
+	hash.update(decode("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362"))
+
+	if sum := hash.sum(); hex.EncodeToString(sum[:]) != "f7a3b47b846119fae5b7866cf5e5b77e" {
+		t.Error("unexpected POLYVAL ", hex.EncodeToString(sum[:]))
+	}
+
+	aead, err := newAESGCMSIV(decode("0100000000000000000000000000000000000000000000000000000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := decode("030000000000000000000000")
+
+	vectors := map[string]string{
+		"":                 "07f5f4169bbf55a8400cd47ea6fd400f",
+		"0100000000000000": "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+	}
+
+	for plaintext, expected := range vectors {
+		sealed := aead.Seal(nil, nonce, decode(plaintext), nil)
+		if hex.EncodeToString(sealed) != expected {
+			t.Error("unexpected AES-GCM-SIV result for ", plaintext, ": ", hex.EncodeToString(sealed))
+		}
+
+		opened, err := aead.Open(nil, nonce, sealed, nil)
+		if err != nil || hex.EncodeToString(opened) != plaintext {
+			t.Error("AES-GCM-SIV did not open its own result for ", plaintext, ": ", err)
+		}
+
+		sealed[0] ^= 1
+		if _, err := aead.Open(nil, nonce, sealed, nil); err == nil {
+			t.Error("AES-GCM-SIV opened a tampered message")
+		}
+	}
+}
+
+func Test_NoncePrefix(t *testing.T) {
+	original := filepath.Join(getTestFilesDirectory(), "small.txt")
+
+	for _, suite := range cipherSuites {
+		t.Run(suite.Name, func(t *testing.T) {
+			encrypted := filepath.Join(t.TempDir(), "nonce.enc")
+			decrypted := filepath.Join(t.TempDir(), "nonce.dec")
+
+			options := Options{KeyHex: testKeyHex, Cipher: suite.Name, ChunkSizeMB: 1}
+
+			err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header, endOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+			if err != nil || header.NonceScheme != NonceSchemePrefixCounter || len(header.NoncePrefix) != NoncePrefixSize {
+				t.Fatal("expected a nonce prefix in the header: ", header, err)
+			}
+
+			if header.FormatVersion != "1.16" || header.PlaintextSize == 0 {
+				t.Error("expected a 1.16 header recording the plaintext size: ", header)
+			}
+
+			// Every chunk's nonce is the prefix and the chunk's ID, the sealed plaintext hash's is random throughout
+			encryptedData, _ := os.ReadFile(encrypted)
+			offset := int64(endOfHeader)
+
+			for chunkID := uint32(1); chunkID <= header.NumChunks; chunkID++ {
+				expected := append(append([]byte{}, header.NoncePrefix...), byte(chunkID>>24), byte(chunkID>>16), byte(chunkID>>8), byte(chunkID))
+				if !bytes.HasPrefix(encryptedData[offset:], expected) {
+					t.Error("chunk ", chunkID, " does not start with the nonce prefix and its ID")
+				}
+
+				offset += header.ChunkSizeBytes + int64(suite.NonceSize+suite.TagSize)
+			}
+
+			if len(header.PlaintextHash) == 0 || bytes.HasPrefix(header.PlaintextHash, header.NoncePrefix) {
+				t.Error("the sealed plaintext hash took a chunk's nonce")
+			}
+
+			// Files with the same key draw from different nonce spaces
+			err = Encrypt(original, encrypted, &Options{KeyHex: options.KeyHex, Cipher: suite.Name, ForceOperation: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			other, err := ReadHeader(encrypted)
+			if err != nil || bytes.Equal(other.NoncePrefix, header.NoncePrefix) {
+				t.Error("two files share a nonce prefix: ", other.NoncePrefix, err)
+			}
+
+			// Streams too
+			var stream bytes.Buffer
+
+			writer, err := NewEncryptWriter(&stream, &options)
+			if err == nil {
+				_, err = writer.Write([]byte("streamed"))
+			}
+			if err == nil {
+				err = writer.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = os.WriteFile(encrypted, stream.Bytes(), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			streamed, streamEnd, err := getEncryptedFileHeaderFromFile(encrypted)
+			if err != nil || streamed.NonceScheme != NonceSchemePrefixCounter || !bytes.HasPrefix(stream.Bytes()[streamEnd:], chunkNonceStart(streamed.NoncePrefix, 1)) {
+				t.Error("expected a stream's chunks to start with its nonce prefix: ", streamed, err)
+			}
+
+			// Readers need nothing new, so a stream (which records no size) is at the version it would be without one
+			if streamed.FormatVersion != "1.9" || streamed.PlaintextSize != 0 {
+				t.Error("a nonce prefix raised the format version to ", streamed.FormatVersion)
+			}
+		})
+	}
+
+	// Nonces are random throughout without a prefix, as before
+	nonce, err := newChunkNonce(nil, int(AESNonceSize), 0)
+	if err != nil || len(nonce) != int(AESNonceSize) || bytes.Equal(nonce, make([]byte, AESNonceSize)) {
+		t.Error("unexpected nonce without a prefix: ", nonce, err)
+	}
+
+	// There must be room for the prefix and the chunk ID
+	if _, err = newChunkNonce(chunkNonceStart(make([]byte, NoncePrefixSize), 1), NoncePrefixSize, 0); err == nil {
+		t.Error("expected a nonce too short for its start to be refused")
+	}
+}
+
+func Test_EndToEnd_ChunkChecksum(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filesDir + string(os.PathSeparator) + "temp_crc.enc"
+	decrypted := filesDir + string(os.PathSeparator) + "temp_crc.dec"
+
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(encrypted)
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(decrypted)
+
+	encryptOptions := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		Readers:        2,
+		Executors:      3,
+		Writers:        1,
+		ChunkChecksum:  true,
+		ForceOperation: true,
+	}
+
+	// Checksums are read from the header, so decryption does not ask for them
+	decryptOptions := encryptOptions
+	decryptOptions.ChunkChecksum = false
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte in the middle of the file, the checksum must catch it before authentication
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[len(data)/2] ^= 0xff
+	err = os.WriteFile(encrypted, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if err == nil || !strings.Contains(err.Error(), "CRC32C") {
+		t.Error("expected a CRC32C failure decrypting a corrupt file, got: ", err)
+	}
+}
+
+func Test_CloudChecksums(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	encrypted := filepath.Join(t.TempDir(), "cloud.enc")
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		Readers:        2,
+		Executors:      2,
+		Writers:        1,
+		CloudChecksums: true,
+		PartSizeMB:     5,
+	}
+
+	err := Encrypt(filesDir+string(os.PathSeparator)+"small.txt", encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(encrypted + CloudChecksumsSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var checksums CloudChecksums
+	err = json.Unmarshal(data, &checksums)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The inline values must match the file as it landed on disk
+	written, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(written)
+	if checksums.SHA256 != base64.StdEncoding.EncodeToString(digest[:]) || checksums.Size != int64(len(written)) {
+		t.Error("whole object checksum does not match the written file")
+	}
+
+	if len(checksums.Parts) != 2 || checksums.Parts[0].Size != bytesFromMB(5) || !strings.HasSuffix(checksums.CompositeSHA256, "-2") {
+		t.Error("unexpected parts: ", checksums.Parts, checksums.CompositeSHA256)
+	}
+
+	partDigest := sha256.Sum256(written[bytesFromMB(5):])
+	if checksums.Parts[1].SHA256 != base64.StdEncoding.EncodeToString(partDigest[:]) {
+		t.Error("last part checksum does not match the written file")
+	}
+}
+
+func Test_EndToEnd_GPGRecipients(t *testing.T) {
+	if _, err := exec.LookPath(gpgBinary); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	// A throwaway keyring with a single unprotected key
+	gpgHome := t.TempDir()
+	t.Setenv("GNUPGHOME", gpgHome)
+
+	defer func() {
+		_ = exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+	}()
+
+	_, err := runGPG(nil, "--passphrase", "", "--quick-gen-key", "Encryptor Test <test@example.com>", "default", "default", "never")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filepath.Join(t.TempDir(), "gpg.enc")
+	decrypted := filepath.Join(t.TempDir(), "gpg.dec")
+
+	encryptOptions := Options{
+		ChunkSizeMB:   1,
+		Readers:       2,
+		Executors:     2,
+		Writers:       1,
+		GPGRecipients: []string{"test@example.com"},
+	}
+
+	// No key or password, gpg-agent unwraps the file key
+	decryptOptions := Options{
+		Readers:   2,
+		Executors: 2,
+		Writers:   1,
+	}
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || len(header.Recipients) != 1 || header.FormatVersion != "1.16" {
+		t.Error("unexpected header for a file encrypted to recipients: ", header, err)
+	}
+
+	// Recipients replace the password, they cannot be mixed
+	encryptOptions.Password = "some_password_here"
+	err = Encrypt(original, encrypted, &encryptOptions)
+	if err == nil {
+		t.Error("expected an error combining recipients with a password")
+	}
+}
+
+func Test_EndToEnd_SSHRecipients(t *testing.T) {
+	keysDir := t.TempDir()
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ed25519DER, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write each keypair the way ssh-keygen would lay it out
+	keys := []struct {
+		name       string
+		privateKey interface{}
+		block      *pem.Block
+	}{
+		{"id_ed25519", ed25519Key, &pem.Block{Type: "PRIVATE KEY", Bytes: ed25519DER}},
+		{"id_rsa", rsaKey, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}},
+	}
+
+	var identities []string
+	for _, key := range keys {
+		signer, err := ssh.NewSignerFromKey(key.privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identity := filepath.Join(keysDir, key.name)
+		err = os.WriteFile(identity, pem.EncodeToMemory(key.block), 0600)
+		if err == nil {
+			err = os.WriteFile(identity+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identities = append(identities, identity)
+	}
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+
+	// Each identity on its own must be able to decrypt
+	for _, identity := range identities {
+		t.Run(filepath.Base(identity), func(t *testing.T) {
+			encrypted := filepath.Join(t.TempDir(), "ssh.enc")
+			decrypted := filepath.Join(t.TempDir(), "ssh.dec")
+
+			encryptOptions := Options{
+				ChunkSizeMB:   1,
+				Readers:       2,
+				Executors:     2,
+				Writers:       1,
+				SSHRecipients: []string{identities[0] + ".pub", identities[1] + ".pub"},
+			}
+
+			decryptOptions := Options{
+				Readers:       2,
+				Executors:     2,
+				Writers:       1,
+				SSHIdentities: []string{identity},
+			}
+
+			err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header, _, err := getEncryptedFileHeaderFromFile(encrypted)
+			if err != nil || len(header.Recipients) != 2 || header.FormatVersion != "1.16" {
+				t.Error("unexpected header for a file encrypted to SSH recipients: ", header, err)
+			}
+		})
+	}
+}
+
+func Test_EndToEnd_X25519Recipients(t *testing.T) {
+	keysDir := t.TempDir()
+
+	// Alice is given as a key, Bob as a file of his key
+	var identities []string
+	var recipients []string
+
+	for _, name := range []string{"alice", "bob"} {
+		privateKey, publicKey, err := GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identity := filepath.Join(keysDir, name+".key")
+		err = os.WriteFile(identity, []byte("# public key: "+publicKey+"\n"+privateKey+"\n"), 0600)
+		if err == nil {
+			err = os.WriteFile(identity+".pub", []byte(publicKey+"\n"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identities = append(identities, identity)
+		recipients = append(recipients, publicKey)
+	}
+
+	recipients[1] = identities[1] + ".pub"
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filepath.Join(t.TempDir(), "x25519.enc")
+
+	encryptOptions := Options{ChunkSizeMB: 1, Readers: 2, Executors: 2, Writers: 1, X25519Recipients: recipients}
+
+	// Each identity on its own must be able to decrypt
+	for _, identity := range identities {
+		decrypted := filepath.Join(t.TempDir(), "x25519.dec")
+		decryptOptions := Options{Readers: 2, Executors: 2, Writers: 1, X25519Identities: []string{identity}}
+
+		err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, _, err := getEncryptedFileHeaderFromFile(encrypted)
+		if err != nil || len(header.Recipients) != 2 || header.Recipients[0].Type != RecipientTypeX25519 {
+			t.Error("unexpected header for a file encrypted to X25519 recipients: ", header, err)
+		}
+
+		err = os.Remove(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Someone else's identity, or none, opens nothing
+	strangerKey, _, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stranger := filepath.Join(keysDir, "stranger.key")
+	err = os.WriteFile(stranger, []byte(strangerKey+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &encryptOptions)
+	if err == nil {
+		_, err = writer.Write([]byte("for alice and bob"))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, decryptOptions := range []Options{{X25519Identities: []string{stranger}}, {}} {
+		if _, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &decryptOptions); err == nil {
+			t.Error("expected decryption without a matching identity to fail")
+		}
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &Options{X25519Identities: []string{stranger, identities[1]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := io.ReadAll(reader)
+	if err != nil || string(plaintext) != "for alice and bob" {
+		t.Error("unexpected plaintext from a stream encrypted to X25519 recipients: ", string(plaintext), err)
+	}
+
+	// Recipients replace the password, and X25519 is not FIPS approved
+	for _, options := range []Options{
+		{X25519Recipients: recipients, Password: "password"},
+		{X25519Recipients: recipients, FIPS: true},
+		{X25519Recipients: []string{"not a key"}},
+	} {
+		if _, err := NewEncryptWriter(io.Discard, &options); err == nil {
+			t.Error("expected encrypting to X25519 recipients to fail with ", options)
+		}
+	}
+}
+
+func Test_EndToEnd_MLKEMX25519Recipients(t *testing.T) {
+	if !mlkemSupported {
+		t.Skip("ML-KEM needs a build with Go 1.24 or later")
+	}
+
+	keysDir := t.TempDir()
+
+	// A hybrid identity and a plain X25519 one, in one identity file
+	hybridKey, hybridPublic, err := GenerateMLKEMX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hybridPublic, mlkemX25519PublicPrefix) || !strings.HasPrefix(hybridKey, mlkemX25519SecretPrefix) {
+		t.Fatal("unexpected hybrid keypair: ", hybridPublic)
+	}
+
+	plainKey, plainPublic, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hybridIdentity := filepath.Join(keysDir, "hybrid.key")
+	plainIdentity := filepath.Join(keysDir, "plain.key")
+	bothIdentities := filepath.Join(keysDir, "both.key")
+
+	for fileName, contents := range map[string]string{
+		hybridIdentity: "# public key: " + hybridPublic + "\n" + hybridKey + "\n",
+		plainIdentity:  plainKey + "\n",
+		bothIdentities: plainKey + "\n" + hybridKey + "\n",
+	} {
+		if err := os.WriteFile(fileName, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filepath.Join(t.TempDir(), "mlkem.enc")
+
+	encryptOptions := Options{ChunkSizeMB: 1, Readers: 2, Executors: 2, Writers: 1, X25519Recipients: []string{hybridPublic, plainPublic}}
+
+	for _, identity := range []string{hybridIdentity, plainIdentity, bothIdentities} {
+		decrypted := filepath.Join(t.TempDir(), "mlkem.dec")
+		decryptOptions := Options{Readers: 2, Executors: 2, Writers: 1, X25519Identities: []string{identity}}
+
+		err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+		if err != nil {
+			t.Fatal(identity, err)
+		}
+
+		header, _, err := getEncryptedFileHeaderFromFile(encrypted)
+		if err != nil || len(header.Recipients) != 2 || header.Recipients[0].Type != RecipientTypeMLKEMX25519 || header.Recipients[1].Type != RecipientTypeX25519 {
+			t.Error("unexpected header for a file encrypted to hybrid recipients: ", header, err)
+		}
+
+		err = os.Remove(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the hybrid recipient, so the X25519 identity opens nothing
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &Options{X25519Recipients: []string{hybridPublic}})
+	if err == nil {
+		_, err = writer.Write([]byte("for the vault"))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &Options{X25519Identities: []string{plainIdentity}}); err == nil {
+		t.Error("expected an X25519 identity not to open a hybrid stanza")
+	}
+
+	// A damaged public key, and FIPS, are refused
+	for _, options := range []Options{
+		{X25519Recipients: []string{hybridPublic[:len(hybridPublic)-8]}},
+		{X25519Recipients: []string{hybridPublic}, FIPS: true},
+	} {
+		if _, err := NewEncryptWriter(io.Discard, &options); err == nil {
+			t.Error("expected encrypting to a hybrid recipient to fail with ", options.FIPS)
+		}
+	}
+
+	// Enough hybrid stanzas overflow the header's length indicator, which must fail rather than write a file that cannot be read
+	manyRecipients := make([]string, 45)
+	for i := range manyRecipients {
+		manyRecipients[i] = hybridPublic
+	}
+
+	encryptOptions.X25519Recipients = manyRecipients
+	if err := Encrypt(original, encrypted, &encryptOptions); err == nil {
+		t.Error("expected encrypting to 45 hybrid recipients to fail, the header is too large")
+	}
+
+	if _, err := os.Stat(encrypted); !os.IsNotExist(err) {
+		t.Error("expected no target written for a header that is too large, got ", err)
+	}
+
+	if _, err := NewEncryptWriter(io.Discard, &encryptOptions); err == nil {
+		t.Error("expected a stream to 45 hybrid recipients to fail, the header is too large")
+	}
+}
+
+func Test_EndToEnd_RSARecipients(t *testing.T) {
+	keysDir := t.TempDir()
+
+	aliceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice has a certificate and a PKCS#8 PEM key, Bob a DER public key and a PKCS#1 DER key
+	template := x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	aliceCertificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &aliceKey.PublicKey, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alicePKCS8, err := x509.MarshalPKCS8PrivateKey(aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPublic, err := x509.MarshalPKIXPublicKey(&bobKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"alice.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: aliceCertificate}),
+		"alice.key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: alicePKCS8}),
+		"bob.der":   bobPublic,
+		"bob.key":   x509.MarshalPKCS1PrivateKey(bobKey),
+	}
+
+	for name, data := range files {
+		err = os.WriteFile(filepath.Join(keysDir, name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+
+	encryptOptions := Options{ChunkSizeMB: 1, RSARecipients: []string{filepath.Join(keysDir, "alice.crt"), filepath.Join(keysDir, "bob.der")}}
+
+	// Each identity on its own must be able to decrypt, in FIPS mode as well
+	for _, identity := range []string{"alice.key", "bob.key"} {
+		encrypted := filepath.Join(t.TempDir(), "rsa.enc")
+		decrypted := filepath.Join(t.TempDir(), "rsa.dec")
+		decryptOptions := Options{FIPS: true, RSAIdentities: []string{filepath.Join(keysDir, identity)}}
+
+		err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+		if err != nil {
+			t.Fatal(identity, ": ", err)
+		}
+
+		header, _, err := getEncryptedFileHeaderFromFile(encrypted)
+		if err != nil || len(header.Recipients) != 2 || header.Recipients[0].Type != RecipientTypeRSAOAEP {
+			t.Error("unexpected header for a file encrypted to RSA recipients: ", header, err)
+		}
+	}
+
+	// The stanza names the key the way openssl would find it, the SHA256 of its DER public key
+	digest := sha256.Sum256(bobPublic)
+	stanza, err := wrapFileKeyRSAOAEP(make([]byte, FileKeySize), &bobKey.PublicKey)
+	if err != nil || stanza.Args[0] != "SHA256:"+base64.RawStdEncoding.EncodeToString(digest[:]) {
+		t.Error("unexpected rsa-oaep stanza: ", stanza, err)
+	}
+
+	if _, err := unwrapFileKeyRSAOAEP(stanza, []*rsa.PrivateKey{aliceKey}); err == nil {
+		t.Error("expected someone else's RSA key to be refused")
+	}
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := filepath.Join(keysDir, "small.pem")
+	err = os.WriteFile(small, pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&smallKey.PublicKey)}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Too small, not a public key, or mixed with a password
+	for _, options := range []Options{
+		{RSARecipients: []string{small}},
+		{RSARecipients: []string{filepath.Join(keysDir, "alice.key")}},
+		{RSARecipients: encryptOptions.RSARecipients, Password: "password"},
+	} {
+		if _, err := NewEncryptWriter(io.Discard, &options); err == nil {
+			t.Error("expected encrypting to RSA recipients to fail with ", options)
+		}
+	}
+
+	if _, err := NewEncryptWriter(io.Discard, &Options{FIPS: true, RSARecipients: encryptOptions.RSARecipients}); err != nil {
+		t.Error("expected FIPS mode to allow RSA-OAEP recipients: ", err)
+	}
+}
+
+func Test_EndToEnd_Signatures(t *testing.T) {
+	keysDir := t.TempDir()
+
+	signingKey, signerPublic, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, strangerPublic, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKeyFile := filepath.Join(keysDir, "signing.key")
+	signersFile := filepath.Join(keysDir, "signers.pub")
+
+	err = os.WriteFile(signingKeyFile, []byte(signingKey+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(signersFile, []byte("# trusted\n"+strangerPublic+"\n"+signerPublic+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	original := filepath.Join(getTestFilesDirectory(), "medium.txt")
+	encrypted := filepath.Join(tempDir, "signed.enc")
+	decrypted := filepath.Join(tempDir, "signed.dec")
+
+	// Signed, with and without the trailers that follow the signature
+	for _, trailers := range []bool{false, true} {
+		encryptOptions := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, SigningKey: signingKeyFile, HeaderCopy: trailers, ChunkMarkers: trailers}
+
+		for _, signers := range [][]string{nil, {signerPublic}, {signersFile}} {
+			decryptOptions := Options{KeyHex: testKeyHex, SignerKeys: signers, ForceOperation: true}
+
+			err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+			if err != nil {
+				t.Fatal(trailers, signers, err)
+			}
+
+			err = os.Remove(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = Encrypt(original, encrypted, &encryptOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inspection, err := Inspect(encrypted)
+		if err != nil || inspection.Signature != SignatureEd25519 || inspection.SignerKey != signerPublic || inspection.FormatVersion != "1.16" ||
+			inspection.PayloadBytes+inspection.HeaderBytes+inspection.FooterBytes+inspection.SignatureBytes+inspection.HeaderCopyBytes != inspection.FileSizeBytes {
+			t.Error("unexpected inspection of a signed file: ", inspection, err)
+		}
+
+		err = Verify(encrypted, &Options{KeyHex: testKeyHex, SignerKeys: []string{signerPublic}})
+		if err != nil {
+			t.Error("could not verify a signed file: ", err)
+		}
+
+		err = Verify(encrypted, &Options{KeyHex: testKeyHex, SignerKeys: []string{strangerPublic}})
+		if !errors.Is(err, ErrSignatureInvalid) {
+			t.Error("expected a file signed by someone else to be refused: ", err)
+		}
+
+		// Anyone with the key can change the file and its footer, only the signature tells
+		encryptedData, _ := os.ReadFile(encrypted)
+		damaged := append([]byte{}, encryptedData...)
+		damaged[len(damaged)/2] ^= 0x01
+
+		err = os.WriteFile(encrypted, damaged, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Decrypt(encrypted, decrypted, &Options{KeyHex: testKeyHex, ForceOperation: true})
+		if !errors.Is(err, ErrSignatureInvalid) {
+			t.Error("expected a changed file to fail its signature: ", err)
+		}
+
+		err = os.Remove(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unsigned file is refused when a signer is required
+	err = Encrypt(original, encrypted, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt(encrypted, decrypted, &Options{KeyHex: testKeyHex, SignerKeys: []string{signerPublic}, ForceOperation: true})
+	if !errors.Is(err, ErrNotSigned) {
+		t.Error("expected an unsigned file to be refused: ", err)
+	}
+
+	err = os.Remove(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A detached signature leaves the file as it would be unsigned
+	detached := filepath.Join(tempDir, "signed.enc.sig")
+	encryptOptions := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, SigningKey: signingKeyFile, DetachedSignature: detached}
+	decryptOptions := Options{KeyHex: testKeyHex, SignerKeys: []string{signerPublic}, DetachedSignature: detached, ForceOperation: true}
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || header.Signature != "" || header.SignerKey != "" {
+		t.Error("expected no signature in the header of a file signed detached: ", header, err)
+	}
+
+	err = Decrypt(encrypted, decrypted, &Options{KeyHex: testKeyHex, DetachedSignature: detached, ForceOperation: true})
+	if err == nil {
+		t.Error("expected a detached signature without signers to be refused")
+	}
+
+	if _, err := NewEncryptWriter(io.Discard, &Options{KeyHex: testKeyHex, DetachedSignature: detached}); err == nil {
+		t.Error("expected a detached signature without a signing key to be refused")
+	}
+
+	// Streams are signed and checked the same way, embedded and detached
+	data, _ := os.ReadFile(original)
+
+	for _, detachedSignature := range []string{"", filepath.Join(tempDir, "stream.sig")} {
+		var stream bytes.Buffer
+
+		writer, err := NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1, SigningKey: signingKeyFile, DetachedSignature: detachedSignature, HeaderCopy: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = writer.Write(data)
+
+		err = writer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readOptions := Options{KeyHex: testKeyHex, SignerKeys: []string{signerPublic}, DetachedSignature: detachedSignature}
+
+		reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &readOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		streamed, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(streamed, data) {
+			t.Fatal("could not read back a signed stream: ", detachedSignature, err)
+		}
+
+		readOptions.SignerKeys = []string{strangerPublic}
+
+		reader, err = NewDecryptReader(bytes.NewReader(stream.Bytes()), &readOptions)
+		if err == nil {
+			_, err = io.ReadAll(reader)
+		}
+
+		if !errors.Is(err, ErrSignatureInvalid) {
+			t.Error("expected a stream signed by someone else to be refused: ", detachedSignature, err)
+		}
+	}
+}
+
+func Test_FIPSMode(t *testing.T) {
+	keysDir := t.TempDir()
+
+	ed25519Public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPublic, err := ssh.NewPublicKey(ed25519Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient := filepath.Join(keysDir, "id_ed25519.pub")
+	err = os.WriteFile(recipient, ssh.MarshalAuthorizedKey(sshPublic), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused before anything is wrapped, so gpg need not be installed
+	for _, options := range []Options{
+		{FIPS: true, SSHRecipients: []string{recipient}},
+		{FIPS: true, RecipientsFiles: []string{recipient}},
+		{FIPS: true, GPGRecipients: []string{"alice@example.com"}},
+		{FIPS: true, Password: "password", Cipher: "XChaCha20-Poly1305"},
+	} {
+		if _, err := NewEncryptWriter(io.Discard, &options); err == nil || !strings.Contains(err.Error(), "FIPS") {
+			t.Error("expected FIPS mode to refuse ", options, ": ", err)
+		}
+	}
+
+	if _, err := NewEncryptWriter(io.Discard, &Options{FIPS: true, Password: "password"}); err != nil {
+		t.Error("expected FIPS mode to allow passwords: ", err)
+	}
+
+	// A file wrapped to ssh-ed25519 cannot be opened in FIPS mode, whatever the identities
+	if FIPSBuild() {
+		return
+	}
+
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &Options{SSHRecipients: []string{recipient}})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDecryptReader(&stream, &Options{FIPS: true}); err == nil || !strings.Contains(err.Error(), "FIPS") {
+		t.Error("expected FIPS mode to refuse an ssh-ed25519 stanza: ", err)
+	}
+}
+
+func Test_RecipientsURL(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := filepath.Join(t.TempDir(), "id_ed25519")
+	err = os.WriteFile(identity, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Published key lists can hold keys we cannot encrypt to, they are skipped
+	keys := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=\n" +
+		string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+
+	status := http.StatusOK
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(keys))
+	}))
+
+	defaultClient := recipientsHTTPClient
+	recipientsHTTPClient = server.Client()
+	defer func() {
+		recipientsHTTPClient = defaultClient
+	}()
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filepath.Join(t.TempDir(), "url.enc")
+	decrypted := filepath.Join(t.TempDir(), "url.dec")
+
+	var warnings []string
+	encryptOptions := Options{ChunkSizeMB: 1, RecipientsFiles: []string{server.URL + "/alice.keys"}, ForceOperation: true, Warn: func(warning string) { warnings = append(warnings, warning) }}
+	decryptOptions := Options{SSHIdentities: []string{identity}, ForceOperation: true}
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil || len(warnings) != 0 {
+		t.Fatal(err, warnings)
+	}
+
+	// Keys withdrawn on purpose are not taken from the cache
+	status = http.StatusGone
+	err = Encrypt(original, encrypted, &encryptOptions)
+	if err == nil || len(warnings) != 0 {
+		t.Error("expected a server answering 410 to fail rather than use the cache: ", err, warnings)
+	}
+
+	// Offline, the cached copy is used, and the user told
+	server.Close()
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal("cached recipients were not used: ", err)
+	}
+
+	cacheFilename := recipientsCacheFilename(server.URL + "/alice.keys")
+	if len(warnings) != 1 || !strings.Contains(warnings[0], cacheFilename) || !strings.Contains(warnings[0], " ago") {
+		t.Error("expected a warning naming the cached copy and its age: ", warnings)
+	}
+
+	encryptOptions.RecipientsFiles = []string{"http://example.com/alice.keys"}
+	err = Encrypt(original, encrypted, &encryptOptions)
+	if err == nil {
+		t.Error("expected an error for a recipients URL without https")
+	}
+}
+
+func Test_GCPKMS(t *testing.T) {
+	keyName := "projects/acme/locations/global/keyRings/backups/cryptoKeys/nightly"
+
+	serviceAccountKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token endpoint that checks the service account's assertion, a metadata server, and KMS itself
+	var kmsRequests int
+	var denied bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			assertion := strings.Split(r.FormValue("assertion"), ".")
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(assertion) != 3 {
+				http.Error(w, `{"error_description": "bad grant"}`, http.StatusBadRequest)
+				return
+			}
+
+			signature, _ := base64.RawURLEncoding.DecodeString(assertion[2])
+			digest := sha256.Sum256([]byte(assertion[0] + "." + assertion[1]))
+			if rsa.VerifyPKCS1v15(&serviceAccountKey.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+				http.Error(w, `{"error_description": "invalid signature"}`, http.StatusUnauthorized)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"access_token": "service-account-token", "expires_in": 3600}`))
+		case r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"access_token": "workload-identity-token", "expires_in": 3600}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/"+keyName+":"):
+			kmsRequests++
+
+			var request map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&request)
+
+			aad, _ := base64.StdEncoding.DecodeString(request["additionalAuthenticatedData"])
+			if denied || !strings.HasSuffix(r.Header.Get("Authorization"), "-token") || string(aad) != gcpKMSLabel {
+				http.Error(w, `{"error": {"message": "Permission 'cloudkms.cryptoKeyVersions.useToDecrypt' denied"}}`, http.StatusForbidden)
+				return
+			}
+
+			// Wrapping is a reversible stand-in, what matters is what goes where
+			if strings.HasSuffix(r.URL.Path, ":encrypt") {
+				_ = json.NewEncoder(w).Encode(map[string]string{"name": keyName + "/cryptoKeyVersions/1", "ciphertext": base64.StdEncoding.EncodeToString([]byte("kms:" + request["plaintext"]))})
+			} else {
+				wrapped, _ := base64.StdEncoding.DecodeString(request["ciphertext"])
+				_ = json.NewEncoder(w).Encode(map[string]string{"plaintext": strings.TrimPrefix(string(wrapped), "kms:")})
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defaultEndpoint := gcpKMSEndpoint
+	gcpKMSEndpoint = server.URL + "/v1/"
+	defer func() {
+		gcpKMSEndpoint = defaultEndpoint
+	}()
+
+	resetToken := func() {
+		gcpToken.token = ""
+	}
+	defer resetToken()
+
+	der, err := x509.MarshalPKCS8PrivateKey(serviceAccountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "backup@acme.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL + "/token",
+	})
+
+	credentialsFile := filepath.Join(t.TempDir(), "service-account.json")
+
+	err = os.WriteFile(credentialsFile, credentials, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := filepath.Join(getTestFilesDirectory(), "small.txt")
+	encrypted := filepath.Join(t.TempDir(), "kms.enc")
+	decrypted := filepath.Join(t.TempDir(), "kms.dec")
+
+	_, publicKey, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptOptions := Options{ChunkSizeMB: 1, GCPKMSKeys: []string{keyName}, X25519Recipients: []string{publicKey}, ForceOperation: true}
+	decryptOptions := Options{ForceOperation: true}
+
+	// A service account key file, then the metadata server as on GKE with workload identity
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentialsFile)
+	resetToken()
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal("could not use a service account: ", err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || len(header.Recipients) != 2 || header.Recipients[1].Type != RecipientTypeGCPKMS || header.Recipients[1].Args[0] != keyName {
+		t.Error("unexpected header for a file encrypted to Cloud KMS: ", header, err)
+	}
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	resetToken()
+
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if err != nil || gcpToken.token != "workload-identity-token" {
+		t.Fatal("could not use the metadata server: ", err)
+	}
+
+	// The token is reused rather than asked for again
+	requestsBefore := kmsRequests
+
+	err = Verify(encrypted, &decryptOptions)
+	if err != nil || kmsRequests != requestsBefore+1 || gcpToken.token != "workload-identity-token" {
+		t.Error("expected a second job to reuse the token: ", err)
+	}
+
+	// Google's reason for refusing is passed on
+	denied = true
+
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if err == nil || !strings.Contains(err.Error(), "cloudkms.cryptoKeyVersions.useToDecrypt") {
+		t.Error("expected a denied Cloud KMS decryption to say why: ", err)
+	}
+
+	denied = false
+
+	if err := Encrypt(original, encrypted, &Options{GCPKMSKeys: []string{"nightly"}, ForceOperation: true}); err == nil {
+		t.Error("expected a key that is not a resource name to be refused")
+	}
+
+	if err := Encrypt(original, encrypted, &Options{GCPKMSKeys: []string{keyName}, Offline: true, ForceOperation: true}); !errors.Is(err, ErrOffline) {
+		t.Error("expected Cloud KMS to be refused offline: ", err)
+	}
+
+	if err := Decrypt(encrypted, decrypted, &Options{Offline: true, ForceOperation: true}); !errors.Is(err, ErrOffline) && (err == nil || !strings.Contains(err.Error(), ErrOffline.Error())) {
+		t.Error("expected a gcp-kms stanza to be refused offline: ", err)
+	}
+
+	if err := Encrypt(original, encrypted, &Options{GCPKMSKeys: []string{keyName}, FIPS: true, ForceOperation: true}); err != nil {
+		t.Error("expected FIPS mode to allow Cloud KMS: ", err)
+	}
+}
+
+func Test_GCS(t *testing.T) {
+	type gcsSession struct {
+		name      string
+		data      []byte
+		cancelled bool
+	}
+
+	var mutex sync.Mutex
+	objects := map[string][]byte{"backups/old.enc": []byte("already here")}
+	generations := map[string]int{"backups/old.enc": 1}
+	sessions := map[string]*gcsSession{}
+	var rangeReads, sentBytes int
+	var failNextPart bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		path := r.URL.EscapedPath()
+
+		switch {
+		case path == "/computeMetadata/v1/instance/service-accounts/default/token":
+			if !strings.Contains(r.URL.Query().Get("scopes"), "devstorage.read_write") {
+				http.Error(w, "missing scope", http.StatusForbidden)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"access_token": "storage-token", "expires_in": 3600}`))
+		case r.Header.Get("Authorization") != "Bearer storage-token" && !strings.HasPrefix(path, "/session/"):
+			http.Error(w, `{"error": {"message": "Anonymous caller does not have storage.objects.get access"}}`, http.StatusUnauthorized)
+		case r.Method == http.MethodGet && strings.HasPrefix(path, "/storage/v1/b/"):
+			parts := strings.Split(strings.TrimPrefix(path, "/storage/v1/b/"), "/o/")
+			object, _ := url.PathUnescape(parts[1])
+			name := parts[0] + "/" + object
+
+			data, ok := objects[name]
+			if !ok {
+				http.Error(w, `{"error": {"message": "No such object: `+name+`"}}`, http.StatusNotFound)
+				return
+			}
+
+			if r.URL.Query().Get("alt") != "media" {
+				_ = json.NewEncoder(w).Encode(map[string]string{"size": strconv.Itoa(len(data)), "generation": strconv.Itoa(generations[name])})
+				return
+			}
+
+			var start, end int
+			_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			if err != nil || end >= len(data) || r.URL.Query().Get("generation") != strconv.Itoa(generations[name]) {
+				http.Error(w, "bad range or generation", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+
+			rangeReads++
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[start : end+1])
+		case r.Method == http.MethodPost && path == "/upload/storage/v1/b/backups/o":
+			name := "backups/" + r.URL.Query().Get("name")
+			if _, exists := objects[name]; exists && r.URL.Query().Get("ifGenerationMatch") == "0" {
+				http.Error(w, `{"error": {"message": "At least one of the pre-conditions you specified did not hold."}}`, http.StatusPreconditionFailed)
+				return
+			}
+
+			id := strconv.Itoa(len(sessions) + 1)
+			sessions[id] = &gcsSession{name: name}
+			w.Header().Set("Location", "http://"+r.Host+"/session/"+id)
+		case strings.HasPrefix(path, "/session/"):
+			session := sessions[strings.TrimPrefix(path, "/session/")]
+			if session == nil || session.cancelled {
+				http.NotFound(w, r)
+				return
+			}
+
+			if r.Method == http.MethodDelete {
+				session.cancelled = true
+				w.WriteHeader(499)
+				return
+			}
+
+			body, _ := io.ReadAll(r.Body)
+			sentBytes += len(body)
+
+			// A part cut off part way, after the first 256KB arrived
+			if failNextPart && len(body) > 256*1024 {
+				failNextPart = false
+				session.data = append(session.data, body[:256*1024]...)
+				http.Error(w, "connection reset", http.StatusServiceUnavailable)
+				return
+			}
+
+			var start, end int
+			var total string
+			if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total); err == nil {
+				if start != len(session.data) || end-start+1 != len(body) {
+					http.Error(w, "out of order", http.StatusBadRequest)
+					return
+				}
+
+				session.data = append(session.data, body...)
+			} else {
+				total = strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes */")
+			}
+
+			if total == strconv.Itoa(len(session.data)) {
+				objects[session.name] = session.data
+				generations[session.name]++
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			if len(session.data) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+			}
+
+			w.WriteHeader(http.StatusPermanentRedirect)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defaultEndpoint, defaultDelay := gcsEndpoint, objectRetryDelay
+	gcsEndpoint, objectRetryDelay = server.URL+"/", 0
+	defer func() {
+		gcsEndpoint, objectRetryDelay = defaultEndpoint, defaultDelay
+	}()
+
+	defaultJournals := uploadJournalDirectory
+	journals := t.TempDir()
+	uploadJournalDirectory = func() string { return journals }
+	defer func() {
+		uploadJournalDirectory = defaultJournals
+	}()
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	gcpToken.token = ""
+	defer func() {
+		gcpToken.token = ""
+	}()
+
+	data := make([]byte, 3*1024*1024+12345)
+	_, _ = rand.Read(data)
+
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, PartSizeMB: 1, Readers: 3}
+
+	// Uploaded a part at a time, resuming from what arrived when a part fails
+	failNextPart = true
+	objectURL := "gs://backups/nightly/data.enc"
+
+	upload, err := NewGCSWriter(objectURL, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewEncryptWriter(upload, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := objects["backups/nightly/data.enc"]; ok {
+		t.Error("expected the object to appear only once the upload finishes")
+	}
+
+	if err = upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if failNextPart || len(objects["backups/nightly/data.enc"]) < len(data) {
+		t.Fatal("expected a failed part to be resumed and the upload finished")
+	}
+
+	// Read back with ranged reads of the generation that was opened
+	download, err := NewGCSReader(objectURL, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if download.Size() != int64(len(objects["backups/nightly/data.enc"])) {
+		t.Error("unexpected object size: ", download.Size())
+	}
+
+	reader, err := NewDecryptReader(download, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, data) || rangeReads < 4 {
+		t.Fatal("could not read an object back in ranges: ", err, rangeReads)
+	}
+
+	if header := peekHeader(objectURL); header == nil || header.ChunkSizeBytes != 1024*1024 {
+		t.Error("expected an object's header to be peeked: ", header)
+	}
+
+	// An upload whose process is killed part way is carried on by the next run, from its journal
+	interrupted := func(name string, data []byte) {
+		upload, err := NewGCSWriter(name, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writer, err := NewEncryptWriter(upload, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = writer.Write(data[:2*1024*1024+777]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uploadAll := func(name string, data []byte) error {
+		upload, err := NewGCSWriter(name, &options)
+		if err != nil {
+			return err
+		}
+
+		writer, err := NewEncryptWriter(upload, &options)
+		if err == nil {
+			_, err = writer.Write(data)
+		}
+
+		if err == nil {
+			err = writer.Close()
+		}
+
+		if err == nil {
+			return upload.Close()
+		}
+
+		_ = upload.Abort()
+		return err
+	}
+
+	decrypt := func(encrypted []byte) ([]byte, error) {
+		reader, err := NewDecryptReader(bytes.NewReader(encrypted), &options)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(reader)
+	}
+
+	resumedURL := "gs://backups/nightly/resumed.enc"
+	interrupted(resumedURL, data)
+
+	if journaled, _ := filepath.Glob(filepath.Join(journals, "*.json")); len(journaled) != 1 {
+		t.Fatal("expected the interrupted upload to be journaled: ", journaled)
+	}
+
+	sessionCount, sentBefore := len(sessions), sentBytes
+
+	if err = uploadAll(resumedURL, data); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := objects["backups/nightly/resumed.enc"]
+	if len(sessions) != sessionCount || sentBytes-sentBefore > len(encrypted)-2*1024*1024 {
+		t.Error("expected the upload to carry on in its session, from what was persisted: ", len(sessions)-sessionCount, sentBytes-sentBefore)
+	}
+
+	if decrypted, err := decrypt(encrypted); err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatal("could not decrypt a resumed upload: ", err)
+	}
+
+	if journaled, _ := filepath.Glob(filepath.Join(journals, "*.json")); len(journaled) != 0 {
+		t.Error("expected a finished upload's journal to be removed: ", journaled)
+	}
+
+	// Other plaintext is never sent under the nonces of the header written again, the next run starts over
+	interrupted("gs://backups/nightly/changed.enc", data)
+
+	changed := append([]byte{}, data...)
+	changed[100] ^= 1
+
+	if err = uploadAll("gs://backups/nightly/changed.enc", changed); !errors.Is(err, errUploadDiffers) {
+		t.Fatal("expected a resumed upload of other data to fail: ", err)
+	}
+
+	if err = uploadAll("gs://backups/nightly/changed.enc", changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted, err := decrypt(objects["backups/nightly/changed.enc"]); err != nil || !bytes.Equal(decrypted, changed) {
+		t.Fatal("could not decrypt an upload started over: ", err)
+	}
+
+	// An existing object is only replaced when forced
+	if _, err := NewGCSWriter("gs://backups/old.enc", &options); !errors.Is(err, ErrTargetExists) {
+		t.Error("expected an existing object to be refused: ", err)
+	}
+
+	forced := options
+	forced.ForceOperation = true
+
+	replace, err := NewGCSWriter("gs://backups/old.enc", &forced)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = replace.Write([]byte("replaced")); err != nil || replace.Close() != nil || string(objects["backups/old.enc"]) != "replaced" {
+		t.Error("expected a forced upload to replace the object: ", err)
+	}
+
+	// A cancelled upload leaves nothing behind
+	cancelled, err := NewGCSWriter("gs://backups/cancelled.enc", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = cancelled.Write(data[:2*1024*1024]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cancelled.Abort(); err != nil {
+		t.Error(err)
+	}
+
+	if _, ok := objects["backups/cancelled.enc"]; ok || cancelled.Close() != nil {
+		t.Error("expected an aborted upload to leave no object")
+	}
+
+	// Google's reason for refusing is passed on
+	if _, err := NewGCSReader("gs://backups/missing.enc", &options); err == nil || !strings.Contains(err.Error(), "No such object") {
+		t.Error("expected a missing object to say so: ", err)
+	}
+
+	if _, err := NewGCSReader("gs://backups", &options); err == nil {
+		t.Error("expected a URL without an object to be refused")
+	}
+
+	offline := options
+	offline.Offline = true
+
+	if _, err := NewGCSReader(objectURL, &offline); !errors.Is(err, ErrOffline) {
+		t.Error("expected objects to be refused offline: ", err)
+	}
+
+	if _, err := NewGCSWriter(objectURL, &offline); !errors.Is(err, ErrOffline) {
+		t.Error("expected uploads to be refused offline: ", err)
+	}
+}
+
+func Test_AzureBlob(t *testing.T) {
+	type azureTestBlob struct {
+		data []byte
+		etag int
+	}
+
+	var mutex sync.Mutex
+	blobs := map[string]*azureTestBlob{"backups/old.enc": {data: []byte("already here"), etag: 1}}
+	uncommitted := map[string]map[string][]byte{}
+	var rangeReads, blockPuts int
+	var failBlock string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if r.URL.Path == "/tenant/oauth2/v2.0/token" {
+			if r.FormValue("scope") != "https://storage.azure.com/.default" {
+				http.Error(w, `{"error": "invalid_scope"}`, http.StatusBadRequest)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"access_token": "storage-token", "expires_in": 3599}`))
+			return
+		}
+
+		// Path style, as the storage emulator has it: /<account>/<container>/<blob>
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) != 2 || parts[0] != "acmebackups" || r.Header.Get("x-ms-version") == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer storage-token" && r.URL.Query().Get("sig") != "signed" {
+			w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+			http.Error(w, "\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>AuthenticationFailed</Code><Message>Server failed to authenticate the request.\nRequestId:1</Message></Error>", http.StatusForbidden)
+			return
+		}
+
+		name := parts[1]
+		blob := blobs[name]
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "blocklist":
+			if r.URL.Query().Get("blocklisttype") != "uncommitted" || len(uncommitted[name]) == 0 {
+				w.Header().Set("x-ms-error-code", "BlobNotFound")
+				http.Error(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobNotFound</Code></Error>`, http.StatusNotFound)
+				return
+			}
+
+			list := `<?xml version="1.0" encoding="utf-8"?><BlockList><UncommittedBlocks>`
+			for id, block := range uncommitted[name] {
+				list += fmt.Sprintf("<Block><Name>%s</Name><Size>%d</Size></Block>", id, len(block))
+			}
+
+			_, _ = w.Write([]byte(list + "</UncommittedBlocks></BlockList>"))
+		case r.Method == http.MethodHead || r.Method == http.MethodGet:
+			if blob == nil {
+				w.Header().Set("x-ms-error-code", "BlobNotFound")
+				http.Error(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>`, http.StatusNotFound)
+				return
+			}
+
+			etag := fmt.Sprintf(`"0x%d"`, blob.etag)
+			w.Header().Set("ETag", etag)
+
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+				return
+			}
+
+			if r.Header.Get("If-Match") != etag {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(blob.data) {
+				http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+
+			rangeReads++
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(blob.data[start : end+1])
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "block":
+			id := r.URL.Query().Get("blockid")
+			body, _ := io.ReadAll(r.Body)
+			blockPuts++
+
+			// Lost once, the block is sent again whole
+			if id == failBlock {
+				failBlock = ""
+				http.Error(w, "server busy", http.StatusServiceUnavailable)
+				return
+			}
+
+			if uncommitted[name] == nil {
+				uncommitted[name] = map[string][]byte{}
+			}
+
+			uncommitted[name][id] = body
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "blocklist":
+			if blob != nil && r.Header.Get("If-None-Match") == "*" {
+				w.Header().Set("x-ms-error-code", "BlobAlreadyExists")
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			var list struct {
+				Latest []string `xml:"Latest"`
+			}
+
+			if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+				http.Error(w, "bad block list", http.StatusBadRequest)
+				return
+			}
+
+			var data []byte
+			for _, id := range list.Latest {
+				block, ok := uncommitted[name][id]
+				if !ok || len(id) != len(list.Latest[0]) {
+					http.Error(w, "InvalidBlockList", http.StatusBadRequest)
+					return
+				}
+
+				data = append(data, block...)
+			}
+
+			etag := 1
+			if blob != nil {
+				etag = blob.etag + 1
+			}
+
+			blobs[name] = &azureTestBlob{data: data, etag: etag}
+			delete(uncommitted, name)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defaultEndpoint, defaultAuthority, defaultDelay := azureBlobEndpoint, azureAuthorityHost, objectRetryDelay
+	azureBlobEndpoint, azureAuthorityHost, objectRetryDelay = server.URL+"/%s/", server.URL+"/", 0
+	defer func() {
+		azureBlobEndpoint, azureAuthorityHost, objectRetryDelay = defaultEndpoint, defaultAuthority, defaultDelay
+	}()
+
+	defaultJournals := uploadJournalDirectory
+	journals := t.TempDir()
+	uploadJournalDirectory = func() string { return journals }
+	defer func() {
+		uploadJournalDirectory = defaultJournals
+	}()
+
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "backup-pipeline")
+	t.Setenv("AZURE_CLIENT_SECRET", "s3cret")
+	t.Setenv("AZURE_AUTHORITY_HOST", "")
+	azureTokens.tokens = nil
+	defer func() {
+		azureTokens.tokens = nil
+	}()
+
+	for name, expected := range map[string]bool{
+		"az://acmebackups/backups/nightly.enc":                                true,
+		"https://acmebackups.blob.core.windows.net/backups/nightly.enc?sig=x": true,
+		"https://acmebackups.blob.core.usgovcloudapi.net/backups/nightly.enc": true,
+		"https://acmebackups.blob.core.windows.net.example.com/backups/x.enc": false,
+		"https://example.com/acmebackups.blob.core.windows.net/backups/x.enc": false,
+		"https://a.b.blob.core.windows.net/backups/x.enc":                     false,
+		"gs://bucket/object": false,
+		"nightly.enc":        false,
+	} {
+		if isAzureBlobURL(name) != expected {
+			t.Errorf("expected isAzureBlobURL(%q) to be %v", name, expected)
+		}
+	}
+
+	for _, name := range []string{"az://acmebackups/backups", "az://Acme_Backups/backups/x.enc", "az://acmebackups//x.enc", "https://acmebackups.blob.core.windows.net/backups"} {
+		if _, err := parseAzureBlobURL(name); err == nil {
+			t.Errorf("expected %q to be refused", name)
+		}
+	}
+
+	// A SAS token is sent with every request and never shown
+	sas, err := parseAzureBlobURL("https://acmebackups.blob.core.windows.net/backups/2024/a%20b.enc?sv=2021&sig=signed")
+	if err != nil || sas.String() != "https://acmebackups.blob.core.windows.net/backups/2024/a%20b.enc" || sas.url("comp=block") != "https://acmebackups.blob.core.windows.net/backups/2024/a%20b.enc?comp=block&sv=2021&sig=signed" {
+		t.Error("unexpected SAS blob: ", sas, err)
+	}
+
+	data := make([]byte, 3*1024*1024+12345)
+	_, _ = rand.Read(data)
+
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, PartSizeMB: 1, Readers: 3}
+	blobURL := "az://acmebackups/backups/nightly/data.enc"
+
+	// Staged a block per part, one of them sent twice, and committed on Close
+	failBlock = base64.StdEncoding.EncodeToString([]byte("block-00000001"))
+
+	upload, err := NewAzureBlobWriter(blobURL, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewEncryptWriter(upload, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if blobs["backups/nightly/data.enc"] != nil {
+		t.Error("expected the blob to appear only once its blocks are committed")
+	}
+
+	if err = upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if failBlock != "" || blockPuts != 5 || blobs["backups/nightly/data.enc"] == nil {
+		t.Fatal("expected a lost block to be sent again and the blob committed: ", blockPuts)
+	}
+
+	download, err := NewAzureBlobReader(blobURL, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if download.Size() != int64(len(blobs["backups/nightly/data.enc"].data)) {
+		t.Error("unexpected blob size: ", download.Size())
+	}
+
+	reader, err := NewDecryptReader(download, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, data) || rangeReads < 4 {
+		t.Fatal("could not read a blob back in ranges: ", err, rangeReads)
+	}
+
+	if header := peekHeader(blobURL); header == nil || header.ChunkSizeBytes != 1024*1024 {
+		t.Error("expected a blob's header to be peeked: ", header)
+	}
+
+	// An upload whose process is killed part way stages only the blocks Azure does not have on the next run
+	interrupted := func(name string, data []byte) {
+		upload, err := NewAzureBlobWriter(name, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writer, err := NewEncryptWriter(upload, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = writer.Write(data[:2*1024*1024+777]); err != nil {
+			t.Fatal(err)
+		}
+
+		// The blocks in flight land before the process goes
+		upload.staging.Wait()
+	}
+
+	uploadAll := func(name string, data []byte) error {
+		upload, err := NewAzureBlobWriter(name, &options)
+		if err != nil {
+			return err
+		}
+
+		writer, err := NewEncryptWriter(upload, &options)
+		if err == nil {
+			_, err = writer.Write(data)
+		}
+
+		if err == nil {
+			err = writer.Close()
+		}
+
+		if err == nil {
+			return upload.Close()
+		}
+
+		_ = upload.Abort()
+		return err
+	}
+
+	decrypt := func(encrypted []byte) ([]byte, error) {
+		reader, err := NewDecryptReader(bytes.NewReader(encrypted), &options)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(reader)
+	}
+
+	interrupted("az://acmebackups/backups/resumed.enc", data)
+
+	if journaled, _ := filepath.Glob(filepath.Join(journals, "*.json")); len(journaled) != 1 || len(uncommitted["backups/resumed.enc"]) != 2 {
+		t.Fatal("expected the interrupted upload's blocks to be staged and journaled: ", journaled)
+	}
+
+	putsBefore := blockPuts
+
+	if err = uploadAll("az://acmebackups/backups/resumed.enc", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if blockPuts-putsBefore != 2 || blobs["backups/resumed.enc"] == nil {
+		t.Error("expected only the blocks Azure did not have to be staged: ", blockPuts-putsBefore)
+	}
+
+	if decrypted, err := decrypt(blobs["backups/resumed.enc"].data); err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatal("could not decrypt a resumed upload: ", err)
+	}
+
+	if journaled, _ := filepath.Glob(filepath.Join(journals, "*.json")); len(journaled) != 0 {
+		t.Error("expected a committed upload's journal to be removed: ", journaled)
+	}
+
+	// Other plaintext is never staged under the nonces of the header written again, the next run starts over
+	interrupted("az://acmebackups/backups/changed.enc", data)
+
+	changed := append([]byte{}, data...)
+	changed[100] ^= 1
+
+	if err = uploadAll("az://acmebackups/backups/changed.enc", changed); !errors.Is(err, errUploadDiffers) {
+		t.Fatal("expected a resumed upload of other data to fail: ", err)
+	}
+
+	if err = uploadAll("az://acmebackups/backups/changed.enc", changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted, err := decrypt(blobs["backups/changed.enc"].data); err != nil || !bytes.Equal(decrypted, changed) {
+		t.Fatal("could not decrypt an upload started over: ", err)
+	}
+
+	// A blob replaced while it is read is not spliced into the one that was opened
+	changing, err := NewAzureBlobReader(blobURL, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs["backups/nightly/data.enc"].etag++
+
+	if _, err = io.ReadAll(changing); err == nil || !strings.Contains(err.Error(), "changed while it was being read") {
+		t.Error("expected a replaced blob to fail the read: ", err)
+	}
+
+	// An existing blob is only replaced when forced, and refused before anything is staged
+	if _, err := NewAzureBlobWriter("az://acmebackups/backups/old.enc", &options); !errors.Is(err, ErrTargetExists) {
+		t.Error("expected an existing blob to be refused: ", err)
+	}
+
+	forced := options
+	forced.ForceOperation = true
+
+	replace, err := NewAzureBlobWriter("az://acmebackups/backups/old.enc", &forced)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = replace.Write([]byte("replaced")); err != nil || replace.Close() != nil || string(blobs["backups/old.enc"].data) != "replaced" {
+		t.Error("expected a forced upload to replace the blob: ", err)
+	}
+
+	// One that appears during the job is caught as the blocks are committed
+	racing, err := NewAzureBlobWriter("az://acmebackups/backups/racing.enc", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs["backups/racing.enc"] = &azureTestBlob{data: []byte("first"), etag: 1}
+
+	if _, err = racing.Write([]byte("second")); err != nil || !errors.Is(racing.Close(), ErrTargetExists) || string(blobs["backups/racing.enc"].data) != "first" {
+		t.Error("expected a blob that appeared during the upload to be kept: ", err)
+	}
+
+	// An aborted upload commits nothing
+	cancelled, err := NewAzureBlobWriter("az://acmebackups/backups/cancelled.enc", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = cancelled.Write(data[:2*1024*1024]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cancelled.Abort(); err != nil || cancelled.Close() != nil || blobs["backups/cancelled.enc"] != nil {
+		t.Error("expected an aborted upload to leave no blob: ", err)
+	}
+
+	// Azure's reason for refusing is passed on, without the request ID
+	if _, err := NewAzureBlobReader("az://acmebackups/backups/missing.enc", &options); err == nil || !strings.Contains(err.Error(), "BlobNotFound") {
+		t.Error("expected a missing blob to say so: ", err)
+	}
+
+	azureTokens.tokens = map[string]azureCachedToken{azureStorageResource: {token: "expired-token", expiry: time.Now().Add(time.Hour)}}
+
+	if _, err := NewAzureBlobWriter("az://acmebackups/backups/denied.enc", &options); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Error("expected a refused token to say so: ", err)
+	}
+
+	offline := options
+	offline.Offline = true
+
+	if _, err := NewAzureBlobReader(blobURL, &offline); !errors.Is(err, ErrOffline) {
+		t.Error("expected blobs to be refused offline: ", err)
+	}
+
+	if _, err := NewAzureBlobWriter(blobURL, &offline); !errors.Is(err, ErrOffline) {
+		t.Error("expected uploads to be refused offline: ", err)
+	}
+}
+
+func Test_HTTPSource(t *testing.T) {
+	var mutex sync.Mutex
+	var encrypted []byte
+	version, rangeReads, replaceAfter := 1, 0, 0
+	noRanges := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if r.URL.Path != "/artifacts/data.enc" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Header.Get("Range") != "" && r.Header.Get("Range") != "bytes=0-0" {
+			rangeReads++
+
+			// Published again part way through the read
+			if rangeReads == replaceAfter {
+				version++
+			}
+		}
+
+		if noRanges {
+			_, _ = w.Write(encrypted)
+			return
+		}
+
+		// ServeContent answers ranges, and If-Range against the ETag
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, version))
+		http.ServeContent(w, r, "data.enc", time.Time{}, bytes.NewReader(encrypted))
+	}))
+	defer server.Close()
+
+	defaultDelay := objectRetryDelay
+	objectRetryDelay = 0
+	defer func() {
+		objectRetryDelay = defaultDelay
+	}()
+
+	data := make([]byte, 3*1024*1024+12345)
+	_, _ = rand.Read(data)
+
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, PartSizeMB: 1, Readers: 3}
+
+	var buffer bytes.Buffer
+	writer, err := NewEncryptWriter(&buffer, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = writer.Write(data); err != nil || writer.Close() != nil {
+		t.Fatal(err)
+	}
+
+	encrypted = buffer.Bytes()
+	location := server.URL + "/artifacts/data.enc?token=secret"
+
+	if !IsHTTPURL(location) || IsHTTPURL("https://acmebackups.blob.core.windows.net/backups/data.enc") || IsHTTPURL("gs://backups/data.enc") {
+		t.Error("unexpected recognition of http(s):// URLs")
+	}
+
+	download, err := NewHTTPReader(location, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if download.Size() != int64(len(encrypted)) {
+		t.Error("unexpected file size: ", download.Size())
+	}
+
+	reader, err := NewDecryptReader(download, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, data) || rangeReads < 4 {
+		t.Fatal("could not decrypt a file read in ranges from a server: ", err, rangeReads)
+	}
+
+	if header := peekHeader(location); header == nil || header.ChunkSizeBytes != 1024*1024 {
+		t.Error("expected the header of a file on a server to be peeked: ", header)
+	}
+
+	// A file published again while it is read fails rather than splicing the two
+	rangeReads, replaceAfter = 0, 2
+
+	download, err = NewHTTPReader(location, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reader, err = NewDecryptReader(download, &options); err == nil {
+		_, err = io.ReadAll(reader)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "changed while it was being read") {
+		t.Error("expected a file replaced part way through to fail: ", err)
+	}
+
+	// A server without ranges sends the whole file, which is read as it arrives
+	noRanges = true
+
+	download, err = NewHTTPReader(location, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reader, err = NewDecryptReader(download, &options); err == nil {
+		decrypted, err = io.ReadAll(reader)
+	}
+
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Error("could not decrypt a file from a server without ranges: ", err)
+	}
+
+	// Presigned URLs keep their signature out of errors
+	if _, err := NewHTTPReader(server.URL+"/artifacts/missing.enc?token=secret", &options); err == nil || !strings.Contains(err.Error(), "404") || strings.Contains(err.Error(), "secret") {
+		t.Error("expected a missing file to be reported without the query: ", err)
+	}
+
+	offline := options
+	offline.Offline = true
+
+	if _, err := NewHTTPReader(location, &offline); !errors.Is(err, ErrOffline) {
+		t.Error("expected a server to be refused offline: ", err)
+	}
+
+	for _, contentRange := range []string{"", "bytes 0-0/*", "bytes 5-2/10", "bytes 0-10/10", "items 0-0/10"} {
+		if _, _, _, err := parseContentRange(contentRange); err == nil {
+			t.Errorf("expected Content-Range %q to be refused", contentRange)
+		}
+	}
+}
+
+func Test_AzureKeyVault(t *testing.T) {
+	// Entra ID, the instance metadata service and the vault itself
+	var vaultRequests int
+	var denied bool
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/tenant/oauth2/v2.0/token":
+			if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_secret") != "s3cret" || r.FormValue("scope") != "https://127.0.0.1/.default" {
+				http.Error(w, `{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided"}`, http.StatusUnauthorized)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"access_token": "client-secret-token", "expires_in": 3599}`))
+		case r.URL.Path == "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.FormValue("resource") != "https://127.0.0.1" {
+				http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"access_token": "managed-identity-token", "expires_in": "86399"}`))
+		case strings.HasPrefix(r.URL.Path, "/keys/nightly"):
+			vaultRequests++
+
+			var request map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&request)
+
+			if denied || !strings.HasSuffix(r.Header.Get("Authorization"), "-token") || request["alg"] != "RSA-OAEP-256" || r.FormValue("api-version") == "" {
+				http.Error(w, `{"error": {"code": "Forbidden", "message": "The user does not have keys unwrapKey permission on key vault 'acme-backups'"}}`, http.StatusForbidden)
+				return
+			}
+
+			// Wrapping is a reversible stand-in, what matters is what goes where
+			value, _ := base64.RawURLEncoding.DecodeString(request["value"])
+			switch r.URL.Path {
+			case "/keys/nightly/wrapkey":
+				_ = json.NewEncoder(w).Encode(map[string]string{"kid": server.URL + "/keys/nightly/v1", "value": base64.RawURLEncoding.EncodeToString(append([]byte("kv:"), value...))})
+			case "/keys/nightly/v1/unwrapkey":
+				_ = json.NewEncoder(w).Encode(map[string]string{"kid": server.URL + "/keys/nightly/v1", "value": base64.RawURLEncoding.EncodeToString(bytes.TrimPrefix(value, []byte("kv:")))})
+			default:
+				http.NotFound(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defaultClient, defaultHosts, defaultAuthority, defaultIMDS := keyServiceHTTPClient, azureKeyVaultHosts, azureAuthorityHost, azureIMDSEndpoint
+	keyServiceHTTPClient, azureKeyVaultHosts, azureAuthorityHost, azureIMDSEndpoint = server.Client(), []string{"127.0.0.1"}, server.URL+"/", server.URL+"/metadata/identity/oauth2/token"
+	defer func() {
+		keyServiceHTTPClient, azureKeyVaultHosts, azureAuthorityHost, azureIMDSEndpoint = defaultClient, defaultHosts, defaultAuthority, defaultIMDS
+	}()
+
+	resetTokens := func() {
+		azureTokens.tokens = nil
+	}
+	defer resetTokens()
+
+	keyID := server.URL + "/keys/nightly"
+
+	original := filepath.Join(getTestFilesDirectory(), "small.txt")
+	encrypted := filepath.Join(t.TempDir(), "kv.enc")
+	decrypted := filepath.Join(t.TempDir(), "kv.dec")
+
+	_, publicKey, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptOptions := Options{ChunkSizeMB: 1, AzureKeyVaultKeys: []string{keyID}, X25519Recipients: []string{publicKey}, ForceOperation: true}
+	decryptOptions := Options{ForceOperation: true}
+
+	// A service principal's client secret, then a managed identity
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "backup-pipeline")
+	t.Setenv("AZURE_CLIENT_SECRET", "s3cret")
+	t.Setenv("IDENTITY_ENDPOINT", "")
+	resetTokens()
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal("could not use a client secret: ", err)
+	}
+
+	// The stanza names the version that wrapped
+	header, err := ReadHeader(encrypted)
+	if err != nil || len(header.Recipients) != 2 || header.Recipients[1].Type != RecipientTypeAzureKeyVault || header.Recipients[1].Args[0] != keyID+"/v1" {
+		t.Error("unexpected header for a file encrypted to Key Vault: ", header, err)
+	}
+
+	t.Setenv("AZURE_CLIENT_ID", "")
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+	resetTokens()
+
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if err != nil || azureTokens.tokens["https://127.0.0.1"].token != "managed-identity-token" {
+		t.Fatal("could not use a managed identity: ", err)
+	}
+
+	// The token is reused rather than asked for again
+	requestsBefore := vaultRequests
+
+	err = Verify(encrypted, &decryptOptions)
+	if err != nil || vaultRequests != requestsBefore+1 {
+		t.Error("expected a second job to reuse the token: ", err)
+	}
+
+	// Azure's reasons for refusing are passed on
+	denied = true
+
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if err == nil || !strings.Contains(err.Error(), "unwrapKey permission") {
+		t.Error("expected a denied unwrap to say why: ", err)
+	}
+
+	denied = false
+
+	t.Setenv("AZURE_CLIENT_ID", "backup-pipeline")
+	t.Setenv("AZURE_CLIENT_SECRET", "wrong")
+	resetTokens()
+
+	err = Encrypt(original, encrypted, &encryptOptions)
+	if err == nil || !strings.Contains(err.Error(), "AADSTS7000215") {
+		t.Error("expected a wrong client secret to say why: ", err)
+	}
+
+	// Tokens only go to Key Vault hosts, never to one a file names
+	for _, key := range []string{"https://attacker.example.com/keys/nightly", "http://127.0.0.1/keys/nightly", server.URL + "/secrets/nightly", "nightly"} {
+		if err := Encrypt(original, encrypted, &Options{AzureKeyVaultKeys: []string{key}, ForceOperation: true}); err == nil {
+			t.Error("expected a key identifier to be refused: ", key)
+		}
+	}
+
+	if err := Encrypt(original, encrypted, &Options{AzureKeyVaultKeys: []string{keyID}, Offline: true, ForceOperation: true}); !errors.Is(err, ErrOffline) {
+		t.Error("expected Key Vault to be refused offline: ", err)
+	}
+
+	t.Setenv("AZURE_CLIENT_SECRET", "s3cret")
+	resetTokens()
+
+	if err := Encrypt(original, encrypted, &Options{AzureKeyVaultKeys: []string{keyID}, FIPS: true, ForceOperation: true}); err != nil {
+		t.Error("expected FIPS mode to allow Key Vault: ", err)
+	}
+
+	azureKeyVaultHosts = defaultHosts
+
+	if key, err := parseAzureKeyVaultKey("https://acme-backups.vault.azure.net/keys/nightly/"); err != nil || key.resource != "https://vault.azure.net" {
+		t.Error("expected a Key Vault key identifier to be accepted: ", key, err)
+	}
+
+	if key, err := parseAzureKeyVaultKey("https://acme.managedhsm.azure.net/keys/nightly/0123"); err != nil || key.resource != "https://managedhsm.azure.net" {
+		t.Error("expected a Managed HSM key identifier to be accepted: ", key, err)
+	}
+}
+
+func Test_PKCS11(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed to stand in for a token")
+	}
+
+	// A stand-in for pkcs11-tool, with openssl holding the token's private key
+	token := t.TempDir()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	publicDER, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+
+	err = os.WriteFile(filepath.Join(token, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(token, "key.der"), publicDER, 0600)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := `#!/bin/sh
+echo "$@" >> "` + token + `/calls"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--read-object) operation=read ;;
+	--decrypt) operation=decrypt ;;
+	--type) type="$2"; shift ;;
+	--pin) pin="$2"; shift ;;
+	--input-file) input="$2"; shift ;;
+	--output-file) output="$2"; shift ;;
+	esac
+	shift
+done
+if [ "$operation" = read ]; then
+	[ "$type" = pubkey ] && cp "` + token + `/key.der" "$output"
+	exit $?
+fi
+if [ "$pin" != "env:ENCRYPTOR_PKCS11_PIN" ] || [ "$ENCRYPTOR_PKCS11_PIN" != "1234" ]; then
+	echo "error: PKCS11 function C_Login failed: rv = CKR_PIN_INCORRECT (0xa0)" >&2
+	exit 1
+fi
+exec openssl pkeyutl -decrypt -inkey "` + token + `/key.pem" -pkeyopt rsa_padding_mode:oaep -pkeyopt rsa_oaep_md:sha256 -pkeyopt rsa_mgf1_md:sha256 -in "$input" -out "$output"
+`
+
+	err = os.WriteFile(filepath.Join(token, "pkcs11-tool"), []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultBinary := pkcs11ToolBinary
+	pkcs11ToolBinary = filepath.Join(token, "pkcs11-tool")
+	defer func() {
+		pkcs11ToolBinary = defaultBinary
+	}()
+
+	keyURI := "pkcs11:token=Backup%20HSM;object=nightly;id=%01%a0?module-path=/usr/lib/softhsm/libsofthsm2.so"
+
+	original := filepath.Join(getTestFilesDirectory(), "small.txt")
+	encrypted := filepath.Join(t.TempDir(), "pkcs11.enc")
+	decrypted := filepath.Join(t.TempDir(), "pkcs11.dec")
+
+	var prompts int
+	encryptOptions := Options{ChunkSizeMB: 1, PKCS11Keys: []string{keyURI}, ForceOperation: true}
+	decryptOptions := Options{ForceOperation: true, PKCS11Module: "/usr/lib/vendor/pkcs11.so", PromptSecret: func(prompt string) (string, error) {
+		prompts++
+		return "1234", nil
+	}}
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil || prompts != 1 {
+		t.Fatal("could not encrypt to and decrypt with a PKCS#11 key: ", err, prompts)
+	}
+
+	// The header names the key without the module, the token is logged in to for the PIN prompted for
+	fingerprint, _ := rsaKeyFingerprint(&privateKey.PublicKey)
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || len(header.Recipients) != 1 || header.Recipients[0].Type != RecipientTypePKCS11 ||
+		header.Recipients[0].Args[0] != "pkcs11:token=Backup%20HSM;object=nightly;id=%01%a0" || header.Recipients[0].Args[1] != fingerprint {
+		t.Error("unexpected header for a file encrypted to a PKCS#11 key: ", header, err)
+	}
+
+	calls, _ := os.ReadFile(filepath.Join(token, "calls"))
+	if !strings.Contains(string(calls), "--module /usr/lib/softhsm/libsofthsm2.so --token-label Backup HSM --label nightly --id 01a0 --read-object") ||
+		!strings.Contains(string(calls), "--module /usr/lib/vendor/pkcs11.so --token-label Backup HSM --label nightly --id 01a0 --login --decrypt --mechanism RSA-PKCS-OAEP") ||
+		strings.Contains(string(calls), "1234") {
+		t.Error("unexpected pkcs11-tool calls: ", string(calls))
+	}
+
+	// A PIN given is not prompted for, and the token's refusal is passed on
+	err = Decrypt(encrypted, decrypted, &Options{ForceOperation: true, PKCS11PIN: "1234"})
+	if err != nil {
+		t.Error("could not decrypt with a PIN given: ", err)
+	}
+
+	err = Decrypt(encrypted, decrypted, &Options{ForceOperation: true, PKCS11PIN: "0000"})
+	if err == nil || !strings.Contains(err.Error(), "CKR_PIN_INCORRECT") {
+		t.Error("expected a wrong PIN to say why: ", err)
+	}
+
+	if err := Encrypt(original, encrypted, &Options{PKCS11Keys: []string{keyURI}, FIPS: true, ForceOperation: true}); err != nil {
+		t.Error("expected FIPS mode to allow PKCS#11 keys: ", err)
+	}
+
+	// A bare label names the key, a PIN never goes in a URI
+	if key, err := parsePKCS11Key("nightly"); err != nil || key.String() != "pkcs11:object=nightly" {
+		t.Error("expected a label to name a key: ", key, err)
+	}
+
+	for _, key := range []string{"pkcs11:token=backups", "pkcs11:object=nightly?pin-value=1234", "pkcs11:object=nightly;type=cert", "pkcs11:slot-id=0;object=nightly", ""} {
+		if _, err := parsePKCS11Key(key); err == nil {
+			t.Error("expected a PKCS#11 key to be refused: ", key)
+		}
+	}
+}
+
+func Test_TPM2(t *testing.T) {
+	// Stand-ins for tpm2-tools, the PCRs are a file and the seal is kept as it was given
+	tpm := t.TempDir()
+
+	scripts := map[string]string{
+		"createprimary": `echo primary > "$c"`,
+		"createpolicy":  `echo "$l $(cat ` + tpm + `/pcrs)" > "$L"`,
+		"create":        `[ -f "$C" ] || exit 1; cat "${L:-/dev/null}" > ` + tpm + `/policy; printf '\000\004seal' > "$u"; cat > "$r"`,
+		"load":          `[ -f "$C" ] || exit 1; cat "$r" > "$c"`,
+		"unseal":        `if [ -s ` + tpm + `/policy ] && [ "pcr:$(cat ` + tpm + `/policy)" != "$p $(cat ` + tpm + `/pcrs)" ]; then echo "ERROR: Esys_Unseal(0x99D) - tpm:session(1):a policy check failed" >&2; exit 1; fi; cp "$c" "$o"`,
+	}
+
+	for command, body := range scripts {
+		script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do case \"$1\" in --*) ;; -*) name=$(echo \"$1\" | tr -d -); eval \"$name=\\\"\\$2\\\"\"; shift ;; esac; shift; done\n" + body + "\n"
+
+		err := os.WriteFile(filepath.Join(tpm, "tpm2_"+command), []byte(script), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.WriteFile(filepath.Join(tpm, "pcrs"), []byte("firmware-1"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultPrefix := tpm2ToolsPrefix
+	tpm2ToolsPrefix = filepath.Join(tpm, "tpm2_")
+	defer func() {
+		tpm2ToolsPrefix = defaultPrefix
+	}()
+
+	original := filepath.Join(getTestFilesDirectory(), "small.txt")
+	encrypted := filepath.Join(t.TempDir(), "tpm.enc")
+	decrypted := filepath.Join(t.TempDir(), "tpm.dec")
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &Options{ChunkSizeMB: 1, TPMSeal: true, ForceOperation: true}, &Options{ForceOperation: true})
+	if err != nil {
+		t.Fatal("could not seal to and unseal with the TPM: ", err)
+	}
+
+	// Bound to PCRs, the seal holds until they change
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &Options{ChunkSizeMB: 1, TPMSeal: true, TPMPCRs: "7,0,7", ForceOperation: true}, &Options{ForceOperation: true})
+	if err != nil {
+		t.Fatal("could not seal to and unseal with PCRs: ", err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || len(header.Recipients) != 1 || header.Recipients[0].Type != RecipientTypeTPM2 || !reflect.DeepEqual(header.Recipients[0].Args, []string{"sha256:7,0"}) {
+		t.Error("unexpected header for a file sealed to the TPM: ", header, err)
+	}
+
+	err = os.WriteFile(filepath.Join(tpm, "pcrs"), []byte("firmware-2"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt(encrypted, decrypted, &Options{ForceOperation: true})
+	if err == nil || !strings.Contains(err.Error(), "PCRs sha256:7,0 may have changed") || !strings.Contains(err.Error(), "policy check failed") {
+		t.Error("expected a changed PCR to keep the file sealed: ", err)
+	}
+
+	if err := Encrypt(original, encrypted, &Options{TPMSeal: true, FIPS: true, ForceOperation: true}); err == nil {
+		t.Error("expected FIPS mode to refuse sealing to the TPM")
+	}
+
+	for _, pcrs := range []string{"24", "0,x", "-1"} {
+		if _, err := parseTPMPCRs(pcrs); err == nil {
+			t.Error("expected PCRs to be refused: ", pcrs)
+		}
+	}
+}
+
+func Test_Plugins(t *testing.T) {
+	// The plugin is this test binary again, running Test_PluginHelper
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := t.TempDir()
+	script := "#!/bin/sh\nENCRYPTOR_TEST_PLUGIN=1 exec '" + executable + "' -test.run='^Test_PluginHelper$'\n"
+
+	err = os.WriteFile(filepath.Join(bin, "encryptor-plugin-toy"), []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultPath := os.Getenv("PATH")
+	_ = os.Setenv("PATH", bin+string(os.PathListSeparator)+defaultPath)
+	defer func() {
+		_ = os.Setenv("PATH", defaultPath)
+	}()
+
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "plugin.enc")
+	decrypted := filepath.Join(tempDir, "plugin.dec")
+
+	data := writeRandomFile(t, original, 2*bytesFromMB(1)+1000)
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1, Cipher: "toy:xchacha", ForceOperation: true}, &Options{KeyHex: testKeyHex, ForceOperation: true})
+	if err != nil {
+		t.Fatal("could not encrypt and decrypt with a plugin cipher: ", err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || header.Algorithm != "plugin:toy" || header.Mode != "xchacha" || header.KeySize != 256 {
+		t.Error("unexpected header for a plugin cipher: ", header, err)
+	}
+
+	// The declared nonce and tag are the whole overhead of a chunk
+	inspection, err := Inspect(encrypted)
+	if err != nil || inspection.Cipher != "toy:xchacha" || inspection.PayloadBytes != int64(len(data))+3*(24+16) {
+		t.Error("unexpected inspection of a plugin cipher's file: ", inspection, err)
+	}
+
+	err = Decrypt(encrypted, decrypted, &Options{KeyHex: strings.Repeat("00", 32), ForceOperation: true})
+	if err == nil || !strings.Contains(err.Error(), "could not decrypt the data using the provided key material") {
+		t.Error("expected the wrong key to fail to open a plugin cipher's chunks: ", err)
+	}
+
+	// Recipients of the plugin, alongside one of ours
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &Options{ChunkSizeMB: 1, PluginRecipients: []string{"toy:alice"}, ForceOperation: true}, &Options{ForceOperation: true})
+	if err != nil {
+		t.Fatal("could not encrypt to and decrypt as a plugin recipient: ", err)
+	}
+
+	header, err = ReadHeader(encrypted)
+	if err != nil || len(header.Recipients) != 1 || header.Recipients[0].Type != RecipientTypePlugin || !reflect.DeepEqual(header.Recipients[0].Args, []string{"toy", encodePluginArg([]byte("alice"))}) {
+		t.Error("unexpected header for a plugin recipient: ", header, err)
+	}
+
+	found := false
+	for _, cipher := range GetCapabilities().Ciphers {
+		found = found || cipher.Name == "toy:xchacha" && cipher.NonceSizeBytes == 24 && cipher.TagSizeBytes == 16 && !cipher.FIPSApproved
+	}
+
+	if !found {
+		t.Error("expected capabilities to list the started plugin's cipher")
+	}
+
+	refused := map[string]*Options{
+		"a plugin that is not installed":         {KeyHex: testKeyHex, Cipher: "missing:xchacha", ForceOperation: true},
+		"a cipher the plugin does not have":      {KeyHex: testKeyHex, Cipher: "toy:aes-ocb", ForceOperation: true},
+		"a plugin recipient without a plugin":    {PluginRecipients: []string{"alice"}, ForceOperation: true},
+		"a plugin cipher in FIPS mode":           {KeyHex: testKeyHex, Cipher: "toy:xchacha", FIPS: true, ForceOperation: true},
+		"a plugin recipient in FIPS mode":        {PluginRecipients: []string{"toy:alice"}, FIPS: true, ForceOperation: true},
+		"a recipient the plugin refuses to wrap": {PluginRecipients: []string{"toy:nobody"}, ForceOperation: true},
+	}
+
+	for name, options := range refused {
+		if err := Encrypt(original, encrypted, options); err == nil {
+			t.Error("expected encrypting to be refused for ", name)
+		}
+	}
+
+	frames := []pluginFrame{
+		{command: "hello", args: []string{"1"}},
+		{command: "ok", body: bytes.Repeat([]byte{7}, 200)},
+	}
+
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	for _, frame := range frames {
+		if err := writePluginFrame(writer, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := bufio.NewReader(&buffer)
+	for _, frame := range frames {
+		read, err := readPluginFrame(reader)
+		if err != nil || read.command != frame.command || len(read.args) != len(frame.args) || !bytes.Equal(read.body, frame.body) {
+			t.Error("a frame did not read back as it was written: ", read, err)
+		}
+	}
+
+	for _, broken := range []string{"ok\n\n", "-> ok\n" + strings.Repeat("A", 65) + "\n", "-> ok\n!!!\n", "-> ok\n" + strings.Repeat("A", 64) + "\n"} {
+		if _, err := readPluginFrame(bufio.NewReader(strings.NewReader(broken))); err == nil {
+			t.Errorf("expected %q to be refused as a frame", broken)
+		}
+	}
+}
+
+// Run by Test_Plugins as encryptor-plugin-toy, XChaCha20-Poly1305 under another name and recipients keyed by their names
+func Test_PluginHelper(t *testing.T) {
+	if os.Getenv("ENCRYPTOR_TEST_PLUGIN") == "" {
+		t.Skip("only run as a plugin by Test_Plugins")
+	}
+
+	reader, writer := bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout)
+	answer := func(command string, args []string, body []byte) {
+		_ = writePluginFrame(writer, pluginFrame{command: command, args: args, body: body})
+	}
+
+	for {
+		frame, err := readPluginFrame(reader)
+		if err != nil {
+			os.Exit(0)
+		}
+
+		switch frame.command {
+		case "hello":
+			answer("cipher", []string{"xchacha", "256", "24", "16"}, nil)
+			answer("recipients", nil, nil)
+			answer("done", nil, nil)
+		case "seal", "open":
+			key, _ := decodePluginArg(frame.args[1])
+			nonce, _ := decodePluginArg(frame.args[2])
+			additionalData, _ := decodePluginArg(frame.args[3])
+
+			aead, err := chacha20poly1305.NewX(key)
+			if err != nil {
+				answer("error", nil, []byte(err.Error()))
+			} else if frame.command == "seal" {
+				answer("ok", nil, aead.Seal(nil, nonce, frame.body, additionalData))
+			} else if plaintext, err := aead.Open(nil, nonce, frame.body, additionalData); err == nil {
+				answer("ok", nil, plaintext)
+			} else {
+				answer("fail", nil, nil)
+			}
+		case "wrap", "unwrap":
+			// Keyed by the recipient's name, with a fixed nonce - file keys are random, and this is a toy
+			name, _ := decodePluginArg(frame.args[0])
+			key := sha256.Sum256(name)
+			aead, _ := chacha20poly1305.New(key[:])
+			nonce := make([]byte, aead.NonceSize())
+
+			if string(name) == "nobody" {
+				answer("fail", nil, nil)
+			} else if frame.command == "wrap" {
+				answer("ok", frame.args, aead.Seal(nil, nonce, frame.body, nil))
+			} else if fileKey, err := aead.Open(nil, nonce, frame.body, nil); err == nil {
+				answer("ok", nil, fileKey)
+			} else {
+				answer("fail", nil, nil)
+			}
+		default:
+			answer("error", nil, []byte("no such command "+frame.command))
+		}
+	}
+}
+
+func Test_Offline(t *testing.T) {
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	defaultClient := recipientsHTTPClient
+	recipientsHTTPClient = server.Client()
+	defer func() {
+		recipientsHTTPClient = defaultClient
+	}()
+
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filepath.Join(t.TempDir(), "offline.enc")
+	decrypted := filepath.Join(t.TempDir(), "offline.dec")
+
+	options := Options{ChunkSizeMB: 1, RecipientsFiles: []string{server.URL + "/alice.keys"}, ForceOperation: true, Offline: true}
+
+	err := Encrypt(original, encrypted, &options)
+	if !errors.Is(err, ErrOffline) {
+		t.Error("expected a recipients URL to be refused offline: ", err)
+	}
+
+	_, err = NewEncryptWriter(io.Discard, &options)
+	if !errors.Is(err, ErrOffline) {
+		t.Error("expected a recipients URL to be refused offline by a stream: ", err)
+	}
+
+	if requests != 0 {
+		t.Error("offline mode touched the network ", requests, " times")
+	}
+
+	// Nothing that stays on the machine is affected
+	keyOptions := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, ForceOperation: true, Offline: true}
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &keyOptions, &keyOptions)
+	if err != nil {
+		t.Error("offline mode refused an encryption with a key: ", err)
+	}
+
+	args := gpgArgs(true, "--decrypt")
+	if args[0] != "--disable-dirmngr" || args[len(args)-1] != "--decrypt" {
+		t.Error("gpg is not kept from the network offline: ", args)
+	}
+}
+
+func Test_Streams(t *testing.T) {
+	options := Options{
+		KeyHex:        testKeyHex,
+		ChunkSizeMB:   1,
+		ChunkChecksum: true,
+	}
+
+	chunkSize := int(bytesFromMB(1))
+
+	// Empty, tiny, exactly one chunk (followed by an empty final chunk), and several chunks
+	for _, size := range []int{0, 1, chunkSize, chunkSize*2 + chunkSize/2} {
+		plaintext := make([]byte, size)
+		_, _ = rand.Read(plaintext)
+
+		var stream bytes.Buffer
+
+		writer, err := NewEncryptWriter(&stream, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Odd sized writes so chunks are assembled from several of them
+		for remaining := plaintext; len(remaining) > 0; {
+			portion := remaining
+			if len(portion) > 100000 {
+				portion = remaining[:100000]
+			}
+
+			_, err = writer.Write(portion)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remaining = remaining[len(portion):]
+		}
+
+		err = writer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encrypted := stream.Bytes()
+
+		reader, err := NewDecryptReader(bytes.NewReader(encrypted), &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decrypted, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("stream of ", size, " bytes did not round trip: ", err)
+		}
+
+		// Cutting a stream at a chunk boundary must not go unnoticed
+		if size >= chunkSize {
+			header, endOfHeader, err := readEncryptedFileHeader(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encryptedChunkSize := int(header.ChunkSizeBytes + chunkOverheadBytes(&header))
+			payloadSize := len(encrypted) - endOfHeader - int(footerSizeBytes(&header))
+			cut := endOfHeader + payloadSize - payloadSize%encryptedChunkSize
+
+			reader, err = NewDecryptReader(bytes.NewReader(encrypted[:cut]), &options)
+			if err == nil {
+				_, err = io.ReadAll(reader)
+			}
+
+			if err == nil || !strings.Contains(err.Error(), "truncated") {
+				t.Error("truncated stream of ", size, " bytes was not detected: ", err)
+			}
+		}
+	}
+
+	// Streams written to disk decrypt as files, and files decrypt as streams
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	streamed := filepath.Join(t.TempDir(), "streamed.enc")
+	decrypted := filepath.Join(t.TempDir(), "streamed.dec")
+
+	source, err := os.Open(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(source)
+
+	target, err := os.Create(streamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewEncryptWriter(target, &options)
+	if err == nil {
+		_, err = io.Copy(writer, source)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = target.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt(streamed, decrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalData, err := os.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decryptedData, err := os.ReadFile(decrypted)
+	if err != nil || !bytes.Equal(originalData, decryptedData) {
+		t.Fatal("streamed file did not decrypt as a file: ", err)
+	}
+
+	encryptedFile := filepath.Join(t.TempDir(), "file.enc")
+	err = Encrypt(original, encryptedFile, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(encryptedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	reader, err := NewDecryptReader(file, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decryptedData, err = io.ReadAll(reader)
+	if err != nil || !bytes.Equal(originalData, decryptedData) {
+		t.Fatal("file did not decrypt as a stream: ", err)
+	}
+}
+
+func Test_BandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("0:00-6:00=unlimited, 22:00-1:00=1MB, 10MB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows are checked in order, so the overlap just after midnight is unlimited
+	rates := map[string]int64{"00:30": 0, "05:59": 0, "06:00": 10 * 1024 * 1024, "12:00": 10 * 1024 * 1024, "23:00": 1024 * 1024}
+	for clock, expected := range rates {
+		moment, _ := time.ParseInLocation("15:04", clock, time.Local)
+		if rate := schedule.rateAt(moment); rate != expected {
+			t.Error("rate at ", clock, " expected ", expected, " got ", rate)
+		}
+	}
+
+	// The day clocks go forward is 23 hours long, 6:30 is still past the 6:00 window
+	if newYork, err := time.LoadLocation("America/New_York"); err == nil {
+		moment := time.Date(2026, time.March, 8, 6, 30, 0, 0, newYork)
+		if rate := schedule.rateAt(moment); rate != 10*1024*1024 {
+			t.Error("rate at 6:30 on a daylight saving day expected ", 10*1024*1024, " got ", rate)
+		}
+	}
+
+	for _, invalid := range []string{"10MB,20MB", "6:00=1MB", "25:00-1:00=1MB", "0:00-6:00=fast"} {
+		if _, err := ParseBandwidthSchedule(invalid); err == nil {
+			t.Error("expected an error parsing bandwidth schedule ", invalid)
+		}
+	}
+
+	// Three 1MB chunks (the last is the empty final chunk) at 8MB/s, only the first may burst
+	options := Options{
+		KeyHex:      testKeyHex,
+		ChunkSizeMB: 1,
+		Bandwidth:   BandwidthSchedule{DefaultBytesPerSecond: 8 * 1024 * 1024},
+	}
+
+	start := time.Now()
+
+	writer, err := NewEncryptWriter(io.Discard, &options)
+	if err == nil {
+		_, err = writer.Write(make([]byte, bytesFromMB(2)))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Error("bandwidth limit was not applied, 2MB at 8MB/s took ", elapsed)
+	}
+}
+
+func Test_MaxOutputSize(t *testing.T) {
+	original := filepath.Join(getTestFilesDirectory(), "small.txt")
+	encrypted := filepath.Join(t.TempDir(), "limited.enc")
+	decrypted := filepath.Join(t.TempDir(), "limited.dec")
+
+	signingKey, _, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKeyFile := filepath.Join(t.TempDir(), "signing.key")
+
+	err = os.WriteFile(signingKeyFile, []byte(signingKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything that adds to a file's size, so the size worked out beforehand is checked against all of it
+	encryptOptions := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, ChunkChecksum: true, StoreKeyCheck: true, HeaderCopy: true, ChunkMarkers: true, SigningKey: signingKeyFile}
+	decryptOptions := Options{KeyHex: testKeyHex}
+
+	err = Encrypt(original, encrypted, &encryptOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedStats, err := os.Stat(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalStats, err := os.Stat(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exactly at the limit is allowed, a byte over is refused before the target is created
+	exact := encryptOptions
+	exact.MaxOutputBytes = encryptedStats.Size()
+	exact.ForceOperation = true
+
+	err = Encrypt(original, encrypted, &exact)
+	if err != nil {
+		t.Error("expected a target exactly at the limit to be written: ", err)
+	}
+
+	over := filepath.Join(t.TempDir(), "over.enc")
+
+	exact.MaxOutputBytes--
+	err = Encrypt(original, over, &exact)
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Error("expected a target over the limit to be refused: ", err)
+	}
+
+	if _, err := os.Stat(over); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written when the limit is exceeded: ", err)
+	}
+
+	decryptOptions.MaxOutputBytes = originalStats.Size()
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if err != nil {
+		t.Error("expected a plaintext exactly at the limit to be written: ", err)
+	}
+
+	decryptOptions.MaxOutputBytes--
+	decryptOptions.ForceOperation = true
+	_ = os.Remove(decrypted)
+
+	err = Decrypt(encrypted, decrypted, &decryptOptions)
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Error("expected a plaintext over the limit to be refused: ", err)
+	}
+
+	if _, err := os.Stat(decrypted); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written when the limit is exceeded: ", err)
+	}
+
+	// Verifying writes nothing, so there is nothing to limit
+	if err := Verify(encrypted, &decryptOptions); err != nil {
+		t.Error("expected verification to ignore the output limit: ", err)
+	}
+
+	// Streams fail as the write that would go over is attempted
+	data, err := os.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1, MaxOutputBytes: int64(len(data))})
+	if err == nil {
+		_, err = writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+	}
+
+	if !errors.Is(err, ErrOutputTooLarge) || int64(stream.Len()) > int64(len(data)) {
+		t.Error("expected an encrypted stream over the limit to fail: ", err, stream.Len())
+	}
+
+	stream.Reset()
+
+	writer, err = NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &Options{KeyHex: testKeyHex, MaxOutputBytes: int64(len(data)) - 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := io.Copy(io.Discard, reader)
+	if !errors.Is(err, ErrOutputTooLarge) || read >= int64(len(data)) {
+		t.Error("expected a decrypted stream over the limit to fail: ", err, read)
+	}
+
+	for size, expected := range map[string]int64{"1024": 1024, "500MB": 500 << 20, "2TB": 2 << 40, "1.5 GB": 3 << 29, "64kb": 64 << 10, "100G": 100 << 30} {
+		if parsed, err := ParseByteSize(size); err != nil || parsed != expected {
+			t.Error("unexpected byte size for ", size, ": ", parsed, err)
+		}
+	}
+
+	for _, size := range []string{"", "-1MB", "lots", "99999999TB"} {
+		if _, err := ParseByteSize(size); err == nil {
+			t.Error("expected an invalid byte size to be refused: ", size)
+		}
+	}
+}
+
+func Test_MemoryBound(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	writeRandomFile(t, original, bytesFromMB(6)+12345)
+
+	// 4MB chunks cannot fit an 8MB bound, so the chunk size and workers must be lowered
+	var report MemoryReport
+
+	encryptOptions := Options{
+		KeyHex:       testKeyHex,
+		ChunkSizeMB:  4,
+		Readers:      4,
+		Executors:    4,
+		MaxMemoryMB:  8,
+		MemoryReport: &report,
+
+		MemorySampleInterval: time.Millisecond,
+	}
+
+	decryptOptions := encryptOptions
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.BoundBytes != uint64(bytesFromMB(8)) || report.ChunkSizeMB != 1 || report.Readers != 1 || report.PeakHeapBytes == 0 {
+		t.Error("unexpected memory report: ", report)
+	}
+
+	// The runtime collected against the bound, and was put back afterwards
+	if runtimeMemoryLimitSupported && report.Runtime.SoftLimitBytes != uint64(bytesFromMB(8)) {
+		t.Error("expected the bound to be the runtime's soft memory limit: ", report.Runtime)
+	}
+
+	if report.Runtime.GCPercent < minimumGCPercent || setRuntimeMemoryLimit(-1) < bytesFromMB(8) {
+		t.Error("unexpected runtime settings during or after the job: ", report.Runtime, setRuntimeMemoryLimit(-1))
+	}
+
+	// Decrypting 6MB allocates at least that much, and the final sample is always taken
+	if report.TotalAllocBytes < uint64(bytesFromMB(6)) || len(report.Samples) == 0 || report.Elapsed == 0 {
+		t.Error("memory report is missing statistics: ", report.TotalAllocBytes, " bytes allocated, ", len(report.Samples), " samples")
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || header.ChunkSizeBytes != bytesFromMB(1) || header.NumChunks != 7 {
+		t.Error("expected the file to be written with 1MB chunks: ", header, err)
+	}
+
+	// Decryption cannot change the chunk size, so a bound too small for it is an error
+	decryptOptions.MaxMemoryMB = 2
+	decryptOptions.ForceOperation = true
+
+	if err = Decrypt(encrypted, decrypted, &decryptOptions); err == nil {
+		t.Error("expected an error decrypting under a bound smaller than a chunk")
+	}
+}
+
+func Test_Prefetch(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	writeRandomFile(t, original, bytesFromMB(5)+777)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		Executors:      3,
+		PrefetchChunks: 2,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Under a bound the window is capped by the budget, deeper than fits must still finish
+	options.PrefetchChunks = PrefetchDepthMax
+	options.MaxMemoryMB = 8
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads slower than executors need a deeper window, faster reads need almost none
+	if depth := prefetchDepth(40*time.Millisecond, 10*time.Millisecond, PrefetchDepthMax); depth != 5 {
+		t.Error("expected a depth of 5 for reads 4 times slower than executors, got ", depth)
+	}
+
+	if depth := prefetchDepth(time.Millisecond, 10*time.Millisecond, PrefetchDepthMax); depth != 2 {
+		t.Error("expected a depth of 2 for fast reads, got ", depth)
+	}
+
+	if depth := prefetchDepth(time.Second, time.Millisecond, 6); depth != 6 {
+		t.Error("expected the depth to be capped, got ", depth)
+	}
+}
+
+func Test_HeadFirst(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(9)+333)
+
+	encryptOptions := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		ForceOperation: true,
+	}
+
+	decryptOptions := encryptOptions
+	decryptOptions.Readers = 2
+	decryptOptions.Executors = 3
+	decryptOptions.BatchChunks = 4
+	decryptOptions.WriteBufferKB = 4096
+	decryptOptions.HeadFirst = true
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Into a pipe, which only takes what its reader has read, so the head is read while the rest decrypts
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decryptErr := make(chan error, 1)
+	go func() {
+		decryptErr <- DecryptToFile(encrypted, writer, &decryptOptions)
+		_ = writer.Close()
+	}()
+
+	head := make([]byte, bytesFromMB(1))
+	if _, err := io.ReadFull(reader, head); err != nil || !bytes.Equal(head, data[:len(head)]) {
+		t.Error("expected the first chunk to be readable from the pipe: ", err)
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(append(head, rest...), data) {
+		t.Error("expected the whole plaintext through the pipe: ", err)
+	}
+
+	if err := <-decryptErr; err != nil {
+		t.Error("decrypting into a pipe failed: ", err)
+	}
+
+	_ = reader.Close()
+
+	// Two chunks in flight per worker, a pool's workers being the workers
+	if window := headFirstWindow(&pipelineJob{NumReaders: 2, NumExecutors: 3}); window != 10 {
+		t.Error("expected a window of 10 chunks, not ", window)
+	}
+
+	if window := headFirstWindow(&pipelineJob{NumReaders: 2, NumExecutors: 3, PoolWorkers: 4}); window != 8 {
+		t.Error("expected a window of 8 chunks with a pool, not ", window)
+	}
+
+	// Encryption has nothing to put first
+	job, err := newPipelineJob(Encryption, original, encrypted, withDefaults(decryptOptions, original))
+	if err != nil || job.HeadFirst {
+		t.Error("expected head first to be for decryption only: ", err)
+	}
+}
+
+func Test_WorkerPool(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	writeRandomFile(t, original, bytesFromMB(7)+4321)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		Readers:        1,
+		Executors:      4,
+		PoolWorkers:    4,
+		ChunkChecksum:  true,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A budget of a few chunks must not starve the writer
+	options.MaxMemoryMB = 8
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file written by the pool reads back with separate workers, and a corrupt chunk is still caught
+	options.PoolWorkers = 0
+
+	err = Decrypt(encrypted, decrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedData, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedData[len(encryptedData)/2] ^= 0xff
+	err = os.WriteFile(encrypted, encryptedData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options.PoolWorkers = 3
+	if err = Decrypt(encrypted, decrypted, &options); err == nil {
+		t.Error("expected the pool to report a corrupt chunk")
+	}
+
+	options.PrefetchChunks = 2
+	if err = Decrypt(encrypted, decrypted, &options); err == nil {
+		t.Error("expected an error combining the prefetch stage and a worker pool")
+	}
+}
+
+func Test_ScaleExecutors(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(9)+1234)
+
+	var report MemoryReport
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		Executors:      6,
+		BatchChunks:    2,
+		ScaleExecutors: true,
+		MemoryReport:   &report,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Scaling) == 0 || report.Scaling[0].Executors != 3 {
+		t.Error("expected the job to start half of 6 executors, got ", report.Scaling)
+	}
+
+	// A budget of a few chunks lowers the cap, and the prefetch stage still feeds the executors
+	options.MaxMemoryMB = 8
+	options.PrefetchChunks = 2
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options.PrefetchChunks = 0
+	options.PoolWorkers = 4
+	if err = Encrypt(original, encrypted, &options); err == nil {
+		t.Error("expected an error combining scaling executors and a worker pool")
+	}
+
+	// Every executor parked but the first, the job still finishes
+	scaler := newExecutorScaler(true, 5, 2, 1)
+	if batch, ok := scaler.next(1); !ok || batch != 1 {
+		t.Error("expected the first executor to claim batch 1, got ", batch)
+	}
+
+	scaler.next(1)
+	scaler.next(1)
+	if _, ok := scaler.next(2); ok {
+		t.Error("expected no batch once all 3 were claimed")
+	}
+
+	// Chunks read and not yet claimed are what the stage is sampled on
+	scaler = newExecutorScaler(true, 8, 1, 4)
+	scaler.begin()
+
+	executeChannels := make([]chan *[]byte, 8)
+	writeChannels := make([]chan *[]byte, 8)
+	for i := range executeChannels {
+		executeChannels[i] = make(chan *[]byte, 1)
+		writeChannels[i] = make(chan *[]byte, 1)
+	}
+
+	for i := 0; i < 4; i++ {
+		executeChannels[i] <- &data
+	}
+
+	time.Sleep(time.Millisecond)
+	scaler.sample(executeChannels, writeChannels)
+
+	decisions := scaler.decisionsMade()
+	if len(decisions) != 2 || decisions[1].Executors != 3 || decisions[1].ReadQueue != 4 {
+		t.Error("expected an executor added for 4 chunks waiting, got ", decisions)
+	}
+
+	sample := scalingSample{active: 2, maxWorkers: 4, batchChunks: 2}
+
+	sample.readQueue = 4
+	if change, _ := scalingStep(sample); change != 1 {
+		t.Error("expected an executor added while reads wait, got ", change)
+	}
+
+	sample.hold = 1
+	if change, _ := scalingStep(sample); change != 0 {
+		t.Error("expected no executor added while holding, got ", change)
+	}
+
+	sample.hold, sample.readQueue, sample.waitFraction = 0, 0, 0.8
+	if change, _ := scalingStep(sample); change != -1 {
+		t.Error("expected an executor parked while executors wait on reads, got ", change)
+	}
+
+	sample.waitFraction, sample.writeQueue = 0, 8
+	if change, _ := scalingStep(sample); change != -1 {
+		t.Error("expected an executor parked while the writer is behind, got ", change)
+	}
+
+	sample.writeQueue, sample.readQueue, sample.grewFrom, sample.chunksPerSecond = 0, 4, 100, 101
+	if change, _ := scalingStep(sample); change != -1 {
+		t.Error("expected the last executor added to be parked when throughput did not rise, got ", change)
+	}
+
+	sample.active = 1
+	if change, _ := scalingStep(sample); change != 1 {
+		t.Error("expected one executor never to be parked, got ", change)
+	}
+}
+
+func Test_ChunkBinding(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	other := filepath.Join(tempDir, "other")
+	tampered := filepath.Join(tempDir, "tampered")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(3)+100)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same plaintext under the same key, only the file ID differs
+	err = Encrypt(original, other, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, endOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || header.FormatVersion != "1.16" || header.ChunkAAD != ChunkAADHeaderIndex || len(header.FileID) != int(FileIDSize) {
+		t.Fatal("expected a header binding its chunks: ", header, err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+	otherData, _ := os.ReadFile(other)
+	chunkSize := int(header.ChunkSizeBytes + chunkOverheadBytes(&header))
+
+	chunk := func(data []byte, i int) []byte {
+		return data[endOfHeader+i*chunkSize : endOfHeader+(i+1)*chunkSize]
+	}
+
+	tamperings := map[string]func() []byte{
+		"reordered": func() []byte {
+			result := append([]byte{}, encryptedData...)
+			copy(chunk(result, 0), chunk(encryptedData, 1))
+			copy(chunk(result, 1), chunk(encryptedData, 0))
+			return result
+		},
+		"duplicated": func() []byte {
+			result := append([]byte{}, encryptedData...)
+			copy(chunk(result, 1), chunk(encryptedData, 0))
+			return result
+		},
+		"swapped between files": func() []byte {
+			result := append([]byte{}, encryptedData...)
+			copy(chunk(result, 2), chunk(otherData, 2))
+			return result
+		},
+		"header chunk count changed": func() []byte {
+			forged := header
+			forged.NumChunks--
+			headerBytes, _ := getCompleteEncryptedFileHeaderAsBytes(&forged)
+			return append(headerBytes, encryptedData[endOfHeader:endOfHeader+3*chunkSize]...)
+		},
+	}
+
+	for name, tamper := range tamperings {
+		err = os.WriteFile(tampered, tamper(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = Decrypt(tampered, decrypted, &options); err == nil {
+			t.Error("expected decryption to fail for chunks ", name)
+		}
+	}
+
+	// Streams have no chunk count to bind, they bind which chunk is final instead
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: options.KeyHex, ChunkSizeMB: 1})
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(plaintext, data) {
+		t.Fatal("bound stream did not round trip: ", err)
+	}
+
+	// Files from before 1.8 sealed chunks without AAD and must still decrypt
+	legacyHeader := EncryptedFileHeader{FormatVersion: "1.0", NumChunks: 1, ChunkSizeBytes: bytesFromMB(1), Algorithm: "AES", Mode: "GCM", KeySize: 256}
+	legacyData, _ := getCompleteEncryptedFileHeaderAsBytes(&legacyHeader)
+
+	key, _ := hex.DecodeString(options.KeyHex)
+	plainChunk := []byte("sealed without additional data")
+
+	sealed, err := encryptBlob(AES, GCM, &plainChunk, key, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(tampered, append(legacyData, *sealed...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Decrypt(tampered, decrypted, &options)
+	if err != nil {
+		t.Fatal("a file from before chunk binding did not decrypt: ", err)
+	}
+
+	if decryptedData, _ := os.ReadFile(decrypted); !bytes.Equal(decryptedData, plainChunk) {
+		t.Error("a file from before chunk binding decrypted incorrectly")
+	}
+}
+
+func Test_Footer(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	tampered := filepath.Join(tempDir, "tampered")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(2)+100)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, endOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || header.Footer != FooterHMACSHA256 || header.FormatVersion != "1.16" {
+		t.Fatal("expected a 1.16 header with a footer: ", header, err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+	footerSize := int(footerSizeBytes(&header))
+	chunkSize := int(header.ChunkSizeBytes + chunkOverheadBytes(&header))
+
+	// A forged header can drop the last chunk from the count, only the footer still knows it was there
+	forged := header
+	forged.NumChunks--
+	forged.digest = nil
+	forgedHeader, _ := getCompleteEncryptedFileHeaderAsBytes(&forged)
+
+	tamperings := map[string][]byte{
+		"missing its footer":          encryptedData[:len(encryptedData)-footerSize],
+		"with a changed footer":       append(append([]byte{}, encryptedData[:len(encryptedData)-1]...), encryptedData[len(encryptedData)-1]^0xff),
+		"cut on a chunk boundary":     append(append([]byte{}, encryptedData[:endOfHeader+2*chunkSize]...), encryptedData[len(encryptedData)-footerSize:]...),
+		"with its chunk count forged": append(append([]byte{}, forgedHeader...), encryptedData[endOfHeader:endOfHeader+2*chunkSize]...),
+		"shorter than a footer":       encryptedData[:endOfHeader+footerSize-1],
+	}
+
+	for name, tamperedData := range tamperings {
+		err = os.WriteFile(tampered, tamperedData, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = os.Remove(decrypted)
+		if err = Decrypt(tampered, decrypted, &options); err == nil {
+			t.Error("expected decryption to fail for a file ", name)
+		}
+
+		// Whatever was decrypted before the footer failed is gone with it
+		if _, err = os.Stat(decrypted); !os.IsNotExist(err) {
+			t.Error("expected no target to be left by a file ", name, err)
+		}
+
+		if partials, _ := filepath.Glob(filepath.Join(tempDir, ".*.partial")); len(partials) > 0 {
+			t.Error("expected no partial files to be left by a file ", name, partials)
+		}
+
+		reader, err := NewDecryptReader(bytes.NewReader(tamperedData), &options)
+		if err == nil {
+			_, err = io.ReadAll(reader)
+		}
+
+		if err == nil {
+			t.Error("expected stream decryption to fail for a file ", name)
+		}
+	}
+
+	// Streams end with a footer too, and one cut off before it is truncated
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: options.KeyHex, ChunkSizeMB: 1})
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(plaintext, data) {
+		t.Fatal("stream with a footer did not round trip: ", err)
+	}
+
+	reader, err = NewDecryptReader(bytes.NewReader(stream.Bytes()[:stream.Len()-footerSize]), &options)
+	if err == nil {
+		_, err = io.ReadAll(reader)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Error("a stream missing its footer was not detected: ", err)
+	}
+
+	// A stream written to disk is checked against its footer as a file
+	err = os.WriteFile(tampered, stream.Bytes(), 0600)
+	if err == nil {
+		err = Decrypt(tampered, decrypted, &options)
+	}
+	if err != nil {
+		t.Fatal("a stream with a footer did not decrypt as a file: ", err)
+	}
+}
+
+func Test_PlaintextDigest(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(2)+100)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || len(header.PlaintextHash) == 0 || header.FormatVersion != "1.16" {
+		t.Fatal("expected a 1.16 header with a plaintext digest: ", header, err)
+	}
+
+	// The digest is sealed, only the key opens it, and it is the hash --hash prints
+	if bytes.Contains(header.PlaintextHash, sha256Sum(data)) {
+		t.Error("the plaintext digest is stored in the clear")
+	}
+
+	key, _ := hex.DecodeString(options.KeyHex)
+
+	digest, err := openPlaintextDigest(&header, key)
+	if err != nil || !bytes.Equal(digest, sha256Sum(data)) {
+		t.Fatal("the sealed digest is not the SHA256 of the plaintext: ", err)
+	}
+
+	if _, err = openPlaintextDigest(&header, make([]byte, 32)); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected the digest not to open with the wrong key: ", err)
+	}
+
+	if err = verifyPlaintextDigest(digest, sha256Sum(data[1:])); !errors.Is(err, ErrPlaintextMismatch) {
+		t.Error("expected a mismatch to be reported: ", err)
+	}
+
+	// Files read as streams are checked too
+	source, err := os.Open(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(source)
+
+	reader, err := NewDecryptReader(source, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(plaintext, data) {
+		t.Fatal("a file with a plaintext digest did not decrypt as a stream: ", err)
+	}
+
+	// Skipping the extra read of the source leaves the digest out, and the version down
+	options.SkipSourceHash = true
+
+	err = encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, err = getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || len(header.PlaintextHash) != 0 || header.FormatVersion != "1.16" {
+		t.Error("expected a 1.16 header without a plaintext digest: ", header, err)
+	}
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func Test_Verify(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	tampered := filepath.Join(tempDir, "tampered")
+
+	writeRandomFile(t, original, bytesFromMB(3)+100)
+
+	options := Options{
+		KeyHex:      testKeyHex,
+		ChunkSizeMB: 1,
+	}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Verify(encrypted, &options)
+	if err != nil {
+		t.Fatal("an intact file did not verify: ", err)
+	}
+
+	// Nothing is written, not even next to the source
+	entries, _ := os.ReadDir(tempDir)
+	if len(entries) != 2 {
+		t.Error("verification wrote files: ", entries)
+	}
+
+	// Every way of running the read and execute stages verifies the same
+	for name, workers := range map[string]Options{"pool": {PoolWorkers: 3}, "prefetch": {PrefetchChunks: 2}, "bounded": {MaxMemoryMB: 8}} {
+		workers.KeyHex = options.KeyHex
+
+		if err = Verify(encrypted, &workers); err != nil {
+			t.Error("an intact file did not verify with ", name, ": ", err)
+		}
+	}
+
+	if err = Verify(encrypted, &Options{KeyHex: strings.Repeat("00", 32)}); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected verification with the wrong key to fail authentication: ", err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+
+	for name, tamperedData := range map[string][]byte{
+		"a flipped bit": append(append(append([]byte{}, encryptedData[:len(encryptedData)/2]...), encryptedData[len(encryptedData)/2]^0x01), encryptedData[len(encryptedData)/2+1:]...),
+		"truncation":    encryptedData[:len(encryptedData)-1],
+	} {
+		err = os.WriteFile(tampered, tamperedData, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = Verify(tampered, &options); err == nil {
+			t.Error("expected verification to fail for ", name)
+		}
+
+		if err = VerifyReader(bytes.NewReader(tamperedData), &options); err == nil {
+			t.Error("expected stream verification to fail for ", name)
+		}
+	}
+
+	if err = VerifyReader(bytes.NewReader(encryptedData), &options); err != nil {
+		t.Error("an intact stream did not verify: ", err)
+	}
+}
+
+func Test_VerifyMedia(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	streamed := filepath.Join(tempDir, "streamed")
+	tampered := filepath.Join(tempDir, "tampered")
+	progressFilename := filepath.Join(tempDir, "progress.json")
+
+	data := writeRandomFile(t, original, bytesFromMB(4)+100)
+
+	options := Options{
+		Password:    "correct horse battery staple",
+		ChunkSizeMB: 1,
+	}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	writer, err := NewEncryptWriter(&stream, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = writer.Write(data)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(streamed, stream.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media := MediaVerificationOptions{ProgressFilename: progressFilename}
+
+	for _, fileName := range []string{encrypted, streamed} {
+		certificate, err := VerifyMedia(fileName, &media, &options)
+		if err != nil || !certificate.Verified {
+			t.Fatal("an intact file did not verify: ", fileName, err)
+		}
+
+		hash, _ := hashFile(fileName)
+		if certificate.SHA256 != hash || certificate.NumChunks != 5 || !certificate.Footer || certificate.Runs != 1 {
+			t.Error("unexpected certificate: ", certificate)
+		}
+
+		if _, err = os.Stat(progressFilename); !os.IsNotExist(err) {
+			t.Error("the progress file was left behind by a verification that finished")
+		}
+	}
+
+	// Stopped after two chunks, as if the disc was ejected, the next run picks up from there
+	file, err := os.Open(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, _ := file.Stat()
+	source := &mediaReader{file: file, hash: sha256.New()}
+
+	reader, err := NewDecryptReader(source, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = reader.openChunk(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	started := time.Now().Add(-time.Hour)
+	progress := mediaVerificationProgress{FileName: encrypted, FileSizeBytes: info.Size(), ModTime: info.ModTime(), HeaderDigest: reader.header.digest, Started: started, Runs: 1}
+
+	err = saveMediaProgress(progressFilename, &progress, source, reader)
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := VerifyMedia(encrypted, &media, &options)
+	hash, _ := hashFile(encrypted)
+	if err != nil || certificate.Runs != 2 || !certificate.Started.Equal(started) || certificate.SHA256 != hash || certificate.NumChunks != 5 {
+		t.Error("a resumed verification did not finish as if it had never stopped: ", certificate, err)
+	}
+
+	// The plaintext hash's state is sealed, and opens only with the file's key
+	savedProgress := progress
+	err = saveMediaProgress(progressFilename, &savedProgress, source, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progressData, _ := os.ReadFile(progressFilename)
+	plaintextState, _ := reader.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if bytes.Contains(progressData, []byte(base64.StdEncoding.EncodeToString(plaintextState))) {
+		t.Error("the plaintext hash's state was saved in the clear")
+	}
+
+	wrongKey := Options{KeyHex: testKeyHex}
+	if _, err = VerifyMedia(encrypted, &media, &wrongKey); err == nil {
+		t.Error("expected an error verifying with the wrong key")
+	}
+
+	// Progress for a file that has since changed is not used
+	_ = os.Remove(progressFilename)
+	err = saveMediaProgress(progressFilename, &savedProgress, source, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(encrypted, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err = VerifyMedia(encrypted, &media, &options)
+	if err != nil || certificate.Runs != 1 {
+		t.Error("progress was resumed for a file that changed: ", certificate, err)
+	}
+
+	// A failed check is reported in the certificate, and is not resumed from
+	encryptedData, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedData[len(encryptedData)/2] ^= 0xff
+	if err = os.WriteFile(tampered, encryptedData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	media.SaveInterval = time.Nanosecond
+	certificate, err = VerifyMedia(tampered, &media, &options)
+	if err == nil || certificate.Verified || certificate.Error == "" || certificate.SHA256 != "" {
+		t.Error("a tampered file verified: ", certificate)
+	}
+
+	if _, err = os.Stat(progressFilename); !os.IsNotExist(err) {
+		t.Error("the progress of a verification that failed its check was kept")
+	}
+}
+
+func Test_Recover(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	recovered := filepath.Join(tempDir, "recovered")
+
+	chunkSize := bytesFromMB(1)
+	data := writeRandomFile(t, original, 4*chunkSize+chunkSize/2)
+
+	// What should come back, with the third chunk damaged
+	expected := append([]byte(nil), data...)
+	copy(expected[2*chunkSize:3*chunkSize], make([]byte, chunkSize))
+	expectedLost := []RecoveredRange{{Offset: 2 * chunkSize, Length: chunkSize}}
+
+	for _, checksum := range []bool{false, true} {
+		options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, ChunkChecksum: checksum, ForceOperation: true}
+
+		err := Encrypt(original, encrypted, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, endOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encryptedData, err := os.ReadFile(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		overhead := int64(AESNonceSize + AESTagSize)
+		if checksum {
+			overhead += int64(CRC32CSize)
+		}
+
+		encryptedData[int64(endOfHeader)+2*(chunkSize+overhead)+1000] ^= 0x01
+
+		// The header intact, only the damaged chunk is lost
+		err = os.WriteFile(encrypted, encryptedData, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := Recover(encrypted, recovered, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !report.HeaderIntact || report.Authentication != RecoveryByHeader || report.NumChunks != 5 || report.ChunksRecovered != 4 || !reflect.DeepEqual(report.Lost, expectedLost) {
+			t.Errorf("unexpected recovery with the header intact: %+v", report)
+		}
+
+		if recoveredData, err := os.ReadFile(recovered); err != nil || !bytes.Equal(recoveredData, expected) {
+			t.Error("the chunks recovered with the header intact are not where they belong: ", err)
+		}
+
+		// The header destroyed, found again from the key and the guesses
+		copy(encryptedData, make([]byte, endOfHeader))
+
+		err = os.WriteFile(encrypted, encryptedData, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = Decrypt(encrypted, recovered, &options); err == nil {
+			t.Fatal("a file without its header decrypted")
+		}
+
+		report, err = Recover(encrypted, recovered, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.HeaderIntact || report.Authentication != RecoveryByConsistentAAD || report.FirstChunkOffset != int64(endOfHeader) || report.ChunksRecovered != 4 || !reflect.DeepEqual(report.Lost, expectedLost) {
+			t.Errorf("unexpected recovery with the header destroyed (checksums %v): %+v", checksum, report)
+		}
+
+		if recoveredData, err := os.ReadFile(recovered); err != nil || !bytes.Equal(recoveredData, expected) {
+			t.Error("the chunks recovered without the header are not where they belong: ", err)
+		}
+
+		// The wrong key finds nothing (after a whole scan, once is enough)
+		if checksum {
+			continue
+		}
+
+		wrongKey := Options{KeyHex: strings.Repeat("00", 32), ChunkSizeMB: 1, ForceOperation: true}
+		if _, err = Recover(encrypted, recovered, &wrongKey); !errors.Is(err, ErrNothingRecovered) {
+			t.Error("expected ErrNothingRecovered for the wrong key, got: ", err)
+		}
+	}
+
+	// Streams end on a short final chunk the same way
+	var stream bytes.Buffer
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = writer.Write(data)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	streamed := stream.Bytes()
+	copy(streamed, make([]byte, 100))
+
+	err = os.WriteFile(encrypted, streamed, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Recover(encrypted, recovered, &Options{KeyHex: testKeyHex, ChunkSizeMB: 1, ForceOperation: true})
+	if err != nil || report.ChunksRecovered != report.NumChunks || len(report.Lost) != 0 {
+		t.Errorf("a stream without its header was not recovered: %+v %v", report, err)
+	}
+
+	if recoveredData, err := os.ReadFile(recovered); err != nil || !bytes.Equal(recoveredData, data) {
+		t.Error("a stream recovered without its header is not the original: ", err)
+	}
+
+	// Other ciphers authenticate each chunk with its own key, without the header there is nothing to agree on
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, Cipher: "XChaCha20-Poly1305", ForceOperation: true}
+
+	err = Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedData, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(encryptedData, make([]byte, 50))
+
+	err = os.WriteFile(encrypted, encryptedData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Recover(encrypted, recovered, &options); !errors.Is(err, ErrNothingRecovered) {
+		t.Error("expected ErrNothingRecovered for XChaCha20-Poly1305 without its header, got: ", err)
+	}
+}
+
+func Test_ChunkMarkers(t *testing.T) {
+	tempDir := t.TempDir()
+	scrubDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(scrubDir, "encrypted.enc")
+	decrypted := filepath.Join(tempDir, "decrypted")
+	recovered := filepath.Join(tempDir, "recovered")
+
+	chunkSize := bytesFromMB(1)
+	data := writeRandomFile(t, original, 4*chunkSize+chunkSize/2)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		ChunkMarkers:   true,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, endOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || header.ChunkMarkers != ChunkMarkersMagicIndex || header.FormatVersion != "1.16" {
+		t.Fatal("expected a 1.16 header with chunk markers: ", header, err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+	encryptedChunkSizeBytes := chunkSize + chunkOverheadBytes(&header)
+	secondChunk := endOfHeader + int(encryptedChunkSizeBytes)
+
+	// Streams write and check markers too
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = writer.Write(data)
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamed, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(streamed, data) {
+		t.Fatal("could not read back a stream with chunk markers: ", err)
+	}
+
+	// A marker naming another chunk is corruption, found by decryption and by scrub without the key
+	misplaced := append([]byte{}, encryptedData...)
+	binary.BigEndian.PutUint32(misplaced[secondChunk+len(chunkMarkerMagic):], 3)
+
+	err = os.WriteFile(encrypted, misplaced, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Verify(encrypted, &options)
+	if !errors.Is(err, ErrFileCorrupt) {
+		t.Error("expected a misplaced marker to be corruption: ", err)
+	}
+
+	report, err := Scrub(scrubDir, &ScrubOptions{SamplePercent: 100})
+	if err != nil || len(report.Failed) != 1 {
+		t.Error("scrub did not find a misplaced marker: ", report, err)
+	}
+
+	// Bytes lost from the second chunk move every chunk after it, markers find them again
+	expected := append([]byte(nil), data...)
+	copy(expected[chunkSize:2*chunkSize], make([]byte, chunkSize))
+	expectedLost := []RecoveredRange{{Offset: chunkSize, Length: chunkSize}}
+
+	shifted := append(append([]byte{}, encryptedData[:secondChunk+1000]...), encryptedData[secondChunk+2000:]...)
+
+	for _, headerIntact := range []bool{true, false} {
+		if !headerIntact {
+			copy(shifted, make([]byte, endOfHeader))
+		}
+
+		err = os.WriteFile(encrypted, shifted, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recovery, err := Recover(encrypted, recovered, &options)
+		if err != nil {
+			t.Fatal("could not recover with the header intact ", headerIntact, ": ", err)
+		}
+
+		if recovery.HeaderIntact != headerIntact || recovery.ChunksRecovered != 4 || recovery.NumChunks != 5 || !reflect.DeepEqual(recovery.Lost, expectedLost) {
+			t.Error("unexpected recovery with the header intact ", headerIntact, ": ", recovery)
+		}
+
+		recoveredData, _ := os.ReadFile(recovered)
+		if !bytes.Equal(recoveredData, expected) {
+			t.Error("recovered data does not match with the header intact ", headerIntact)
+		}
+	}
+}
+
+func Test_WriteBuffer(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "medium.txt"
+
+	// Vectored (where supported) and buffered writes must write the same file, however often they sync
+	fsyncPolicies := []string{"", FsyncEnd, FsyncFlush}
+
+	for i, writeBufferKB := range []uint{0, 4, 1024} {
+		fsync := fsyncPolicies[i]
+		encrypted := filepath.Join(t.TempDir(), "buffered.enc")
+		decrypted := filepath.Join(t.TempDir(), "buffered.dec")
+
+		encryptOptions := Options{
+			Password:       "write buffer",
+			ChunkSizeMB:    1,
+			ChunkChecksum:  true,
+			CloudChecksums: true,
+			ChunkMarkers:   true,
+			HeaderCopy:     true,
+			WriteBufferKB:  writeBufferKB,
+			Fsync:          fsync,
+		}
+
+		decryptOptions := Options{Password: "write buffer", WriteBufferKB: writeBufferKB, Fsync: fsync}
+
+		err := encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+		if err != nil {
+			t.Fatal(writeBufferKB, "KB: ", err)
+		}
+
+		report, err := Scrub(filepath.Dir(encrypted), &ScrubOptions{})
+		if err != nil || len(report.Failed) != 0 || len(report.Passed) != 1 {
+			t.Error(writeBufferKB, "KB: expected the file and its cloud checksums to scrub clean: ", report, err)
+		}
+	}
+
+	err := Encrypt(original, filepath.Join(t.TempDir(), "unknown.enc"), &Options{Password: "write buffer", Fsync: "sometimes"})
+	if err == nil {
+		t.Error("expected an unknown fsync policy to be refused")
+	}
+
+	// Everything is written, and seen by the observers, in order - however the kernel splits it, and however often it is flushed
+	segments := [][]byte{[]byte("header"), chunkMarker(1), bytes.Repeat([]byte{'a'}, 100000), []byte("footer")}
+	for i := uint32(2); i < 2*maxGatherSegments; i++ {
+		segments = append(segments, chunkMarker(i), bytes.Repeat([]byte{byte(i)}, 1000))
+	}
+
+	expected := bytes.Join(segments, nil)
+
+	for _, bufferKB := range []uint{0, 1} {
+		file, err := os.Create(filepath.Join(t.TempDir(), "segments"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		observer := sha256.New()
+		writer := newChunkWriter(file, []io.Writer{observer}, bufferKB, FsyncNever)
+
+		for _, segment := range segments {
+			_, err = writer.Write(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = writer.Flush()
+		_ = file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		written, err := os.ReadFile(file.Name())
+		if err != nil || !bytes.Equal(written, expected) {
+			t.Error(bufferKB, "KB: the segments were not written in order: ", len(written), err)
+		}
+
+		expectedDigest := sha256.Sum256(expected)
+		if !bytes.Equal(observer.Sum(nil), expectedDigest[:]) {
+			t.Error(bufferKB, "KB: the observer did not see every segment in order")
+		}
+	}
+
+	remaining := advanceSegments([][]byte{[]byte("ab"), []byte("cde"), []byte("f")}, 3)
+	if len(remaining) != 2 || string(remaining[0]) != "de" || string(remaining[1]) != "f" {
+		t.Error("unexpected segments left after a short write: ", remaining)
+	}
+}
+
+func Test_CryptoAcceleration(t *testing.T) {
+	acceleration := GetCryptoAcceleration()
+	if acceleration.Architecture != runtime.GOARCH || acceleration.AESGCMHardware != (acceleration.AES && acceleration.CarrylessMultiply) {
+		t.Error("unexpected crypto acceleration: ", acceleration)
+	}
+
+	software := CryptoAcceleration{}
+	aesOnly := CryptoAcceleration{AES: true}
+	hardware := CryptoAcceleration{AES: true, CarrylessMultiply: true, AESGCMHardware: true}
+
+	for _, test := range []struct {
+		acceleration CryptoAcceleration
+		cipher       string
+		fallback     bool
+	}{
+		{software, "", true},
+		{software, "AES-256-GCM", true},
+		{software, "AES-256-GCM-SIV", true},
+		{software, "XChaCha20-Poly1305", false},
+		{software, "no such cipher", false},
+		{aesOnly, "aes-256-gcm", true},
+		{aesOnly, "AES-256-GCM-SIV", false},
+		{hardware, "", false},
+		{hardware, "AES-256-GCM-SIV", false},
+	} {
+		if test.acceleration.SoftwareFallback(test.cipher) != test.fallback {
+			t.Error("unexpected software fallback for ", test.cipher, " with ", test.acceleration)
+		}
+	}
+}
+
+func Test_Preview(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(3)+100)
+
+	options := Options{
+		KeyHex:      testKeyHex,
+		ChunkSizeMB: 1,
+	}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+
+	var preview bytes.Buffer
+
+	written, err := Preview(bytes.NewReader(encryptedData), &preview, 100, &options)
+	if err != nil || written != 100 || !bytes.Equal(preview.Bytes(), data[:100]) {
+		t.Fatal("the preview is not the start of the plaintext: ", written, err)
+	}
+
+	// Only the chunks the preview needs are read, damage further on goes unseen
+	damaged := append([]byte{}, encryptedData...)
+	damaged[len(damaged)-100] ^= 0xff
+	preview.Reset()
+
+	written, err = Preview(bytes.NewReader(damaged), &preview, bytesFromMB(1)+1, &options)
+	if err != nil || written != bytesFromMB(1)+1 {
+		t.Error("a preview read past the chunks it needed: ", written, err)
+	}
+
+	// A preview longer than the file shows all of it
+	preview.Reset()
+
+	written, err = Preview(bytes.NewReader(encryptedData), &preview, int64(len(data))*2, &options)
+	if err != nil || !bytes.Equal(preview.Bytes(), data) {
+		t.Error("a preview longer than the file did not show all of it: ", written, err)
+	}
+
+	if _, err = Preview(bytes.NewReader(encryptedData), io.Discard, 100, &Options{KeyHex: strings.Repeat("00", 32)}); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected a preview with the wrong key to fail authentication: ", err)
+	}
+
+	if _, err = Preview(bytes.NewReader(encryptedData), io.Discard, 0, &options); err == nil {
+		t.Error("expected an error for an empty preview")
+	}
+}
+
+func Test_Inspect(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(3)+100)
+
+	options := Options{
+		KeyHex:        testKeyHex,
+		ChunkSizeMB:   1,
+		ChunkChecksum: true,
+	}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := Inspect(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inspection.FormatVersion != "1.16" || !inspection.PlaintextRecorded || !inspection.Supported || inspection.Cipher != DefaultCipher || inspection.KeySizeBits != 256 {
+		t.Error("unexpected format or cipher: ", inspection)
+	}
+
+	if inspection.NumChunks != 4 || inspection.ChunkSizeBytes != bytesFromMB(1) || inspection.ChunkChecksum != ChecksumCRC32C {
+		t.Error("unexpected chunk geometry: ", inspection)
+	}
+
+	if inspection.KeySource != KeySourceKeyOrPassword || inspection.Footer != FooterHMACSHA256 || !inspection.PlaintextHash {
+		t.Error("unexpected key source, footer, or plaintext hash: ", inspection)
+	}
+
+	// The sizes account for every byte of the file, and the plaintext is what was encrypted
+	if inspection.HeaderBytes+inspection.PayloadBytes+inspection.FooterBytes != inspection.FileSizeBytes || inspection.PlaintextBytes != int64(len(data)) {
+		t.Error("unexpected sizes: ", inspection)
+	}
+
+	// Nothing but the header and the size is read, the key never enters into it
+	encryptedData, _ := os.ReadFile(encrypted)
+
+	err = os.WriteFile(encrypted, encryptedData[:int64(len(encryptedData))-bytesFromMB(1)], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Inspect(encrypted); err == nil {
+		t.Error("expected an error inspecting a truncated file")
+	}
+
+	if _, err = Inspect(original); !errors.Is(err, ErrNotEncryptedFile) {
+		t.Error("expected inspecting an unencrypted file to fail as not encrypted: ", err)
+	}
+}
+
+func Test_PlaintextSize(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	truncated := filepath.Join(tempDir, "truncated")
+	streamed := filepath.Join(tempDir, "streamed")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(3)+123)
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ChunkSizeMB:    1,
+		ForceOperation: true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || header.PlaintextSize != int64(len(data)) || header.FormatVersion != "1.16" {
+		t.Fatal("expected a 1.16 header recording the plaintext's size: ", header.PlaintextSize, header.FormatVersion, err)
+	}
+
+	// A file cut short inside its last chunk is found before it is decrypted, the footer kept where it was
+	encryptedData, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	footerStart := len(encryptedData) - int(footerSizeBytes(&header))
+	cut := append(append([]byte{}, encryptedData[:footerStart-10]...), encryptedData[footerStart:]...)
+
+	err = os.WriteFile(truncated, cut, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Inspect(truncated); !errors.Is(err, ErrFileCorrupt) {
+		t.Error("expected inspecting a file shorter than its recorded size to find it corrupt, got ", err)
+	}
+
+	if err = Decrypt(truncated, decrypted, &options); !errors.Is(err, ErrFileCorrupt) || !strings.Contains(err.Error(), "header records") {
+		t.Error("expected decrypting a file shorter than its recorded size to fail before decrypting, got ", err)
+	}
+
+	// Recovery sizes the target from the header, a lost last chunk is as long as it was
+	err = os.WriteFile(truncated, encryptedData[:len(encryptedData)-100], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Recover(truncated, decrypted, &options)
+	if err != nil || report.PlaintextBytes != int64(len(data)) || len(report.Lost) != 1 || report.Lost[0].Length != 123 {
+		t.Error("expected the recovered target sized from the header: ", report, err)
+	}
+
+	// Streams do not know their size up front, they are sized from their chunks as files before 1.16 are
+	var stream bytes.Buffer
+	writer, err := NewEncryptWriter(&stream, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = writer.Write(data)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(streamed, stream.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := Inspect(streamed)
+	if err != nil || inspection.PlaintextRecorded || inspection.PlaintextBytes != int64(len(data)) || inspection.FormatVersion == "1.16" {
+		t.Error("expected a stream sized from its chunks: ", inspection, err)
+	}
+
+	err = Decrypt(streamed, decrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A target larger than its filesystem fails before anything is written, where free space can be told
+	if _, ok := freeSpaceBytes(tempDir); ok {
+		if err = checkFreeSpace(decrypted, 1<<62); !errors.Is(err, ErrInsufficientSpace) {
+			t.Error("expected a target too large for its filesystem to be refused, got ", err)
+		}
+
+		if err = checkFreeSpace(decrypted, int64(len(data))); err != nil {
+			t.Error("expected room for a target overwriting one of the same size, got ", err)
+		}
+	}
+}
+
+func Test_WrapEmail(t *testing.T) {
+	data := make([]byte, bytesFromMB(1)+100)
+	_, _ = rand.Read(data)
+
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1}
+	email := EmailOptions{To: []string{"Zoë <zoe@example.com>"}, AttachmentName: "résumé 2024.pdf.enc"}
+
+	var wrapped bytes.Buffer
+
+	err := WrapEmail(bytes.NewReader(data), &wrapped, &email, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Gateways only ever see 7 bit lines no longer than mail allows
+	for _, line := range strings.Split(wrapped.String(), "\r\n") {
+		if len(line) > 998 || strings.IndexFunc(line, func(r rune) bool { return r > 0x7e }) >= 0 {
+			t.Fatal("the email has a line that is too long or not 7 bit: ", line)
+		}
+	}
+
+	message, err := mail.ReadMessage(&wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Header.Get("X-Unsent") != "1" || !strings.Contains(message.Header.Get("To"), "zoe@example.com") {
+		t.Error("unexpected email headers: ", message.Header)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatal("unexpected content type: ", mediaType, err)
+	}
+
+	parts := multipart.NewReader(message.Body, params["boundary"])
+
+	var attachment *multipart.Part
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			break
+		}
+
+		if part.FileName() != "" {
+			attachment = part
+			break
+		}
+	}
+
+	if attachment == nil || attachment.FileName() != email.AttachmentName {
+		t.Fatal("the attachment was not found by its name")
+	}
+
+	reader, err := NewDecryptReader(base64.NewDecoder(base64.StdEncoding, attachment), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Error("the attachment did not decrypt to the source: ", err)
+	}
+
+	if err = WrapEmail(bytes.NewReader(data), io.Discard, &EmailOptions{To: []string{"not an address"}}, &options); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+
+	if name := safeAttachmentName("../../etc/passwd\n"); strings.ContainsAny(name, "/\n") {
+		t.Error("an attachment name kept a path or control character: ", name)
+	}
+}
+
+func Test_OpenPGP(t *testing.T) {
+	plaintext := make([]byte, 300000)
+	_, _ = rand.Read(plaintext)
+
+	options := Options{Password: "correct horse battery staple"}
+
+	var message bytes.Buffer
+	err := EncryptOpenPGP(bytes.NewReader(plaintext), &message, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted bytes.Buffer
+	err = DecryptOpenPGP(bytes.NewReader(message.Bytes()), &decrypted, &options)
+	if err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Fatal("an OpenPGP message did not decrypt to what was encrypted: ", err)
+	}
+
+	wrongPassword := Options{Password: "incorrect horse battery staple"}
+	if err = DecryptOpenPGP(bytes.NewReader(message.Bytes()), io.Discard, &wrongPassword); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected ErrAuthenticationFailed for the wrong password, got: ", err)
+	}
+
+	// The integrity check is at the end, a change anywhere is caught once everything is read
+	corrupted := append([]byte(nil), message.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0x01
+
+	if err = DecryptOpenPGP(bytes.NewReader(corrupted), io.Discard, &options); !errors.Is(err, ErrFileCorrupt) {
+		t.Error("expected ErrFileCorrupt for a changed message, got: ", err)
+	}
+
+	if err = DecryptOpenPGP(strings.NewReader("not a message"), io.Discard, &options); !errors.Is(err, ErrNotEncryptedFile) {
+		t.Error("expected ErrNotEncryptedFile for something that is not a message, got: ", err)
+	}
+
+	// Only passwords, and never in FIPS mode
+	for _, refused := range []Options{
+		{KeyHex: testKeyHex},
+		{Password: options.Password, SSHRecipients: []string{"ssh-ed25519 AAAA"}},
+		{Password: options.Password, FIPS: true},
+		{},
+	} {
+		if err = EncryptOpenPGP(bytes.NewReader(plaintext), io.Discard, &refused); err == nil {
+			t.Error("expected an OpenPGP message to be refused for options: ", refused)
+		}
+	}
+
+	// Told apart from our own files, for the hint when one is decrypted without --openpgp
+	tempDir := t.TempDir()
+	messageFilename := filepath.Join(tempDir, "message.gpg")
+	encrypted := filepath.Join(tempDir, "encrypted")
+
+	err = os.WriteFile(messageFilename, message.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encrypt(messageFilename, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsOpenPGPMessage(messageFilename) || IsOpenPGPMessage(encrypted) {
+		t.Error("OpenPGP messages and encrypted files were not told apart")
+	}
+
+	if _, err := exec.LookPath(gpgBinary); err != nil {
+		t.Skip("gpg is not installed, interoperability with it was not tested")
+	}
+
+	gpgHome := t.TempDir()
+	t.Setenv("GNUPGHOME", gpgHome)
+
+	defer func() {
+		_ = exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+	}()
+
+	// gpg reads ours, and we read what gpg writes with its defaults (compressed, AES-256)
+	gpgDecrypted, err := runGPG(message.Bytes(), "--pinentry-mode", "loopback", "--passphrase", options.Password, "--decrypt")
+	if err != nil || !bytes.Equal(gpgDecrypted, plaintext) {
+		t.Error("gpg did not decrypt our OpenPGP message: ", err)
+	}
+
+	gpgMessage, err := runGPG(plaintext, "--pinentry-mode", "loopback", "--passphrase", options.Password, "--symmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted.Reset()
+	err = DecryptOpenPGP(bytes.NewReader(gpgMessage), &decrypted, &options)
+	if err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Error("a message from gpg --symmetric did not decrypt: ", err)
+	}
+}
+
+func Test_JWE(t *testing.T) {
+	// RFC 3394 4.6, a 256 bit key wrapped with a 256 bit key
+	wrappingKey, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	keyData, _ := hex.DecodeString("00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f")
+	expected, _ := hex.DecodeString("28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21")
+
+	wrapped, err := aesKeyWrap(wrappingKey, keyData)
+	if err != nil || !bytes.Equal(wrapped, expected) {
+		t.Fatal("AES key wrap does not match RFC 3394: ", hex.EncodeToString(wrapped), err)
+	}
+
+	unwrapped, err := aesKeyUnwrap(wrappingKey, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, keyData) {
+		t.Fatal("AES key unwrap did not return the key wrapped: ", err)
+	}
+
+	plaintext := make([]byte, 10000)
+	_, _ = rand.Read(plaintext)
+
+	passwordOptions := Options{Password: "correct horse battery staple"}
+	keyOptions := Options{KeyHex: testKeyHex}
+
+	messages := map[string][]byte{}
+
+	for _, serialization := range []string{JWECompact, JWEJSON} {
+		for name, options := range map[string]*Options{"password": &passwordOptions, "key": &keyOptions} {
+			var message bytes.Buffer
+			err = EncryptJWE(bytes.NewReader(plaintext), &message, serialization, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decrypted bytes.Buffer
+			err = DecryptJWE(bytes.NewReader(message.Bytes()), &decrypted, options)
+			if err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Fatalf("a %s JWE with a %s did not decrypt to what was encrypted: %v", serialization, name, err)
+			}
+
+			messages[serialization+" "+name] = message.Bytes()
+		}
+	}
+
+	compact := messages[JWECompact+" password"]
+	if parts := strings.Split(string(compact), "."); len(parts) != 5 || len(parts[1]) == 0 {
+		t.Fatal("a compact JWE is not five parts with an encrypted key: ", string(compact[:80]))
+	}
+
+	if parts := strings.Split(string(messages[JWECompact+" key"]), "."); len(parts) != 5 || len(parts[1]) != 0 {
+		t.Error("a JWE encrypted with a key directly should have no encrypted key")
+	}
+
+	wrongPassword := Options{Password: "incorrect horse battery staple"}
+	if err = DecryptJWE(bytes.NewReader(compact), io.Discard, &wrongPassword); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected ErrAuthenticationFailed for the wrong password, got: ", err)
+	}
+
+	wrongKey := Options{KeyHex: strings.Repeat("00", 32)}
+	if err = DecryptJWE(bytes.NewReader(messages[JWEJSON+" key"]), io.Discard, &wrongKey); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected ErrAuthenticationFailed for the wrong key, got: ", err)
+	}
+
+	// The password unwrapped the content key, a change to the ciphertext is the message's fault
+	parts := strings.Split(string(compact), ".")
+	ciphertext, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	ciphertext[len(ciphertext)/2] ^= 0x01
+	parts[3] = base64.RawURLEncoding.EncodeToString(ciphertext)
+
+	if err = DecryptJWE(strings.NewReader(strings.Join(parts, ".")), io.Discard, &passwordOptions); !errors.Is(err, ErrFileCorrupt) {
+		t.Error("expected ErrFileCorrupt for a changed JWE, got: ", err)
+	}
+
+	if err = DecryptJWE(strings.NewReader("not a message"), io.Discard, &passwordOptions); !errors.Is(err, ErrNotEncryptedFile) {
+		t.Error("expected ErrNotEncryptedFile for something that is not a JWE, got: ", err)
+	}
+
+	// The general serialization, as JOSE libraries write for several recipients, is read too
+	var flattened map[string]interface{}
+	err = json.Unmarshal(messages[JWEJSON+" password"], &flattened)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flattened["recipients"] = []interface{}{map[string]interface{}{"encrypted_key": flattened["encrypted_key"]}}
+	delete(flattened, "encrypted_key")
+
+	general, _ := json.Marshal(flattened)
+
+	var decrypted bytes.Buffer
+	err = DecryptJWE(bytes.NewReader(general), &decrypted, &passwordOptions)
+	if err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Error("a general JSON JWE did not decrypt: ", err)
+	}
+
+	// A message does not get to choose hours of PBKDF2, or an algorithm we do not write
+	for _, header := range []string{
+		fmt.Sprintf(`{"alg":"%s","enc":"A256GCM","p2s":"QMBDkul1_5NS3yeXaiM8WQ","p2c":%d}`, jweAlgorithmPBES2, jweMaxKDFIterations+1),
+		`{"alg":"PBES2-HS256+A128KW","enc":"A256GCM","p2s":"QMBDkul1_5NS3yeXaiM8WQ","p2c":1000}`,
+		`{"alg":"dir","enc":"A128CBC-HS256"}`,
+		fmt.Sprintf(`{"alg":"%s","enc":"A256GCM","zip":"DEF","p2s":"QMBDkul1_5NS3yeXaiM8WQ","p2c":1000}`, jweAlgorithmPBES2),
+	} {
+		parts = strings.Split(string(compact), ".")
+		parts[0] = base64.RawURLEncoding.EncodeToString([]byte(header))
+
+		err = DecryptJWE(strings.NewReader(strings.Join(parts, ".")), io.Discard, &passwordOptions)
+		if err == nil || errors.Is(err, ErrAuthenticationFailed) {
+			t.Error("expected a JWE to be refused before decrypting for its header: ", header, err)
+		}
+	}
+
+	// Small payloads only, and a password or a key but never recipients
+	if err = EncryptJWE(io.LimitReader(rand.Reader, jweMaxPayloadBytes+1), io.Discard, JWECompact, &keyOptions); err == nil {
+		t.Error("expected a payload over the JWE limit to be refused")
+	}
+
+	for _, refused := range []Options{
+		{KeyHex: keyOptions.KeyHex, Password: passwordOptions.Password},
+		{KeyHex: "e0a8caca"},
+		{Password: passwordOptions.Password, SSHRecipients: []string{"ssh-ed25519 AAAA"}},
+		{},
+	} {
+		if err = EncryptJWE(bytes.NewReader(plaintext), io.Discard, JWECompact, &refused); err == nil {
+			t.Error("expected a JWE to be refused for options: ", refused)
+		}
+	}
+
+	if err = EncryptJWE(bytes.NewReader(plaintext), io.Discard, "xml", &keyOptions); err == nil {
+		t.Error("expected an unknown serialization to be refused")
+	}
+
+	// Told apart from our own files, for the hint when one is decrypted without --jwe
+	tempDir := t.TempDir()
+	encrypted := filepath.Join(tempDir, "encrypted")
+
+	for name, message := range messages {
+		messageFilename := filepath.Join(tempDir, strings.Replace(name, " ", "-", 1)+".jwe")
+
+		err = os.WriteFile(messageFilename, message, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsJWE(messageFilename) {
+			t.Error("a JWE was not recognized: ", name)
+		}
+
+		err = Encrypt(messageFilename, encrypted, &Options{KeyHex: keyOptions.KeyHex, ForceOperation: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if IsJWE(encrypted) {
+			t.Error("an encrypted file was taken for a JWE")
+		}
+	}
+}
+
+func Test_KeyCheck(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	writeRandomFile(t, original, bytesFromMB(2)+100)
+
+	options := Options{
+		KeyHex:        testKeyHex,
+		ChunkSizeMB:   1,
+		StoreKeyCheck: true,
+	}
+	wrongKey := Options{KeyHex: strings.Repeat("00", 32)}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || len(header.KeyCheck) != KeyCheckSize || header.FormatVersion != "1.16" {
+		t.Fatal("expected a 1.16 header with a key check: ", header, err)
+	}
+
+	// A wrong key is named as such, and still matches as an authentication failure
+	err = Decrypt(encrypted, decrypted, &wrongKey)
+	if !errors.Is(err, ErrWrongKey) || !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected a wrong key error: ", err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+
+	if _, err = NewDecryptReader(bytes.NewReader(encryptedData), &wrongKey); !errors.Is(err, ErrWrongKey) {
+		t.Error("expected a wrong key error from a stream: ", err)
+	}
+
+	// With the right key, a chunk that fails to authenticate is corruption
+	damaged := append([]byte{}, encryptedData...)
+	damaged[len(damaged)-100] ^= 0xff
+
+	err = os.WriteFile(encrypted, damaged, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Verify(encrypted, &options)
+	if !errors.Is(err, ErrFileCorrupt) || errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected a corrupt file error: ", err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(damaged), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = io.Copy(io.Discard, reader); !errors.Is(err, ErrFileCorrupt) {
+		t.Error("expected a corrupt file error from a stream: ", err)
+	}
+
+	// Fingerprints are stable for a key or password, and differ between them
+	first, err := KeyFingerprint(&options)
+	if err != nil || len(strings.ReplaceAll(first, " ", "")) != KeyFingerprintSize*2 {
+		t.Fatal("unexpected fingerprint: ", first, err)
+	}
+
+	second, _ := KeyFingerprint(&Options{KeyHex: options.KeyHex})
+	other, _ := KeyFingerprint(&wrongKey)
+	password, _ := KeyFingerprint(&Options{Password: "a password"})
+	passwordAgain, _ := KeyFingerprint(&Options{Password: "a password"})
+
+	if first != second || first == other || password != passwordAgain || password == first {
+		t.Error("fingerprints are not stable or not distinct: ", first, second, other, password, passwordAgain)
+	}
+
+	if _, err = KeyFingerprint(&Options{}); err == nil {
+		t.Error("expected an error fingerprinting no key")
+	}
+}
+
+func Test_HeaderCopy(t *testing.T) {
+	tempDir := t.TempDir()
+	scrubDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(scrubDir, "encrypted.enc")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	data := writeRandomFile(t, original, bytesFromMB(2)+100)
+
+	options := Options{
+		KeyHex:      testKeyHex,
+		ChunkSizeMB: 1,
+		HeaderCopy:  true,
+	}
+
+	err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(encrypted)
+	if err != nil || header.HeaderCopy != HeaderCopyTrailer || header.FormatVersion != "1.16" {
+		t.Fatal("expected a 1.16 header with a copy: ", header, err)
+	}
+
+	scrubOptions := ScrubOptions{SamplePercent: 100}
+
+	report, err := Scrub(scrubDir, &scrubOptions)
+	if err != nil || len(report.Passed) != 1 {
+		t.Fatal("an intact file with a header copy did not scrub: ", report, err)
+	}
+
+	encryptedData, _ := os.ReadFile(encrypted)
+
+	// A destroyed header is read from the copy, a destroyed copy is not needed, scrub reports either
+	for name, offset := range map[string]int{"header": 0, "copy": len(encryptedData) - headerCopyTrailerBytes - 40} {
+		damaged := append([]byte{}, encryptedData...)
+		for i := offset; i < offset+20; i++ {
+			damaged[i] ^= 0xff
+		}
+
+		err = os.WriteFile(encrypted, damaged, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Decrypt(encrypted, decrypted, &Options{KeyHex: options.KeyHex, ForceOperation: true})
+		if err != nil {
+			t.Fatal("could not decrypt with a damaged ", name, ": ", err)
+		}
+
+		decryptedData, _ := os.ReadFile(decrypted)
+		if !bytes.Equal(decryptedData, data) {
+			t.Error("decrypted data does not match with a damaged ", name)
+		}
+
+		inspection, err := Inspect(encrypted)
+		if err != nil || inspection.HeaderFromCopy != (name == "header") || inspection.PayloadBytes+inspection.HeaderBytes+inspection.FooterBytes+inspection.HeaderCopyBytes != int64(len(damaged)) {
+			t.Error("unexpected inspection with a damaged ", name, ": ", inspection, err)
+		}
+
+		report, err = Scrub(scrubDir, &scrubOptions)
+		if err != nil || len(report.Failed) != 1 {
+			t.Error("scrub did not report a damaged ", name, ": ", report, err)
+		}
+	}
+
+	// Streams read the copy past their footer without trying to decrypt it
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = writer.Write(data)
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamed, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(streamed, data) {
+		t.Fatal("could not read back a stream with a header copy: ", err)
+	}
+
+	// And a streamed file is read from its copy like any other
+	damaged := stream.Bytes()
+	copy(damaged, make([]byte, 20))
+
+	err = os.WriteFile(encrypted, damaged, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Verify(encrypted, &options)
+	if err != nil {
+		t.Error("could not verify a streamed file with a damaged header: ", err)
+	}
+}
+
+func Test_KeyFile(t *testing.T) {
+	tempDir := t.TempDir()
+	key, _ := hex.DecodeString(testKeyHex)
+
+	write := func(name string, data []byte) string {
+		fileName := filepath.Join(tempDir, name)
+		if err := os.WriteFile(fileName, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		return fileName
+	}
+
+	keyFiles := map[string][]byte{
+		"raw":      key,
+		"hex":      []byte(testKeyHex),
+		"hex line": []byte(strings.ToUpper(testKeyHex) + "\n"),
+	}
+
+	for name, data := range keyFiles {
+		loaded, err := LoadKeyFile(write(name, data))
+		if err != nil || loaded != testKeyHex {
+			t.Error("the ", name, " key file did not load the key: ", loaded, err)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"short":     key[:16],
+		"short hex": []byte(testKeyHex[:32]),
+		"not hex":   []byte(strings.Repeat("zz", 32)),
+		"large":     make([]byte, 4096),
+		"empty":     {},
+	}
+
+	for name, data := range invalid {
+		if _, err := LoadKeyFile(write(name, data)); err == nil {
+			t.Error("expected an error loading the ", name, " key file")
+		}
+	}
+
+	if _, err := LoadKeyFile(filepath.Join(tempDir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("expected a missing key file to be reported as such: ", err)
+	}
+}
+
+func Test_PasswordFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	write := func(name string, data string) string {
+		fileName := filepath.Join(tempDir, name)
+		if err := os.WriteFile(fileName, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		return fileName
+	}
+
+	passwordFiles := map[string]string{
+		"bare":        "some password",
+		"line":        "some password\n",
+		"crlf":        "some password\r\n",
+		"two lines":   "some password\nsomething else\n",
+		"long second": "some password\n" + strings.Repeat("x", 4096),
+	}
+
+	for name, data := range passwordFiles {
+		loaded, err := LoadPasswordFile(write(name, data))
+		if err != nil || loaded != "some password" {
+			t.Error("the ", name, " password file did not load the password: ", loaded, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"empty":      "",
+		"empty line": "\nsome password\n",
+		"large":      strings.Repeat("x", 4096),
+	}
+
+	for name, data := range invalid {
+		if _, err := LoadPasswordFile(write(name, data)); err == nil {
+			t.Error("expected an error loading the ", name, " password file")
+		}
+	}
+
+	if _, err := LoadPasswordFile(filepath.Join(tempDir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("expected a missing password file to be reported as such: ", err)
+	}
+}
+
+func Test_VerifyRelease(t *testing.T) {
+	tempDir := t.TempDir()
+	binary := filepath.Join(tempDir, "encryptor")
+	manifestFilename := filepath.Join(tempDir, "manifest.json")
+
+	err := os.WriteFile(binary, []byte("a released binary"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, _ := Hash(binary)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, _ := json.Marshal(ReleaseManifest{
+		Version:   "1.2.0",
+		GitCommit: "abc123",
+		Released:  time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		Binaries:  []ReleaseBinary{{Name: "encryptor-linux-amd64", SHA256: digest}},
+	})
+
+	sign := func(data []byte) {
+		_ = os.WriteFile(manifestFilename, data, 0600)
+		_ = os.WriteFile(manifestFilename+".sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data))+"\n"), 0600)
+	}
+
+	sign(manifest)
+
+	// The release key is accepted in either form it is published in
+	sshKey, _ := ssh.NewPublicKey(publicKey)
+	for _, encoded := range []string{base64.StdEncoding.EncodeToString(publicKey), string(ssh.MarshalAuthorizedKey(sshKey))} {
+		releaseKey, err := ParseReleaseKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verification, err := VerifyRelease(binary, manifestFilename, releaseKey)
+		if err != nil || verification.Binary.Name != "encryptor-linux-amd64" || verification.Manifest.Version != "1.2.0" {
+			t.Error("a released binary did not verify: ", verification, err)
+		}
+	}
+
+	// A manifest changed after signing is rejected before it is read
+	_ = os.WriteFile(manifestFilename, append(manifest, ' '), 0600)
+
+	if _, err = VerifyRelease(binary, manifestFilename, publicKey); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Error("expected a changed manifest to fail its signature: ", err)
+	}
+
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	sign(manifest)
+
+	if _, err = VerifyRelease(binary, manifestFilename, otherKey); err == nil {
+		t.Error("expected a manifest signed by another key to fail")
+	}
+
+	// A binary that is not the one released is not listed
+	err = os.WriteFile(binary, []byte("a tampered binary"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = VerifyRelease(binary, manifestFilename, publicKey); err == nil || !strings.Contains(err.Error(), "not one release") {
+		t.Error("expected a tampered binary to fail: ", err)
+	}
+
+	if _, err = ParseReleaseKey("not a key"); err == nil {
+		t.Error("expected an error parsing an invalid release key")
+	}
+}
+
+func Test_InstallReleaseBinary(t *testing.T) {
+	releaseDir := t.TempDir()
+	installDir := t.TempDir()
+	manifestFilename := filepath.Join(releaseDir, "manifest.json")
+	installed := filepath.Join(installDir, "encryptor")
+
+	released := []byte("a newer released binary")
+	name := releaseBinaryName("linux", "amd64")
+
+	err := os.WriteFile(filepath.Join(releaseDir, name), released, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(released)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestData, _ := json.Marshal(ReleaseManifest{
+		Version:  "1.3.0",
+		Binaries: []ReleaseBinary{{Name: name, SHA256: hex.EncodeToString(digest[:])}, {Name: releaseBinaryName("windows", "amd64"), SHA256: "00"}},
+	})
+
+	_ = os.WriteFile(manifestFilename, manifestData, 0600)
+	_ = os.WriteFile(manifestFilename+".sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifestData))), 0600)
+
+	manifest, err := ReadReleaseManifest(manifestFilename, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary, ok := ReleaseBinaryFor(&manifest, "linux", "amd64")
+	if !ok || binary.Name != "encryptor-linux-amd64" {
+		t.Fatal("the manifest's binary for linux/amd64 was not found: ", binary)
+	}
+
+	if _, ok = ReleaseBinaryFor(&manifest, "darwin", "arm64"); ok {
+		t.Error("found a binary for a platform the manifest does not list")
+	}
+
+	// A binary that is not the one released never replaces the installed one
+	err = os.WriteFile(installed, []byte("the installed binary"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := binary
+	tampered.SHA256 = strings.Repeat("0", 64)
+
+	if err = InstallReleaseBinary(installed, manifestFilename, tampered, nil); err == nil || !strings.Contains(err.Error(), "not the binary that was released") {
+		t.Error("expected a binary with the wrong SHA256 to be refused: ", err)
+	}
+
+	if data, _ := os.ReadFile(installed); string(data) != "the installed binary" {
+		t.Error("a refused binary replaced the installed one")
+	}
+
+	err = InstallReleaseBinary(installed, manifestFilename, binary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(installed)
+	info, _ := os.Stat(installed)
+	if !bytes.Equal(data, released) || info.Mode().Perm() != 0700 {
+		t.Error("the released binary was not installed in place of the old one: ", info.Mode())
+	}
+
+	if leftovers, _ := filepath.Glob(filepath.Join(installDir, ".*")); len(leftovers) != 0 {
+		t.Error("temporary files were left beside the binary: ", leftovers)
+	}
+
+	// Binaries are found beside a manifest, wherever it is
+	locations := map[string]string{
+		"https://example.com/releases/1.3.0/manifest.json": "https://example.com/releases/1.3.0/encryptor-linux-amd64",
+		filepath.Join("releases", "manifest.json"):         filepath.Join("releases", "encryptor-linux-amd64"),
+	}
+
+	for manifestName, expected := range locations {
+		if location, err := releaseBinaryLocation(manifestName, binary); err != nil || location != expected {
+			t.Error("the binary beside ", manifestName, " was located at ", location, err)
+		}
+	}
+
+	remote := binary
+	remote.URL = "https://example.com/encryptor-linux-amd64"
+
+	if err = InstallReleaseBinary(installed, manifestFilename, remote, &Options{Offline: true}); !errors.Is(err, ErrOffline) {
+		t.Error("expected a binary fetched over the network to be refused offline: ", err)
+	}
+}
+
+func Test_CrashRecovery(t *testing.T) {
+	// Workers report through a channel in a deferred send, a recovered panic must still be sent
+	worker := func(ch chan<- error) {
+		var err error = nil
+		defer func() { ch <- err }()
+		defer recoverWorkerPanic("test worker 1", &err)
+
+		var chunks map[uint][]byte
+		chunks[1] = nil
+	}
+
+	workerErrors := make(chan error, 1)
+	go worker(workerErrors)
+
+	err := fmt.Errorf("execute worker error: %w", <-workerErrors)
+	if !errors.Is(err, ErrCrashed) {
+		t.Fatal("expected a panic to become an ErrCrashed: ", err)
+	}
+
+	var crash *CrashError
+	if !errors.As(err, &crash) {
+		t.Fatal("expected the crash report with the error: ", err)
+	}
+
+	report := crash.Report
+	if report.Worker != "test worker 1" || !strings.Contains(report.Panic, "nil map") || !strings.Contains(report.Stack, "Test_CrashRecovery") || !strings.Contains(report.Goroutines, "goroutine") {
+		t.Error("the crash report does not say where and how it crashed: ", report.Worker, report.Panic)
+	}
+
+	if err = runRecovered("test", func() error { return ErrTargetExists }); !errors.Is(err, ErrTargetExists) {
+		t.Error("an error was not passed through unchanged: ", err)
+	}
+
+	// Nothing secret is reported, the job's parameters have nowhere to put it
+	job := pipelineJob{Operation: Encryption, SourceFilename: "source", KeyMaterial: make([]byte, 32), Salt: []byte("salt"), Recipients: make([]RecipientStanza, 2)}
+	header := EncryptedFileHeader{Algorithm: "AES", Mode: "GCM", KeySize: 256, NumChunks: 3}
+
+	parameters := crashJobParameters(&job, &header)
+	if parameters.SourceFilename != "source" || parameters.Recipients != 2 || parameters.NumChunks != 3 || parameters.Cipher == "" {
+		t.Error("the job's parameters were not reported: ", parameters)
+	}
+}
+
+/*
+Allocations are counted per chunk rather than timed, so the budgets
+hold on any machine: encrypting or decrypting a file pays a fixed
+cost for its header and stages, and every chunk after that should
+only cost its cipher and its sealed or opened buffer. A chunk that
+starts paying for a fresh reader, bufio buffer, or re-marshaled
+header shows up as its allocations growing with the file
+*/
+const allocationBudgetPerEncryptedChunk = 32
+const allocationBudgetPerDecryptedChunk = 32
+
+func Test_AllocationBudget(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	decrypted := filepath.Join(tempDir, "decrypted")
+
+	// Allocations of a whole file of numChunks, encrypting and then decrypting it
+	allocations := func(options *Options, numChunks int) (float64, float64) {
+		err := os.WriteFile(original, make([]byte, numChunks*int(bytesFromMB(1))), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encryptAllocations := testing.AllocsPerRun(3, func() {
+			if err := Encrypt(original, encrypted, options); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		decryptAllocations := testing.AllocsPerRun(3, func() {
+			if err := Decrypt(encrypted, decrypted, options); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		return encryptAllocations, decryptAllocations
+	}
+
+	for _, suite := range cipherSuites {
+		for _, poolWorkers := range []uint8{0, 2} {
+			options := Options{
+				KeyHex:         testKeyHex,
+				Cipher:         suite.Name,
+				ChunkSizeMB:    1,
+				Readers:        1,
+				Executors:      1,
+				Writers:        1,
+				PoolWorkers:    poolWorkers,
+				ChunkChecksum:  true,
+				ForceOperation: true,
+			}
+
+			// The difference between a short file and a long one is what the extra chunks cost
+			shortEncrypt, shortDecrypt := allocations(&options, 2)
+			longEncrypt, longDecrypt := allocations(&options, 10)
+
+			perEncryptedChunk := (longEncrypt - shortEncrypt) / 8
+			perDecryptedChunk := (longDecrypt - shortDecrypt) / 8
+			t.Logf("%s, %d pool workers: %.1f allocations per encrypted chunk, %.1f per decrypted chunk", suite.Name, poolWorkers, perEncryptedChunk, perDecryptedChunk)
+
+			if perEncryptedChunk > allocationBudgetPerEncryptedChunk {
+				t.Errorf("%s with %d pool workers makes %.1f allocations per encrypted chunk, the budget is %d", suite.Name, poolWorkers, perEncryptedChunk, allocationBudgetPerEncryptedChunk)
+			}
+
+			if perDecryptedChunk > allocationBudgetPerDecryptedChunk {
+				t.Errorf("%s with %d pool workers makes %.1f allocations per decrypted chunk, the budget is %d", suite.Name, poolWorkers, perDecryptedChunk, allocationBudgetPerDecryptedChunk)
+			}
+		}
+	}
+}
+
+// go test -bench=Chunk -run=^$ ./pkg/encryptor - a chunk through the execute stage alone, without any I/O
+func Benchmark_EncryptChunk(b *testing.B) {
+	for _, suite := range cipherSuites {
+		b.Run(suite.Name, func(b *testing.B) {
+			header, key := benchmarkChunkHeader(suite)
+			plaintext := make([]byte, bytesFromMB(1))
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(plaintext)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				chunkData := plaintext
+				_, err := executeChunk(Encryption, suite.Cipher, suite.Mode, key, true, &header, nil, nil, 1, 2, &chunkData)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Benchmark_DecryptChunk(b *testing.B) {
+	for _, suite := range cipherSuites {
+		b.Run(suite.Name, func(b *testing.B) {
+			header, key := benchmarkChunkHeader(suite)
+			chunkData := make([]byte, bytesFromMB(1))
+
+			sealed, err := executeChunk(Encryption, suite.Cipher, suite.Mode, key, true, &header, nil, nil, 1, 2, &chunkData)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(chunkData)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// Decrypting only reslices the sealed chunk, so it can be opened again
+				chunkData := *sealed
+				_, err := executeChunk(Decryption, suite.Cipher, suite.Mode, key, true, &header, nil, nil, 1, 2, &chunkData)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+/*
+	go test -bench=PipelineReaders -run=^$ ./pkg/encryptor - a file encrypted
+	end to end with a few reader counts and the default executors, what
+	DefaultReaders' constants in tuning.go are taken from. The source is
+	read from the page cache after the first run, so this measures how
+	many readers it takes to keep the executors fed, not the storage -
+	drop the caches between runs to measure that
+*/
+func Benchmark_PipelineReaders(b *testing.B) {
+	source := filepath.Join(b.TempDir(), "source")
+	target := filepath.Join(b.TempDir(), "target")
+
+	size := bytesFromMB(256)
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	if err := os.WriteFile(source, data, 0600); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, readers := range []uint8{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("readers_%d", readers), func(b *testing.B) {
+			options := Options{
+				KeyHex:         testKeyHex,
+				ChunkSizeMB:    1,
+				Readers:        readers,
+				Executors:      DefaultExecutors(),
+				ForceOperation: true,
+			}
+
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := Encrypt(source, target, &options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// go test -bench=WriteChunks -run=^$ ./pkg/encryptor - vectored writes against buffers of a few sizes, a flush per chunk as the write stage does
+func Benchmark_WriteChunks(b *testing.B) {
+	// Small chunks are where flushing after each one costs the most
+	for _, chunkKB := range []int{4, 64, 8 * 1024} {
+		for _, bufferKB := range []uint{0, 64, 1024} {
+			for _, flushEachChunk := range []bool{true, false} {
+				name := fmt.Sprintf("chunk_%dKB/buffer_%dKB", chunkKB, bufferKB)
+				if bufferKB == 0 {
+					name = fmt.Sprintf("chunk_%dKB/vectored", chunkKB)
+				}
+
+				if flushEachChunk {
+					name += "/flush_each_chunk"
+				} else {
+					name += "/flush_when_full"
+				}
+
+				b.Run(name, func(b *testing.B) {
+					benchmarkWriteChunks(b, chunkKB*1024, bufferKB, flushEachChunk)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkWriteChunks(b *testing.B, chunkBytes int, bufferKB uint, flushEachChunk bool) {
+	chunk := make([]byte, chunkBytes)
+	marker := chunkMarker(1)
+
+	file, err := os.Create(filepath.Join(b.TempDir(), "chunks"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	writer := newChunkWriter(file, nil, bufferKB, FsyncNever)
+
+	// Keeps the file from growing past what the machine has to give
+	rewindEvery := 128 * 1024 * 1024 / chunkBytes
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(marker) + len(chunk)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = writer.Write(marker)
+		_, _ = writer.Write(chunk)
+
+		if flushEachChunk {
+			err = writer.Flush()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if i%rewindEvery == rewindEvery-1 {
+			err = writer.Flush()
+			if err == nil {
+				_, err = file.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkChunkHeader(suite cipherSuite) (EncryptedFileHeader, []byte) {
+	key := make([]byte, FileKeySize)
+	_, _ = rand.Read(key)
+
+	header := EncryptedFileHeader{
+		Algorithm:     suite.Algorithm,
+		Mode:          suite.ModeName,
+		KeySize:       suite.KeySize,
+		NumChunks:     2,
+		ChunkChecksum: ChecksumCRC32C,
+		ChunkAAD:      ChunkAADHeaderIndex,
+	}
+	header.digest = make([]byte, sha256.Size)
+
+	return header, key
+}
+
+func Test_PasswordSalt(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	original := filesDir + string(os.PathSeparator) + "small.txt"
+	encrypted := filesDir + string(os.PathSeparator) + "temp_salt.enc"
+	decrypted := filesDir + string(os.PathSeparator) + "temp_salt.dec"
+
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(encrypted)
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(decrypted)
+
+	options := Options{
+		Password:       "correct horse battery staple",
+		ChunkSizeMB:    1,
+		ForceOperation: true,
+	}
+
+	// The same password must not derive the same key for two files
+	var salts [][]byte
+	for i := 0; i < 2; i++ {
+		err := encryptDecryptAndCompare(original, encrypted, decrypted, &options, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, err := ReadHeader(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(header.Salt) != int(PasswordSaltSize) || header.FormatVersion != "1.16" {
+			t.Fatal("expected a ", PasswordSaltSize, " byte salt in a 1.16 header, got ", len(header.Salt), " bytes in ", header.FormatVersion)
+		}
+
+		if header.KDF != KDFPBKDF2SHA256 || header.KDFIterations != PasswordKDFIterations {
+			t.Fatal("expected the KDF parameters in the header, got ", header.KDF, " ", header.KDFIterations)
+		}
+
+		salts = append(salts, header.Salt)
+	}
+
+	if bytes.Equal(salts[0], salts[1]) {
+		t.Error("two encryptions with the same password used the same salt")
+	}
+
+	// Files from before the salt derived their key with a nil salt and must still decrypt
+	legacyKey, err := generateKey256FromString(options.Password, nil, legacyKDFIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: hex.EncodeToString(legacyKey)})
+	if err == nil {
+		_, err = writer.Write([]byte("written before salts"))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(&stream, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := io.ReadAll(reader)
+	if err != nil || string(plaintext) != "written before salts" {
+		t.Error("unsalted password file did not decrypt: ", err)
+	}
+
+	// The header's parameters are honored, not whatever this release uses for new files
+	header := EncryptedFileHeader{Salt: salts[0], KDF: KDFPBKDF2SHA256, KDFIterations: 1000}
+
+	expected, err := generateKey256FromString(options.Password, header.Salt, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := resolveKeyMaterial(Decryption, &header, &options)
+	if err != nil || !bytes.Equal(key.Material, expected) {
+		t.Error("the header's KDF iterations were not used: ", err)
+	}
+
+	header.KDF = "scrypt"
+	if _, err = resolveKeyMaterial(Decryption, &header, &options); err == nil {
+		t.Error("expected an error for an unsupported KDF")
+	}
+}
+
+func Test_KeyCache(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+
+	expected, err := generateKey256FromString("hunter2", salt, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := cachedPasswordKey("hunter2", salt, KDFPBKDF2SHA256, 1000)
+	if err != nil || !bytes.Equal(first, expected) {
+		t.Fatal("cached key does not match a direct derivation: ", err)
+	}
+
+	// Changing the returned key must not change what the cache hands out next
+	first[0] ^= 0xff
+
+	second, err := cachedPasswordKey("hunter2", salt, KDFPBKDF2SHA256, 1000)
+	if err != nil || !bytes.Equal(second, expected) {
+		t.Error("the cached key was changed through a returned copy: ", err)
+	}
+
+	// Any difference in what goes into the key is a different entry
+	for _, different := range []struct {
+		password   string
+		salt       []byte
+		iterations int
+	}{{"hunter3", salt, 1000}, {"hunter2", []byte("fedcba9876543210"), 1000}, {"hunter2", salt, 1001}} {
+		key, err := cachedPasswordKey(different.password, different.salt, KDFPBKDF2SHA256, different.iterations)
+		if err != nil || bytes.Equal(key, expected) {
+			t.Error("different derivation parameters returned the cached key: ", different.password, different.iterations, err)
+		}
+	}
+
+	// Failures are returned, not cached
+	if _, err = cachedPasswordKey("hunter2", salt, KDFPBKDF2SHA256, 0); err == nil {
+		t.Error("expected an error for zero iterations")
+	}
+
+	derivedKeyCache.mutex.Lock()
+	cacheKey := derivedKeyCacheKey{PasswordDigest: sha256.Sum256([]byte("hunter2")), Salt: string(salt), KDF: KDFPBKDF2SHA256}
+	_, cachedFailure := derivedKeyCache.entries[cacheKey]
+	derivedKeyCache.mutex.Unlock()
+
+	if cachedFailure {
+		t.Error("a failed derivation was left in the cache")
+	}
+}
+
+func Test_HeaderCache(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	copied := filepath.Join(tempDir, "copied")
+
+	err := os.WriteFile(original, []byte("cached header"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := Options{
+		KeyHex:         testKeyHex,
+		ForceOperation: true,
+	}
+
+	isCached := func(fileName string) bool {
+		headerCache.mutex.Lock()
+		defer headerCache.mutex.Unlock()
+
+		_, ok := headerCache.entries[headerCacheKey(fileName)]
+		return ok
+	}
+
+	err = Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file just written may still change within its modification time's tick
+	first, _, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isCached(encrypted) {
+		t.Error("a file modified just now was cached")
+	}
+
+	settled := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(encrypted, settled, settled); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || !isCached(encrypted) {
+		t.Fatal("a settled file was not cached: ", err)
+	}
+
+	// Changing a returned header must not change what the cache hands out next
+	cached, endOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || !bytes.Equal(cached.FileID, first.FileID) || !bytes.Equal(cached.digest, first.digest) {
+		t.Fatal("the cached header is not the one in the file: ", err)
+	}
+
+	cached.FileID[0] ^= 0xff
+	cached.digest[0] ^= 0xff
+
+	again, againEndOfHeader, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || !bytes.Equal(again.FileID, first.FileID) || !bytes.Equal(again.digest, first.digest) || againEndOfHeader != endOfHeader {
+		t.Error("the cached header was changed through a returned copy: ", err)
+	}
+
+	// Encrypting over the file forgets it, and a rewrite of the same size is read again once its time moves
+	err = Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isCached(encrypted) {
+		t.Error("a file written by Encrypt was left in the cache")
+	}
+
+	rewritten := settled.Add(time.Minute)
+	if err = os.Chtimes(encrypted, rewritten, rewritten); err != nil {
+		t.Fatal(err)
+	}
+
+	second, _, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || bytes.Equal(second.FileID, first.FileID) {
+		t.Fatal("a rewritten file returned its old header: ", err)
+	}
+
+	// Another process replacing the file is seen without being told
+	encryptedData, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encrypt(original, copied, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chtimes(copied, rewritten, rewritten); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Rename(copied, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	third, _, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || bytes.Equal(third.FileID, second.FileID) {
+		t.Error("a replaced file returned the header of the file it replaced: ", err)
+	}
+
+	// And so is one that changed size, even with its time put back
+	if err = os.WriteFile(encrypted, append(encryptedData, 0), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chtimes(encrypted, rewritten, rewritten); err != nil {
+		t.Fatal(err)
+	}
+
+	fourth, _, err := getEncryptedFileHeaderFromFile(encrypted)
+	if err != nil || !bytes.Equal(fourth.FileID, second.FileID) {
+		t.Error("a file that changed size returned its old header: ", err)
+	}
+}
+
+func Test_Policy(t *testing.T) {
+	policyFilename := filepath.Join(t.TempDir(), "policy.json")
+
+	err := os.WriteFile(policyFilename, []byte(`{"MinimumKDFIterations": 1000000, "AllowedCiphers": ["aes-256-gcm"], "RequireVerification": true}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(policyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Too few iterations and no chunk checksums, the cipher is allowed regardless of case
+	violations := policy.Violations(Encryption, &Options{Password: "password"})
+	if len(violations) != 2 {
+		t.Error("expected 2 violations, got ", violations)
+	}
+
+	if violations = policy.Violations(Encryption, &Options{KeyHex: "00", ChunkChecksum: true}); len(violations) != 0 {
+		t.Error("expected no violations, got ", violations)
+	}
+
+	if violations = policy.Violations(Decryption, &Options{Password: "password"}); len(violations) != 0 {
+		t.Error("decryption should not be governed by policy, got ", violations)
+	}
+
+	policy.AllowedCiphers = []string{"XCHACHA20-POLY1305"}
+	if violations = policy.Violations(Encryption, &Options{KeyHex: "00", ChunkChecksum: true}); len(violations) != 1 {
+		t.Error("expected the cipher to be disallowed, got ", violations)
+	}
+
+	// OpenPGP and JWE are held to what they write, not to options.Cipher, and refused unless listed
+	policy = Policy{AllowedCiphers: []string{"AES-256-GCM"}}
+	if violations = policy.OutputViolations(Encryption, OutputFormatOpenPGP, &Options{Password: "password"}); len(violations) != 2 {
+		t.Error("expected OpenPGP and its cipher to be disallowed, got ", violations)
+	}
+
+	if violations = policy.OutputViolations(Encryption, OutputFormatJWE, &Options{Password: "password"}); len(violations) != 1 {
+		t.Error("expected JWE to be disallowed, got ", violations)
+	}
+
+	policy.AllowedFormats = []string{"openpgp", "JWE"}
+	if violations = policy.OutputViolations(Encryption, OutputFormatJWE, &Options{Password: "password"}); len(violations) != 0 {
+		t.Error("expected a listed JWE to be allowed, got ", violations)
+	}
+
+	if violations = policy.OutputViolations(Encryption, OutputFormatOpenPGP, &Options{Password: "password"}); len(violations) != 1 {
+		t.Error("expected only OpenPGP's cipher to be disallowed, got ", violations)
+	}
+
+	// The S2K's iterations depend on the password, a long one is hashed fewer times
+	policy = Policy{AllowedFormats: []string{"OpenPGP"}, MinimumKDFIterations: openPGPS2KIterations("password") - 1, RequireVerification: true}
+	if violations = policy.OutputViolations(Encryption, OutputFormatOpenPGP, &Options{Password: "password"}); len(violations) != 1 {
+		t.Error("expected only the missing chunk checksums to be a violation, got ", violations)
+	}
+
+	if violations = policy.OutputViolations(Encryption, OutputFormatOpenPGP, &Options{Password: strings.Repeat("password", 10)}); len(violations) != 2 {
+		t.Error("expected too few S2K iterations to be a violation, got ", violations)
+	}
+
+	if violations = policy.OutputViolations(Decryption, OutputFormatOpenPGP, &Options{Password: "password"}); len(violations) != 0 {
+		t.Error("decrypting OpenPGP should not be governed by policy, got ", violations)
+	}
+
+	// A typo must not loosen a policy
+	err = os.WriteFile(policyFilename, []byte(`{"RequireVerificaton": true}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = LoadPolicy(policyFilename); err == nil {
+		t.Error("expected an error loading a policy with an unknown rule")
+	}
+
+	// The system policy must be locked
+	defer func(name string) {
+		SystemPolicyFilename = name
+	}(SystemPolicyFilename)
+
+	SystemPolicyFilename = filepath.Join(t.TempDir(), "missing.json")
+	if _, found, err := LoadSystemPolicy(); found || err != nil {
+		t.Error("a missing system policy should not be found or an error: ", err)
+	}
+
+	SystemPolicyFilename = policyFilename
+	_ = os.WriteFile(policyFilename, []byte(`{"RequireVerification": true}`), 0644)
+
+	if _, found, err := LoadSystemPolicy(); !found || err != nil {
+		t.Error("expected the locked system policy to load: ", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		_ = os.Chmod(policyFilename, 0666)
+
+		if _, _, err := LoadSystemPolicy(); err == nil {
+			t.Error("expected an error loading a system policy writable by others")
+		}
+	}
+}
+
+func Test_Capabilities(t *testing.T) {
+	capabilities := GetCapabilities()
+
+	// Everything a file header can describe must be listed
+	formats := capabilities.FormatVersions
+	if len(formats) == 0 || formats[len(formats)-1] != supportedFormatVersions[len(supportedFormatVersions)-1] {
+		t.Error("capabilities do not list the latest format version: ", formats)
+	}
+
+	// Names must match what policies are written against
+	policy := Policy{AllowedCiphers: []string{capabilities.Ciphers[0].Name}}
+	if violations := policy.Violations(Encryption, &Options{KeyHex: "00"}); len(violations) != 0 {
+		t.Error("the listed cipher is not the one policies check: ", violations)
+	}
+
+	data, err := json.Marshal(capabilities)
+	if err != nil || !strings.Contains(string(data), `"Iterations":`+strconv.Itoa(PasswordKDFIterations)) {
+		t.Error("capabilities did not marshal as expected: ", err)
+	}
+}
+
+// Non-pipeline Feature tests
+func Test_Hashing(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+
+	for _, testTable := range hashFiles {
+
+		t.Run(testTable.TestName, func(t *testing.T) {
+
+			// Hash the file and compare to the expected test result
+			fileName := filesDir + string(os.PathSeparator) + testTable.FileName
+			expectedHash := testTable.Data
+
+			fileHash, err := hashFile(fileName)
+			if err != nil {
+				if testTable.expectSuccess {
+					t.Error(err)
+				}
+				return
+			}
+
+			if expectedHash != fileHash {
+				if testTable.expectSuccess {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_ChecksumManifest(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":             "a\n",
+		"sub/b.txt":         "b\n",
+		"sub/back\\slash":   "x",
+		"sub/new\nline.txt": "",
+	}
+
+	for name, data := range files {
+		fileName := filepath.Join(root, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err == nil {
+			err = os.WriteFile(fileName, []byte(data), 0644)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := HashTree(root, 4, nil)
+	if err != nil || len(entries) != len(files) {
+		t.Fatal("unexpected entries for a tree: ", entries, err)
+	}
+
+	for i, entry := range entries {
+		expected, _ := hashReader(strings.NewReader(files[filepath.ToSlash(strings.TrimPrefix(entry.Path, root+string(os.PathSeparator)))]))
+		if entry.Hash != expected || (i > 0 && entries[i-1].Path >= entry.Path) {
+			t.Error("unexpected entry, or entries out of order: ", entry)
+		}
+	}
+
+	// Both formats read back as they were written, escaped paths included
+	for _, format := range []string{ManifestFormatGNU, ManifestFormatBSD} {
+		var manifest bytes.Buffer
+
+		err = WriteChecksumManifest(&manifest, entries, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := ReadChecksumManifest(&manifest)
+		if err != nil || !reflect.DeepEqual(read, entries) {
+			t.Error("a manifest did not read back as written: ", format, err)
+		}
+	}
+
+	if err := WriteChecksumManifest(io.Discard, entries, "md5"); err == nil {
+		t.Error("expected an unknown manifest format to be refused")
+	}
+
+	// Lines as sha256sum, sha256sum --tag, and BSD's sha256 write them, mixed
+	aHash, _ := hashReader(strings.NewReader("a\n"))
+	bHash, _ := hashReader(strings.NewReader("b\n"))
+
+	manifest := aHash + "  " + filepath.ToSlash(filepath.Join(root, "a.txt")) + "\r\n" +
+		"\n" +
+		strings.ToUpper(bHash) + " *" + filepath.ToSlash(filepath.Join(root, "sub", "b.txt")) + "\n" +
+		"SHA256 (" + filepath.ToSlash(filepath.Join(root, "missing.txt")) + ") = " + aHash + "\n" +
+		"SHA256 (" + filepath.ToSlash(filepath.Join(root, "sub", "b.txt")) + ") = " + aHash + "\n"
+
+	read, err := ReadChecksumManifest(strings.NewReader(manifest))
+	if err != nil || len(read) != 4 {
+		t.Fatal("could not read a manifest of mixed formats: ", read, err)
+	}
+
+	results := CheckChecksums(read, 2, nil)
+	if len(results) != 4 || !results[0].OK || !results[1].OK || results[2].OK || results[2].Err == nil || results[3].OK || results[3].Err != nil {
+		t.Error("unexpected results checking a manifest: ", results)
+	}
+
+	for _, line := range []string{"MD5 (a.txt) = 60b725f10c9c85c70d97880dfe8191b3", "abc  a.txt", aHash + " a.txt", aHash + "  ", "SHA256 (a.txt) = abc", "SHA256 (a.txt)"} {
+		if _, err := ReadChecksumManifest(strings.NewReader(line + "\n")); err == nil {
+			t.Error("expected a malformed manifest line to be refused: ", line)
+		}
+	}
+
+	if _, err := ReadChecksumManifest(strings.NewReader("\n\n")); err == nil {
+		t.Error("expected an empty manifest to be refused")
+	}
+}
+
+func Test_MerkleTree(t *testing.T) {
+	const chunkSize = 1024
+
+	data := make([]byte, 9*chunkSize+100)
+	_, _ = rand.Read(data)
+
+	directory := t.TempDir()
+
+	// Every tree shape up to ten chunks, and every chunk's proof
+	for leafCount := 0; leafCount <= 10; leafCount++ {
+		size := leafCount * chunkSize
+		if leafCount == 10 {
+			size = len(data)
+		}
+
+		fileName := filepath.Join(directory, fmt.Sprintf("merkle%d", leafCount))
+
+		err := os.WriteFile(fileName, data[:size], 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := MerkleTreeHash(fileName, chunkSize, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var leaves [][]byte
+		for offset := 0; offset < size; offset += chunkSize {
+			end := offset + chunkSize
+			if end > size {
+				end = size
+			}
+
+			leaves = append(leaves, merkleLeafHash(data[offset:end]))
+		}
+
+		if tree.Root != hex.EncodeToString(merkleRoot(leaves)) || tree.SizeBytes != int64(size) {
+			t.Error("unexpected Merkle root for chunks: ", leafCount, tree.Root)
+		}
+
+		if size == 0 {
+			if empty := sha256.Sum256(nil); tree.Root != hex.EncodeToString(empty[:]) {
+				t.Error("expected an empty file's root to be the hash of nothing: ", tree.Root)
+			}
+
+			continue
+		}
+
+		proof, err := ProveMerkleRange(&tree, 0, int64(size))
+		if err != nil || len(proof.Chunks) != len(leaves) {
+			t.Fatal("could not prove a whole file: ", err)
+		}
+
+		for _, chunk := range proof.Chunks {
+			if err := VerifyMerkleChunk(proof, chunk, data[chunk.Offset:chunk.Offset+chunk.Length]); err != nil {
+				t.Error("a chunk's proof did not verify: ", leafCount, chunk.Index, err)
+			}
+		}
+	}
+
+	// A range is rounded out to the chunks it touches, and a changed byte fails
+	tree, err := MerkleTreeHash(filepath.Join(directory, "merkle10"), chunkSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := ProveMerkleRange(&tree, 3*chunkSize-1, 4*chunkSize+1)
+	if err != nil || len(proof.Chunks) != 3 || proof.Chunks[0].Index != 2 || proof.Chunks[2].Index != 4 {
+		t.Fatal("unexpected proof of a range: ", proof, err)
+	}
+
+	tampered := append([]byte(nil), data[2*chunkSize:3*chunkSize]...)
+	tampered[7] ^= 1
+
+	if err := VerifyMerkleChunk(proof, proof.Chunks[0], tampered); err == nil {
+		t.Error("expected a changed chunk to fail its proof")
+	}
+
+	if err := VerifyMerkleChunk(proof, proof.Chunks[1], data[2*chunkSize:3*chunkSize]); err == nil {
+		t.Error("expected a chunk to fail another chunk's proof")
+	}
+
+	if _, err := ProveMerkleRange(&tree, 0, int64(len(data))+1); err == nil {
+		t.Error("expected a range past the end of the file to be refused")
+	}
+
+	// Encrypting and decrypting give the root of the plaintext's chunks, with separate workers or a pool
+	original := filepath.Join(directory, "merkle-large")
+	encrypted := filepath.Join(t.TempDir(), "merkle.enc")
+	decrypted := filepath.Join(t.TempDir(), "merkle.dec")
+
+	large := writeRandomFile(t, original, 5*1024*1024+17)
+
+	expected, err := MerkleTreeHash(original, 1024*1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, poolWorkers := range []uint8{0, 2} {
+		var encryptTree, decryptTree MerkleTree
+
+		encryptOptions := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, PoolWorkers: poolWorkers, TreeHash: &encryptTree, ForceOperation: true}
+		decryptOptions := Options{KeyHex: testKeyHex, PoolWorkers: poolWorkers, TreeHash: &decryptTree, ForceOperation: true}
+
+		err = encryptDecryptAndCompare(original, encrypted, decrypted, &encryptOptions, &decryptOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if encryptTree.Root != expected.Root || decryptTree.Root != expected.Root || decryptTree.SizeBytes != int64(len(large)) {
+			t.Error("expected the plaintext's root from encrypting and decrypting: ", poolWorkers, expected.Root, encryptTree.Root, decryptTree.Root)
+		}
+	}
+}
+
+func Test_MerkleProof(t *testing.T) {
+	directory := t.TempDir()
+	original := filepath.Join(directory, "original")
+	encrypted := filepath.Join(directory, "encrypted")
+
+	data := writeRandomFile(t, original, 4*1024*1024+321)
+
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 1, ForceOperation: true}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := MerkleTreeHash(original, 1024*1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An auditor with the root alone checks the chunks the proof carries
+	proof, err := ProveEncryptedRange(encrypted, 1024*1024+5, 3*1024*1024+5, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proof.Root != tree.Root || len(proof.Chunks) != 3 || !bytes.Equal(proof.Chunks[2].Data, data[3*1024*1024:4*1024*1024]) {
+		t.Fatal("unexpected proof of an encrypted file's range: ", proof.Root, len(proof.Chunks))
+	}
+
+	err = VerifyMerkleRangeProof(proof, strings.ToUpper(tree.Root), nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := VerifyMerkleRangeProof(proof, hex.EncodeToString(make([]byte, 32)), nil); err == nil {
+		t.Error("expected a proof against another root to fail")
+	}
+
+	shortened := proof
+	shortened.Chunks = proof.Chunks[:2]
+	if err := VerifyMerkleRangeProof(shortened, tree.Root, nil); err == nil {
+		t.Error("expected a proof missing part of its range to fail")
+	}
+
+	tampered := proof
+	tampered.Chunks = append([]MerkleChunkProof(nil), proof.Chunks...)
+	tampered.Chunks[1].Data = append([]byte(nil), proof.Chunks[1].Data...)
+	tampered.Chunks[1].Data[0] ^= 1
+	if err := VerifyMerkleRangeProof(tampered, tree.Root, nil); err == nil {
+		t.Error("expected a proof carrying a changed chunk to fail")
+	}
+
+	// A proof of the plaintext carries no chunks, they are read from the file
+	plainProof, err := ProveMerkleRange(&tree, 4*1024*1024, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyMerkleRangeProof(plainProof, tree.Root, nil); err == nil {
+		t.Error("expected a proof without its chunks to need the file")
+	}
+
+	file, err := os.Open(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	if err := VerifyMerkleRangeProof(plainProof, tree.Root, file); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ProveEncryptedRange(encrypted, 0, int64(len(data))+1, &options); err == nil {
+		t.Error("expected a range past the end of the plaintext to be refused")
+	}
+
+	options.KeyHex = "f0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6"
+	if _, err := ProveEncryptedRange(encrypted, 0, 1, &options); err == nil {
+		t.Error("expected proving with the wrong key to fail")
+	}
+}
+
+func Test_TreeHash(t *testing.T) {
+	root := t.TempDir()
+
+	// Large enough to be read ahead, and not a whole number of chunks
+	large := make([]byte, hashReadAheadMinimumBytes+3)
+	_, _ = rand.Read(large)
+
+	files := map[string][]byte{"large.bin": large, "a.txt": []byte("a"), filepath.Join("sub", "b.txt"): []byte("b")}
+	for name, data := range files {
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+
+		err := os.WriteFile(filepath.Join(root, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	largeHash, err := Hash(filepath.Join(root, "large.bin"))
+	if expected := sha256.Sum256(large); err != nil || largeHash != hex.EncodeToString(expected[:]) {
+		t.Fatal("a large file read ahead hashed differently: ", largeHash, err)
+	}
+
+	entries, err := HashTree(root, 3, nil)
+	if err != nil || len(entries) != 3 {
+		t.Fatal("could not hash a tree: ", entries, err)
+	}
+
+	hash, err := TreeHash(root, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest with relative paths, as sha256sum of one written from inside the tree
+	var manifest bytes.Buffer
+	for _, entry := range entries {
+		relative, _ := filepath.Rel(root, entry.Path)
+		manifest.WriteString(entry.Hash + "  " + filepath.ToSlash(relative) + "\n")
+	}
+
+	if expected := sha256.Sum256(manifest.Bytes()); hash != hex.EncodeToString(expected[:]) {
+		t.Error("unexpected tree hash: ", hash, manifest.String())
+	}
+
+	// A copy elsewhere has the same tree hash, a renamed file changes it
+	copied := filepath.Join(t.TempDir(), "copy")
+	for name, data := range files {
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(copied, name)), 0755)
+		_ = os.WriteFile(filepath.Join(copied, name), data, 0644)
+	}
+
+	copiedEntries, err := HashTree(copied, 1, nil)
+	if copiedHash, _ := TreeHash(copied, copiedEntries); err != nil || copiedHash != hash {
+		t.Error("expected a copy of a tree to have the same tree hash: ", copiedHash, err)
+	}
+
+	err = os.Rename(filepath.Join(copied, "a.txt"), filepath.Join(copied, "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copiedEntries, err = HashTree(copied, 1, nil)
+	if copiedHash, _ := TreeHash(copied, copiedEntries); err != nil || copiedHash == hash {
+		t.Error("expected a renamed file to change the tree hash: ", err)
+	}
+}
+
+func Test_HashCache(t *testing.T) {
+	root := t.TempDir()
+	cacheFilename := filepath.Join(t.TempDir(), "hashes.json")
+	settled := time.Now().Add(-time.Hour)
+
+	for _, name := range []string{"a.txt", "b.txt", "recent.txt"} {
+		err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name != "recent.txt" {
+			_ = os.Chtimes(filepath.Join(root, name), settled, settled)
+		}
+	}
+
+	cache, err := OpenHashCache(cacheFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := HashTree(root, 2, cache)
+	if err != nil || len(entries) != 3 {
+		t.Fatal("could not hash a tree with a cache: ", entries, err)
+	}
+
+	err = SaveHashCache(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed in place with its size and modification time put back, only the cache is fooled
+	aFilename := filepath.Join(root, "a.txt")
+
+	err = os.WriteFile(aFilename, []byte("A.txt"), 0644)
+	if err == nil {
+		err = os.Chtimes(aFilename, settled, settled)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = OpenHashCache(cacheFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cache.entries) != 2 {
+		t.Error("expected settled files to be cached and the recent one not: ", cache.entries)
+	}
+
+	results := CheckChecksums(entries, 2, cache)
+	if !results[0].OK {
+		t.Error("expected an unchanged looking file's hash to come from the cache")
+	}
+
+	if results := CheckChecksums(entries, 2, nil); results[0].OK {
+		t.Error("expected a file to be hashed again without the cache")
+	}
+
+	// A new modification time (or size) means hashing again
+	_ = os.Chtimes(aFilename, settled.Add(time.Minute), settled.Add(time.Minute))
+
+	if results := CheckChecksums(entries, 2, cache); results[0].OK || !results[1].OK || !results[2].OK {
+		t.Error("expected a changed file to be hashed again: ", results)
+	}
+
+	// Saving forgets files that are gone, and a cache that cannot be parsed is started again
+	err = os.Remove(filepath.Join(root, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SaveHashCache(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = OpenHashCache(cacheFilename)
+	if err != nil || len(cache.entries) != 1 {
+		t.Error("expected the cache to forget a deleted file: ", err)
+	}
+
+	err = os.WriteFile(cacheFilename, []byte("{not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = OpenHashCache(cacheFilename)
+	if err != nil || len(cache.entries) != 0 {
+		t.Error("expected an unreadable cache to be started again: ", err)
+	}
+}
+
+func Test_DefaultConcurrency(t *testing.T) {
+	readers := DefaultReaders()
+	if readers < 1 || readers > ReadersLimit {
+		t.Error("default readers out of range: ", readers)
+	}
+
+	executors := DefaultExecutors()
+	if executors < 1 || executors > ExecutorsLimit {
+		t.Error("default executors out of range: ", executors)
+	}
+
+	// A file we cannot identify the storage of should never change the value
+	if TuneReadersForStorage(getTestFilesDirectory()+string(os.PathSeparator)+"does_not_exist.txt", readers) != readers {
+		t.Error("readers were changed for a file that does not exist")
+	}
+}
+
+func Test_RuntimeMemoryTuning(t *testing.T) {
+	if !runtimeMemoryLimitSupported {
+		t.Skip("the runtime has no soft memory limit before Go 1.19")
+	}
+
+	t.Setenv("GOGC", "")
+
+	previousLimit := setRuntimeMemoryLimit(-1)
+	previousGCPercent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(previousGCPercent)
+
+	// Half of each bound is the chunk budget, so the heap goal is twice the chunks
+	restoreFirst := tuneRuntimeMemory(bytesFromMB(64), bytesFromMB(32))
+	if settings := currentRuntimeMemorySettings(); settings.SoftLimitBytes != uint64(bytesFromMB(64)) || settings.GCPercent != 100 {
+		t.Error("unexpected settings for one bounded job: ", settings)
+	}
+
+	// Jobs at once add their bounds together
+	restoreSecond := tuneRuntimeMemory(bytesFromMB(32), bytesFromMB(16))
+	if setRuntimeMemoryLimit(-1) != bytesFromMB(96) {
+		t.Error("expected the bounds to be added together: ", setRuntimeMemoryLimit(-1))
+	}
+
+	restoreFirst()
+	if setRuntimeMemoryLimit(-1) != bytesFromMB(32) {
+		t.Error("expected the remaining job's bound: ", setRuntimeMemoryLimit(-1))
+	}
+
+	restoreSecond()
+	if setRuntimeMemoryLimit(-1) != previousLimit || debug.SetGCPercent(previousGCPercent) != previousGCPercent {
+		t.Error("expected the runtime's own settings to be put back")
+	}
+
+	// A tighter limit from before is kept, and GOGC from the environment is left alone
+	t.Setenv("GOGC", "50")
+	setRuntimeMemoryLimit(bytesFromMB(16))
+	debug.SetGCPercent(50)
+
+	restore := tuneRuntimeMemory(bytesFromMB(64), bytesFromMB(8))
+	if settings := currentRuntimeMemorySettings(); settings.SoftLimitBytes != uint64(bytesFromMB(16)) || settings.GCPercent != 50 {
+		t.Error("expected the tighter limit and GOGC to be kept: ", settings)
+	}
+
+	restore()
+	setRuntimeMemoryLimit(previousLimit)
+	debug.SetGCPercent(previousGCPercent)
+}
+
+func Test_MemoryLimit(t *testing.T) {
+	for value, expected := range map[string]uint64{"": 0, "off": 0, "1048576": 1 << 20, "512B": 512, "64KiB": 64 << 10, "256MiB": 256 << 20, "2GiB": 2 << 30, "1TiB": 1 << 40} {
+		limit, err := parseGoMemLimit(value)
+		if err != nil || limit != expected {
+			t.Errorf("GOMEMLIMIT=%s parsed as %d, %d was expected: %v", value, limit, expected, err)
+		}
+	}
+
+	for _, value := range []string{"256M", "1.5GiB", "-1", "lots", "99999999999TiB"} {
+		if _, err := parseGoMemLimit(value); err == nil {
+			t.Error("expected GOMEMLIMIT to be refused: ", value)
+		}
+	}
+
+	root := t.TempDir()
+	writeLimit := func(path string, value string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cgroup v2, where the parent's limit is smaller than our own
+	writeLimit(filepath.Join(root, "memory.max"), "max")
+	writeLimit(filepath.Join(root, "kubepods", "memory.max"), "536870912")
+	writeLimit(filepath.Join(root, "kubepods", "pod1", "memory.max"), "1073741824")
+
+	selfCgroup := filepath.Join(t.TempDir(), "cgroup")
+	writeLimit(selfCgroup, "0::/kubepods/pod1")
+
+	limit := cgroupMemoryLimit(root, selfCgroup)
+	if runtime.GOOS == "linux" && (limit.Bytes != 512<<20 || limit.Source != "cgroup v2") {
+		t.Error("expected the parent's cgroup v2 limit: ", limit)
+	}
+
+	// cgroup v1, the memory controller sharing a line, unlimited is a huge number
+	writeLimit(filepath.Join(root, "memory", "memory.limit_in_bytes"), "9223372036854771712")
+	writeLimit(filepath.Join(root, "memory", "docker", "abc", "memory.limit_in_bytes"), "268435456")
+	writeLimit(selfCgroup, "5:cpu,cpuacct:/docker/abc\n4:memory,hugetlb:/docker/abc\n0::/")
+
+	limit = cgroupMemoryLimit(root, selfCgroup)
+	if runtime.GOOS == "linux" && (limit.Bytes != 256<<20 || limit.Source != "cgroup v1") {
+		t.Error("expected the cgroup v1 limit: ", limit)
+	}
+
+	if limit := cgroupMemoryLimit(root, filepath.Join(root, "does_not_exist")); limit.Bytes != 0 {
+		t.Error("expected no limit without a cgroup file: ", limit)
+	}
+
+	host := uint64(64 << 30)
+	container := MemoryLimit{Bytes: 256 << 20, Source: "cgroup v1"}
+
+	if limit := smallestMemoryLimit(host, MemoryLimit{}, ""); limit.Bytes != 0 {
+		t.Error("expected no limit on a machine of its own: ", limit)
+	}
+
+	if limit := smallestMemoryLimit(host, MemoryLimit{Bytes: 9223372036854771712, Source: "cgroup v1"}, ""); limit.Bytes != 0 {
+		t.Error("expected a limit above the host's memory to be no limit: ", limit)
+	}
+
+	if limit := smallestMemoryLimit(host, container, "128MiB"); limit.Bytes != 128<<20 || limit.Source != "GOMEMLIMIT" {
+		t.Error("expected the smaller GOMEMLIMIT: ", limit)
+	}
+
+	if limit := smallestMemoryLimit(host, container, "1GiB"); limit != container {
+		t.Error("expected the smaller cgroup limit: ", limit)
+	}
+
+	if limit := smallestMemoryLimit(0, MemoryLimit{}, "1GiB"); limit.Bytes != 1<<30 {
+		t.Error("expected GOMEMLIMIT where the host's memory is unknown: ", limit)
+	}
+
+	// 75% of 256 MiB bounds jobs to 192 MB, half of it holds 6 chunks of 8 MB in and out
+	if bound := automaticMaxMemoryMB(container); bound != 192 {
+		t.Error("expected a 192 MB bound, not ", bound)
+	}
+
+	if workers := memoryLimitedWorkers(64, container); workers != 6 {
+		t.Error("expected 6 workers to fit, not ", workers)
+	}
+
+	if workers := memoryLimitedWorkers(64, MemoryLimit{}); workers != 64 {
+		t.Error("expected workers to be left alone without a limit, not ", workers)
+	}
+
+	if clampWorkers(memoryLimitedWorkers(16, MemoryLimit{Bytes: 16 << 20, Source: "GOMEMLIMIT"}), ExecutorsLimit) != 1 {
+		t.Error("expected at least one worker however little memory there is")
+	}
+
+	// A bound from a limit says so when a chunk cannot fit
+	source := getTestFilesDirectory() + string(os.PathSeparator) + "small.txt"
+	encrypted := filepath.Join(t.TempDir(), "small.enc")
+
+	options := Options{KeyHex: testKeyHex, ChunkSizeMB: 32}
+	if err := Encrypt(source, encrypted, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := newPipelineJob(Decryption, encrypted, encrypted+".dec", withDefaults(options, encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job.MaxMemoryMB, job.MemoryLimit = 16, "GOMEMLIMIT"
+	if err := runPipelineJob(&job); err == nil || !strings.Contains(err.Error(), "GOMEMLIMIT memory limit") {
+		t.Error("expected the memory limit to be named: ", err)
+	}
+}
+
+func Test_Scrub(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	scrubDir := t.TempDir()
+
+	// One file with checksums, one without, and one that is not ours
+	for name, checksum := range map[string]bool{"checksummed.enc": true, "structure_only.enc": false} {
+		options := Options{
+			KeyHex:        testKeyHex,
+			ChunkSizeMB:   1,
+			Readers:       2,
+			Executors:     2,
+			Writers:       1,
+			ChunkChecksum: checksum,
+		}
+
+		err := Encrypt(filesDir+string(os.PathSeparator)+"small.txt", filepath.Join(scrubDir, name), &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.WriteFile(filepath.Join(scrubDir, "notes.txt"), []byte("not encrypted"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scrubOptions := ScrubOptions{SamplePercent: 100}
+
+	report, err := Scrub(scrubDir, &scrubOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Passed) != 2 || len(report.Failed) != 0 || len(report.Skipped) != 1 {
+		t.Fatal("unexpected scrub report for healthy files: ", report)
+	}
+
+	// Corrupt the checksummed file, it verified last time so it is newly failing
+	checksummed := filepath.Join(scrubDir, "checksummed.enc")
+	data, err := os.ReadFile(checksummed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[len(data)/2] ^= 0xff
+	err = os.WriteFile(checksummed, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Scrub(scrubDir, &scrubOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Failed) != 1 || len(report.NewlyFailing) != 1 || report.NewlyFailing[0] != "checksummed.enc" {
+		t.Fatal("corruption was not reported as newly failing: ", report)
+	}
+
+	// Shuffling still visits every chunk, so the corruption is still found
+	scrubOptions.RandomOrder = true
+
+	report, err = Scrub(scrubDir, &scrubOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Failed) != 1 || len(report.Passed) != 1 {
+		t.Fatal("corruption was not found scrubbing in a random order: ", report)
+	}
+
+	order := scrubChunkOrder(100, true)
+	seen := map[uint32]bool{}
+	for _, chunk := range order {
+		seen[chunk] = true
+	}
+
+	if len(order) != 100 || len(seen) != 100 {
+		t.Error("random chunk order does not visit every chunk exactly once")
+	}
+
+	// A tiny byte budget allows one file (the failing one, it is checked first) and defers the rest
+	scrubOptions.MaxBytes = 1
+
+	report, err = Scrub(scrubDir, &scrubOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Failed) != 1 || len(report.Deferred) != 2 {
+		t.Error("byte budget was not honored: ", report)
+	}
+}
+
+// Runs both pipeline jobs and compares the hashes of the original and the decrypted
+func encryptDecryptAndCompare(original string, encrypted string, decrypted string, encryptOptions *Options, decryptOptions *Options) error {
+	err := Encrypt(original, encrypted, encryptOptions)
+	if err != nil {
+		return err
+	}
+
+	err = Decrypt(encrypted, decrypted, decryptOptions)
+	if err != nil {
+		return err
+	}
+
+	// Hash the original and the decrypted
+	hashOriginal, err := hashFile(original)
+	if err != nil {
+		return err
+	}
+
+	hashDecrypted, err := hashFile(decrypted)
+	if err != nil {
+		return err
+	}
+
+	if hashOriginal != hashDecrypted {
+		return errors.New("hashes of the original and the decrypted file do not match")
+	}
+
+	return nil
+}
+
+// The key tests encrypt with, when which key does not matter
+const testKeyHex = "e0a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6"
+
+// Writes size random bytes to fileName, the source most tests encrypt, and returns them
+func writeRandomFile(t *testing.T, fileName string, size int64) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// The test files live at the root of the repository, above this package
+func getTestFilesDirectory() string {
+	workDir, _ := os.Getwd()
+	for {
+		testFiles := workDir + string(os.PathSeparator) + "test_files"
+		if info, err := os.Stat(testFiles); err == nil && info.IsDir() {
+			return testFiles
+		}
+
+		parent := filepath.Dir(workDir)
+		if parent == workDir {
+			return testFiles
+		}
+
+		workDir = parent
+	}
+}
+
+func Test_DirectoryArchive(t *testing.T) {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "source")
+	restored := filepath.Join(tempDir, "restored")
+
+	files := map[string]os.FileMode{"top.txt": 0644, "nested/deeper/secret.txt": 0600, "nested/run.sh": 0755}
+	for name, mode := range files {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.Symlink("deeper/secret.txt", filepath.Join(source, "nested", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(filepath.Join(source, "nested", "deeper"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := Options{KeyHex: testKeyHex}
+
+	var encrypted bytes.Buffer
+	err = EncryptDirectory(source, &encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DecryptDirectory(bytes.NewReader(encrypted.Bytes()), restored, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mode := range files {
+		path := filepath.Join(restored, filepath.FromSlash(name))
+
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != name {
+			t.Error("expected ", name, " to be restored: ", err)
+		}
+
+		if stats, err := os.Stat(path); err != nil || stats.Mode().Perm() != mode {
+			t.Error("expected ", name, " to keep its mode ", mode)
+		}
+	}
+
+	if link, err := os.Readlink(filepath.Join(restored, "nested", "link")); err != nil || link != "deeper/secret.txt" {
+		t.Error("expected the symbolic link to be restored: ", link, err)
+	}
+
+	if stats, err := os.Stat(filepath.Join(restored, "nested", "deeper")); err != nil || stats.Mode().Perm() != 0700 {
+		t.Error("expected the directory to keep its mode")
+	}
+
+	// An existing directory is only extracted into when overwriting
+	err = DecryptDirectory(bytes.NewReader(encrypted.Bytes()), restored, &options)
+	if !errors.Is(err, ErrTargetExists) {
+		t.Error("expected extracting over an existing directory to fail: ", err)
+	}
+
+	// A tampered archive leaves nothing behind
+	tampered := append([]byte(nil), encrypted.Bytes()...)
+	tampered[len(tampered)-40] ^= 1
+
+	err = DecryptDirectory(bytes.NewReader(tampered), filepath.Join(tempDir, "tampered"), &options)
+	if err == nil {
+		t.Error("expected a tampered archive to fail")
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 2 {
+		t.Error("expected a failed extraction to leave nothing behind, found ", len(entries), " entries")
+	}
+
+	// Names that climb out of the directory are refused
+	for _, name := range []string{"../escaped", "/escaped", "a/../../escaped"} {
+		var archive bytes.Buffer
+
+		writer, err := newEncryptWriter(&archive, &options, ContentTar, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tarWriter := tar.NewWriter(writer)
+		_ = tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+		_, _ = tarWriter.Write([]byte("x"))
+		_ = tarWriter.Close()
+		_ = writer.Close()
+
+		err = DecryptDirectory(&archive, filepath.Join(tempDir, "escape"), &options)
+		if err == nil {
+			t.Error("expected ", name, " to be refused")
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "escaped")); err == nil {
+		t.Error("expected nothing to be written outside the directory")
+	}
+
+	// Nor is anything written through a link the archive made
+	var archive bytes.Buffer
+
+	writer, err := newEncryptWriter(&archive, &options, ContentTar, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	_ = tarWriter.WriteHeader(&tar.Header{Name: "out", Linkname: tempDir, Typeflag: tar.TypeSymlink})
+	_ = tarWriter.WriteHeader(&tar.Header{Name: "out/escaped", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	_, _ = tarWriter.Write([]byte("x"))
+	_ = tarWriter.Close()
+	_ = writer.Close()
+
+	err = DecryptDirectory(&archive, filepath.Join(tempDir, "escape"), &options)
+	if err == nil {
+		t.Error("expected writing through a symbolic link to be refused")
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "escaped")); err == nil {
+		t.Error("expected nothing to be written through the symbolic link")
+	}
+
+	// Files are not archives
+	var plain bytes.Buffer
+	plainWriter, _ := NewEncryptWriter(&plain, &options)
+	_, _ = plainWriter.Write([]byte("not a directory"))
+	_ = plainWriter.Close()
+
+	if err := DecryptDirectory(&plain, filepath.Join(tempDir, "plain"), &options); err == nil {
+		t.Error("expected a file that is not an archive to be refused")
+	}
+}
+
+func Test_DirectoryArchiveSymlinks(t *testing.T) {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "source")
+	outside := filepath.Join(tempDir, "outside")
+
+	for _, name := range []string{filepath.Join(source, "sub", "file.txt"), filepath.Join(outside, "shared.txt")} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(name, []byte(filepath.Base(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{"to-file": "sub/file.txt", "to-outside": outside, "dangling": "nowhere", "sub/loop": ".."}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(source, filepath.FromSlash(name))); err != nil {
+			t.Skip("symbolic links are needed: ", err)
+		}
+	}
+
+	options := Options{KeyHex: testKeyHex}
+
+	archived := func(symlinks string) map[string]*tar.Header {
+		options.Symlinks = symlinks
+
+		var encrypted bytes.Buffer
+		if err := EncryptDirectory(source, &encrypted, &options); err != nil {
+			t.Fatal(symlinks, ": ", err)
+		}
+
+		reader, err := NewDecryptReader(&encrypted, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers := map[string]*tar.Header{}
+		archive := tar.NewReader(reader)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return headers
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			headers[strings.TrimSuffix(header.Name, "/")] = header
+		}
+	}
+
+	preserved := archived(SymlinksPreserve)
+	for name, target := range links {
+		if header := preserved[name]; header == nil || header.Typeflag != tar.TypeSymlink || header.Linkname != target {
+			t.Errorf("expected %s preserved as a link to %s: %+v", name, target, header)
+		}
+	}
+
+	skipped := archived(SymlinksSkip)
+	for name := range links {
+		if skipped[name] != nil {
+			t.Error("expected ", name, " to be left out")
+		}
+	}
+
+	if skipped["sub/file.txt"] == nil {
+		t.Error("expected files to be archived when links are skipped")
+	}
+
+	followed := archived(SymlinksFollow)
+	if header := followed["to-file"]; header == nil || header.Typeflag != tar.TypeReg || header.Size != int64(len("file.txt")) || header.PAXRecords[paxSymlinkTarget] != "sub/file.txt" {
+		t.Errorf("expected the link to a file archived as the file, recording the link: %+v", header)
+	}
+
+	if header := followed["to-outside/shared.txt"]; header == nil || header.Typeflag != tar.TypeReg {
+		t.Errorf("expected the directory a link points to archived beneath it: %+v", header)
+	}
+
+	for _, name := range []string{"dangling", "sub/loop"} {
+		if header := followed[name]; header == nil || header.Typeflag != tar.TypeSymlink {
+			t.Errorf("expected %s kept as a link rather than followed: %+v", name, header)
+		}
+	}
+
+	options.Symlinks = "dereference"
+	if err := EncryptDirectory(source, &bytes.Buffer{}, &options); err == nil {
+		t.Error("expected an unknown symbolic link behavior to be refused")
+	}
+}
+
+func Test_FileReader(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+	streamed := filepath.Join(tempDir, "streamed")
+
+	data := writeRandomFile(t, original, bytesFromMB(3)+777)
+
+	options := Options{
+		KeyHex:        testKeyHex,
+		ChunkSizeMB:   1,
+		ChunkChecksum: true,
+		ChunkMarkers:  true,
+	}
+
+	err := Encrypt(original, encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	writer, err := NewEncryptWriter(&stream, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = writer.Write(data)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(streamed, stream.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileName := range []string{encrypted, streamed} {
+		reader, err := OpenFileReader(fileName, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reader.Size() != int64(len(data)) {
+			t.Error("expected the plaintext's size, got ", reader.Size())
+		}
+
+		// Within a chunk, across chunk boundaries, and past the end
+		for _, span := range [][2]int64{{0, 10}, {bytesFromMB(1) - 5, bytesFromMB(1) + 5}, {100, bytesFromMB(3) + 100}, {int64(len(data)) - 10, int64(len(data))}} {
+			buffer := make([]byte, span[1]-span[0])
+
+			read, err := reader.ReadAt(buffer, span[0])
+			if (err != nil && err != io.EOF) || !bytes.Equal(buffer[:read], data[span[0]:span[1]]) {
+				t.Error("expected bytes ", span[0], "-", span[1], " of the plaintext: ", err)
+			}
+		}
+
+		read, err := reader.ReadAt(make([]byte, 20), int64(len(data))-10)
+		if read != 10 || err != io.EOF {
+			t.Error("expected a read past the end to stop at the end with io.EOF: ", read, err)
+		}
+
+		_ = reader.Close()
+	}
+
+	// A damaged chunk fails its reads, the chunks around it are still read
+	damaged, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := Inspect(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged[inspection.HeaderBytes+bytesFromMB(1)+1000] ^= 1
+	if err = os.WriteFile(encrypted, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenFileReader(encrypted, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(reader *FileReader) {
+		_ = reader.Close()
+	}(reader)
+
+	if _, err = reader.ReadAt(make([]byte, 10), bytesFromMB(1)+10); err == nil {
+		t.Error("expected a damaged chunk to fail")
+	}
+
+	buffer := make([]byte, 10)
+	if _, err = reader.ReadAt(buffer, bytesFromMB(2)); err != nil || !bytes.Equal(buffer, data[bytesFromMB(2):bytesFromMB(2)+10]) {
+		t.Error("expected the chunk after a damaged one to be read: ", err)
+	}
+
+	wrongKey := options
+	wrongKey.KeyHex = "10a8caca8965ae9b0de13b699012b2331acc003960c287408a55c5e133aedff6"
+
+	if wrongReader, err := OpenFileReader(streamed, &wrongKey); err == nil {
+		if _, err = wrongReader.ReadAt(buffer, 0); err == nil {
+			t.Error("expected the wrong key to fail")
+		}
+
+		_ = wrongReader.Close()
+	}
+}
+
+func Test_Compression(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 3<<20; i++ {
+		fmt.Fprintf(&text, "%d: %s\n", i*i%1009, strings.Repeat("compressible ", i%5))
+	}
+
+	original := filepath.Join(tempDir, "original")
+	encrypted := filepath.Join(tempDir, "encrypted")
+
+	err := os.WriteFile(original, text.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encryptDecryptAndCompare(original, encrypted, filepath.Join(tempDir, "decrypted"), &Options{KeyHex: testKeyHex, Compression: CompressionZstd}, &Options{KeyHex: testKeyHex})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := Inspect(encrypted)
+	if err != nil || inspection.Compression != CompressionZstd || inspection.FormatVersion != "1.15" || inspection.PlaintextBytes > int64(text.Len())/4 {
+		t.Error("expected a smaller file saying it is compressed: ", inspection.PlaintextBytes, err)
+	}
+
+	err = Decrypt(encrypted, filepath.Join(tempDir, "limited"), &Options{KeyHex: testKeyHex, MaxOutputBytes: int64(text.Len()) - 1})
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Error("expected the output limit to apply to the decompressed plaintext: ", err)
+	}
+
+	if _, err = OpenFileReader(encrypted, &Options{KeyHex: testKeyHex}); err == nil {
+		t.Error("expected a compressed file not to be read at an offset")
+	}
+
+	err = Encrypt(original, filepath.Join(tempDir, "unknown"), &Options{KeyHex: testKeyHex, Compression: "brotli"})
+	if err == nil {
+		t.Error("expected an unknown compression to be refused")
+	}
+
+	// Data that does not compress, streamed over several chunks
+	random := make([]byte, 2<<20+12345)
+	if _, err = rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, Compression: CompressionZstd, ChunkSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rest := random; len(rest) > 0; rest = rest[len(rest)/3+1:] {
+		if _, err = writer.Write(rest[:len(rest)/3+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDecryptReader(bytes.NewReader(stream.Bytes()), &Options{KeyHex: testKeyHex})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, random) {
+		t.Error("expected the stream to decompress to what was written: ", err)
+	}
+
+	// Cut short the stream fails, even where the compressed data could have ended
+	reader, err = NewDecryptReader(bytes.NewReader(stream.Bytes()[:stream.Len()-100]), &Options{KeyHex: testKeyHex})
+	if err == nil {
+		_, err = io.ReadAll(reader)
+	}
+
+	if err == nil {
+		t.Error("expected a truncated stream to fail")
+	}
+
+	// A frame written by the zstd CLI (1.5.6, -19), a skippable frame, and one of ours
+	var lines bytes.Buffer
+	words := []string{"alpha", "größe", "café", "naïve", "zeta", "ünïcödé", "omega"}
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&lines, "line %d: %s %x\n", i, words[i*5%len(words)], i*i*i)
+	}
+
+	zstdCLIFrame, _ := hex.DecodeString("" +
+		"28b52ffd64ca103525007a51680b22a027950e737c3a24543589fddf6feda5fd6defbde77f63884c524a2925affb667304bf00a800a4009a75e57865" +
+		"3eac0a352a5d817e3746da41686d0ffa39aede8852e2b1c42377b669f6a4a25a2b26b2c5f1e950b3c72ce1a52009eacb914355e0bf7b94e466fb75f0" +
+		"34d07533d8f00eae09e2cd90d38bbb5c17433b4f7fecbb55ea8a7c873c88a03d493a99a96dca53053fc4e1de4cb2cc906e2c784badeb8aa4e508120c" +
+		"b268100618048201fa82386004182018dca0601238587050c08160600fe6000507224130280a0a1c94050744c14182050e8201197010001080400403" +
+		"0793200004012b88d0164574aa44d88e642e97fd3881ecab3bc1a6618698fd099a531553d4f64b1e422aa8449070e83c12cc84cc281347075d1c1ade" +
+		"2544c4da99e27ac422e8f7c6862cc6e0a26f786f7cc7ed64f34567d0c976d1e01f83d7b01fc5f4887a524d6a64da399978632a6ff7180ca635309452" +
+		"2ad2cb30b41633e3fa08b98f927b7a5b5e4822b60b68db7767b898fd94b042916a6432ce9c765516f625ce37ad94da4654aad9179e024f9166762e5a" +
+		"a9f767f43d6a168c45ac9685f5a9927ddcd5a627444f258dbb41db5bea8e304becc363d42125116462ca96cf8638afbd59fa178969a95d99a9451cb1" +
+		"e4b8ba72d05899ef645563cb55d19da7b2d189b8c2dab62bfc28ddd11fbca1c42ca4109a2895336312b2178e515bf7a0b20d0a978a1c4b7b2a5a7a39" +
+		"ebd5474529873953fc8dcd23c2739a6d45aa73a61cd1eddc997014315a93df9046a99354e59e06748f5dc3be90a686977171aabe33a539f08a14efcd" +
+		"7374354a9a6d933a562832d0fe5c3cbd5867cd35e68d28b1d497ad32d7907506b48dcf5dd35eec54cec02a1e2a907ce51cfd21ec8afb334e0c272a7b" +
+		"18d4b619e6b11242bc551a0f957ccce444b9322247e8a9475877a4d8b505feae46a4a74742f0b2e0f81dfaccd9851be7a82e58fea7f88a4c11c7c8f6" +
+		"8d394f412c7b3d45ec4888879a14b38996558e1762a8dd06818aa811a09951daae64580391d5a805550721040803d5d116d4010292262750c7950da5" +
+		"52841219ce938160f89d060c99393bd3762053a662431ddaeb5bfc97e06e832250059402a456e001d18e3d62b48d1ebf525d723ed3b09fdb58a4880c" +
+		"5404bec832789cd1586003a647aa4bce67de9b5b29b18e9422a457e00129d8620c4d2d8ac8267186546ba0e993449cae65dc4ec1e29f1ede09ad6934" +
+		"a08c20b5a000286c316612473949a3c242aa3d7894d15840bd20adfc9435ce3a24fb6cf79583559e4403731299a7a19a9295d2c0a974077b13dc6506" +
+		"7256193f9a0523a27d47527781586cf946441502ad0d92be279fb6cce52e204f60e741687a3a471eb8ef24f9e9ce8570d4f40b4dd21ee55a2adc24a2" +
+		"f748b6af60aac4673d2815f01dc2b1dd0e671699bcb40ae9228e0ea4dea2dcb27cbe9592479eabd3cda24210874a77b12b6af2fa432b0a1c627a55b8" +
+		"98119ade02e8e138ffbdbc2cc5448ac95ee48d4a7ec4b8ac9ff1c892369fc4592f9924c495fc8cd24072734b83c825a112e380142a0a7b27364f9240" +
+		"ccfd46f109654238f39e87678223660318986ba7b06c12821397199cc872d6c08f0ece81a451103f7a043d8a014c43a0107e7350e9f0cb0795599f2a" +
+		"3c5375c6")
+
+	var ours bytes.Buffer
+	compressor := newZstdWriter(&ours)
+	if _, err = compressor.Write(lines.Bytes()); err != nil || compressor.Close() != nil {
+		t.Fatal(err)
+	}
+
+	frames := append(append([]byte{}, zstdCLIFrame...), 0x50, 0x2A, 0x4D, 0x18, 3, 0, 0, 0, 1, 2, 3)
+	frames = append(frames, ours.Bytes()...)
+
+	decompressed, err := io.ReadAll(newZstdReader(bytes.NewReader(frames)))
+	if err != nil || !bytes.Equal(decompressed, append(append([]byte{}, lines.Bytes()...), lines.Bytes()...)) {
+		t.Error("expected zstd frames to decompress: ", err)
+	}
+
+	damaged := append([]byte{}, zstdCLIFrame...)
+	damaged[len(damaged)/2] ^= 0x40
+
+	if _, err = io.ReadAll(newZstdReader(bytes.NewReader(damaged))); err == nil {
+		t.Error("expected a damaged frame to fail")
+	}
+}
+
+func Test_Report(t *testing.T) {
+	filesDir := getTestFilesDirectory()
+	reportDir := t.TempDir()
+
+	for _, name := range []string{"intact.enc", "damaged.enc"} {
+		err := Encrypt(filepath.Join(filesDir, "small.txt"), filepath.Join(reportDir, name), &Options{KeyHex: testKeyHex, ChunkChecksum: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := Encrypt(filepath.Join(filesDir, "small.txt"), filepath.Join(reportDir, "unchecksummed.enc"), &Options{KeyHex: testKeyHex, Cipher: "XChaCha20-Poly1305"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(reportDir, "notes.txt"), []byte("not encrypted"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged, err := os.OpenFile(filepath.Join(reportDir, "damaged.enc"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, _ := damaged.Stat()
+	_, err = damaged.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, stats.Size()/2)
+	_ = damaged.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := Policy{AllowedCiphers: []string{"AES-256-GCM"}}
+	reportOptions := ReportOptions{Authenticate: true, Policies: []Policy{policy}}
+
+	report, err := ReportVerification(reportDir, &reportOptions, &Options{KeyHex: testKeyHex})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Summary.Files != 3 || report.Summary.Passed != 1 || report.Summary.Failed != 2 || report.Summary.Skipped != 1 || report.Summary.Violations != 1 {
+		t.Fatalf("expected one file to pass, one damaged, one violating the policy, and one skipped: %+v", report.Summary)
+	}
+
+	for _, file := range report.Files {
+		switch file.FileName {
+		case "intact.enc":
+			if !file.Passed || !file.Authenticated || file.ChunksVerified != file.NumChunks || file.FileID == "" {
+				t.Errorf("expected every chunk of the intact file to authenticate: %+v", file)
+			}
+		case "damaged.enc":
+			if file.Passed || file.Error == "" {
+				t.Errorf("expected the damaged file to fail: %+v", file)
+			}
+		case "unchecksummed.enc":
+			if file.Passed || !file.Authenticated || len(file.Violations) != 1 {
+				t.Errorf("expected the file to authenticate and fail the policy: %+v", file)
+			}
+		}
+	}
+
+	if report.Parameters.KeyFingerprint == "" || !report.Parameters.Authenticated {
+		t.Error("expected the parameters to say files were authenticated, and with which key")
+	}
+
+	// Passwords can be guessed from their fingerprints, reports are published
+	withPassword, err := ReportVerification(reportDir, &ReportOptions{Authenticate: true}, &Options{Password: "a password"})
+	if err != nil || withPassword.Parameters.KeyFingerprint != "" {
+		t.Errorf("expected no fingerprint for a password: %+v %v", withPassword.Parameters, err)
+	}
+
+	// Without the key, files are only scrubbed
+	keyless, err := ReportVerification(reportDir, &ReportOptions{}, &Options{})
+	if err != nil || keyless.Summary.Passed != 2 || keyless.Parameters.KeyFingerprint != "" {
+		t.Errorf("expected the intact files to pass a keyless report: %+v %v", keyless.Summary, err)
+	}
+
+	findings := auditFindings(&FileInspection{KeySource: KeySourcePassword, KDFIterations: 1000, Supported: true})
+	if len(findings) != 3 {
+		t.Error("expected findings for no chunk AAD, no footer, and few KDF iterations: ", findings)
+	}
+
+	signingKey, publicKey, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKeyFilename := filepath.Join(t.TempDir(), "signing.key")
+	err = os.WriteFile(signingKeyFilename, []byte(signingKey+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{ReportFormatJSON, ReportFormatHTML} {
+		data, signature, err := RenderReport(&report, format, &Options{SigningKey: signingKeyFilename})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// html/template writes a + in the key as &#43;
+		if !strings.Contains(html.UnescapeString(string(data)), publicKey) || !bytes.Contains(data, []byte("damaged.enc")) {
+			t.Error("expected the report to name its signer and every file: ", format)
+		}
+
+		err = VerifyReportSignature(data, signature, []string{publicKey})
+		if err != nil {
+			t.Error("expected the report's signature to verify: ", format, err)
+		}
+
+		err = VerifyReportSignature(append(data, ' '), signature, []string{publicKey})
+		if err == nil {
+			t.Error("expected a changed report not to verify: ", format)
+		}
+
+		_, otherKey, _ := GenerateSigningKey()
+		err = VerifyReportSignature(data, signature, []string{otherKey})
+		if err == nil {
+			t.Error("expected a report signed by someone else not to verify: ", format)
+		}
+	}
+
+	var parsed VerificationReport
+	data, signature, err := RenderReport(&report, ReportFormatJSON, &Options{})
+	if err != nil || signature != "" || json.Unmarshal(data, &parsed) != nil || parsed.Summary != report.Summary {
+		t.Error("expected an unsigned JSON report that parses back: ", err)
+	}
+
+	_, _, err = RenderReport(&report, "pdf", &Options{})
+	if err == nil {
+		t.Error("expected an unknown report format to be refused")
+	}
+}
+
+// A codec of the caller's own, reversing each write so a file it compressed is plainly not the plaintext
+type reversingCodec struct{}
+
+func (reversingCodec) Name() string { return "test-reverse" }
+
+func (reversingCodec) NewWriter(target io.Writer) io.WriteCloser {
+	return nopWriteCloser{writerFunc(func(data []byte) (int, error) {
+		reversed := make([]byte, len(data)+4)
+		binary.BigEndian.PutUint32(reversed, uint32(len(data)))
+		for i, b := range data {
+			reversed[len(reversed)-1-i] = b
+		}
+
+		_, err := target.Write(reversed)
+		return len(data), err
+	})}
+}
+
+func (reversingCodec) NewReader(source io.Reader) io.Reader {
+	var pending []byte
+	return readerFunc(func(data []byte) (int, error) {
+		if len(pending) == 0 {
+			size := make([]byte, 4)
+			if _, err := io.ReadFull(source, size); err != nil {
+				return 0, err
+			}
+
+			pending = make([]byte, binary.BigEndian.Uint32(size))
+			if _, err := io.ReadFull(source, pending); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			for i, j := 0, len(pending)-1; i < j; i, j = i+1, j-1 {
+				pending[i], pending[j] = pending[j], pending[i]
+			}
+		}
+
+		n := copy(data, pending)
+		pending = pending[n:]
+		return n, nil
+	})
+}
+
+type writerFunc func(data []byte) (int, error)
+
+func (write writerFunc) Write(data []byte) (int, error) { return write(data) }
+
+type readerFunc func(data []byte) (int, error)
+
+func (read readerFunc) Read(data []byte) (int, error) { return read(data) }
+
+func Test_CompressionCodecs(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 5<<20; i++ {
+		fmt.Fprintf(&text, "%d: %s\n", i*i%1009, strings.Repeat("compressible ", i%5))
+	}
+
+	original := filepath.Join(tempDir, "original")
+	err := os.WriteFile(original, text.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RegisterCodec(reversingCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RegisterCodec(reversingCodec{}); err == nil {
+		t.Error("expected a codec's name to be registered only once")
+	}
+
+	for _, compression := range []string{CompressionGzip, CompressionLZ4, CompressionNone, "test-reverse"} {
+		encrypted := filepath.Join(tempDir, compression+".enc")
+
+		err = encryptDecryptAndCompare(original, encrypted, filepath.Join(tempDir, compression), &Options{KeyHex: testKeyHex, Compression: compression, ChunkSizeMB: 1}, &Options{KeyHex: testKeyHex})
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+
+		inspection, err := Inspect(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch compression {
+		case CompressionNone:
+			if inspection.Compression != "" || inspection.FormatVersion == "1.15" {
+				t.Error("expected none to leave the file as it would be uncompressed: ", inspection.Compression, inspection.FormatVersion)
+			}
+		case "test-reverse":
+			if inspection.Compression != compression {
+				t.Error("expected the header to name the registered codec: ", inspection.Compression)
+			}
+		default:
+			if inspection.Compression != compression || inspection.FormatVersion != "1.15" || inspection.PlaintextBytes > int64(text.Len())/3 {
+				t.Error("expected a smaller file naming its codec: ", compression, inspection.PlaintextBytes)
+			}
+		}
+	}
+
+	capabilities := GetCapabilities()
+	if strings.Join(capabilities.Compressions, ",") != "zstd,gzip,lz4,none,test-reverse" {
+		t.Error("expected capabilities to list every codec: ", capabilities.Compressions)
+	}
+
+	// A frame written by the lz4 CLI (1.9.4, -BD -B4 -BX --content-size), linked blocks with checksums
+	lz4CLIFrame, _ := hex.DecodeString("04224d187c4073000000000000005136000000f00f656e63727970746f7220636f6d707265737365732077697468206c7a342c0500081900062e00172d0c000f3a001750746f722e0ab97cafe500000000672a1b1b")
+
+	decompressed, err := io.ReadAll(newLZ4Reader(bytes.NewReader(lz4CLIFrame)))
+	if err != nil || string(decompressed) != "encryptor compresses with lz4, lz4 compresses encryptor - encryptor compresses with lz4, lz4 compresses encryptor.\n" {
+		t.Error("expected the lz4 CLI's frame to decompress: ", err, string(decompressed))
+	}
+
+	damaged := append([]byte{}, lz4CLIFrame...)
+	damaged[30] ^= 1
+	if _, err = io.ReadAll(newLZ4Reader(bytes.NewReader(damaged))); err == nil {
+		t.Error("expected a damaged lz4 block to fail its checksum")
+	}
+
+	if _, err = io.ReadAll(newLZ4Reader(bytes.NewReader(lz4CLIFrame[:len(lz4CLIFrame)-6]))); err == nil {
+		t.Error("expected a truncated lz4 frame to fail")
+	}
+
+	// Compressed and decompressed again, where the greedy matcher's limits are: the end of a block, and data that does not match
+	random := make([]byte, lz4BlockMaxBytes+70000)
+	if _, err = rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(random[lz4BlockMaxBytes-100:], bytes.Repeat([]byte{'z'}, 200))
+	for _, data := range [][]byte{nil, []byte("short"), bytes.Repeat([]byte{'a'}, 13), random} {
+		var compressed bytes.Buffer
+		writer := newLZ4Writer(&compressed)
+		if _, err = writer.Write(data); err != nil || writer.Close() != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err = io.ReadAll(newLZ4Reader(bytes.NewReader(compressed.Bytes())))
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Error("expected lz4 to decompress to what was compressed: ", len(data), err)
+		}
+	}
+
+	if lz4XXH32Sum(nil) != 0x02CC5D05 || lz4XXH32Sum([]byte("encryptor compresses with lz4")) != newLZ4XXH32Of("encryptor compresses with lz4") {
+		t.Error("expected XXH32 to match its reference value, whole and streamed")
+	}
+}
+
+func Test_CompressionStage(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 5<<20+333; i++ {
+		fmt.Fprintf(&text, "%d: %s\n", i*i%1009, strings.Repeat("compressible ", i%5))
+	}
+
+	original := filepath.Join(tempDir, "original")
+	if err := os.WriteFile(original, text.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames compressed by several workers read back as the one stream of each codec
+	for _, compression := range []string{CompressionZstd, CompressionGzip, CompressionLZ4} {
+		var report StageReport
+		encrypted := filepath.Join(tempDir, compression+".enc")
+
+		err := encryptDecryptAndCompare(original, encrypted, filepath.Join(tempDir, compression), &Options{KeyHex: testKeyHex, Compression: compression, Compressors: 4, ChunkSizeMB: 1, StageReport: &report}, &Options{KeyHex: testKeyHex})
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+
+		if len(report.Stages) != 3 || report.Elapsed <= 0 {
+			t.Fatal("expected the read, compress, and seal stages to be reported: ", report)
+		}
+
+		read, compress, seal := report.Stages[0], report.Stages[1], report.Stages[2]
+		if read.Name != "read" || read.Bytes != int64(text.Len()) || compress.Name != "compress" || compress.Workers != 4 || compress.Bytes != int64(text.Len()) {
+			t.Error("expected the plaintext to pass through reading and the compression workers: ", report.Stages)
+		}
+
+		if seal.Name != "seal" || seal.Bytes <= 0 || seal.Bytes > int64(text.Len())/3 || compress.Throughput() <= 0 || compress.Utilization(report.Elapsed) <= 0 {
+			t.Error("expected the compressed frames to be sealed: ", report.Stages)
+		}
+	}
+
+	// Written to a stream a few bytes at a time, and nothing at all, with one worker
+	for _, data := range [][]byte{text.Bytes()[:3<<20+7], nil} {
+		var stream bytes.Buffer
+		writer, err := NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, Compression: CompressionZstd, Compressors: 1, ChunkSizeMB: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for rest := data; len(rest) > 0; rest = rest[len(rest)/7+1:] {
+			if _, err = writer.Write(rest[:len(rest)/7+1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewDecryptReader(&stream, &Options{KeyHex: testKeyHex})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decrypted, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Error("expected a stream compressed by the stage to decrypt: ", len(data), err)
+		}
+	}
+
+	// Several files add up in one report
+	var report StageReport
+	for _, name := range []string{"first", "second"} {
+		if err := Encrypt(original, filepath.Join(tempDir, name), &Options{KeyHex: testKeyHex, Compression: CompressionLZ4, StageReport: &report}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(report.Stages) != 3 || report.Stages[0].Bytes != 2*int64(text.Len()) || report.Stages[1].Workers != int(DefaultExecutors()) {
+		t.Error("expected the stages of both files in one report, with as many compression workers as executors: ", report.Stages)
+	}
+}
+
+func Test_CompressionDictionary(t *testing.T) {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "source")
+
+	if err := os.MkdirAll(source, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		record := fmt.Sprintf(`{"id": %d, "user": "user%d@example.com", "level": "info", "message": "request served", "path": "/api/v1/items/%d", "status": %d}`, i, i%17, i*31, 200+i%3)
+		if err := os.WriteFile(filepath.Join(source, fmt.Sprintf("record%03d.json", i)), []byte(record+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The dictionary is trained from the directory, sealed in the header, and every entry reads back
+	options := Options{KeyHex: testKeyHex, Compression: CompressionZstd, ZstdDictionary: true}
+	encrypted := filepath.Join(tempDir, "encrypted")
+
+	target, err := os.Create(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = EncryptDirectory(source, target, &options)
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := Inspect(encrypted)
+	if err != nil || !inspection.Dictionary || inspection.FormatVersion != "1.17" {
+		t.Error("expected a sealed dictionary and format 1.17: ", inspection.Dictionary, inspection.FormatVersion, err)
+	}
+
+	sealed, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(tempDir, "restored")
+	if err = DecryptDirectory(bytes.NewReader(sealed), restored, &Options{KeyHex: testKeyHex}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("record%03d.json", i)
+		original, _ := os.ReadFile(filepath.Join(source, name))
+		data, err := os.ReadFile(filepath.Join(restored, name))
+		if err != nil || !bytes.Equal(data, original) {
+			t.Fatal("expected every entry to be restored: ", name, err)
+		}
+	}
+
+	// The same entries compressed a frame each without the dictionary come to more
+	samples, err := sampleArchiveEntries(source)
+	if err != nil || len(samples) != 200 {
+		t.Fatal("expected every file to be sampled: ", len(samples), err)
+	}
+
+	trained := trainZstdDictionary(samples)
+	dictionary, err := parseZstdDictionary(trained)
+	if err != nil || len(dictionary.content) == 0 || dictionary.id < zstdDictionaryMinID {
+		t.Fatal("expected the trained dictionary to parse: ", err)
+	}
+
+	withDictionary, without := 0, 0
+	for _, sample := range samples {
+		var frame, plain bytes.Buffer
+
+		compressor := newZstdDictionaryWriter(&frame, dictionary)
+		_, _ = compressor.Write(sample)
+		if err = compressor.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		compressor = newZstdWriter(&plain)
+		_, _ = compressor.Write(sample)
+		_ = compressor.Close()
+
+		decompressed, err := io.ReadAll(newZstdDictionaryReader(bytes.NewReader(frame.Bytes()), dictionary))
+		if err != nil || !bytes.Equal(decompressed, sample) {
+			t.Fatal("expected a frame compressed with the dictionary to read back with it: ", err)
+		}
+
+		withDictionary += frame.Len()
+		without += plain.Len()
+	}
+
+	if withDictionary >= without/2 {
+		t.Error("expected the dictionary to compress small entries far better: ", withDictionary, without)
+	}
+
+	// A frame naming a dictionary is not read without it, or with another
+	var frame bytes.Buffer
+	compressor := newZstdDictionaryWriter(&frame, dictionary)
+	_, _ = compressor.Write(samples[0])
+	_ = compressor.Close()
+
+	if _, err = io.ReadAll(newZstdReader(bytes.NewReader(frame.Bytes()))); err == nil {
+		t.Error("expected a frame naming a dictionary to need it")
+	}
+
+	other, err := parseZstdDictionary(encodeZstdDictionary(bytes.Repeat([]byte("other content "), 10), make([]uint32, 129)))
+	if err != nil || other.id == dictionary.id {
+		t.Fatal("expected another dictionary: ", err)
+	}
+
+	if _, err = io.ReadAll(newZstdDictionaryReader(bytes.NewReader(frame.Bytes()), other)); err == nil {
+		t.Error("expected a frame naming one dictionary not to be read with another")
+	}
+
+	// A dictionary's FSE distributions read back as they were written
+	for _, predefined := range []struct {
+		distribution []int16
+		accuracyLog  uint8
+	}{
+		{zstdLiteralLengthDistribution, zstdLiteralLengthAccuracyLog},
+		{zstdMatchLengthDistribution, zstdMatchLengthAccuracyLog},
+		{zstdOffsetDistribution, zstdOffsetAccuracyLog},
+	} {
+		written := writeZstdFSEDistribution(nil, predefined.distribution, predefined.accuracyLog)
+		distribution, accuracyLog, used, err := readZstdFSEDistribution(written, len(predefined.distribution)-1, predefined.accuracyLog)
+		if err != nil || used != len(written) || accuracyLog != predefined.accuracyLog || fmt.Sprint(distribution[:len(predefined.distribution)]) != fmt.Sprint(predefined.distribution) {
+			t.Error("expected the distribution to read back: ", distribution, err)
+		}
+	}
+
+	// Too few files train nothing, and only zstd has a dictionary
+	few := filepath.Join(tempDir, "few")
+	if err = os.MkdirAll(few, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(filepath.Join(few, "one.json"), []byte(`{"id": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if trained, err := trainArchiveDictionary(few, &options); err != nil || trained != nil {
+		t.Error("expected no dictionary for a single file: ", err)
+	}
+
+	if _, err = trainArchiveDictionary(source, &Options{Compression: CompressionGzip, ZstdDictionary: true}); err == nil {
+		t.Error("expected a dictionary for gzip to be refused")
+	}
+}
+
+// The XXH32 of text written a byte at a time
+func newLZ4XXH32Of(text string) uint32 {
+	hash := newLZ4XXH32()
+	for i := range text {
+		hash.write([]byte{text[i]})
+	}
+
+	return hash.sum32()
+}
+
+func Test_TempFiles(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Earlier tests (the TPM and PKCS#11 ones) may have made a session in the system's temporary directory
+	err := RemoveTempFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = SetTempDir(filepath.Join(tempDir, "missing")); err == nil {
+		t.Error("expected a temporary directory that does not exist to be refused")
+	}
+
+	err = SetTempDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = RemoveTempFiles()
+		_ = SetTempDir("")
+	}()
+
+	// Left by crashed runs: unlocked, and locked by something still running, and one made an instant ago
+	crashed := filepath.Join(tempDir, tempSessionPrefix+"crashed")
+	running := filepath.Join(tempDir, tempSessionPrefix+"running")
+	starting := filepath.Join(tempDir, tempSessionPrefix+"starting")
+
+	for _, session := range []string{crashed, running, starting} {
+		if err = os.Mkdir(session, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, session := range []string{crashed, running} {
+		if err = os.WriteFile(filepath.Join(session, tempSessionLockName), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = os.WriteFile(filepath.Join(crashed, "preview-1"), []byte("plaintext"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := os.Open(filepath.Join(running, tempSessionLockName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(lock *os.File) {
+		_ = lock.Close()
+	}(lock)
+
+	if locked, err := lockTempSession(lock); !locked || err != nil {
+		t.Fatal("could not lock the running session: ", err)
+	}
+
+	file, err := CreateTempFile("preview-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = file.Close()
+
+	if filepath.Dir(filepath.Dir(file.Name())) != tempDir || !strings.HasPrefix(filepath.Base(filepath.Dir(file.Name())), tempSessionPrefix) {
+		t.Error("expected the temporary file in a session under the temporary directory: ", file.Name())
+	}
+
+	if runtime.GOOS != "windows" {
+		fileInfo, _ := os.Stat(file.Name())
+		sessionInfo, _ := os.Stat(filepath.Dir(file.Name()))
+		if fileInfo.Mode().Perm() != 0600 || sessionInfo.Mode().Perm() != 0700 {
+			t.Error("expected temporary files only the user can read: ", fileInfo.Mode(), sessionInfo.Mode())
+		}
+	}
+
+	if err = SetTempDir(t.TempDir()); err == nil {
+		t.Error("expected the temporary directory not to change once a session is made in it")
+	}
+
+	removed, err := CleanStaleTempFiles()
+	if err != nil || removed != 1 {
+		t.Error("expected only the crashed session to be removed: ", removed, err)
+	}
+
+	for session, kept := range map[string]bool{crashed: false, running: true, starting: true, filepath.Dir(file.Name()): true} {
+		if _, err = os.Stat(session); (err == nil) != kept {
+			t.Error("expected ", session, " kept ", kept, ": ", err)
+		}
+	}
+
+	err = RemoveTempFiles()
+	if _, statErr := os.Stat(filepath.Dir(file.Name())); err != nil || !os.IsNotExist(statErr) {
+		t.Error("expected the session to be removed with its files: ", err, statErr)
+	}
+
+	// A leftover of an interrupted write is replaced, not written through with the permissions it had
+	state := filepath.Join(tempDir, "state.json")
+	if err = os.WriteFile(state+".tmp", []byte("half written"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeFileAtomic(state, []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(state)
+	info, _ := os.Stat(state)
+	_, statErr := os.Stat(state + ".tmp")
+	if string(data) != "{}" || !os.IsNotExist(statErr) || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Error("expected the file written in place of the leftover: ", string(data), statErr, info.Mode())
+	}
+}
+
+func Test_StoredName(t *testing.T) {
+	tempDir := t.TempDir()
+	otherKeyHex := "0000000000000000000000000000000000000000000000000000000000000001"
+
+	original := filepath.Join(tempDir, "report.txt")
+	err := os.WriteFile(original, bytes.Repeat([]byte("quarterly numbers\n"), 1000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unnamed := filepath.Join(tempDir, "unnamed.enc")
+	err = Encrypt(original, unnamed, &Options{KeyHex: testKeyHex})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OriginalName(unnamed, &Options{KeyHex: testKeyHex}); !errors.Is(err, ErrNoStoredName) {
+		t.Error("expected a file encrypted without a name to say so: ", err)
+	}
+
+	unnamedInspection, _ := Inspect(unnamed)
+
+	for _, storeName := range []string{NameStorePlain, NameStoreSealed} {
+		encrypted := filepath.Join(tempDir, storeName+".enc")
+
+		err = encryptDecryptAndCompare(original, encrypted, filepath.Join(tempDir, storeName), &Options{KeyHex: testKeyHex, StoreName: storeName}, &Options{KeyHex: testKeyHex})
+		if err != nil {
+			t.Fatal(storeName, err)
+		}
+
+		name, err := OriginalName(encrypted, &Options{KeyHex: testKeyHex})
+		if err != nil || name != "report.txt" {
+			t.Error("expected the source's name back: ", storeName, name, err)
+		}
+
+		inspection, _ := Inspect(encrypted)
+		if (inspection.Name == "report.txt") != (storeName == NameStorePlain) || inspection.NameSealed != (storeName == NameStoreSealed) {
+			t.Errorf("expected only a plain name to be shown without the key: %+v", inspection)
+		}
+
+		if inspection.FormatVersion != unnamedInspection.FormatVersion {
+			t.Error("expected a name not to need a newer format version: ", inspection.FormatVersion)
+		}
+
+		// A plain name needs no key, a sealed one needs the right one
+		_, err = OriginalName(encrypted, &Options{KeyHex: otherKeyHex})
+		if (storeName == NameStorePlain) != (err == nil) || (err != nil && !errors.Is(err, ErrAuthenticationFailed)) {
+			t.Error("expected only the sealed name to need the file's key: ", storeName, err)
+		}
+	}
+
+	// Headers are anyone's to write, a name that is a path is refused - and changing it fails the decryption
+	data, err := os.ReadFile(filepath.Join(tempDir, NameStorePlain+".enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := filepath.Join(tempDir, "tampered.enc")
+	err = os.WriteFile(tampered, bytes.Replace(data, []byte(`"report.txt"`), []byte(`"../rep.txt"`), 1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OriginalName(tampered, &Options{}); !errors.Is(err, ErrFileCorrupt) {
+		t.Error("expected a name that is a path to be refused: ", err)
+	}
+
+	err = Decrypt(tampered, filepath.Join(tempDir, "tampered"), &Options{KeyHex: testKeyHex})
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("expected a changed name to fail the decryption: ", err)
+	}
+
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`, "tab\there", strings.Repeat("n", 256), "\xff"} {
+		if checkStoredName(name) == nil {
+			t.Errorf("expected %q to be refused as a name", name)
+		}
+	}
+
+	// Streams have no source filename to take a name from
+	if _, err = NewEncryptWriter(io.Discard, &Options{KeyHex: testKeyHex, StoreName: NameStoreSealed}); err == nil {
+		t.Error("expected a stream to need OriginalName to store a name")
+	}
+
+	var stream bytes.Buffer
+	writer, err := NewEncryptWriter(&stream, &Options{KeyHex: testKeyHex, StoreName: NameStoreSealed, OriginalName: "stream.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = writer.Write([]byte("logged")); err != nil || writer.Close() != nil {
+		t.Fatal(err)
+	}
+
+	streamed := filepath.Join(tempDir, "streamed.enc")
+	if err = os.WriteFile(streamed, stream.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if name, err := OriginalName(streamed, &Options{KeyHex: testKeyHex}); err != nil || name != "stream.log" {
+		t.Error("expected a stream's name back: ", name, err)
+	}
+
+	if err = Encrypt(original, filepath.Join(tempDir, "unknown.enc"), &Options{KeyHex: testKeyHex, StoreName: "hidden"}); err == nil {
+		t.Error("expected an unknown way of storing the name to be refused")
+	}
+}
+
+func Test_Shred(t *testing.T) {
+	tempDir := t.TempDir()
+
+	plaintext := filepath.Join(tempDir, "payroll.csv")
+	err := os.WriteFile(plaintext, bytes.Repeat([]byte("name,salary\n"), 200000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second name for the same data sees what shredding did to it
+	witness := filepath.Join(tempDir, "witness")
+	if err = os.Link(plaintext, witness); err != nil {
+		t.Skip("hard links are needed to see what shredding did: ", err)
+	}
+
+	report, err := Shred(plaintext, &ShredOptions{Passes: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(witness)
+	if _, statErr := os.Stat(plaintext); err != nil || info.Size() != 0 || !os.IsNotExist(statErr) || report.Bytes != 2400000 || len(report.Files) != 1 {
+		t.Errorf("expected the file overwritten, truncated, and unlinked: %+v %v", report, statErr)
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 1 {
+		t.Error("expected nothing left but the witness, not even under another name: ", entries)
+	}
+
+	directory := filepath.Join(tempDir, "exports")
+	for _, name := range []string{"a/one.csv", "a/b/two.csv", "a/b/kept.enc", "three.txt"} {
+		fileName := filepath.Join(directory, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.WriteFile(fileName, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = Shred(directory, &ShredOptions{Include: []string{"*.csv", "*.enc"}, Exclude: []string{"kept*"}, DryRun: true})
+	if err != nil || len(report.Files) != 2 {
+		t.Errorf("expected a dry run to list the csv files: %+v %v", report, err)
+	}
+
+	if _, err = os.Stat(filepath.Join(directory, "a", "one.csv")); err != nil {
+		t.Error("expected a dry run to change nothing: ", err)
+	}
+
+	report, err = Shred(directory, &ShredOptions{Exclude: []string{"*.enc"}})
+	if err != nil || len(report.Files) != 3 {
+		t.Errorf("expected every file but the excluded one shredded: %+v %v", report, err)
+	}
+
+	if _, err = os.Stat(filepath.Join(directory, "a", "b", "kept.enc")); err != nil {
+		t.Error("expected an excluded file, and the directories holding it, to be left: ", err)
+	}
+
+	_, err = Shred(directory, &ShredOptions{})
+	if _, statErr := os.Stat(directory); err != nil || !os.IsNotExist(statErr) {
+		t.Error("expected a directory shredded without filters to be removed: ", err, statErr)
+	}
+
+	if _, err = Shred(tempDir, &ShredOptions{Passes: ShredPassesMax + 1}); err == nil {
+		t.Error("expected more passes than any policy asks for to be refused")
+	}
+
+	if _, err = Shred(tempDir, &ShredOptions{Include: []string{"["}}); err == nil {
+		t.Error("expected a malformed pattern to be refused")
+	}
+
+	if _, err = os.Stat(witness); err != nil {
+		t.Error("expected refused shreds to leave everything alone: ", err)
+	}
+}
+
+// Fails as many reads as failures says, then reads from crypto/rand
+type flakyRandom struct {
+	failures int
+}
+
+func (random *flakyRandom) Read(data []byte) (int, error) {
+	if random.failures > 0 {
+		random.failures--
+		return 0, errors.New("getrandom: resource temporarily unavailable")
+	}
+
+	return rand.Read(data)
+}
+
+func Test_Entropy(t *testing.T) {
+	defer func(source io.Reader) {
+		entropySource = source
+	}(entropySource)
+
+	// A hiccup mid job is retried, not the end of the job
+	entropySource = &flakyRandom{failures: 3}
+
+	tempDir := t.TempDir()
+	plaintext := filepath.Join(tempDir, "plaintext")
+	if err := os.WriteFile(plaintext, bytes.Repeat([]byte("entropy"), 100000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	options := Options{KeyHex: "7f3c2a1b9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b"}
+	if err := Encrypt(plaintext, plaintext+".enc", &options); err != nil {
+		t.Fatal("expected failed reads of random data to be retried: ", err)
+	}
+
+	if err := Decrypt(plaintext+".enc", filepath.Join(tempDir, "decrypted"), &options); err != nil {
+		t.Fatal(err)
+	}
+
+	// A generator that keeps failing ends the job, with nothing weaker in its place
+	entropySource = &flakyRandom{failures: entropyRetries + 1}
+	if err := readRandom(make([]byte, 16)); !errors.Is(err, ErrEntropyUnavailable) {
+		t.Error("expected ErrEntropyUnavailable once the retries run out: ", err)
+	}
+
+	entropySource = rand.Reader
+	status, err := CheckEntropy(0)
+	if err != nil || !status.Ready || status.Waited > time.Second {
+		t.Errorf("expected a seeded generator, found without waiting: %+v %v", status, err)
+	}
+}
+
+func Test_Soak(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var rounds []SoakRound
+	soakOptions := SoakOptions{SizeBytes: bytesFromMB(3) + 5, Progress: func(round SoakRound) { rounds = append(rounds, round) }}
+
+	report, err := Soak(tempDir, &soakOptions, &Options{ChunkSizeMB: 1, Readers: 2, Executors: 2, Writers: 1})
+	if err != nil || report.Rounds != 1 || report.FailedRounds != 0 || len(rounds) != 1 || report.BytesEncrypted != soakOptions.SizeBytes {
+		t.Fatalf("expected one clean round: %+v %+v %v", report, rounds, err)
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Error("expected a round to remove what it wrote: ", entries)
+	}
+
+	// A bit flipped on the device is found, and said to be a single bit in its word
+	seed := bytes.Repeat([]byte{7}, 32)
+	fileName := filepath.Join(tempDir, "data")
+	if err = writeSoakData(fileName, seed, &soakOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[1234567] ^= 0x10
+	data[2000000] ^= 0xff
+	if err = os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report = SoakReport{}
+	mismatches, err := compareSoakData(fileName, seed, SoakStageStorage, 1, &soakOptions, &report)
+	if err != nil || mismatches != 2 || report.SingleBitWords != 1 || report.MultiBitWords != 1 || len(report.Mismatches) != 2 {
+		t.Fatalf("expected one single bit and one multi-bit word error: %d %+v %v", mismatches, report, err)
+	}
+
+	if mismatch := report.Mismatches[0]; mismatch.Offset != 1234560 || mismatch.Bits != 1 || mismatch.Expected^mismatch.Found != 0x10<<(8*(7-1234567%8)) {
+		t.Errorf("expected the flipped bit's word to be reported: %+v", mismatch)
+	}
+
+	if err = os.WriteFile(fileName, data[:1000], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = compareSoakData(fileName, seed, SoakStageStorage, 1, &soakOptions, &report); err == nil {
+		t.Error("expected data that did not all come back to fail")
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	soakOptions.Stop = stop
+
+	report, err = Soak(tempDir, &soakOptions, &Options{})
+	if err != nil || !report.Stopped || report.Rounds != 0 {
+		t.Errorf("expected a stopped soak to run no rounds: %+v %v", report, err)
+	}
+}
@@ -0,0 +1,565 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+	For web services, small payloads can be written as a JWE (RFC 7516)
+	instead of in our own format, so any JOSE library can decrypt them
+	without parsing the HLI header. A JWE is one AES-256-GCM encryption of
+	the whole payload in memory - no chunks, no streaming, no footer - so
+	payloads are limited to jweMaxPayloadBytes
+
+	With a password the content key is random and wrapped with a key from
+	PBES2-HS512+A256KW (PBKDF2 with HMAC-SHA-512, then AES Key Wrap), with
+	a key the content is encrypted with it directly ("dir"). Messages are
+	written in the compact serialization (five base64url parts joined by
+	dots) or the flattened JSON serialization, and either, or the general
+	JSON serialization, is read back
+
+	Reading accepts only the algorithms written - the headers of a message
+	choose its algorithms, and a message is never allowed to choose weaker
+	ones (or a PBKDF2 count that would take hours)
+*/
+
+const (
+	JWECompact = "compact"
+	JWEJSON    = "json"
+)
+
+const jweMaxPayloadBytes = 16 * 1024 * 1024
+
+const (
+	jweAlgorithmPBES2  = "PBES2-HS512+A256KW"
+	jweAlgorithmDirect = "dir"
+	jweEncryption      = "A256GCM"
+	jweSaltSize        = 16
+	jweIVSize          = 12
+	jweTagSize         = 16
+)
+
+// RFC 7518 asks for at least 1000, the most is what a message may ask of us
+const (
+	jweMinKDFIterations = 1000
+	jweMaxKDFIterations = 10 * PasswordKDFIterations
+)
+
+// RFC 3394's default initial value, unwrapping to anything else means the wrong key
+var jweKeyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+type jweHeader struct {
+	Algorithm   string   `json:"alg,omitempty"`
+	Encryption  string   `json:"enc,omitempty"`
+	Salt        string   `json:"p2s,omitempty"`
+	Iterations  int      `json:"p2c,omitempty"`
+	Compression string   `json:"zip,omitempty"`
+	Critical    []string `json:"crit,omitempty"`
+}
+
+type jweRecipient struct {
+	Header       *jweHeader `json:"header,omitempty"`
+	EncryptedKey string     `json:"encrypted_key,omitempty"`
+}
+
+// The flattened JSON serialization, or with Recipients the general one
+type jweJSONSerialization struct {
+	Protected    string         `json:"protected"`
+	Unprotected  *jweHeader     `json:"unprotected,omitempty"`
+	Header       *jweHeader     `json:"header,omitempty"`
+	EncryptedKey string         `json:"encrypted_key,omitempty"`
+	Recipients   []jweRecipient `json:"recipients,omitempty"`
+	AAD          string         `json:"aad,omitempty"`
+	IV           string         `json:"iv"`
+	Ciphertext   string         `json:"ciphertext"`
+	Tag          string         `json:"tag"`
+}
+
+type jweMessage struct {
+	header         jweHeader
+	additionalData []byte // What GCM authenticates, the encoded protected header (and aad)
+	encryptedKey   []byte
+	iv             []byte
+	ciphertext     []byte
+	tag            []byte
+}
+
+var jweEncoding = base64.RawURLEncoding
+
+func checkJWEOptions(options *Options) error {
+	if options == nil {
+		return errors.New("options is nil")
+	}
+
+	if len(options.GPGRecipients) > 0 || len(options.SSHRecipients) > 0 || len(options.RecipientsFiles) > 0 || len(options.X25519Recipients) > 0 || len(options.RSARecipients) > 0 || len(options.GCPKMSKeys) > 0 || len(options.AzureKeyVaultKeys) > 0 || len(options.PKCS11Keys) > 0 || options.TPMSeal || len(options.PluginRecipients) > 0 {
+		return errors.New("a JWE is encrypted with a password or a key, not recipients")
+	}
+
+	if options.KeyHex != "" && options.Password != "" {
+		return errors.New("a JWE is encrypted with a password or a key, not both")
+	}
+
+	if options.KeyHex == "" && options.Password == "" {
+		return errors.New("a password or key is needed to encrypt or decrypt a JWE")
+	}
+
+	return nil
+}
+
+// The A256GCM key for "dir", which must be exactly 256 bits
+func jweDirectKey(options *Options) ([]byte, error) {
+	key, err := hex.DecodeString(options.KeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode key: %w", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("a JWE key must be 256 bits, the key given is %d", len(key)*8)
+	}
+
+	return key, nil
+}
+
+// The key PBES2 wraps the content key with, its salt is the algorithm's name, a zero byte, and p2s
+func jwePBES2Key(password string, salt []byte, iterations int) []byte {
+	saltInput := append(append([]byte(jweAlgorithmPBES2), 0), salt...)
+
+	return pbkdf2.Key([]byte(password), saltInput, iterations, 32, sha512.New)
+}
+
+func encryptJWE(source io.Reader, target io.Writer, serialization string, options *Options) error {
+	if source == nil || target == nil {
+		return errors.New("source or target is nil")
+	}
+
+	if serialization != JWECompact && serialization != JWEJSON {
+		return fmt.Errorf("unknown JWE serialization %q, it is %s or %s", serialization, JWECompact, JWEJSON)
+	}
+
+	err := checkJWEOptions(options)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := io.ReadAll(io.LimitReader(source, jweMaxPayloadBytes+1))
+	if err != nil {
+		return fmt.Errorf("could not read source: %w", err)
+	}
+
+	if len(plaintext) > jweMaxPayloadBytes {
+		return fmt.Errorf("a JWE holds at most %d bytes, larger payloads need our own format", jweMaxPayloadBytes)
+	}
+
+	header := jweHeader{Encryption: jweEncryption}
+
+	var contentKey []byte
+	var encryptedKey []byte
+
+	if options.KeyHex != "" {
+		header.Algorithm = jweAlgorithmDirect
+
+		contentKey, err = jweDirectKey(options)
+		if err != nil {
+			return err
+		}
+	} else {
+		salt := make([]byte, jweSaltSize)
+		contentKey = make([]byte, 32)
+		if err := readRandom(salt); err != nil {
+			return fmt.Errorf("could not generate salt: %w", err)
+		}
+
+		if err := readRandom(contentKey); err != nil {
+			return fmt.Errorf("could not generate content key: %w", err)
+		}
+
+		header.Algorithm = jweAlgorithmPBES2
+		header.Salt = jweEncoding.EncodeToString(salt)
+		header.Iterations = PasswordKDFIterations
+
+		encryptedKey, err = aesKeyWrap(jwePBES2Key(options.Password, salt, header.Iterations), contentKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("could not serialize JWE header: %w", err)
+	}
+
+	protected := jweEncoding.EncodeToString(headerJSON)
+
+	aead, err := jweAEAD(contentKey)
+	if err != nil {
+		return err
+	}
+
+	iv := make([]byte, jweIVSize)
+	if err := readRandom(iv); err != nil {
+		return fmt.Errorf("could not generate IV: %w", err)
+	}
+
+	sealed := aead.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-jweTagSize], sealed[len(sealed)-jweTagSize:]
+
+	var message []byte
+	if serialization == JWECompact {
+		message = []byte(strings.Join([]string{
+			protected,
+			jweEncoding.EncodeToString(encryptedKey),
+			jweEncoding.EncodeToString(iv),
+			jweEncoding.EncodeToString(ciphertext),
+			jweEncoding.EncodeToString(tag),
+		}, "."))
+	} else {
+		message, err = json.Marshal(jweJSONSerialization{
+			Protected:    protected,
+			EncryptedKey: jweEncoding.EncodeToString(encryptedKey),
+			IV:           jweEncoding.EncodeToString(iv),
+			Ciphertext:   jweEncoding.EncodeToString(ciphertext),
+			Tag:          jweEncoding.EncodeToString(tag),
+		})
+		if err != nil {
+			return fmt.Errorf("could not serialize JWE: %w", err)
+		}
+	}
+
+	_, err = target.Write(message)
+	if err != nil {
+		return fmt.Errorf("could not write JWE: %w", err)
+	}
+
+	return nil
+}
+
+func decryptJWE(source io.Reader, target io.Writer, options *Options) error {
+	if source == nil || target == nil {
+		return errors.New("source or target is nil")
+	}
+
+	err := checkJWEOptions(options)
+	if err != nil {
+		return err
+	}
+
+	// Base64 grows the payload by a third, the rest is headers
+	limit := int64(jweMaxPayloadBytes)*4/3 + 64*1024
+
+	data, err := io.ReadAll(io.LimitReader(source, limit+1))
+	if err != nil {
+		return fmt.Errorf("could not read source: %w", err)
+	}
+
+	if int64(len(data)) > limit {
+		return fmt.Errorf("the JWE is larger than the %d bytes a JWE holds", jweMaxPayloadBytes)
+	}
+
+	message, err := parseJWE(bytes.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+
+	header := &message.header
+
+	if header.Encryption != jweEncryption {
+		return fmt.Errorf("the JWE is encrypted with %q, only %s is read", header.Encryption, jweEncryption)
+	}
+
+	if header.Compression != "" || len(header.Critical) > 0 {
+		return errors.New("the JWE is compressed or has critical extensions, neither is read")
+	}
+
+	if len(message.iv) != jweIVSize || len(message.tag) != jweTagSize {
+		return fmt.Errorf("%w, the JWE's IV or tag is the wrong size", ErrFileCorrupt)
+	}
+
+	var contentKey []byte
+
+	switch header.Algorithm {
+	case jweAlgorithmDirect:
+		if options.KeyHex == "" {
+			return errors.New("the JWE is encrypted with a key (dir), give it with --keyhex")
+		}
+
+		contentKey, err = jweDirectKey(options)
+		if err != nil {
+			return err
+		}
+	case jweAlgorithmPBES2:
+		if options.Password == "" {
+			return fmt.Errorf("the JWE is encrypted with a password (%s), give it with --password", jweAlgorithmPBES2)
+		}
+
+		if header.Iterations < jweMinKDFIterations || header.Iterations > jweMaxKDFIterations {
+			return fmt.Errorf("the JWE asks for %d PBKDF2 iterations, only %d to %d are allowed", header.Iterations, jweMinKDFIterations, jweMaxKDFIterations)
+		}
+
+		salt, err := jweEncoding.DecodeString(header.Salt)
+		if err != nil || len(salt) < 8 {
+			return fmt.Errorf("%w, the JWE's salt (p2s) is malformed", ErrFileCorrupt)
+		}
+
+		contentKey, err = aesKeyUnwrap(jwePBES2Key(options.Password, salt, header.Iterations), message.encryptedKey)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("the JWE's key is managed with %q, only %s and %s are read", header.Algorithm, jweAlgorithmPBES2, jweAlgorithmDirect)
+	}
+
+	aead, err := jweAEAD(contentKey)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := aead.Open(nil, message.iv, append(message.ciphertext, message.tag...), message.additionalData)
+	if err != nil && header.Algorithm == jweAlgorithmDirect {
+		return fmt.Errorf("%w, the key does not open the JWE or it was changed", ErrAuthenticationFailed)
+	} else if err != nil {
+		// The password unwrapped the content key, so it is the message that is wrong
+		return fmt.Errorf("%w, the JWE failed its integrity check", ErrFileCorrupt)
+	}
+
+	_, err = target.Write(plaintext)
+	if err != nil {
+		return fmt.Errorf("could not write plaintext: %w", err)
+	}
+
+	return nil
+}
+
+func jweAEAD(contentKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCM: %w", err)
+	}
+
+	return aead, nil
+}
+
+func parseJWE(data []byte) (*jweMessage, error) {
+	if bytes.HasPrefix(data, []byte("{")) {
+		return parseJWEJSON(data)
+	}
+
+	parts := strings.Split(string(data), ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("%w, it is not a JWE", ErrNotEncryptedFile)
+	}
+
+	message := jweMessage{additionalData: []byte(parts[0])}
+
+	err := decodeJWEHeader(parts[0], &message.header)
+	if err != nil {
+		return nil, err
+	}
+
+	for index, part := range []*[]byte{&message.encryptedKey, &message.iv, &message.ciphertext, &message.tag} {
+		*part, err = jweEncoding.DecodeString(parts[index+1])
+		if err != nil {
+			return nil, fmt.Errorf("%w, the JWE is malformed: %v", ErrFileCorrupt, err)
+		}
+	}
+
+	return &message, nil
+}
+
+// Flattened or general, only the first recipient of a general JWE is read (we write one)
+func parseJWEJSON(data []byte) (*jweMessage, error) {
+	var serialization jweJSONSerialization
+
+	err := json.Unmarshal(data, &serialization)
+	if err != nil || serialization.Protected == "" || serialization.Ciphertext == "" {
+		return nil, fmt.Errorf("%w, it is not a JWE", ErrNotEncryptedFile)
+	}
+
+	message := jweMessage{additionalData: []byte(serialization.Protected)}
+
+	// The aad member is authenticated as well, after the protected header and a dot
+	if serialization.AAD != "" {
+		message.additionalData = append(append(message.additionalData, '.'), serialization.AAD...)
+	}
+
+	err = decodeJWEHeader(serialization.Protected, &message.header)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey := serialization.EncryptedKey
+	message.header.merge(serialization.Unprotected)
+	message.header.merge(serialization.Header)
+
+	if len(serialization.Recipients) > 0 {
+		encryptedKey = serialization.Recipients[0].EncryptedKey
+		message.header.merge(serialization.Recipients[0].Header)
+	}
+
+	for _, field := range []struct {
+		part    *[]byte
+		encoded string
+	}{
+		{&message.encryptedKey, encryptedKey},
+		{&message.iv, serialization.IV},
+		{&message.ciphertext, serialization.Ciphertext},
+		{&message.tag, serialization.Tag},
+	} {
+		*field.part, err = jweEncoding.DecodeString(field.encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w, the JWE is malformed: %v", ErrFileCorrupt, err)
+		}
+	}
+
+	return &message, nil
+}
+
+func decodeJWEHeader(encoded string, header *jweHeader) error {
+	headerJSON, err := jweEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w, it is not a JWE", ErrNotEncryptedFile)
+	}
+
+	err = json.Unmarshal(headerJSON, header)
+	if err != nil || header.Encryption == "" && header.Algorithm == "" {
+		return fmt.Errorf("%w, it is not a JWE", ErrNotEncryptedFile)
+	}
+
+	return nil
+}
+
+// Unprotected headers fill in what the protected header leaves out, they never replace it
+func (header *jweHeader) merge(other *jweHeader) {
+	if other == nil {
+		return
+	}
+
+	if header.Algorithm == "" {
+		header.Algorithm = other.Algorithm
+	}
+
+	if header.Encryption == "" {
+		header.Encryption = other.Encryption
+	}
+
+	if header.Salt == "" {
+		header.Salt = other.Salt
+	}
+
+	if header.Iterations == 0 {
+		header.Iterations = other.Iterations
+	}
+
+	if header.Compression == "" {
+		header.Compression = other.Compression
+	}
+
+	header.Critical = append(header.Critical, other.Critical...)
+}
+
+// AES Key Wrap (RFC 3394) of a key a multiple of 64 bits long
+func aesKeyWrap(wrappingKey []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errors.New("only keys of a multiple of 64 bits, at least 128, can be wrapped")
+	}
+
+	numBlocks := len(key) / 8
+	wrapped := append(append([]byte{}, jweKeyWrapIV...), key...)
+	buffer := make([]byte, 16)
+
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= numBlocks; i++ {
+			copy(buffer, wrapped[:8])
+			copy(buffer[8:], wrapped[i*8:i*8+8])
+			block.Encrypt(buffer, buffer)
+
+			binary.BigEndian.PutUint64(wrapped[:8], binary.BigEndian.Uint64(buffer[:8])^uint64(numBlocks*j+i))
+			copy(wrapped[i*8:], buffer[8:])
+		}
+	}
+
+	return wrapped, nil
+}
+
+func aesKeyUnwrap(wrappingKey []byte, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("%w, the JWE's encrypted key is the wrong size", ErrFileCorrupt)
+	}
+
+	numBlocks := len(wrapped)/8 - 1
+	key := append([]byte{}, wrapped...)
+	buffer := make([]byte, 16)
+
+	for j := 5; j >= 0; j-- {
+		for i := numBlocks; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buffer[:8], binary.BigEndian.Uint64(key[:8])^uint64(numBlocks*j+i))
+			copy(buffer[8:], key[i*8:i*8+8])
+			block.Decrypt(buffer, buffer)
+
+			copy(key[:8], buffer[:8])
+			copy(key[i*8:], buffer[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(key[:8], jweKeyWrapIV) != 1 {
+		return nil, fmt.Errorf("%w, the password does not open the JWE", ErrAuthenticationFailed)
+	}
+
+	return key[8:], nil
+}
+
+// Does the file start like a JWE, in either serialization?
+func isJWE(fileName string) bool {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	prefix := make([]byte, 4096)
+	read, _ := io.ReadFull(file, prefix)
+	prefix = bytes.TrimSpace(prefix[:read])
+
+	if bytes.HasPrefix(prefix, []byte("{")) {
+		return bytes.Contains(prefix, []byte(`"protected"`)) && bytes.Contains(prefix, []byte(`"iv"`))
+	}
+
+	dot := bytes.IndexByte(prefix, '.')
+	if dot < 0 {
+		return false
+	}
+
+	var header jweHeader
+	return decodeJWEHeader(string(prefix[:dot]), &header) == nil && header.Encryption != ""
+}
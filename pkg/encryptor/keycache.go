@@ -0,0 +1,81 @@
+package encryptor
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+/*
+	Password key derivation is slow on purpose, and extracting an archive
+	or verifying a batch of files encrypted with the same password would
+	otherwise pay for it once per file. Derived keys are cached for the
+	life of the process, in memory only, keyed by everything that goes
+	into them - the password (by its SHA256, the password itself is not
+	kept), the salt, the KDF, and its iterations
+
+	Files encrypted since the salt have a salt of their own, so the cache
+	helps when the same file is read more than once (encrypt then verify,
+	decrypting a file that was just encrypted) and for files from before
+	the salt, which all share one key per password
+*/
+
+// Reaching this clears the cache, long running processes should not collect keys forever
+const derivedKeyCacheLimit = 64
+
+type derivedKeyCacheKey struct {
+	PasswordDigest [sha256.Size]byte
+	Salt           string
+	KDF            string
+	Iterations     int
+}
+
+type derivedKeyCacheEntry struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+var derivedKeyCache = struct {
+	mutex   sync.Mutex
+	entries map[derivedKeyCacheKey]*derivedKeyCacheEntry
+}{entries: map[derivedKeyCacheKey]*derivedKeyCacheEntry{}}
+
+// Concurrent callers asking for the same key wait for one derivation rather than running their own
+func cachedPasswordKey(password string, salt []byte, kdf string, iterations int) ([]byte, error) {
+	cacheKey := derivedKeyCacheKey{
+		PasswordDigest: sha256.Sum256([]byte(password)),
+		Salt:           string(salt),
+		KDF:            kdf,
+		Iterations:     iterations,
+	}
+
+	derivedKeyCache.mutex.Lock()
+	entry, ok := derivedKeyCache.entries[cacheKey]
+	if !ok {
+		if len(derivedKeyCache.entries) >= derivedKeyCacheLimit {
+			derivedKeyCache.entries = map[derivedKeyCacheKey]*derivedKeyCacheEntry{}
+		}
+
+		entry = &derivedKeyCacheEntry{}
+		derivedKeyCache.entries[cacheKey] = entry
+	}
+	derivedKeyCache.mutex.Unlock()
+
+	entry.once.Do(func() {
+		entry.key, entry.err = generateKey256FromString(password, salt, iterations)
+	})
+
+	// Failures are not kept, the next caller tries again
+	if entry.err != nil {
+		derivedKeyCache.mutex.Lock()
+		if derivedKeyCache.entries[cacheKey] == entry {
+			delete(derivedKeyCache.entries, cacheKey)
+		}
+		derivedKeyCache.mutex.Unlock()
+
+		return nil, entry.err
+	}
+
+	// Callers get their own copy, the cached key is never handed out to be changed
+	return append([]byte(nil), entry.key...), nil
+}
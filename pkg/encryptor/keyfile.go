@@ -0,0 +1,95 @@
+package encryptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+	A key given on the command line ends up in shell history and in ps
+	output for anyone on the machine to read, a key file does not. Key
+	files hold the 256 bit key either as 32 raw bytes (e.g. head -c 32
+	/dev/urandom) or as 64 hex digits, surrounding whitespace allowed, and
+	are loaded into Options.KeyHex so they behave exactly like --keyhex
+
+	Password files are the same for scripts that hold a passphrase: the
+	first line is the password, its line ending stripped and nothing else
+	(spaces inside and around a passphrase are part of it)
+*/
+
+const keyFileMaxBytes = 1024
+
+// The key in a key file, hex encoded for Options.KeyHex
+func loadKeyFile(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", fmt.Errorf("could not open key file: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	// Anything this large is not a key file, and need not be read to find out
+	data, err := io.ReadAll(io.LimitReader(file, keyFileMaxBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("could not read key file: %w", err)
+	}
+
+	if len(data) > keyFileMaxBytes {
+		return "", errors.New("key file is too large to hold a key")
+	}
+
+	digits := strings.TrimSpace(string(data))
+	if len(digits) == hex.EncodedLen(FileKeySize) {
+		if _, err = hex.DecodeString(digits); err == nil {
+			return strings.ToLower(digits), nil
+		}
+	}
+
+	// Random bytes are never all hex digits, this is a key of the wrong length in hex
+	if _, err = hex.DecodeString(digits); err == nil && len(digits) > 0 {
+		return "", fmt.Errorf("key file holds %d hex digits, a %d bit key is %d", len(digits), FileKeySize*8, hex.EncodedLen(FileKeySize))
+	}
+
+	if len(data) == FileKeySize {
+		return hex.EncodeToString(data), nil
+	}
+
+	return "", fmt.Errorf("key file must hold a %d bit key, as %d raw bytes or %d hex digits, it holds %d bytes", FileKeySize*8, FileKeySize, hex.EncodedLen(FileKeySize), len(data))
+}
+
+// The password on the first line of a password file
+func loadPasswordFile(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", fmt.Errorf("could not open password file: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	data, err := io.ReadAll(io.LimitReader(file, keyFileMaxBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("could not read password file: %w", err)
+	}
+
+	line := string(data)
+	if end := strings.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	} else if len(data) > keyFileMaxBytes {
+		return "", errors.New("password file is too large, its first line is not a password")
+	}
+
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" {
+		return "", errors.New("password file is empty, its first line must be the password")
+	}
+
+	return line, nil
+}
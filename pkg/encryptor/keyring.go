@@ -0,0 +1,64 @@
+package encryptor
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+	Recurring backup jobs need their password without anyone typing it,
+	and a password file is one more secret on disk. The platform keyring
+	(Keychain on macOS, the Secret Service on Linux and the BSDs, the
+	Credential Manager on Windows) keeps it encrypted at rest and unlocked
+	with the user's login instead, so passwords can be stored there under
+	a profile name (e.g. nightly-backups) and read back by name
+
+	As with gpg, the platform's own tools are used where there are any
+	(security, secret-tool) rather than linking their libraries
+*/
+
+const keyringService = "encryptor"
+
+// Profiles name passwords in tools and UIs, so they are kept to what survives all of them
+func validKeyringProfile(profile string) error {
+	if profile == "" {
+		return errors.New("a keyring profile name is needed")
+	}
+
+	for _, r := range profile {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.@", r)) {
+			return errors.New("keyring profile names may only hold letters, digits, and - _ . @")
+		}
+	}
+
+	return nil
+}
+
+func keyringPassword(profile string) (string, error) {
+	if err := validKeyringProfile(profile); err != nil {
+		return "", err
+	}
+
+	password, err := readKeyring(profile)
+	if err != nil {
+		return "", err
+	}
+
+	if password == "" {
+		return "", ErrNotInKeyring
+	}
+
+	return password, nil
+}
+
+func storeKeyringPassword(profile string, password string) error {
+	if err := validKeyringProfile(profile); err != nil {
+		return err
+	}
+
+	if password == "" {
+		return errors.New("an empty password cannot be stored in the keyring")
+	}
+
+	return writeKeyring(profile, password)
+}
@@ -0,0 +1,73 @@
+//go:build darwin
+
+package encryptor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var securityBinary = "security"
+
+// security's exit status when there is no such item
+const securityItemNotFound = 44
+
+func readKeyring(profile string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(securityBinary, "find-generic-password", "-s", keyringService, "-a", profile, "-w")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound {
+		return "", fmt.Errorf("keyring profile %s: %w", profile, ErrNotInKeyring)
+	}
+
+	if err != nil {
+		return "", keyringToolError(err, stderr.String())
+	}
+
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+func writeKeyring(profile string, password string) error {
+	var stderr bytes.Buffer
+
+	// security -i reads its commands from stdin, keeping the password off the command line
+	command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", securityQuote(keyringService), securityQuote(profile), securityQuote(password))
+
+	cmd := exec.Command(securityBinary, "-i")
+	cmd.Stdin = strings.NewReader(command)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return keyringToolError(err, stderr.String())
+	}
+
+	// Interactive mode exits 0 whatever its commands did, failures are only reported
+	if detail := strings.TrimSpace(stderr.String()); detail != "" {
+		return fmt.Errorf("could not store the password in the keyring: %s", detail)
+	}
+
+	return nil
+}
+
+func securityQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func keyringToolError(err error, stderr string) error {
+	if detail := strings.TrimSpace(stderr); detail != "" {
+		return fmt.Errorf("could not reach the keychain: %w: %s", err, detail)
+	}
+
+	return fmt.Errorf("could not reach the keychain: %w", err)
+}
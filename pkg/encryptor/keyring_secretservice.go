@@ -0,0 +1,65 @@
+//go:build !darwin && !windows
+
+package encryptor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// secret-tool (libsecret) speaks to whichever Secret Service is running, GNOME Keyring or KWallet
+var secretToolBinary = "secret-tool"
+
+func readKeyring(profile string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(secretToolBinary, "lookup", "service", keyringService, "profile", profile)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	// Nothing stored is an exit status of 1 and no output
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && strings.TrimSpace(stderr.String()) == "" {
+		return "", fmt.Errorf("keyring profile %s: %w", profile, ErrNotInKeyring)
+	}
+
+	if err != nil {
+		return "", keyringToolError(err, stderr.String())
+	}
+
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+func writeKeyring(profile string, password string) error {
+	var stderr bytes.Buffer
+
+	// The password goes in on stdin, never the command line
+	cmd := exec.Command(secretToolBinary, "store", "--label", keyringService+" "+profile, "service", keyringService, "profile", profile)
+	cmd.Stdin = strings.NewReader(password)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return keyringToolError(err, stderr.String())
+	}
+
+	return nil
+}
+
+func keyringToolError(err error, stderr string) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("the keyring is reached with %s, which is not installed (it is in libsecret-tools or libsecret): %w", secretToolBinary, err)
+	}
+
+	if detail := strings.TrimSpace(stderr); detail != "" {
+		return fmt.Errorf("could not reach the keyring: %w: %s", err, detail)
+	}
+
+	return fmt.Errorf("could not reach the keyring: %w", err)
+}
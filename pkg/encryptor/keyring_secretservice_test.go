@@ -0,0 +1,74 @@
+//go:build !darwin && !windows
+
+package encryptor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A stand-in secret-tool keeping each profile's password in a file
+const fakeSecretTool = `#!/bin/sh
+store="$(dirname "$0")/store"
+mkdir -p "$store"
+case "$1" in
+store) cat > "$store/$7" ;;
+lookup) [ -f "$store/$5" ] && cat "$store/$5" || exit 1 ;;
+*) echo "unexpected $1" >&2; exit 2 ;;
+esac
+`
+
+func Test_KeyringPassword(t *testing.T) {
+	toolFilename := filepath.Join(t.TempDir(), "secret-tool")
+
+	err := os.WriteFile(toolFilename, []byte(fakeSecretTool), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultBinary := secretToolBinary
+	secretToolBinary = toolFilename
+	defer func() {
+		secretToolBinary = defaultBinary
+	}()
+
+	if _, err = KeyringPassword("nightly-backups"); !errors.Is(err, ErrNotInKeyring) {
+		t.Error("expected a profile with nothing stored to be ErrNotInKeyring: ", err)
+	}
+
+	err = StoreKeyringPassword("nightly-backups", "some password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if password, err := KeyringPassword("nightly-backups"); err != nil || password != "some password" {
+		t.Error("the stored password was not read back: ", password, err)
+	}
+
+	// Stored again, the old password is replaced
+	err = StoreKeyringPassword("nightly-backups", "another password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if password, _ := KeyringPassword("nightly-backups"); password != "another password" {
+		t.Error("storing a profile again did not replace its password: ", password)
+	}
+
+	for _, profile := range []string{"", "../escape", "two words"} {
+		if err = StoreKeyringPassword(profile, "some password"); err == nil {
+			t.Error("expected an error for the profile name ", profile)
+		}
+	}
+
+	if err = StoreKeyringPassword("nightly-backups", ""); err == nil {
+		t.Error("expected an error storing an empty password")
+	}
+
+	secretToolBinary = filepath.Join(t.TempDir(), "missing-secret-tool")
+	if _, err = KeyringPassword("nightly-backups"); err == nil || errors.Is(err, ErrNotInKeyring) {
+		t.Error("expected a missing secret-tool to be an error of its own: ", err)
+	}
+}
@@ -0,0 +1,99 @@
+//go:build windows
+
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Windows has no tool that reads credentials back, so the Credential Manager is called directly
+var (
+	advapi32      = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead  = advapi32.NewProc("CredReadW")
+	procCredWrite = advapi32.NewProc("CredWriteW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+const credTypeGeneric = 1
+const credPersistLocalMachine = 2
+const errorNotFound syscall.Errno = 1168
+
+// CREDENTIALW
+type windowsCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func keyringTarget(profile string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(keyringService + ":" + profile)
+}
+
+func readKeyring(profile string) (string, error) {
+	target, err := keyringTarget(profile)
+	if err != nil {
+		return "", err
+	}
+
+	var credential *windowsCredential
+
+	result, _, callErr := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&credential)))
+	if result == 0 {
+		if errors.Is(callErr, errorNotFound) {
+			return "", fmt.Errorf("keyring profile %s: %w", profile, ErrNotInKeyring)
+		}
+
+		return "", fmt.Errorf("could not read from the Credential Manager: %w", callErr)
+	}
+
+	defer func() {
+		_, _, _ = procCredFree.Call(uintptr(unsafe.Pointer(credential)))
+	}()
+
+	if credential.CredentialBlobSize == 0 {
+		return "", nil
+	}
+
+	return string(unsafe.Slice(credential.CredentialBlob, credential.CredentialBlobSize)), nil
+}
+
+func writeKeyring(profile string, password string) error {
+	target, err := keyringTarget(profile)
+	if err != nil {
+		return err
+	}
+
+	userName, err := syscall.UTF16PtrFromString(profile)
+	if err != nil {
+		return err
+	}
+
+	blob := []byte(password)
+	credential := windowsCredential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		CredentialBlob:     &blob[0],
+		Persist:            credPersistLocalMachine,
+		UserName:           userName,
+	}
+
+	result, _, callErr := procCredWrite.Call(uintptr(unsafe.Pointer(&credential)), 0)
+	if result == 0 {
+		return fmt.Errorf("could not write to the Credential Manager: %w", callErr)
+	}
+
+	return nil
+}
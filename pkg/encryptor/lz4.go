@@ -0,0 +1,644 @@
+package encryptor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+/*
+	LZ4 trades ratio for speed - it compresses at several hundred MB/s a
+	core and decompresses faster still, for plaintext that should be
+	smaller without the encryption slowing down. Streams are LZ4 frames
+	(the format of the lz4 command, lz4 -d reads them), written with
+	independent blocks of up to lz4BlockMaxBytes and a checksum of the
+	content. Blocks are compressed by a greedy search of a hash table of
+	4 byte sequences, and a block that does not shrink is stored as it is
+
+	Reading takes any frame the format describes - linked or independent
+	blocks, block checksums, a content size - and skips skippable frames.
+	Frames needing a dictionary are refused
+*/
+
+const (
+	lz4Magic           = 0x184D2204
+	lz4SkippableMagic  = 0x184D2A50 // The low 4 bits are the frame's to choose
+	lz4BlockMaxBytes   = 4 << 20
+	lz4MinMatch        = 4
+	lz4HistoryBytes    = 64 << 10 // How far back a match may reach, and so what linked blocks keep
+	lz4LastLiterals    = 5        // A block ends with at least this many literals
+	lz4MatchLimit      = 12       // And its last match starts at least this far from the end
+	lz4HashLog         = 16
+	lz4SkipTrigger     = 6 // Every this many bits of misses in a row, another byte is skipped between looks
+	lz4UncompressedBit = 1 << 31
+)
+
+var errLZ4Corrupt = errors.New("lz4 data is corrupt")
+
+type lz4Writer struct {
+	target  io.Writer
+	block   []byte
+	output  []byte
+	table   []int32 // Position+1 of the last sequence with each hash, 0 is none
+	content *lz4XXH32
+	started bool
+	closed  bool
+	err     error
+}
+
+func newLZ4Writer(target io.Writer) *lz4Writer {
+	return &lz4Writer{target: target, content: newLZ4XXH32()}
+}
+
+func (writer *lz4Writer) Write(data []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	if writer.closed {
+		return 0, errors.New("write to a closed lz4 writer")
+	}
+
+	written := 0
+
+	for len(data) > 0 {
+		if writer.block == nil {
+			writer.block = make([]byte, 0, lz4BlockMaxBytes)
+		}
+
+		portion := data
+		if space := lz4BlockMaxBytes - len(writer.block); len(portion) > space {
+			portion = data[:space]
+		}
+
+		writer.block = append(writer.block, portion...)
+		written += len(portion)
+		data = data[len(portion):]
+
+		if len(writer.block) == lz4BlockMaxBytes {
+			writer.err = writer.flushBlock()
+			if writer.err != nil {
+				return written, writer.err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Ends the frame, the target is not closed
+func (writer *lz4Writer) Close() error {
+	if writer.err != nil || writer.closed {
+		return writer.err
+	}
+
+	writer.closed = true
+
+	if len(writer.block) > 0 || !writer.started {
+		writer.err = writer.flushBlock()
+		if writer.err != nil {
+			return writer.err
+		}
+	}
+
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[4:], writer.content.sum32())
+
+	_, writer.err = writer.target.Write(trailer)
+	return writer.err
+}
+
+func (writer *lz4Writer) flushBlock() error {
+	if !writer.started {
+		writer.started = true
+
+		// Version 01, independent blocks, a content checksum - then 4MB blocks, and the descriptor's checksum
+		descriptor := []byte{0x04, 0x22, 0x4D, 0x18, 0x64, 0x70, 0}
+		descriptor[6] = byte(lz4XXH32Sum(descriptor[4:6]) >> 8)
+
+		if _, err := writer.target.Write(descriptor); err != nil {
+			return err
+		}
+	}
+
+	if len(writer.block) == 0 {
+		return nil
+	}
+
+	writer.content.write(writer.block)
+
+	if writer.table == nil {
+		writer.table = make([]int32, 1<<lz4HashLog)
+	}
+
+	writer.output = lz4CompressBlock(writer.output[:0], writer.block, writer.table)
+
+	size := make([]byte, 4)
+	data := writer.output
+
+	if len(writer.output) >= len(writer.block) {
+		binary.LittleEndian.PutUint32(size, uint32(len(writer.block))|lz4UncompressedBit)
+		data = writer.block
+	} else {
+		binary.LittleEndian.PutUint32(size, uint32(len(writer.output)))
+	}
+
+	if _, err := writer.target.Write(size); err != nil {
+		return err
+	}
+
+	if _, err := writer.target.Write(data); err != nil {
+		return err
+	}
+
+	writer.block = writer.block[:0]
+	return nil
+}
+
+func lz4Hash(sequence uint32) uint32 {
+	return (sequence * 2654435761) >> (32 - lz4HashLog)
+}
+
+// Appends src compressed as one block to dst, table is cleared first
+func lz4CompressBlock(dst []byte, src []byte, table []int32) []byte {
+	for i := range table {
+		table[i] = 0
+	}
+
+	anchor := 0
+	misses := 0
+
+	for i := 0; i+lz4MatchLimit <= len(src); {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		hash := lz4Hash(sequence)
+		candidate := int(table[hash]) - 1
+		table[hash] = int32(i + 1)
+
+		// Data that does not match is looked at less closely the longer it goes on, so random data passes quickly
+		if candidate < 0 || i-candidate >= lz4HistoryBytes || binary.LittleEndian.Uint32(src[candidate:]) != sequence {
+			misses++
+			i += 1 + misses>>lz4SkipTrigger
+			continue
+		}
+
+		misses = 0
+
+		// Whatever matches before the sequence is part of the match too
+		for i > anchor && candidate > 0 && src[i-1] == src[candidate-1] {
+			i--
+			candidate--
+		}
+
+		length := lz4MinMatch
+		for i+length < len(src)-lz4LastLiterals && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		dst = lz4AppendSequence(dst, src[anchor:i], i-candidate, length)
+		i += length
+		anchor = i
+	}
+
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// A match length of 0 is the block's last sequence, literals alone
+func lz4AppendSequence(dst []byte, literals []byte, offset int, matchLength int) []byte {
+	token := byte(15 << 4)
+	if len(literals) < 15 {
+		token = byte(len(literals) << 4)
+	}
+
+	if matchLength > 0 {
+		if matchLength-lz4MinMatch < 15 {
+			token |= byte(matchLength - lz4MinMatch)
+		} else {
+			token |= 15
+		}
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+
+	dst = append(dst, literals...)
+	if matchLength == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLength-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, matchLength-lz4MinMatch-15)
+	}
+
+	return dst
+}
+
+func lz4AppendLength(dst []byte, length int) []byte {
+	for ; length >= 255; length -= 255 {
+		dst = append(dst, 255)
+	}
+
+	return append(dst, byte(length))
+}
+
+type lz4Reader struct {
+	source          io.Reader
+	inFrame         bool
+	independent     bool
+	blockChecksum   bool
+	contentChecksum bool
+	blockMax        int
+	contentBytes    int64 // -1 when the frame does not say
+	produced        int64
+	content         *lz4XXH32
+	window          []byte // What was decoded, linked blocks keep the last lz4HistoryBytes of it
+	block           []byte
+	pending         []byte
+	err             error
+}
+
+func newLZ4Reader(source io.Reader) *lz4Reader {
+	return &lz4Reader{source: source}
+}
+
+func (reader *lz4Reader) Read(data []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+
+		if !reader.inFrame {
+			reader.err = reader.startFrame()
+		} else {
+			reader.err = reader.decodeBlock()
+		}
+	}
+
+	n := copy(data, reader.pending)
+	reader.pending = reader.pending[n:]
+
+	return n, nil
+}
+
+// The source ends cleanly between frames, anywhere else it is truncated
+func (reader *lz4Reader) readFull(data []byte) error {
+	_, err := io.ReadFull(reader.source, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("lz4 data is truncated: %w", io.ErrUnexpectedEOF)
+	}
+
+	return err
+}
+
+func (reader *lz4Reader) startFrame() error {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(reader.source, magic); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("lz4 data is truncated: %w", err)
+		}
+
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(magic)&^0xF == lz4SkippableMagic {
+		if err := reader.readFull(magic); err != nil {
+			return err
+		}
+
+		skipped, err := io.CopyN(io.Discard, reader.source, int64(binary.LittleEndian.Uint32(magic)))
+		if err == io.EOF || (err == nil && skipped < int64(binary.LittleEndian.Uint32(magic))) {
+			return fmt.Errorf("lz4 data is truncated: %w", io.ErrUnexpectedEOF)
+		}
+
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(magic) != lz4Magic {
+		return errors.New("not lz4 frame data, or not a version of it that can be read")
+	}
+
+	descriptor := make([]byte, 2, 15)
+	if err := reader.readFull(descriptor); err != nil {
+		return err
+	}
+
+	flags := descriptor[0]
+	if flags>>6 != 1 || flags&0x02 != 0 || descriptor[1]&0x8F != 0 {
+		return errLZ4Corrupt
+	}
+
+	if flags&0x01 != 0 {
+		return errors.New("lz4 data needing a dictionary cannot be read")
+	}
+
+	blockSizeID := descriptor[1] >> 4
+	if blockSizeID < 4 {
+		return errLZ4Corrupt
+	}
+
+	optional := 0
+	if flags&0x08 != 0 {
+		optional = 8
+	}
+
+	fields := descriptor[2 : 2+optional+1]
+	if err := reader.readFull(fields); err != nil {
+		return err
+	}
+
+	descriptor = descriptor[:2+optional]
+	if byte(lz4XXH32Sum(descriptor)>>8) != fields[optional] {
+		return fmt.Errorf("%w: the frame descriptor's checksum does not match", errLZ4Corrupt)
+	}
+
+	reader.contentBytes = -1
+	if optional > 0 {
+		reader.contentBytes = int64(binary.LittleEndian.Uint64(descriptor[2:]))
+	}
+
+	reader.inFrame = true
+	reader.independent = flags&0x20 != 0
+	reader.blockChecksum = flags&0x10 != 0
+	reader.contentChecksum = flags&0x04 != 0
+	reader.blockMax = 1 << (8 + 2*int(blockSizeID))
+	reader.produced = 0
+	reader.content = newLZ4XXH32()
+	reader.window = reader.window[:0]
+
+	return nil
+}
+
+func (reader *lz4Reader) decodeBlock() error {
+	sizeData := make([]byte, 4)
+	if err := reader.readFull(sizeData); err != nil {
+		return err
+	}
+
+	size := binary.LittleEndian.Uint32(sizeData)
+	if size == 0 {
+		return reader.endFrame()
+	}
+
+	uncompressed := size&lz4UncompressedBit != 0
+	size &^= lz4UncompressedBit
+	if int(size) > reader.blockMax {
+		return errLZ4Corrupt
+	}
+
+	if cap(reader.block) < int(size)+4 {
+		reader.block = make([]byte, 0, reader.blockMax+4)
+	}
+
+	block := reader.block[:size]
+	if reader.blockChecksum {
+		block = reader.block[:size+4]
+	}
+
+	if err := reader.readFull(block); err != nil {
+		return err
+	}
+
+	if reader.blockChecksum {
+		if lz4XXH32Sum(block[:size]) != binary.LittleEndian.Uint32(block[size:]) {
+			return fmt.Errorf("%w: a block's checksum does not match", errLZ4Corrupt)
+		}
+
+		block = block[:size]
+	}
+
+	// Linked blocks may reach back into the ones before, independent blocks only into themselves
+	if reader.independent {
+		reader.window = reader.window[:0]
+	} else if len(reader.window) > lz4HistoryBytes {
+		reader.window = append(reader.window[:0], reader.window[len(reader.window)-lz4HistoryBytes:]...)
+	}
+
+	start := len(reader.window)
+
+	if uncompressed {
+		reader.window = append(reader.window, block...)
+	} else {
+		var err error
+		reader.window, err = lz4DecodeBlock(reader.window, block, reader.blockMax)
+		if err != nil {
+			return err
+		}
+	}
+
+	decoded := reader.window[start:]
+	reader.content.write(decoded)
+	reader.produced += int64(len(decoded))
+
+	if reader.contentBytes >= 0 && reader.produced > reader.contentBytes {
+		return fmt.Errorf("%w: the frame is longer than its content size", errLZ4Corrupt)
+	}
+
+	reader.pending = decoded
+
+	return nil
+}
+
+func (reader *lz4Reader) endFrame() error {
+	reader.inFrame = false
+
+	if reader.contentBytes >= 0 && reader.produced != reader.contentBytes {
+		return fmt.Errorf("%w: the frame is shorter than its content size", errLZ4Corrupt)
+	}
+
+	if !reader.contentChecksum {
+		return nil
+	}
+
+	checksum := make([]byte, 4)
+	if err := reader.readFull(checksum); err != nil {
+		return err
+	}
+
+	if reader.content.sum32() != binary.LittleEndian.Uint32(checksum) {
+		return fmt.Errorf("%w: the content checksum does not match", errLZ4Corrupt)
+	}
+
+	return nil
+}
+
+// Appends what src decodes to to window, matches reach back into all of window
+func lz4DecodeBlock(window []byte, src []byte, maxBytes int) ([]byte, error) {
+	limit := len(window) + maxBytes
+
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, errLZ4Corrupt
+		}
+
+		token := src[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			var err error
+			literals, i, err = lz4ReadLength(src, i, literals, maxBytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if literals > len(src)-i || len(window)+literals > limit {
+			return nil, errLZ4Corrupt
+		}
+
+		window = append(window, src[i:i+literals]...)
+		i += literals
+
+		// The last sequence has no match
+		if i == len(src) {
+			return window, nil
+		}
+
+		if i+2 > len(src) {
+			return nil, errLZ4Corrupt
+		}
+
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+
+		if offset == 0 || offset > len(window) {
+			return nil, errLZ4Corrupt
+		}
+
+		length := int(token&0x0F) + lz4MinMatch
+		if token&0x0F == 15 {
+			var err error
+			length, i, err = lz4ReadLength(src, i, length, maxBytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(window)+length > limit {
+			return nil, errLZ4Corrupt
+		}
+
+		// A match may overlap what it produces, so it is copied at most offset bytes at a time
+		from := len(window) - offset
+		for length > 0 {
+			n := length
+			if n > offset {
+				n = offset
+			}
+
+			window = append(window, window[from:from+n]...)
+			from += n
+			length -= n
+		}
+	}
+}
+
+func lz4ReadLength(src []byte, i int, length int, maxBytes int) (int, int, error) {
+	for {
+		if i >= len(src) {
+			return 0, i, errLZ4Corrupt
+		}
+
+		length += int(src[i])
+		i++
+
+		if length > maxBytes {
+			return 0, i, errLZ4Corrupt
+		}
+
+		if src[i-1] != 255 {
+			return length, i, nil
+		}
+	}
+}
+
+const (
+	lz4Prime1 uint32 = 2654435761
+	lz4Prime2 uint32 = 2246822519
+	lz4Prime3 uint32 = 3266489917
+	lz4Prime4 uint32 = 668265263
+	lz4Prime5 uint32 = 374761393
+)
+
+// XXH32 with a seed of 0, the checksum of frame descriptors, blocks, and content
+type lz4XXH32 struct {
+	lanes  [4]uint32
+	buffer []byte
+	total  uint64
+}
+
+func newLZ4XXH32() *lz4XXH32 {
+	prime1, prime2 := lz4Prime1, lz4Prime2
+	return &lz4XXH32{lanes: [4]uint32{prime1 + prime2, prime2, 0, -prime1}, buffer: make([]byte, 0, 16)}
+}
+
+func lz4XXH32Sum(data []byte) uint32 {
+	hash := newLZ4XXH32()
+	hash.write(data)
+	return hash.sum32()
+}
+
+func lz4XXH32Round(lane uint32, input uint32) uint32 {
+	return bits.RotateLeft32(lane+input*lz4Prime2, 13) * lz4Prime1
+}
+
+func (hash *lz4XXH32) write(data []byte) {
+	hash.total += uint64(len(data))
+
+	if len(hash.buffer) > 0 {
+		n := copy(hash.buffer[len(hash.buffer):16], data)
+		hash.buffer = hash.buffer[:len(hash.buffer)+n]
+		data = data[n:]
+
+		if len(hash.buffer) < 16 {
+			return
+		}
+
+		hash.stripe(hash.buffer)
+		hash.buffer = hash.buffer[:0]
+	}
+
+	for ; len(data) >= 16; data = data[16:] {
+		hash.stripe(data)
+	}
+
+	hash.buffer = append(hash.buffer, data...)
+}
+
+func (hash *lz4XXH32) stripe(data []byte) {
+	for i := range hash.lanes {
+		hash.lanes[i] = lz4XXH32Round(hash.lanes[i], binary.LittleEndian.Uint32(data[4*i:]))
+	}
+}
+
+func (hash *lz4XXH32) sum32() uint32 {
+	var sum uint32
+	if hash.total >= 16 {
+		sum = bits.RotateLeft32(hash.lanes[0], 1) + bits.RotateLeft32(hash.lanes[1], 7) + bits.RotateLeft32(hash.lanes[2], 12) + bits.RotateLeft32(hash.lanes[3], 18)
+	} else {
+		sum = hash.lanes[2] + lz4Prime5
+	}
+
+	sum += uint32(hash.total)
+
+	data := hash.buffer
+	for ; len(data) >= 4; data = data[4:] {
+		sum = bits.RotateLeft32(sum+binary.LittleEndian.Uint32(data)*lz4Prime3, 17) * lz4Prime4
+	}
+
+	for _, b := range data {
+		sum = bits.RotateLeft32(sum+uint32(b)*lz4Prime5, 11) * lz4Prime1
+	}
+
+	sum ^= sum >> 15
+	sum *= lz4Prime2
+	sum ^= sum >> 13
+	sum *= lz4Prime3
+	sum ^= sum >> 16
+
+	return sum
+}
@@ -0,0 +1,259 @@
+package encryptor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+	Checksum manifests in the formats sha256sum and BSD's sha256 write, so
+	hashing a tree and checking it again fits pipelines built around them
+
+		GNU  <sha256>  <path>          (sha256sum, a * before the path is binary mode)
+		BSD  SHA256 (<path>) = <sha256> (sha256 on the BSDs and macOS, sha256sum --tag)
+
+	A path holding a backslash or a newline is escaped the way sha256sum
+	escapes it, the line starting with a backslash. Paths are written with
+	forward slashes and read back as the platform's, relative paths are
+	relative to the working directory as sha256sum -c has them. Reading
+	accepts either format on any line, files are hashed (and checked) by
+	a pool of workers in parallel, and results keep the manifest's order.
+	Given a hash cache (see hashcache.go) only changed files are hashed
+*/
+
+const (
+	ManifestFormatGNU = "gnu"
+	ManifestFormatBSD = "bsd"
+)
+
+type ChecksumEntry struct {
+	Path string
+	Hash string // Hex encoded SHA256
+}
+
+type ChecksumResult struct {
+	Path string
+	OK   bool
+	Err  error // The file could not be read, OK is false
+}
+
+// Every regular file under root in lexical order (root itself if it is a file), symlinks to files are followed
+func hashTree(root string, workers uint, cache *HashCache) ([]ChecksumEntry, error) {
+	var paths []string
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.Type().IsRegular() {
+			paths = append(paths, path)
+		} else if entry.Type()&fs.ModeSymlink != 0 {
+			if stats, err := os.Stat(path); err == nil && stats.Mode().IsRegular() {
+				paths = append(paths, path)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk %s: %w", root, err)
+	}
+
+	hashes, errs := hashPaths(paths, workers, cache)
+
+	entries := make([]ChecksumEntry, len(paths))
+	for i, path := range paths {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("could not hash %s: %w", path, errs[i])
+		}
+
+		entries[i] = ChecksumEntry{Path: path, Hash: hashes[i]}
+	}
+
+	return entries, nil
+}
+
+func checkChecksums(entries []ChecksumEntry, workers uint, cache *HashCache) []ChecksumResult {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = entry.Path
+	}
+
+	hashes, errs := hashPaths(paths, workers, cache)
+
+	results := make([]ChecksumResult, len(entries))
+	for i, entry := range entries {
+		results[i] = ChecksumResult{Path: entry.Path, OK: errs[i] == nil && strings.EqualFold(hashes[i], entry.Hash), Err: errs[i]}
+	}
+
+	return results
+}
+
+// Each file's hash or error at its own index
+func hashPaths(paths []string, workers uint, cache *HashCache) ([]string, []error) {
+	hashes := make([]string, len(paths))
+	errs := make([]error, len(paths))
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	indices := make(chan int)
+	var wait sync.WaitGroup
+
+	for i := uint(0); i < workers; i++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			for index := range indices {
+				hashes[index], errs[index] = cache.hashFile(paths[index])
+			}
+		}()
+	}
+
+	for i := range paths {
+		indices <- i
+	}
+
+	close(indices)
+	wait.Wait()
+
+	return hashes, errs
+}
+
+func writeChecksumManifest(w io.Writer, entries []ChecksumEntry, format string) error {
+	if format == "" {
+		format = ManifestFormatGNU
+	}
+
+	if format != ManifestFormatGNU && format != ManifestFormatBSD {
+		return fmt.Errorf("unknown manifest format %q, use %s or %s", format, ManifestFormatGNU, ManifestFormatBSD)
+	}
+
+	writer := bufio.NewWriter(w)
+
+	for _, entry := range entries {
+		path, escaped := escapeManifestPath(filepath.ToSlash(entry.Path))
+
+		prefix := ""
+		if escaped {
+			prefix = "\\"
+		}
+
+		if format == ManifestFormatGNU {
+			_, _ = fmt.Fprintf(writer, "%s%s  %s\n", prefix, entry.Hash, path)
+		} else {
+			_, _ = fmt.Fprintf(writer, "%sSHA256 (%s) = %s\n", prefix, path, entry.Hash)
+		}
+	}
+
+	return writer.Flush()
+}
+
+func readChecksumManifest(r io.Reader) ([]ChecksumEntry, error) {
+	var entries []ChecksumEntry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := parseManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("manifest line %d: %w", number, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read manifest: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("the manifest lists no files")
+	}
+
+	return entries, nil
+}
+
+func parseManifestLine(line string) (ChecksumEntry, error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+
+	var hash, path string
+
+	if strings.HasPrefix(line, "SHA256 (") {
+		separator := strings.LastIndex(line, ") = ")
+		if separator < 0 {
+			return ChecksumEntry{}, errors.New("not a BSD style line, SHA256 (<path>) = <sha256>")
+		}
+
+		path, hash = line[len("SHA256 ("):separator], line[separator+len(") = "):]
+	} else if bsd := strings.Index(line, " ("); bsd > 0 && !strings.Contains(line[:bsd], " ") && strings.Contains(line, ") = ") {
+		return ChecksumEntry{}, fmt.Errorf("%s checksums are not supported, only SHA256", line[:bsd])
+	} else {
+		if len(line) < 66 || line[64] != ' ' || (line[65] != ' ' && line[65] != '*') {
+			return ChecksumEntry{}, errors.New("not a GNU style line, <sha256>  <path>")
+		}
+
+		hash, path = line[:64], line[66:]
+	}
+
+	if !isHexSHA256(hash) {
+		return ChecksumEntry{}, fmt.Errorf("%q is not a SHA256 checksum", hash)
+	}
+
+	if escaped {
+		path = unescapeManifestPath(path)
+	}
+
+	if path == "" {
+		return ChecksumEntry{}, errors.New("the line names no file")
+	}
+
+	return ChecksumEntry{Path: filepath.FromSlash(path), Hash: strings.ToLower(hash)}, nil
+}
+
+func isHexSHA256(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+
+	for _, digit := range hash {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", digit) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// As sha256sum escapes, the caller starts the line with a backslash when escaped is true
+func escapeManifestPath(path string) (string, bool) {
+	if !strings.ContainsAny(path, "\\\n\r") {
+		return path, false
+	}
+
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(path), true
+}
+
+func unescapeManifestPath(path string) string {
+	return strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(path)
+}
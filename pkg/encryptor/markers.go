@@ -0,0 +1,106 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+	Chunks are a random nonce, ciphertext, and a tag - nothing in them
+	says where one starts, so a damaged region that added or lost bytes
+	(a tape that skipped, a capture that dropped packets) leaves every
+	chunk after it at the wrong offset. Since format 1.13 each chunk may
+	start with a marker, 8 bytes of magic and the chunk's ID
+
+		magic | chunk ID (uint32) | nonce | ciphertext | tag [| CRC32C]
+
+	big endian like the chunk AAD, the checksum covering the sealed chunk
+	and not the marker. The marker is not sealed itself, but its ID is the
+	one the chunk's AAD holds, so a chunk opened with the ID from a damaged
+	or forged marker fails to authenticate - the marker is as trustworthy
+	as the chunk behind it. Reading a whole file checks each marker is
+	where it belongs, scrub checks them without the key, and recovery
+	looks for the next marker to find its place again after damage
+*/
+
+const ChunkMarkersMagicIndex = "MAGIC-INDEX"
+
+const chunkMarkerMagic = "\x89ENCCHNK"
+
+const chunkMarkerBytes = int64(len(chunkMarkerMagic) + 4)
+
+// How much is read at a time looking for the next marker
+const chunkMarkerSearchBytes = 64 * 1024
+
+// The bytes a header's markers add to each chunk
+func chunkMarkerSizeBytes(header *EncryptedFileHeader) int64 {
+	if header.ChunkMarkers == "" {
+		return 0
+	}
+
+	return chunkMarkerBytes
+}
+
+func chunkMarker(chunkID uint32) []byte {
+	marker := make([]byte, chunkMarkerBytes)
+	copy(marker, chunkMarkerMagic)
+	binary.BigEndian.PutUint32(marker[len(chunkMarkerMagic):], chunkID)
+
+	return marker
+}
+
+// Streams have no write stage to write the marker on its own, so it is copied in front of the chunk
+func prependChunkMarker(chunkID uint32, chunk []byte) []byte {
+	marked := make([]byte, 0, chunkMarkerBytes+int64(len(chunk)))
+
+	return append(append(marked, chunkMarker(chunkID)...), chunk...)
+}
+
+// The chunk without its marker, an error if the marker is missing or is another chunk's
+func stripChunkMarker(chunkID uint32, chunk []byte) ([]byte, error) {
+	markedID, ok := readChunkMarker(chunk)
+	if !ok {
+		return nil, fmt.Errorf("%w, chunk %d does not start with a chunk marker", ErrFileCorrupt, chunkID)
+	}
+
+	if markedID != chunkID {
+		return nil, fmt.Errorf("%w, chunk %d is marked as chunk %d, chunks were lost, repeated, or moved", ErrFileCorrupt, chunkID, markedID)
+	}
+
+	return chunk[chunkMarkerBytes:], nil
+}
+
+func readChunkMarker(data []byte) (uint32, bool) {
+	if int64(len(data)) < chunkMarkerBytes || string(data[:len(chunkMarkerMagic)]) != chunkMarkerMagic {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(data[len(chunkMarkerMagic):]), true
+}
+
+// Where the next marker in source starts, from offset up to end, -1 if there is none
+func findChunkMarker(source io.ReaderAt, offset int64, end int64) (int64, error) {
+	window := make([]byte, chunkMarkerSearchBytes)
+
+	for offset < end {
+		read, err := source.ReadAt(window[:minInt64(int64(len(window)), end-offset)], offset)
+		if err != nil && err != io.EOF {
+			return -1, fmt.Errorf("could not read while looking for a chunk marker: %w", err)
+		}
+
+		if index := bytes.Index(window[:read], []byte(chunkMarkerMagic)); index >= 0 {
+			return offset + int64(index), nil
+		}
+
+		// A marker may straddle the end of what was read
+		if read < len(chunkMarkerMagic) {
+			break
+		}
+
+		offset += int64(read - len(chunkMarkerMagic) + 1)
+	}
+
+	return -1, nil
+}
@@ -0,0 +1,376 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+	Optical discs and other write-once media are slow to seek and quick
+	to read straight through, and the pipeline's concurrent readers seek
+	constantly. Verifying media reads the file once, front to back, on
+	one goroutine - every chunk, the footer, and the plaintext digest are
+	authenticated as with Verify, and the SHA256 of the file as read is
+	computed in the same pass for the certificate
+
+	Discs take hours and get ejected, so the position is saved to a
+	progress file as the run goes and the next run resumes from it (once
+	the file is known to be the same one). The progress holds the state of
+	the running hashes and the chunk tags read so far - the plaintext
+	hash's state is sealed with the file's key, in the clear it would
+	confirm a guess at the contents like an unsealed plaintext digest
+
+	The certificate is the record to keep beside the archive: which file,
+	its size and SHA256, what was authenticated, when, and where
+*/
+
+type MediaVerificationOptions struct {
+	ProgressFilename string        // The position is kept here so an interrupted run resumes, empty always starts over
+	SaveInterval     time.Duration // How often the position is saved, 0 is DefaultProgressSaveInterval
+}
+
+type VerificationCertificate struct {
+	FileName        string
+	FileSizeBytes   int64
+	SHA256          string `json:",omitempty"` // Of the encrypted file as read, only once all of it was
+	FileID          string `json:",omitempty"` // Hex, from the header
+	FormatVersion   string `json:",omitempty"`
+	Cipher          string `json:",omitempty"`
+	NumChunks       uint32
+	Footer          bool // A footer authenticated every chunk and the file's length
+	PlaintextDigest bool // The plaintext matched the SHA256 sealed in the header
+	Verified        bool
+	Error           string `json:",omitempty"`
+	Started         time.Time
+	Finished        time.Time
+	Runs            int    // More than 1 when resumed
+	Hostname        string `json:",omitempty"`
+	Verifier        string `json:",omitempty"` // Left for the caller, e.g. the tool and its version
+}
+
+const DefaultProgressSaveInterval = 10 * time.Second
+
+const mediaProgressLabel = "encryptor media verification progress"
+
+type mediaVerificationProgress struct {
+	FileName            string
+	FileSizeBytes       int64
+	ModTime             time.Time
+	HeaderDigest        []byte
+	Offset              int64    // Read from the file so far
+	ChunkID             uint32   // Chunks authenticated so far
+	Held                []byte   `json:",omitempty"` // Read past the last chunk, possibly the footer
+	FileHash            []byte   // State of the SHA256 of the file
+	Tags                [][]byte `json:",omitempty"`
+	SealedPlaintextHash []byte   `json:",omitempty"` // State of the SHA256 of the plaintext, sealed with the file's key
+	SignedHash          []byte   `json:",omitempty"` // State of the SHA256 the signature is checked against
+	Started             time.Time
+	Runs                int
+}
+
+// Hashes and counts everything the decrypt reader reads from the file
+type mediaReader struct {
+	file   *os.File
+	hash   hash.Hash
+	offset int64
+}
+
+func (reader *mediaReader) Read(data []byte) (int, error) {
+	read, err := reader.file.Read(data)
+	reader.hash.Write(data[:read])
+	reader.offset += int64(read)
+
+	return read, err
+}
+
+func verifyMedia(fileName string, media *MediaVerificationOptions, options *Options) (VerificationCertificate, error) {
+	if media == nil || options == nil {
+		return VerificationCertificate{}, errors.New("media verification options or options is nil")
+	}
+
+	certificate := VerificationCertificate{FileName: fileName, Started: time.Now(), Runs: 1}
+	certificate.Hostname, _ = os.Hostname()
+
+	err := verifyMediaFile(fileName, media, options, &certificate)
+
+	certificate.Finished = time.Now()
+	certificate.Verified = err == nil
+	if err != nil {
+		certificate.Error = err.Error()
+	}
+
+	return certificate, err
+}
+
+func verifyMediaFile(fileName string, media *MediaVerificationOptions, options *Options, certificate *VerificationCertificate) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not obtain file stat info: %w", err)
+	}
+
+	source := &mediaReader{file: file, hash: sha256.New()}
+
+	reader, err := NewDecryptReader(source, options)
+	if err != nil {
+		return err
+	}
+
+	certificate.FileSizeBytes = stats.Size()
+	certificate.FileID = hex.EncodeToString(reader.header.FileID)
+	certificate.FormatVersion = reader.header.FormatVersion
+	certificate.Footer = reader.auth != nil
+	certificate.PlaintextDigest = reader.hash != nil
+
+	if suite, err := cipherSuiteForHeader(&reader.header); err == nil {
+		certificate.Cipher = suite.Name
+	}
+
+	progress := mediaVerificationProgress{
+		FileName:      fileName,
+		FileSizeBytes: stats.Size(),
+		ModTime:       stats.ModTime(),
+		HeaderDigest:  reader.header.digest,
+		Started:       certificate.Started,
+		Runs:          1,
+	}
+
+	if media.ProgressFilename != "" {
+		resumed, err := resumeMediaVerification(media.ProgressFilename, &progress, source, reader)
+		if err != nil {
+			return err
+		}
+
+		if resumed {
+			certificate.Started = progress.Started
+			certificate.Runs = progress.Runs
+		}
+	}
+
+	saveInterval := media.SaveInterval
+	if saveInterval <= 0 {
+		saveInterval = DefaultProgressSaveInterval
+	}
+
+	lastSaved := time.Now()
+
+	for !reader.done {
+		err = reader.openChunk()
+		if err != nil {
+			break
+		}
+
+		// Nothing is kept, the chunk authenticated
+		reader.plaintext = nil
+
+		// Never after the final chunk, a run resumed there would have no footer left to check
+		if media.ProgressFilename != "" && !reader.done && time.Since(lastSaved) >= saveInterval {
+			err = saveMediaProgress(media.ProgressFilename, &progress, source, reader)
+			if err != nil {
+				return err
+			}
+
+			lastSaved = time.Now()
+		}
+	}
+
+	certificate.NumChunks = reader.chunkID
+
+	// A read error (a dirty disc, a drive that went away) can be retried from the last position saved, a failed check cannot
+	if err != nil {
+		if media.ProgressFilename != "" && (errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrFileCorrupt) || errors.Is(err, ErrPlaintextMismatch)) {
+			_ = os.Remove(media.ProgressFilename)
+		}
+
+		return err
+	}
+
+	// Files without a footer may end on a chunk boundary with more after it, the SHA256 is of the whole file regardless
+	_, err = io.Copy(io.Discard, source)
+	if err != nil {
+		return fmt.Errorf("could not read the end of the file: %w", err)
+	}
+
+	certificate.FileSizeBytes = source.offset
+	certificate.SHA256 = hex.EncodeToString(source.hash.Sum(nil))
+
+	if media.ProgressFilename != "" {
+		_ = os.Remove(media.ProgressFilename)
+	}
+
+	return nil
+}
+
+// Picks up where a saved run stopped, if it was verifying this same file
+func resumeMediaVerification(progressFilename string, progress *mediaVerificationProgress, source *mediaReader, reader *DecryptReader) (bool, error) {
+	data, err := os.ReadFile(progressFilename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not read progress file: %w", err)
+	}
+
+	var saved mediaVerificationProgress
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return false, fmt.Errorf("could not parse progress file: %w", err)
+	}
+
+	// Progress for another file, or this one since it changed, is started over
+	if saved.FileSizeBytes != progress.FileSizeBytes || !saved.ModTime.Equal(progress.ModTime) || !bytes.Equal(saved.HeaderDigest, progress.HeaderDigest) || saved.Offset < source.offset {
+		return false, nil
+	}
+
+	fileHash := sha256.New()
+	err = fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(saved.FileHash)
+	if err != nil {
+		return false, fmt.Errorf("could not restore progress: %w", err)
+	}
+
+	var plaintextHash hash.Hash
+	if reader.hash != nil {
+		plaintextHash, err = openMediaProgressHash(reader, saved.SealedPlaintextHash)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if reader.auth != nil {
+		if len(saved.Held) > reader.holdback.holdSize || uint32(len(saved.Tags)) > saved.ChunkID {
+			return false, errors.New("could not restore progress: the progress file is malformed")
+		}
+
+		// Files with a chunk count have a slot for every tag already, streams grow theirs
+		if len(reader.auth.tags) >= len(saved.Tags) {
+			copy(reader.auth.tags, saved.Tags)
+		} else {
+			reader.auth.tags = saved.Tags
+		}
+
+		reader.holdback.held = saved.Held
+	}
+
+	if reader.signedHash != nil {
+		err = reader.signedHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(saved.SignedHash)
+		if err != nil {
+			return false, fmt.Errorf("could not restore progress: %w", err)
+		}
+	}
+
+	_, err = source.file.Seek(saved.Offset, io.SeekStart)
+	if err != nil {
+		return false, fmt.Errorf("could not resume at offset %d: %w", saved.Offset, err)
+	}
+
+	source.offset = saved.Offset
+	source.hash = fileHash
+	reader.chunkID = saved.ChunkID
+	reader.hash = plaintextHash
+
+	progress.Started = saved.Started
+	progress.Runs = saved.Runs + 1
+
+	return true, nil
+}
+
+// Written to a temporary file and renamed, like the scrub state, so an interrupted save keeps the last one
+func saveMediaProgress(progressFilename string, progress *mediaVerificationProgress, source *mediaReader, reader *DecryptReader) error {
+	var err error
+
+	progress.Offset = source.offset
+	progress.ChunkID = reader.chunkID
+
+	progress.FileHash, err = source.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not save progress: %w", err)
+	}
+
+	if reader.auth != nil {
+		progress.Tags = reader.auth.tags
+		if uint32(len(progress.Tags)) > reader.chunkID {
+			progress.Tags = progress.Tags[:reader.chunkID]
+		}
+
+		progress.Held = reader.holdback.held
+	}
+
+	if reader.hash != nil {
+		progress.SealedPlaintextHash, err = sealMediaProgressHash(reader)
+		if err != nil {
+			return err
+		}
+	}
+
+	if reader.signedHash != nil {
+		progress.SignedHash, err = reader.signedHash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("could not save progress: %w", err)
+		}
+	}
+
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("could not serialize progress: %w", err)
+	}
+
+	err = writeFileAtomic(progressFilename, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write progress file: %w", err)
+	}
+
+	return nil
+}
+
+func mediaProgressAdditionalData(fileID []byte) []byte {
+	return append([]byte(mediaProgressLabel), fileID...)
+}
+
+func sealMediaProgressHash(reader *DecryptReader) ([]byte, error) {
+	state, err := reader.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not save progress: %w", err)
+	}
+
+	sealed, err := encryptBlob(reader.cipher, reader.mode, &state, reader.keyMaterial, mediaProgressAdditionalData(reader.header.FileID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not seal progress: %w", err)
+	}
+
+	return *sealed, nil
+}
+
+func openMediaProgressHash(reader *DecryptReader, sealed []byte) (hash.Hash, error) {
+	if int64(len(sealed)) < chunkOverheadBytes(&reader.header) {
+		return nil, errors.New("could not restore progress: the progress file is malformed")
+	}
+
+	state, err := decryptBlob(reader.cipher, reader.mode, &sealed, reader.keyMaterial, mediaProgressAdditionalData(reader.header.FileID))
+	if err != nil {
+		return nil, fmt.Errorf("%w, the progress file was not saved with this key: %v", ErrAuthenticationFailed, err)
+	}
+
+	plaintextHash := sha256.New()
+	err = plaintextHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(*state)
+	if err != nil {
+		return nil, fmt.Errorf("could not restore progress: %w", err)
+	}
+
+	return plaintextHash, nil
+}
@@ -0,0 +1,122 @@
+package encryptor
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Inside a container the host's memory is not what we may use - the
+	container's cgroup limit is, and going over it gets the process OOM
+	killed rather than slowed down. So auto-tuning works from the
+	smallest of the host's memory, the memory limit of our cgroup and of
+	each cgroup above it (memory.max with cgroup v2, memory.limit_in_bytes
+	with cgroup v1), and GOMEMLIMIT, the limit given to the Go runtime
+
+	When one of those is below the host's memory the default workers are
+	capped to what default sized chunks can fit in it, and file jobs
+	without Options.MaxMemoryMB are bounded to memoryLimitPercent of it
+	(the rest is for the runtime, the binary, and whatever else shares
+	the container). Without a limit nothing changes, jobs are unbounded
+*/
+
+const memoryLimitPercent uint64 = 75
+
+type MemoryLimit struct {
+	Bytes  uint64 // 0 when nothing limits us below the host's memory
+	Source string // cgroup v2, cgroup v1, or GOMEMLIMIT
+}
+
+var memoryLimit struct {
+	once  sync.Once
+	limit MemoryLimit
+}
+
+// Found once, a cgroup's limit is not expected to change under a running job
+func GetMemoryLimit() MemoryLimit {
+	memoryLimit.once.Do(func() {
+		memoryLimit.limit = smallestMemoryLimit(hostMemoryBytes(), cgroupMemoryLimit(cgroupRoot, "/proc/self/cgroup"), os.Getenv("GOMEMLIMIT"))
+	})
+
+	return memoryLimit.limit
+}
+
+// A GOMEMLIMIT that does not parse is ignored, as the runtime refuses to start with one
+func smallestMemoryLimit(hostBytes uint64, cgroup MemoryLimit, goMemLimit string) MemoryLimit {
+	limit := cgroup
+
+	if goLimit, err := parseGoMemLimit(goMemLimit); err == nil && goLimit > 0 && (limit.Bytes == 0 || goLimit < limit.Bytes) {
+		limit = MemoryLimit{Bytes: goLimit, Source: "GOMEMLIMIT"}
+	}
+
+	// Unlimited cgroup v1 limits are a huge number rather than a word
+	if hostBytes > 0 && limit.Bytes >= hostBytes {
+		return MemoryLimit{}
+	}
+
+	return limit
+}
+
+// As the runtime reads it, bytes with an optional B, KiB, MiB, GiB, or TiB suffix - 0 for off or unset
+func parseGoMemLimit(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "off" {
+		return 0, nil
+	}
+
+	multiplier := uint64(1)
+	for i, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSuffix(value, suffix)
+			multiplier = uint64(1) << (10 * (i + 1))
+			break
+		}
+	}
+
+	if multiplier == 1 {
+		value = strings.TrimSuffix(value, "B")
+	}
+
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("GOMEMLIMIT is not a number of bytes")
+	}
+
+	if number > (1<<63-1)/multiplier {
+		return 0, errors.New("GOMEMLIMIT is too large")
+	}
+
+	return number * multiplier, nil
+}
+
+// The bound file jobs without Options.MaxMemoryMB get, 0 (unbounded) without a limit
+func automaticMaxMemoryMB(limit MemoryLimit) uint {
+	if limit.Bytes == 0 {
+		return 0
+	}
+
+	boundMB := limit.Bytes / uint64(bytesFromMB(1)) * memoryLimitPercent / 100
+	if boundMB < 1 {
+		return 1
+	}
+
+	return uint(boundMB)
+}
+
+// Workers each hold a chunk or two, so no more than the chunks that fit in half the bound
+func memoryLimitedWorkers(workers uint, limit MemoryLimit) uint {
+	boundMB := automaticMaxMemoryMB(limit)
+	if boundMB == 0 {
+		return workers
+	}
+
+	fit := uint(bytesFromMB(boundMB) / 2 / chunkMemoryCost(bytesFromMB(DefaultChunkSizeMB), 0))
+	if workers > fit {
+		return fit
+	}
+
+	return workers
+}
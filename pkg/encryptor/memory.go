@@ -0,0 +1,344 @@
+package encryptor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+	Without a bound, read workers run ahead of the execute and write stages
+	and a large file can be pulled into memory far faster than it is
+	written - peaks of many chunks per worker are normal
+
+	With Options.MaxMemoryMB every chunk must be admitted to the pipeline
+	before it is read, and it stays charged until it has been written.
+	A chunk in flight costs its plaintext and its ciphertext (both exist
+	while it is executed), and only half of the bound is handed out to
+	chunks - the rest leaves room for the garbage the collector has not
+	reached yet and for the pipeline's own bookkeeping. Chunks are
+	admitted strictly in order, so the chunk the writer is waiting on can
+	never be starved by later ones
+
+	Workers beyond what the bound can feed are not started, and when
+	encrypting the chunk size is lowered until at least one chunk fits
+
+	Jobs without a bound of their own are bounded by a container's memory
+	limit or GOMEMLIMIT when there is one, see memlimit.go
+
+	The runtime is told about the bound too, so garbage is collected
+	against it rather than whenever the heap happens to be noticed near
+	it. The bound becomes the runtime's soft memory limit (what GOMEMLIMIT
+	sets) and GOGC is chosen so the heap's goal is the bound when the
+	chunk budget is full - no collections are forced while there is room,
+	and the collector works harder only as the bound is approached.
+	Bounded jobs running at once add their bounds together, a tighter
+	GOMEMLIMIT or a GOGC from the environment is left as it is, and the
+	runtime's own settings are put back once the last bounded job ends.
+	Before Go 1.19 there is no soft limit, so GOGC is all there is and the
+	sampler still collects whenever the heap passes 3/4 of the bound
+*/
+
+// Bytes of bookkeeping per chunk (three channels and a read request), a generous estimate
+const pipelineBytesPerChunk int64 = 512
+
+/*
+	How a file job used memory, so chunk size and workers can be tuned to
+	a machine - allocation and GC figures cover the job only, while the
+	heap is sampled (the true peak may be slightly higher)
+*/
+type MemoryReport struct {
+	BoundBytes      uint64 // 0 when no bound was set
+	PeakHeapBytes   uint64
+	TotalAllocBytes uint64
+	NumGC           uint32
+	GCPauseTotal    time.Duration
+	Elapsed         time.Duration
+	Readers         uint // Workers actually started, after fitting the bound
+	Executors       uint // The cap when scaling
+	ChunkSizeMB     uint
+	Runtime         RuntimeMemorySettings // Bounded jobs only, as they stood when the job ended
+	Samples         []MemorySample        // Only with Options.MemorySampleInterval
+	Scaling         []ScalingDecision     // Only with Options.ScaleExecutors, see scaling.go
+}
+
+// How the runtime was tuned for a bounded job, see runtimeMemory
+type RuntimeMemorySettings struct {
+	SoftLimitBytes uint64 // 0 where the runtime has no soft limit
+	GCPercent      int
+}
+
+type MemorySample struct {
+	Elapsed         time.Duration
+	HeapAllocBytes  uint64
+	TotalAllocBytes uint64 // Since the job started
+	NumGC           uint32
+}
+
+// The share of the job's wall time the GC stopped the world for
+func (report *MemoryReport) GCPauseFraction() float64 {
+	if report.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(report.GCPauseTotal) / float64(report.Elapsed)
+}
+
+type memoryBudget struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	available int64
+	chunkCost int64
+	nextChunk uint
+}
+
+// nil when there is no bound, a nil budget admits everything immediately
+func newMemoryBudget(chunkBudgetBytes int64, chunkCost int64) *memoryBudget {
+	if chunkBudgetBytes <= 0 {
+		return nil
+	}
+
+	budget := &memoryBudget{available: chunkBudgetBytes, chunkCost: chunkCost, nextChunk: 1}
+	budget.cond = sync.NewCond(&budget.mutex)
+
+	return budget
+}
+
+// Blocks until it is this chunk's turn and there is room for it
+func (budget *memoryBudget) acquire(chunkID uint) {
+	if budget == nil {
+		return
+	}
+
+	budget.mutex.Lock()
+	for budget.nextChunk != chunkID || budget.available < budget.chunkCost {
+		budget.cond.Wait()
+	}
+
+	budget.available -= budget.chunkCost
+	budget.nextChunk++
+
+	budget.cond.Broadcast()
+	budget.mutex.Unlock()
+}
+
+// Called once a chunk has been written and its buffers are garbage
+func (budget *memoryBudget) release() {
+	if budget == nil {
+		return
+	}
+
+	budget.mutex.Lock()
+	budget.available += budget.chunkCost
+
+	budget.cond.Broadcast()
+	budget.mutex.Unlock()
+}
+
+func chunkMemoryCost(chunkSizeBytes int64, overheadBytes int64) int64 {
+	return chunkSizeBytes*2 + overheadBytes
+}
+
+/*
+	Fits a job to a memory bound, returning the bytes available to chunks
+	in flight - when encrypting the chunk size is lowered until at least
+	one chunk fits, so the header and chunk count may change
+*/
+func fitMemoryBound(job *pipelineJob, header *EncryptedFileHeader, numChunks *uint32, sourceSizeBytes int64) (int64, error) {
+	boundBytes := bytesFromMB(job.MaxMemoryMB)
+
+	for {
+		chunkSizeBytes := header.ChunkSizeBytes
+		chunkBudgetBytes := boundBytes/2 - int64(*numChunks)*pipelineBytesPerChunk
+		cost := chunkMemoryCost(chunkSizeBytes, chunkOverheadBytes(header))
+
+		if chunkBudgetBytes >= cost {
+			return chunkBudgetBytes, nil
+		}
+
+		if job.Operation != Encryption || job.ChunkSizeMB <= ChunkSizeMin {
+			bound := fmt.Sprintf("a memory bound of %d MB", job.MaxMemoryMB)
+			if job.MemoryLimit != "" {
+				bound += fmt.Sprintf(" (%d%% of the %s memory limit)", memoryLimitPercent, job.MemoryLimit)
+			}
+
+			return 0, fmt.Errorf("%s cannot fit a %d MB chunk, at least %d MB is needed",
+				bound, chunkSizeBytes/bytesFromMB(1), (2*(cost+int64(*numChunks)*pipelineBytesPerChunk))/bytesFromMB(1)+1)
+		}
+
+		// Halving the chunk size roughly doubles the chunk count, the header is rebuilt to match
+		job.ChunkSizeMB = job.ChunkSizeMB / 2
+		if job.ChunkSizeMB < ChunkSizeMin {
+			job.ChunkSizeMB = ChunkSizeMin
+		}
+
+		*numChunks = plaintextChunkCount(sourceSizeBytes, bytesFromMB(job.ChunkSizeMB))
+		*header = newEncryptedFileHeader(job, *numChunks)
+	}
+}
+
+// GOGC is at least this, below it the collector runs almost continuously
+const minimumGCPercent = 25
+
+// The runtime's settings before the first of the bounded jobs running now
+var runtimeMemory struct {
+	mutex             sync.Mutex
+	jobs              uint
+	boundBytes        int64 // The bounds of the running jobs added together
+	previousLimit     int64
+	previousGCPercent int
+	settings          RuntimeMemorySettings
+}
+
+/*
+	Tunes the runtime for a bounded job, returning what to call when the
+	job ends - the heap goal is the live chunks (the chunk budget) plus
+	GOGC percent of them, so that percent is what is left of the bound
+*/
+func tuneRuntimeMemory(boundBytes int64, chunkBudgetBytes int64) func() {
+	runtimeMemory.mutex.Lock()
+	defer runtimeMemory.mutex.Unlock()
+
+	if runtimeMemory.jobs == 0 {
+		runtimeMemory.previousLimit = setRuntimeMemoryLimit(-1)
+		runtimeMemory.previousGCPercent = debug.SetGCPercent(-1)
+		debug.SetGCPercent(runtimeMemory.previousGCPercent)
+
+		runtimeMemory.settings.GCPercent = runtimeMemory.previousGCPercent
+		if os.Getenv("GOGC") == "" && chunkBudgetBytes > 0 {
+			runtimeMemory.settings.GCPercent = int(maxInt64(100*(boundBytes-chunkBudgetBytes)/chunkBudgetBytes, minimumGCPercent))
+			debug.SetGCPercent(runtimeMemory.settings.GCPercent)
+		}
+	}
+
+	runtimeMemory.jobs++
+	runtimeMemory.boundBytes += boundBytes
+	applyRuntimeMemoryLimit()
+
+	return func() {
+		runtimeMemory.mutex.Lock()
+		defer runtimeMemory.mutex.Unlock()
+
+		runtimeMemory.jobs--
+		runtimeMemory.boundBytes -= boundBytes
+
+		if runtimeMemory.jobs > 0 {
+			applyRuntimeMemoryLimit()
+			return
+		}
+
+		setRuntimeMemoryLimit(runtimeMemory.previousLimit)
+		debug.SetGCPercent(runtimeMemory.previousGCPercent)
+		runtimeMemory.settings = RuntimeMemorySettings{}
+	}
+}
+
+// Called with runtimeMemory.mutex held, a tighter limit from before is kept
+func applyRuntimeMemoryLimit() {
+	limit := runtimeMemory.boundBytes
+	if runtimeMemory.previousLimit < limit {
+		limit = runtimeMemory.previousLimit
+	}
+
+	if runtimeMemoryLimitSupported {
+		setRuntimeMemoryLimit(limit)
+		runtimeMemory.settings.SoftLimitBytes = uint64(limit)
+	}
+}
+
+func currentRuntimeMemorySettings() RuntimeMemorySettings {
+	runtimeMemory.mutex.Lock()
+	defer runtimeMemory.mutex.Unlock()
+
+	return runtimeMemory.settings
+}
+
+// Samples the heap while a job runs, collecting early near a bound only without a soft limit
+type memorySampler struct {
+	boundBytes     uint64
+	sampleInterval time.Duration
+	start          time.Time
+	startStats     runtime.MemStats
+	lastSample     time.Time
+	report         MemoryReport
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+// A sample interval of 0 records no time series
+func startMemorySampler(boundBytes uint64, sampleInterval time.Duration) *memorySampler {
+	sampler := &memorySampler{
+		boundBytes:     boundBytes,
+		sampleInterval: sampleInterval,
+		start:          time.Now(),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	runtime.ReadMemStats(&sampler.startStats)
+
+	go func() {
+		defer close(sampler.done)
+
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			sampler.sample()
+
+			select {
+			case <-sampler.stop:
+				sampler.sample()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return sampler
+}
+
+func (sampler *memorySampler) sample() {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	now := time.Now()
+	report := &sampler.report
+
+	if memStats.HeapAlloc > report.PeakHeapBytes {
+		report.PeakHeapBytes = memStats.HeapAlloc
+	}
+
+	report.Elapsed = now.Sub(sampler.start)
+	report.TotalAllocBytes = memStats.TotalAlloc - sampler.startStats.TotalAlloc
+	report.NumGC = memStats.NumGC - sampler.startStats.NumGC
+	report.GCPauseTotal = time.Duration(memStats.PauseTotalNs - sampler.startStats.PauseTotalNs)
+
+	if sampler.sampleInterval > 0 && now.Sub(sampler.lastSample) >= sampler.sampleInterval {
+		report.Samples = append(report.Samples, MemorySample{
+			Elapsed:         report.Elapsed,
+			HeapAllocBytes:  memStats.HeapAlloc,
+			TotalAllocBytes: report.TotalAllocBytes,
+			NumGC:           report.NumGC,
+		})
+
+		sampler.lastSample = now
+	}
+
+	if !runtimeMemoryLimitSupported && sampler.boundBytes > 0 && memStats.HeapAlloc > sampler.boundBytes*3/4 {
+		runtime.GC()
+	}
+}
+
+// Stops sampling, the final sample is always taken
+func (sampler *memorySampler) finish() MemoryReport {
+	close(sampler.stop)
+	<-sampler.done
+
+	sampler.report.BoundBytes = sampler.boundBytes
+
+	return sampler.report
+}
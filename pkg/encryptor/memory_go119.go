@@ -0,0 +1,14 @@
+//go:build go1.19
+
+package encryptor
+
+import (
+	"runtime/debug"
+)
+
+const runtimeMemoryLimitSupported = true
+
+// Sets the runtime's soft memory limit and returns the one before, a negative limit only reads it
+func setRuntimeMemoryLimit(limit int64) int64 {
+	return debug.SetMemoryLimit(limit)
+}
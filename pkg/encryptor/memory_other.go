@@ -0,0 +1,14 @@
+//go:build !go1.19
+
+package encryptor
+
+import (
+	"math"
+)
+
+// TBD: the runtime has no soft memory limit before Go 1.19, bounded jobs tune GOGC alone
+const runtimeMemoryLimitSupported = false
+
+func setRuntimeMemoryLimit(limit int64) int64 {
+	return math.MaxInt64
+}
@@ -0,0 +1,440 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+	A Merkle tree over a file's chunks, so a byte range of a huge file can
+	be verified against one root without hashing the rest of the file.
+	The tree is RFC 6962's (Certificate Transparency's), whose proofs
+	existing libraries already check
+
+		leaf  SHA256(0x00 || chunk)
+		node  SHA256(0x01 || left || right)
+
+	with n leaves split at the largest power of two below n, and an empty
+	file's root the SHA256 of nothing. Chunks are ChunkSizeBytes long but
+	the last, which is whatever is left
+
+	The chunk size defaults to the encryption chunk size, and encrypting or
+	decrypting with a tree hash wanted computes it over the plaintext as
+	the pipeline's executors see each chunk - chunk i of the tree is then
+	plaintext chunk i of the encrypted file, so a range proven against the
+	root can be fetched by decrypting only the chunks it covers
+
+	A range proof carries an audit path for each chunk the range touches,
+	and whoever verifies needs those whole chunks - the range is rounded
+	out to chunk boundaries, Offset and Length say which bytes to fetch
+
+	A proof of an encrypted file's range is for auditors, who hold the
+	root but neither the key nor the archive. The file is decrypted once
+	without writing the plaintext, and the chunks the range touches are
+	kept and carried in the proof, so the auditor checks the sample
+	against the root with nothing else. The root pins each chunk's
+	content and place, the chunk size is the proof's word - an auditor
+	should be given it with the root
+*/
+
+type MerkleTree struct {
+	ChunkSizeBytes int64
+	SizeBytes      int64
+	Root           string // Hex encoded
+	leaves         [][]byte
+	keep           merkleKeep
+}
+
+// Plaintext chunks kept for a proof as the pipeline passes them, see proveEncryptedRange
+type merkleKeep struct {
+	start  int64
+	end    int64 // 0 keeps nothing
+	chunks [][]byte
+}
+
+type MerkleRangeProof struct {
+	Root           string // Hex encoded, what the proof is checked against
+	ChunkSizeBytes int64
+	SizeBytes      int64
+	LeafCount      int
+	Start          int64 // The range asked for, End exclusive
+	End            int64
+	Chunks         []MerkleChunkProof
+}
+
+type MerkleChunkProof struct {
+	Index  int
+	Offset int64
+	Length int64
+	Path   []string // Hex encoded audit path, leaf to root
+	Data   []byte   `json:",omitempty"` // The chunk itself, when the proof carries it
+}
+
+// Leaf hashes recorded by the pipeline's executors, each at its own index so no lock is needed
+type merkleLeaves struct {
+	hashes         [][]byte
+	sizes          []int64
+	chunkSizeBytes int64
+	keep           merkleKeep
+}
+
+// A nil collector records nothing, as when no tree hash is wanted
+func newMerkleLeaves(numChunks uint32) *merkleLeaves {
+	return &merkleLeaves{hashes: make([][]byte, numChunks), sizes: make([]int64, numChunks)}
+}
+
+func (leaves *merkleLeaves) record(chunkID uint, plaintext []byte) {
+	if leaves == nil || chunkID < 1 || int(chunkID) > len(leaves.hashes) {
+		return
+	}
+
+	leaves.hashes[chunkID-1] = merkleLeafHash(plaintext)
+	leaves.sizes[chunkID-1] = int64(len(plaintext))
+
+	// A copy, the executors reuse their buffers
+	offset := int64(chunkID-1) * leaves.chunkSizeBytes
+	if leaves.keep.chunks != nil && offset < leaves.keep.end && offset+int64(len(plaintext)) > leaves.keep.start {
+		leaves.keep.chunks[chunkID-1] = append([]byte(nil), plaintext...)
+	}
+}
+
+// The chunks touching keep's range are kept as they are recorded, each at its own index as the hashes are
+func (leaves *merkleLeaves) keepRange(keep merkleKeep, chunkSizeBytes int64) {
+	if keep.end <= keep.start {
+		return
+	}
+
+	leaves.chunkSizeBytes = chunkSizeBytes
+	leaves.keep = merkleKeep{start: keep.start, end: keep.end, chunks: make([][]byte, len(leaves.hashes))}
+}
+
+func (leaves *merkleLeaves) tree(chunkSizeBytes int64) MerkleTree {
+	tree := MerkleTree{ChunkSizeBytes: chunkSizeBytes, keep: leaves.keep}
+
+	for _, size := range leaves.sizes {
+		tree.SizeBytes += size
+	}
+
+	// An empty file is one empty chunk to the pipeline, and no chunks to the tree
+	if tree.SizeBytes > 0 {
+		tree.leaves = leaves.hashes
+	}
+
+	tree.Root = hex.EncodeToString(merkleRoot(tree.leaves))
+	return tree
+}
+
+func merkleLeafHash(chunk []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{0x00})
+	hash.Write(chunk)
+
+	return hash.Sum(nil)
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{0x01})
+	hash.Write(left)
+	hash.Write(right)
+
+	return hash.Sum(nil)
+}
+
+// The largest power of two below n, for n of at least 2
+func merkleSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+
+	return k
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := merkleSplit(len(leaves))
+
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// RFC 6962's PATH(m, D[n]), the siblings from leaf m up to the root
+func merkleAuditPath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := merkleSplit(len(leaves))
+
+	if index < k {
+		return append(merkleAuditPath(index, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+
+	return append(merkleAuditPath(index-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// The root an audit path leads to from a leaf, following RFC 9162's verification of an inclusion proof
+func merkleRootFromPath(index int, leafCount int, leaf []byte, path [][]byte) ([]byte, error) {
+	if index < 0 || index >= leafCount {
+		return nil, fmt.Errorf("chunk %d is not in a tree of %d chunks", index, leafCount)
+	}
+
+	fn, sn := index, leafCount-1
+	hash := leaf
+
+	for _, sibling := range path {
+		if sn == 0 {
+			return nil, errors.New("the audit path is too long")
+		}
+
+		if fn%2 == 1 || fn == sn {
+			hash = merkleNodeHash(sibling, hash)
+
+			for fn%2 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNodeHash(hash, sibling)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errors.New("the audit path is too short")
+	}
+
+	return hash, nil
+}
+
+// Every chunk hashed by workers in parallel, each reading its own chunks at their offsets
+func merkleTreeHashFile(fileName string, chunkSizeBytes int64, workers uint) (MerkleTree, error) {
+	if chunkSizeBytes <= 0 {
+		return MerkleTree{}, errors.New("the tree hash chunk size must be positive")
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return MerkleTree{}, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil {
+		return MerkleTree{}, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	numChunks := plaintextChunkCount(stats.Size(), chunkSizeBytes)
+	leaves := newMerkleLeaves(numChunks)
+
+	indices := make(chan uint)
+	errs := make(chan error, workers)
+	var wait sync.WaitGroup
+
+	for i := uint(0); i < workers; i++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			chunk := make([]byte, chunkSizeBytes)
+
+			for chunkID := range indices {
+				offset := int64(chunkID-1) * chunkSizeBytes
+
+				bytesRead, err := file.ReadAt(chunk, offset)
+				if err != nil && !(errors.Is(err, io.EOF) && offset+int64(bytesRead) == stats.Size()) {
+					errs <- fmt.Errorf("could not read chunk %d: %w", chunkID, err)
+					return
+				}
+
+				leaves.record(chunkID, chunk[:bytesRead])
+			}
+		}()
+	}
+
+	var readErr error
+
+	for chunkID := uint(1); chunkID <= uint(numChunks) && readErr == nil; chunkID++ {
+		select {
+		case indices <- chunkID:
+		case readErr = <-errs:
+		}
+	}
+
+	close(indices)
+	wait.Wait()
+
+	if readErr == nil && len(errs) > 0 {
+		readErr = <-errs
+	}
+
+	if readErr != nil {
+		return MerkleTree{}, readErr
+	}
+
+	return leaves.tree(chunkSizeBytes), nil
+}
+
+// The chunks [start, end) touches, with an audit path for each
+func (tree *MerkleTree) proveRange(start int64, end int64) (MerkleRangeProof, error) {
+	if start < 0 || end <= start || end > tree.SizeBytes {
+		return MerkleRangeProof{}, fmt.Errorf("range %d-%d is not within the file's %d bytes", start, end, tree.SizeBytes)
+	}
+
+	proof := MerkleRangeProof{
+		Root:           tree.Root,
+		ChunkSizeBytes: tree.ChunkSizeBytes,
+		SizeBytes:      tree.SizeBytes,
+		LeafCount:      len(tree.leaves),
+		Start:          start,
+		End:            end,
+	}
+
+	for index := int(start / tree.ChunkSizeBytes); int64(index)*tree.ChunkSizeBytes < end; index++ {
+		chunk := MerkleChunkProof{Index: index, Offset: int64(index) * tree.ChunkSizeBytes, Length: tree.ChunkSizeBytes}
+		if chunk.Offset+chunk.Length > tree.SizeBytes {
+			chunk.Length = tree.SizeBytes - chunk.Offset
+		}
+
+		for _, sibling := range merkleAuditPath(index, tree.leaves) {
+			chunk.Path = append(chunk.Path, hex.EncodeToString(sibling))
+		}
+
+		if tree.keep.chunks != nil {
+			chunk.Data = tree.keep.chunks[index]
+		}
+
+		proof.Chunks = append(proof.Chunks, chunk)
+	}
+
+	return proof, nil
+}
+
+// Checks one whole chunk against the proof's root, chunk holds the bytes at its Offset and Length
+func verifyMerkleChunk(proof MerkleRangeProof, chunkProof MerkleChunkProof, chunk []byte) error {
+	if int64(len(chunk)) != chunkProof.Length {
+		return fmt.Errorf("chunk %d is %d bytes, the proof says %d", chunkProof.Index, len(chunk), chunkProof.Length)
+	}
+
+	var path [][]byte
+
+	for _, sibling := range chunkProof.Path {
+		hash, err := hex.DecodeString(sibling)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("chunk %d has a malformed audit path", chunkProof.Index)
+		}
+
+		path = append(path, hash)
+	}
+
+	expected, err := hex.DecodeString(proof.Root)
+	if err != nil {
+		return errors.New("the proof has a malformed root")
+	}
+
+	root, err := merkleRootFromPath(chunkProof.Index, proof.LeafCount, merkleLeafHash(chunk), path)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", chunkProof.Index, err)
+	}
+
+	if !bytes.Equal(root, expected) {
+		return fmt.Errorf("chunk %d does not match the tree hash", chunkProof.Index)
+	}
+
+	return nil
+}
+
+// Decrypts the file without writing the plaintext, keeping the chunks [start, end) touches to carry in the proof
+func proveEncryptedRange(sourceFilename string, start int64, end int64, options *Options) (MerkleRangeProof, error) {
+	if options == nil {
+		return MerkleRangeProof{}, errors.New("options is nil")
+	}
+
+	if start < 0 || end <= start {
+		return MerkleRangeProof{}, fmt.Errorf("range %d-%d is empty", start, end)
+	}
+
+	tree := MerkleTree{keep: merkleKeep{start: start, end: end}}
+
+	jobOptions := *options
+	jobOptions.TreeHash = &tree
+
+	err := runOperation(Verification, sourceFilename, "", &jobOptions)
+	if err != nil {
+		return MerkleRangeProof{}, err
+	}
+
+	return tree.proveRange(start, end)
+}
+
+// Checks a whole proof against the root the verifier knows the file by, chunks the proof does not carry are read from source
+func verifyMerkleRangeProof(proof MerkleRangeProof, root string, source io.ReaderAt) error {
+	if !strings.EqualFold(strings.TrimSpace(root), proof.Root) {
+		return fmt.Errorf("the proof is against root %s, not %s", proof.Root, root)
+	}
+
+	if proof.ChunkSizeBytes <= 0 || proof.ChunkSizeBytes > bytesFromMB(ChunkSizeMax) || len(proof.Chunks) == 0 {
+		return errors.New("malformed proof")
+	}
+
+	// Consecutive chunks covering the whole range, or part of it would go unproven
+	for i, chunkProof := range proof.Chunks {
+		if chunkProof.Offset != int64(chunkProof.Index)*proof.ChunkSizeBytes || chunkProof.Length <= 0 || chunkProof.Length > proof.ChunkSizeBytes ||
+			(i > 0 && chunkProof.Index != proof.Chunks[i-1].Index+1) {
+			return fmt.Errorf("malformed proof of chunk %d", chunkProof.Index)
+		}
+	}
+
+	first, last := proof.Chunks[0], proof.Chunks[len(proof.Chunks)-1]
+	if proof.Start < first.Offset || proof.End > last.Offset+last.Length || proof.End <= proof.Start {
+		return fmt.Errorf("the proof's chunks do not cover bytes %d-%d", proof.Start, proof.End)
+	}
+
+	for _, chunkProof := range proof.Chunks {
+		chunk := chunkProof.Data
+
+		if chunk == nil {
+			if source == nil {
+				return fmt.Errorf("the proof does not carry chunk %d, give the file it was proven from", chunkProof.Index)
+			}
+
+			chunk = make([]byte, chunkProof.Length)
+
+			bytesRead, err := source.ReadAt(chunk, chunkProof.Offset)
+			if bytesRead != len(chunk) {
+				return fmt.Errorf("could not read chunk %d: %w", chunkProof.Index, err)
+			}
+		}
+
+		err := verifyMerkleChunk(proof, chunkProof, chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
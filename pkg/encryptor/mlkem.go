@@ -0,0 +1,182 @@
+package encryptor
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"strings"
+)
+
+/*
+	Archives kept for decades outlive the assumption that X25519 cannot
+	be broken - a recording of the file today could be opened by a
+	quantum computer later. Hybrid recipients wrap the file key with both
+	ML-KEM-768 (FIPS 203) and X25519, so it stays safe while either holds
+
+		shared secret = ML-KEM shared secret | X25519 shared secret
+		salt = ML-KEM ciphertext | ephemeral share | recipient's X25519 key
+
+	and, as for x25519 recipients, HKDF of the shared secret and salt keys
+	a ChaCha20-Poly1305 seal of the file key, with a label of its own.
+	The stanza holds the ephemeral share and the ML-KEM ciphertext
+
+	Keys are marked so they are never mistaken for X25519 keys (or the
+	other way round), then base64
+
+		public key - ML-KEM-768 encapsulation key (1184 bytes) | X25519 public key
+		private key - ML-KEM-768 seed (64 bytes) | X25519 private key
+
+	ML-KEM comes from crypto/mlkem, in Go 1.24 and later - built with an
+	older toolchain, hybrid recipients are refused with errMLKEMUnsupported
+*/
+
+const RecipientTypeMLKEMX25519 = "mlkem768-x25519"
+
+const mlkemX25519Label = "encryptor/v1/mlkem768-x25519"
+
+const (
+	mlkemX25519PublicPrefix = "mlkem768x25519:"
+	mlkemX25519SecretPrefix = "mlkem768x25519-secret:"
+)
+
+// The sizes FIPS 203 gives ML-KEM-768
+const (
+	mlkemEncapsulationKeySize = 1184
+	mlkemCiphertextSize       = 1088
+	mlkemSeedSize             = 64
+)
+
+var errMLKEMUnsupported = errors.New("ML-KEM needs a build with Go 1.24 or later, this one cannot use mlkem768-x25519 recipients")
+
+// The private key, and its public key to give to whoever encrypts to it
+func generateMLKEMX25519Identity() (string, string, error) {
+	seed, encapsulationKey, err := newMLKEMKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	privateX25519 := make([]byte, curve25519.ScalarSize)
+	if err := readRandom(privateX25519); err != nil {
+		return "", "", fmt.Errorf("internal crypto error generating private key: %w", err)
+	}
+
+	publicX25519, err := curve25519.X25519(privateX25519, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+
+	privateKey := mlkemX25519SecretPrefix + base64.StdEncoding.EncodeToString(append(seed, privateX25519...))
+	publicKey := mlkemX25519PublicPrefix + base64.StdEncoding.EncodeToString(append(encapsulationKey, publicX25519...))
+
+	return privateKey, publicKey, nil
+}
+
+func parseMLKEMX25519Key(encoded string, prefix string, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(encoded), prefix))
+	if err != nil || len(key) != size+curve25519.PointSize {
+		return nil, fmt.Errorf("an ML-KEM-768 + X25519 key is %s and %d bytes in base64", prefix, size+curve25519.PointSize)
+	}
+
+	return key, nil
+}
+
+func parseMLKEMX25519Secret(encoded string) ([]byte, error) {
+	return parseMLKEMX25519Key(encoded, mlkemX25519SecretPrefix, mlkemSeedSize)
+}
+
+func wrapFileKeyMLKEMX25519(fileKey []byte, publicKey string) (RecipientStanza, error) {
+	key, err := parseMLKEMX25519Key(publicKey, mlkemX25519PublicPrefix, mlkemEncapsulationKeySize)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	encapsulationKey, recipientX25519 := key[:mlkemEncapsulationKeySize], key[mlkemEncapsulationKeySize:]
+
+	mlkemShared, ciphertext, err := mlkemEncapsulate(encapsulationKey)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if err := readRandom(ephemeral); err != nil {
+		return RecipientStanza{}, fmt.Errorf("internal crypto error generating ephemeral key: %w", err)
+	}
+
+	ephemeralShare, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	x25519Shared, err := curve25519.X25519(ephemeral, recipientX25519)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not encrypt to X25519 recipient: %w", err)
+	}
+
+	salt := append(append(append([]byte{}, ciphertext...), ephemeralShare...), recipientX25519...)
+
+	body, err := sealFileKey(fileKey, append(mlkemShared, x25519Shared...), salt, mlkemX25519Label)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeMLKEMX25519,
+		Args: []string{base64.StdEncoding.EncodeToString(ephemeralShare), base64.StdEncoding.EncodeToString(ciphertext)},
+		Body: base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+func unwrapFileKeyMLKEMX25519(stanza RecipientStanza, identities [][]byte) ([]byte, error) {
+	if len(stanza.Args) < 2 {
+		return nil, errors.New("malformed mlkem768-x25519 stanza")
+	}
+
+	ephemeralShare, err := parseX25519Key(stanza.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed mlkem768-x25519 stanza: %w", err)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(stanza.Args[1])
+	if err != nil || len(ciphertext) != mlkemCiphertextSize {
+		return nil, errors.New("malformed mlkem768-x25519 stanza, the ML-KEM ciphertext is the wrong size")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed mlkem768-x25519 stanza: %w", err)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("no ML-KEM-768 + X25519 identity was given, use --identity")
+	}
+
+	for _, identity := range identities {
+		seed, privateX25519 := identity[:mlkemSeedSize], identity[mlkemSeedSize:]
+
+		// ML-KEM never fails to decapsulate, a ciphertext for another key gives another secret
+		mlkemShared, err := mlkemDecapsulate(seed, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+
+		publicX25519, err := curve25519.X25519(privateX25519, curve25519.Basepoint)
+		if err != nil {
+			continue
+		}
+
+		x25519Shared, err := curve25519.X25519(privateX25519, ephemeralShare)
+		if err != nil {
+			return nil, fmt.Errorf("malformed mlkem768-x25519 stanza: %w", err)
+		}
+
+		salt := append(append(append([]byte{}, ciphertext...), ephemeralShare...), publicX25519...)
+
+		fileKey, err := openFileKey(body, append(mlkemShared, x25519Shared...), salt, mlkemX25519Label)
+		if err == nil {
+			return fileKey, nil
+		}
+	}
+
+	return nil, errors.New("no ML-KEM-768 + X25519 identity matches")
+}
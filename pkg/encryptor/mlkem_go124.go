@@ -0,0 +1,40 @@
+//go:build go1.24
+
+package encryptor
+
+import (
+	"crypto/mlkem"
+	"fmt"
+)
+
+const mlkemSupported = true
+
+// The seed the decapsulation key is expanded from, and the encapsulation key
+func newMLKEMKey() ([]byte, []byte, error) {
+	key, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, fmt.Errorf("internal crypto error generating ML-KEM key: %w", err)
+	}
+
+	return key.Bytes(), key.EncapsulationKey().Bytes(), nil
+}
+
+func mlkemEncapsulate(encapsulationKey []byte) ([]byte, []byte, error) {
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ML-KEM-768 public key: %w", err)
+	}
+
+	shared, ciphertext := key.Encapsulate()
+
+	return shared, ciphertext, nil
+}
+
+func mlkemDecapsulate(seed []byte, ciphertext []byte) ([]byte, error) {
+	key, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM-768 private key: %w", err)
+	}
+
+	return key.Decapsulate(ciphertext)
+}
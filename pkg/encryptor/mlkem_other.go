@@ -0,0 +1,18 @@
+//go:build !go1.24
+
+package encryptor
+
+// TBD: ML-KEM before Go 1.24 would need a module of its own, hybrid recipients are refused instead
+const mlkemSupported = false
+
+func newMLKEMKey() ([]byte, []byte, error) {
+	return nil, nil, errMLKEMUnsupported
+}
+
+func mlkemEncapsulate(encapsulationKey []byte) ([]byte, []byte, error) {
+	return nil, nil, errMLKEMUnsupported
+}
+
+func mlkemDecapsulate(seed []byte, ciphertext []byte) ([]byte, error) {
+	return nil, errMLKEMUnsupported
+}
@@ -0,0 +1,181 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	Options.StoreName records the source's base name in the header, so a
+	file decrypted long after it was encrypted - backup.enc, temp.enc -
+	can be given its name back (the CLI's -d --restore-name). Only the
+	base name is kept, never the directory it was in, and a name read
+	from a header is checked before it is used as one: anyone can write
+	any header
+
+	NameStoreSealed seals the name with the file's key, bound to the file
+	ID like the plaintext digest, so it tells nothing to whoever holds the
+	file without the key. NameStorePlain keeps it in the clear, where
+	inspect shows it without the key, and it is bound into every chunk's
+	AAD with the rest of the header, so a name that was changed fails the
+	decryption it named. Neither needs a new format version, older
+	versions ignore the name and decrypt as they always have
+*/
+
+const (
+	NameStorePlain  = "plain"
+	NameStoreSealed = "sealed"
+)
+
+// What most filesystems allow in a name
+const storedNameMaxBytes = 255
+
+const storedNameLabel = "encryptor original name"
+
+func storedNameAdditionalData(fileID []byte) []byte {
+	return append([]byte(storedNameLabel), fileID...)
+}
+
+func checkStoreName(storeName string) error {
+	if storeName != "" && storeName != NameStorePlain && storeName != NameStoreSealed {
+		return fmt.Errorf("unknown way of storing the name %q, use %s or %s", storeName, NameStorePlain, NameStoreSealed)
+	}
+
+	return nil
+}
+
+// A name that is a file in whatever directory it is restored to, and nothing else
+func checkStoredName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%q is not a file name", name)
+	}
+
+	if len(name) > storedNameMaxBytes {
+		return fmt.Errorf("the name is %d bytes, longer than the %d a name can be", len(name), storedNameMaxBytes)
+	}
+
+	if !utf8.ValidString(name) {
+		return errors.New("the name is not valid UTF-8")
+	}
+
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%q is a path, not a file name", name)
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%q has control characters in it", name)
+		}
+	}
+
+	return nil
+}
+
+// Sets the job's name for the header, as StoreName says it is kept
+func setStoredName(job *pipelineJob, storeName string, name string) error {
+	if storeName == "" {
+		return nil
+	}
+
+	err := checkStoreName(storeName)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return errors.New("there is no source filename to take a name from, set OriginalName to store one")
+	}
+
+	err = checkStoredName(name)
+	if err != nil {
+		return fmt.Errorf("cannot store the name: %w", err)
+	}
+
+	if storeName == NameStorePlain {
+		job.Name = name
+		return nil
+	}
+
+	data := []byte(name)
+
+	sealed, err := encryptBlob(job.Cipher, job.CipherMode, &data, job.KeyMaterial, storedNameAdditionalData(job.FileID), nil)
+	if err != nil {
+		return fmt.Errorf("could not seal the name: %w", err)
+	}
+
+	job.SealedName = *sealed
+	return nil
+}
+
+// The name a file job stores when OriginalName does not give one
+func withSourceName(options *Options, sourceFilename string) *Options {
+	if options.StoreName == "" || options.OriginalName != "" {
+		return options
+	}
+
+	// A directory given as . still has a name
+	if absolute, err := filepath.Abs(sourceFilename); err == nil {
+		sourceFilename = absolute
+	}
+
+	named := *options
+	named.OriginalName = filepath.Base(sourceFilename)
+	return &named
+}
+
+func originalName(fileName string, options *Options) (string, error) {
+	header, _, err := getEncryptedFileHeaderFromFile(fileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve encryption header from file: %w", err)
+	}
+
+	var name string
+
+	switch {
+	case header.Name != "":
+		name = header.Name
+	case len(header.SealedName) > 0:
+		if options == nil {
+			return "", errors.New("options is nil")
+		}
+
+		key, err := resolveKeyMaterial(Decryption, &header, options)
+		if err != nil {
+			return "", err
+		}
+
+		name, err = openStoredName(&header, key.Material)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrNoStoredName
+	}
+
+	err = checkStoredName(name)
+	if err != nil {
+		return "", fmt.Errorf("%w, the name it records cannot be used: %v", ErrFileCorrupt, err)
+	}
+
+	return name, nil
+}
+
+func openStoredName(header *EncryptedFileHeader, keyMaterial []byte) (string, error) {
+	suite, err := cipherSuiteForHeader(header)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := header.SealedName
+
+	name, err := decryptBlob(suite.Cipher, suite.Mode, &sealed, keyMaterial, storedNameAdditionalData(header.FileID))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAuthenticationFailed, err)
+	}
+
+	return string(*name), nil
+}
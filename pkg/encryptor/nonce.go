@@ -0,0 +1,75 @@
+package encryptor
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+	Chunk nonces were random from end to end, so every file encrypted with
+	one key (a key file, a password's key is salted per file) drew from a
+	single flat space of 2^96 AES-GCM nonces, and the 2^32 seal limit in
+	encryptBlobAESGCM256 was shared by all of them. Now each file has a
+	random nonce prefix in its header, and each chunk's nonce is the
+	prefix followed by the chunk's ID
+
+		prefix (8 bytes) | chunk ID (4 bytes, big endian) | random, for longer nonces
+
+	Within a file no two chunks can share a nonce, and files with the same
+	key only share nonces when their prefixes collide - 64 random bits, so
+	not before billions of files. Chunk IDs are a uint32, as many as the
+	seal limit allows. Everything else sealed with the file's key (the
+	plaintext digest, a stored name, media verification progress, which
+	is sealed again and again) takes a nonce random throughout, with no
+	prefix, so it never lands on a chunk's
+
+	Files written earlier with NonceSchemePrefixRandom have a 4
+	byte prefix and 8 random bytes - too few for a file of billions of
+	chunks. Nonces are stored whole in front of each chunk and a reader
+	opens a chunk the same way whatever the scheme, so the format version
+	is not raised and older readers read either as they are. NonceScheme
+	names the scheme, empty for random nonces
+*/
+
+const NonceSchemePrefixRandom = "PREFIX-RANDOM"
+const NonceSchemePrefixCounter = "PREFIX-COUNTER"
+
+const NoncePrefixSize = 8
+const NonceCounterSize = 4
+
+func newNoncePrefix() ([]byte, error) {
+	prefix := make([]byte, NoncePrefixSize)
+	if err := readRandom(prefix); err != nil {
+		return nil, fmt.Errorf("internal crypto error generating nonce prefix: %w", err)
+	}
+
+	return prefix, nil
+}
+
+// What a chunk's nonce starts with, nil without a prefix so the nonce is random throughout
+func chunkNonceStart(prefix []byte, chunkID uint32) []byte {
+	if len(prefix) == 0 {
+		return nil
+	}
+
+	start := make([]byte, len(prefix)+NonceCounterSize)
+	binary.BigEndian.PutUint32(start[copy(start, prefix):], chunkID)
+
+	return start
+}
+
+// Starts with start (see chunkNonceStart) and is random after it, with room for the sealed data as Seal appends to it
+func newChunkNonce(start []byte, nonceSize int, sealedSize int) ([]byte, error) {
+	if len(start) > nonceSize {
+		return nil, fmt.Errorf("internal crypto error: %d byte nonces have no room for %d fixed bytes", nonceSize, len(start))
+	}
+
+	nonce := make([]byte, nonceSize, nonceSize+sealedSize)
+	random := nonce[copy(nonce, start):]
+
+	if err := readRandom(random); err != nil {
+		return nil, fmt.Errorf("internal crypto error generating random data: %w", err)
+	}
+
+	return nonce, nil
+}
@@ -0,0 +1,170 @@
+package encryptor
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+/*
+	What objects in cloud storage have in common, gs:// (see gcs.go) and
+	az:// (see azureblob.go) alike, with files on HTTP servers (see
+	httpsource.go) read the same way. They are read and written as
+	streams - the concurrent pipeline wants a file it can stat and seek -
+	but a stream read from an object is fed by ranged reads of
+	Options.PartSizeMB each, Options.Readers of them in flight at once,
+	handed on in order as the chunks they hold are wanted
+*/
+
+// A variable so tests do not wait to retry
+var objectRetryDelay = time.Second
+
+// Transient failures are tried again this many times, the delay doubling each time
+const objectRetries = 5
+
+// A range or part per request, unlike key service requests they can take minutes
+var objectHTTPClient = &http.Client{Timeout: 10 * time.Minute}
+
+// Sends what newRequest makes until the answer is worth keeping, anything but a dropped connection, 429, or 5xx
+func objectRequest(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	delay := objectRetryDelay
+
+	for try := 0; ; try++ {
+		request, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := objectHTTPClient.Do(request)
+		if (err == nil && !objectTransient(response.StatusCode)) || try == objectRetries {
+			return response, err
+		}
+
+		if err == nil {
+			_ = response.Body.Close()
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func objectTransient(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// An object read as a stream, fetch reads bytes [start, end) of it
+type rangedReader struct {
+	size       int64
+	rangeBytes int64
+	window     int
+	fetch      func(start int64, end int64) ([]byte, error)
+	next       int64 // Where the next range to fetch starts
+	pending    []*objectRange
+	buffer     []byte
+	err        error
+}
+
+type objectRange struct {
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+func newRangedReader(size int64, options *Options, fetch func(start int64, end int64) ([]byte, error)) rangedReader {
+	window := int(options.Readers)
+	if window < 1 {
+		window = int(DefaultReaders())
+	}
+
+	return rangedReader{
+		size:       size,
+		rangeBytes: bytesFromMB(objectPartSizeMB(options)),
+		window:     window,
+		fetch:      fetch,
+	}
+}
+
+func objectPartSizeMB(options *Options) uint {
+	if options.PartSizeMB == 0 {
+		return DefaultPartSizeMB
+	}
+
+	return options.PartSizeMB
+}
+
+func (reader *rangedReader) Size() int64 {
+	return reader.size
+}
+
+func (reader *rangedReader) Read(p []byte) (int, error) {
+	for len(reader.buffer) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+
+		reader.fetchAhead()
+
+		if len(reader.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		next := reader.pending[0]
+		reader.pending = reader.pending[1:]
+
+		<-next.done
+		reader.buffer, reader.err = next.data, next.err
+	}
+
+	n := copy(p, reader.buffer)
+	reader.buffer = reader.buffer[n:]
+
+	return n, nil
+}
+
+// Keeps the window full, each range fetched on its own goroutine
+func (reader *rangedReader) fetchAhead() {
+	for len(reader.pending) < reader.window && reader.next < reader.size {
+		start, end := reader.next, reader.next+reader.rangeBytes
+		if end > reader.size {
+			end = reader.size
+		}
+
+		fetch := &objectRange{done: make(chan struct{})}
+
+		go func() {
+			defer close(fetch.done)
+			fetch.data, fetch.err = reader.fetch(start, end)
+		}()
+
+		reader.pending = append(reader.pending, fetch)
+		reader.next = end
+	}
+}
+
+// The header of an object, read with a single range ahead
+func peekObjectHeader(objectURL string) *EncryptedFileHeader {
+	options := &Options{Readers: 1, PartSizeMB: 1}
+
+	var reader io.Reader
+	var err error
+
+	if isAzureBlobURL(objectURL) {
+		reader, err = newAzureBlobReader(objectURL, options)
+	} else if isHTTPURL(objectURL) {
+		reader, err = newHTTPReader(objectURL, options)
+	} else {
+		reader, err = newGCSReader(objectURL, options)
+	}
+
+	if err != nil {
+		return nil
+	}
+
+	header, _, err := readEncryptedFileHeader(reader)
+	if err != nil {
+		return nil
+	}
+
+	return &header
+}
@@ -0,0 +1,52 @@
+package encryptor
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	Air-gapped machines need more than a promise that nothing phones home,
+	so Options.Offline is enforced: anything that could touch the network
+	is refused with ErrOffline before any work starts, never attempted and
+	left to time out. There are no update checks or telemetry to disable,
+	what could reach the network is
+
+		- recipients files given as https:// URLs, cached copies included
+		- gpg, which asks dirmngr to find keys missing from the keyring -
+		  offline it is run with dirmngr disabled instead of refused
+		- Cloud KMS keys, for encrypting and for gcp-kms stanzas when
+		  decrypting
+		- Azure Key Vault keys, likewise for azure-key-vault stanzas
+		- gs:// objects, refused as they are opened by NewGCSReader and
+		  NewGCSWriter (the command line refuses them up front)
+		- Azure blobs, likewise refused by NewAzureBlobReader and
+		  NewAzureBlobWriter
+		- http:// and https:// sources, refused by NewHTTPReader
+
+	Release manifests fetched by verify-binary and self-update are refused
+	by the command line, the library's VerifyRelease is given the manifest
+	by its caller. InstallReleaseBinary refuses to download a binary
+*/
+
+func checkOffline(options *Options) error {
+	if options == nil || !options.Offline {
+		return nil
+	}
+
+	for _, recipientsFile := range options.RecipientsFiles {
+		if isRecipientsURL(strings.TrimSpace(recipientsFile)) {
+			return fmt.Errorf("recipients file %s is fetched over the network: %w", recipientsFile, ErrOffline)
+		}
+	}
+
+	if len(options.GCPKMSKeys) > 0 {
+		return fmt.Errorf("Cloud KMS key %s is reached over the network: %w", options.GCPKMSKeys[0], ErrOffline)
+	}
+
+	if len(options.AzureKeyVaultKeys) > 0 {
+		return fmt.Errorf("Key Vault key %s is reached over the network: %w", options.AzureKeyVaultKeys[0], ErrOffline)
+	}
+
+	return nil
+}
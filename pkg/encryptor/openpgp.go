@@ -0,0 +1,225 @@
+package encryptor
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	openpgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+	"io"
+	"os"
+)
+
+/*
+	For recipients who only have gpg, a file can be written as an OpenPGP
+	password encrypted message (gpg --symmetric) instead of in our own
+	format, and messages gpg wrote can be read back. These are whole file
+	messages - no chunks, no concurrency, no footer - so they are for
+	handing a file to someone else, not for archives
+
+	Messages are written as gpg writes them by default: AES-256 with the
+	password hashed by the iterated and salted S2K (SHA-256), inside an
+	integrity protected (SEIPD) packet. Reading refuses messages without
+	integrity protection, which anyone could have changed undetected
+
+	The integrity check is at the end of the message, so the plaintext
+	can only be trusted once all of it has been read without an error -
+	callers writing it somewhere should throw it away if one is returned
+*/
+
+// The most iterations the S2K can express, gpg's own default is close to it
+const openPGPS2KCount = 65011712
+
+/*
+	The S2K count is a number of bytes hashed, the salt (8 bytes) and the
+	password over and over, so how many times the password is hashed -
+	the iterations a policy asks for - depends on how long it is
+*/
+func openPGPS2KIterations(password string) int {
+	iterations := openPGPS2KCount / (8 + len(password))
+	if iterations < 1 {
+		iterations = 1
+	}
+
+	return iterations
+}
+
+var openPGPConfig = &packet.Config{
+	DefaultCipher: packet.CipherAES256,
+	DefaultHash:   crypto.SHA256,
+	S2KCount:      openPGPS2KCount,
+}
+
+func checkOpenPGPOptions(options *Options) error {
+	if options == nil {
+		return errors.New("options is nil")
+	}
+
+	if fipsEnabled(options) {
+		return errors.New("FIPS mode: OpenPGP messages use CFB mode and a SHA-1 integrity check and are not allowed")
+	}
+
+	if options.KeyHex != "" || len(options.GPGRecipients) > 0 || len(options.SSHRecipients) > 0 || len(options.RecipientsFiles) > 0 || len(options.X25519Recipients) > 0 || len(options.RSARecipients) > 0 || len(options.GCPKMSKeys) > 0 || len(options.AzureKeyVaultKeys) > 0 || len(options.PKCS11Keys) > 0 || options.TPMSeal || len(options.PluginRecipients) > 0 {
+		return errors.New("OpenPGP messages are encrypted with a password, not a key or recipients")
+	}
+
+	if options.Password == "" {
+		return errors.New("a password is needed to encrypt or decrypt an OpenPGP message")
+	}
+
+	return nil
+}
+
+func encryptOpenPGP(source io.Reader, target io.Writer, options *Options) error {
+	if source == nil || target == nil {
+		return errors.New("source or target is nil")
+	}
+
+	err := checkOpenPGPOptions(options)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := openpgp.SymmetricallyEncrypt(target, []byte(options.Password), &openpgp.FileHints{IsBinary: true}, openPGPConfig)
+	if err != nil {
+		return fmt.Errorf("could not start OpenPGP message: %w", err)
+	}
+
+	_, err = io.Copy(plaintext, source)
+	if err != nil {
+		return fmt.Errorf("could not write OpenPGP message: %w", err)
+	}
+
+	err = plaintext.Close()
+	if err != nil {
+		return fmt.Errorf("could not finish OpenPGP message: %w", err)
+	}
+
+	return nil
+}
+
+func decryptOpenPGP(source io.Reader, target io.Writer, options *Options) error {
+	if source == nil || target == nil {
+		return errors.New("source or target is nil")
+	}
+
+	err := checkOpenPGPOptions(options)
+	if err != nil {
+		return err
+	}
+
+	packets := packet.NewReader(source)
+
+	// Password stanzas come first, then the encrypted data they unlock
+	var keys []*packet.SymmetricKeyEncrypted
+	var encrypted *packet.SymmetricallyEncrypted
+
+	for encrypted == nil {
+		p, err := packets.Next()
+		if err != nil {
+			return fmt.Errorf("%w, could not read an OpenPGP message: %v", ErrNotEncryptedFile, err)
+		}
+
+		switch p := p.(type) {
+		case *packet.SymmetricKeyEncrypted:
+			keys = append(keys, p)
+		case *packet.EncryptedKey:
+			// Also encrypted to a public key, the password stanzas may still open it
+		case *packet.SymmetricallyEncrypted:
+			encrypted = p
+		default:
+			return fmt.Errorf("%w, it is not an encrypted OpenPGP message", ErrNotEncryptedFile)
+		}
+	}
+
+	if len(keys) == 0 {
+		return errors.New("the OpenPGP message is encrypted to public keys only, decrypt it with gpg")
+	}
+
+	if !encrypted.MDC {
+		return errors.New("the OpenPGP message has no integrity protection, anyone could have changed it, it will not be decrypted")
+	}
+
+	var decrypted io.ReadCloser
+	for _, key := range keys {
+		sessionKey, cipherFunction, err := key.Decrypt([]byte(options.Password))
+		if err != nil {
+			continue
+		}
+
+		decrypted, err = encrypted.Decrypt(cipherFunction, sessionKey)
+		if err == nil {
+			break
+		}
+
+		if err != openpgperrors.ErrKeyIncorrect {
+			return fmt.Errorf("could not decrypt the OpenPGP message: %w", err)
+		}
+	}
+
+	if decrypted == nil {
+		return fmt.Errorf("%w, the password does not open the OpenPGP message", ErrAuthenticationFailed)
+	}
+
+	err = packets.Push(decrypted)
+	if err != nil {
+		return fmt.Errorf("could not read the OpenPGP message: %w", err)
+	}
+
+	// gpg compresses by default, and signatures over the data are skipped (they are not checked)
+	var literal *packet.LiteralData
+	for literal == nil {
+		p, err := packets.Next()
+		if err != nil {
+			return fmt.Errorf("%w, could not read the OpenPGP message: %v", ErrFileCorrupt, err)
+		}
+
+		switch p := p.(type) {
+		case *packet.Compressed:
+			err = packets.Push(p.Body)
+			if err != nil {
+				return fmt.Errorf("could not read the OpenPGP message: %w", err)
+			}
+		case *packet.LiteralData:
+			literal = p
+		}
+	}
+
+	_, err = io.Copy(target, literal.Body)
+	if err != nil {
+		return fmt.Errorf("could not decrypt the OpenPGP message: %w", err)
+	}
+
+	// Closing reads the rest of the message and checks its integrity
+	err = decrypted.Close()
+	if err != nil {
+		return fmt.Errorf("%w, the OpenPGP message failed its integrity check: %v", ErrFileCorrupt, err)
+	}
+
+	return nil
+}
+
+// Does the file start like an encrypted OpenPGP message (binary, not armored)?
+func isOpenPGPMessage(fileName string) bool {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	p, err := packet.Read(file)
+	if err != nil {
+		return false
+	}
+
+	switch p.(type) {
+	case *packet.SymmetricKeyEncrypted, *packet.EncryptedKey:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,121 @@
+package encryptor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Options.MaxOutputBytes bounds what a job writes, for destinations with
+	a quota and as a safety net for automated jobs pointed at the wrong
+	(huge) source. A file job knows exactly how large its target will be
+	once its header is built - the header, every chunk with its overhead,
+	and whatever follows the chunks, or the plaintext the header describes
+	when decrypting - so one that would go over fails with
+	ErrOutputTooLarge before the target is created, and nothing needs
+	cleaning up. Streams cannot know in advance, so they fail as the write
+	that would go over is attempted, leaving what was written to the
+	caller to remove (the command line removes a target file)
+
+	Decrypting, the same exact size is checked against the free space of
+	the target's filesystem where it can be looked up (see
+	freespace_linux.go), so a disk too small fails with
+	ErrInsufficientSpace before hours of decryption rather than at the
+	last chunk. A target being overwritten gives its space back
+*/
+
+// A size in bytes, or with a KB, MB, GB, or TB suffix (powers of 1024, the B may be left off)
+func parseByteSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+
+	multiplier := int64(1)
+	for suffix, unit := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = unit
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "B")), 64)
+	if err != nil || number < 0 || number*float64(multiplier) >= 1<<63 {
+		return 0, fmt.Errorf("size %q is not a number of bytes, e.g. 500MB or 2TB", size)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
+
+func checkOutputSize(outputBytes int64, maxOutputBytes int64) error {
+	if maxOutputBytes > 0 && outputBytes > maxOutputBytes {
+		return fmt.Errorf("%w, it would be %d bytes and the limit is %d", ErrOutputTooLarge, outputBytes, maxOutputBytes)
+	}
+
+	return nil
+}
+
+// The size of a file job's target, header is the job's - built when encrypting, read from the source when decrypting
+func pipelineOutputBytes(job *pipelineJob, header *EncryptedFileHeader, numChunks uint32, sourceSizeBytes int64, endOfHeader int) (int64, error) {
+	chunksOverheadBytes := int64(numChunks) * chunkOverheadBytes(header)
+
+	if job.Operation == Decryption {
+		payloadBytes := sourceSizeBytes - int64(endOfHeader) - footerSizeBytes(header) - signatureSizeBytes(header) - headerCopySizeBytes(header, endOfHeader)
+		return plaintextSizeBytes(header, payloadBytes, numChunks)
+	}
+
+	headerBytes, err := getCompleteEncryptedFileHeaderAsBytes(header)
+	if err != nil {
+		return 0, fmt.Errorf("failed to assemble encrypted file header: %w", err)
+	}
+
+	return int64(len(headerBytes)) + sourceSizeBytes + chunksOverheadBytes + footerSizeBytes(header) + signatureSizeBytes(header) + headerCopySizeBytes(header, len(headerBytes)), nil
+}
+
+// Fails any write that would take what was written past maxBytes, writing none of it
+type outputLimitWriter struct {
+	target   io.Writer
+	written  int64
+	maxBytes int64
+}
+
+func newOutputLimitWriter(target io.Writer, maxBytes int64) io.Writer {
+	if maxBytes <= 0 {
+		return target
+	}
+
+	return &outputLimitWriter{target: target, maxBytes: maxBytes}
+}
+
+func (writer *outputLimitWriter) Write(data []byte) (int, error) {
+	err := checkOutputSize(writer.written+int64(len(data)), writer.maxBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := writer.target.Write(data)
+	writer.written += int64(written)
+
+	return written, err
+}
+
+func checkFreeSpace(targetFilename string, outputBytes int64) error {
+	directory := filepath.Dir(targetFilename)
+
+	freeBytes, ok := freeSpaceBytes(directory)
+	if !ok {
+		return nil
+	}
+
+	if stats, err := os.Stat(targetFilename); err == nil && stats.Mode().IsRegular() {
+		freeBytes += stats.Size()
+	}
+
+	if outputBytes > freeBytes {
+		return fmt.Errorf("%w, %s needs %d bytes and %s has %d free", ErrInsufficientSpace, targetFilename, outputBytes, directory, freeBytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	RSA keys held in an HSM or smartcard as recipients, reached through
+	PKCS#11. As with gpg, the token is driven by a binary (OpenSC's
+	pkcs11-tool) rather than by loading a module into this process - we
+	stay free of cgo, and the private key never leaves the token
+
+	A key is named by an RFC 7512 URI, or by its label alone
+
+		pkcs11:token=<token label>;object=<key label>;id=%01
+		backup-key
+
+	The file key is encrypted locally with RSA-OAEP (SHA-256, MGF1-SHA256)
+	to the key's public half, read from the token without logging in, and
+	the stanza holds the URI (token, object and id only) and the key's
+	fingerprint as for rsa-oaep. Decrypting logs in to the token named by
+	the stanza and has it decrypt (CKM_RSA_PKCS_OAEP, without a label, as
+	pkcs11-tool cannot give one)
+
+	The module to load is never taken from a file - a header naming a
+	shared library would have us load whatever it names - it is
+	Options.PKCS11Module, or the module-path of a URI given when
+	encrypting, or else pkcs11-tool's default (OpenSC's own module). The
+	PIN reaches pkcs11-tool through its environment, never its command
+	line, and no PIN at all leaves a PIN pad reader to ask for it
+*/
+
+const RecipientTypePKCS11 = "pkcs11"
+
+// A variable so tests can stand in for the token
+var pkcs11ToolBinary = "pkcs11-tool"
+
+// pkcs11-tool reads the PIN from this variable of its environment (--pin env:...)
+const pkcs11PINVariable = "ENCRYPTOR_PKCS11_PIN"
+
+type pkcs11Key struct {
+	token  string // Token label, empty for the first token with the key
+	object string // Key label
+	id     []byte // CKA_ID
+	module string // Only from the command line, never from a stanza
+}
+
+func parsePKCS11Key(key string) (pkcs11Key, error) {
+	key = strings.TrimSpace(key)
+
+	if !strings.HasPrefix(key, "pkcs11:") {
+		if key == "" {
+			return pkcs11Key{}, errors.New("empty PKCS#11 key")
+		}
+
+		return pkcs11Key{object: key}, nil
+	}
+
+	path, query := strings.TrimPrefix(key, "pkcs11:"), ""
+	if separator := strings.Index(path, "?"); separator >= 0 {
+		path, query = path[:separator], path[separator+1:]
+	}
+
+	var parsed pkcs11Key
+
+	for _, attribute := range strings.Split(path, ";") {
+		if attribute == "" {
+			continue
+		}
+
+		name, value, err := splitPKCS11Attribute(attribute)
+		if err != nil {
+			return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q: %w", key, err)
+		}
+
+		switch name {
+		case "token":
+			parsed.token = value
+		case "object":
+			parsed.object = value
+		case "id":
+			parsed.id = []byte(value)
+		case "type":
+			if value != "private" && value != "public" {
+				return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q names a %s object, not a key", key, value)
+			}
+		default:
+			return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q: %s is not supported, name the key by token, object, and id", key, name)
+		}
+	}
+
+	for _, attribute := range strings.Split(query, "&") {
+		if attribute == "" {
+			continue
+		}
+
+		name, value, err := splitPKCS11Attribute(attribute)
+		if err != nil {
+			return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q: %w", key, err)
+		}
+
+		switch name {
+		case "module-path":
+			parsed.module = value
+		case "pin-value", "pin-source":
+			return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q: give the PIN in %s rather than the URI", key, pkcs11PINVariable)
+		default:
+			return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q: %s is not supported", key, name)
+		}
+	}
+
+	if parsed.object == "" && len(parsed.id) == 0 {
+		return pkcs11Key{}, fmt.Errorf("PKCS#11 URI %q names no key, give its object or id", key)
+	}
+
+	return parsed, nil
+}
+
+func splitPKCS11Attribute(attribute string) (string, string, error) {
+	separator := strings.Index(attribute, "=")
+	if separator <= 0 {
+		return "", "", fmt.Errorf("%q is not an attribute=value pair", attribute)
+	}
+
+	value, err := url.PathUnescape(attribute[separator+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("%q is not percent encoded correctly", attribute)
+	}
+
+	return attribute[:separator], value, nil
+}
+
+// The URI a stanza keeps, without the module
+func (key pkcs11Key) String() string {
+	var attributes []string
+
+	if key.token != "" {
+		attributes = append(attributes, "token="+escapePKCS11Value(key.token))
+	}
+
+	if key.object != "" {
+		attributes = append(attributes, "object="+escapePKCS11Value(key.object))
+	}
+
+	if len(key.id) > 0 {
+		var id strings.Builder
+		for _, b := range key.id {
+			_, _ = fmt.Fprintf(&id, "%%%02x", b)
+		}
+
+		attributes = append(attributes, "id="+id.String())
+	}
+
+	return "pkcs11:" + strings.Join(attributes, ";")
+}
+
+// Stanza arguments are separated by spaces, so spaces are escaped too (as are ; and ?)
+func escapePKCS11Value(value string) string {
+	return url.PathEscape(value)
+}
+
+// Which key (and token) pkcs11-tool is to use
+func (key pkcs11Key) toolArgs(module string) []string {
+	var args []string
+
+	if key.module != "" {
+		module = key.module
+	}
+
+	if module != "" {
+		args = append(args, "--module", module)
+	}
+
+	if key.token != "" {
+		args = append(args, "--token-label", key.token)
+	}
+
+	if key.object != "" {
+		args = append(args, "--label", key.object)
+	}
+
+	if len(key.id) > 0 {
+		args = append(args, "--id", hex.EncodeToString(key.id))
+	}
+
+	return args
+}
+
+func wrapFileKeyPKCS11(fileKey []byte, key pkcs11Key, module string) (RecipientStanza, error) {
+	publicKey, err := readPKCS11PublicKey(key, module)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not read PKCS#11 key %s: %w", key, err)
+	}
+
+	fingerprint, err := rsaKeyFingerprint(publicKey)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	body, err := rsa.EncryptOAEP(sha256.New(), randomReader, publicKey, fileKey, nil)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not wrap file key with PKCS#11 key %s: %w", key, err)
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypePKCS11,
+		Args: []string{key.String(), fingerprint},
+		Body: base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+// The key's public object, or its certificate for tokens that keep no public key object
+func readPKCS11PublicKey(key pkcs11Key, module string) (*rsa.PublicKey, error) {
+	var der []byte
+	var err error
+
+	for _, objectType := range []string{"pubkey", "cert"} {
+		der, err = runPKCS11Tool(nil, "", append(key.toolArgs(module), "--read-object", "--type", objectType)...)
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed interface{}
+
+	if parsed, err = x509.ParsePKIXPublicKey(der); err != nil {
+		if parsed, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			parsed, err = parseRSACertificateKey(der)
+		}
+	}
+
+	if err != nil {
+		return nil, errors.New("the token returned no public key or certificate we could parse")
+	}
+
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+
+	if publicKey.N.BitLen() < rsaMinimumKeyBits {
+		return nil, fmt.Errorf("a %d bit key, at least %d bits are needed", publicKey.N.BitLen(), rsaMinimumKeyBits)
+	}
+
+	return publicKey, nil
+}
+
+func unwrapFileKeyPKCS11(stanza RecipientStanza, module string, pin string) ([]byte, error) {
+	if len(stanza.Args) != 2 {
+		return nil, errors.New("malformed PKCS#11 stanza")
+	}
+
+	key, err := parsePKCS11Key(stanza.Args[0])
+	if err != nil || key.module != "" || !strings.HasPrefix(stanza.Args[0], "pkcs11:") {
+		return nil, errors.New("malformed PKCS#11 stanza URI")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PKCS#11 stanza: %w", err)
+	}
+
+	args := append(key.toolArgs(module), "--login", "--decrypt", "--mechanism", "RSA-PKCS-OAEP", "--hash-algorithm", "SHA256", "--mgf", "MGF1-SHA256")
+
+	return runPKCS11Tool(body, pin, args...)
+}
+
+// Input and output go through files in a private directory, pkcs11-tool talks to the terminal on stdout
+func runPKCS11Tool(input []byte, pin string, args ...string) ([]byte, error) {
+	directory, err := createTempDir("pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = os.RemoveAll(directory)
+	}()
+
+	outputName := filepath.Join(directory, "output")
+	args = append(args, "--output-file", outputName)
+
+	if input != nil {
+		inputName := filepath.Join(directory, "input")
+
+		err = os.WriteFile(inputName, input, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("could not write temporary file: %w", err)
+		}
+
+		args = append(args, "--input-file", inputName)
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(pkcs11ToolBinary, args...)
+	cmd.Stderr = &stderr
+
+	if pin != "" {
+		cmd.Args = append(cmd.Args, "--pin", "env:"+pkcs11PINVariable)
+		cmd.Env = append(os.Environ(), pkcs11PINVariable+"="+pin)
+	}
+
+	err = cmd.Run()
+	if err != nil {
+		detail := strings.TrimSpace(stderr.String())
+		if detail != "" {
+			return nil, fmt.Errorf("%w: %s", err, detail)
+		}
+
+		return nil, err
+	}
+
+	output, err := os.ReadFile(outputName)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11-tool wrote no output: %w", err)
+	}
+
+	return output, nil
+}
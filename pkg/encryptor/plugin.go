@@ -0,0 +1,553 @@
+package encryptor
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Plugins add ciphers and key providers without a new build of
+	encryptor. The plugin named name is a binary, encryptor-plugin-name,
+	found on the PATH and started with --encryptor-plugin=1 the first
+	time one of its ciphers or recipients is wanted. It is asked things on
+	its stdin and answers on its stdout, its stderr is passed through, and
+	it runs until encryptor exits and its stdin closes
+
+	Both directions are framed like age's stanzas, a line of a command
+	and its arguments and then a body, unpadded base64 wrapped at 64
+	columns and ended by a shorter line (an empty one if need be)
+
+		-> command arg arg
+		body
+
+	Byte arguments are unpadded base64 too, - when empty. encryptor says
+	"-> hello 1" and the plugin declares what it has, then "-> done"
+
+		-> cipher <name> <key bits> <nonce bytes> <tag bytes>
+		-> recipients
+
+	after which encryptor asks one thing at a time, and the plugin
+	answers "-> ok" with a body, "-> fail" when the key does not open the
+	data or the stanza, or "-> error" with a message as the body
+
+		-> seal <cipher> <key> <nonce> <additional data>   the plaintext, ok with ciphertext and tag
+		-> open <cipher> <key> <nonce> <additional data>   ciphertext and tag, ok with the plaintext
+		-> wrap <recipient>                                the file key, ok <args...> with the stanza's body
+		-> unwrap <args...>                                the stanza's body, ok with the file key
+
+	A cipher is <plugin>:<cipher> (e.g. --cipher=hsm:aes-ocb) and is
+	recorded in the header as Algorithm plugin:<plugin> and Mode <cipher>.
+	Its chunks are laid out like every other cipher's, the nonce encryptor
+	chose (see newChunkNonce) and then what seal returned, so the nonce
+	and tag it declares are its whole overhead. It takes 256 bit keys,
+	the file key or the key derived from a password, and its nonces must
+	have room for the nonce prefix and a chunk ID
+
+	A recipient is <plugin>:<recipient> (Options.PluginRecipients,
+	--plugin-recipient), stored as a plugin stanza whose first argument is
+	the plugin's name and the rest what wrap answered with. Decrypting
+	needs no flag, the stanza names the plugin to unwrap it
+
+	Neither is FIPS approved, what a plugin does is outside our control
+*/
+
+const RecipientTypePlugin = "plugin"
+
+const pluginBinaryPrefix = "encryptor-plugin-"
+const pluginProtocolVersion = "1"
+const pluginAlgorithmPrefix = "plugin:"
+
+// Plugin ciphers' modes count up from here, clear of the built-in modes
+const pluginModeBase CipherModeEnum = 128
+
+// Frames start with this, bodies are wrapped at this many columns
+const pluginFramePrefix = "->"
+const pluginColumns = 64
+
+// A body holds at most a whole chunk, its tag, and then some
+var maximumPluginBodyBytes = int(bytesFromMB(ChunkSizeMax)) + 64*1024
+
+var errPluginFailed = errors.New("the plugin could not open it with this key")
+
+type plugin struct {
+	name       string
+	mutex      sync.Mutex
+	writer     *bufio.Writer
+	reader     *bufio.Reader
+	recipients bool
+	err        error // Once the plugin breaks the protocol or exits every request fails with this
+}
+
+type pluginCipher struct {
+	plugin *plugin
+	name   string
+	suite  cipherSuite
+}
+
+// Every plugin started by this process, and the ciphers they declared
+var plugins = struct {
+	mutex   sync.Mutex
+	running map[string]*plugin
+	ciphers []pluginCipher // Indexed by mode - pluginModeBase
+}{running: map[string]*plugin{}}
+
+type pluginFrame struct {
+	command string
+	args    []string
+	body    []byte
+}
+
+func validPluginName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Splits <plugin>:<rest>, both must be there
+func splitPluginName(value string) (string, string, error) {
+	value = strings.TrimSpace(value)
+
+	colon := strings.Index(value, ":")
+	if colon < 0 || colon == len(value)-1 || !validPluginName(value[:colon]) {
+		return "", "", fmt.Errorf("%q is not <plugin>:<name>, plugin names are lowercase letters, digits, and -", value)
+	}
+
+	return value[:colon], value[colon+1:], nil
+}
+
+// The running plugin, started and asked what it has the first time
+func startPlugin(name string) (*plugin, error) {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+
+	if running, ok := plugins.running[name]; ok {
+		return running, running.err
+	}
+
+	started := &plugin{name: name}
+	started.err = started.start()
+	plugins.running[name] = started
+
+	return started, started.err
+}
+
+// Called with plugins.mutex held
+func (p *plugin) start() error {
+	path, err := exec.LookPath(pluginBinaryPrefix + p.name)
+	if err != nil {
+		return fmt.Errorf("plugin %s is not installed: %w", p.name, err)
+	}
+
+	cmd := exec.Command(path, "--encryptor-plugin="+pluginProtocolVersion)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("plugin %s could not be started: %w", p.name, err)
+	}
+
+	p.writer = bufio.NewWriter(stdin)
+	p.reader = bufio.NewReader(stdout)
+
+	if err := writePluginFrame(p.writer, pluginFrame{command: "hello", args: []string{pluginProtocolVersion}}); err != nil {
+		return fmt.Errorf("plugin %s did not say hello: %w", p.name, err)
+	}
+
+	var declared []pluginCipher
+
+	for {
+		frame, err := readPluginFrame(p.reader)
+		if err != nil {
+			return fmt.Errorf("plugin %s did not say what it has: %w", p.name, err)
+		}
+
+		switch frame.command {
+		case "cipher":
+			cipher, err := p.declareCipher(frame.args, CipherModeEnum(int(pluginModeBase)+len(plugins.ciphers)+len(declared)))
+			if err != nil {
+				return fmt.Errorf("plugin %s: %w", p.name, err)
+			}
+
+			declared = append(declared, cipher)
+		case "recipients":
+			p.recipients = true
+		case "error":
+			return fmt.Errorf("plugin %s: %s", p.name, strings.TrimSpace(string(frame.body)))
+		case "done":
+			if int(pluginModeBase)+len(plugins.ciphers)+len(declared) > 255 {
+				return fmt.Errorf("plugin %s declares more ciphers than there are modes for", p.name)
+			}
+
+			plugins.ciphers = append(plugins.ciphers, declared...)
+			return nil
+		}
+
+		// Anything else is from a later version of the protocol, and is not for us
+	}
+}
+
+func (p *plugin) declareCipher(args []string, mode CipherModeEnum) (pluginCipher, error) {
+	if len(args) != 4 || strings.ContainsAny(args[0], ": ") {
+		return pluginCipher{}, fmt.Errorf("%q is not cipher <name> <key bits> <nonce bytes> <tag bytes>", strings.Join(args, " "))
+	}
+
+	var sizes [3]int
+	for i, arg := range args[1:] {
+		size, err := strconv.Atoi(arg)
+		if err != nil || size < 0 || size > 1024 {
+			return pluginCipher{}, fmt.Errorf("cipher %s has a size %q that is not a number from 0 to 1024", args[0], arg)
+		}
+
+		sizes[i] = size
+	}
+
+	if sizes[0] != 8*FileKeySize {
+		return pluginCipher{}, fmt.Errorf("cipher %s takes %d bit keys, only %d bit keys are given", args[0], sizes[0], 8*FileKeySize)
+	}
+
+	if sizes[1] < NoncePrefixSize+NonceCounterSize {
+		return pluginCipher{}, fmt.Errorf("cipher %s has %d byte nonces, at least %d are needed for a prefix and a chunk ID", args[0], sizes[1], NoncePrefixSize+NonceCounterSize)
+	}
+
+	if sizes[2] < 12 {
+		return pluginCipher{}, fmt.Errorf("cipher %s has a %d byte tag, at least 12 are needed to authenticate a chunk", args[0], sizes[2])
+	}
+
+	return pluginCipher{
+		plugin: p,
+		name:   args[0],
+		suite: cipherSuite{
+			Name:      p.name + ":" + args[0],
+			Cipher:    Plugin,
+			Mode:      mode,
+			Algorithm: pluginAlgorithmPrefix + p.name,
+			ModeName:  args[0],
+			KeySize:   sizes[0],
+			NonceSize: uint(sizes[1]),
+			TagSize:   uint(sizes[2]),
+		},
+	}, nil
+}
+
+// Asks the plugin one thing, a fail answer is errPluginFailed
+func (p *plugin) request(command string, args []string, body []byte) (pluginFrame, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.err != nil {
+		return pluginFrame{}, p.err
+	}
+
+	err := writePluginFrame(p.writer, pluginFrame{command: command, args: args, body: body})
+
+	var answer pluginFrame
+	if err == nil {
+		answer, err = readPluginFrame(p.reader)
+	}
+
+	if err != nil {
+		p.err = fmt.Errorf("plugin %s stopped answering: %w", p.name, err)
+		return pluginFrame{}, p.err
+	}
+
+	switch answer.command {
+	case "ok":
+		return answer, nil
+	case "fail":
+		return answer, errPluginFailed
+	case "error":
+		return answer, fmt.Errorf("plugin %s: %s", p.name, strings.TrimSpace(string(answer.body)))
+	}
+
+	p.err = fmt.Errorf("plugin %s answered %s %s, not ok, fail, or error", p.name, pluginFramePrefix, answer.command)
+	return pluginFrame{}, p.err
+}
+
+func writePluginFrame(writer *bufio.Writer, frame pluginFrame) error {
+	_, _ = writer.WriteString(pluginFramePrefix + " " + strings.Join(append([]string{frame.command}, frame.args...), " ") + "\n")
+
+	body := base64.RawStdEncoding.EncodeToString(frame.body)
+	for len(body) >= pluginColumns {
+		_, _ = writer.WriteString(body[:pluginColumns] + "\n")
+		body = body[pluginColumns:]
+	}
+
+	_, _ = writer.WriteString(body + "\n")
+
+	return writer.Flush()
+}
+
+func readPluginFrame(reader *bufio.Reader) (pluginFrame, error) {
+	line, err := readPluginLine(reader)
+	if err != nil {
+		return pluginFrame{}, err
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, pluginFramePrefix+" "))
+	if !strings.HasPrefix(line, pluginFramePrefix+" ") || len(fields) == 0 {
+		return pluginFrame{}, fmt.Errorf("%q is not a frame", line)
+	}
+
+	var body strings.Builder
+	for {
+		line, err := readPluginLine(reader)
+		if err != nil {
+			return pluginFrame{}, err
+		}
+
+		if len(line) > pluginColumns {
+			return pluginFrame{}, fmt.Errorf("a body line of %d characters is longer than %d", len(line), pluginColumns)
+		}
+
+		if base64.RawStdEncoding.DecodedLen(body.Len()+len(line)) > maximumPluginBodyBytes {
+			return pluginFrame{}, fmt.Errorf("a body is longer than %d bytes", maximumPluginBodyBytes)
+		}
+
+		body.WriteString(line)
+
+		if len(line) < pluginColumns {
+			break
+		}
+	}
+
+	decoded, err := base64.RawStdEncoding.DecodeString(body.String())
+	if err != nil {
+		return pluginFrame{}, fmt.Errorf("a body is not unpadded base64: %w", err)
+	}
+
+	return pluginFrame{command: fields[0], args: fields[1:], body: decoded}, nil
+}
+
+// A line without its newline, no longer than the reader's buffer
+func readPluginLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errors.New("a line is too long")
+	}
+
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
+
+func encodePluginArg(data []byte) string {
+	if len(data) == 0 {
+		return "-"
+	}
+
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+func decodePluginArg(arg string) ([]byte, error) {
+	if arg == "-" {
+		return nil, nil
+	}
+
+	return base64.RawStdEncoding.DecodeString(arg)
+}
+
+// The cipher <plugin>:<cipher>, starting the plugin if it is not running
+func pluginCipherSuiteByName(name string) (cipherSuite, error) {
+	pluginName, cipherName, err := splitPluginName(name)
+	if err != nil {
+		return cipherSuite{}, fmt.Errorf("cipher %q is not supported", name)
+	}
+
+	if _, err := startPlugin(pluginName); err != nil {
+		return cipherSuite{}, err
+	}
+
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+
+	for _, cipher := range plugins.ciphers {
+		if cipher.plugin.name == pluginName && cipher.name == cipherName {
+			return cipher.suite, nil
+		}
+	}
+
+	return cipherSuite{}, fmt.Errorf("plugin %s has no cipher %s", pluginName, cipherName)
+}
+
+// The ciphers of the plugins started so far
+func pluginCipherSuites() []cipherSuite {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+
+	suites := make([]cipherSuite, 0, len(plugins.ciphers))
+	for _, cipher := range plugins.ciphers {
+		suites = append(suites, cipher.suite)
+	}
+
+	return suites
+}
+
+func pluginCipherByMode(mode CipherModeEnum) (pluginCipher, error) {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+
+	index := int(mode) - int(pluginModeBase)
+	if index < 0 || index >= len(plugins.ciphers) {
+		return pluginCipher{}, fmt.Errorf("no plugin cipher has mode %d", mode)
+	}
+
+	return plugins.ciphers[index], nil
+}
+
+// Laid out like AES-GCM chunks - nonce, ciphertext, tag - the plugin seals, we choose the nonce
+func encryptBlobPlugin(mode CipherModeEnum, blob *[]byte, key []byte, additionalData []byte, nonceStart []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	cipher, err := pluginCipherByMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key)*8 != cipher.suite.KeySize {
+		return nil, fmt.Errorf("invalid key size supplied - cipher %s takes %d bits of key material", cipher.suite.Name, cipher.suite.KeySize)
+	}
+
+	sealedSize := len(*blob) + int(cipher.suite.TagSize)
+
+	nonce, err := newChunkNonce(nonceStart, int(cipher.suite.NonceSize), sealedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := cipher.plugin.request("seal", []string{cipher.name, encodePluginArg(key), encodePluginArg(nonce), encodePluginArg(additionalData)}, *blob)
+	if errors.Is(err, errPluginFailed) {
+		return nil, fmt.Errorf("plugin cipher %s could not seal the data", cipher.suite.Name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(answer.body) != sealedSize {
+		return nil, fmt.Errorf("plugin cipher %s sealed %d bytes into %d, its %d byte tag makes %d", cipher.suite.Name, len(*blob), len(answer.body), cipher.suite.TagSize, sealedSize)
+	}
+
+	encryptedData := append(nonce, answer.body...)
+
+	return &encryptedData, nil
+}
+
+func decryptBlobPlugin(mode CipherModeEnum, blob *[]byte, key []byte, additionalData []byte) (*[]byte, error) {
+	if blob == nil {
+		return nil, errors.New("invalid data supplied")
+	}
+
+	cipher, err := pluginCipherByMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize, tagSize := int(cipher.suite.NonceSize), int(cipher.suite.TagSize)
+	if len(*blob) < nonceSize+tagSize {
+		return nil, errors.New("encrypted data is shorter than its nonce and tag")
+	}
+
+	nonce, ciphertext := (*blob)[:nonceSize], (*blob)[nonceSize:]
+
+	answer, err := cipher.plugin.request("open", []string{cipher.name, encodePluginArg(key), encodePluginArg(nonce), encodePluginArg(additionalData)}, ciphertext)
+	if errors.Is(err, errPluginFailed) {
+		return nil, fmt.Errorf("could not decrypt the data using the provided key material: %w", err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(answer.body) != len(ciphertext)-tagSize {
+		return nil, fmt.Errorf("plugin cipher %s opened %d bytes into %d, its %d byte tag makes %d", cipher.suite.Name, len(ciphertext), len(answer.body), tagSize, len(ciphertext)-tagSize)
+	}
+
+	return &answer.body, nil
+}
+
+func wrapFileKeyPlugin(fileKey []byte, recipient string) (RecipientStanza, error) {
+	name, rest, err := splitPluginName(recipient)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("plugin recipient %w", err)
+	}
+
+	p, err := startPlugin(name)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	if !p.recipients {
+		return RecipientStanza{}, fmt.Errorf("plugin %s has no recipients, only ciphers", name)
+	}
+
+	answer, err := p.request("wrap", []string{encodePluginArg([]byte(rest))}, fileKey)
+	if errors.Is(err, errPluginFailed) {
+		return RecipientStanza{}, fmt.Errorf("plugin %s could not wrap the file key to %s", name, rest)
+	}
+
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypePlugin,
+		Args: append([]string{name}, answer.args...),
+		Body: base64.StdEncoding.EncodeToString(answer.body),
+	}, nil
+}
+
+func unwrapFileKeyPlugin(stanza RecipientStanza) ([]byte, error) {
+	if len(stanza.Args) < 1 || !validPluginName(stanza.Args[0]) {
+		return nil, errors.New("the plugin stanza does not name a plugin")
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("the plugin stanza's body is not base64: %w", err)
+	}
+
+	p, err := startPlugin(stanza.Args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := p.request("unwrap", stanza.Args[1:], wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return answer.body, nil
+}
@@ -0,0 +1,197 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+/*
+	Organizations can standardize how encryptor is used across a fleet
+	with a policy file, a JSON document of rules every job must satisfy
+
+		{"MinimumKDFIterations": 300000, "AllowedCiphers": ["AES-256-GCM"], "RequireVerification": true}
+
+	The system policy is locked by the administrator - it must not be
+	writable by group or others (a policy anyone can edit is no policy,
+	so an unlocked one stops every job rather than being ignored). Unknown
+	rules are errors for the same reason, a typo must not loosen a policy
+
+	Rules are checked against what the job actually writes. OpenPGP
+	messages (--openpgp) are AES-256-CFB with a SHA-1 integrity check and
+	a password stretched by the iterated S2K, JWEs (--jwe) are AES-256-GCM
+	with PBKDF2-HMAC-SHA-512 - neither has chunk checksums. Both are
+	refused unless the policy lists them in AllowedFormats, as FIPS mode
+	refuses what it does not approve, and once allowed their cipher and
+	key derivation are held to the same rules as our own format
+*/
+
+var SystemPolicyFilename = "/etc/encryptor/policy.json"
+
+type Policy struct {
+	MinimumKDFIterations int      `json:",omitempty"` // Password key derivation
+	AllowedCiphers       []string `json:",omitempty"` // e.g. AES-256-GCM, XChaCha20-Poly1305, empty allows every cipher
+	RequireVerification  bool     `json:",omitempty"` // Encrypted files must carry chunk checksums so scrub can verify them
+	AllowedFormats       []string `json:",omitempty"` // OpenPGP and JWE, which are refused unless listed - our own format is always allowed
+
+	// shred only destroys a file once its .enc decrypts to exactly its bytes, or it is encrypted itself
+	ForbidUnverifiedDelete bool `json:",omitempty"`
+}
+
+// What a job writes, policies allow our own format and whichever others they list
+const (
+	OutputFormatEncryptor = "encryptor"
+	OutputFormatOpenPGP   = "OpenPGP"
+	OutputFormatJWE       = "JWE"
+)
+
+func LoadPolicy(fileName string) (Policy, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return Policy{}, fmt.Errorf("could not read policy file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var policy Policy
+	if err := decoder.Decode(&policy); err != nil {
+		return Policy{}, fmt.Errorf("could not parse policy file %s: %w", fileName, err)
+	}
+
+	return policy, nil
+}
+
+// The system policy, if the administrator installed one (found is false otherwise)
+func LoadSystemPolicy() (policy Policy, found bool, err error) {
+	info, err := os.Stat(SystemPolicyFilename)
+	if os.IsNotExist(err) {
+		return Policy{}, false, nil
+	} else if err != nil {
+		return Policy{}, true, fmt.Errorf("could not check system policy file: %w", err)
+	}
+
+	// Windows does not have meaningful permission bits
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		return Policy{}, true, fmt.Errorf("system policy file %s is writable by group or others, it must be locked down by an administrator", SystemPolicyFilename)
+	}
+
+	policy, err = LoadPolicy(SystemPolicyFilename)
+	return policy, true, err
+}
+
+// Every rule the operation would break, empty when it complies
+func (policy *Policy) Violations(operation OperationEnum, options *Options) []string {
+	return policy.OutputViolations(operation, OutputFormatEncryptor, options)
+}
+
+// Every rule the operation would break writing format (an OutputFormat), empty when it complies
+func (policy *Policy) OutputViolations(operation OperationEnum, format string, options *Options) []string {
+	var violations []string
+
+	if (operation != Encryption && operation != EmailWrapping) || options == nil {
+		// Existing files must stay readable, policy governs what is written
+		return violations
+	}
+
+	if format != OutputFormatEncryptor && !containsFold(policy.AllowedFormats, format) {
+		violations = append(violations, fmt.Sprintf("%s output is not allowed, policy must list it in AllowedFormats", format))
+	}
+
+	output := describeOutput(operation, format, options)
+
+	if output.kdfIterations > 0 && output.kdfIterations < policy.MinimumKDFIterations {
+		violations = append(violations, fmt.Sprintf("password key derivation (%s) uses %d iterations, policy requires at least %d", output.kdf, output.kdfIterations, policy.MinimumKDFIterations))
+	}
+
+	if len(policy.AllowedCiphers) > 0 && !containsFold(policy.AllowedCiphers, output.cipher) {
+		violations = append(violations, fmt.Sprintf("cipher %s%s is not allowed, policy allows %s", output.cipher, output.integrity, strings.Join(policy.AllowedCiphers, ", ")))
+	}
+
+	if policy.RequireVerification && !output.chunkChecksums {
+		if format == OutputFormatEncryptor {
+			violations = append(violations, "policy requires verifiable files, encrypt with --chunk-crc")
+		} else {
+			violations = append(violations, fmt.Sprintf("policy requires verifiable files, %s output has no chunk checksums", format))
+		}
+	}
+
+	return violations
+}
+
+// The parameters a policy is checked against, as the format would write them
+type policyOutput struct {
+	cipher         string
+	integrity      string // How the cipher's output is authenticated, when its name does not say
+	kdf            string
+	kdfIterations  int // 0 when no password is stretched
+	chunkChecksums bool
+}
+
+func describeOutput(operation OperationEnum, format string, options *Options) policyOutput {
+	passwordOnly := options.Password != "" && options.KeyHex == ""
+
+	switch format {
+	case OutputFormatOpenPGP:
+		output := policyOutput{cipher: "AES-256-CFB", integrity: " (with a SHA-1 integrity check)", kdf: "OpenPGP iterated S2K, SHA-256"}
+		if passwordOnly {
+			output.kdfIterations = openPGPS2KIterations(options.Password)
+		}
+
+		return output
+	case OutputFormatJWE:
+		output := policyOutput{cipher: "AES-256-GCM", kdf: "PBES2, PBKDF2-HMAC-SHA-512"}
+		if passwordOnly {
+			output.kdfIterations = PasswordKDFIterations
+		}
+
+		return output
+	}
+
+	output := policyOutput{cipher: DefaultCipher, kdf: "PBKDF2-HMAC-SHA-256", chunkChecksums: options.ChunkChecksum}
+	if options.Cipher != "" {
+		output.cipher = options.Cipher
+	}
+
+	if passwordOnly && !usesRecipients(operation, "", options) {
+		output.kdfIterations = PasswordKDFIterations
+	}
+
+	return output
+}
+
+// Every rule an encrypted file breaks, as its header describes it - policy governs files already written only when audited
+func (policy *Policy) FileViolations(inspection *FileInspection) []string {
+	var violations []string
+
+	if inspection == nil {
+		return violations
+	}
+
+	if inspection.KeySource == KeySourcePassword && inspection.KDFIterations < policy.MinimumKDFIterations {
+		violations = append(violations, fmt.Sprintf("password key derivation used %d iterations, policy requires at least %d", inspection.KDFIterations, policy.MinimumKDFIterations))
+	}
+
+	if len(policy.AllowedCiphers) > 0 && !containsFold(policy.AllowedCiphers, inspection.Cipher) {
+		violations = append(violations, fmt.Sprintf("cipher %s is not allowed, policy allows %s", inspection.Cipher, strings.Join(policy.AllowedCiphers, ", ")))
+	}
+
+	if policy.RequireVerification && inspection.ChunkChecksum == "" {
+		violations = append(violations, "policy requires verifiable files, this one has no chunk checksums")
+	}
+
+	return violations
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(strings.TrimSpace(candidate), value) {
+			return true
+		}
+	}
+
+	return false
+}
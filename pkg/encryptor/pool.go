@@ -0,0 +1,207 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+	Separate read and execute workers leave cores idle whenever one stage
+	is the bottleneck - readers wait on storage while executors starve,
+	or executors fall behind while readers have nothing left to do. With
+	Options.PoolWorkers the two stages are replaced by one pool whose
+	workers take whichever task is ready: executing a chunk that has been
+	read comes first (it moves memory toward the writer), otherwise the
+	next chunk is read
+
+	Readers and Executors become caps on how many of the pool may read or
+	execute at once - hints for storage that suffers under too many
+	concurrent reads, set them high to let the pool decide. Chunks are
+	handed out one at a time, so BatchChunks does not apply
+*/
+
+type poolTaskEnum uint8
+
+const (
+	poolTaskRead poolTaskEnum = iota
+	poolTaskExecute
+)
+
+type poolTask struct {
+	Type      poolTaskEnum
+	ChunkID   uint
+	ChunkData *[]byte // Only for executing
+}
+
+type workerPool struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	numChunks   uint
+	nextRead    uint
+	ready       []poolTask // Read and waiting to be executed
+	reading     uint
+	executing   uint
+	maxReads    uint
+	maxExecutes uint
+	failed      bool
+}
+
+func newWorkerPool(numChunks uint, maxReads uint, maxExecutes uint) *workerPool {
+	if maxReads < 1 {
+		maxReads = 1
+	}
+
+	if maxExecutes < 1 {
+		maxExecutes = 1
+	}
+
+	pool := &workerPool{numChunks: numChunks, nextRead: 1, maxReads: maxReads, maxExecutes: maxExecutes}
+	pool.cond = sync.NewCond(&pool.mutex)
+
+	return pool
+}
+
+// Blocks until there is a task, false once every chunk is done or a task has failed
+func (pool *workerPool) next() (poolTask, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for !pool.failed {
+		if len(pool.ready) > 0 && pool.executing < pool.maxExecutes {
+			task := pool.ready[0]
+			pool.ready = pool.ready[1:]
+			pool.executing++
+
+			return task, true
+		}
+
+		if pool.nextRead <= pool.numChunks && pool.reading < pool.maxReads {
+			task := poolTask{Type: poolTaskRead, ChunkID: pool.nextRead}
+			pool.nextRead++
+			pool.reading++
+
+			return task, true
+		}
+
+		if pool.nextRead > pool.numChunks && len(pool.ready) == 0 && pool.reading == 0 && pool.executing == 0 {
+			break
+		}
+
+		pool.cond.Wait()
+	}
+
+	return poolTask{}, false
+}
+
+// A finished read hands its chunk back to be executed
+func (pool *workerPool) done(task poolTask) {
+	pool.mutex.Lock()
+
+	if task.Type == poolTaskRead {
+		pool.reading--
+		pool.ready = append(pool.ready, poolTask{Type: poolTaskExecute, ChunkID: task.ChunkID, ChunkData: task.ChunkData})
+	} else {
+		pool.executing--
+	}
+
+	pool.cond.Broadcast()
+	pool.mutex.Unlock()
+}
+
+func (pool *workerPool) fail() {
+	pool.mutex.Lock()
+	pool.failed = true
+	pool.cond.Broadcast()
+	pool.mutex.Unlock()
+}
+
+// Dev note: stands in for the read and execute stages, write to write channels
+func poolStage(job *pipelineJob, stats os.FileInfo, fileHeader EncryptedFileHeader, endOfHeader int, budget *memoryBudget, auth *fileAuthenticator, ch chan<- error, numWorkers uint, writeChannels []chan *[]byte) {
+	var once sync.Once
+	report := func(err error) {
+		once.Do(func() { ch <- err })
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			report(newCrashError("pool stage", recovered))
+		}
+	}()
+
+	// Reads at an offset do not share a file position, so one descriptor serves every worker
+	file, err := os.Open(job.SourceFilename)
+	if err != nil {
+		report(fmt.Errorf("could not open source file: %w", err))
+		return
+	}
+
+	pool := newWorkerPool(uint(len(writeChannels)), job.NumReaders, job.NumExecutors)
+	chunkSizeBytes := bytesFromMB(job.ChunkSizeMB)
+
+	var workers sync.WaitGroup
+
+	for i := uint(1); i <= numWorkers; i++ {
+		workers.Add(1)
+
+		go func(id uint) {
+			defer workers.Done()
+
+			err := runRecovered(fmt.Sprintf("pool worker %d", id), func() error {
+				return poolWorker(job, file, pool, chunkSizeBytes, stats.Size(), &fileHeader, endOfHeader, budget, auth, writeChannels)
+			})
+			if err != nil {
+				pool.fail()
+				report(fmt.Errorf("pool worker error: %w", err))
+			}
+		}(i)
+	}
+
+	workers.Wait()
+	_ = file.Close()
+	report(nil)
+}
+
+func poolWorker(job *pipelineJob, file *os.File, pool *workerPool, chunkSizeBytes int64, sourceSizeBytes int64, fileHeader *EncryptedFileHeader, endOfHeader int, budget *memoryBudget, auth *fileAuthenticator, writeChannels []chan *[]byte) error {
+	for {
+		task, ok := pool.next()
+		if !ok {
+			return nil
+		}
+
+		if task.Type == poolTaskExecute {
+			chunkData, err := executeChunk(job.Operation, job.Cipher, job.CipherMode, job.KeyMaterial, job.ChunkChecksum, fileHeader, auth, job.TreeLeaves, task.ChunkID, pool.numChunks, task.ChunkData)
+			if err != nil {
+				return err
+			}
+
+			writeChannels[task.ChunkID-1] <- chunkData
+			pool.done(task)
+			continue
+		}
+
+		request, err := chunkReadRange(job.Operation, task.ChunkID, chunkSizeBytes, fileHeader, endOfHeader, sourceSizeBytes)
+		if err != nil {
+			return err
+		}
+
+		/*
+			A bounded job waits here until the chunk fits in memory - this
+			cannot starve the writer, the worker that read the chunk it is
+			waiting on goes back to the pool and executing comes first
+		*/
+		budget.acquire(task.ChunkID)
+
+		chunkData := make([]byte, request.RangeEnd-request.RangeStart)
+
+		bytesRead, err := file.ReadAt(chunkData, request.RangeStart)
+		if err != nil && !(errors.Is(err, io.EOF) && bytesRead == len(chunkData)) {
+			return fmt.Errorf("error occurred during read of chunk %d: %w", task.ChunkID, err)
+		}
+
+		task.ChunkData = &chunkData
+		pool.done(task)
+	}
+}
@@ -0,0 +1,202 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	On high latency sources (network filesystems, cloud ranged GETs) a
+	read worker spends most of its time waiting, and adding workers only
+	helps until they are all waiting too. The prefetch stage replaces the
+	read workers with a single dispatcher that keeps a window of reads in
+	flight ahead of the executors, each on its own goroutine against one
+	shared descriptor
+
+	The window starts at Options.PrefetchChunks and adapts as the job
+	runs - hiding a read latency L from executors that take a chunk every
+	C needs about L/C reads in flight (Little's law), so the depth follows
+	moving averages of both, between 1 and PrefetchDepthMax. A bounded
+	job still admits every read against the memory budget, and the depth
+	never grows past what the budget can hold
+*/
+
+const PrefetchDepthMax uint = 64
+
+type prefetchWindow struct {
+	mutex           sync.Mutex
+	cond            *sync.Cond
+	depth           uint
+	maxDepth        uint
+	ahead           uint // Read or being read, not yet taken by an executor
+	readLatency     time.Duration
+	consumeInterval time.Duration
+	lastConsumed    time.Time
+	failed          bool
+}
+
+// nil when prefetching is off, a nil window is never waited on
+func newPrefetchWindow(depth uint, maxDepth uint) *prefetchWindow {
+	if depth == 0 || maxDepth == 0 {
+		return nil
+	}
+
+	if depth > maxDepth {
+		depth = maxDepth
+	}
+
+	window := &prefetchWindow{depth: depth, maxDepth: maxDepth}
+	window.cond = sync.NewCond(&window.mutex)
+
+	return window
+}
+
+// Blocks until another read fits in the window, false once a read has failed
+func (window *prefetchWindow) acquire() bool {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+
+	for window.ahead >= window.depth && !window.failed {
+		window.cond.Wait()
+	}
+
+	window.ahead++
+	return !window.failed
+}
+
+func (window *prefetchWindow) observeRead(latency time.Duration) {
+	window.mutex.Lock()
+	window.readLatency = movingAverage(window.readLatency, latency)
+	window.adapt()
+	window.mutex.Unlock()
+}
+
+// Called by executors as they take a chunk off its channel
+func (window *prefetchWindow) consumed() {
+	if window == nil {
+		return
+	}
+
+	window.mutex.Lock()
+
+	now := time.Now()
+	if !window.lastConsumed.IsZero() {
+		window.consumeInterval = movingAverage(window.consumeInterval, now.Sub(window.lastConsumed))
+	}
+
+	window.lastConsumed = now
+	window.ahead--
+	window.adapt()
+
+	window.cond.Broadcast()
+	window.mutex.Unlock()
+}
+
+func (window *prefetchWindow) fail() {
+	window.mutex.Lock()
+	window.failed = true
+	window.cond.Broadcast()
+	window.mutex.Unlock()
+}
+
+// The lock must be held, nothing changes until both averages have a sample
+func (window *prefetchWindow) adapt() {
+	if window.readLatency == 0 || window.consumeInterval == 0 {
+		return
+	}
+
+	window.depth = prefetchDepth(window.readLatency, window.consumeInterval, window.maxDepth)
+}
+
+// One read more than the latency needs, so an executor finishing early still finds work
+func prefetchDepth(readLatency time.Duration, consumeInterval time.Duration, maxDepth uint) uint {
+	depth := uint(1)
+	if consumeInterval > 0 {
+		depth = uint((readLatency+consumeInterval-1)/consumeInterval) + 1
+	}
+
+	if depth > maxDepth {
+		depth = maxDepth
+	}
+
+	return depth
+}
+
+// Weighted toward history so one slow read does not swing the depth
+func movingAverage(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+
+	return average + (sample-average)/4
+}
+
+// Dev note: stands in for the read workers, read requests are taken in order
+func prefetchWorker(fileName string, window *prefetchWindow, budget *memoryBudget, ch chan<- error, readChannels []chan *chunkReadRequest, executeChannels []chan *[]byte) {
+	var once sync.Once
+	report := func(err error) {
+		once.Do(func() { ch <- err })
+	}
+
+	// Reads at an offset do not share a file position, so one descriptor serves every read
+	file, err := os.Open(fileName)
+	if err != nil {
+		report(fmt.Errorf("could not open source file: %w", err))
+		return
+	}
+
+	var reads sync.WaitGroup
+
+	defer func(file *os.File) {
+		reads.Wait()
+		_ = file.Close()
+		report(nil)
+	}(file)
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			window.fail()
+			report(newCrashError("prefetch worker", recovered))
+		}
+	}()
+
+	for i := uint(1); i <= uint(len(readChannels)); i++ {
+		request := <-readChannels[i-1]
+		close(readChannels[i-1])
+
+		if !window.acquire() {
+			return
+		}
+
+		// A bounded job waits here until the chunk fits in memory
+		budget.acquire(i)
+
+		reads.Add(1)
+
+		go func(chunkID uint, request *chunkReadRequest) {
+			defer reads.Done()
+
+			err := runRecovered(fmt.Sprintf("prefetch read of chunk %d", chunkID), func() error {
+				start := time.Now()
+				chunkData := make([]byte, request.RangeEnd-request.RangeStart)
+
+				bytesRead, err := file.ReadAt(chunkData, request.RangeStart)
+				if err != nil && !(errors.Is(err, io.EOF) && bytesRead == len(chunkData)) {
+					return fmt.Errorf("error occurred during read of chunk %d: %w", chunkID, err)
+				}
+
+				window.observeRead(time.Since(start))
+				executeChannels[chunkID-1] <- &chunkData
+				return nil
+			})
+			if err != nil {
+				window.fail()
+				report(err)
+			}
+		}(i, request)
+	}
+}
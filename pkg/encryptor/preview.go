@@ -0,0 +1,42 @@
+package encryptor
+
+import (
+	"errors"
+	"io"
+)
+
+/*
+	Decrypting a large archive can take hours, and finding out at the end
+	that it was the wrong file (or that the key is right but the contents
+	are not what was expected) wastes all of them. A preview decrypts only
+	the chunks holding the first bytes of the plaintext - each of them
+	authenticated as usual, so a wrong key fails on the first chunk - and
+	stops there
+
+	The footer and the plaintext digest cover the whole file, so they are
+	only checked when the preview reaches its end - a preview says the key
+	opens the file and shows how it begins, Verify says all of it is intact
+*/
+
+func preview(source io.Reader, target io.Writer, numBytes int64, options *Options) (int64, error) {
+	if source == nil || target == nil || options == nil {
+		return 0, errors.New("source, target, or options is nil")
+	}
+
+	if numBytes <= 0 {
+		return 0, errors.New("a preview must be at least 1 byte")
+	}
+
+	reader, err := NewDecryptReader(source, options)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files shorter than the preview are shown whole
+	written, err := io.CopyN(target, reader, numBytes)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return written, err
+}
@@ -0,0 +1,348 @@
+package encryptor
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	Recipients let a file be encrypted to people rather than to a shared
+	password - a random file key encrypts the payload as usual, and that
+	key is wrapped once per recipient into a stanza stored in the header
+
+	Decryption tries each stanza with whatever identities are available
+	until one unwraps the file key, the payload itself is unaffected
+*/
+
+type RecipientStanza struct {
+	Type string
+	Args []string `json:",omitempty"` // Identifies the recipient (e.g. key id), informational only
+	Body string   // The wrapped file key, base64 encoded
+}
+
+const FileKeySize = 32
+
+const RecipientTypeOpenPGP = "openpgp"
+
+// Does this job get its key material from recipient stanzas?
+func usesRecipients(operation OperationEnum, sourceFilename string, options *Options) bool {
+	if operation == Encryption || operation == EmailWrapping {
+		return len(options.GPGRecipients) > 0 || len(options.SSHRecipients) > 0 || len(options.RecipientsFiles) > 0 || len(options.X25519Recipients) > 0 || len(options.RSARecipients) > 0 || len(options.GCPKMSKeys) > 0 || len(options.AzureKeyVaultKeys) > 0 || len(options.PKCS11Keys) > 0 || options.TPMSeal || len(options.PluginRecipients) > 0
+	}
+
+	if operation == Decryption || operation == Verification || operation == Previewing || operation == Recovering || operation == RangeProving || operation == FileServing {
+		return options.KeyHex == "" && len(peekRecipients(sourceFilename)) > 0
+	}
+
+	return false
+}
+
+func peekRecipients(fileName string) []RecipientStanza {
+	header := peekHeader(fileName)
+	if header == nil {
+		return nil
+	}
+
+	return header.Recipients
+}
+
+// Errors are ignored (nil is returned), the pipeline reports problems with the header in detail
+func peekHeader(fileName string) *EncryptedFileHeader {
+	if isGCSURL(fileName) || isAzureBlobURL(fileName) || isHTTPURL(fileName) {
+		return peekObjectHeader(fileName)
+	}
+
+	header, _, err := getEncryptedFileHeaderFromFile(fileName)
+	if err != nil {
+		return nil
+	}
+
+	return &header
+}
+
+func newFileKeyForRecipients(options *Options) ([]byte, []RecipientStanza, error) {
+	if options.KeyHex != "" || options.Password != "" {
+		return nil, nil, errors.New("recipients cannot be combined with a key or password")
+	}
+
+	// Streams and email wrapping come here without passing runOperation
+	err := checkOffline(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileKey := make([]byte, FileKeySize)
+	if err := readRandom(fileKey); err != nil {
+		return nil, nil, fmt.Errorf("internal crypto error generating file key: %w", err)
+	}
+
+	var stanzas []RecipientStanza
+
+	for _, recipient := range options.GPGRecipients {
+		stanza, err := wrapFileKeyOpenPGP(fileKey, strings.TrimSpace(recipient), options.Offline)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, recipient := range options.SSHRecipients {
+		keys, err := parseSSHRecipients(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, key := range keys {
+			if fipsEnabled(options) && !fipsApprovedSSHKey(key) {
+				return nil, nil, fmt.Errorf("FIPS mode: %s recipients are not allowed, use ssh-rsa", key.Type())
+			}
+
+			stanza, err := wrapFileKeySSH(fileKey, key)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			stanzas = append(stanzas, stanza)
+		}
+	}
+
+	for _, recipient := range options.X25519Recipients {
+		keys, err := readRecipientKeys(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, key := range keys {
+			if fipsEnabled(options) {
+				return nil, nil, errors.New("FIPS mode: x25519 and mlkem768-x25519 recipients are not allowed, use ssh-rsa or rsa-oaep")
+			}
+
+			stanza, err := wrapFileKeyForPublicKey(fileKey, key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not encrypt to recipient %s: %w", recipient, err)
+			}
+
+			stanzas = append(stanzas, stanza)
+		}
+	}
+
+	for _, recipient := range options.RSARecipients {
+		publicKey, err := parseRSARecipient(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanza, err := wrapFileKeyRSAOAEP(fileKey, publicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, keyName := range options.GCPKMSKeys {
+		name, err := parseGCPKMSKeyName(keyName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanza, err := wrapFileKeyGCPKMS(fileKey, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, keyID := range options.AzureKeyVaultKeys {
+		key, err := parseAzureKeyVaultKey(keyID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanza, err := wrapFileKeyAzureKeyVault(fileKey, key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, keyName := range options.PKCS11Keys {
+		key, err := parsePKCS11Key(keyName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanza, err := wrapFileKeyPKCS11(fileKey, key, options.PKCS11Module)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	if options.TPMSeal {
+		stanza, err := wrapFileKeyTPM2(fileKey, options.TPMPCRs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	for _, recipient := range options.PluginRecipients {
+		stanza, err := wrapFileKeyPlugin(fileKey, recipient)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza)
+	}
+
+	/*
+		Published key lists (e.g. GitHub's) often include key types we
+		cannot encrypt to (or may not, in FIPS mode), those are skipped as
+		long as one key remains
+	*/
+	for _, recipientsFile := range options.RecipientsFiles {
+		data, err := readRecipientsFile(strings.TrimSpace(recipientsFile), options)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keys, err := parseSSHPublicKeys(data, recipientsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		supported := 0
+		for _, key := range keys {
+			if !isSupportedSSHKey(key) || (fipsEnabled(options) && !fipsApprovedSSHKey(key)) {
+				continue
+			}
+
+			stanza, err := wrapFileKeySSH(fileKey, key)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			stanzas = append(stanzas, stanza)
+			supported++
+		}
+
+		if supported == 0 && fipsEnabled(options) {
+			return nil, nil, fmt.Errorf("recipients file %s has no ssh-rsa keys, which FIPS mode requires", recipientsFile)
+		} else if supported == 0 {
+			return nil, nil, fmt.Errorf("recipients file %s has no ssh-ed25519 or ssh-rsa keys", recipientsFile)
+		}
+	}
+
+	return fileKey, stanzas, nil
+}
+
+func unwrapFileKey(stanzas []RecipientStanza, options *Options) ([]byte, error) {
+	var failures []string
+
+	// Identities are only loaded (and passphrases prompted for) if a stanza needs them
+	var sshIdentities []interface{}
+	sshIdentitiesLoaded := false
+
+	var identities keyIdentities
+	identitiesLoaded := false
+
+	var rsaIdentities []*rsa.PrivateKey
+	rsaIdentitiesLoaded := false
+
+	pkcs11PIN := options.PKCS11PIN
+	pkcs11PINAsked := pkcs11PIN != "" || options.PromptSecret == nil
+
+	for _, stanza := range stanzas {
+		var fileKey []byte
+		var err error
+
+		if fipsEnabled(options) && !fipsApprovedRecipientType(stanza.Type) {
+			failures = append(failures, stanza.Type+" "+strings.Join(stanza.Args, " ")+": not allowed in FIPS mode")
+			continue
+		}
+
+		switch stanza.Type {
+		case RecipientTypeOpenPGP:
+			fileKey, err = unwrapFileKeyOpenPGP(stanza, options.Offline)
+		case RecipientTypeSSHEd25519, RecipientTypeSSHRSA:
+			if !sshIdentitiesLoaded {
+				sshIdentities, err = loadSSHIdentities(options.SSHIdentities, options.PromptSecret)
+				if err != nil {
+					return nil, err
+				}
+
+				sshIdentitiesLoaded = true
+			}
+
+			fileKey, err = unwrapFileKeySSH(stanza, sshIdentities)
+		case RecipientTypeX25519, RecipientTypeMLKEMX25519:
+			if !identitiesLoaded {
+				identities, err = loadKeyIdentities(options.X25519Identities)
+				if err != nil {
+					return nil, err
+				}
+
+				identitiesLoaded = true
+			}
+
+			if stanza.Type == RecipientTypeX25519 {
+				fileKey, err = unwrapFileKeyX25519(stanza, identities.x25519)
+			} else {
+				fileKey, err = unwrapFileKeyMLKEMX25519(stanza, identities.mlkemX25519)
+			}
+		case RecipientTypeRSAOAEP:
+			if !rsaIdentitiesLoaded {
+				rsaIdentities, err = loadRSAIdentities(options.RSAIdentities)
+				if err != nil {
+					return nil, err
+				}
+
+				rsaIdentitiesLoaded = true
+			}
+
+			fileKey, err = unwrapFileKeyRSAOAEP(stanza, rsaIdentities)
+		case RecipientTypeGCPKMS:
+			fileKey, err = unwrapFileKeyGCPKMS(stanza, options.Offline)
+		case RecipientTypeAzureKeyVault:
+			fileKey, err = unwrapFileKeyAzureKeyVault(stanza, options.Offline)
+		case RecipientTypePKCS11:
+			// Once for every token, an empty answer leaves a PIN pad reader to ask
+			if !pkcs11PINAsked {
+				pkcs11PIN, err = options.PromptSecret("PKCS#11 token PIN: ")
+				if err != nil {
+					return nil, err
+				}
+
+				pkcs11PINAsked = true
+			}
+
+			fileKey, err = unwrapFileKeyPKCS11(stanza, options.PKCS11Module, pkcs11PIN)
+		case RecipientTypeTPM2:
+			fileKey, err = unwrapFileKeyTPM2(stanza)
+		case RecipientTypePlugin:
+			fileKey, err = unwrapFileKeyPlugin(stanza)
+		default:
+			err = fmt.Errorf("unsupported recipient type %q", stanza.Type)
+		}
+
+		if err == nil && len(fileKey) != FileKeySize {
+			err = errors.New("unwrapped file key has an invalid length")
+		}
+
+		if err == nil {
+			return fileKey, nil
+		}
+
+		failures = append(failures, stanza.Type+" "+strings.Join(stanza.Args, " ")+": "+err.Error())
+	}
+
+	return nil, errors.New("no recipient stanza could be unwrapped with the available identities\n" + strings.Join(failures, "\n"))
+}
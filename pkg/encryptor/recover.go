@@ -0,0 +1,840 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	A file whose header was destroyed (a bad sector at the front of a
+	disc, a tool that rewrote the first bytes) cannot be decrypted - the
+	header says where the chunks start, how large they are, and which
+	cipher sealed them, and since format 1.8 every chunk's AAD holds the
+	header's digest. Recovery reconstructs what it can from the key and
+	best guesses at the rest (Options.ChunkSizeMB, Cipher, and
+	ChunkChecksum, as they were when encrypting), writing every chunk that
+	authenticates to its place in the target and reporting the plaintext
+	ranges recovered and lost. With the header intact, chunks are read as
+	it describes and only damaged chunks are lost
+
+	Chunks carry no magic to find them by (the format would need to add
+	one) - a chunk is a random nonce, ciphertext, and a tag - so the first
+	chunk is found by authenticating chunks at each offset the header
+	could have ended at: where its surviving length indicator says, then
+	within recoveryScanBytes of the length a header for the guesses would
+	have. Headers with recipients are larger, but those files cannot be
+	recovered without their header anyway - the file key is wrapped in it.
+	The rest of the chunks follow at fixed intervals from the first
+
+	How a chunk authenticates without its header depends on its format:
+
+	- before 1.8 chunks have no AAD and authenticate on their own, with
+	  any cipher
+	- since 1.8 the AAD holds the lost digest, but it is the same digest
+	  (and chunk count) in every chunk, and AES-GCM's tag is linear in the
+	  AAD - the difference between a chunk's tag and the tag of the same
+	  chunk sealed with the digest and count zeroed is the same for every
+	  chunk of the same length (and scales with the GHASH key for other
+	  lengths). Two chunks that agree authenticate each other and every
+	  chunk is checked against them, so at least two must survive. The
+	  other ciphers authenticate each chunk with its own key, they cannot
+	  be recovered this way
+
+	Passwords are stretched with a salt kept in the header since format
+	1.4, so without the header only files encrypted with a key (or older
+	password files) can be recovered. Each recovered chunk is authentic,
+	but not the file as a whole - its footer and plaintext digest need the
+	header - and lost ranges are left as zeros
+*/
+
+type RecoveredRange struct {
+	Offset int64 // In the plaintext
+	Length int64
+}
+
+type RecoveryReport struct {
+	HeaderIntact     bool
+	FirstChunkOffset int64 // Where the chunks start, the length of the header
+	ChunkSizeBytes   int64
+	Cipher           string
+	Authentication   string // How chunks were authenticated, RecoveryByHeader, RecoveryWithoutAAD, or RecoveryByConsistentAAD
+	NumChunks        uint32
+	ChunksRecovered  uint32
+	Recovered        []RecoveredRange
+	Lost             []RecoveredRange
+	PlaintextBytes   int64 // The size of the target, recovered and lost ranges together
+}
+
+const (
+	RecoveryByHeader        = "header"
+	RecoveryWithoutAAD      = "chunks without AAD (format before 1.8)"
+	RecoveryByConsistentAAD = "chunks agreeing on the lost header (AES-GCM)"
+)
+
+// A header is a uint16 length and at most that much JSON
+const recoveryMaxHeaderBytes = 2 + 65535
+
+// How far from the length of a header for the guesses the first chunk is looked for
+const recoveryScanBytes = 512
+
+// Chunks tried at each candidate offset, one of them may be damaged too
+const recoveryProbeChunks = 3
+
+type recoveryLayout struct {
+	suite          cipherSuite
+	chunkSizeBytes int64
+	checksum       bool
+	markers        bool  // Chunks start with markers, see recoverMarkedChunks
+	plaintextSize  int64 // From the header (format 1.16), 0 when it is lost or does not record it
+	first          int64 // Where the first chunk starts
+	dataEnd        int64 // Where the last chunk ends, any footer follows
+	numChunks      uint32
+	authentication string
+
+	// Opens a sealed chunk (without its checksum), nil if it does not authenticate
+	open func(chunkID uint32, final bool, sealed []byte) []byte
+	// Whether the chunk is the last, when the header is lost it is the one that reaches dataEnd
+	final func(chunkID uint32, end int64) bool
+}
+
+func (layout *recoveryLayout) encryptedChunkSizeBytes() int64 {
+	overhead := int64(layout.suite.NonceSize) + int64(layout.suite.TagSize)
+	if layout.checksum {
+		overhead += int64(CRC32CSize)
+	}
+
+	if layout.markers {
+		overhead += chunkMarkerBytes
+	}
+
+	return layout.chunkSizeBytes + overhead
+}
+
+func recoverFile(sourceFilename string, targetFilename string, options *Options) (RecoveryReport, error) {
+	if options == nil {
+		return RecoveryReport{}, errors.New("options is nil")
+	}
+
+	source, err := os.Open(sourceFilename)
+	if err != nil {
+		return RecoveryReport{}, fmt.Errorf("could not open source file: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(source)
+
+	stats, err := source.Stat()
+	if err != nil {
+		return RecoveryReport{}, fmt.Errorf("could not obtain file stat info: %w", err)
+	}
+
+	var layout *recoveryLayout
+
+	header, endOfHeader, headerErr := getEncryptedFileHeaderFromFile(sourceFilename)
+	if headerErr == nil {
+		layout, err = headerRecoveryLayout(&header, int64(endOfHeader), stats.Size(), options)
+	} else {
+		layout, err = scanRecoveryLayout(source, stats.Size(), options)
+	}
+
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+
+	if _, err := os.Stat(targetFilename); err == nil && !options.ForceOperation {
+		return RecoveryReport{}, ErrTargetExists
+	}
+
+	forgetCachedEncryptedFileHeader(targetFilename)
+
+	target, err := os.Create(targetFilename)
+	if err != nil {
+		return RecoveryReport{}, fmt.Errorf("could not open file for writing: %w", err)
+	}
+
+	report, err := recoverChunks(source, target, layout)
+
+	closeErr := target.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing file we were writing to: %w", closeErr)
+	}
+
+	report.HeaderIntact = headerErr == nil
+
+	if err == nil && report.ChunksRecovered == 0 {
+		err = fmt.Errorf("%w, none of the %d chunks authenticated", ErrNothingRecovered, report.NumChunks)
+	}
+
+	return report, err
+}
+
+// The header is intact, chunks are exactly where it says and authenticate as they always do
+func headerRecoveryLayout(header *EncryptedFileHeader, endOfHeader int64, sizeBytes int64, options *Options) (*recoveryLayout, error) {
+	suite, err := cipherSuiteForHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := resolveKeyMaterial(Decryption, header, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// A wrong key is told apart from damage up front, when the header can tell
+	err = verifyKeyCheck(header, key.Material)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := &recoveryLayout{
+		suite:          suite,
+		chunkSizeBytes: header.ChunkSizeBytes,
+		checksum:       header.ChunkChecksum == ChecksumCRC32C,
+		markers:        header.ChunkMarkers != "",
+		first:          endOfHeader,
+		dataEnd:        sizeBytes - footerSizeBytes(header) - signatureSizeBytes(header) - headerCopySizeBytes(header, int(endOfHeader)),
+		plaintextSize:  header.PlaintextSize,
+		authentication: RecoveryByHeader,
+	}
+
+	if layout.chunkSizeBytes <= 0 || layout.dataEnd < layout.first {
+		return nil, fmt.Errorf("%w, the header describes no chunks", ErrFileCorrupt)
+	}
+
+	// Streamed files and files cut short end where their data does, the rest are as long as the header says
+	layout.numChunks = chunksBetween(layout.first, layout.dataEnd, layout.encryptedChunkSizeBytes())
+	if !header.Streamed {
+		layout.numChunks = header.NumChunks
+	}
+
+	layout.open = func(chunkID uint32, final bool, sealed []byte) []byte {
+		plaintext, err := decryptBlob(suite.Cipher, suite.Mode, &sealed, key.Material, chunkAdditionalData(header, chunkID, final))
+		if err != nil {
+			return nil
+		}
+
+		return *plaintext
+	}
+
+	layout.final = func(chunkID uint32, end int64) bool {
+		if header.Streamed {
+			return end == layout.dataEnd
+		}
+
+		return chunkID == header.NumChunks
+	}
+
+	return layout, nil
+}
+
+func chunksBetween(first int64, dataEnd int64, encryptedChunkSizeBytes int64) uint32 {
+	payloadBytes := dataEnd - first
+	if payloadBytes <= 0 {
+		return 0
+	}
+
+	numChunks := payloadBytes / encryptedChunkSizeBytes
+	if payloadBytes%encryptedChunkSizeBytes != 0 {
+		numChunks++
+	}
+
+	return uint32(numChunks)
+}
+
+// The header is lost, the chunks are found from the key and the guesses in options
+func scanRecoveryLayout(source *os.File, sizeBytes int64, options *Options) (*recoveryLayout, error) {
+	suite, err := cipherSuiteByName(options.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSizeMB := options.ChunkSizeMB
+	if chunkSizeMB == 0 {
+		chunkSizeMB = DefaultChunkSizeMB
+	}
+
+	key, err := resolveKeyMaterial(Decryption, nil, options)
+	if err != nil {
+		return nil, fmt.Errorf("%w (without the header a key is needed, or a password from before format 1.4)", err)
+	}
+
+	// A copy of the header that is damaged too still ends the file, the chunks end before it
+	if trailer, err := readHeaderCopyTrailer(source, sizeBytes); err == nil {
+		sizeBytes -= int64(trailer.length) + int64(headerCopyTrailerBytes)
+	}
+
+	layout := &recoveryLayout{suite: suite, chunkSizeBytes: bytesFromMB(chunkSizeMB), checksum: options.ChunkChecksum}
+
+	// Every offset the first chunk could start at, and the chunks after it that are probed (room is left for markers)
+	window := make([]byte, minInt64(sizeBytes, recoveryMaxHeaderBytes+recoveryProbeChunks*(layout.encryptedChunkSizeBytes()+chunkMarkerBytes)))
+	_, err = source.ReadAt(window, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read source file: %w", err)
+	}
+
+	// Chunks with markers say where they are, the first marker found places the first chunk
+	candidates := recoveryCandidateOffsets(window, sizeBytes, &suite, layout)
+
+	if marker := bytes.Index(window, []byte(chunkMarkerMagic)); marker >= 0 {
+		if markedID, ok := readChunkMarker(window[marker:]); ok && markedID > 0 {
+			layout.markers = true
+			first := int64(marker) - int64(markedID-1)*layout.encryptedChunkSizeBytes()
+			candidates = append([]int64{first}, candidates...)
+		}
+	}
+
+	encryptedChunkSizeBytes := layout.encryptedChunkSizeBytes()
+
+	var gcm *gcmAADRecovery
+	if suite.Cipher == AES && suite.Mode == GCM {
+		gcm, err = newGCMAADRecovery(key.Material, layout.chunkSizeBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A chunk (nonce, ciphertext, tag, checksum) in the window without its marker, nil past its end
+	probeChunk := func(offset int64, dataEnd int64) []byte {
+		end := minInt64(offset+encryptedChunkSizeBytes, minInt64(dataEnd, int64(len(window))))
+		if offset < 0 || (end == int64(len(window)) && end < dataEnd) {
+			return nil
+		}
+
+		if layout.markers {
+			offset += chunkMarkerBytes
+		}
+
+		if end-offset <= int64(suite.NonceSize+suite.TagSize) {
+			return nil
+		}
+
+		return stripRecoveryChecksum(window[offset:end], layout.checksum)
+	}
+
+	for _, first := range candidates {
+		// Chunks bound to a header have a footer after them, older chunks have none
+		if gcm != nil {
+			dataEnd := sizeBytes - sha256.Size
+			chunkIDs := make([]uint32, 0, recoveryProbeChunks)
+			chunks := make([][]byte, 0, recoveryProbeChunks)
+			finals := make([]bool, 0, recoveryProbeChunks)
+
+			// Marked chunks are probed where their markers are, wherever damage moved them
+			offset := first
+			for index := int64(0); index < recoveryProbeChunks; index++ {
+				chunkID := uint32(index + 1)
+				if layout.markers {
+					marker := bytes.Index(window[minInt64(maxInt64(offset, 0), int64(len(window))):], []byte(chunkMarkerMagic))
+					if marker < 0 {
+						break
+					}
+
+					offset = maxInt64(offset, 0) + int64(marker)
+					chunkID, _ = readChunkMarker(window[offset:])
+				}
+
+				chunkIDs = append(chunkIDs, chunkID)
+				chunks = append(chunks, probeChunk(offset, dataEnd))
+				finals = append(finals, offset+encryptedChunkSizeBytes >= dataEnd)
+
+				if layout.markers {
+					offset++
+				} else {
+					offset += encryptedChunkSizeBytes
+				}
+			}
+
+			if gcm.agree(chunkIDs, chunks, finals) {
+				layout.first = first
+				layout.dataEnd = dataEnd
+				layout.authentication = RecoveryByConsistentAAD
+				layout.open = gcm.open
+				break
+			}
+		}
+
+		for index := int64(0); index < recoveryProbeChunks; index++ {
+			chunk := probeChunk(first+index*encryptedChunkSizeBytes, sizeBytes)
+			if chunk == nil {
+				break
+			}
+
+			if _, err := decryptBlob(suite.Cipher, suite.Mode, &chunk, key.Material, nil); err == nil {
+				layout.first = first
+				layout.dataEnd = sizeBytes
+				layout.authentication = RecoveryWithoutAAD
+				layout.open = func(chunkID uint32, final bool, sealed []byte) []byte {
+					plaintext, err := decryptBlob(suite.Cipher, suite.Mode, &sealed, key.Material, nil)
+					if err != nil {
+						return nil
+					}
+
+					return *plaintext
+				}
+				break
+			}
+		}
+
+		if layout.open != nil {
+			break
+		}
+	}
+
+	if layout.open == nil {
+		if gcm == nil {
+			return nil, fmt.Errorf("%w, no chunk authenticated at any offset - without the header only AES-256-GCM chunks, or chunks from before format 1.8, can be authenticated", ErrNothingRecovered)
+		}
+
+		return nil, fmt.Errorf("%w, no chunk authenticated at any offset, check the key and that the chunk size, cipher, and chunk checksums are what the file was encrypted with", ErrNothingRecovered)
+	}
+
+	layout.numChunks = chunksBetween(layout.first, layout.dataEnd, encryptedChunkSizeBytes)
+	layout.final = func(chunkID uint32, end int64) bool {
+		return end == layout.dataEnd
+	}
+
+	return layout, nil
+}
+
+/*
+	The offsets to look for the first chunk at, in the order to try them:
+	where the header's length indicator says it ends (it may have
+	survived), then outwards from the length of headers for the guesses -
+	with and without the optional fields a header commonly has - as far as
+	recoveryScanBytes
+*/
+func recoveryCandidateOffsets(window []byte, sizeBytes int64, suite *cipherSuite, layout *recoveryLayout) []int64 {
+	var centers []int64
+
+	guess := EncryptedFileHeader{
+		ChunkSizeBytes: layout.chunkSizeBytes,
+		Algorithm:      suite.Algorithm,
+		Mode:           suite.ModeName,
+		KeySize:        suite.KeySize,
+		NumChunks:      chunksBetween(0, sizeBytes, layout.encryptedChunkSizeBytes()),
+	}
+
+	if layout.checksum {
+		guess.ChunkChecksum = ChecksumCRC32C
+	}
+
+	legacy := guess
+
+	guess.FileID = make([]byte, FileIDSize)
+	guess.ChunkAAD = ChunkAADHeaderIndex
+	guess.Footer = FooterHMACSHA256
+
+	withDigest := guess
+	withDigest.PlaintextHash = make([]byte, suite.NonceSize+sha256.Size+suite.TagSize)
+
+	withKeyCheck := withDigest
+	withKeyCheck.KeyCheck = make([]byte, KeyCheckSize)
+
+	// Since 1.16 the size is recorded too, its digits are close enough to those of the file's
+	withSize := withDigest
+	withSize.PlaintextSize = sizeBytes
+
+	streamed := withDigest
+	streamed.NumChunks = 0
+	streamed.Streamed = true
+
+	for _, header := range []EncryptedFileHeader{withSize, withDigest, guess, withKeyCheck, streamed, legacy} {
+		header.FormatVersion = minimumFormatVersion(&header)
+
+		headerBytes, err := getCompleteEncryptedFileHeaderAsBytes(&header)
+		if err == nil {
+			centers = append(centers, int64(len(headerBytes)))
+		}
+	}
+
+	last := minInt64(recoveryMaxHeaderBytes, sizeBytes)
+	tried := make([]bool, last+1)
+
+	var candidates []int64
+	add := func(offset int64) {
+		if offset >= 2 && offset <= last && !tried[offset] {
+			tried[offset] = true
+			candidates = append(candidates, offset)
+		}
+	}
+
+	if len(window) >= 2 {
+		add(2 + int64(binary.LittleEndian.Uint16(window)))
+	}
+
+	for distance := int64(0); distance <= recoveryScanBytes; distance++ {
+		for _, center := range centers {
+			add(center - distance)
+			add(center + distance)
+		}
+	}
+
+	return candidates
+}
+
+// Checksums are only for sweeps without the key, authentication decides here
+func stripRecoveryChecksum(chunk []byte, checksum bool) []byte {
+	if !checksum {
+		return chunk
+	}
+
+	if len(chunk) < int(CRC32CSize) {
+		return nil
+	}
+
+	return chunk[:len(chunk)-int(CRC32CSize)]
+}
+
+func recoverChunks(source *os.File, target *os.File, layout *recoveryLayout) (RecoveryReport, error) {
+	report := RecoveryReport{
+		FirstChunkOffset: layout.first,
+		ChunkSizeBytes:   layout.chunkSizeBytes,
+		Cipher:           layout.suite.Name,
+		Authentication:   layout.authentication,
+		NumChunks:        layout.numChunks,
+	}
+
+	if layout.markers {
+		return recoverMarkedChunks(source, target, layout, report)
+	}
+
+	encryptedChunkSizeBytes := layout.encryptedChunkSizeBytes()
+	overhead := int64(layout.suite.NonceSize + layout.suite.TagSize)
+
+	for chunkID := uint32(1); chunkID <= layout.numChunks; chunkID++ {
+		offset := layout.first + int64(chunkID-1)*encryptedChunkSizeBytes
+		end := minInt64(offset+encryptedChunkSizeBytes, layout.dataEnd)
+		plaintextOffset := int64(chunkID-1) * layout.chunkSizeBytes
+
+		// A chunk cut short by the end of the file is lost as if it were full
+		plaintextLength := layout.chunkSizeBytes
+		if end > offset && end == layout.dataEnd {
+			plaintextLength = minInt64(layout.chunkSizeBytes, end-offset-overhead)
+			if layout.checksum {
+				plaintextLength -= int64(CRC32CSize)
+			}
+		}
+
+		// Where the header records the size, the last chunk is exactly as long as it was however much of it is left
+		if layout.plaintextSize > 0 && chunkID == layout.numChunks {
+			plaintextLength = layout.plaintextSize - plaintextOffset
+		}
+
+		var plaintext []byte
+
+		if end-offset > overhead {
+			chunk := make([]byte, end-offset)
+
+			_, err := source.ReadAt(chunk, offset)
+			if err != nil && err != io.EOF {
+				return report, fmt.Errorf("could not read chunk %d: %w", chunkID, err)
+			}
+
+			if sealed := stripRecoveryChecksum(chunk, layout.checksum); sealed != nil {
+				plaintext = layout.open(chunkID, layout.final(chunkID, end), sealed)
+			}
+		}
+
+		if plaintextLength < 0 {
+			plaintextLength = 0
+		}
+
+		if plaintext == nil {
+			report.Lost = appendRecoveredRange(report.Lost, plaintextOffset, plaintextLength)
+		} else {
+			_, err := target.WriteAt(plaintext, plaintextOffset)
+			if err != nil {
+				return report, fmt.Errorf("could not write recovered chunk %d: %w", chunkID, err)
+			}
+
+			plaintextLength = int64(len(plaintext))
+			report.ChunksRecovered++
+			report.Recovered = appendRecoveredRange(report.Recovered, plaintextOffset, plaintextLength)
+		}
+
+		report.PlaintextBytes = plaintextOffset + plaintextLength
+	}
+
+	// Lost ranges at the end are zeros too, so every recovered range is where it belongs
+	err := target.Truncate(report.PlaintextBytes)
+	if err != nil {
+		return report, fmt.Errorf("could not size the recovered file: %w", err)
+	}
+
+	return report, nil
+}
+
+/*
+	With markers a chunk is wherever its marker is, not where the chunks
+	before it put it. Each chunk is read from its marker and opened with
+	the ID the marker holds (a wrong ID fails to authenticate), and after
+	a chunk that does not open the next marker is looked for instead of
+	assuming the next chunk follows - damage that added or lost bytes
+	costs the chunks it touched, not every chunk after it
+*/
+func recoverMarkedChunks(source *os.File, target *os.File, layout *recoveryLayout, report RecoveryReport) (RecoveryReport, error) {
+	encryptedChunkSizeBytes := layout.encryptedChunkSizeBytes()
+	chunk := make([]byte, encryptedChunkSizeBytes)
+	recovered := map[uint32]int64{}
+	lastID := layout.numChunks
+
+	offset := layout.first
+	for offset >= 0 && offset < layout.dataEnd {
+		end := minInt64(offset+encryptedChunkSizeBytes, layout.dataEnd)
+		data := chunk[:end-offset]
+
+		_, err := source.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return report, fmt.Errorf("could not read at offset %d: %w", offset, err)
+		}
+
+		var plaintext []byte
+
+		chunkID, ok := readChunkMarker(data)
+		if ok && chunkID > 0 {
+			if sealed := stripRecoveryChecksum(data[chunkMarkerBytes:], layout.checksum); sealed != nil {
+				plaintext = layout.open(chunkID, layout.final(chunkID, end), sealed)
+			}
+		}
+
+		if plaintext == nil {
+			offset, err = findChunkMarker(source, offset+1, layout.dataEnd)
+			if err != nil {
+				return report, err
+			}
+
+			continue
+		}
+
+		// A chunk repeated by whatever damaged the file is only written once
+		if _, seen := recovered[chunkID]; !seen {
+			_, err = target.WriteAt(plaintext, int64(chunkID-1)*layout.chunkSizeBytes)
+			if err != nil {
+				return report, fmt.Errorf("could not write recovered chunk %d: %w", chunkID, err)
+			}
+
+			recovered[chunkID] = int64(len(plaintext))
+			report.ChunksRecovered++
+		}
+
+		if chunkID > lastID {
+			lastID = chunkID
+		}
+
+		offset = end
+	}
+
+	// A lost final chunk is as long as what is left after the others, if nothing moved
+	finalBytes := layout.dataEnd - layout.first - int64(lastID-1)*encryptedChunkSizeBytes - (encryptedChunkSizeBytes - layout.chunkSizeBytes)
+	if finalBytes < 0 || finalBytes > layout.chunkSizeBytes {
+		finalBytes = 0
+	}
+
+	// Unless the header says, when the chunks are the ones it describes
+	if layout.plaintextSize > 0 && lastID == layout.numChunks {
+		finalBytes = layout.plaintextSize - int64(lastID-1)*layout.chunkSizeBytes
+	}
+
+	for chunkID := uint32(1); chunkID <= lastID; chunkID++ {
+		plaintextOffset := int64(chunkID-1) * layout.chunkSizeBytes
+
+		if plaintextLength, ok := recovered[chunkID]; ok {
+			report.Recovered = appendRecoveredRange(report.Recovered, plaintextOffset, plaintextLength)
+			report.PlaintextBytes = plaintextOffset + plaintextLength
+		} else if chunkID < lastID {
+			report.Lost = appendRecoveredRange(report.Lost, plaintextOffset, layout.chunkSizeBytes)
+			report.PlaintextBytes = plaintextOffset + layout.chunkSizeBytes
+		} else if finalBytes > 0 {
+			report.Lost = appendRecoveredRange(report.Lost, plaintextOffset, finalBytes)
+			report.PlaintextBytes = plaintextOffset + finalBytes
+		}
+	}
+
+	report.NumChunks = lastID
+
+	err := target.Truncate(report.PlaintextBytes)
+	if err != nil {
+		return report, fmt.Errorf("could not size the recovered file: %w", err)
+	}
+
+	return report, nil
+}
+
+// Adjacent ranges are merged, reports list runs of chunks rather than every chunk
+func appendRecoveredRange(ranges []RecoveredRange, offset int64, length int64) []RecoveredRange {
+	if last := len(ranges) - 1; last >= 0 && ranges[last].Offset+ranges[last].Length == offset {
+		ranges[last].Length += length
+		return ranges
+	}
+
+	return append(ranges, RecoveredRange{Offset: offset, Length: length})
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+/*
+	AES-GCM chunks whose AAD holds a digest we no longer have. A chunk's
+	tag XOR the tag of its plaintext resealed with the digest and count
+	zeroed is the digest's (and count's) share of GHASH, which for a chunk
+	of n GHASH blocks is a constant times H^n - so every chunk's share,
+	scaled to the length of a full chunk, is the same one
+*/
+type gcmAADRecovery struct {
+	block      cipher.Block
+	aead       cipher.AEAD
+	h          gcmElement
+	fullBlocks int         // The ciphertext of a full chunk, in blocks
+	agreed     *gcmElement // A full chunk's share, once chunks have agreed on it
+}
+
+type gcmElement [16]byte
+
+func newGCMAADRecovery(key []byte, chunkSizeBytes int64) (*gcmAADRecovery, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error attempting to create cipher object: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("internal crypto error creating mode block for cipher: %w", err)
+	}
+
+	recovery := &gcmAADRecovery{block: block, aead: aead, fullBlocks: gcmBlocks(int(chunkSizeBytes))}
+	block.Encrypt(recovery.h[:], recovery.h[:])
+
+	return recovery, nil
+}
+
+// The chunk's plaintext, not yet authenticated, and its share scaled to a full chunk
+func (recovery *gcmAADRecovery) share(chunkID uint32, final bool, sealed []byte) ([]byte, gcmElement) {
+	nonce := sealed[:AESNonceSize]
+	ciphertext := sealed[AESNonceSize : len(sealed)-int(AESTagSize)]
+	tag := sealed[len(sealed)-int(AESTagSize):]
+
+	// GCM's counter for the first block of data is the nonce followed by 2
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, nonce)
+	counter[aes.BlockSize-1] = 2
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(recovery.block, counter).XORKeyStream(plaintext, ciphertext)
+
+	zeroed := EncryptedFileHeader{ChunkAAD: ChunkAADHeaderIndex, digest: make([]byte, sha256.Size)}
+	resealed := recovery.aead.Seal(nil, nonce, plaintext, chunkAdditionalData(&zeroed, chunkID, final))
+
+	var share gcmElement
+	zeroedTag := resealed[len(resealed)-int(AESTagSize):]
+	for i := range share {
+		share[i] = tag[i] ^ zeroedTag[i]
+	}
+
+	// Scaled by H to the power of how many fewer blocks than a full chunk this one has
+	return plaintext, gcmMultiply(share, gcmPower(recovery.h, recovery.fullBlocks-gcmBlocks(len(ciphertext))))
+}
+
+func gcmBlocks(length int) int {
+	return (length + aes.BlockSize - 1) / aes.BlockSize
+}
+
+// Whether two of the chunks agree on their share, which then checks every other chunk - a chunk repeated agrees with itself and proves nothing
+func (recovery *gcmAADRecovery) agree(chunkIDs []uint32, chunks [][]byte, finals []bool) bool {
+	shares := make([]*gcmElement, len(chunks))
+
+	for index, chunk := range chunks {
+		if chunk == nil {
+			continue
+		}
+
+		_, share := recovery.share(chunkIDs[index], finals[index], chunk)
+		shares[index] = &share
+
+		for earlierIndex, earlier := range shares[:index] {
+			if earlier != nil && *earlier == share && chunkIDs[earlierIndex] != chunkIDs[index] {
+				recovery.agreed = earlier
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (recovery *gcmAADRecovery) open(chunkID uint32, final bool, sealed []byte) []byte {
+	if len(sealed) < int(AESNonceSize+AESTagSize) {
+		return nil
+	}
+
+	plaintext, share := recovery.share(chunkID, final, sealed)
+	if recovery.agreed == nil || share != *recovery.agreed {
+		return nil
+	}
+
+	return plaintext
+}
+
+/*
+	Multiplication in GCM's field, GF(2^128) with GCM's bit order (the
+	first bit of a block is the lowest power of x) - NIST SP 800-38D,
+	algorithm 1
+*/
+func gcmMultiply(x gcmElement, y gcmElement) gcmElement {
+	var z gcmElement
+	v := y
+
+	for i := 0; i < 128; i++ {
+		if x[i/8]>>(7-uint(i%8))&1 == 1 {
+			for j := range z {
+				z[j] ^= v[j]
+			}
+		}
+
+		carry := v[15] & 1
+		for j := 15; j > 0; j-- {
+			v[j] = v[j]>>1 | v[j-1]<<7
+		}
+
+		v[0] >>= 1
+		if carry == 1 {
+			v[0] ^= 0xe1
+		}
+	}
+
+	return z
+}
+
+// x to the power n, gcmElement{0x80} is 1
+func gcmPower(x gcmElement, n int) gcmElement {
+	result := gcmElement{0x80}
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			result = gcmMultiply(result, x)
+		}
+
+		x = gcmMultiply(x, x)
+	}
+
+	return result
+}
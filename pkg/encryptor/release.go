@@ -0,0 +1,343 @@
+package encryptor
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+	A binary trusted with keys should be known to be the one that was
+	released. Releases publish a manifest - the version, commit, release
+	time, and the SHA256 of every binary built - with a detached Ed25519
+	signature beside it (<manifest>.sig, base64). The release key is
+	built into release binaries, so a binary can check itself: the
+	signature first, then that its own SHA256 is one the manifest lists
+
+	A tampered binary could of course claim anything about itself, so
+	this guards against corrupted downloads and swapped files, and the
+	SHA256 it prints should be compared with the published one by anyone
+	who cannot trust the binary at all
+
+	Updating is the same check in the other direction: the latest
+	release's manifest is verified, the binary for this platform is
+	downloaded beside the running one, and it only replaces it once its
+	SHA256 is the one the manifest lists
+*/
+
+type ReleaseManifest struct {
+	Version   string
+	GitCommit string
+	Released  time.Time
+	Binaries  []ReleaseBinary
+}
+
+type ReleaseBinary struct {
+	Name   string // e.g. encryptor-linux-amd64
+	SHA256 string // Hex encoded
+	URL    string `json:",omitempty"` // Absolute, or relative to the manifest, defaults to Name beside the manifest
+}
+
+type ReleaseVerification struct {
+	Manifest ReleaseManifest
+	Binary   ReleaseBinary // The manifest's entry for the binary checked
+	SHA256   string        // Of the binary checked
+}
+
+const releaseSignatureSuffix = ".sig"
+const releaseBinaryMaxBytes int64 = 512 * 1024 * 1024
+
+// Binaries are far larger than recipients files, so they get longer to download
+var releaseHTTPClient = &http.Client{Timeout: 10 * time.Minute}
+
+// A release key given as base64 of its 32 bytes, or as an ssh-ed25519 public key line
+func parseReleaseKey(key string) (ed25519.PublicKey, error) {
+	return parseEd25519PublicKey(key, "release key")
+}
+
+// Base64 of the 32 bytes, or an ssh-ed25519 public key line - name says what the key is for in errors
+func parseEd25519PublicKey(key string, name string) (ed25519.PublicKey, error) {
+	key = strings.TrimSpace(key)
+
+	if strings.HasPrefix(key, "ssh-ed25519 ") {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", name, err)
+		}
+
+		cryptoKey, ok := parsed.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an Ed25519 key", name)
+		}
+
+		publicKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an Ed25519 key", name)
+		}
+
+		return publicKey, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s must be %d bytes base64 encoded, or an ssh-ed25519 public key", name, ed25519.PublicKeySize)
+	}
+
+	return ed25519.PublicKey(decoded), nil
+}
+
+func readReleaseFile(name string) ([]byte, error) {
+	if !isRecipientsURL(name) {
+		return os.ReadFile(name)
+	}
+
+	if !strings.HasPrefix(strings.ToLower(name), "https://") {
+		return nil, fmt.Errorf("release URL %q must use https", name)
+	}
+
+	return fetchRecipientsURL(name)
+}
+
+// A manifest is only parsed once its signature verifies with the release key
+func readReleaseManifest(manifestName string, publicKey ed25519.PublicKey) (ReleaseManifest, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return ReleaseManifest{}, errors.New("a release key is needed to verify a release manifest")
+	}
+
+	manifestData, err := readReleaseFile(manifestName)
+	if err != nil {
+		return ReleaseManifest{}, fmt.Errorf("could not read release manifest: %w", err)
+	}
+
+	signatureData, err := readReleaseFile(manifestName + releaseSignatureSuffix)
+	if err != nil {
+		return ReleaseManifest{}, fmt.Errorf("could not read release manifest signature: %w", err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signatureData)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return ReleaseManifest{}, errors.New("release manifest signature is not a base64 encoded Ed25519 signature")
+	}
+
+	// Nothing in the manifest is looked at until it is known to be the one released
+	if !ed25519.Verify(publicKey, manifestData, signature) {
+		return ReleaseManifest{}, errors.New("release manifest signature does not verify with the release key, the manifest is not the one released")
+	}
+
+	var manifest ReleaseManifest
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return ReleaseManifest{}, fmt.Errorf("could not parse release manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+func verifyRelease(binaryFilename string, manifestName string, publicKey ed25519.PublicKey) (ReleaseVerification, error) {
+	manifest, err := readReleaseManifest(manifestName, publicKey)
+	if err != nil {
+		return ReleaseVerification{}, err
+	}
+
+	digest, err := hashFile(binaryFilename)
+	if err != nil {
+		return ReleaseVerification{}, fmt.Errorf("could not hash binary: %w", err)
+	}
+
+	verification := ReleaseVerification{Manifest: manifest, SHA256: digest}
+
+	for _, binary := range manifest.Binaries {
+		if strings.EqualFold(binary.SHA256, digest) {
+			verification.Binary = binary
+			return verification, nil
+		}
+	}
+
+	return verification, fmt.Errorf("the binary's SHA256 %s is not one release %s lists, it is not a binary that was released", digest, manifest.Version)
+}
+
+// Release binaries are named for their platform, e.g. encryptor-linux-amd64 or encryptor-windows-amd64.exe
+func releaseBinaryName(goos string, goarch string) string {
+	name := "encryptor-" + goos + "-" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+
+	return name
+}
+
+func (manifest *ReleaseManifest) binaryFor(goos string, goarch string) (ReleaseBinary, bool) {
+	name := releaseBinaryName(goos, goarch)
+
+	for _, binary := range manifest.Binaries {
+		if binary.Name == name {
+			return binary, true
+		}
+	}
+
+	return ReleaseBinary{}, false
+}
+
+// Where a binary is downloaded from, resolved against the manifest's own location
+func releaseBinaryLocation(manifestName string, binary ReleaseBinary) (string, error) {
+	reference := binary.URL
+	if reference == "" {
+		reference = binary.Name
+	}
+
+	if isRecipientsURL(reference) {
+		return reference, nil
+	}
+
+	if isRecipientsURL(manifestName) {
+		base, err := url.Parse(manifestName)
+		if err != nil {
+			return "", fmt.Errorf("could not parse release manifest URL: %w", err)
+		}
+
+		relative, err := url.Parse(reference)
+		if err != nil {
+			return "", fmt.Errorf("could not parse release binary URL: %w", err)
+		}
+
+		return base.ResolveReference(relative).String(), nil
+	}
+
+	if filepath.IsAbs(reference) {
+		return reference, nil
+	}
+
+	return filepath.Join(filepath.Dir(manifestName), filepath.FromSlash(reference)), nil
+}
+
+func openReleaseBinary(location string) (io.ReadCloser, error) {
+	if !isRecipientsURL(location) {
+		return os.Open(location)
+	}
+
+	if !strings.HasPrefix(strings.ToLower(location), "https://") {
+		return nil, fmt.Errorf("release URL %q must use https", location)
+	}
+
+	response, err := releaseHTTPClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, errors.New("server responded " + response.Status)
+	}
+
+	return response.Body, nil
+}
+
+/*
+	The new binary is written beside the old one, so replacing it is a
+	rename on the same filesystem, and the old one is only replaced once
+	the new one's SHA256 matches the manifest. Windows cannot replace a
+	running binary, but it can rename it - the old one is left as
+	<binary>.old for the next update to remove
+*/
+func installReleaseBinary(binaryFilename string, manifestName string, binary ReleaseBinary, options *Options) error {
+	location, err := releaseBinaryLocation(manifestName, binary)
+	if err != nil {
+		return err
+	}
+
+	if options != nil && options.Offline && isRecipientsURL(location) {
+		return fmt.Errorf("release binary %s is fetched over the network: %w", location, ErrOffline)
+	}
+
+	info, err := os.Stat(binaryFilename)
+	if err != nil {
+		return fmt.Errorf("could not stat the binary to replace: %w", err)
+	}
+
+	source, err := openReleaseBinary(location)
+	if err != nil {
+		return fmt.Errorf("could not download release binary %s: %w", binary.Name, err)
+	}
+
+	defer func(source io.ReadCloser) {
+		_ = source.Close()
+	}(source)
+
+	temporary, err := os.CreateTemp(filepath.Dir(binaryFilename), "."+filepath.Base(binaryFilename)+".update-*")
+	if err != nil {
+		return fmt.Errorf("could not write beside the binary to replace: %w", err)
+	}
+
+	installed := false
+	defer func() {
+		if !installed {
+			_ = temporary.Close()
+			_ = os.Remove(temporary.Name())
+		}
+	}()
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(temporary, hasher), io.LimitReader(source, releaseBinaryMaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("could not download release binary %s: %w", binary.Name, err)
+	}
+
+	if written > releaseBinaryMaxBytes {
+		return fmt.Errorf("release binary %s is larger than %d bytes", binary.Name, releaseBinaryMaxBytes)
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(digest, binary.SHA256) {
+		return fmt.Errorf("the downloaded %s has SHA256 %s, the manifest lists %s, it is not the binary that was released", binary.Name, digest, binary.SHA256)
+	}
+
+	err = temporary.Chmod(info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("could not make the new binary executable: %w", err)
+	}
+
+	err = temporary.Sync()
+	if err != nil {
+		return fmt.Errorf("could not write the new binary: %w", err)
+	}
+
+	err = temporary.Close()
+	if err != nil {
+		return fmt.Errorf("could not write the new binary: %w", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		oldFilename := binaryFilename + ".old"
+		_ = os.Remove(oldFilename)
+
+		err = os.Rename(binaryFilename, oldFilename)
+		if err != nil {
+			return fmt.Errorf("could not move the running binary aside: %w", err)
+		}
+	}
+
+	err = os.Rename(temporary.Name(), binaryFilename)
+	if err != nil {
+		if runtime.GOOS == "windows" {
+			_ = os.Rename(binaryFilename+".old", binaryFilename)
+		}
+
+		return fmt.Errorf("could not replace the binary: %w", err)
+	}
+
+	installed = true
+	return nil
+}
@@ -0,0 +1,447 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	A verification report is the evidence a compliance review asks for
+	of a backup: which encrypted files were checked, how, what was found,
+	and when, in one document that can be attached to the review as it
+	is. Every file under the path reported on is put through the checks
+	encryptor has for it
+
+	- scrub's, which need no key: the header, the size, the header copy,
+	  and the chunk checksums (all of them, or a sample)
+	- verify's, with the key: every chunk, the footer, the plaintext
+	  digest, and any signature authenticated
+	- an audit of the header: parameters that fall short of what files
+	  are written with now (no footer, chunks not bound to their index,
+	  fewer KDF iterations) are findings, and parameters a policy forbids
+	  are violations that fail the file as a failed check does
+
+	The report is written as JSON, or as HTML laid out to print (or be
+	saved as PDF) on A4 and Letter alike. Signed, the signature is over
+	the bytes written, base64 in a file of its own like a detached file
+	signature, so whichever form is attached is the form checked - the
+	report names the key it is signed with, and checking it needs that
+	key from somewhere the reader trusts, not from the report
+*/
+
+const (
+	ReportFormatJSON = "json"
+	ReportFormatHTML = "html"
+)
+
+const reportSignatureLabel = "encryptor/v1/report"
+
+type ReportOptions struct {
+	Authenticate  bool     // Decrypt every file with the key in options, otherwise files are only scrubbed
+	SamplePercent uint     // Of checksummed chunks scrubbing verifies, 0 verifies every one
+	Policies      []Policy // Files are audited against these as well, a violation fails the file
+	Verifier      string   // Left for the caller, e.g. the tool and its version
+}
+
+type VerificationReport struct {
+	Started    time.Time
+	Finished   time.Time
+	Hostname   string `json:",omitempty"`
+	Verifier   string `json:",omitempty"`
+	Parameters ReportParameters
+	Summary    ReportSummary
+	Files      []ReportFile
+}
+
+type ReportParameters struct {
+	Path           string
+	Authenticated  bool     // Files were decrypted with the key, not only scrubbed
+	KeyFingerprint string   `json:",omitempty"` // Of the key files were decrypted with, never of a password
+	SamplePercent  uint     // Of checksummed chunks scrubbing verified
+	SignerKeys     []string `json:",omitempty"` // Files had to be signed by one of these
+	Policies       []Policy `json:",omitempty"`
+	ReportSigner   string   `json:",omitempty"` // The Ed25519 public key the report is signed with, base64
+}
+
+type ReportSummary struct {
+	Files          int
+	Passed         int
+	Failed         int
+	Skipped        int    // Not encrypted files, left out of the report
+	ChunksVerified uint64 // Authenticated with the key, or whose checksums verified
+	Findings       int
+	Violations     int
+	BytesChecked   int64
+}
+
+type ReportFile struct {
+	FileName       string // Relative to the path reported on
+	FileSizeBytes  int64
+	FileID         string `json:",omitempty"` // Hex, from the header
+	FormatVersion  string `json:",omitempty"`
+	Cipher         string `json:",omitempty"`
+	NumChunks      uint32
+	ChunksVerified uint32
+	Authenticated  bool     // Every chunk, the footer, and any signature authenticated with the key
+	Findings       []string `json:",omitempty"` // Short of what files are written with now
+	Violations     []string `json:",omitempty"` // Forbidden by a policy
+	Error          string   `json:",omitempty"`
+	Passed         bool
+}
+
+func reportVerification(path string, report *ReportOptions, options *Options) (VerificationReport, error) {
+	if report == nil || options == nil {
+		return VerificationReport{}, errors.New("report options or options is nil")
+	}
+
+	root := strings.TrimSpace(path)
+	if root == "" {
+		return VerificationReport{}, errors.New("a file or directory to report on must be specified")
+	}
+
+	samplePercent := report.SamplePercent
+	if samplePercent == 0 || samplePercent > 100 {
+		samplePercent = 100
+	}
+
+	result := VerificationReport{
+		Started:  time.Now().UTC(),
+		Verifier: report.Verifier,
+		Parameters: ReportParameters{
+			Path:          root,
+			Authenticated: report.Authenticate,
+			SamplePercent: samplePercent,
+			SignerKeys:    options.SignerKeys,
+			Policies:      report.Policies,
+		},
+	}
+
+	result.Hostname, _ = os.Hostname()
+
+	// A password's fingerprint can be guessed from, only a key's is published
+	if report.Authenticate && options.KeyHex != "" {
+		fingerprint, err := keyFingerprint(options)
+		if err != nil {
+			return result, err
+		}
+
+		result.Parameters.KeyFingerprint = fingerprint
+	}
+
+	candidates, err := reportCandidates(root)
+	if err != nil {
+		return result, err
+	}
+
+	for _, candidate := range candidates {
+		file, encrypted := reportFile(candidate.fileName, candidate.relativeName, samplePercent, report, options)
+
+		// Files we were not asked for by name are only ours if they look like it
+		if !encrypted && !candidate.named && filepath.Ext(candidate.fileName) != ".enc" {
+			result.Summary.Skipped++
+			continue
+		}
+
+		result.Files = append(result.Files, file)
+		result.Summary.Files++
+		result.Summary.ChunksVerified += uint64(file.ChunksVerified)
+		result.Summary.Findings += len(file.Findings)
+		result.Summary.Violations += len(file.Violations)
+		result.Summary.BytesChecked += file.FileSizeBytes
+
+		if file.Passed {
+			result.Summary.Passed++
+		} else {
+			result.Summary.Failed++
+		}
+	}
+
+	result.Finished = time.Now().UTC()
+
+	return result, nil
+}
+
+type reportCandidate struct {
+	fileName     string
+	relativeName string
+	named        bool // The path reported on is the file itself
+}
+
+// Every regular file under root in lexical order, or root when it is a file
+func reportCandidates(root string) ([]reportCandidate, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("could not access %s: %w", root, err)
+	}
+
+	if !info.IsDir() {
+		return []reportCandidate{{fileName: root, relativeName: filepath.Base(root), named: true}}, nil
+	}
+
+	var candidates []reportCandidate
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Scrub's history is not part of the archive
+		if !entry.Type().IsRegular() || entry.Name() == DefaultScrubStateFilename {
+			return nil
+		}
+
+		relativeName, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		candidates = append(candidates, reportCandidate{fileName: path, relativeName: relativeName})
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not walk directory to report on: %w", err)
+	}
+
+	return candidates, nil
+}
+
+// The checks of one file, and whether it is an encrypted file at all
+func reportFile(fileName string, relativeName string, samplePercent uint, report *ReportOptions, options *Options) (ReportFile, bool) {
+	file := ReportFile{FileName: relativeName}
+
+	if stats, err := os.Stat(fileName); err == nil {
+		file.FileSizeBytes = stats.Size()
+	}
+
+	// The header is read whole or not at all, so a failure here is the scrub's to describe
+	if header, _, err := getEncryptedFileHeaderFromFile(fileName); err == nil {
+		file.FileID = hex.EncodeToString(header.FileID)
+	}
+
+	inspection, inspectErr := inspect(fileName)
+	if inspectErr == nil {
+		file.FormatVersion = inspection.FormatVersion
+		file.Cipher = inspection.Cipher
+		file.NumChunks = inspection.NumChunks
+		file.Findings = auditFindings(&inspection)
+
+		for _, policy := range report.Policies {
+			file.Violations = append(file.Violations, policy.FileViolations(&inspection)...)
+		}
+	}
+
+	budget := scrubBudget{}
+	err := scrubFile(fileName, samplePercent, false, &budget)
+	if errors.Is(err, ErrNotEncryptedFile) {
+		file.Error = err.Error()
+		return file, false
+	}
+
+	file.ChunksVerified = budget.checked
+
+	if err == nil && report.Authenticate {
+		err = Verify(fileName, options)
+		if err == nil {
+			file.Authenticated = true
+			file.ChunksVerified = file.NumChunks
+		}
+	}
+
+	if err != nil {
+		file.Error = err.Error()
+	}
+
+	file.Passed = err == nil && len(file.Violations) == 0
+
+	return file, true
+}
+
+// What the header lacks that files are written with now, each a reason to re-encrypt the file some day
+func auditFindings(inspection *FileInspection) []string {
+	var findings []string
+
+	if !inspection.Supported {
+		findings = append(findings, fmt.Sprintf("format version %s is not supported by this build", inspection.FormatVersion))
+	}
+
+	if inspection.HeaderFromCopy {
+		findings = append(findings, "the header is damaged, it was read from its copy at the end of the file")
+	}
+
+	if inspection.ChunkAAD == "" {
+		findings = append(findings, "chunks do not authenticate their index or the chunk count (format 1.8), chunks could be reordered or dropped from the end unnoticed")
+	}
+
+	if inspection.Footer == "" {
+		findings = append(findings, "no footer authenticates the whole file (format 1.9)")
+	}
+
+	if inspection.KeySource == KeySourcePassword && inspection.KDFIterations < PasswordKDFIterations {
+		findings = append(findings, fmt.Sprintf("the password key was derived with %d iterations, new files use %d", inspection.KDFIterations, PasswordKDFIterations))
+	}
+
+	return findings
+}
+
+func renderReport(report *VerificationReport, format string, options *Options) ([]byte, string, error) {
+	if report == nil || options == nil {
+		return nil, "", errors.New("report or options is nil")
+	}
+
+	var privateKey ed25519.PrivateKey
+	if options.SigningKey != "" {
+		var err error
+		privateKey, err = loadSigningKey(options.SigningKey, options.PromptSecret)
+		if err != nil {
+			return nil, "", err
+		}
+
+		report.Parameters.ReportSigner = base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	}
+
+	var data []byte
+	var err error
+
+	switch format {
+	case ReportFormatJSON, "":
+		data, err = json.MarshalIndent(report, "", "\t")
+		data = append(data, '\n')
+	case ReportFormatHTML:
+		var buffer bytes.Buffer
+		err = reportTemplate.Execute(&buffer, report)
+		data = buffer.Bytes()
+	default:
+		return nil, "", fmt.Errorf("unknown report format %q, use %s or %s", format, ReportFormatJSON, ReportFormatHTML)
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("could not render report: %w", err)
+	}
+
+	if privateKey == nil {
+		return data, "", nil
+	}
+
+	signature := ed25519.Sign(privateKey, reportSignedMessage(data))
+
+	return data, base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Signatures are over the SHA256 of the report, prefixed so one can never pass for a file's signature
+func reportSignedMessage(data []byte) []byte {
+	digest := sha256.Sum256(data)
+	return append([]byte(reportSignatureLabel), digest[:]...)
+}
+
+func verifyReportSignature(data []byte, signature string, signers []string) error {
+	publicKeys, err := parseSignerKeys(signers)
+	if err != nil {
+		return err
+	}
+
+	if len(publicKeys) == 0 {
+		return errors.New("a signer is needed to check a report's signature, the key the report names is whatever its author chose")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(decoded) != ed25519.SignatureSize {
+		return errors.New("report signature is not a base64 encoded Ed25519 signature")
+	}
+
+	message := reportSignedMessage(data)
+	for _, publicKey := range publicKeys {
+		if ed25519.Verify(publicKey, message, decoded) {
+			return nil
+		}
+	}
+
+	return errors.New("report signature does not verify with any signer, the report was changed or signed by someone else")
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Backup verification report {{timestamp .Finished}}</title>
+<style>
+@page { size: auto; margin: 15mm; }
+body { font-family: sans-serif; font-size: 10pt; color: #000; }
+h1 { font-size: 16pt; margin-bottom: 2mm; }
+h2 { font-size: 12pt; margin-top: 6mm; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #888; padding: 1mm 2mm; text-align: left; vertical-align: top; }
+th { background: #eee; }
+thead { display: table-header-group; }
+tr { page-break-inside: avoid; }
+td.number { text-align: right; }
+.passed { color: #060; }
+.failed { color: #a00; font-weight: bold; }
+code { font-size: 9pt; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Backup verification report</h1>
+<table>
+<tr><th>Path</th><td><code>{{.Parameters.Path}}</code></td></tr>
+<tr><th>Started</th><td>{{timestamp .Started}}</td></tr>
+<tr><th>Finished</th><td>{{timestamp .Finished}}</td></tr>
+<tr><th>Host</th><td>{{.Hostname}}</td></tr>
+<tr><th>Verifier</th><td>{{.Verifier}}</td></tr>
+<tr><th>Checks</th><td>{{if .Parameters.Authenticated}}decrypted and authenticated with the key{{else}}scrubbed without the key{{end}}, {{.Parameters.SamplePercent}}% of chunk checksums</td></tr>
+{{- if .Parameters.KeyFingerprint}}
+<tr><th>Key fingerprint</th><td><code>{{.Parameters.KeyFingerprint}}</code></td></tr>
+{{- end}}
+{{- range .Parameters.SignerKeys}}
+<tr><th>Required signer</th><td><code>{{.}}</code></td></tr>
+{{- end}}
+{{- range .Parameters.Policies}}
+<tr><th>Policy</th><td>{{if .MinimumKDFIterations}}at least {{.MinimumKDFIterations}} KDF iterations; {{end}}{{if .AllowedCiphers}}ciphers {{range $i, $cipher := .AllowedCiphers}}{{if $i}}, {{end}}{{$cipher}}{{end}}; {{end}}{{if .RequireVerification}}chunk checksums required{{end}}</td></tr>
+{{- end}}
+{{- if .Parameters.ReportSigner}}
+<tr><th>Report signed by</th><td><code>{{.Parameters.ReportSigner}}</code> (Ed25519)</td></tr>
+{{- end}}
+</table>
+<h2>Summary</h2>
+<table>
+<tr><th>Files</th><th>Passed</th><th>Failed</th><th>Skipped</th><th>Chunks verified</th><th>Findings</th><th>Violations</th><th>Bytes checked</th></tr>
+<tr><td class="number">{{.Summary.Files}}</td><td class="number">{{.Summary.Passed}}</td><td class="number">{{.Summary.Failed}}</td><td class="number">{{.Summary.Skipped}}</td><td class="number">{{.Summary.ChunksVerified}}</td><td class="number">{{.Summary.Findings}}</td><td class="number">{{.Summary.Violations}}</td><td class="number">{{.Summary.BytesChecked}}</td></tr>
+</table>
+<h2>Files</h2>
+<table>
+<thead>
+<tr><th>File</th><th>Size</th><th>Format</th><th>Cipher</th><th>Chunks verified</th><th>Result</th></tr>
+</thead>
+<tbody>
+{{- range .Files}}
+<tr>
+<td><code>{{.FileName}}</code><br><small>{{.FileID}}</small></td>
+<td class="number">{{.FileSizeBytes}}</td>
+<td>{{.FormatVersion}}</td>
+<td>{{.Cipher}}</td>
+<td class="number">{{.ChunksVerified}} of {{.NumChunks}}</td>
+<td>{{if .Passed}}<span class="passed">passed</span>{{else}}<span class="failed">FAILED</span>{{end}}{{if .Authenticated}}, authenticated{{end}}
+{{- if .Error}}<br>{{.Error}}{{end}}
+{{- range .Violations}}<br>violation: {{.}}{{end}}
+{{- range .Findings}}<br>finding: {{.}}{{end}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,201 @@
+package encryptor
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+	RSA public keys from an existing PKI as recipients - the file key is
+	encrypted with RSA-OAEP (SHA-256), as for ssh-rsa but with a label of
+	its own. A recipient is a file holding a certificate, a public key
+	(SubjectPublicKeyInfo), or a PKCS#1 public key, as PEM or DER - for a
+	PEM file of several (e.g. a certificate chain) the first, the leaf,
+	is the recipient
+
+	The stanza names the key by the SHA256 of its DER SubjectPublicKeyInfo
+	(openssl pkey -pubin -outform DER | sha256sum finds it), and decrypting
+	needs the private key file, PKCS#1 or PKCS#8 as PEM or DER - keys
+	encrypted with a passphrase must be decrypted with openssl first, and
+	keys kept in an HSM are not reachable from here
+*/
+
+const RecipientTypeRSAOAEP = "rsa-oaep"
+
+const rsaOAEPLabel = "encryptor/v1/rsa-oaep"
+
+// Smaller keys are refused, as FIPS 140-3 refuses them
+const rsaMinimumKeyBits = 2048
+
+func rsaKeyFingerprint(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("could not encode RSA public key: %w", err)
+	}
+
+	digest := sha256.Sum256(der)
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:]), nil
+}
+
+func parseRSARecipient(fileName string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not read RSA recipient: %w", err)
+	}
+
+	der := data
+	blockType := ""
+
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+		blockType = block.Type
+	}
+
+	var key interface{}
+
+	switch blockType {
+	case "CERTIFICATE":
+		key, err = parseRSACertificateKey(der)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(der)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(der)
+	case "":
+		// DER says nothing of what it holds, so each is tried
+		if key, err = parseRSACertificateKey(der); err != nil {
+			if key, err = x509.ParsePKIXPublicKey(der); err != nil {
+				key, err = x509.ParsePKCS1PublicKey(der)
+			}
+		}
+	default:
+		err = fmt.Errorf("a PEM %q block is not a certificate or public key", blockType)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse RSA recipient %s: %w", fileName, err)
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("RSA recipient %s is not an RSA key", fileName)
+	}
+
+	if publicKey.N.BitLen() < rsaMinimumKeyBits {
+		return nil, fmt.Errorf("RSA recipient %s is a %d bit key, at least %d bits are needed", fileName, publicKey.N.BitLen(), rsaMinimumKeyBits)
+	}
+
+	return publicKey, nil
+}
+
+func parseRSACertificateKey(der []byte) (interface{}, error) {
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return certificate.PublicKey, nil
+}
+
+func wrapFileKeyRSAOAEP(fileKey []byte, publicKey *rsa.PublicKey) (RecipientStanza, error) {
+	fingerprint, err := rsaKeyFingerprint(publicKey)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	body, err := rsa.EncryptOAEP(sha256.New(), randomReader, publicKey, fileKey, []byte(rsaOAEPLabel))
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not wrap file key with RSA key: %w", err)
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeRSAOAEP,
+		Args: []string{fingerprint},
+		Body: base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+func unwrapFileKeyRSAOAEP(stanza RecipientStanza, identities []*rsa.PrivateKey) ([]byte, error) {
+	if len(stanza.Args) < 1 {
+		return nil, errors.New("malformed rsa-oaep stanza")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed rsa-oaep stanza: %w", err)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("no RSA identity was given, use --rsa-identity")
+	}
+
+	for _, privateKey := range identities {
+		fingerprint, err := rsaKeyFingerprint(&privateKey.PublicKey)
+		if err != nil || fingerprint != stanza.Args[0] {
+			continue
+		}
+
+		return rsa.DecryptOAEP(sha256.New(), nil, privateKey, body, []byte(rsaOAEPLabel))
+	}
+
+	return nil, fmt.Errorf("no RSA identity matches %s", stanza.Args[0])
+}
+
+func loadRSAIdentities(fileNames []string) ([]*rsa.PrivateKey, error) {
+	var identities []*rsa.PrivateKey
+
+	for _, fileName := range fileNames {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("could not read RSA identity: %w", err)
+		}
+
+		der := data
+		blockType := ""
+
+		if block, _ := pem.Decode(data); block != nil {
+			der = block.Bytes
+			blockType = block.Type
+
+			if _, encrypted := block.Headers["Proc-Type"]; encrypted {
+				blockType = "ENCRYPTED PRIVATE KEY"
+			}
+		}
+
+		var key interface{}
+
+		switch blockType {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(der)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(der)
+		case "ENCRYPTED PRIVATE KEY":
+			err = errors.New("the key is encrypted with a passphrase, decrypt it with openssl first")
+		case "":
+			if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+				key, err = x509.ParsePKCS1PrivateKey(der)
+			}
+		default:
+			err = fmt.Errorf("a PEM %q block is not a private key", blockType)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse RSA identity %s: %w", fileName, err)
+		}
+
+		privateKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("RSA identity %s is not an RSA key", fileName)
+		}
+
+		identities = append(identities, privateKey)
+	}
+
+	return identities, nil
+}
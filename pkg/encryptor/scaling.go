@@ -0,0 +1,342 @@
+package encryptor
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+/*
+	A fixed number of executors is a guess made before the job starts -
+	too few and chunks that have been read wait for a core, too many and
+	they wait on reads (or on the writer) while holding memory and
+	contending for caches. With Options.ScaleExecutors, Executors becomes
+	a cap and the execute stage follows the bottleneck as the job runs
+
+	Every executor up to the cap is started, but only the active ones
+	take work: batches are claimed from a shared cursor, in order, so
+	a parked executor costs nothing and ordering is kept as it is with
+	fixed workers. Half the cap starts active. Every scaleInterval the
+	stage is sampled - chunks read and waiting for an executor, chunks
+	executed and waiting for the writer, how long executors waited on
+	reads, and chunks executed per second - and one executor is added or
+	parked (see scalingStep)
+
+		reads waiting on executors      - one more, up to the cap
+		executors waiting on reads      - one fewer
+		the writer behind the executors - one fewer, executing faster only fills memory
+		an executor added, no faster    - parked again, and none added for a while
+
+	Executors park at the end of a batch, never in the middle of one.
+	Each decision is kept, with what it was made on, in the job's
+	MemoryReport for tuning. A worker pool already takes whichever task
+	is ready and cannot be combined with scaling
+*/
+
+const scaleInterval = 200 * time.Millisecond
+
+// Intervals without growth once an executor added did not help
+const scaleHoldIntervals = 5
+
+// Throughput must rise by this much for an executor added to be kept
+const scaleGainMin = 1.05
+
+type ScalingDecision struct {
+	Elapsed         time.Duration
+	Executors       uint   // Active once the decision was made
+	Reason          string // Why, e.g. reads waiting on executors
+	ChunksPerSecond float64
+	ReadQueue       uint // Chunks read and waiting for an executor, counted up to a window
+	WriteQueue      uint // Chunks executed and waiting for the writer, counted up to a window
+}
+
+// What a scaling decision is made on, sampled once an interval
+type scalingSample struct {
+	active          uint
+	maxWorkers      uint
+	batchChunks     uint
+	readQueue       uint
+	writeQueue      uint
+	waitFraction    float64 // Of the active executors' time, spent waiting on reads
+	chunksPerSecond float64
+	grewFrom        float64 // Chunks per second before the last executor was added, 0 when the last decision was not one
+	hold            uint    // Intervals left without growth
+}
+
+type executorScaler struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	numChunks   uint
+	numBatches  uint
+	batchChunks uint
+	nextBatch   uint
+	active      uint
+	maxWorkers  uint
+	failed      bool
+	executed    uint          // Chunks, since the last sample
+	waited      time.Duration // On reads, since the last sample
+	grewFrom    float64
+	hold        uint
+	start       time.Time
+	lastSample  time.Time
+	decisions   []ScalingDecision
+}
+
+// nil when scaling is off, maxWorkers is the cap
+func newExecutorScaler(scale bool, numChunks uint, batchChunks uint, maxWorkers uint) *executorScaler {
+	if !scale {
+		return nil
+	}
+
+	if batchChunks < 1 {
+		batchChunks = 1
+	}
+
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+
+	scaler := &executorScaler{
+		numChunks:   numChunks,
+		numBatches:  (numChunks + batchChunks - 1) / batchChunks,
+		batchChunks: batchChunks,
+		nextBatch:   1,
+		active:      (maxWorkers + 1) / 2,
+		maxWorkers:  maxWorkers,
+	}
+	scaler.cond = sync.NewCond(&scaler.mutex)
+
+	return scaler
+}
+
+// Blocks while the executor is parked, false once every batch is claimed or an executor has failed
+func (scaler *executorScaler) next(id uint) (uint, bool) {
+	scaler.mutex.Lock()
+	defer scaler.mutex.Unlock()
+
+	for id > scaler.active && !scaler.failed && scaler.nextBatch <= scaler.numBatches {
+		scaler.cond.Wait()
+	}
+
+	if scaler.failed || scaler.nextBatch > scaler.numBatches {
+		return 0, false
+	}
+
+	batch := scaler.nextBatch
+	scaler.nextBatch++
+
+	// Parked executors have nothing left to wait for
+	if scaler.nextBatch > scaler.numBatches {
+		scaler.cond.Broadcast()
+	}
+
+	return batch, true
+}
+
+func (scaler *executorScaler) chunkDone(waited time.Duration) {
+	scaler.mutex.Lock()
+	scaler.executed++
+	scaler.waited += waited
+	scaler.mutex.Unlock()
+}
+
+func (scaler *executorScaler) fail() {
+	scaler.mutex.Lock()
+	scaler.failed = true
+	scaler.cond.Broadcast()
+	scaler.mutex.Unlock()
+}
+
+func (scaler *executorScaler) begin() {
+	scaler.mutex.Lock()
+	scaler.start = time.Now()
+	scaler.lastSample = scaler.start
+	scaler.decisions = append(scaler.decisions, ScalingDecision{Executors: scaler.active, Reason: "started with half the cap"})
+	scaler.mutex.Unlock()
+}
+
+// Samples the stage and applies a decision, queues are read from the channels without taking from them
+func (scaler *executorScaler) sample(executeChannels []chan *[]byte, writeChannels []chan *[]byte) {
+	scaler.mutex.Lock()
+	defer scaler.mutex.Unlock()
+
+	now := time.Now()
+	interval := now.Sub(scaler.lastSample)
+	if interval <= 0 {
+		return
+	}
+
+	// Chunks claimed so far end here, what is read beyond waits on an executor and what is executed before waits on the writer
+	claimed := (scaler.nextBatch - 1) * scaler.batchChunks
+	if claimed > scaler.numChunks {
+		claimed = scaler.numChunks
+	}
+
+	window := 2 * scaler.maxWorkers * scaler.batchChunks
+
+	sample := scalingSample{
+		active:          scaler.active,
+		maxWorkers:      scaler.maxWorkers,
+		batchChunks:     scaler.batchChunks,
+		readQueue:       queuedChunks(executeChannels, claimed, claimed+window),
+		chunksPerSecond: float64(scaler.executed) / interval.Seconds(),
+		waitFraction:    float64(scaler.waited) / float64(interval*time.Duration(scaler.active)),
+		grewFrom:        scaler.grewFrom,
+		hold:            scaler.hold,
+	}
+
+	if claimed > window {
+		sample.writeQueue = queuedChunks(writeChannels, claimed-window, claimed)
+	} else {
+		sample.writeQueue = queuedChunks(writeChannels, 0, claimed)
+	}
+
+	scaler.executed = 0
+	scaler.waited = 0
+	scaler.lastSample = now
+
+	if scaler.hold > 0 {
+		scaler.hold--
+	}
+
+	change, reason := scalingStep(sample)
+
+	scaler.grewFrom = 0
+	if change == 0 {
+		return
+	}
+
+	if change > 0 {
+		scaler.active++
+		scaler.grewFrom = sample.chunksPerSecond
+	} else {
+		scaler.active--
+
+		if sample.grewFrom > 0 {
+			scaler.hold = scaleHoldIntervals
+		}
+	}
+
+	scaler.decisions = append(scaler.decisions, ScalingDecision{
+		Elapsed:         now.Sub(scaler.start),
+		Executors:       scaler.active,
+		Reason:          reason,
+		ChunksPerSecond: sample.chunksPerSecond,
+		ReadQueue:       sample.readQueue,
+		WriteQueue:      sample.writeQueue,
+	})
+
+	scaler.cond.Broadcast()
+}
+
+func (scaler *executorScaler) decisionsMade() []ScalingDecision {
+	if scaler == nil {
+		return nil
+	}
+
+	scaler.mutex.Lock()
+	defer scaler.mutex.Unlock()
+
+	return append([]ScalingDecision(nil), scaler.decisions...)
+}
+
+// Chunks in [first, last) whose channel holds one, chunk indexes start at 0 here
+func queuedChunks(channels []chan *[]byte, first uint, last uint) uint {
+	if last > uint(len(channels)) {
+		last = uint(len(channels))
+	}
+
+	queued := uint(0)
+	for i := first; i < last; i++ {
+		if len(channels[i]) > 0 {
+			queued++
+		}
+	}
+
+	return queued
+}
+
+// One executor more (1), fewer (-1), or as it is (0), and why
+func scalingStep(sample scalingSample) (int, string) {
+	if sample.active > 1 && sample.grewFrom > 0 && sample.chunksPerSecond < sample.grewFrom*scaleGainMin {
+		return -1, "the last executor added did not raise throughput"
+	}
+
+	if sample.active > 1 && sample.writeQueue >= 2*sample.active*sample.batchChunks {
+		return -1, "the writer is behind the executors"
+	}
+
+	if sample.active > 1 && sample.waitFraction > 0.5 {
+		return -1, "executors waiting on reads"
+	}
+
+	if sample.active < sample.maxWorkers && sample.hold == 0 && sample.readQueue >= sample.active*sample.batchChunks {
+		return 1, "reads waiting on executors"
+	}
+
+	return 0, ""
+}
+
+// Stands in for executeWorker when scaling, claiming batches until there are none left
+func scaledExecuteWorker(op OperationEnum, cipherEnum CipherEnum, mode CipherModeEnum, keyMaterial []byte, chunkChecksum bool, fileHeader *EncryptedFileHeader, auth *fileAuthenticator, tree *merkleLeaves, prefetch *prefetchWindow, scaler *executorScaler, ch chan<- error, id uint, executeChannels []chan *[]byte, writeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() {
+		if err != nil {
+			scaler.fail()
+		}
+
+		ch <- err
+	}()
+	defer recoverWorkerPanic(fmt.Sprintf("execute worker %d", id), &err)
+
+	numChunks := uint(len(executeChannels))
+
+	for {
+		batch, ok := scaler.next(id)
+		if !ok {
+			return
+		}
+
+		last := batch * scaler.batchChunks
+		if last > numChunks {
+			last = numChunks
+		}
+
+		for i := (batch-1)*scaler.batchChunks + 1; i <= last; i++ {
+			waitStart := time.Now()
+			chunkData := <-executeChannels[i-1]
+			close(executeChannels[i-1])
+			waited := time.Since(waitStart)
+
+			// Makes room for the prefetch stage to read another chunk ahead
+			prefetch.consumed()
+
+			chunkData, err = executeChunk(op, cipherEnum, mode, keyMaterial, chunkChecksum, fileHeader, auth, tree, i, numChunks, chunkData)
+			if err != nil {
+				return
+			}
+
+			writeChannels[i-1] <- chunkData
+			scaler.chunkDone(waited)
+		}
+
+		// Yield once per batch rather than once per chunk
+		runtime.Gosched()
+	}
+}
+
+// Samples the stage until done is closed
+func runExecutorScaler(scaler *executorScaler, done <-chan struct{}, executeChannels []chan *[]byte, writeChannels []chan *[]byte) {
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			scaler.sample(executeChannels, writeChannels)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package encryptor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Scrubbing walks a directory of encrypted files and checks them without
+	the key - headers must parse, file sizes must match what the header
+	describes, and chunks written with --chunk-crc have their checksums
+	verified (all of them, or a random sample)
+
+	Runs are meant to be scheduled (cron, systemd timers) against large
+	archives, so they are bounded by --max-runtime and --max-bytes and the
+	files checked least recently are checked first - over several runs the
+	whole archive is covered. Results are kept in a state file so that a
+	file which verified before and fails now is reported as newly failing,
+	which is usually the first sign of deteriorating media
+*/
+
+const DefaultScrubStateFilename = ".encryptor-scrub.json"
+
+type ScrubFileState struct {
+	LastVerified time.Time `json:",omitempty"`
+	LastFailed   time.Time `json:",omitempty"`
+	LastError    string    `json:",omitempty"`
+	Failures     uint
+}
+
+type ScrubState struct {
+	Files map[string]*ScrubFileState
+}
+
+type ScrubReport struct {
+	Passed       []string
+	Failed       []string
+	NewlyFailing []string
+	Skipped      []string
+	Deferred     []string
+	BytesRead    int64
+	Elapsed      time.Duration
+}
+
+type scrubBudget struct {
+	deadline time.Time
+	maxBytes int64
+	used     int64
+	checked  uint32 // Chunks whose checksums verified
+}
+
+// Checked before each file, a file that has been started is finished unless the deadline passes
+func (budget *scrubBudget) exhausted() bool {
+	return budget.pastDeadline() || (budget.maxBytes > 0 && budget.used >= budget.maxBytes)
+}
+
+func (budget *scrubBudget) pastDeadline() bool {
+	return !budget.deadline.IsZero() && time.Now().After(budget.deadline)
+}
+
+var errScrubBudgetExhausted = errors.New("scrub budget exhausted")
+
+func Scrub(directory string, options *ScrubOptions) (ScrubReport, error) {
+	if options == nil {
+		return ScrubReport{}, errors.New("options is nil")
+	}
+
+	root := strings.TrimSpace(directory)
+	if root == "" {
+		return ScrubReport{}, errors.New("a directory to scrub must be specified")
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return ScrubReport{}, fmt.Errorf("could not access directory to scrub: %w", err)
+	}
+
+	if !info.IsDir() {
+		return ScrubReport{}, errors.New("scrub target is not a directory")
+	}
+
+	stateFilename := options.StateFilename
+	if stateFilename == "" {
+		stateFilename = filepath.Join(root, DefaultScrubStateFilename)
+	}
+
+	state, err := loadScrubState(stateFilename)
+	if err != nil {
+		return ScrubReport{}, err
+	}
+
+	candidates, err := scrubCandidates(root, stateFilename, state)
+	if err != nil {
+		return ScrubReport{}, err
+	}
+
+	report := ScrubReport{}
+	start := time.Now()
+	budget := scrubBudget{maxBytes: options.MaxBytes}
+	if options.MaxRuntime > 0 {
+		budget.deadline = start.Add(options.MaxRuntime)
+	}
+
+	samplePercent := options.SamplePercent
+	if samplePercent == 0 || samplePercent > 100 {
+		samplePercent = 100
+	}
+
+	for _, relativeName := range candidates {
+		if budget.exhausted() {
+			report.Deferred = append(report.Deferred, relativeName)
+			continue
+		}
+
+		fileState, known := state.Files[relativeName]
+		err := scrubFile(filepath.Join(root, relativeName), samplePercent, options.RandomOrder, &budget)
+
+		// Files we have never seen pass are only ours if they look like it
+		if errors.Is(err, ErrNotEncryptedFile) && !known && filepath.Ext(relativeName) != ".enc" {
+			report.Skipped = append(report.Skipped, relativeName)
+			continue
+		}
+
+		if errors.Is(err, errScrubBudgetExhausted) {
+			report.Deferred = append(report.Deferred, relativeName)
+			continue
+		}
+
+		if !known {
+			fileState = &ScrubFileState{}
+			state.Files[relativeName] = fileState
+		}
+
+		if err != nil {
+			if !fileState.LastVerified.IsZero() && fileState.LastVerified.After(fileState.LastFailed) {
+				report.NewlyFailing = append(report.NewlyFailing, relativeName)
+			}
+
+			fileState.LastFailed = time.Now().UTC()
+			fileState.LastError = err.Error()
+			fileState.Failures++
+			report.Failed = append(report.Failed, relativeName+": "+err.Error())
+			continue
+		}
+
+		fileState.LastVerified = time.Now().UTC()
+		fileState.LastError = ""
+		report.Passed = append(report.Passed, relativeName)
+	}
+
+	report.BytesRead = budget.used
+	report.Elapsed = time.Since(start)
+
+	// Forget files that no longer exist so the state file does not grow forever
+	present := make(map[string]bool, len(candidates))
+	for _, name := range candidates {
+		present[name] = true
+	}
+
+	for name := range state.Files {
+		if !present[name] {
+			delete(state.Files, name)
+		}
+	}
+
+	err = saveScrubState(stateFilename, state)
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+/*
+	Previously failing files come first (is it getting worse?), then files
+	that have never been verified, then everything else, least recently
+	verified first
+*/
+func scrubCandidates(root string, stateFilename string, state ScrubState) ([]string, error) {
+	var candidates []string
+
+	stateAbs, _ := filepath.Abs(stateFilename)
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		if abs, _ := filepath.Abs(path); abs == stateAbs || abs == stateAbs+".tmp" {
+			return nil
+		}
+
+		relativeName, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		candidates = append(candidates, relativeName)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not walk directory to scrub: %w", err)
+	}
+
+	priority := func(name string) (int, time.Time) {
+		fileState, ok := state.Files[name]
+		if !ok {
+			return 1, time.Time{}
+		}
+
+		if fileState.LastFailed.After(fileState.LastVerified) {
+			return 0, fileState.LastFailed
+		}
+
+		if fileState.LastVerified.IsZero() {
+			return 1, time.Time{}
+		}
+
+		return 2, fileState.LastVerified
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		rankI, timeI := priority(candidates[i])
+		rankJ, timeJ := priority(candidates[j])
+
+		if rankI != rankJ {
+			return rankI < rankJ
+		}
+
+		return timeI.Before(timeJ)
+	})
+
+	return candidates, nil
+}
+
+func scrubFile(fileName string, samplePercent uint, randomOrder bool, budget *scrubBudget) error {
+	header, endOfHeader, err := getEncryptedFileHeaderFromFile(fileName)
+	if err != nil {
+		// A file whose header cannot be read at all is not ours either
+		if !errors.Is(err, ErrNotEncryptedFile) {
+			err = fmt.Errorf("%w: %s", ErrNotEncryptedFile, err.Error())
+		}
+
+		return err
+	}
+
+	if !isSupportedFormatVersion(header.FormatVersion) {
+		return fmt.Errorf("unsupported format version %q", header.FormatVersion)
+	}
+
+	stats, err := getStatsFromFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	payloadBytes := stats.Size() - int64(endOfHeader) - footerSizeBytes(&header) - signatureSizeBytes(&header) - headerCopySizeBytes(&header, endOfHeader)
+
+	numChunks, err := chunkCount(&header, payloadBytes)
+	if err != nil {
+		return err
+	}
+
+	if numChunks == 0 || header.ChunkSizeBytes <= 0 {
+		return errors.New("header describes no chunks")
+	}
+
+	// Decryption falls back to the copy on its own, so a damaged header or copy is only ever noticed here
+	if header.HeaderCopy != "" {
+		err = verifyHeaderCopy(fileName, stats.Size(), numChunks)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Every chunk but the last is full, and the last holds at least one byte (streamed files may end with an empty chunk)
+	lastChunkMinimumBytes := chunkOverheadBytes(&header) + 1
+	if header.Streamed {
+		lastChunkMinimumBytes = chunkOverheadBytes(&header)
+	}
+
+	encryptedChunkSizeBytes := header.ChunkSizeBytes + chunkOverheadBytes(&header)
+	minimumBytes := int64(numChunks-1)*encryptedChunkSizeBytes + lastChunkMinimumBytes
+	maximumBytes := int64(numChunks) * encryptedChunkSizeBytes
+
+	if payloadBytes < minimumBytes {
+		return fmt.Errorf("file is truncated, expected at least %d bytes of chunk data, found %d", minimumBytes, payloadBytes)
+	}
+
+	if payloadBytes > maximumBytes {
+		return fmt.Errorf("file is larger than its header describes, expected at most %d bytes of chunk data, found %d", maximumBytes, payloadBytes)
+	}
+
+	budget.used += int64(endOfHeader)
+
+	// Without checksums or markers the structure is all we can check without the key
+	checksummed := header.ChunkChecksum == ChecksumCRC32C
+	if !checksummed && header.ChunkMarkers == "" {
+		return nil
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	chunkData := make([]byte, encryptedChunkSizeBytes)
+
+	for _, i := range scrubChunkOrder(numChunks, randomOrder) {
+		if samplePercent < 100 && uint(rand.Intn(100)) >= samplePercent {
+			continue
+		}
+
+		if budget.pastDeadline() {
+			return errScrubBudgetExhausted
+		}
+
+		rangeStart := int64(endOfHeader) + int64(i)*encryptedChunkSizeBytes
+		rangeEnd := rangeStart + encryptedChunkSizeBytes
+		if rangeEnd > int64(endOfHeader)+payloadBytes {
+			rangeEnd = int64(endOfHeader) + payloadBytes
+		}
+
+		// Only the marker is read when there is no checksum to check
+		if !checksummed {
+			rangeEnd = rangeStart + chunkMarkerBytes
+		}
+
+		chunk := chunkData[:rangeEnd-rangeStart]
+
+		_, err = file.ReadAt(chunk, rangeStart)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("could not read chunk %d: %w", i+1, err)
+		}
+
+		budget.used += int64(len(chunk))
+
+		if header.ChunkMarkers != "" {
+			chunk, err = stripChunkMarker(i+1, chunk)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !checksummed {
+			continue
+		}
+
+		_, err = stripChecksumCRC32C(chunk)
+		if err != nil {
+			return fmt.Errorf("chunk %d is corrupt: %w", i+1, err)
+		}
+
+		budget.checked++
+	}
+
+	return nil
+}
+
+/*
+	Front to back unless asked otherwise - media that should not be
+	hammered sequentially (some flash, SMR disks) get a shuffled order
+	that still visits every chunk exactly once
+
+	File jobs always read and write in order, the single writer appends
+	as it goes, so shuffling them waits on positional writes and a reorder
+	buffer
+*/
+func scrubChunkOrder(numChunks uint32, randomOrder bool) []uint32 {
+	order := make([]uint32, numChunks)
+	for i := range order {
+		order[i] = uint32(i)
+	}
+
+	if randomOrder {
+		rand.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+
+	return order
+}
+
+func loadScrubState(fileName string) (ScrubState, error) {
+	state := ScrubState{Files: map[string]*ScrubFileState{}}
+
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("could not read scrub state file: %w", err)
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("could not parse scrub state file: %w", err)
+	}
+
+	if state.Files == nil {
+		state.Files = map[string]*ScrubFileState{}
+	}
+
+	return state, nil
+}
+
+// Written to a temporary file and renamed so an interrupted run cannot lose the history
+func saveScrubState(fileName string, state ScrubState) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not serialize scrub state: %w", err)
+	}
+
+	err = writeFileAtomic(fileName, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write scrub state file: %w", err)
+	}
+
+	return nil
+}
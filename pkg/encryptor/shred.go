@@ -0,0 +1,295 @@
+package encryptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+	Shredding overwrites a file where it lies, syncing each pass to disk,
+	then renames it to random characters (the name was plaintext too) and
+	unlinks it - so deleting the plaintext once it is encrypted needs no
+	other tool. A directory has every regular file under it shredded, or
+	only those Include and Exclude select by name, and when nothing was
+	filtered out the directories themselves are removed after. Symbolic
+	links and special files are never followed or written, only reported
+
+	Overwriting only reaches the blocks the file is on now. SSDs and flash
+	remap writes to fresh blocks and keep the old ones until they are
+	erased, copy-on-write filesystems (btrfs, ZFS, APFS) and snapshots
+	write the new data elsewhere, and journals and backups keep copies of
+	their own - on those the plaintext may survive any number of passes.
+	Shred says so when the storage is not known to be a spinning disk, but
+	the real answer there is for the plaintext to never be written
+	unencrypted (full disk encryption, or encrypting from a pipe)
+
+	One pass of random data is what NIST SP 800-88 asks of a drive made
+	this century, more passes cost time for nothing on those but are
+	there for policies that require them
+*/
+
+const DefaultShredPasses uint = 1
+const ShredPassesMax uint = 35 // Gutmann's, the most any policy asks for
+
+const shredBufferBytes = 1 << 20
+
+type ShredOptions struct {
+	Passes  uint     // Overwrites of random data before the file is unlinked, 0 is DefaultShredPasses
+	Include []string // In a directory, only files whose names match one of these patterns (filepath.Match), every file when empty
+	Exclude []string // In a directory, files whose names match one of these patterns are left alone
+	DryRun  bool     // Only report what would be shredded
+}
+
+type ShredReport struct {
+	Files    []string // Shredded (with DryRun, would be)
+	Bytes    int64
+	Skipped  []string // Symbolic links and special files, left alone
+	Warnings []string // Where overwriting may not reach every copy of the data
+}
+
+func Shred(path string, options *ShredOptions) (ShredReport, error) {
+	var report ShredReport
+
+	if options == nil {
+		return report, errors.New("options is nil")
+	}
+
+	passes := options.Passes
+	if passes == 0 {
+		passes = DefaultShredPasses
+	}
+
+	if passes > ShredPassesMax {
+		return report, fmt.Errorf("at most %d passes can be made", ShredPassesMax)
+	}
+
+	for _, pattern := range append(append([]string{}, options.Include...), options.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return report, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return report, err
+	}
+
+	if warning := shredStorageWarning(path); warning != "" {
+		report.Warnings = append(report.Warnings, warning)
+	}
+
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return report, fmt.Errorf("%s is not a regular file, only files and directories of them are shredded", path)
+		}
+
+		if !options.DryRun {
+			err = shredFile(path, passes)
+			if err != nil {
+				return report, err
+			}
+		}
+
+		report.Files = append(report.Files, path)
+		report.Bytes = info.Size()
+
+		return report, nil
+	}
+
+	var directories []string
+
+	err = filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			directories = append(directories, name)
+			return nil
+		}
+
+		if !entry.Type().IsRegular() {
+			report.Skipped = append(report.Skipped, name)
+			return nil
+		}
+
+		if !shredSelected(entry.Name(), options) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if !options.DryRun {
+			err = shredFile(name, passes)
+			if err != nil {
+				return err
+			}
+		}
+
+		report.Files = append(report.Files, name)
+		report.Bytes += info.Size()
+
+		return nil
+	})
+
+	if err != nil {
+		return report, err
+	}
+
+	// Directories holding files that were filtered out, or were skipped, are not ours to remove
+	if options.DryRun || len(options.Include) > 0 || len(options.Exclude) > 0 || len(report.Skipped) > 0 {
+		return report, nil
+	}
+
+	// Deepest first, so each is empty by the time it is removed
+	sort.Sort(sort.Reverse(sort.StringSlice(directories)))
+
+	for _, directory := range directories {
+		err = os.Remove(directory)
+		if err != nil {
+			return report, fmt.Errorf("could not remove directory: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+func shredSelected(name string, options *ShredOptions) bool {
+	for _, pattern := range options.Exclude {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+
+	if len(options.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range options.Include {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Overwrites the file passes times, syncing each, then renames and unlinks it
+func shredFile(fileName string, passes uint) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open file to shred: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, shredBufferBytes)
+
+	for pass := uint(1); pass <= passes; pass++ {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		for remaining := stats.Size(); remaining > 0; {
+			chunk := buffer
+			if remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+
+			err = readRandom(chunk)
+			if err != nil {
+				return err
+			}
+
+			_, err = file.Write(chunk)
+			if err != nil {
+				return fmt.Errorf("could not overwrite %s (pass %d of %d): %w", fileName, pass, passes, err)
+			}
+
+			remaining -= int64(len(chunk))
+		}
+
+		// Otherwise every pass but the last could be no more than a write to the page cache
+		err = file.Sync()
+		if err != nil {
+			return fmt.Errorf("could not sync %s (pass %d of %d): %w", fileName, pass, passes, err)
+		}
+	}
+
+	// The size is plaintext's as much as the contents, and some filesystems free truncated blocks at once
+	err = file.Truncate(0)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not truncate %s: %w", fileName, err)
+	}
+
+	_ = file.Close()
+
+	// The directory entry keeps the name until the slot is reused, so the name is overwritten too
+	anonymous, err := shredAnonymousName(fileName)
+	if err == nil {
+		err = os.Rename(fileName, anonymous)
+	}
+
+	if err != nil {
+		anonymous = fileName
+	}
+
+	err = os.Remove(anonymous)
+	if err != nil {
+		return fmt.Errorf("could not remove %s once it was overwritten: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// A random name as long as the file's, in the same directory, that nothing else has
+func shredAnonymousName(fileName string) (string, error) {
+	length := len(filepath.Base(fileName))
+
+	random := make([]byte, (length+1)/2)
+	err := readRandom(random)
+	if err != nil {
+		return "", err
+	}
+
+	anonymous := filepath.Join(filepath.Dir(fileName), hex.EncodeToString(random)[:length])
+	if _, err = os.Lstat(anonymous); err == nil {
+		return "", errors.New("the random name is taken")
+	}
+
+	return anonymous, nil
+}
+
+func shredStorageWarning(path string) string {
+	rotational, err := isRotationalStorage(path)
+	if err != nil {
+		return fmt.Sprintf("could not tell what storage %s is on - on SSDs, flash, copy-on-write filesystems, and anything with snapshots, overwriting does not reach every copy of the data", path)
+	}
+
+	if !rotational {
+		return fmt.Sprintf("%s is on solid state storage, which keeps old copies of overwritten blocks out of reach - only full disk encryption, or never writing the plaintext, protects it there", path)
+	}
+
+	return ""
+}
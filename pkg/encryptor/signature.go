@@ -0,0 +1,317 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+	Since format 1.14 a file may be signed with an Ed25519 key, so whoever
+	receives it can tell who sent it and not only that it is intact - the
+	footer is keyed with the file's key, which every recipient holds and
+	so could forge it with. The header names the signer's public key, and
+	64 bytes of signature follow the footer (before any header copy):
+
+		header | chunks | footer | signature | header copy
+
+	The signature is over the SHA256 of every byte before it, prefixed
+	with signatureLabel so it can never be mistaken for a signature of
+	anything else. A detached signature (base64, in a file of its own) is
+	over the whole file instead and leaves the file as it would be
+	unsigned, for formats and tools that must not change
+
+	Decrypting checks an embedded signature before anything is written.
+	Given signers, the file must be signed by one of them - a file that
+	is not signed, or is signed by someone else, is refused. Without any
+	the signature is still checked against the key the header names,
+	which says the file is intact but not who made it
+
+	A signing key is a file holding an Ed25519 private key - the seed in
+	base64, as keygen --signing writes it, or an OpenSSH ed25519 key, whose
+	ssh-ed25519 public key line then works as the signer
+*/
+
+const SignatureEd25519 = "Ed25519"
+
+const signatureLabel = "encryptor/v1/signature"
+
+type fileSigner struct {
+	privateKey ed25519.PrivateKey
+	hash       hash.Hash // Fed everything written before the signature
+	detached   string    // The signature goes to this file, not into the encrypted one
+}
+
+// A new Ed25519 signing key (its seed) and its public key, both base64
+func generateSigningKey() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(randomReader)
+	if err != nil {
+		return "", "", fmt.Errorf("internal crypto error generating signing key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(privateKey.Seed()), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// nil when the options do not ask for signing
+func newFileSigner(options *Options) (*fileSigner, error) {
+	if options.SigningKey == "" {
+		if options.DetachedSignature != "" {
+			return nil, errors.New("a detached signature is only written with a signing key")
+		}
+
+		return nil, nil
+	}
+
+	privateKey, err := loadSigningKey(options.SigningKey, options.PromptSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSigner{privateKey: privateKey, hash: sha256.New(), detached: options.DetachedSignature}, nil
+}
+
+func loadSigningKey(fileName string, promptSecret func(prompt string) (string, error)) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+
+	if bytes.Contains(data, []byte("PRIVATE KEY-----")) {
+		identities, err := loadSSHIdentities([]string{fileName}, promptSecret)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := identities[0].(type) {
+		case ed25519.PrivateKey:
+			return key, nil
+		case *ed25519.PrivateKey:
+			return *key, nil
+		}
+
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", fileName)
+	}
+
+	lines := keyLines(string(data))
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("signing key %s must hold one key", fileName)
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key %s is not a base64 Ed25519 key", fileName)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// A signer is a public key (base64 or an ssh-ed25519 line), or a file of them one per line
+func parseSignerKeys(signers []string) ([]ed25519.PublicKey, error) {
+	var publicKeys []ed25519.PublicKey
+
+	for _, signer := range signers {
+		if publicKey, err := parseEd25519PublicKey(signer, "signer key"); err == nil {
+			publicKeys = append(publicKeys, publicKey)
+			continue
+		}
+
+		data, err := os.ReadFile(signer)
+		if err != nil {
+			return nil, fmt.Errorf("signer %q is neither an Ed25519 public key nor a readable file: %w", signer, err)
+		}
+
+		lines := keyLines(string(data))
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("signer %s has no public keys in it", signer)
+		}
+
+		for _, line := range lines {
+			publicKey, err := parseEd25519PublicKey(line, "signer key")
+			if err != nil {
+				return nil, fmt.Errorf("could not parse signer %s: %w", signer, err)
+			}
+
+			publicKeys = append(publicKeys, publicKey)
+		}
+	}
+
+	return publicKeys, nil
+}
+
+func (signer *fileSigner) embedded() bool {
+	return signer != nil && signer.detached == ""
+}
+
+func (signer *fileSigner) publicKey() string {
+	return base64.StdEncoding.EncodeToString(signer.privateKey.Public().(ed25519.PublicKey))
+}
+
+// Signs what the hash has been fed so far
+func (signer *fileSigner) sign() []byte {
+	return ed25519.Sign(signer.privateKey, signedMessage(signer.hash.Sum(nil)))
+}
+
+// Once the file is complete, for a detached signature
+func (signer *fileSigner) writeDetached() error {
+	signature := base64.StdEncoding.EncodeToString(signer.sign()) + "\n"
+
+	err := os.WriteFile(signer.detached, []byte(signature), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write detached signature: %w", err)
+	}
+
+	return nil
+}
+
+func signedMessage(digest []byte) []byte {
+	return append([]byte(signatureLabel), digest...)
+}
+
+// The bytes a header's signature takes, after the footer
+func signatureSizeBytes(header *EncryptedFileHeader) int64 {
+	if header.Signature == "" {
+		return 0
+	}
+
+	return ed25519.SignatureSize
+}
+
+func (header *EncryptedFileHeader) signerPublicKey() (ed25519.PublicKey, error) {
+	if header.Signature != SignatureEd25519 {
+		return nil, fmt.Errorf("file signature %q is not supported by this version of encryptor", header.Signature)
+	}
+
+	return parseEd25519PublicKey(header.SignerKey, "signer key")
+}
+
+// What a signed file must verify against, nil when there is nothing to check
+type signatureCheck struct {
+	signers  []ed25519.PublicKey // Any one of them may have signed
+	detached []byte              // The detached signature, nil for one embedded in the file
+}
+
+func newSignatureCheck(header *EncryptedFileHeader, signers []ed25519.PublicKey, detached string) (*signatureCheck, error) {
+	if detached != "" {
+		if len(signers) == 0 {
+			return nil, errors.New("a detached signature names no signer, give the signers it may be from")
+		}
+
+		data, err := os.ReadFile(detached)
+		if err != nil {
+			return nil, fmt.Errorf("could not read detached signature: %w", err)
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(signature) != ed25519.SignatureSize {
+			return nil, errors.New("detached signature is not a base64 encoded Ed25519 signature")
+		}
+
+		return &signatureCheck{signers: signers, detached: signature}, nil
+	}
+
+	if header.Signature == "" {
+		if len(signers) > 0 {
+			return nil, ErrNotSigned
+		}
+
+		return nil, nil
+	}
+
+	publicKey, err := header.signerPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(signers) > 0 && !containsPublicKey(signers, publicKey) {
+		return nil, fmt.Errorf("%w, it is signed by %s", ErrSignatureInvalid, header.SignerKey)
+	}
+
+	return &signatureCheck{signers: []ed25519.PublicKey{publicKey}}, nil
+}
+
+// The digest is of everything signed - before an embedded signature, or the whole file for a detached one
+func (check *signatureCheck) verify(digest []byte, signature []byte) error {
+	if check.detached != nil {
+		signature = check.detached
+	}
+
+	message := signedMessage(digest)
+
+	for _, publicKey := range check.signers {
+		if ed25519.Verify(publicKey, message, signature) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w, the file was changed after it was signed", ErrSignatureInvalid)
+}
+
+/*
+	Checks a file's signature before it is decrypted, see the top of this
+	file - sizeBytes is the whole file's, and a detached signature is read
+	from detached rather than the file
+*/
+func verifyFileSignature(fileName string, header *EncryptedFileHeader, endOfHeader int, sizeBytes int64, signers []ed25519.PublicKey, detached string) error {
+	// A header read from its copy means the front of the file is damaged, so only a required signature is checked (and fails)
+	if header.fromCopy && len(signers) == 0 {
+		return nil
+	}
+
+	check, err := newSignatureCheck(header, signers, detached)
+	if err != nil || check == nil {
+		return err
+	}
+
+	signedBytes := sizeBytes
+	if check.detached == nil {
+		signedBytes -= headerCopySizeBytes(header, endOfHeader) + signatureSizeBytes(header)
+	}
+
+	if signedBytes <= int64(endOfHeader) {
+		return fmt.Errorf("%w, the file is too small to hold its signature", ErrSignatureInvalid)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("could not open file to check its signature: %w", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	signature := make([]byte, ed25519.SignatureSize)
+
+	if check.detached == nil {
+		_, err = file.ReadAt(signature, signedBytes)
+		if err != nil {
+			return fmt.Errorf("could not read file signature: %w", err)
+		}
+	}
+
+	digest := sha256.New()
+
+	_, err = io.Copy(digest, io.NewSectionReader(file, 0, signedBytes))
+	if err != nil {
+		return fmt.Errorf("could not read file to check its signature: %w", err)
+	}
+
+	return check.verify(digest.Sum(nil), signature)
+}
+
+func containsPublicKey(publicKeys []ed25519.PublicKey, publicKey ed25519.PublicKey) bool {
+	for _, candidate := range publicKeys {
+		if candidate.Equal(publicKey) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,389 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	A soak burns in a new backup disk, or a machine suspected of flaky RAM,
+	by running the pipeline against it round after round: synthetic data
+	is written to the device and read back, encrypted, and decrypted, and
+	what comes back is compared with what was generated. Every round
+	draws a new seed, the data is AES-CTR keystream from it, so nothing
+	needs to be kept in memory to check against and no two rounds write
+	the same bytes
+
+	Each round checks in two places. The plaintext read back from the
+	device (SoakStageStorage) finds a disk that loses or damages writes.
+	The decryption (SoakStagePipeline) finds data damaged on its way
+	through memory - the pipeline reads, seals, and writes every byte,
+	keeping many chunks in flight on every core. A chunk that fails to
+	authenticate was damaged after it was sealed, on the device or in
+	memory, and fails the round as an error
+
+	Mismatches are reported a word (8 bytes) at a time, as ECC memory
+	reports them: a single flipped bit in a word is what ECC would have
+	corrected, and scattered single bit flips point at RAM, where whole
+	runs of wrong words point at storage. Pages are dropped from the
+	cache once written where the system allows it (see soak_linux.go), so
+	reads come from the device rather than memory
+
+	The device needs room for about twice SizeBytes - the encrypted file
+	and its plaintext - and each round removes what it wrote, whether it
+	passed or failed
+*/
+
+const (
+	SoakStageStorage  = "storage"
+	SoakStagePipeline = "pipeline"
+)
+
+const soakWordBytes = 8
+const soakMismatchesKept = 64
+const soakBufferBytes = 1 << 20
+
+var errSoakStopped = errors.New("the soak was stopped")
+
+type SoakOptions struct {
+	SizeBytes int64                 // The synthetic data written each round
+	Duration  time.Duration         // Rounds start until this has passed, 0 runs one round
+	Progress  func(round SoakRound) // Called as each round ends, may be nil
+	Stop      <-chan struct{}       // Closing it ends the soak, the round running is cleaned up rather than finished
+}
+
+type SoakRound struct {
+	Round       int
+	Bytes       int64
+	WriteTime   time.Duration // Writing the plaintext and reading it back
+	EncryptTime time.Duration
+	DecryptTime time.Duration // Decrypting and comparing
+	Mismatches  int64         // Words that came back different
+	Err         string        // A failure other than mismatches, e.g. a chunk that did not authenticate
+}
+
+type SoakMismatch struct {
+	Round    int
+	Stage    string // SoakStageStorage or SoakStagePipeline
+	Offset   int64  // Of the word in the synthetic data
+	Expected uint64
+	Found    uint64
+	Bits     int // Flipped, 1 is what ECC memory would correct
+}
+
+type SoakReport struct {
+	Rounds         int
+	FailedRounds   int
+	BytesWritten   int64          // Written to the device and read back
+	BytesEncrypted int64          // Encrypted and decrypted again
+	Mismatches     []SoakMismatch // The first soakMismatchesKept, in the order found
+	SingleBitWords int64
+	MultiBitWords  int64
+	Errors         []string
+	Elapsed        time.Duration
+	Stopped        bool // Ended by SoakOptions.Stop
+}
+
+// Runs rounds in directory, which should be on the device tested - options tune the pipeline, their key material is not used
+func Soak(directory string, soakOptions *SoakOptions, options *Options) (SoakReport, error) {
+	var report SoakReport
+
+	if soakOptions == nil || options == nil {
+		return report, errors.New("soak options or options is nil")
+	}
+
+	if soakOptions.SizeBytes <= 0 {
+		return report, errors.New("a soak needs a size of data to write each round")
+	}
+
+	stats, err := os.Stat(directory)
+	if err != nil {
+		return report, err
+	}
+
+	if !stats.IsDir() {
+		return report, fmt.Errorf("%s is not a directory", directory)
+	}
+
+	start := time.Now()
+
+	for round := 1; round == 1 || time.Since(start) < soakOptions.Duration; round++ {
+		if soakStopped(soakOptions.Stop) {
+			report.Stopped = true
+			break
+		}
+
+		result, err := soakRound(directory, round, soakOptions, options, &report)
+		if errors.Is(err, errSoakStopped) {
+			report.Stopped = true
+			break
+		}
+
+		report.Rounds++
+
+		if err != nil {
+			result.Err = err.Error()
+			report.Errors = append(report.Errors, fmt.Sprintf("round %d: %v", round, err))
+		}
+
+		if result.Err != "" || result.Mismatches > 0 {
+			report.FailedRounds++
+		}
+
+		if soakOptions.Progress != nil {
+			soakOptions.Progress(result)
+		}
+	}
+
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+func soakRound(directory string, round int, soakOptions *SoakOptions, options *Options, report *SoakReport) (SoakRound, error) {
+	result := SoakRound{Round: round, Bytes: soakOptions.SizeBytes}
+
+	seed := make([]byte, 32)
+	key := make([]byte, 32)
+	for _, random := range [][]byte{seed, key} {
+		if err := readRandom(random); err != nil {
+			return result, err
+		}
+	}
+
+	prefix := filepath.Join(directory, fmt.Sprintf("encryptor-soak-%d-%d", os.Getpid(), round))
+	plaintextName := prefix + ".data"
+	encryptedName := prefix + ".enc"
+
+	defer func() {
+		_ = os.Remove(plaintextName)
+		_ = os.Remove(encryptedName)
+	}()
+
+	started := time.Now()
+
+	err := writeSoakData(plaintextName, seed, soakOptions)
+	if err != nil {
+		return result, err
+	}
+
+	result.Mismatches, err = compareSoakData(plaintextName, seed, SoakStageStorage, round, soakOptions, report)
+	result.WriteTime = time.Since(started)
+	report.BytesWritten += soakOptions.SizeBytes
+	if err != nil {
+		return result, err
+	}
+
+	// The pipeline as any job would run it, with the caller's workers, chunk size, and cipher
+	jobOptions := Options{
+		KeyHex:         hex.EncodeToString(key),
+		ChunkSizeMB:    options.ChunkSizeMB,
+		Readers:        options.Readers,
+		Executors:      options.Executors,
+		Writers:        options.Writers,
+		PoolWorkers:    options.PoolWorkers,
+		ScaleExecutors: options.ScaleExecutors,
+		BatchChunks:    options.BatchChunks,
+		Cipher:         options.Cipher,
+		SkipSourceHash: true, // Comparing with the seed's data finds more, and says where
+		Fsync:          FsyncEnd,
+		ForceOperation: true,
+	}
+
+	started = time.Now()
+
+	err = Encrypt(plaintextName, encryptedName, &jobOptions)
+	if err != nil {
+		return result, fmt.Errorf("could not encrypt: %w", err)
+	}
+
+	dropCachedPages(encryptedName)
+	result.EncryptTime = time.Since(started)
+
+	if soakStopped(soakOptions.Stop) {
+		return result, errSoakStopped
+	}
+
+	started = time.Now()
+
+	err = Decrypt(encryptedName, plaintextName, &jobOptions)
+	if err != nil {
+		return result, fmt.Errorf("could not decrypt: %w", err)
+	}
+
+	dropCachedPages(plaintextName)
+
+	mismatches, err := compareSoakData(plaintextName, seed, SoakStagePipeline, round, soakOptions, report)
+	result.Mismatches += mismatches
+	result.DecryptTime = time.Since(started)
+	report.BytesEncrypted += soakOptions.SizeBytes
+
+	return result, err
+}
+
+func soakStopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// The synthetic data for seed, a keystream nothing but the seed can reproduce
+func newSoakData(seed []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
+
+func writeSoakData(fileName string, seed []byte, soakOptions *SoakOptions) error {
+	data, err := newSoakData(seed)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	zeroes := make([]byte, soakBufferBytes)
+	buffer := make([]byte, soakBufferBytes)
+
+	for remaining := soakOptions.SizeBytes; remaining > 0 && err == nil; {
+		if soakStopped(soakOptions.Stop) {
+			err = errSoakStopped
+			break
+		}
+
+		size := int64(len(buffer))
+		if remaining < size {
+			size = remaining
+		}
+
+		data.XORKeyStream(buffer[:size], zeroes[:size])
+		_, err = file.Write(buffer[:size])
+		remaining -= size
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dropCachedPages(fileName)
+	return nil
+}
+
+// Reads fileName back and compares it with the seed's data a word at a time, returning how many words differ
+func compareSoakData(fileName string, seed []byte, stage string, round int, soakOptions *SoakOptions, report *SoakReport) (int64, error) {
+	data, err := newSoakData(seed)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	zeroes := make([]byte, soakBufferBytes)
+	expected := make([]byte, soakBufferBytes)
+	found := make([]byte, soakBufferBytes)
+
+	var mismatches int64
+	var offset int64
+
+	for offset < soakOptions.SizeBytes {
+		if soakStopped(soakOptions.Stop) {
+			return mismatches, errSoakStopped
+		}
+
+		size := int64(len(found))
+		if remaining := soakOptions.SizeBytes - offset; remaining < size {
+			size = remaining
+		}
+
+		read, err := io.ReadFull(file, found[:size])
+		if err != nil {
+			return mismatches, fmt.Errorf("%s: read back %d of %d bytes: %w", stage, offset+int64(read), soakOptions.SizeBytes, err)
+		}
+
+		data.XORKeyStream(expected[:size], zeroes[:size])
+
+		if !bytes.Equal(expected[:size], found[:size]) {
+			mismatches += compareSoakWords(expected[:size], found[:size], offset, stage, round, report)
+		}
+
+		offset += size
+	}
+
+	// Trailing data is as wrong as missing data
+	if read, _ := file.Read(found[:1]); read > 0 {
+		return mismatches, fmt.Errorf("%s: read back more than the %d bytes written", stage, soakOptions.SizeBytes)
+	}
+
+	return mismatches, nil
+}
+
+func compareSoakWords(expected []byte, found []byte, offset int64, stage string, round int, report *SoakReport) int64 {
+	var mismatches int64
+
+	for i := 0; i < len(expected); i += soakWordBytes {
+		var expectedWord, foundWord [soakWordBytes]byte
+		copy(expectedWord[:], expected[i:])
+		copy(foundWord[:], found[i:])
+
+		if expectedWord == foundWord {
+			continue
+		}
+
+		mismatch := SoakMismatch{
+			Round:    round,
+			Stage:    stage,
+			Offset:   offset + int64(i),
+			Expected: binary.BigEndian.Uint64(expectedWord[:]),
+			Found:    binary.BigEndian.Uint64(foundWord[:]),
+		}
+		mismatch.Bits = bits.OnesCount64(mismatch.Expected ^ mismatch.Found)
+
+		if mismatch.Bits == 1 {
+			report.SingleBitWords++
+		} else {
+			report.MultiBitWords++
+		}
+
+		if len(report.Mismatches) < soakMismatchesKept {
+			report.Mismatches = append(report.Mismatches, mismatch)
+		}
+
+		mismatches++
+	}
+
+	return mismatches
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package encryptor
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// So the next read of fileName comes from the device, the file must be synced first or dirty pages are kept
+func dropCachedPages(fileName string) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	_ = unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,333 @@
+package encryptor
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Nearly every developer already has an SSH keypair, so SSH public keys
+	can be used as recipients (the same idea as age's ssh recipients)
+
+	ssh-ed25519 - the Ed25519 key is converted to its X25519 equivalent, an
+	ephemeral X25519 exchange with it produces a shared secret, and HKDF of
+	that secret keys a ChaCha20-Poly1305 seal of the file key
+
+	ssh-rsa - the file key is encrypted with RSA-OAEP (SHA-256)
+
+	Decryption needs the private key file - ssh-agent cannot help because
+	the agent protocol only exposes signing, never key exchange or
+	decryption
+*/
+
+const RecipientTypeSSHEd25519 = "ssh-ed25519"
+const RecipientTypeSSHRSA = "ssh-rsa"
+
+const sshEd25519Label = "encryptor/v1/ssh-ed25519"
+const sshRSALabel = "encryptor/v1/ssh-rsa"
+
+// Tried when no identities are specified, in the same spirit as ssh itself
+var defaultSSHIdentityFilenames = []string{"id_ed25519", "id_rsa"}
+
+/*
+	Recipients can be given as a public key string ("ssh-ed25519 AAAA...")
+	or as a file of them (a .pub file, an authorized_keys file, or a file
+	downloaded from e.g. https://github.com/username.keys)
+*/
+func parseSSHRecipients(recipient string) ([]ssh.PublicKey, error) {
+	data := []byte(recipient)
+
+	if !strings.HasPrefix(recipient, "ssh-") {
+		fileData, err := os.ReadFile(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("SSH recipient %q is neither a public key nor a readable file: %w", recipient, err)
+		}
+
+		data = fileData
+	}
+
+	return parseSSHPublicKeys(data, recipient)
+}
+
+// Authorized keys format, one key per line (blank lines and comments are skipped)
+func parseSSHPublicKeys(data []byte, source string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+
+	for len(strings.TrimSpace(string(data))) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			if len(keys) > 0 {
+				break
+			}
+
+			return nil, fmt.Errorf("could not parse SSH recipient %q: %w", source, err)
+		}
+
+		keys = append(keys, key)
+		data = rest
+	}
+
+	return keys, nil
+}
+
+func isSupportedSSHKey(key ssh.PublicKey) bool {
+	return key.Type() == ssh.KeyAlgoED25519 || key.Type() == ssh.KeyAlgoRSA
+}
+
+func wrapFileKeySSH(fileKey []byte, key ssh.PublicKey) (RecipientStanza, error) {
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return RecipientStanza{}, errors.New("unsupported SSH key")
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	switch publicKey := cryptoKey.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		recipientX25519, err := ed25519PublicKeyToX25519(publicKey)
+		if err != nil {
+			return RecipientStanza{}, err
+		}
+
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		if err := readRandom(ephemeral); err != nil {
+			return RecipientStanza{}, fmt.Errorf("internal crypto error generating ephemeral key: %w", err)
+		}
+
+		ephemeralShare, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return RecipientStanza{}, err
+		}
+
+		shared, err := curve25519.X25519(ephemeral, recipientX25519)
+		if err != nil {
+			return RecipientStanza{}, err
+		}
+
+		body, err := sealFileKey(fileKey, shared, append(ephemeralShare, recipientX25519...), sshEd25519Label)
+		if err != nil {
+			return RecipientStanza{}, err
+		}
+
+		return RecipientStanza{
+			Type: RecipientTypeSSHEd25519,
+			Args: []string{fingerprint, base64.StdEncoding.EncodeToString(ephemeralShare)},
+			Body: base64.StdEncoding.EncodeToString(body),
+		}, nil
+	case *rsa.PublicKey:
+		body, err := rsa.EncryptOAEP(sha256.New(), randomReader, publicKey, fileKey, []byte(sshRSALabel))
+		if err != nil {
+			return RecipientStanza{}, fmt.Errorf("could not wrap file key with RSA key: %w", err)
+		}
+
+		return RecipientStanza{
+			Type: RecipientTypeSSHRSA,
+			Args: []string{fingerprint},
+			Body: base64.StdEncoding.EncodeToString(body),
+		}, nil
+	}
+
+	return RecipientStanza{}, fmt.Errorf("SSH key type %q is not supported, use ssh-ed25519 or ssh-rsa", key.Type())
+}
+
+func unwrapFileKeySSH(stanza RecipientStanza, identities []interface{}) ([]byte, error) {
+	if len(stanza.Args) < 1 {
+		return nil, errors.New("malformed SSH stanza")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH stanza: %w", err)
+	}
+
+	for _, identity := range identities {
+		signer, err := ssh.NewSignerFromKey(identity)
+		if err != nil || ssh.FingerprintSHA256(signer.PublicKey()) != stanza.Args[0] {
+			continue
+		}
+
+		switch privateKey := identity.(type) {
+		case ed25519.PrivateKey:
+			return unwrapFileKeySSHEd25519(stanza, body, privateKey)
+		case *ed25519.PrivateKey:
+			return unwrapFileKeySSHEd25519(stanza, body, *privateKey)
+		case *rsa.PrivateKey:
+			return rsa.DecryptOAEP(sha256.New(), nil, privateKey, body, []byte(sshRSALabel))
+		}
+	}
+
+	return nil, fmt.Errorf("no SSH identity matches %s", stanza.Args[0])
+}
+
+func unwrapFileKeySSHEd25519(stanza RecipientStanza, body []byte, privateKey ed25519.PrivateKey) ([]byte, error) {
+	if len(stanza.Args) < 2 {
+		return nil, errors.New("malformed ssh-ed25519 stanza")
+	}
+
+	ephemeralShare, err := base64.StdEncoding.DecodeString(stanza.Args[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ssh-ed25519 stanza: %w", err)
+	}
+
+	// The X25519 scalar for an Ed25519 key is the first half of the hashed seed (X25519 clamps it)
+	digest := sha512.Sum512(privateKey.Seed())
+	scalar := digest[:curve25519.ScalarSize]
+
+	ourX25519, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := curve25519.X25519(scalar, ephemeralShare)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFileKey(body, shared, append(ephemeralShare, ourX25519...), sshEd25519Label)
+}
+
+/*
+	The birational map from the Edwards curve to the Montgomery curve,
+	u = (1 + y) / (1 - y) mod p, applied to the encoded y coordinate
+*/
+func ed25519PublicKeyToX25519(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key length")
+	}
+
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	// Little endian, with the sign of x in the top bit
+	encoded := make([]byte, len(publicKey))
+	for i := range publicKey {
+		encoded[len(publicKey)-1-i] = publicKey[i]
+	}
+	encoded[0] &= 0x7f
+
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(p) >= 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+
+	numerator := new(big.Int).Add(big.NewInt(1), y)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, p)
+
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+
+	u := numerator.Mul(numerator, denominator.ModInverse(denominator, p))
+	u.Mod(u, p)
+
+	uBytes := u.FillBytes(make([]byte, curve25519.PointSize))
+	for i, j := 0, len(uBytes)-1; i < j; i, j = i+1, j-1 {
+		uBytes[i], uBytes[j] = uBytes[j], uBytes[i]
+	}
+
+	return uBytes, nil
+}
+
+// Every seal uses a fresh key derived from an ephemeral exchange, so a fixed nonce is safe
+func sealFileKey(fileKey []byte, shared []byte, salt []byte, label string) ([]byte, error) {
+	aead, err := fileKeyWrappingAEAD(shared, salt, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+func openFileKey(body []byte, shared []byte, salt []byte, label string) ([]byte, error) {
+	aead, err := fileKeyWrappingAEAD(shared, salt, label)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+	if err != nil {
+		return nil, errors.New("could not unwrap file key, the identity does not match")
+	}
+
+	return fileKey, nil
+}
+
+func fileKeyWrappingAEAD(shared []byte, salt []byte, label string) (cipher.AEAD, error) {
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(label)), wrappingKey); err != nil {
+		return nil, fmt.Errorf("internal crypto error deriving wrapping key: %w", err)
+	}
+
+	return chacha20poly1305.New(wrappingKey)
+}
+
+/*
+	Loads the private keys we may decrypt with - either the ones asked for,
+	or the usual suspects in ~/.ssh (missing defaults are not an error)
+*/
+func loadSSHIdentities(fileNames []string, promptSecret func(prompt string) (string, error)) ([]interface{}, error) {
+	explicit := len(fileNames) > 0
+
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+
+		for _, name := range defaultSSHIdentityFilenames {
+			fileNames = append(fileNames, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var identities []interface{}
+
+	for _, fileName := range fileNames {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			if !explicit && os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("could not read SSH identity: %w", err)
+		}
+
+		identity, err := ssh.ParseRawPrivateKey(data)
+
+		var passphraseMissing *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseMissing) {
+			if promptSecret == nil {
+				return nil, fmt.Errorf("SSH identity %s is passphrase protected and there is no way to ask for the passphrase", fileName)
+			}
+
+			passphrase, promptErr := promptSecret("Please supply the passphrase for " + fileName + ": ")
+			if promptErr != nil {
+				return nil, promptErr
+			}
+
+			identity, err = ssh.ParseRawPrivateKeyWithPassphrase(data, []byte(passphrase))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse SSH identity %s: %w", fileName, err)
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
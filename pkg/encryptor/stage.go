@@ -0,0 +1,222 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+)
+
+/*
+	Golang still doesn't support slices of directional channels,
+	so these are two-way, but we'll only use one direction - this
+	is better that deep conversions using unsafe in my opinion, and
+	arguably more readable
+*/
+
+// Dev note: Read from read channels, write to execute channels
+func readStage(op OperationEnum, fileName string, chunkSizeMB uint, stats os.FileInfo, fileHeader EncryptedFileHeader, endOfHeader int, budget *memoryBudget, prefetch *prefetchWindow, ch chan<- error, numWorkers uint, readChannels []chan *chunkReadRequest, executeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic("read stage", &err)
+
+	chunkSizeBytes := bytesFromMB(chunkSizeMB)
+
+	// The prefetch stage does the reading itself, in place of the workers
+	if prefetch != nil {
+		numWorkers = 1
+	}
+
+	// Follow the same pattern as the main pipeline for our concurrent reads
+	readWorkerErrors := make(chan error, numWorkers)
+
+	if prefetch != nil {
+		go prefetchWorker(fileName, prefetch, budget, readWorkerErrors, readChannels, executeChannels)
+	} else {
+		for i := uint(1); i <= numWorkers; i++ {
+			go readWorker(op, fileName, budget, readWorkerErrors, i, numWorkers, readChannels, executeChannels)
+		}
+	}
+
+	/*
+		The read pipeline is the start - let's prime the pump!
+
+		An encryption operation results in differently generated ranges
+		than decryption - as decryption has chunk count and size specified
+		by the file's header because we have to use the chunk count and
+		size specified during encryption
+	*/
+
+	for i := uint(0); i < uint(len(readChannels)); i++ {
+		var request chunkReadRequest
+		request, err = chunkReadRange(op, i+1, chunkSizeBytes, &fileHeader, endOfHeader, stats.Size())
+		if err != nil {
+			return
+		}
+
+		readChannels[i] <- &request
+	}
+
+	for i := uint(0); i < numWorkers; i++ {
+		readError := <-readWorkerErrors
+		if readError != nil {
+			err = fmt.Errorf("read worker error: %w", readError)
+		}
+	}
+
+	// No defer because returning from errors results in process exit anyhow
+	close(readWorkerErrors)
+}
+
+// The byte range of a chunk in the source, chunk IDs start at 1
+func chunkReadRange(op OperationEnum, chunkID uint, chunkSizeBytes int64, fileHeader *EncryptedFileHeader, endOfHeader int, sourceSizeBytes int64) (chunkReadRequest, error) {
+	request := chunkReadRequest{
+		ChunkID: chunkID,
+	}
+
+	i := chunkID - 1
+
+	// Encryption is simple - start and end are iterations of chunk size
+	if op == Encryption {
+		request.RangeStart = int64(i) * chunkSizeBytes
+		request.RangeEnd = request.RangeStart + chunkSizeBytes
+	} else if op == Decryption {
+		/*
+			We rely on the chunk size in bytes from file header because
+			some encryption schemes can have complicated paddings and
+			encoding schemes that are more easily managed in this manner.
+
+			Because we only support AES-GCM right now, everything is the same
+			as reading an unencrypted file (because AES-GCM encrypts in place)
+			except the chunk size has the 12 byte nonce/iv prefixed and the
+			16 byte authentication tag (we only support AES-GCM right now)
+			postfixed
+		*/
+
+		// Don't forget the header offset!
+		encryptedChunkSizeBytes := fileHeader.ChunkSizeBytes + chunkOverheadBytes(fileHeader)
+		request.RangeStart = int64(endOfHeader) + (int64(i) * encryptedChunkSizeBytes)
+		request.RangeEnd = request.RangeStart + encryptedChunkSizeBytes
+	} else {
+		return request, errors.New("unsupported operation specified in read stage")
+	}
+
+	// Chunk data ends where the footer, if the file has one, begins
+	if op == Decryption {
+		sourceSizeBytes -= footerSizeBytes(fileHeader) + signatureSizeBytes(fileHeader) + headerCopySizeBytes(fileHeader, endOfHeader)
+	}
+
+	/*
+		Make sure we're not past the end of the file (meaning we
+		should be the last chunk as well)
+		Also note that the extreme edge case where the header offset of
+		an encrypted file could place a RangeStart value to pass the
+		EOF is handled by the fact that encrypted files are constructed
+		in such a way as to make this impossible
+	*/
+	if request.RangeEnd >= sourceSizeBytes {
+		request.RangeEnd = sourceSizeBytes
+	}
+
+	// Truncated files are not constructed that way, so a chunk that cannot hold its nonce and tag is caught here
+	if op == Decryption && request.RangeEnd-request.RangeStart < chunkOverheadBytes(fileHeader) {
+		return request, fmt.Errorf("file is truncated, chunk %d is incomplete", chunkID)
+	}
+
+	return request, nil
+}
+
+// Dev note: Read from execute channels, write to write channels
+func executeStage(op OperationEnum, cipherEnum CipherEnum, mode CipherModeEnum, keyMaterial []byte, chunkChecksum bool, fileHeader *EncryptedFileHeader, auth *fileAuthenticator, tree *merkleLeaves, prefetch *prefetchWindow, scaler *executorScaler, ch chan<- error, numWorkers uint, batchChunks uint, executeChannels []chan *[]byte, writeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic("execute stage", &err)
+
+	// Every cipher we support takes a 256-bit key
+	if len(keyMaterial) != 32 {
+		err = errors.New("execute stage currently only supports 256-bit (32 byte) key materials")
+		return
+	}
+
+	// Scaling starts every executor up to the cap, parking those not needed yet
+	if scaler != nil {
+		numWorkers = scaler.maxWorkers
+
+		scalerDone := make(chan struct{})
+		defer close(scalerDone)
+
+		scaler.begin()
+		go runExecutorScaler(scaler, scalerDone, executeChannels, writeChannels)
+	}
+
+	executeWorkerErrors := make(chan error, numWorkers)
+
+	for i := uint(1); i <= numWorkers; i++ {
+		if scaler != nil {
+			go scaledExecuteWorker(op, cipherEnum, mode, keyMaterial, chunkChecksum, fileHeader, auth, tree, prefetch, scaler, executeWorkerErrors, i, executeChannels, writeChannels)
+			continue
+		}
+
+		go executeWorker(op, cipherEnum, mode, keyMaterial, chunkChecksum, fileHeader, auth, tree, prefetch, executeWorkerErrors, i, numWorkers, batchChunks, executeChannels, writeChannels)
+	}
+
+	// The read pipeline will feed our workers for us
+
+	for i := uint(0); i < numWorkers; i++ {
+		executeError := <-executeWorkerErrors
+		if executeError != nil {
+			err = fmt.Errorf("execute worker error: %w", executeError)
+		}
+	}
+
+	// No defer because returning from errors results in process exit anyhow
+	close(executeWorkerErrors)
+}
+
+// Dev note: header prefixes and auth's footer ends an encrypted file (both ignored when decrypting), plaintextHash is fed everything written
+func writeStage(op OperationEnum, fileName string, target *os.File, force bool, flushChunks bool, header EncryptedFileHeader, cloudPartSizeBytes int64, limiter *bandwidthLimiter, budget *memoryBudget, auth *fileAuthenticator, plaintextHash hash.Hash, writeBufferKB uint, fsync string, signer *fileSigner, ch chan<- error, numWorkers uint, writeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic("write stage", &err)
+
+	/*
+		The number of write workers is capped at 1 while concurrent random access
+		writes are researched (e.g. pre-writing 0 based file and then overwriting)
+	*/
+	numWorkers = 1
+
+	// Workers feed everything they write through the checksummer
+	var checksummer *cloudChecksummer
+	if cloudPartSizeBytes > 0 {
+		checksummer = newCloudChecksummer(cloudPartSizeBytes)
+	}
+
+	// Follow the same pattern as the main pipeline for our concurrent writes
+	writeWorkerErrors := make(chan error, numWorkers)
+
+	/*
+		We pass the header because it is potentially of use
+		to every worker during the writing of encrypted data
+		As of today it is primarily of use to the first chunk
+		writer, so it can prefix the file with header data which
+		is needed during decryption - for future proofing we
+		send a copy rather than share a pointer
+	*/
+	for i := uint(1); i <= numWorkers; i++ {
+		go writeWorker(op, header, fileName, target, force, flushChunks, checksummer, limiter, budget, auth, plaintextHash, writeBufferKB, fsync, signer, writeWorkerErrors, i, numWorkers, writeChannels)
+	}
+
+	for i := uint(0); i < numWorkers; i++ {
+		writeError := <-writeWorkerErrors
+		if writeError != nil {
+			err = fmt.Errorf("write worker error: %w", writeError)
+		}
+	}
+
+	if err == nil && checksummer != nil {
+		err = writeCloudChecksums(fileName, checksummer)
+	}
+
+	// No defer because returning from errors results in process exit anyhow
+	close(writeWorkerErrors)
+}
@@ -0,0 +1,770 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+/*
+	Streams (network connections, pipes, buffers) are encrypted with the
+	same chunked format as files, so a stream written to disk can be
+	decrypted with encryptor -d and an encrypted file can be read back as a
+	stream
+
+	A stream's length is unknown until it ends, so streamed headers carry
+	no chunk count - instead the final chunk is always short, even if that
+	means it is empty, which lets readers tell a complete stream from one
+	that was cut off at a chunk boundary
+
+	Streams are processed one chunk at a time on the caller's goroutine,
+	the concurrent pipeline is only used for files
+*/
+
+type EncryptWriter struct {
+	target        io.Writer
+	cipher        CipherEnum
+	mode          CipherModeEnum
+	keyMaterial   []byte
+	header        EncryptedFileHeader
+	chunkChecksum bool
+	chunk         []byte
+	chunkSize     int
+	chunkID       uint32
+	auth          *fileAuthenticator
+	signer        *fileSigner
+	limiter       *bandwidthLimiter
+	compressor    io.WriteCloser // Set when the plaintext is compressed, what it writes is chunked
+	pool          *compressPool  // The compressor, when its codec's frames are compressed by workers
+	stageReport   *StageReport
+	started       time.Time
+	closed        bool
+	err           error
+}
+
+type DecryptReader struct {
+	source      io.Reader
+	cipher      CipherEnum
+	mode        CipherModeEnum
+	keyMaterial []byte
+	header      EncryptedFileHeader
+	chunk       []byte
+	plaintext   []byte
+	chunkID     uint32
+	auth        *fileAuthenticator
+	holdback    *footerHoldbackReader // Set when the stream ends with a footer
+	digest      []byte                // The plaintext's SHA256 from the header, checked once the stream ends
+	hash        hash.Hash             // Set when there is a digest to check
+	signature   *signatureCheck       // Set when the stream is signed, checked once it ends
+	signedHash  hash.Hash             // Everything read, for the signature
+	maxOutput   int64                 // Plaintext handed out is limited to this, 0 is unlimited
+	output      int64
+	decompress  io.Reader // Set when the chunks hold compressed plaintext, reads them
+	done        bool
+	err         error
+}
+
+// Writes the header to w immediately, Close must be called to write the final chunk
+func NewEncryptWriter(w io.Writer, options *Options) (*EncryptWriter, error) {
+	return newEncryptWriter(w, options, "", nil)
+}
+
+// Content is recorded in the header as what the plaintext is, empty for anything, and dictionary is the zstd one compressing it, nil for none
+func newEncryptWriter(w io.Writer, options *Options, content string, dictionary []byte) (*EncryptWriter, error) {
+	if w == nil || options == nil {
+		return nil, errors.New("writer or options is nil")
+	}
+
+	options = withDefaults(*options, "")
+
+	err := checkCompression(options.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ChunkSizeMB < ChunkSizeMin || options.ChunkSizeMB > ChunkSizeMax {
+		return nil, fmt.Errorf("chunk size (MB) must be between %d and %d", ChunkSizeMin, ChunkSizeMax)
+	}
+
+	key, err := resolveKeyMaterial(Encryption, nil, options)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := cipherSuiteByName(options.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	fileID, err := newFileID()
+	if err != nil {
+		return nil, err
+	}
+
+	noncePrefix, err := newNoncePrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := newFileSigner(options)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, _ := w.(resumableUpload)
+
+	// Counted before the signer sees it, a write that would go over the limit reaches neither
+	w = newOutputLimitWriter(w, options.MaxOutputBytes)
+
+	// Everything written passes through the signer's hash
+	if signer != nil {
+		w = io.MultiWriter(w, signer.hash)
+	}
+
+	job := pipelineJob{
+		FileID:        fileID,
+		NoncePrefix:   noncePrefix,
+		Cipher:        suite.Cipher,
+		CipherMode:    suite.Mode,
+		ChunkSizeMB:   options.ChunkSizeMB,
+		ChunkChecksum: options.ChunkChecksum,
+		Recipients:    key.Recipients,
+		Salt:          key.Salt,
+		KDF:           key.KDF,
+		KDFIterations: key.KDFIterations,
+		KeyMaterial:   key.Material,
+		StoreKeyCheck: options.StoreKeyCheck,
+		HeaderCopy:    options.HeaderCopy,
+		ChunkMarkers:  options.ChunkMarkers,
+		Signer:        signer,
+		Content:       content,
+	}
+
+	header, headerBytes, err := newStreamHeader(&job, nil, options, dictionary)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+		An interrupted upload's header is written again, so the parts it
+		sent come out the same - only when the whole of it does, its nonces
+		are not to be used for anything else
+	*/
+	if previous, previousBytes, previousKey := resumedStreamHeader(upload, options); previous != nil {
+		resumed := job
+		resumed.FileID, resumed.NoncePrefix, resumed.KeyMaterial = previous.FileID, previous.NoncePrefix, previousKey
+		resumed.Salt, resumed.KDF, resumed.KDFIterations = previous.Salt, previous.KDF, previous.KDFIterations
+
+		resumedHeader, resumedBytes, err := newStreamHeader(&resumed, previous, options, dictionary)
+		if err == nil && bytes.Equal(resumedBytes, previousBytes) {
+			job, header, headerBytes = resumed, resumedHeader, resumedBytes
+			key.Material = previousKey
+		}
+	}
+
+	// Told before it is written, the upload checks what follows against what it sent when the header is the one it has
+	if upload != nil {
+		upload.recordHeader(headerBytes, keyCheck(key.Material, job.FileID))
+	}
+
+	_, err = w.Write(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not write encryption header: %w", err)
+	}
+
+	err = setHeaderDigest(&header)
+	if err != nil {
+		return nil, fmt.Errorf("could not create encryption header: %w", err)
+	}
+
+	// Streams do not know their chunk count, the authenticator grows as chunks are sealed
+	auth, err := newFileAuthenticator(&header, key.Material, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := int(header.ChunkSizeBytes)
+
+	writer := &EncryptWriter{
+		target:        w,
+		cipher:        suite.Cipher,
+		mode:          suite.Mode,
+		keyMaterial:   key.Material,
+		header:        header,
+		chunkChecksum: options.ChunkChecksum,
+		chunk:         make([]byte, 0, chunkSize),
+		chunkSize:     chunkSize,
+		auth:          auth,
+		signer:        signer,
+		limiter:       newBandwidthLimiter(options.Bandwidth),
+		stageReport:   options.StageReport,
+		started:       time.Now(),
+	}
+
+	if header.Compression != "" {
+		codec, err := codecByName(header.Compression)
+		if err != nil {
+			return nil, err
+		}
+
+		if dictionary != nil {
+			parsed, err := parseZstdDictionary(dictionary)
+			if err != nil {
+				return nil, err
+			}
+
+			codec = zstdDictionaryCodec{parsed}
+		}
+
+		// Frames compressed by a pool of workers, see compressstage.go
+		if _, ok := codec.(framedCodec); ok {
+			writer.pool = newCompressPool(codec, int(options.Compressors), compressedChunks{writer})
+			writer.compressor = writer.pool
+		} else {
+			writer.compressor = codec.NewWriter(compressedChunks{writer})
+		}
+	}
+
+	return writer, nil
+}
+
+// A stream's header, its name and dictionary sealed again unless previous has them sealed already
+func newStreamHeader(job *pipelineJob, previous *EncryptedFileHeader, options *Options, dictionary []byte) (EncryptedFileHeader, []byte, error) {
+	err := setStoredName(job, options.StoreName, options.OriginalName)
+	if err != nil {
+		return EncryptedFileHeader{}, nil, err
+	}
+
+	// Sealed with a random nonce, the one already sent is kept when it is of the same name
+	if previous != nil && len(job.SealedName) > 0 {
+		if name, err := openStoredName(previous, job.KeyMaterial); err == nil && name == options.OriginalName {
+			job.SealedName = previous.SealedName
+		}
+	}
+
+	if dictionary != nil {
+		if err = sealDictionary(job, dictionary); err != nil {
+			return EncryptedFileHeader{}, nil, err
+		}
+
+		if previous != nil && len(previous.Dictionary) > 0 {
+			if opened, err := openDictionary(previous, job.KeyMaterial); err == nil && bytes.Equal(opened, dictionary) {
+				job.Dictionary = previous.Dictionary
+			}
+		}
+	}
+
+	header := newEncryptedFileHeader(job, 0)
+	header.Streamed = true
+	header.Compression = headerCompression(options.Compression)
+	header.FormatVersion = minimumFormatVersion(&header)
+
+	headerBytes, err := getCompleteEncryptedFileHeaderAsBytes(&header)
+	if err != nil {
+		return EncryptedFileHeader{}, nil, fmt.Errorf("could not create encryption header: %w", err)
+	}
+
+	return header, headerBytes, nil
+}
+
+/*
+	The header an interrupted upload started with, as it was written, and
+	its file key when the options give that key again - nil to write a
+	new one. A random file key wrapped to recipients cannot be had again
+	(Ed25519 signatures can, they are deterministic)
+*/
+func resumedStreamHeader(upload resumableUpload, options *Options) (*EncryptedFileHeader, []byte, []byte) {
+	if upload == nil || usesRecipients(Encryption, "", options) {
+		return nil, nil, nil
+	}
+
+	data, check := upload.resumeHeader()
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	// Parsing may consume what it is given
+	parsed := append([]byte{}, data...)
+
+	header, _, err := getEncryptedFileHeaderFromBytes(&parsed)
+	if err != nil || len(header.Recipients) > 0 || len(header.FileID) == 0 || len(header.NoncePrefix) == 0 {
+		return nil, nil, nil
+	}
+
+	key, err := resolveKeyMaterial(Decryption, header, options)
+	if err != nil || !hmac.Equal(keyCheck(key.Material, header.FileID), check) {
+		return nil, nil, nil
+	}
+
+	return header, data, key.Material
+}
+
+func (writer *EncryptWriter) Write(data []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	if writer.closed {
+		return 0, errors.New("write to a closed encrypt writer")
+	}
+
+	if writer.compressor == nil {
+		return writer.writeChunks(data)
+	}
+
+	// The compressor's errors are ours, they come from writing chunks
+	written, err := writer.compressor.Write(data)
+	if err != nil && writer.err == nil {
+		writer.err = err
+	}
+
+	return written, err
+}
+
+func (writer *EncryptWriter) writeChunks(data []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	written := 0
+
+	for len(data) > 0 {
+		// A full chunk is only sealed once more data arrives, the last chunk must be short
+		if len(writer.chunk) == writer.chunkSize {
+			writer.err = writer.sealChunk(false)
+			if writer.err != nil {
+				return written, writer.err
+			}
+		}
+
+		portion := data
+		if space := writer.chunkSize - len(writer.chunk); len(portion) > space {
+			portion = data[:space]
+		}
+
+		writer.chunk = append(writer.chunk, portion...)
+		written += len(portion)
+		data = data[len(portion):]
+	}
+
+	return written, nil
+}
+
+// Writes the final chunk and the footer, the underlying writer is not closed
+// What is written next starts a compressed frame of its own, for a directory's entries (see dictionary.go)
+func (writer *EncryptWriter) endFrame() error {
+	if writer.err != nil || writer.pool == nil {
+		return writer.err
+	}
+
+	writer.err = writer.pool.endFrame()
+	return writer.err
+}
+
+func (writer *EncryptWriter) Close() error {
+	if writer.err != nil || writer.closed {
+		return writer.err
+	}
+
+	writer.closed = true
+
+	if writer.compressor != nil {
+		err := writer.compressor.Close()
+		if err != nil {
+			writer.err = err
+			return writer.err
+		}
+	}
+
+	if len(writer.chunk) == writer.chunkSize {
+		writer.err = writer.sealChunk(false)
+		if writer.err != nil {
+			return writer.err
+		}
+	}
+
+	writer.err = writer.sealChunk(true)
+	if writer.err != nil || writer.auth == nil {
+		return writer.err
+	}
+
+	_, err := writer.target.Write(writer.auth.sum())
+	if err != nil {
+		writer.err = fmt.Errorf("could not write file footer: %w", err)
+		return writer.err
+	}
+
+	if writer.header.Signature != "" {
+		_, err = writer.target.Write(writer.signer.sign())
+		if err != nil {
+			writer.err = fmt.Errorf("could not write file signature: %w", err)
+			return writer.err
+		}
+	}
+
+	// Only now is the chunk count known for the copy's trailer
+	if writer.header.HeaderCopy != "" {
+		headerCopy, err := headerCopyBytes(&writer.header, writer.chunkID)
+		if err == nil {
+			_, err = writer.target.Write(headerCopy)
+		}
+
+		if err != nil {
+			writer.err = fmt.Errorf("could not write the copy of the header: %w", err)
+			return writer.err
+		}
+	}
+
+	if writer.signer != nil && !writer.signer.embedded() {
+		writer.err = writer.signer.writeDetached()
+	}
+
+	if writer.err == nil && writer.pool != nil && writer.stageReport != nil {
+		writer.stageReport.add(time.Since(writer.started), writer.pool.stages()...)
+	}
+
+	return writer.err
+}
+
+func (writer *EncryptWriter) sealChunk(final bool) error {
+	writer.chunkID++
+	additionalData := chunkAdditionalData(&writer.header, writer.chunkID, final)
+
+	chunkData, err := encryptBlob(writer.cipher, writer.mode, &writer.chunk, writer.keyMaterial, additionalData, chunkNonceStart(writer.header.NoncePrefix, writer.chunkID))
+	if err != nil {
+		return err
+	}
+
+	writer.auth.record(writer.chunkID, *chunkData)
+
+	if writer.chunkChecksum {
+		*chunkData = appendChecksumCRC32C(*chunkData)
+	}
+
+	if writer.header.ChunkMarkers != "" {
+		*chunkData = prependChunkMarker(writer.chunkID, *chunkData)
+	}
+
+	writer.limiter.wait(len(*chunkData))
+
+	_, err = writer.target.Write(*chunkData)
+	if err != nil {
+		return fmt.Errorf("could not write encrypted chunk: %w", err)
+	}
+
+	writer.chunk = writer.chunk[:0]
+	return nil
+}
+
+// Reads and checks the header from r immediately, files written by Encrypt can be read as well
+func NewDecryptReader(r io.Reader, options *Options) (*DecryptReader, error) {
+	if r == nil || options == nil {
+		return nil, errors.New("reader or options is nil")
+	}
+
+	// The header as read is kept for the signature, if there is one
+	var headerBytes bytes.Buffer
+
+	header, endOfHeader, err := readEncryptedFileHeader(io.TeeReader(r, &headerBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve encryption header from stream: %w", err)
+	}
+
+	if !isSupportedFormatVersion(header.FormatVersion) {
+		return nil, fmt.Errorf("file format version %q is not supported by this version of encryptor", header.FormatVersion)
+	}
+
+	if header.ChunkSizeBytes <= 0 || header.ChunkSizeBytes > bytesFromMB(ChunkSizeMax) {
+		return nil, errors.New("encryption header has an invalid chunk size")
+	}
+
+	suite, err := cipherSuiteForHeader(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := resolveKeyMaterial(Decryption, &header, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyKeyCheck(&header, key.Material)
+	if err != nil {
+		return nil, err
+	}
+
+	numChunks := header.NumChunks
+	if header.Streamed {
+		numChunks = 0
+	}
+
+	auth, err := newFileAuthenticator(&header, key.Material, numChunks)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := openPlaintextDigest(&header, key.Material)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintextHash hash.Hash
+	if digest != nil {
+		plaintextHash = sha256.New()
+	}
+
+	signerKeys, err := parseSignerKeys(options.SignerKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := newSignatureCheck(&header, signerKeys, options.DetachedSignature)
+	if err != nil {
+		return nil, err
+	}
+
+	var signedHash hash.Hash
+	if signature != nil {
+		if auth == nil {
+			return nil, errors.New("only streams that end with a footer can have their signature checked")
+		}
+
+		signedHash = sha256.New()
+		signedHash.Write(headerBytes.Bytes())
+	}
+
+	// The footer (and the signature and header's copy after it) must never reach a chunk, so it is held back from them until the stream ends
+	var holdback *footerHoldbackReader
+	if auth != nil {
+		holdback = newFooterHoldbackReader(r, int(footerSizeBytes(&header)+signatureSizeBytes(&header)+headerCopySizeBytes(&header, endOfHeader)))
+		r = holdback
+	}
+
+	reader := &DecryptReader{
+		source:      r,
+		cipher:      suite.Cipher,
+		mode:        suite.Mode,
+		keyMaterial: key.Material,
+		header:      header,
+		auth:        auth,
+		holdback:    holdback,
+		digest:      digest,
+		hash:        plaintextHash,
+		signature:   signature,
+		signedHash:  signedHash,
+		maxOutput:   options.MaxOutputBytes,
+		chunk:       make([]byte, header.ChunkSizeBytes+chunkOverheadBytes(&header)),
+	}
+
+	if len(header.Dictionary) > 0 {
+		codec, err := dictionaryCodec(&header, key.Material)
+		if err != nil {
+			return nil, err
+		}
+
+		reader.decompress = codec.NewReader(decryptedChunks{reader})
+	} else if header.Compression != "" {
+		codec, err := codecByName(header.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("the plaintext is compressed with %q, which this version of encryptor cannot decompress", header.Compression)
+		}
+
+		reader.decompress = codec.NewReader(decryptedChunks{reader})
+	}
+
+	return reader, nil
+}
+
+func (reader *DecryptReader) Read(data []byte) (int, error) {
+	if reader.decompress == nil {
+		return reader.readChunks(data)
+	}
+
+	if reader.err != nil {
+		return 0, reader.err
+	}
+
+	read, err := reader.decompress.Read(data)
+
+	// The limit is on the plaintext, not the compressed data the chunks hold
+	if read > 0 && reader.maxOutput > 0 {
+		reader.output += int64(read)
+		if limitErr := checkOutputSize(reader.output, reader.maxOutput); limitErr != nil {
+			reader.err = limitErr
+			return 0, limitErr
+		}
+	}
+
+	return read, err
+}
+
+func (reader *DecryptReader) readChunks(data []byte) (int, error) {
+	for len(reader.plaintext) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		reader.err = reader.openChunk()
+
+		// A chunk that would go over the limit is never handed out
+		if reader.err == nil && reader.maxOutput > 0 && reader.decompress == nil {
+			reader.output += int64(len(reader.plaintext))
+			reader.err = checkOutputSize(reader.output, reader.maxOutput)
+			if reader.err != nil {
+				reader.plaintext = nil
+			}
+		}
+	}
+
+	read := copy(data, reader.plaintext)
+	reader.plaintext = reader.plaintext[read:]
+
+	return read, nil
+}
+
+func (reader *DecryptReader) openChunk() error {
+	bytesRead, err := io.ReadFull(reader.source, reader.chunk)
+	if err == io.EOF {
+		// Files with a known chunk count may end on a chunk boundary, streams may not
+		if !reader.header.Streamed && reader.chunkID == reader.header.NumChunks && reader.chunkID > 0 {
+			reader.done = true
+			return nil
+		}
+
+		return errors.New("stream is truncated, its final chunk is missing")
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("could not read chunk %d: %w", reader.chunkID+1, err)
+	}
+
+	reader.chunkID++
+	chunkData := reader.chunk[:bytesRead]
+	short := bytesRead < len(reader.chunk)
+
+	if reader.signedHash != nil {
+		reader.signedHash.Write(chunkData)
+	}
+
+	if reader.header.Streamed {
+		reader.done = short
+	} else {
+		reader.done = reader.chunkID == reader.header.NumChunks
+
+		if reader.chunkID > reader.header.NumChunks {
+			return errors.New("stream has more chunks than its header describes")
+		}
+
+		if short && !reader.done {
+			return fmt.Errorf("stream is truncated, chunk %d is incomplete", reader.chunkID)
+		}
+	}
+
+	if int64(bytesRead) < chunkOverheadBytes(&reader.header) {
+		return fmt.Errorf("chunk %d is too short to be an encrypted chunk", reader.chunkID)
+	}
+
+	if reader.header.ChunkMarkers != "" {
+		chunkData, err = stripChunkMarker(reader.chunkID, chunkData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The footer is checked first, so a stream cut on a chunk boundary reads as truncated rather than corrupt
+	sealedChunk := chunkData
+	if reader.header.ChunkChecksum == ChecksumCRC32C {
+		sealedChunk = chunkData[:len(chunkData)-int(CRC32CSize)]
+	}
+
+	reader.auth.record(reader.chunkID, sealedChunk)
+
+	if reader.done {
+		err = reader.verifyFooter()
+		if err != nil {
+			return err
+		}
+	}
+
+	// A failed checksum is corruption, not a bad key, so check before authenticating
+	if reader.header.ChunkChecksum == ChecksumCRC32C {
+		chunkData, err = stripChecksumCRC32C(chunkData)
+		if err != nil {
+			return fmt.Errorf("chunk %d is corrupt: %w", reader.chunkID, err)
+		}
+	}
+
+	additionalData := chunkAdditionalData(&reader.header, reader.chunkID, reader.done)
+
+	plaintext, err := decryptBlob(reader.cipher, reader.mode, &chunkData, reader.keyMaterial, additionalData)
+	if err != nil {
+		return corruptUnlessWrongKey(&reader.header, fmt.Errorf("%w: %v", ErrAuthenticationFailed, err))
+	}
+
+	// The final chunk is held back until everything read matches what was encrypted
+	if reader.hash != nil {
+		reader.hash.Write(*plaintext)
+	}
+
+	if reader.hash != nil && reader.done {
+		err = verifyPlaintextDigest(reader.digest, reader.hash.Sum(nil))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Every chunk before the last is whole, so only the last says whether the plaintext is the size recorded
+	if reader.done && reader.header.PlaintextSize > 0 {
+		opened := int64(reader.chunkID-1)*reader.header.ChunkSizeBytes + int64(len(*plaintext))
+		if opened != reader.header.PlaintextSize {
+			return fmt.Errorf("%w, its chunks held %d bytes of plaintext where its header records %d", ErrFileCorrupt, opened, reader.header.PlaintextSize)
+		}
+	}
+
+	reader.plaintext = *plaintext
+	return nil
+}
+
+// Only once the final chunk is open is there a footer to check, and nothing may follow it
+func (reader *DecryptReader) verifyFooter() error {
+	if reader.auth == nil {
+		return nil
+	}
+
+	extra, err := io.ReadFull(reader.source, make([]byte, 1))
+	if extra > 0 {
+		return errors.New("stream has more data than its header describes")
+	} else if err != io.EOF {
+		return fmt.Errorf("could not read file footer: %w", err)
+	}
+
+	footer := reader.holdback.footer()
+	if footer == nil {
+		return errors.New("file authentication failed, the stream is truncated and its footer is missing")
+	}
+
+	footerSize := footerSizeBytes(&reader.header)
+
+	err = reader.auth.verify(footer[:footerSize])
+	if err != nil || reader.signature == nil {
+		return err
+	}
+
+	// A detached signature is of everything, an embedded one of everything before it
+	signature := footer[footerSize:]
+	if reader.signature.detached != nil {
+		reader.signedHash.Write(footer)
+	} else {
+		reader.signedHash.Write(footer[:footerSize])
+		signature = footer[footerSize : footerSize+signatureSizeBytes(&reader.header)]
+	}
+
+	return reader.signature.verify(reader.signedHash.Sum(nil), signature)
+}
@@ -0,0 +1,333 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Temporary files - previews, the private directories the TPM and
+	PKCS#11 tools are handed files in - are all made here, under one
+	directory: the system's temporary directory unless SetTempDir (the
+	CLI's --temp-dir) names another, e.g. one on an encrypted volume or a
+	tmpfs that never reaches disk. A process that makes any gets a
+	session directory of its own, encryptor-session-<random>, readable
+	only by the user (0700, and 0600 for its files) whatever the umask or
+	the permissions of the directory it is in
+
+	A process that crashes or is killed leaves its session behind, with
+	whatever plaintext was in it. The session is locked by the operating
+	system (flock, LockFileEx, as --single-instance is) for as long as its
+	process lives, so CleanStaleTempFiles - the CLI runs it at startup -
+	removes the sessions whose lock can be taken and never one in use.
+	Where there are no such locks, sessions a day old are taken as stale
+
+	Files renamed into place once written (the scrub state, the hash
+	cache, media progress) cannot be made there, renames do not cross
+	filesystems. writeFileAtomic writes them beside their target as
+	<target>.tmp, created anew each time so permissions are never
+	inherited from a leftover, which the next write replaces. --tar
+	extraction and self-update stage beside their targets for the same
+	reason, and so does decryption: the plaintext goes to a hidden
+	.<target>.<random>.partial (0600) that takes the target's name only
+	once the footer and plaintext digest have been checked, so a file
+	that fails them leaves no target behind
+*/
+
+const tempSessionPrefix = "encryptor-session-"
+const tempSessionLockName = "session.lock"
+
+// Where sessions cannot be locked, how old one must be to be removed
+const tempSessionStaleAge = 24 * time.Hour
+
+// A session is locked an instant after it is made, until then it is left alone
+const tempSessionGrace = time.Minute
+
+var tempFiles = struct {
+	mutex     sync.Mutex
+	directory string   // Empty for the system's temporary directory
+	session   string   // This process's session, made on first use
+	lock      *os.File // Held open (and locked) while the session exists
+}{}
+
+func setTempDir(directory string) error {
+	if directory != "" {
+		absolute, err := filepath.Abs(directory)
+		if err != nil {
+			return fmt.Errorf("invalid temporary directory %q: %w", directory, err)
+		}
+
+		info, err := os.Stat(absolute)
+		if err != nil {
+			return fmt.Errorf("invalid temporary directory: %w", err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("temporary directory %s is not a directory", absolute)
+		}
+
+		directory = absolute
+	}
+
+	tempFiles.mutex.Lock()
+	defer tempFiles.mutex.Unlock()
+
+	if tempFiles.session != "" && directory != tempFiles.directory {
+		return errors.New("the temporary directory cannot change once temporary files have been made in it")
+	}
+
+	tempFiles.directory = directory
+	return nil
+}
+
+func tempDir() string {
+	tempFiles.mutex.Lock()
+	defer tempFiles.mutex.Unlock()
+
+	return tempDirLocked()
+}
+
+func tempDirLocked() string {
+	if tempFiles.directory != "" {
+		return tempFiles.directory
+	}
+
+	return os.TempDir()
+}
+
+// This process's session directory, made and locked the first time it is asked for
+func tempSession() (string, error) {
+	tempFiles.mutex.Lock()
+	defer tempFiles.mutex.Unlock()
+
+	if tempFiles.session != "" {
+		return tempFiles.session, nil
+	}
+
+	session, err := os.MkdirTemp(tempDirLocked(), tempSessionPrefix)
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary directory: %w", err)
+	}
+
+	// MkdirTemp asks for 0700, the umask could only have taken from it, but a shared directory's ACLs could add to it
+	err = os.Chmod(session, 0700)
+	if err == nil {
+		tempFiles.lock, err = os.OpenFile(filepath.Join(session, tempSessionLockName), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	}
+
+	if err == nil {
+		var locked bool
+
+		locked, err = lockTempSession(tempFiles.lock)
+		if err == nil && !locked {
+			err = errors.New("another process holds its lock")
+		}
+	}
+
+	if err != nil {
+		if tempFiles.lock != nil {
+			_ = tempFiles.lock.Close()
+			tempFiles.lock = nil
+		}
+
+		_ = os.RemoveAll(session)
+		return "", fmt.Errorf("could not set up temporary directory %s: %w", session, err)
+	}
+
+	tempFiles.session = session
+	return session, nil
+}
+
+// A file readable only by the user in this process's session, os.CreateTemp's pattern
+func createTempFile(pattern string) (*os.File, error) {
+	session, err := tempSession()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(session, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not create temporary file: %w", err)
+	}
+
+	return file, nil
+}
+
+// A directory only the user can enter in this process's session, os.MkdirTemp's pattern
+func createTempDir(pattern string) (string, error) {
+	session, err := tempSession()
+	if err != nil {
+		return "", err
+	}
+
+	directory, err := os.MkdirTemp(session, pattern)
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary directory: %w", err)
+	}
+
+	return directory, nil
+}
+
+// Removes this process's session and everything in it, the next temporary file starts a new one
+func removeTempFiles() error {
+	tempFiles.mutex.Lock()
+	defer tempFiles.mutex.Unlock()
+
+	if tempFiles.session == "" {
+		return nil
+	}
+
+	// Windows will not remove a file that is open
+	_ = tempFiles.lock.Close()
+	tempFiles.lock = nil
+
+	err := os.RemoveAll(tempFiles.session)
+	tempFiles.session = ""
+
+	if err != nil {
+		return fmt.Errorf("could not remove temporary files: %w", err)
+	}
+
+	return nil
+}
+
+// Removes the sessions crashed and killed processes left, returning how many, the first error does not stop the rest
+func cleanStaleTempFiles() (int, error) {
+	tempFiles.mutex.Lock()
+	directory, ownSession := tempDirLocked(), tempFiles.session
+	tempFiles.mutex.Unlock()
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return 0, fmt.Errorf("could not read temporary directory: %w", err)
+	}
+
+	var removed int
+	var firstErr error
+
+	for _, entry := range entries {
+		session := filepath.Join(directory, entry.Name())
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), tempSessionPrefix) || session == ownSession {
+			continue
+		}
+
+		if !isStaleTempSession(session) {
+			continue
+		}
+
+		err = os.RemoveAll(session)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not remove stale temporary files: %w", err)
+			}
+
+			continue
+		}
+
+		removed++
+	}
+
+	return removed, firstErr
+}
+
+// Another user's sessions cannot be opened and are never stale to us
+func isStaleTempSession(session string) bool {
+	file, err := os.OpenFile(filepath.Join(session, tempSessionLockName), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		info, statErr := os.Stat(session)
+		return statErr == nil && time.Since(info.ModTime()) > tempSessionGrace
+	}
+
+	if err != nil {
+		return false
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	if !tempSessionLocking {
+		info, statErr := file.Stat()
+		return statErr == nil && time.Since(info.ModTime()) > tempSessionStaleAge
+	}
+
+	locked, err := lockTempSession(file)
+	return err == nil && locked
+}
+
+// Written beside fileName and renamed over it, so an interrupted write leaves the last whole one
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) (err error) {
+	temporaryName := fileName + ".tmp"
+
+	// Left by a write that was interrupted, with whatever permissions it had then
+	_ = os.Remove(temporaryName)
+
+	file, err := os.OpenFile(temporaryName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(temporaryName)
+		}
+	}()
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryName, fileName)
+}
+
+// Decrypted plaintext is written beside fileName, under a name of its own, until it has been authenticated
+func createPartialTarget(fileName string, force bool) (*os.File, error) {
+	fileName = strings.TrimSpace(fileName)
+	if fileName == "" {
+		return nil, errors.New("empty string passed in for filename")
+	}
+
+	_, err := os.Stat(fileName)
+	if err == nil && !force {
+		return nil, ErrTargetExists
+	} else if os.IsPermission(err) {
+		return nil, fmt.Errorf("permissions error trying to access file for writing: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*.partial")
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for writing: %w", err)
+	}
+
+	return file, nil
+}
+
+// The partial file takes fileName once it has been, and is removed if it never is
+func finishPartialTarget(file *os.File, fileName string, verified bool) error {
+	err := file.Close()
+	if err == nil && verified {
+		forgetCachedEncryptedFileHeader(fileName)
+		err = os.Rename(file.Name(), strings.TrimSpace(fileName))
+	}
+
+	if err != nil || !verified {
+		_ = os.Remove(file.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package encryptor
+
+import (
+	"os"
+)
+
+// Sessions are judged stale by their age instead
+const tempSessionLocking = false
+
+func lockTempSession(file *os.File) (bool, error) {
+	return true, nil
+}
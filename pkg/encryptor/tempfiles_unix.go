@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package encryptor
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+const tempSessionLocking = true
+
+// false when another process holds the lock
+func lockTempSession(file *os.File) (bool, error) {
+	err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package encryptor
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+const tempSessionLocking = true
+
+// false when another process holds the lock
+func lockTempSession(file *os.File) (bool, error) {
+	var overlapped windows.Overlapped
+
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
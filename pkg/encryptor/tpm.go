@@ -0,0 +1,229 @@
+package encryptor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Sealing the file key to the local TPM 2.0, so a file can only be
+	decrypted on the machine that encrypted it - for staging areas that
+	must be useless once the disk leaves the machine. As with gpg the TPM
+	is driven by binaries, tpm2-tools, which reach it through
+	/dev/tpmrm0 (or TPM2TOOLS_TCTI)
+
+	The file key is sealed as a data object under a storage primary key
+	created from the owner hierarchy's seed with a fixed template, so the
+	primary is created again (rather than kept in the TPM) whenever it is
+	needed, and the sealed object can only be loaded by the same TPM. The
+	stanza holds the sealed object's public and private parts, TPM2B
+	structures as tpm2_create writes them, back to back
+
+	With PCRs (Options.TPMPCRs, e.g. 0,7) the object is also bound to a
+	policy on their current SHA-256 values, and unsealing fails once any
+	of them changes - firmware, Secure Boot state, or the bootloader,
+	depending on the PCRs. A firmware update then needs a file decrypted
+	before it and encrypted again after, or a second recipient to fall
+	back on
+
+	Decrypting needs no flag, the stanza says what to unseal and with
+	which PCRs. The owner hierarchy must have no password, as it does
+	unless the TPM was provisioned otherwise
+*/
+
+const RecipientTypeTPM2 = "tpm2"
+
+// The tpm2-tools binaries are this followed by the command, a variable so tests can stand in for the TPM
+var tpm2ToolsPrefix = "tpm2_"
+
+// The storage primary's template, it must be the same for every seal and unseal
+var tpm2PrimaryArgs = []string{"-C", "o", "-g", "sha256", "-G", "ecc256:aes128cfb"}
+
+// PCRs 0-23 of the SHA-256 bank as sha256:<n>,<n>, empty for none
+func parseTPMPCRs(pcrs string) (string, error) {
+	pcrs = strings.TrimPrefix(strings.TrimSpace(pcrs), "sha256:")
+	if pcrs == "" {
+		return "", nil
+	}
+
+	seen := map[int]bool{}
+	var selection []string
+
+	for _, pcr := range strings.Split(pcrs, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(pcr))
+		if err != nil || index < 0 || index > 23 {
+			return "", fmt.Errorf("PCR %q is not a number from 0 to 23, give PCRs as 0,7", pcr)
+		}
+
+		if !seen[index] {
+			seen[index] = true
+			selection = append(selection, strconv.Itoa(index))
+		}
+	}
+
+	return "sha256:" + strings.Join(selection, ","), nil
+}
+
+func wrapFileKeyTPM2(fileKey []byte, pcrs string) (RecipientStanza, error) {
+	selection, err := parseTPMPCRs(pcrs)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	var public, private []byte
+
+	err = withTPM2Session(func(session tpm2Session) error {
+		createArgs := []string{"-C", session.file("primary.ctx"), "-g", "sha256", "-u", session.file("seal.pub"), "-r", session.file("seal.priv"), "-i", "-"}
+
+		if selection != "" {
+			err := session.run(nil, "createpolicy", "--policy-pcr", "-l", selection, "-L", session.file("policy.dat"))
+			if err != nil {
+				return fmt.Errorf("could not create a policy on PCRs %s: %w", selection, err)
+			}
+
+			// Without userwithauth, whose empty password would unseal without the policy
+			createArgs = append(createArgs, "-L", session.file("policy.dat"), "-a", "fixedtpm|fixedparent")
+		}
+
+		err := session.run(fileKey, "create", createArgs...)
+		if err != nil {
+			return fmt.Errorf("could not seal: %w", err)
+		}
+
+		if public, err = os.ReadFile(session.file("seal.pub")); err == nil {
+			private, err = os.ReadFile(session.file("seal.priv"))
+		}
+
+		return err
+	})
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not seal file key to the TPM: %w", err)
+	}
+
+	args := []string{}
+	if selection != "" {
+		args = append(args, selection)
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeTPM2,
+		Args: args,
+		Body: base64.StdEncoding.EncodeToString(append(public, private...)),
+	}, nil
+}
+
+func unwrapFileKeyTPM2(stanza RecipientStanza) ([]byte, error) {
+	selection := ""
+	if len(stanza.Args) == 1 {
+		var err error
+		if selection, err = parseTPMPCRs(stanza.Args[0]); err != nil || selection == "" {
+			return nil, errors.New("malformed tpm2 stanza PCRs")
+		}
+	} else if len(stanza.Args) != 0 {
+		return nil, errors.New("malformed tpm2 stanza")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil || len(sealed) < 2 {
+		return nil, errors.New("malformed tpm2 stanza")
+	}
+
+	// TPM2B_PUBLIC starts with its size, TPM2B_PRIVATE is the rest
+	publicSize := 2 + int(binary.BigEndian.Uint16(sealed))
+	if publicSize >= len(sealed) {
+		return nil, errors.New("malformed tpm2 stanza")
+	}
+
+	var fileKey []byte
+
+	err = withTPM2Session(func(session tpm2Session) error {
+		err := os.WriteFile(session.file("seal.pub"), sealed[:publicSize], 0600)
+		if err == nil {
+			err = os.WriteFile(session.file("seal.priv"), sealed[publicSize:], 0600)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = session.run(nil, "load", "-C", session.file("primary.ctx"), "-u", session.file("seal.pub"), "-r", session.file("seal.priv"), "-c", session.file("seal.ctx"))
+		if err != nil {
+			return fmt.Errorf("could not load the sealed key, was the file encrypted on this machine? %w", err)
+		}
+
+		unsealArgs := []string{"-c", session.file("seal.ctx"), "-o", session.file("key")}
+		if selection != "" {
+			unsealArgs = append(unsealArgs, "-p", "pcr:"+selection)
+		}
+
+		err = session.run(nil, "unseal", unsealArgs...)
+		if err != nil && selection != "" {
+			return fmt.Errorf("could not unseal, PCRs %s may have changed since the file was encrypted: %w", selection, err)
+		} else if err != nil {
+			return fmt.Errorf("could not unseal: %w", err)
+		}
+
+		fileKey, err = os.ReadFile(session.file("key"))
+		return err
+	})
+
+	return fileKey, err
+}
+
+// A private directory for the context and object files of one seal or unseal, with the storage primary created in it
+type tpm2Session struct {
+	directory string
+}
+
+func withTPM2Session(work func(session tpm2Session) error) error {
+	directory, err := createTempDir("tpm2-")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = os.RemoveAll(directory)
+	}()
+
+	session := tpm2Session{directory: directory}
+
+	err = session.run(nil, "createprimary", append(append([]string{}, tpm2PrimaryArgs...), "-c", session.file("primary.ctx"))...)
+	if err != nil {
+		return fmt.Errorf("could not create the TPM's storage primary key: %w", err)
+	}
+
+	// The resource manager flushes transient objects as each command exits, nothing is left in the TPM
+	return work(session)
+}
+
+func (session tpm2Session) file(name string) string {
+	return filepath.Join(session.directory, name)
+}
+
+func (session tpm2Session) run(input []byte, command string, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(tpm2ToolsPrefix+command, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		detail := strings.TrimSpace(stderr.String())
+		if detail != "" {
+			return fmt.Errorf("%w: %s", err, detail)
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package encryptor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Hashing a directory hashes its files with a pool of workers (see
+	manifest.go), and sums the tree up as one hash - the SHA256 of its GNU
+	checksum manifest with paths relative to the directory, which is what
+
+		cd <dir> && encryptor hash --manifest=- . | sha256sum
+
+	prints, so a tree hash can be checked without encryptor. It changes if
+	any file's content, name, or place in the tree changes, or a file is
+	added or removed, and is the same wherever the tree is kept
+
+	A single SHA256 cannot be split across workers, but reading can be -
+	a large file is read ahead by the pipeline's read stage, with a
+	prefetch window of hashReadAhead chunks in flight, while its hash is
+	computed in order. Reading ahead is what helps on network filesystems
+	and disk arrays, whose latency a single sequential read pays in full
+*/
+
+const hashChunkSizeMB uint = 8
+
+// Chunks read ahead of the hash, which is also the bound on memory per file (with the chunk being hashed)
+const hashReadAhead uint = 4
+
+// Smaller files are read sequentially, there is too little to overlap
+const hashReadAheadMinimumBytes = int64(hashReadAhead*hashChunkSizeMB) * 1024 * 1024
+
+func treeHash(root string, entries []ChecksumEntry) (string, error) {
+	relative := make([]ChecksumEntry, len(entries))
+
+	for i, entry := range entries {
+		path, err := filepath.Rel(root, entry.Path)
+		if err != nil {
+			return "", fmt.Errorf("%s is not under %s: %w", entry.Path, root, err)
+		}
+
+		relative[i] = ChecksumEntry{Path: path, Hash: entry.Hash}
+	}
+
+	manifestHash := sha256.New()
+
+	err := writeChecksumManifest(manifestHash, relative, ManifestFormatGNU)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(manifestHash.Sum(nil)), nil
+}
+
+func hashLargeFile(fileName string, stats os.FileInfo) (string, error) {
+	numChunks := plaintextChunkCount(stats.Size(), bytesFromMB(hashChunkSizeMB))
+
+	readChannels := make([]chan *chunkReadRequest, numChunks)
+	executeChannels := make([]chan *[]byte, numChunks)
+
+	for i := range readChannels {
+		readChannels[i] = make(chan *chunkReadRequest, 1)
+		executeChannels[i] = make(chan *[]byte, 1)
+	}
+
+	window := newPrefetchWindow(hashReadAhead, hashReadAhead)
+	readErrors := make(chan error, 1)
+
+	go readStage(Encryption, fileName, hashChunkSizeMB, stats, EncryptedFileHeader{}, 0, nil, window, readErrors, 1, readChannels, executeChannels)
+
+	fileHash := sha256.New()
+
+	for i := range executeChannels {
+		var chunkData *[]byte
+
+		// A failed read never sends its chunk, the read stage's error says why
+		select {
+		case chunkData = <-executeChannels[i]:
+		case err := <-readErrors:
+			if err != nil {
+				return "", err
+			}
+
+			chunkData = <-executeChannels[i]
+		}
+
+		window.consumed()
+
+		fileHash.Write(*chunkData)
+	}
+
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
+}
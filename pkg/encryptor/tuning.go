@@ -0,0 +1,113 @@
+package encryptor
+
+import (
+	"runtime"
+)
+
+/*
+	Default concurrency used to be hard coded (6 readers, 12 executors)
+	which left most cores idle on large servers and oversubscribed small
+	VMs - the defaults are now derived from the machine we are running on
+
+	Executors are CPU bound (AES-GCM with hardware support runs at memory
+	speeds) so we want one per logical CPU and no more
+
+	Readers are IO bound and mostly wait on storage, more readers than the
+	storage can service only increases the number of chunks held in memory,
+	so we use half the CPUs and cap that by the number of NUMA nodes (each
+	node has its own memory controller, so a handful of readers per node is
+	enough to keep the executors on that node fed)
+
+	Benchmark_PipelineReaders (integration_test.go) is where both reader
+	constants come from - it encrypts a 256MB file with 1 to 16 readers
+	and the default executors. With the source in the page cache, a 1
+	CPU VM ran 428MB/s with 1 reader, 419 with 2, 462 with 4, 459 with 8
+	and 445 with 16: past 4 readers nothing is gained and the extra
+	chunks in flight cost memory and scheduling, hence readersPerNUMANode.
+	NumCPU/2 has not been measured the same way (a 1 CPU machine gets 1
+	reader either way) and remains an estimate, that a reader spends most
+	of its time waiting while an executor computes. Re-run it on the
+	hardware in question (and with the caches dropped, for slow storage)
+	before changing either
+
+	Both are capped by the memory we are limited to, so that a container
+	with a small memory limit on a large host does not start more workers
+	than it has memory for chunks (see memlimit.go)
+
+	Rotational storage is a special case - concurrent readers turn a linear
+	read into a seek storm, so a single reader is used unless the user has
+	explicitly asked for more
+*/
+
+// See Benchmark_PipelineReaders, no reader count past 4 was faster
+const readersPerNUMANode uint = 4
+
+func DefaultExecutors() uint8 {
+	return clampWorkers(memoryLimitedWorkers(uint(runtime.NumCPU()), GetMemoryLimit()), ExecutorsLimit)
+}
+
+func DefaultReaders() uint8 {
+	readers := uint(runtime.NumCPU()) / 2
+
+	nodes := numaNodeCount()
+	if nodes < 1 {
+		nodes = 1
+	}
+
+	if readers > nodes*readersPerNUMANode {
+		readers = nodes * readersPerNUMANode
+	}
+
+	return clampWorkers(memoryLimitedWorkers(readers, GetMemoryLimit()), ReadersLimit)
+}
+
+// Only called when the user did not specify readers, an explicit value always wins
+func TuneReadersForStorage(fileName string, readers uint8) uint8 {
+	rotational, err := isRotationalStorage(fileName)
+	if err != nil || !rotational {
+		return readers
+	}
+
+	return 1
+}
+
+func clampWorkers(workers uint, limit uint8) uint8 {
+	if workers < 1 {
+		return 1
+	}
+
+	if workers > uint(limit) {
+		return limit
+	}
+
+	return uint8(workers)
+}
+
+/*
+	Batching aims for roughly batchTargetMB of data per executor task, but
+	never so much that some executors are left without any work at all
+*/
+const batchTargetMB uint = 8
+
+func autoBatchChunks(chunkSizeMB uint, numChunks uint32, numExecutors uint) uint {
+	if chunkSizeMB < 1 || numExecutors < 1 {
+		return 1
+	}
+
+	batch := batchTargetMB / chunkSizeMB
+
+	perExecutor := uint(numChunks) / numExecutors
+	if batch > perExecutor {
+		batch = perExecutor
+	}
+
+	if batch < 1 {
+		return 1
+	}
+
+	if batch > BatchChunksMax {
+		return BatchChunksMax
+	}
+
+	return batch
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package encryptor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func numaNodeCount() uint {
+	nodes, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return 1
+	}
+
+	return uint(len(nodes))
+}
+
+/*
+	sysfs exposes a rotational flag per block device - we find the device
+	backing the file from its stat info and look it up, partitions do not
+	have a queue of their own so we fall back to their parent device
+
+	Anything we cannot identify (overlay, network and fuse filesystems,
+	device mapper stacks, etc) is reported as an error and treated as
+	non-rotational by the caller
+*/
+func isRotationalStorage(fileName string) (bool, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return false, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errors.New("could not obtain device information for file")
+	}
+
+	dev := uint64(stat.Dev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) & ^uint64(0xfff))
+	minor := (dev & 0xff) | ((dev >> 12) & ^uint64(0xff))
+
+	devicePath, err := filepath.EvalSymlinks("/sys/dev/block/" + strconv.FormatUint(major, 10) + ":" + strconv.FormatUint(minor, 10))
+	if err != nil {
+		return false, err
+	}
+
+	for _, dir := range []string{devicePath, filepath.Dir(devicePath)} {
+		data, err := os.ReadFile(filepath.Join(dir, "queue", "rotational"))
+		if err == nil {
+			return strings.TrimSpace(string(data)) == "1", nil
+		}
+	}
+
+	return false, errors.New("could not determine storage type for file")
+}
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+func hostMemoryBytes() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
+
+/*
+	The cgroup file names our cgroup in each hierarchy, 0::<path> with
+	cgroup v2 and <id>:memory:<path> with cgroup v1 (where the memory
+	controller may share a line with others). A limit on any cgroup above
+	ours applies to us as well, so we walk up to the root keeping the
+	smallest - inside a cgroup namespace our path is / and the root is
+	our own cgroup
+*/
+func cgroupMemoryLimit(root string, selfCgroup string) MemoryLimit {
+	data, err := os.ReadFile(selfCgroup)
+	if err != nil {
+		return MemoryLimit{}
+	}
+
+	var limit MemoryLimit
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		var found MemoryLimit
+
+		if fields[0] == "0" && fields[1] == "" {
+			found = cgroupHierarchyLimit(root, fields[2], "memory.max", "cgroup v2")
+		} else {
+			for _, controller := range strings.Split(fields[1], ",") {
+				if controller == "memory" {
+					found = cgroupHierarchyLimit(filepath.Join(root, "memory"), fields[2], "memory.limit_in_bytes", "cgroup v1")
+				}
+			}
+		}
+
+		if found.Bytes > 0 && (limit.Bytes == 0 || found.Bytes < limit.Bytes) {
+			limit = found
+		}
+	}
+
+	return limit
+}
+
+// The smallest limit from the cgroup at path up to the root, max (v2) is no limit
+func cgroupHierarchyLimit(mount string, path string, fileName string, source string) MemoryLimit {
+	var limit MemoryLimit
+
+	for dir := filepath.Clean("/" + path); ; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(mount, dir, fileName))
+		if err == nil {
+			bytes, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			if err == nil && bytes > 0 && (limit.Bytes == 0 || bytes < limit.Bytes) {
+				limit = MemoryLimit{Bytes: bytes, Source: source}
+			}
+		}
+
+		if dir == "/" {
+			return limit
+		}
+	}
+}
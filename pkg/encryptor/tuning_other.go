@@ -0,0 +1,27 @@
+//go:build !linux
+
+package encryptor
+
+import (
+	"errors"
+)
+
+// TBD: NUMA topology, storage, and memory limit detection are only implemented for Linux
+func numaNodeCount() uint {
+	return 1
+}
+
+func isRotationalStorage(fileName string) (bool, error) {
+	return false, errors.New("storage type detection is not supported on this platform")
+}
+
+const cgroupRoot = ""
+
+// Unknown, so a GOMEMLIMIT is taken as given
+func hostMemoryBytes() uint64 {
+	return 0
+}
+
+func cgroupMemoryLimit(root string, selfCgroup string) MemoryLimit {
+	return MemoryLimit{}
+}
@@ -0,0 +1,239 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+	Uploads to gs:// and Azure resume a part that failed part way within
+	the job (see gcs.go and azureblob.go), and a journal lets them resume
+	once the process itself is gone - killed, crashed, or failed on a
+	part that ran out of retries. Each upload keeps one in the encryptor
+	directory of the user cache directory (uploads/, 0700, files 0600 - a
+	GCS session URI authorizes its upload on its own), named for the
+	object, rewritten as parts are sent and removed once the object is
+	finished or the upload is cancelled
+
+	It holds what the service needs to carry on - the GCS resumable
+	session URI, or the IDs of the Azure blocks - and the SHA256 of every
+	part that was sent, which is what tells us the job is the same one. A
+	job run again with the journal there produces its output from the
+	start, and the parts already sent are checked against the journal
+	rather than sent again: a GCS upload carries on from where it stopped
+	once every one of them matches, and an Azure block that matches and
+	that Azure still has is left as it was staged
+
+	Encryption produces the same output again only with the same random
+	values, so the journal also keeps the header that was written (and
+	the key check of its file key), and an EncryptWriter whose target
+	resumes writes it again - its salt, file ID, and nonce prefix - when
+	the key or password gives the same file key and the options the same
+	header. Streams to recipients (a random file key) start over. A part that does not match is never sent under a header
+	written again, that would seal other plaintext with nonces the
+	service has already seen: the job fails, the upload is cancelled, and
+	the next run starts over with a new header. Output that differs under
+	a new header (another source, another key) starts a new upload as
+	long as nothing has been passed over
+*/
+
+// A variable so tests can keep their journals to themselves
+var uploadJournalDirectory = defaultUploadJournalDirectory
+
+// Empty when there is no user cache directory, uploads are then not journaled
+func defaultUploadJournalDirectory() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(cacheDir, "encryptor", "uploads")
+}
+
+type uploadJournal struct {
+	Target    string        // The object, as its String() names it (never with a SAS token)
+	Session   string        `json:",omitempty"` // GCS: the resumable upload's URI
+	Forced    bool          `json:",omitempty"` // GCS: the session replaces an object, rather than on condition there is none
+	Spans     []uploadSpan  `json:",omitempty"` // GCS: what it has persisted, in order
+	Sending   *uploadSpan   `json:",omitempty"` // GCS: the part being sent, which it may have seen some of
+	PartBytes int           `json:",omitempty"` // Azure: the size of every block but the last
+	Blocks    []uploadBlock `json:",omitempty"` // Azure: by block number, journaled before each is staged
+	Header    []byte        `json:",omitempty"` // The encrypted file header the output starts with
+	KeyCheck  []byte        `json:",omitempty"` // Of the header's file key, so another key is not taken for the same
+
+	fileName string
+	mutex    sync.Mutex // Azure blocks are staged, and recorded, concurrently
+}
+
+// Bytes of the output from Start up to End
+type uploadSpan struct {
+	Start  int64
+	End    int64
+	SHA256 []byte
+}
+
+// Journaled before the block is sent, and Staged once Azure has it
+type uploadBlock struct {
+	ID     string
+	SHA256 []byte `json:",omitempty"`
+	Staged bool   `json:",omitempty"`
+}
+
+func uploadJournalFilename(target string) string {
+	directory := uploadJournalDirectory()
+	if directory == "" {
+		return ""
+	}
+
+	digest := sha256.Sum256([]byte(target))
+	return filepath.Join(directory, hex.EncodeToString(digest[:])+".json")
+}
+
+// The journal an earlier run left for target, or a new one - one that cannot be read is started again
+func openUploadJournal(target string) (journal *uploadJournal, found bool) {
+	journal = &uploadJournal{Target: target, fileName: uploadJournalFilename(target)}
+	if journal.fileName == "" {
+		return journal, false
+	}
+
+	data, err := os.ReadFile(journal.fileName)
+	if err != nil {
+		return journal, false
+	}
+
+	var previous uploadJournal
+	if json.Unmarshal(data, &previous) != nil || previous.Target != target {
+		return journal, false
+	}
+
+	previous.fileName = journal.fileName
+	return &previous, true
+}
+
+/*
+	Written as parts land - an upload is no less able to finish for its
+	journal failing to be written, so errors only cost the resumption
+*/
+func (journal *uploadJournal) save() {
+	if journal == nil || journal.fileName == "" {
+		return
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return
+	}
+
+	if os.MkdirAll(filepath.Dir(journal.fileName), 0700) == nil {
+		_ = writeFileAtomic(journal.fileName, data, 0600)
+	}
+}
+
+func (journal *uploadJournal) remove() {
+	if journal != nil && journal.fileName != "" {
+		_ = os.Remove(journal.fileName)
+	}
+}
+
+// Starts the journal over for a new upload, keeping the header the output starts with
+func (journal *uploadJournal) reset() {
+	journal.mutex.Lock()
+	journal.Session, journal.Forced, journal.Spans, journal.Sending, journal.Blocks = "", false, nil, nil, nil
+	journal.mutex.Unlock()
+}
+
+// GCS persisted the bytes from start up to end
+func (journal *uploadJournal) recordSpan(start int64, end int64, data []byte) {
+	digest := sha256.Sum256(data)
+
+	journal.mutex.Lock()
+	journal.Spans = append(journal.Spans, uploadSpan{Start: start, End: end, SHA256: digest[:]})
+	journal.mutex.Unlock()
+
+	journal.save()
+}
+
+// Written before the bytes are, so whatever the service may have seen is journaled
+func (journal *uploadJournal) recordSending(start int64, data []byte) {
+	digest := sha256.Sum256(data)
+
+	journal.mutex.Lock()
+	journal.Sending = &uploadSpan{Start: start, End: start + int64(len(data)), SHA256: digest[:]}
+	journal.mutex.Unlock()
+
+	journal.save()
+}
+
+func (journal *uploadJournal) recordBlock(number int, id string, data []byte) {
+	digest := sha256.Sum256(data)
+
+	journal.mutex.Lock()
+	for len(journal.Blocks) <= number {
+		journal.Blocks = append(journal.Blocks, uploadBlock{})
+	}
+
+	journal.Blocks[number] = uploadBlock{ID: id, SHA256: digest[:]}
+	journal.mutex.Unlock()
+
+	journal.save()
+}
+
+func (journal *uploadJournal) blockStaged(number int, staged bool) {
+	journal.mutex.Lock()
+	journal.Blocks[number].Staged = staged
+	journal.mutex.Unlock()
+
+	journal.save()
+}
+
+/*
+	What the journal says of block number as id: whether it was sent with
+	other data than this, and whether Azure has it as it was sent
+*/
+func (journal *uploadJournal) checkBlock(number int, id string, data []byte) (differs bool, staged bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if number >= len(journal.Blocks) || journal.Blocks[number].ID != id {
+		return false, false
+	}
+
+	digest := sha256.Sum256(data)
+	if !bytes.Equal(journal.Blocks[number].SHA256, digest[:]) {
+		return true, false
+	}
+
+	return false, journal.Blocks[number].Staged
+}
+
+func (journal *uploadJournal) recordHeader(header []byte, keyCheck []byte) {
+	journal.mutex.Lock()
+	journal.Header = append([]byte{}, header...)
+	journal.KeyCheck = append([]byte{}, keyCheck...)
+	journal.mutex.Unlock()
+
+	journal.save()
+}
+
+/*
+	Writers whose upload can resume, as EncryptWriter sees them - the
+	header an interrupted upload started with and its key check (nil when
+	there is none to resume), and the ones this upload starts with, given
+	before they are written
+*/
+type resumableUpload interface {
+	resumeHeader() (header []byte, keyCheck []byte)
+	recordHeader(header []byte, keyCheck []byte)
+}
+
+// The output differs from what an upload sent under a header that was written again
+var errUploadDiffers = errors.New("the output is not what the interrupted upload sent, with nonces that were already used - the upload was cancelled and the next run starts over")
@@ -0,0 +1,50 @@
+package encryptor
+
+import (
+	"errors"
+	"hash"
+	"io"
+)
+
+/*
+	Verifying an archive should not need the disk space to hold what is
+	in it. A verification is a decryption - the read and execute stages
+	run as they would, so every chunk's tag is checked, then the footer
+	and the plaintext digest - but the write stage is replaced by one that
+	takes each chunk in order and lets it go, hashing it on the way
+
+	Unlike scrub, which checks chunk checksums and needs no key, this
+	needs the key and proves the file decrypts
+*/
+
+// Dev note: stands in for the write stage, reads write channels and keeps nothing
+func discardStage(budget *memoryBudget, plaintextHash hash.Hash, ch chan<- error, writeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic("discard stage", &err)
+
+	for i := range writeChannels {
+		chunkData := <-writeChannels[i]
+		close(writeChannels[i])
+
+		if plaintextHash != nil {
+			plaintextHash.Write(*chunkData)
+		}
+
+		budget.release()
+	}
+}
+
+func verifyReader(reader io.Reader, options *Options) error {
+	if reader == nil || options == nil {
+		return errors.New("reader or options is nil")
+	}
+
+	decryptReader, err := NewDecryptReader(reader, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, decryptReader)
+	return err
+}
@@ -0,0 +1,402 @@
+package encryptor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// We pass op into this worker because we will need it for some future cipher/block algorithms and modes
+func readWorker(op OperationEnum, fileName string, budget *memoryBudget, ch chan<- error, id uint, numWorkers uint, readChannels []chan *chunkReadRequest, executeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic(fmt.Sprintf("read worker %d", id), &err)
+
+	// We want our own file descriptor, and we'll use it for each chunk we read
+	fileName = strings.TrimSpace(fileName)
+	if fileName == "" {
+		err = errors.New("empty string passed in for filename")
+		return
+	}
+
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("source file does not exist: %w", err)
+		} else if os.IsPermission(err) {
+			err = fmt.Errorf("could not open source file due to insufficient permissions: %w", err)
+		} else {
+			err = fmt.Errorf("could not open source file due to unexpected error: %w", err)
+		}
+
+		return
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	// Do our share of the work non-linearly based upon the number of workers and our id
+	idMatch := id
+
+	if idMatch == numWorkers {
+		idMatch = 0
+	}
+
+	for i := uint(1); i <= uint(len(readChannels)); i++ {
+		if i%numWorkers == idMatch {
+			// Work on this channel
+			request := <-readChannels[i-1]
+			close(readChannels[i-1])
+
+			// A bounded job waits here until the chunk fits in memory
+			budget.acquire(i)
+
+			// Read the amount of data we have been told to - if we read EOF that's an error
+			seek, err := file.Seek(request.RangeStart, 0)
+			if err != nil || seek != request.RangeStart {
+				err = fmt.Errorf("could not set file position to correct location: %w", err)
+				return
+			}
+
+			// Allocate space for the chunk and create a buffered IO reader to consume with
+			bytesToRead := request.RangeEnd - request.RangeStart
+			chunkData := make([]byte, bytesToRead)
+
+			reader := bufio.NewReader(file)
+			bytesRead, err := io.ReadFull(reader, chunkData)
+			if err != nil || int64(bytesRead) != bytesToRead {
+				err = fmt.Errorf("error occurred durring read of file: %w", err)
+				return
+			}
+
+			// Pass this data to the execute stage's workers
+			executeChannels[i-1] <- &chunkData
+
+			/*
+				Go's userspace scheduler is not preemptive, it's a form of cooperative,
+				so yield in this stage as we do not want it getting too far ahead of
+				our other goroutines
+			*/
+			runtime.Gosched()
+		}
+	}
+}
+
+func executeWorker(op OperationEnum, cipherEnum CipherEnum, mode CipherModeEnum, keyMaterial []byte, chunkChecksum bool, fileHeader *EncryptedFileHeader, auth *fileAuthenticator, tree *merkleLeaves, prefetch *prefetchWindow, ch chan<- error, id uint, numWorkers uint, batchChunks uint, executeChannels []chan *[]byte, writeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic(fmt.Sprintf("execute worker %d", id), &err)
+
+	if batchChunks < 1 {
+		batchChunks = 1
+	}
+
+	// Do our share of the work non-linearly based upon the number of workers and our id
+	idMatch := id
+
+	if idMatch == numWorkers {
+		idMatch = 0
+	}
+
+	/*
+		Work is handed out in batches of consecutive chunks rather than
+		single chunks - ordering is preserved because every chunk still
+		has its own channel to the write stage
+	*/
+	numChunks := uint(len(executeChannels))
+
+	for i := uint(1); i <= numChunks; i++ {
+		batch := (i-1)/batchChunks + 1
+
+		if batch%numWorkers == idMatch {
+			// Work on this channel
+			chunkData := <-executeChannels[i-1]
+			close(executeChannels[i-1])
+
+			// Makes room for the prefetch stage to read another chunk ahead
+			prefetch.consumed()
+
+			chunkData, err = executeChunk(op, cipherEnum, mode, keyMaterial, chunkChecksum, fileHeader, auth, tree, i, numChunks, chunkData)
+			if err != nil {
+				return
+			}
+
+			writeChannels[i-1] <- chunkData
+
+			// Yield once per batch rather than once per chunk
+			if i%batchChunks == 0 || i == numChunks {
+				runtime.Gosched()
+			}
+		}
+	}
+}
+
+// Encrypts or decrypts one chunk, chunk IDs start at 1 - an encrypted chunk's marker is left to the write stage
+func executeChunk(op OperationEnum, cipherEnum CipherEnum, mode CipherModeEnum, keyMaterial []byte, chunkChecksum bool, fileHeader *EncryptedFileHeader, auth *fileAuthenticator, tree *merkleLeaves, chunkID uint, numChunks uint, chunkData *[]byte) (*[]byte, error) {
+	var err error
+
+	additionalData := chunkAdditionalData(fileHeader, uint32(chunkID), chunkID == numChunks)
+
+	if op == Encryption {
+		tree.record(chunkID, *chunkData)
+
+		chunkData, err = encryptBlob(cipherEnum, mode, chunkData, keyMaterial, additionalData, chunkNonceStart(fileHeader.NoncePrefix, uint32(chunkID)))
+		if err == nil {
+			auth.record(uint32(chunkID), *chunkData)
+		}
+
+		if err == nil && chunkChecksum {
+			*chunkData = appendChecksumCRC32C(*chunkData)
+		}
+	} else if op == Decryption {
+		if fileHeader.ChunkMarkers != "" {
+			*chunkData, err = stripChunkMarker(uint32(chunkID), *chunkData)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// A failed checksum is corruption, not a bad key, so check before authenticating
+		if chunkChecksum {
+			var checksumErr error
+			*chunkData, checksumErr = stripChecksumCRC32C(*chunkData)
+			if checksumErr != nil {
+				return nil, fmt.Errorf("chunk %d is corrupt: %w", chunkID, checksumErr)
+			}
+		}
+
+		auth.record(uint32(chunkID), *chunkData)
+
+		chunkData, err = decryptBlob(cipherEnum, mode, chunkData, keyMaterial, additionalData)
+		if err == nil {
+			tree.record(chunkID, *chunkData)
+		}
+	} else {
+		return nil, errors.New("bad operation found in execute pipeline")
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, err)
+	}
+
+	return chunkData, nil
+}
+
+// A target file is written as it is, otherwise fileName is created - flushChunks hands each chunk on as soon as it is written
+func writeWorker(op OperationEnum, header EncryptedFileHeader, fileName string, target *os.File, force bool, flushChunks bool, checksummer *cloudChecksummer, limiter *bandwidthLimiter, budget *memoryBudget, auth *fileAuthenticator, plaintextHash hash.Hash, writeBufferKB uint, fsync string, signer *fileSigner, ch chan<- error, id uint, numWorkers uint, writeChannels []chan *[]byte) {
+	var err error = nil
+	defer func() { ch <- err }()
+	defer recoverWorkerPanic(fmt.Sprintf("write worker %d", id), &err)
+
+	file := target
+	if file == nil {
+		fileName = strings.TrimSpace(fileName)
+		if fileName == "" {
+			err = errors.New("empty string passed in for filename")
+			return
+		}
+
+		// Does the file already exist?  We'll try to get info on it
+		fileExists := true
+
+		_, err = os.Stat(fileName)
+		if os.IsNotExist(err) {
+			fileExists = false
+		} else if os.IsPermission(err) {
+			err = fmt.Errorf("permissions error trying to access file for writing: %w", err)
+			return
+		}
+
+		if true == fileExists && force == false {
+			err = ErrTargetExists
+			return
+		}
+
+		forgetCachedEncryptedFileHeader(fileName)
+
+		/*
+			In case we have time to implement concurrent random access rights,
+			let's create a file descriptor for this worker to use - otherwise
+			we could simply do all this work in the write stage function
+		*/
+		file, err = os.Create(fileName)
+		if err != nil {
+			err = fmt.Errorf("could not open file for writing: %w", err)
+		}
+
+		// Because the close is for a file we are writing to, handle errors on defer
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				err = fmt.Errorf("error closing file we were writing to: %w", err)
+			}
+		}(file)
+	}
+
+	var observers []io.Writer
+	if checksummer != nil {
+		observers = append(observers, checksummer)
+	}
+
+	if plaintextHash != nil {
+		observers = append(observers, plaintextHash)
+	}
+
+	if signer != nil {
+		observers = append(observers, signer.hash)
+	}
+
+	writer := newChunkWriter(file, observers, writeBufferKB, fsync)
+
+	/*
+		Attention: if we get the time to implement concurrent/parallelized writes
+		then ensure we consider the complete header length when computing ranges
+		for channel data pwrites (header length indicator + header UTF-8 length)
+
+		For now, we have 1 worker, meaning if our op is encryption, we prefix the
+		file with the complete header data
+	*/
+	if op == Encryption {
+		headerBytes, err := getCompleteEncryptedFileHeaderAsBytes(&header)
+		if err != nil {
+			err = fmt.Errorf("failed to assemble encrypted file header: %w", err)
+			return
+		}
+
+		// Write the header
+		written, err := writer.Write(headerBytes)
+		if err != nil || written != len(headerBytes) {
+			err = fmt.Errorf("failed to write data to file: %w", err)
+			return
+		}
+	}
+
+	// Do our share of the work non-linearly based upon the number of workers and our id
+	idMatch := id
+
+	if idMatch == numWorkers {
+		idMatch = 0
+	}
+
+	for i := uint(1); i <= uint(len(writeChannels)); i++ {
+		if i%numWorkers == idMatch {
+			// Work on this channel
+			chunkData := <-writeChannels[i-1]
+			close(writeChannels[i-1])
+
+			// Written ahead of the chunk rather than copied in front of it, see newChunkWriter
+			var marker []byte
+			if op == Encryption && header.ChunkMarkers != "" {
+				marker = chunkMarker(uint32(i))
+			}
+
+			// Held back here if the bandwidth schedule says we are going too fast
+			limiter.wait(len(marker) + len(*chunkData))
+
+			if len(marker) > 0 {
+				_, err = writer.Write(marker)
+				if err != nil {
+					err = fmt.Errorf("failed to write data to file: %w", err)
+					return
+				}
+			}
+
+			/*
+				Lots of confusing information talking about concurrent writes from different
+				file descriptors - this is possible in Linux, but I don't know golang's IO well
+				enough to know if this works - if I have time, will experiment
+			*/
+			var written int
+			written, err = writer.Write(*chunkData)
+			if err != nil || written != len(*chunkData) {
+				err = fmt.Errorf("failed to write data to file: %w", err)
+				return
+			}
+
+			// Gathered chunks are held by reference, the memory budget must not count one as gone before it is written
+			if _, gathering := writer.(*gatherWriter); (gathering && budget != nil) || flushChunks {
+				err = writer.Flush()
+				if err != nil {
+					err = fmt.Errorf("flush on write failed: %w", err)
+					return
+				}
+			}
+
+			budget.release()
+		}
+	}
+
+	// The footer goes last, once every chunk tag has been recorded
+	if op == Encryption && auth != nil {
+		footer := auth.sum()
+
+		var written int
+		written, err = writer.Write(footer)
+		if err != nil || written != len(footer) {
+			err = fmt.Errorf("failed to write file footer: %w", err)
+			return
+		}
+	}
+
+	// Signed once everything before it has been through the signer's hash, see fileSigner
+	if op == Encryption && header.Signature != "" {
+		err = writer.Flush()
+		if err != nil {
+			err = fmt.Errorf("flush on write failed: %w", err)
+			return
+		}
+
+		signature := signer.sign()
+
+		var written int
+		written, err = writer.Write(signature)
+		if err != nil || written != len(signature) {
+			err = fmt.Errorf("failed to write file signature: %w", err)
+			return
+		}
+	}
+
+	// The copy of the header follows the footer, see headerCopyBytes
+	if op == Encryption && header.HeaderCopy != "" {
+		var headerCopy []byte
+		headerCopy, err = headerCopyBytes(&header, header.NumChunks)
+		if err != nil {
+			err = fmt.Errorf("failed to assemble the copy of the header: %w", err)
+			return
+		}
+
+		var written int
+		written, err = writer.Write(headerCopy)
+		if err != nil || written != len(headerCopy) {
+			err = fmt.Errorf("failed to write the copy of the header: %w", err)
+			return
+		}
+	}
+
+	// Everything still buffered, see newChunkWriter
+	err = writer.Flush()
+	if err != nil {
+		err = fmt.Errorf("flush on write failed: %w", err)
+		return
+	}
+
+	// With FsyncFlush every flush has synced already
+	if fsync == FsyncEnd {
+		err = file.Sync()
+		if err != nil {
+			err = fmt.Errorf("could not sync file to disk: %w", err)
+			return
+		}
+	}
+
+	if op == Encryption && signer != nil && !signer.embedded() {
+		err = signer.writeDetached()
+	}
+}
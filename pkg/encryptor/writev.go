@@ -0,0 +1,178 @@
+package encryptor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	The write stage does not flush after every chunk, which would make
+	every buffer hand each chunk to the file on its own. What is written
+	is held until there is enough of it - the buffer is full, or for
+	vectored writes DefaultWriteBufferKB has gathered - and flushed once
+	more when the file is complete. A chunk bigger than the buffer is
+	written around it rather than copied in
+
+	Where the platform has vectored writes (writev on Linux) nothing is
+	buffered: what is written is gathered by reference, without copying,
+	and each flush hands all of it to the kernel in one writev. A chunk's
+	nonce, ciphertext, and tag are one contiguous seal already, so they
+	are one segment - the marker before them, the header before the first
+	chunk, and the footer and header copy at the end are the others
+
+	Options.WriteBufferKB chooses a buffer of that size instead, where
+	there are no vectored writes the buffer is DefaultWriteBufferKB
+
+	Flushing is not durability, the data is only in the page cache until
+	the file is synced. Options.Fsync chooses when that happens:
+
+	never - left to the operating system, as most tools do (the default)
+	end - once, when the file is complete, so a finished job is on disk
+	flush - after every flush as well, the most durable and the slowest
+*/
+
+const DefaultWriteBufferKB uint = 1024
+const WriteBufferMaxKB uint = 64 * 1024
+
+const FsyncNever = "never"
+const FsyncEnd = "end"
+const FsyncFlush = "flush"
+
+// The most segments one writev takes (IOV_MAX on Linux)
+const maxGatherSegments = 1024
+
+type chunkWriter interface {
+	io.Writer
+	Flush() error
+}
+
+/*
+	Holds on to everything written until it reaches limit bytes (or too
+	many segments) or Flush is called, then writes it to the file with
+	one vectored write - nothing written may be changed before then.
+	Observers (checksums, hashes) are fed each segment as it is written
+	to the file
+*/
+type gatherWriter struct {
+	file      *os.File
+	observers []io.Writer
+	segments  [][]byte
+	pending   int
+	limit     int
+	sync      bool // The file is synced after every flush
+}
+
+// The file each flush writes to is synced afterwards, for FsyncFlush
+type syncingWriter struct {
+	file *os.File
+}
+
+func checkFsyncPolicy(policy string) error {
+	switch policy {
+	case "", FsyncNever, FsyncEnd, FsyncFlush:
+		return nil
+	}
+
+	return fmt.Errorf("unknown fsync policy %q, use %s, %s, or %s", policy, FsyncNever, FsyncEnd, FsyncFlush)
+}
+
+func newChunkWriter(file *os.File, observers []io.Writer, bufferKB uint, fsync string) chunkWriter {
+	if bufferKB == 0 && vectoredWritesSupported {
+		return &gatherWriter{file: file, observers: observers, limit: int(DefaultWriteBufferKB) * 1024, sync: fsync == FsyncFlush}
+	}
+
+	if bufferKB == 0 {
+		bufferKB = DefaultWriteBufferKB
+	}
+
+	var output io.Writer = file
+	if fsync == FsyncFlush {
+		output = syncingWriter{file: file}
+	}
+
+	if len(observers) > 0 {
+		output = io.MultiWriter(append([]io.Writer{output}, observers...)...)
+	}
+
+	return bufio.NewWriterSize(output, int(bufferKB)*1024)
+}
+
+func (writer syncingWriter) Write(data []byte) (int, error) {
+	written, err := writer.file.Write(data)
+	if err != nil {
+		return written, err
+	}
+
+	return written, writer.file.Sync()
+}
+
+func (writer *gatherWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	writer.segments = append(writer.segments, data)
+	writer.pending += len(data)
+
+	if writer.pending >= writer.limit || len(writer.segments) >= maxGatherSegments {
+		err := writer.Flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (writer *gatherWriter) Flush() error {
+	if len(writer.segments) == 0 {
+		return nil
+	}
+
+	err := writeVectored(writer.file, writer.segments)
+	if err != nil {
+		return err
+	}
+
+	if writer.sync {
+		err = writer.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range writer.segments {
+		for _, observer := range writer.observers {
+			_, err = observer.Write(segment)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The segments are the caller's again, they must not be held on to
+	for i := range writer.segments {
+		writer.segments[i] = nil
+	}
+
+	writer.segments = writer.segments[:0]
+	writer.pending = 0
+
+	return nil
+}
+
+// What remains of segments once written bytes were written from the front of them
+func advanceSegments(segments [][]byte, written int) [][]byte {
+	for len(segments) > 0 && written >= len(segments[0]) {
+		written -= len(segments[0])
+		segments = segments[1:]
+	}
+
+	if len(segments) > 0 && written > 0 {
+		segments[0] = segments[0][written:]
+	}
+
+	return segments
+}
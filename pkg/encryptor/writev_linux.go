@@ -0,0 +1,46 @@
+//go:build linux
+
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+const vectoredWritesSupported = true
+
+// The kernel may write less than asked (or be interrupted), so writev is repeated until everything is written - segments is resliced as it goes
+func writeVectored(file *os.File, segments [][]byte) error {
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("could not write to file: %w", err)
+	}
+
+	for len(segments) > 0 {
+		var written int
+		var writeErr error
+
+		err = rawConn.Write(func(fd uintptr) bool {
+			written, writeErr = unix.Writev(int(fd), segments)
+			return writeErr != unix.EAGAIN
+		})
+		if err != nil {
+			return fmt.Errorf("could not write to file: %w", err)
+		}
+
+		if errors.Is(writeErr, unix.EINTR) {
+			continue
+		} else if writeErr != nil {
+			return fmt.Errorf("could not write to file: %w", writeErr)
+		} else if written == 0 {
+			return fmt.Errorf("could not write to file: %w", io.ErrShortWrite)
+		}
+
+		segments = advanceSegments(segments, written)
+	}
+
+	return nil
+}
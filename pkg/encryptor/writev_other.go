@@ -0,0 +1,21 @@
+//go:build !linux
+
+package encryptor
+
+import (
+	"os"
+)
+
+// TBD: vectored writes are only implemented for Linux, elsewhere the write stage buffers
+const vectoredWritesSupported = false
+
+func writeVectored(file *os.File, segments [][]byte) error {
+	for _, segment := range segments {
+		_, err := file.Write(segment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package encryptor
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"os"
+	"strings"
+)
+
+/*
+	Recipients that are plain X25519 public keys, for people without an
+	SSH key or gpg, and for machines that should each have their own key
+	rather than share a password. A public key is 32 bytes in standard
+	base64 (the same form WireGuard uses, so its keys work as they are)
+
+	The file key is wrapped the way ssh-ed25519 wraps it - an ephemeral
+	X25519 exchange with the recipient produces a shared secret, and HKDF
+	of that secret keys a ChaCha20-Poly1305 seal of the file key - with a
+	label of its own, so a stanza of one type never opens as the other.
+	The stanza holds the ephemeral share and not the recipient's key,
+	decryption tries each identity against it instead
+
+	An identity file holds the private key on a line of its own, lines
+	starting with # are comments (keygen writes the public key in one)
+*/
+
+const RecipientTypeX25519 = "x25519"
+
+const x25519Label = "encryptor/v1/x25519"
+
+// The private key, and its public key to give to whoever encrypts to it
+func generateX25519Identity() (string, string, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if err := readRandom(privateKey); err != nil {
+		return "", "", fmt.Errorf("internal crypto error generating private key: %w", err)
+	}
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(privateKey), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+func parseX25519Key(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != curve25519.PointSize {
+		return nil, errors.New("an X25519 key is 32 bytes in base64")
+	}
+
+	return key, nil
+}
+
+// A recipient is a public key, or a file of them one per line - X25519 or ML-KEM-768 + X25519
+func readRecipientKeys(recipient string) ([]string, error) {
+	if _, err := parseX25519Key(recipient); err == nil || strings.HasPrefix(recipient, mlkemX25519PublicPrefix) {
+		return []string{recipient}, nil
+	}
+
+	data, err := os.ReadFile(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("recipient %q is neither a public key nor a readable file: %w", recipient, err)
+	}
+
+	keys := keyLines(string(data))
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("recipient %s has no public keys in it", recipient)
+	}
+
+	return keys, nil
+}
+
+// Blank lines and comments are skipped
+func keyLines(data string) []string {
+	var keys []string
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+
+	return keys
+}
+
+func wrapFileKeyForPublicKey(fileKey []byte, publicKey string) (RecipientStanza, error) {
+	if strings.HasPrefix(publicKey, mlkemX25519PublicPrefix) {
+		return wrapFileKeyMLKEMX25519(fileKey, publicKey)
+	}
+
+	key, err := parseX25519Key(publicKey)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	return wrapFileKeyX25519(fileKey, key)
+}
+
+func wrapFileKeyX25519(fileKey []byte, recipient []byte) (RecipientStanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if err := readRandom(ephemeral); err != nil {
+		return RecipientStanza{}, fmt.Errorf("internal crypto error generating ephemeral key: %w", err)
+	}
+
+	ephemeralShare, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	// Fails for low order points, which would make the shared secret predictable
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return RecipientStanza{}, fmt.Errorf("could not encrypt to X25519 recipient: %w", err)
+	}
+
+	body, err := sealFileKey(fileKey, shared, append(ephemeralShare, recipient...), x25519Label)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+
+	return RecipientStanza{
+		Type: RecipientTypeX25519,
+		Args: []string{base64.StdEncoding.EncodeToString(ephemeralShare)},
+		Body: base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+func unwrapFileKeyX25519(stanza RecipientStanza, identities [][]byte) ([]byte, error) {
+	if len(stanza.Args) < 1 {
+		return nil, errors.New("malformed x25519 stanza")
+	}
+
+	ephemeralShare, err := parseX25519Key(stanza.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed x25519 stanza: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(stanza.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed x25519 stanza: %w", err)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("no X25519 identity was given, use --identity")
+	}
+
+	for _, privateKey := range identities {
+		publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+		if err != nil {
+			continue
+		}
+
+		shared, err := curve25519.X25519(privateKey, ephemeralShare)
+		if err != nil {
+			return nil, fmt.Errorf("malformed x25519 stanza: %w", err)
+		}
+
+		fileKey, err := openFileKey(body, shared, append(ephemeralShare, publicKey...), x25519Label)
+		if err == nil {
+			return fileKey, nil
+		}
+	}
+
+	return nil, errors.New("no X25519 identity matches")
+}
+
+// The private keys in identity files, X25519 and ML-KEM-768 + X25519
+type keyIdentities struct {
+	x25519      [][]byte
+	mlkemX25519 [][]byte
+}
+
+func loadKeyIdentities(fileNames []string) (keyIdentities, error) {
+	var identities keyIdentities
+
+	for _, fileName := range fileNames {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return keyIdentities{}, fmt.Errorf("could not read identity: %w", err)
+		}
+
+		lines := keyLines(string(data))
+		if len(lines) == 0 {
+			return keyIdentities{}, fmt.Errorf("identity %s has no private keys in it", fileName)
+		}
+
+		for _, line := range lines {
+			if strings.HasPrefix(line, mlkemX25519SecretPrefix) {
+				key, err := parseMLKEMX25519Secret(line)
+				if err != nil {
+					return keyIdentities{}, fmt.Errorf("could not parse identity %s: %w", fileName, err)
+				}
+
+				identities.mlkemX25519 = append(identities.mlkemX25519, key)
+				continue
+			}
+
+			key, err := parseX25519Key(line)
+			if err != nil {
+				return keyIdentities{}, fmt.Errorf("could not parse identity %s: %w", fileName, err)
+			}
+
+			identities.x25519 = append(identities.x25519, key)
+		}
+	}
+
+	return identities, nil
+}
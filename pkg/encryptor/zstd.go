@@ -0,0 +1,397 @@
+package encryptor
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+/*
+	Zstandard (RFC 8878) is written here rather than imported, like the
+	other formats encryptor reads and writes, so the module keeps its
+	short list of dependencies. zstdwriter.go writes frames any zstd
+	decompresses - LZ77 sequences found with a hash table over the last
+	zstdWindowBytes, literals Huffman coded when that is smaller, and
+	sequences coded with the predefined FSE tables - and zstdreader.go
+	decompresses any frame, whatever wrote it, given the dictionary when
+	it names one (see zstddictionary.go)
+
+	Both sides share what is here: the bitstreams (written forwards and
+	read backwards), FSE tables, the codes lengths and offsets are sent
+	as, the recent offsets, and XXH64 for the frame's checksum
+*/
+
+const zstdMagic uint32 = 0xFD2FB528
+const zstdSkippableMagic uint32 = 0x184D2A50 // The low 4 bits are anything
+const zstdBlockMaxBytes = 128 << 10
+const zstdMaxHuffmanBits = 11
+
+// A symbol of probability -1 has less than one cell's worth, and gets one at the end of the table
+var (
+	zstdLiteralLengthDistribution = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMatchLengthDistribution   = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOffsetDistribution        = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+)
+
+const (
+	zstdLiteralLengthAccuracyLog = 6
+	zstdMatchLengthAccuracyLog   = 6
+	zstdOffsetAccuracyLog        = 5
+)
+
+// Lengths are sent as a code and extra bits, the code's baseline plus the bits is the length
+var (
+	zstdLiteralLengthBaselines = []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLiteralLengthExtraBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMatchLengthBaselines   = []uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	zstdMatchLengthExtraBits   = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// The code a length is sent as, the last whose baseline is not above it
+func zstdLengthCode(length uint32, baselines []uint32) uint8 {
+	code := len(baselines) - 1
+	for baselines[code] > length {
+		code--
+	}
+
+	return uint8(code)
+}
+
+// Written forwards a little endian bit at a time, and read backwards by zstdReverseBits
+type zstdBitWriter struct {
+	out       []byte
+	container uint64
+	count     uint
+}
+
+// At most 56 bits at a time
+func (writer *zstdBitWriter) add(value uint64, count uint) {
+	writer.container |= (value & (1<<count - 1)) << writer.count
+	writer.count += count
+
+	for writer.count >= 8 {
+		writer.out = append(writer.out, byte(writer.container))
+		writer.container >>= 8
+		writer.count -= 8
+	}
+}
+
+// A 1 bit marks where the stream ends, readers start just below it
+func (writer *zstdBitWriter) close() []byte {
+	writer.add(1, 1)
+	if writer.count > 0 {
+		writer.out = append(writer.out, byte(writer.container))
+	}
+
+	return writer.out
+}
+
+type zstdReverseBits struct {
+	data     []byte
+	position int // The bits not read yet, those below it - below 0 is reading past the start
+}
+
+func newZstdReverseBits(data []byte) (zstdReverseBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return zstdReverseBits{}, errors.New("zstd bitstream has no end marker")
+	}
+
+	return zstdReverseBits{data: data, position: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// At most 56 bits at a time, bits before the start of the stream read as 0
+func (reader *zstdReverseBits) read(count uint) uint64 {
+	if count == 0 {
+		return 0
+	}
+
+	reader.position -= int(count)
+	return reader.peekAt(reader.position, count)
+}
+
+func (reader *zstdReverseBits) peek(count uint) uint64 {
+	return reader.peekAt(reader.position-int(count), count)
+}
+
+func (reader *zstdReverseBits) peekAt(start int, count uint) uint64 {
+	first := start >> 3
+	shift := uint(start - first*8)
+
+	var window uint64
+	if first >= 0 && first+8 <= len(reader.data) {
+		window = binary.LittleEndian.Uint64(reader.data[first:])
+	} else {
+		for i := 0; i < 8; i++ {
+			if index := first + i; index >= 0 && index < len(reader.data) {
+				window |= uint64(reader.data[index]) << (8 * i)
+			}
+		}
+	}
+
+	return window >> shift & (1<<count - 1)
+}
+
+func (reader *zstdReverseBits) overflowed() bool {
+	return reader.position < 0
+}
+
+type zstdFSEEntry struct {
+	symbol   uint8
+	bits     uint8
+	baseline uint16
+}
+
+type zstdFSETable struct {
+	accuracyLog uint8
+	entries     []zstdFSEEntry
+	encode      [][]uint16 // By symbol then by the state that follows, the state to be in before it - only for the writer
+}
+
+// Spreads the symbols over the table as every zstd does, so the same distribution gives the same table
+func newZstdFSETable(distribution []int16, accuracyLog uint8) (*zstdFSETable, error) {
+	size := 1 << accuracyLog
+	table := &zstdFSETable{accuracyLog: accuracyLog, entries: make([]zstdFSEEntry, size)}
+	next := make([]uint32, len(distribution))
+	high := size - 1
+
+	for symbol, count := range distribution {
+		if count == -1 {
+			if high < 0 {
+				return nil, errors.New("zstd FSE distribution has too many symbols")
+			}
+
+			table.entries[high].symbol = uint8(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = uint32(count)
+		}
+	}
+
+	position, step, mask := 0, size>>1+size>>3+3, size-1
+
+	for symbol, count := range distribution {
+		for i := int16(0); i < count; i++ {
+			table.entries[position].symbol = uint8(symbol)
+
+			position = (position + step) & mask
+			for position > high {
+				position = (position + step) & mask
+			}
+		}
+	}
+
+	// Every cell is reached once when the counts add up to the table
+	if position != 0 {
+		return nil, errors.New("zstd FSE distribution does not fill its table")
+	}
+
+	for i := range table.entries {
+		symbol := table.entries[i].symbol
+		state := next[symbol]
+		next[symbol]++
+
+		stateBits := uint32(accuracyLog) - uint32(bits.Len32(state)-1)
+		table.entries[i].bits = uint8(stateBits)
+		table.entries[i].baseline = uint16(state<<stateBits - uint32(size))
+	}
+
+	return table, nil
+}
+
+// One symbol repeated, every state is the same
+func newZstdRLETable(symbol uint8) *zstdFSETable {
+	return &zstdFSETable{entries: []zstdFSEEntry{{symbol: symbol}}}
+}
+
+/*
+	The writer encodes backwards from the last symbol: the state the
+	decoder will move to is known, and the state before it is the cell
+	of the symbol whose range of next states holds it. A symbol's cells
+	share out every next state between them, so there is always one
+*/
+func (table *zstdFSETable) buildEncoder(symbols int) {
+	table.encode = make([][]uint16, symbols)
+	for symbol := range table.encode {
+		table.encode[symbol] = make([]uint16, len(table.entries))
+	}
+
+	for state, entry := range table.entries {
+		for next := int(entry.baseline); next < int(entry.baseline)+1<<entry.bits; next++ {
+			table.encode[entry.symbol][next] = uint16(state)
+		}
+	}
+}
+
+// Any state that decodes the symbol, for the last symbol of a stream
+func (table *zstdFSETable) firstState(symbol uint8) uint16 {
+	return table.encode[symbol][0]
+}
+
+// The state before the one given that decodes symbol, and the bits the decoder reads to move from one to the other
+func (table *zstdFSETable) previousState(symbol uint8, next uint16) (uint16, uint64, uint) {
+	state := table.encode[symbol][next]
+	entry := table.entries[state]
+
+	return state, uint64(next - entry.baseline), uint(entry.bits)
+}
+
+var zstdPredefinedTables struct {
+	literalLengths *zstdFSETable
+	matchLengths   *zstdFSETable
+	offsets        *zstdFSETable
+}
+
+func init() {
+	var err error
+
+	zstdPredefinedTables.literalLengths, err = newZstdFSETable(zstdLiteralLengthDistribution, zstdLiteralLengthAccuracyLog)
+	if err == nil {
+		zstdPredefinedTables.matchLengths, err = newZstdFSETable(zstdMatchLengthDistribution, zstdMatchLengthAccuracyLog)
+	}
+
+	if err == nil {
+		zstdPredefinedTables.offsets, err = newZstdFSETable(zstdOffsetDistribution, zstdOffsetAccuracyLog)
+	}
+
+	if err != nil {
+		panic("zstd predefined tables: " + err.Error())
+	}
+
+	zstdPredefinedTables.literalLengths.buildEncoder(len(zstdLiteralLengthDistribution))
+	zstdPredefinedTables.matchLengths.buildEncoder(len(zstdMatchLengthDistribution))
+	zstdPredefinedTables.offsets.buildEncoder(len(zstdOffsetDistribution))
+}
+
+// XXH64 with a seed of 0, the low 32 bits of which end a frame
+type zstdXXH64 struct {
+	accumulators [4]uint64
+	total        uint64
+	buffer       [32]byte
+	buffered     int
+}
+
+const (
+	xxh64Prime1 uint64 = 11400714785074694791
+	xxh64Prime2 uint64 = 14029467366897019727
+	xxh64Prime3 uint64 = 1609587929392839161
+	xxh64Prime4 uint64 = 9650029242287828579
+	xxh64Prime5 uint64 = 2870177450012600261
+)
+
+func newZstdXXH64() *zstdXXH64 {
+	prime1, prime2 := xxh64Prime1, xxh64Prime2
+	return &zstdXXH64{accumulators: [4]uint64{prime1 + prime2, prime2, 0, -prime1}}
+}
+
+func xxh64Round(accumulator uint64, lane uint64) uint64 {
+	return bits.RotateLeft64(accumulator+lane*xxh64Prime2, 31) * xxh64Prime1
+}
+
+func xxh64Merge(hash uint64, accumulator uint64) uint64 {
+	return (hash^xxh64Round(0, accumulator))*xxh64Prime1 + xxh64Prime4
+}
+
+func (hash *zstdXXH64) Write(data []byte) (int, error) {
+	written := len(data)
+	hash.total += uint64(written)
+
+	if hash.buffered > 0 {
+		filled := copy(hash.buffer[hash.buffered:], data)
+		hash.buffered += filled
+		data = data[filled:]
+
+		if hash.buffered < len(hash.buffer) {
+			return written, nil
+		}
+
+		hash.stripe(hash.buffer[:])
+		hash.buffered = 0
+	}
+
+	for len(data) >= len(hash.buffer) {
+		hash.stripe(data[:len(hash.buffer)])
+		data = data[len(hash.buffer):]
+	}
+
+	hash.buffered = copy(hash.buffer[:], data)
+	return written, nil
+}
+
+func (hash *zstdXXH64) stripe(data []byte) {
+	for i := range hash.accumulators {
+		hash.accumulators[i] = xxh64Round(hash.accumulators[i], binary.LittleEndian.Uint64(data[8*i:]))
+	}
+}
+
+func (hash *zstdXXH64) sum64() uint64 {
+	var sum uint64
+
+	if hash.total >= uint64(len(hash.buffer)) {
+		a := hash.accumulators
+		sum = bits.RotateLeft64(a[0], 1) + bits.RotateLeft64(a[1], 7) + bits.RotateLeft64(a[2], 12) + bits.RotateLeft64(a[3], 18)
+		for _, accumulator := range a {
+			sum = xxh64Merge(sum, accumulator)
+		}
+	} else {
+		sum = xxh64Prime5
+	}
+
+	sum += hash.total
+
+	rest := hash.buffer[:hash.buffered]
+	for ; len(rest) >= 8; rest = rest[8:] {
+		sum ^= xxh64Round(0, binary.LittleEndian.Uint64(rest))
+		sum = bits.RotateLeft64(sum, 27)*xxh64Prime1 + xxh64Prime4
+	}
+
+	if len(rest) >= 4 {
+		sum ^= uint64(binary.LittleEndian.Uint32(rest)) * xxh64Prime1
+		sum = bits.RotateLeft64(sum, 23)*xxh64Prime2 + xxh64Prime3
+		rest = rest[4:]
+	}
+
+	for _, b := range rest {
+		sum ^= uint64(b) * xxh64Prime5
+		sum = bits.RotateLeft64(sum, 11) * xxh64Prime1
+	}
+
+	sum ^= sum >> 33
+	sum *= xxh64Prime2
+	sum ^= sum >> 29
+	sum *= xxh64Prime3
+	sum ^= sum >> 32
+
+	return sum
+}
+
+// Offset values 1 to 3 are the recent offsets, shifted by one when there are no literals - repeats kept alike by the reader and the writer
+func zstdResolveOffset(repeats *[3]uint32, offsetValue uint32, literalLength uint32) (uint32, error) {
+	if offsetValue > 3 {
+		offset := offsetValue - 3
+		repeats[0], repeats[1], repeats[2] = offset, repeats[0], repeats[1]
+
+		return offset, nil
+	}
+
+	if literalLength == 0 {
+		offsetValue++
+	}
+
+	switch offsetValue {
+	case 1:
+	case 2:
+		repeats[0], repeats[1] = repeats[1], repeats[0]
+	case 3:
+		repeats[0], repeats[1], repeats[2] = repeats[2], repeats[0], repeats[1]
+	default:
+		offset := repeats[0] - 1
+		if offset == 0 {
+			return 0, errZstdCorrupt
+		}
+
+		repeats[0], repeats[1], repeats[2] = offset, repeats[0], repeats[1]
+	}
+
+	return repeats[0], nil
+}
@@ -0,0 +1,357 @@
+package encryptor
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+	A zstd dictionary is content that frames compressed with it may
+	match against as if it came before them, which is what small files
+	lack: each alone has too little history to find repeats in, while a
+	few KB of what files like it share gives every one of them a start.
+	Dictionaries are written the way the zstd CLI's are (zstd --train),
+	so zstd -D reads frames compressed with ours - the magic, an ID that
+	frames name, the Huffman and FSE tables a frame starts with, the
+	three repeat offsets, and then the content
+
+	Training keeps the segments of the samples that most other samples
+	share, as the zstd CLI's cover trainer does. Every 8 bytes (a d-mer)
+	is counted once per sample it appears in - those in one sample only
+	are no use to the rest - and the samples are taken in turn for the
+	window of zstdDictionarySegmentBytes whose d-mers are counted most.
+	Once kept, a segment's d-mers count for nothing, so the next segment
+	adds something else. The first segments kept go at the end, where
+	matches are nearest and cheapest. Samples sharing nothing train no
+	dictionary
+
+	The Huffman table codes the samples' bytes (up to 128, as our trees
+	go), so our writer can send a frame's first literals without a tree
+	of their own. The FSE tables are the predefined distributions, which
+	are what our writer codes sequences with anyway
+*/
+
+const zstdDictionaryMagic uint32 = 0xEC30A437
+const zstdDictionaryMaxBytes = 32 << 10 // Content, so a dictionary sealed in a header leaves room for the rest of it
+const zstdDictionarySegmentBytes = 1 << 10
+const zstdDictionaryDmerBytes = 8
+const zstdDictionaryHashLog = 20
+
+// Below this, IDs are reserved for dictionaries registered with the zstd project
+const zstdDictionaryMinID = 32768
+
+type zstdDictionary struct {
+	id      uint32
+	content []byte
+	huffman *zstdHuffmanTable
+	tables  [3]*zstdFSETable // Literal lengths, offsets, match lengths, as a zstdReader keeps them
+	repeats [3]uint32
+	codes   *zstdHuffmanCodes // huffman as a zstdWriter sends literals with it
+	matches []int64           // A zstdWriter's table once it has seen the content, copied for every frame
+}
+
+func zstdDmerHash(data []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint64(data) * 0x9E3779B185EBCA87 >> (64 - zstdDictionaryHashLog))
+}
+
+// The dictionary, as it is written, trained from samples - nil when they share too little for one
+func trainZstdDictionary(samples [][]byte) []byte {
+	frequencies := make([]uint32, 1<<zstdDictionaryHashLog)
+	lastSample := make([]int, 1<<zstdDictionaryHashLog) // Plus 1, so a d-mer counts once a sample
+
+	for i, sample := range samples {
+		for position := 0; position+zstdDictionaryDmerBytes <= len(sample); position++ {
+			hash := zstdDmerHash(sample[position:])
+			if lastSample[hash] != i+1 {
+				lastSample[hash] = i + 1
+				frequencies[hash]++
+			}
+		}
+	}
+
+	for hash, frequency := range frequencies {
+		if frequency < 2 {
+			frequencies[hash] = 0
+		}
+	}
+
+	var segments [][]byte
+	size := 0
+	inWindow := make([]uint16, 1<<zstdDictionaryHashLog)
+
+	// Until the dictionary is full, or a pass over the samples finds nothing more shared
+	for kept := true; kept && size < zstdDictionaryMaxBytes; {
+		kept = false
+
+		for _, sample := range samples {
+			segment := zstdBestSegment(sample, frequencies, inWindow)
+			if segment == nil {
+				continue
+			}
+
+			for position := 0; position+zstdDictionaryDmerBytes <= len(segment); position++ {
+				frequencies[zstdDmerHash(segment[position:])] = 0
+			}
+
+			if size+len(segment) > zstdDictionaryMaxBytes {
+				segment = segment[len(segment)-(zstdDictionaryMaxBytes-size):]
+			}
+
+			segments = append(segments, segment)
+			size += len(segment)
+			kept = true
+
+			if size == zstdDictionaryMaxBytes {
+				break
+			}
+		}
+	}
+
+	// The repeat offsets (up to 8) have to be inside the content
+	if size < 8 {
+		return nil
+	}
+
+	content := make([]byte, 0, size)
+	for i := len(segments) - 1; i >= 0; i-- {
+		content = append(content, segments[i]...)
+	}
+
+	var counts [129]uint32
+	for _, sample := range samples {
+		for _, b := range sample {
+			if b <= 128 {
+				counts[b]++
+			}
+		}
+	}
+
+	return encodeZstdDictionary(content, counts[:])
+}
+
+// The window of the sample whose d-mers are counted most, trimmed to those counted - nil when none are
+func zstdBestSegment(sample []byte, frequencies []uint32, inWindow []uint16) []byte {
+	dmers := len(sample) - zstdDictionaryDmerBytes + 1
+	windowDmers := zstdDictionarySegmentBytes - zstdDictionaryDmerBytes + 1
+	if dmers <= 0 {
+		return nil
+	}
+
+	score, best, bestScore := uint64(0), 0, uint64(0)
+
+	for position := 0; position < dmers; position++ {
+		hash := zstdDmerHash(sample[position:])
+		if inWindow[hash] == 0 {
+			score += uint64(frequencies[hash])
+		}
+
+		inWindow[hash]++
+
+		if first := position - windowDmers + 1; first > 0 {
+			left := zstdDmerHash(sample[first-1:])
+			inWindow[left]--
+			if inWindow[left] == 0 {
+				score -= uint64(frequencies[left])
+			}
+		}
+
+		if score > bestScore {
+			best, bestScore = position-windowDmers+1, score
+			if best < 0 {
+				best = 0
+			}
+		}
+	}
+
+	// Emptied for the next sample
+	for position := dmers - windowDmers; position < dmers; position++ {
+		if position >= 0 {
+			inWindow[zstdDmerHash(sample[position:])]--
+		}
+	}
+
+	if bestScore == 0 {
+		return nil
+	}
+
+	first, last := best, best+windowDmers-1
+	if last >= dmers {
+		last = dmers - 1
+	}
+
+	for first < last && frequencies[zstdDmerHash(sample[first:])] == 0 {
+		first++
+	}
+
+	for last > first && frequencies[zstdDmerHash(sample[last:])] == 0 {
+		last--
+	}
+
+	return sample[first : last+zstdDictionaryDmerBytes]
+}
+
+// The dictionary as zstd writes it, its Huffman table coding literals as counts has them
+func encodeZstdDictionary(content []byte, literalCounts []uint32) []byte {
+	hash := newZstdXXH64()
+	_, _ = hash.Write(content)
+
+	out := make([]byte, 8, 8+zstdDictionaryMaxBytes/8+len(content))
+	binary.LittleEndian.PutUint32(out, zstdDictionaryMagic)
+	binary.LittleEndian.PutUint32(out[4:], uint32(hash.sum64()%(1<<31-zstdDictionaryMinID))+zstdDictionaryMinID)
+
+	// Every symbol gets a code, whatever literals other writers have
+	counts := make([]uint32, len(literalCounts))
+	for symbol, count := range literalCounts {
+		counts[symbol] = count + 1
+	}
+
+	tree, _ := zstdHuffmanCode(counts)
+	out = append(out, tree...)
+
+	out = writeZstdFSEDistribution(out, zstdOffsetDistribution, zstdOffsetAccuracyLog)
+	out = writeZstdFSEDistribution(out, zstdMatchLengthDistribution, zstdMatchLengthAccuracyLog)
+	out = writeZstdFSEDistribution(out, zstdLiteralLengthDistribution, zstdLiteralLengthAccuracyLog)
+
+	for _, repeat := range []uint32{1, 4, 8} {
+		out = append(out, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], repeat)
+	}
+
+	return append(out, content...)
+}
+
+// An FSE distribution as readZstdFSEDistribution reads it
+func writeZstdFSEDistribution(out []byte, distribution []int16, accuracyLog uint8) []byte {
+	writer := zstdBitWriter{out: out}
+	writer.add(uint64(accuracyLog-5), 4)
+
+	remaining := 1<<accuracyLog + 1
+	threshold := 1 << accuracyLog
+	valueBits := uint(accuracyLog) + 1
+	previousZero := false
+
+	for symbol := 0; symbol < len(distribution) && remaining > 1; {
+		// A run of symbols that never appear is a count, 3 at a time
+		if previousZero {
+			start := symbol
+			for symbol < len(distribution) && distribution[symbol] == 0 {
+				symbol++
+			}
+
+			if symbol == len(distribution) {
+				break
+			}
+
+			for ; symbol-start >= 3; start += 3 {
+				writer.add(3, 2)
+			}
+
+			writer.add(uint64(symbol-start), 2)
+		}
+
+		count := int(distribution[symbol])
+		symbol++
+
+		maxSmall := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+
+		// Sent 1 higher, so less than one cell is 0
+		value := count + 1
+		if value >= threshold {
+			value += maxSmall
+		}
+
+		if value < maxSmall {
+			writer.add(uint64(value), valueBits-1)
+		} else {
+			writer.add(uint64(value), valueBits)
+		}
+
+		previousZero = value == 1
+
+		for remaining < threshold {
+			valueBits--
+			threshold >>= 1
+		}
+	}
+
+	if writer.count > 0 {
+		writer.out = append(writer.out, byte(writer.container))
+	}
+
+	return writer.out
+}
+
+// Reads a dictionary as zstd writes it
+func parseZstdDictionary(data []byte) (*zstdDictionary, error) {
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != zstdDictionaryMagic {
+		return nil, errors.New("not a zstd dictionary")
+	}
+
+	dictionary := &zstdDictionary{id: binary.LittleEndian.Uint32(data[4:])}
+	if dictionary.id == 0 {
+		return nil, errors.New("zstd dictionary has no ID")
+	}
+
+	huffman, used, err := decodeZstdHuffmanTree(data[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	dictionary.huffman = huffman
+	data = data[8+used:]
+
+	// Sent as offsets, match lengths, literal lengths
+	for _, i := range []int{1, 2, 0} {
+		distribution, accuracyLog, used, err := readZstdFSEDistribution(data, zstdSequenceCodes[i].maxSymbol, zstdSequenceCodes[i].maxAccuracyLog)
+		if err != nil {
+			return nil, err
+		}
+
+		if dictionary.tables[i], err = newZstdFSETable(distribution, accuracyLog); err != nil {
+			return nil, errZstdCorrupt
+		}
+
+		data = data[used:]
+	}
+
+	if len(data) < 12 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	dictionary.content = data[12:]
+
+	for i := range dictionary.repeats {
+		dictionary.repeats[i] = binary.LittleEndian.Uint32(data[4*i:])
+		if dictionary.repeats[i] == 0 || int(dictionary.repeats[i]) > len(dictionary.content) {
+			return nil, errZstdCorrupt
+		}
+	}
+
+	dictionary.codes = zstdHuffmanTableCodes(huffman)
+	dictionary.matches = make([]int64, 1<<zstdHashLog)
+
+	for position := 0; position+zstdMinMatch <= len(dictionary.content); position++ {
+		dictionary.matches[zstdHash(binary.LittleEndian.Uint32(dictionary.content[position:]))] = int64(position) + 1
+	}
+
+	return dictionary, nil
+}
+
+// The codes a reader's table decodes, a symbol's code is where its entries start
+func zstdHuffmanTableCodes(table *zstdHuffmanTable) *zstdHuffmanCodes {
+	codes := &zstdHuffmanCodes{lengths: make([]uint8, 256), code: make([]uint16, 256), maxBits: table.maxBits}
+
+	for position := len(table.entries) - 1; position >= 0; position-- {
+		entry := table.entries[position]
+		codes.lengths[entry.symbol] = entry.bits
+		codes.code[entry.symbol] = uint16(position >> (table.maxBits - entry.bits))
+	}
+
+	return codes
+}
@@ -0,0 +1,847 @@
+package encryptor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+/*
+	A zstdReader decompresses zstd frames one block at a time, keeping
+	only the window matches may reach back into. It reads every block,
+	literals, and sequences type the format has, skips skippable frames,
+	and checks each frame's checksum and content size when they are
+	given. Windows over zstdMaxWindowBytes are refused rather than
+	allocated for, and so are frames needing a dictionary other than the
+	one the reader was given (see zstddictionary.go) - frames naming none
+	are read without it
+
+	Reading ends when the source does, so whatever comes after the last
+	frame in the source - for a DecryptReader, the checks of its footer -
+	has happened by the time io.EOF is returned
+*/
+
+const zstdMaxWindowBytes = 1 << 27
+
+var errZstdCorrupt = errors.New("zstd data is corrupt")
+
+type zstdHuffmanEntry struct {
+	symbol uint8
+	bits   uint8
+}
+
+type zstdHuffmanTable struct {
+	maxBits uint8
+	entries []zstdHuffmanEntry
+}
+
+type zstdReader struct {
+	source       io.Reader
+	inFrame      bool
+	last         bool
+	hasChecksum  bool
+	windowBytes  int
+	blockMax     int
+	contentBytes int64 // -1 when the frame does not say
+	produced     int64
+	checksum     *zstdXXH64
+	history      []byte
+	pending      []byte
+	err          error
+	block        []byte
+	literals     []byte
+	huffman      *zstdHuffmanTable
+	tables       [3]*zstdFSETable // Literal lengths, offsets, match lengths, for the next block to repeat
+	repeats      [3]uint32
+	dictionary   *zstdDictionary
+}
+
+func newZstdReader(source io.Reader) *zstdReader {
+	return &zstdReader{source: source}
+}
+
+func newZstdDictionaryReader(source io.Reader, dictionary *zstdDictionary) *zstdReader {
+	return &zstdReader{source: source, dictionary: dictionary}
+}
+
+func (reader *zstdReader) Read(data []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+
+		reader.err = reader.next()
+	}
+
+	n := copy(data, reader.pending)
+	reader.pending = reader.pending[n:]
+
+	return n, nil
+}
+
+func (reader *zstdReader) next() error {
+	if !reader.inFrame {
+		return reader.startFrame()
+	}
+
+	return reader.decodeBlock()
+}
+
+// The source ends cleanly between frames, anywhere else it is truncated
+func (reader *zstdReader) readFull(data []byte) error {
+	_, err := io.ReadFull(reader.source, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("zstd data is truncated: %w", err)
+	}
+
+	return err
+}
+
+func (reader *zstdReader) startFrame() error {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(reader.source, magic); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("zstd data is truncated: %w", err)
+		}
+
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(magic)&^0xF == zstdSkippableMagic {
+		if err := reader.readFull(magic); err != nil {
+			return err
+		}
+
+		skipped, err := io.CopyN(io.Discard, reader.source, int64(binary.LittleEndian.Uint32(magic)))
+		if err == io.EOF || (err == nil && skipped < int64(binary.LittleEndian.Uint32(magic))) {
+			return fmt.Errorf("zstd data is truncated: %w", io.ErrUnexpectedEOF)
+		}
+
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(magic) != zstdMagic {
+		return errors.New("not zstd data, or not a version of it that can be read")
+	}
+
+	descriptor := make([]byte, 1)
+	if err := reader.readFull(descriptor); err != nil {
+		return err
+	}
+
+	contentSizeFlag := descriptor[0] >> 6
+	singleSegment := descriptor[0]&0x20 != 0
+	dictionaryBytes := []int{0, 1, 2, 4}[descriptor[0]&3]
+
+	if descriptor[0]&0x08 != 0 {
+		return errZstdCorrupt
+	}
+
+	contentSizeBytes := []int{0, 2, 4, 8}[contentSizeFlag]
+	if contentSizeFlag == 0 && singleSegment {
+		contentSizeBytes = 1
+	}
+
+	windowDescriptorBytes := 1
+	if singleSegment {
+		windowDescriptorBytes = 0
+	}
+
+	header := make([]byte, windowDescriptorBytes+dictionaryBytes+contentSizeBytes)
+	if err := reader.readFull(header); err != nil {
+		return err
+	}
+
+	var windowBytes uint64
+	if !singleSegment {
+		exponent, mantissa := header[0]>>3, uint64(header[0]&7)
+		base := uint64(1) << (10 + exponent)
+		windowBytes = base + base/8*mantissa
+	}
+
+	dictionaryID := uint32(0)
+	for i, b := range header[windowDescriptorBytes : windowDescriptorBytes+dictionaryBytes] {
+		dictionaryID |= uint32(b) << (8 * i)
+	}
+
+	var dictionary *zstdDictionary
+	if dictionaryID != 0 {
+		if reader.dictionary == nil {
+			return errors.New("zstd data compressed with a dictionary cannot be read")
+		}
+
+		if dictionaryID != reader.dictionary.id {
+			return fmt.Errorf("zstd data compressed with dictionary %d cannot be read with dictionary %d", dictionaryID, reader.dictionary.id)
+		}
+
+		dictionary = reader.dictionary
+	}
+
+	reader.contentBytes = -1
+	if contentSizeBytes > 0 {
+		contentSize := make([]byte, 8)
+		copy(contentSize, header[windowDescriptorBytes+dictionaryBytes:])
+
+		size := binary.LittleEndian.Uint64(contentSize)
+		if contentSizeBytes == 2 {
+			size += 256
+		}
+
+		if singleSegment {
+			windowBytes = size
+		}
+
+		if size > 1<<62 {
+			return errZstdCorrupt
+		}
+
+		reader.contentBytes = int64(size)
+	}
+
+	if windowBytes > zstdMaxWindowBytes {
+		return fmt.Errorf("zstd data needs a %d byte window, more than the %d bytes allowed", windowBytes, zstdMaxWindowBytes)
+	}
+
+	reader.windowBytes = int(windowBytes)
+	reader.blockMax = zstdBlockMaxBytes
+	if reader.windowBytes < reader.blockMax {
+		reader.blockMax = reader.windowBytes
+	}
+
+	reader.inFrame = true
+	reader.hasChecksum = descriptor[0]&0x04 != 0
+	reader.produced = 0
+	reader.checksum = newZstdXXH64()
+	reader.history = reader.history[:0]
+	reader.huffman = nil
+	reader.tables = [3]*zstdFSETable{}
+	reader.repeats = [3]uint32{1, 4, 8}
+
+	// The frame starts as if the dictionary's content and tables came before it
+	if dictionary != nil {
+		reader.history = append(reader.history, dictionary.content...)
+		reader.huffman = dictionary.huffman
+		reader.tables = dictionary.tables
+		reader.repeats = dictionary.repeats
+	}
+
+	return nil
+}
+
+func (reader *zstdReader) decodeBlock() error {
+	// What is handed out has been read by now, so the window can be moved down
+	if len(reader.history) > 2*reader.windowBytes && len(reader.history) > zstdBlockMaxBytes {
+		dropped := len(reader.history) - reader.windowBytes
+		reader.history = reader.history[:copy(reader.history, reader.history[dropped:])]
+	}
+
+	blockHeader := make([]byte, 3)
+	if err := reader.readFull(blockHeader); err != nil {
+		return err
+	}
+
+	value := uint32(blockHeader[0]) | uint32(blockHeader[1])<<8 | uint32(blockHeader[2])<<16
+	last := value&1 != 0
+	size := int(value >> 3)
+	start := len(reader.history)
+
+	if size > reader.blockMax {
+		return errZstdCorrupt
+	}
+
+	switch value >> 1 & 3 {
+	case 0:
+		reader.history = append(reader.history, make([]byte, size)...)
+		if err := reader.readFull(reader.history[start:]); err != nil {
+			return err
+		}
+	case 1:
+		repeated := make([]byte, 1)
+		if err := reader.readFull(repeated); err != nil {
+			return err
+		}
+
+		for i := 0; i < size; i++ {
+			reader.history = append(reader.history, repeated[0])
+		}
+	case 2:
+		if cap(reader.block) < size {
+			reader.block = make([]byte, size)
+		}
+
+		reader.block = reader.block[:size]
+		if err := reader.readFull(reader.block); err != nil {
+			return err
+		}
+
+		if err := reader.decodeCompressed(reader.block); err != nil {
+			return err
+		}
+	default:
+		return errZstdCorrupt
+	}
+
+	output := reader.history[start:]
+	_, _ = reader.checksum.Write(output)
+	reader.produced += int64(len(output))
+
+	if reader.contentBytes >= 0 && reader.produced > reader.contentBytes {
+		return errors.New("zstd data is longer than its frame says")
+	}
+
+	if last {
+		reader.inFrame = false
+
+		if reader.contentBytes >= 0 && reader.produced != reader.contentBytes {
+			return errors.New("zstd data is shorter than its frame says")
+		}
+
+		if reader.hasChecksum {
+			checksum := make([]byte, 4)
+			if err := reader.readFull(checksum); err != nil {
+				return err
+			}
+
+			if binary.LittleEndian.Uint32(checksum) != uint32(reader.checksum.sum64()) {
+				return errors.New("zstd data does not match its checksum")
+			}
+		}
+	}
+
+	reader.pending = output
+	return nil
+}
+
+func (reader *zstdReader) decodeCompressed(block []byte) error {
+	literals, used, err := reader.decodeLiterals(block)
+	if err != nil {
+		return err
+	}
+
+	data := block[used:]
+	if len(data) == 0 {
+		return errZstdCorrupt
+	}
+
+	count, used := int(data[0]), 1
+	switch {
+	case count >= 255:
+		if len(data) < 3 {
+			return errZstdCorrupt
+		}
+
+		count, used = int(data[1])+int(data[2])<<8+0x7F00, 3
+	case count >= 128:
+		if len(data) < 2 {
+			return errZstdCorrupt
+		}
+
+		count, used = (count-128)<<8+int(data[1]), 2
+	}
+
+	start := len(reader.history)
+
+	if count > 0 {
+		if err = reader.decodeSequences(data[used:], count, literals, start); err != nil {
+			return err
+		}
+	} else {
+		reader.history = append(reader.history, literals...)
+	}
+
+	if len(reader.history)-start > reader.blockMax {
+		return errZstdCorrupt
+	}
+
+	return nil
+}
+
+// The block's literals, and how many bytes of it they took
+func (reader *zstdReader) decodeLiterals(block []byte) ([]byte, int, error) {
+	if len(block) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	literalsType, sizeFormat := block[0]&3, block[0]>>2&3
+
+	if literalsType < 2 {
+		regenerated, headerBytes := int(block[0]>>3), 1
+
+		switch sizeFormat {
+		case 1:
+			if len(block) < 2 {
+				return nil, 0, errZstdCorrupt
+			}
+
+			regenerated, headerBytes = int(block[0]>>4)+int(block[1])<<4, 2
+		case 3:
+			if len(block) < 3 {
+				return nil, 0, errZstdCorrupt
+			}
+
+			regenerated, headerBytes = int(block[0]>>4)+int(block[1])<<4+int(block[2])<<12, 3
+		}
+
+		if regenerated > reader.blockMax {
+			return nil, 0, errZstdCorrupt
+		}
+
+		if literalsType == 0 {
+			if len(block) < headerBytes+regenerated {
+				return nil, 0, errZstdCorrupt
+			}
+
+			return block[headerBytes : headerBytes+regenerated], headerBytes + regenerated, nil
+		}
+
+		if len(block) < headerBytes+1 {
+			return nil, 0, errZstdCorrupt
+		}
+
+		reader.literals = reader.literals[:0]
+		for i := 0; i < regenerated; i++ {
+			reader.literals = append(reader.literals, block[headerBytes])
+		}
+
+		return reader.literals, headerBytes + 1, nil
+	}
+
+	headerBytes, sizeBits, streams := 3, uint(10), 4
+	switch sizeFormat {
+	case 0:
+		streams = 1
+	case 2:
+		headerBytes, sizeBits = 4, 14
+	case 3:
+		headerBytes, sizeBits = 5, 18
+	}
+
+	if len(block) < headerBytes {
+		return nil, 0, errZstdCorrupt
+	}
+
+	var value uint64
+	for i := headerBytes - 1; i >= 0; i-- {
+		value = value<<8 | uint64(block[i])
+	}
+
+	regenerated := int(value >> 4 & (1<<sizeBits - 1))
+	compressed := int(value >> (4 + sizeBits) & (1<<sizeBits - 1))
+
+	if regenerated > reader.blockMax || len(block) < headerBytes+compressed {
+		return nil, 0, errZstdCorrupt
+	}
+
+	data := block[headerBytes : headerBytes+compressed]
+
+	if literalsType == 2 {
+		table, used, err := decodeZstdHuffmanTree(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		reader.huffman = table
+		data = data[used:]
+	} else if reader.huffman == nil {
+		return nil, 0, errZstdCorrupt
+	}
+
+	if cap(reader.literals) < regenerated {
+		reader.literals = make([]byte, regenerated)
+	}
+
+	reader.literals = reader.literals[:regenerated]
+
+	if streams == 1 {
+		if err := reader.huffman.decode(reader.literals, data); err != nil {
+			return nil, 0, err
+		}
+
+		return reader.literals, headerBytes + compressed, nil
+	}
+
+	if len(data) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	segmentBytes := (regenerated + 3) / 4
+	if regenerated < 3*segmentBytes {
+		return nil, 0, errZstdCorrupt
+	}
+
+	streamData := data[6:]
+	for i := 0; i < 4; i++ {
+		streamBytes := len(streamData)
+		if i < 3 {
+			streamBytes = int(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+
+		end := (i + 1) * segmentBytes
+		if i == 3 {
+			end = regenerated
+		}
+
+		if streamBytes > len(streamData) {
+			return nil, 0, errZstdCorrupt
+		}
+
+		if err := reader.huffman.decode(reader.literals[i*segmentBytes:end], streamData[:streamBytes]); err != nil {
+			return nil, 0, err
+		}
+
+		streamData = streamData[streamBytes:]
+	}
+
+	return reader.literals, headerBytes + compressed, nil
+}
+
+func decodeZstdHuffmanTree(data []byte) (*zstdHuffmanTable, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	var weights []uint8
+	used := 0
+
+	if header := int(data[0]); header >= 128 {
+		count := header - 127
+		used = 1 + (count+1)/2
+		if len(data) < used {
+			return nil, 0, errZstdCorrupt
+		}
+
+		for i := 0; i < count; i++ {
+			weight := data[1+i/2]
+			if i%2 == 0 {
+				weight >>= 4
+			}
+
+			weights = append(weights, weight&0xF)
+		}
+	} else {
+		used = 1 + header
+		if header == 0 || len(data) < used {
+			return nil, 0, errZstdCorrupt
+		}
+
+		var err error
+		if weights, err = decodeZstdHuffmanWeights(data[1:used]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	total := 0
+	for _, weight := range weights {
+		if weight > zstdMaxHuffmanBits {
+			return nil, 0, errZstdCorrupt
+		}
+
+		if weight > 0 {
+			total += 1 << (weight - 1)
+		}
+	}
+
+	if total == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	// The last symbol's weight is what fills the table
+	maxBits := uint8(bits.Len(uint(total)))
+	left := 1<<maxBits - total
+
+	if maxBits > zstdMaxHuffmanBits || left&(left-1) != 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	weights = append(weights, uint8(bits.Len(uint(left))))
+
+	table := &zstdHuffmanTable{maxBits: maxBits, entries: make([]zstdHuffmanEntry, 1<<maxBits)}
+	position := 0
+
+	for weight := uint8(1); weight <= maxBits; weight++ {
+		for symbol, symbolWeight := range weights {
+			if symbolWeight != weight {
+				continue
+			}
+
+			for i := 0; i < 1<<(weight-1); i++ {
+				table.entries[position] = zstdHuffmanEntry{symbol: uint8(symbol), bits: maxBits + 1 - weight}
+				position++
+			}
+		}
+	}
+
+	return table, used, nil
+}
+
+// Weights FSE compressed, two states taking turns until the bits run out
+func decodeZstdHuffmanWeights(data []byte) ([]uint8, error) {
+	distribution, accuracyLog, used, err := readZstdFSEDistribution(data, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := newZstdFSETable(distribution, accuracyLog)
+	if err != nil {
+		return nil, errZstdCorrupt
+	}
+
+	stream, err := newZstdReverseBits(data[used:])
+	if err != nil {
+		return nil, errZstdCorrupt
+	}
+
+	states := [2]uint64{stream.read(uint(accuracyLog)), stream.read(uint(accuracyLog))}
+	var weights []uint8
+
+	for turn := 0; ; turn ^= 1 {
+		if len(weights) >= 255 {
+			return nil, errZstdCorrupt
+		}
+
+		entry := table.entries[states[turn]]
+		weights = append(weights, entry.symbol)
+		states[turn] = uint64(entry.baseline) + stream.read(uint(entry.bits))
+
+		if stream.overflowed() {
+			weights = append(weights, table.entries[states[turn^1]].symbol)
+			break
+		}
+	}
+
+	if len(weights) > 255 {
+		return nil, errZstdCorrupt
+	}
+
+	return weights, nil
+}
+
+func (table *zstdHuffmanTable) decode(out []byte, data []byte) error {
+	stream, err := newZstdReverseBits(data)
+	if err != nil {
+		return errZstdCorrupt
+	}
+
+	for i := range out {
+		entry := table.entries[stream.peek(uint(table.maxBits))]
+		out[i] = entry.symbol
+		stream.position -= int(entry.bits)
+	}
+
+	if stream.position != 0 {
+		return errZstdCorrupt
+	}
+
+	return nil
+}
+
+/*
+	An FSE table's distribution as it is sent: the accuracy log, then
+	each symbol's probability in as few bits as the probability still
+	unspent allows, with runs of symbols that never appear sent as a
+	count after a 0. Returns the distribution, its accuracy log, and
+	the bytes it took
+*/
+func readZstdFSEDistribution(data []byte, maxSymbol int, maxAccuracyLog uint8) ([]int16, uint8, int, error) {
+	position := 0
+	read := func(count uint) uint32 {
+		var value uint32
+		for i := uint(0); i < count; i++ {
+			if index := (position + int(i)) >> 3; index < len(data) {
+				value |= uint32(data[index]>>((position+int(i))&7)&1) << i
+			}
+		}
+
+		return value
+	}
+
+	if len(data) == 0 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+
+	accuracyLog := uint8(read(4)) + 5
+	position += 4
+
+	if accuracyLog > maxAccuracyLog {
+		return nil, 0, 0, errZstdCorrupt
+	}
+
+	remaining := 1<<accuracyLog + 1
+	threshold := 1 << accuracyLog
+	valueBits := uint(accuracyLog) + 1
+
+	var distribution []int16
+
+	for remaining > 1 && len(distribution) <= maxSymbol {
+		maxSmall := 2*threshold - 1 - remaining
+
+		var count int
+		if small := int(read(valueBits - 1)); small < maxSmall {
+			count = small
+			position += int(valueBits) - 1
+		} else {
+			count = int(read(valueBits))
+			if count >= threshold {
+				count -= maxSmall
+			}
+
+			position += int(valueBits)
+		}
+
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+
+		distribution = append(distribution, int16(count))
+
+		if count == 0 {
+			for {
+				repeat := read(2)
+				position += 2
+
+				for i := uint32(0); i < repeat; i++ {
+					distribution = append(distribution, 0)
+				}
+
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+
+		for remaining < threshold {
+			valueBits--
+			threshold >>= 1
+		}
+	}
+
+	used := (position + 7) / 8
+	if remaining != 1 || len(distribution) > maxSymbol+1 || used > len(data) {
+		return nil, 0, 0, errZstdCorrupt
+	}
+
+	return distribution, accuracyLog, used, nil
+}
+
+// Literal lengths, offsets, and match lengths: the most symbols and accuracy log each may have, their predefined table
+var zstdSequenceCodes = [3]struct {
+	maxSymbol      int
+	maxAccuracyLog uint8
+}{{35, 9}, {31, 8}, {52, 9}}
+
+func (reader *zstdReader) decodeSequences(data []byte, count int, literals []byte, start int) error {
+	if len(data) == 0 || data[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+
+	modes := [3]uint8{data[0] >> 6, data[0] >> 4 & 3, data[0] >> 2 & 3}
+	predefined := [3]*zstdFSETable{zstdPredefinedTables.literalLengths, zstdPredefinedTables.offsets, zstdPredefinedTables.matchLengths}
+	used := 1
+
+	for i, mode := range modes {
+		switch mode {
+		case 0:
+			reader.tables[i] = predefined[i]
+		case 1:
+			if len(data) <= used || int(data[used]) > zstdSequenceCodes[i].maxSymbol {
+				return errZstdCorrupt
+			}
+
+			reader.tables[i] = newZstdRLETable(data[used])
+			used++
+		case 2:
+			distribution, accuracyLog, distributionBytes, err := readZstdFSEDistribution(data[used:], zstdSequenceCodes[i].maxSymbol, zstdSequenceCodes[i].maxAccuracyLog)
+			if err != nil {
+				return err
+			}
+
+			if reader.tables[i], err = newZstdFSETable(distribution, accuracyLog); err != nil {
+				return errZstdCorrupt
+			}
+
+			used += distributionBytes
+		default:
+			if reader.tables[i] == nil {
+				return errZstdCorrupt
+			}
+		}
+	}
+
+	stream, err := newZstdReverseBits(data[used:])
+	if err != nil {
+		return errZstdCorrupt
+	}
+
+	literalLengths, offsets, matchLengths := reader.tables[0], reader.tables[1], reader.tables[2]
+
+	literalLengthState := stream.read(uint(literalLengths.accuracyLog))
+	offsetState := stream.read(uint(offsets.accuracyLog))
+	matchLengthState := stream.read(uint(matchLengths.accuracyLog))
+
+	for i := 0; i < count; i++ {
+		literalLengthCode := literalLengths.entries[literalLengthState].symbol
+		offsetCode := offsets.entries[offsetState].symbol
+		matchLengthCode := matchLengths.entries[matchLengthState].symbol
+
+		if int(literalLengthCode) > zstdSequenceCodes[0].maxSymbol || int(offsetCode) > zstdSequenceCodes[1].maxSymbol || int(matchLengthCode) > zstdSequenceCodes[2].maxSymbol {
+			return errZstdCorrupt
+		}
+
+		offsetValue := uint32(1)<<offsetCode + uint32(stream.read(uint(offsetCode)))
+		matchLength := zstdMatchLengthBaselines[matchLengthCode] + uint32(stream.read(uint(zstdMatchLengthExtraBits[matchLengthCode])))
+		literalLength := zstdLiteralLengthBaselines[literalLengthCode] + uint32(stream.read(uint(zstdLiteralLengthExtraBits[literalLengthCode])))
+
+		offset, err := zstdResolveOffset(&reader.repeats, offsetValue, literalLength)
+		if err != nil {
+			return err
+		}
+
+		if int(literalLength) > len(literals) {
+			return errZstdCorrupt
+		}
+
+		reader.history = append(reader.history, literals[:literalLength]...)
+		literals = literals[literalLength:]
+
+		if int(offset) > len(reader.history) || len(reader.history)-start+int(matchLength) > reader.blockMax {
+			return errZstdCorrupt
+		}
+
+		from := len(reader.history) - int(offset)
+		if int(offset) >= int(matchLength) {
+			reader.history = append(reader.history, reader.history[from:from+int(matchLength)]...)
+		} else {
+			// The match overlaps what it is copying, so it repeats
+			for j := 0; j < int(matchLength); j++ {
+				reader.history = append(reader.history, reader.history[from+j])
+			}
+		}
+
+		if i < count-1 {
+			entry := literalLengths.entries[literalLengthState]
+			literalLengthState = uint64(entry.baseline) + stream.read(uint(entry.bits))
+
+			entry = matchLengths.entries[matchLengthState]
+			matchLengthState = uint64(entry.baseline) + stream.read(uint(entry.bits))
+
+			entry = offsets.entries[offsetState]
+			offsetState = uint64(entry.baseline) + stream.read(uint(entry.bits))
+		}
+	}
+
+	if stream.position != 0 {
+		return errZstdCorrupt
+	}
+
+	reader.history = append(reader.history, literals...)
+	return nil
+}
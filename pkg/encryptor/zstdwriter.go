@@ -0,0 +1,679 @@
+package encryptor
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+/*
+	A zstdWriter compresses what is written to it into one zstd frame,
+	a block of up to zstdBlockMaxBytes at a time, and finishes the frame
+	with its checksum on Close. Matches are looked for greedily, the
+	first 4 bytes that hashed the same within the window - or at the last
+	offset matched, which is sent as a repeat for next to nothing - which
+	is quick and does well on the text, logs, and databases compression
+	is for -
+	data that does not compress (media, archives, already compressed
+	files) costs a few bytes a block, and is hurried past
+
+	Literals are Huffman coded when none is above 128, the most the tree
+	can be sent for without FSE compressing it, and are sent as they are
+	otherwise. A block is written as it is when compressing does not make
+	it smaller
+
+	Given a dictionary (see zstddictionary.go), its content is history
+	before the frame starts, and the frame names the dictionary by its ID
+	so readers know to load it. Its Huffman table codes literals without
+	a tree being sent, until a block sends one of its own, whenever that
+	is smaller - most of what a small frame would otherwise spend
+
+	A frame's history and hash table are taken from zstdWriterBuffers and
+	given back on Close, and the table is never cleared: a frame's
+	positions in it start past the last frame's, which every entry left
+	over is then behind. A frame of a few hundred bytes costs as little to
+	start as a MB does
+*/
+
+const zstdWindowLog = 20
+const zstdWindowBytes = 1 << zstdWindowLog
+const zstdMinMatch = 4
+const zstdHashLog = 16
+
+// Huffman coding costs a tree and a jump table, so short literals are sent as they are
+const zstdMinHuffmanLiterals = 64
+
+type zstdSequence struct {
+	literals    uint32
+	matchLength uint32
+	offsetValue uint32 // As it is sent, 1 to 3 one of the recent offsets and otherwise the offset plus 3
+}
+
+type zstdWriter struct {
+	target       io.Writer
+	history      []byte // The window behind the block being gathered, then the block
+	historyBase  int64  // Where history starts in table's positions
+	dictionary   uint32 // The ID of the dictionary, 0 for none
+	blockStart   int
+	table        []int64 // A hash of 4 bytes to where they were last seen in the frame, plus 1
+	checksum     *zstdXXH64
+	started      bool
+	closed       bool
+	err          error
+	sequences    []zstdSequence
+	literals     []byte
+	block        []byte
+	huffman      *zstdHuffmanCodes // The code the reader has for literals sent without a tree, nil for none
+	blockHuffman *zstdHuffmanCodes // The code the block gathered sent a tree for, the reader's once it is sent compressed
+	matches      []int64           // The dictionary's table, for what table has nothing from this frame for
+	frameBase    int64             // Where the frame, dictionary first, starts in table's positions
+	buffers      *zstdBuffers
+	repeats      [3]uint32 // The recent offsets, as the reader has them after the blocks sent
+	blockRepeats [3]uint32 // As they were before the block gathered, for when it is sent raw
+}
+
+type zstdBuffers struct {
+	history []byte
+	table   []int64
+	next    int64 // Where the next frame starts in table's positions
+}
+
+var zstdWriterBuffers = sync.Pool{New: func() interface{} {
+	return &zstdBuffers{history: make([]byte, 0, 2*zstdWindowBytes+zstdBlockMaxBytes), table: make([]int64, 1<<zstdHashLog)}
+}}
+
+func newZstdWriter(target io.Writer) *zstdWriter {
+	buffers := zstdWriterBuffers.Get().(*zstdBuffers)
+
+	return &zstdWriter{
+		target:      target,
+		history:     buffers.history[:0],
+		historyBase: buffers.next,
+		table:       buffers.table,
+		checksum:    newZstdXXH64(),
+		repeats:     [3]uint32{1, 4, 8},
+		frameBase:   buffers.next,
+		buffers:     buffers,
+	}
+}
+
+// Matches may reach back into the dictionary's content, as if it came before the frame
+func newZstdDictionaryWriter(target io.Writer, dictionary *zstdDictionary) *zstdWriter {
+	writer := newZstdWriter(target)
+	writer.dictionary = dictionary.id
+	writer.history = append(writer.history, dictionary.content...)
+	writer.blockStart = len(writer.history)
+	writer.huffman = dictionary.codes
+	writer.matches = dictionary.matches
+	writer.repeats = dictionary.repeats
+
+	return writer
+}
+
+func (writer *zstdWriter) Write(data []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	if writer.closed {
+		return 0, errors.New("write to a closed zstd writer")
+	}
+
+	written := len(data)
+	_, _ = writer.checksum.Write(data)
+
+	for len(data) > 0 {
+		// Only sent once more follows, the last block has to say it is
+		if len(writer.history)-writer.blockStart == zstdBlockMaxBytes {
+			if writer.err = writer.flushBlock(false); writer.err != nil {
+				return 0, writer.err
+			}
+		}
+
+		n := zstdBlockMaxBytes - (len(writer.history) - writer.blockStart)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		writer.history = append(writer.history, data[:n]...)
+		data = data[n:]
+	}
+
+	return written, nil
+}
+
+// Ends the frame, but does not close the target
+func (writer *zstdWriter) Close() error {
+	if writer.err != nil || writer.closed {
+		return writer.err
+	}
+
+	writer.closed = true
+
+	if writer.err = writer.flushBlock(true); writer.err != nil {
+		return writer.err
+	}
+
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, uint32(writer.checksum.sum64()))
+
+	_, writer.err = writer.target.Write(checksum)
+
+	// Nothing is written to a closed writer, the next frame can have them
+	writer.buffers.history = writer.history[:0]
+	writer.buffers.next = writer.historyBase + int64(len(writer.history)) + 1
+	zstdWriterBuffers.Put(writer.buffers)
+	writer.history, writer.table, writer.buffers = nil, nil, nil
+
+	return writer.err
+}
+
+func (writer *zstdWriter) flushBlock(last bool) error {
+	if !writer.started {
+		// No content size is known up front, the checksum is on, and the window is 1<<zstdWindowLog
+		header := []byte{0, 0, 0, 0, 0x04, (zstdWindowLog - 10) << 3}
+		binary.LittleEndian.PutUint32(header, zstdMagic)
+
+		// The dictionary's ID follows the window, in 4 bytes
+		if writer.dictionary != 0 {
+			header[4] |= 3
+			header = append(header, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(header[6:], writer.dictionary)
+		}
+
+		if _, err := writer.target.Write(header); err != nil {
+			return err
+		}
+
+		writer.started = true
+	}
+
+	raw := writer.history[writer.blockStart:]
+	writer.blockRepeats = writer.repeats
+	body := writer.compressBlock()
+
+	blockType := uint32(2)
+	if len(body) >= len(raw) {
+		blockType, body = 0, raw
+		writer.repeats = writer.blockRepeats
+	}
+
+	// The tree the block sent is what the next block's literals may be sent without one with
+	if blockType == 2 && writer.blockHuffman != nil {
+		writer.huffman = writer.blockHuffman
+	}
+
+	blockHeader := blockType<<1 | uint32(len(body))<<3
+	if last {
+		blockHeader |= 1
+	}
+
+	_, err := writer.target.Write([]byte{byte(blockHeader), byte(blockHeader >> 8), byte(blockHeader >> 16)})
+	if err == nil {
+		_, err = writer.target.Write(body)
+	}
+
+	writer.blockStart = len(writer.history)
+
+	// Only the window is kept, moved down when the next block might not fit behind it
+	if len(writer.history)+zstdBlockMaxBytes > cap(writer.history) {
+		dropped := len(writer.history) - zstdWindowBytes
+		writer.history = writer.history[:copy(writer.history, writer.history[dropped:])]
+		writer.historyBase += int64(dropped)
+		writer.blockStart = len(writer.history)
+	}
+
+	return err
+}
+
+// How offset is sent after literals, one of the recent offsets when it is one
+func (writer *zstdWriter) offsetValue(offset uint32, literals uint32) uint32 {
+	recent := [3]uint32{writer.repeats[0], writer.repeats[1], writer.repeats[2]}
+	if literals == 0 {
+		recent = [3]uint32{writer.repeats[1], writer.repeats[2], writer.repeats[0] - 1}
+	}
+
+	value := offset + 3
+	for i, repeat := range recent {
+		if repeat == offset {
+			value = uint32(i) + 1
+			break
+		}
+	}
+
+	// Only an offset of 0 is an error, and there are none
+	_, _ = zstdResolveOffset(&writer.repeats, value, literals)
+
+	return value
+}
+
+func zstdHash(value uint32) uint32 {
+	return value * 2654435761 >> (32 - zstdHashLog)
+}
+
+// The block's sequences, literals, and the two sections they are sent in, nil for a block with nothing to compress
+func (writer *zstdWriter) compressBlock() []byte {
+	history, base := writer.history, writer.historyBase
+	end := len(history)
+	literalStart, position := writer.blockStart, writer.blockStart
+
+	writer.sequences = writer.sequences[:0]
+	writer.literals = writer.literals[:0]
+
+	if end == position {
+		return nil
+	}
+
+	for position+zstdMinMatch <= end {
+		value := binary.LittleEndian.Uint32(history[position:])
+		hash := zstdHash(value)
+		candidate := int(writer.table[hash] - 1 - base)
+		writer.table[hash] = base + int64(position) + 1
+
+		if candidate < 0 && writer.matches != nil {
+			candidate = int(writer.matches[hash] - 1 + writer.frameBase - base)
+		}
+
+		// The last offset again is preferred, see offsetValue
+		if repeat := position - int(writer.repeats[0]); repeat >= 0 && binary.LittleEndian.Uint32(history[repeat:]) == value {
+			candidate = repeat
+		}
+
+		if candidate < 0 || position-candidate > zstdWindowBytes || binary.LittleEndian.Uint32(history[candidate:]) != value {
+			// The longer nothing has matched, the further ahead the next look
+			position += 1 + (position-literalStart)>>6
+			continue
+		}
+
+		length := zstdMinMatch
+		for position+length < end && history[candidate+length] == history[position+length] {
+			length++
+		}
+
+		for position > literalStart && candidate > 0 && history[position-1] == history[candidate-1] {
+			position--
+			candidate--
+			length++
+		}
+
+		writer.literals = append(writer.literals, history[literalStart:position]...)
+		writer.sequences = append(writer.sequences, zstdSequence{
+			literals:    uint32(position - literalStart),
+			matchLength: uint32(length),
+			offsetValue: writer.offsetValue(uint32(position-candidate), uint32(position-literalStart)),
+		})
+
+		for next := position + 1; next < position+length && next+zstdMinMatch <= end; next++ {
+			writer.table[zstdHash(binary.LittleEndian.Uint32(history[next:]))] = base + int64(next) + 1
+		}
+
+		position += length
+		literalStart = position
+	}
+
+	writer.literals = append(writer.literals, history[literalStart:end]...)
+
+	writer.block = writer.encodeLiterals(writer.block[:0], writer.literals)
+	writer.block = zstdEncodeSequences(writer.block, writer.sequences)
+
+	return writer.block
+}
+
+func (writer *zstdWriter) encodeLiterals(out []byte, literals []byte) []byte {
+	writer.blockHuffman = nil
+
+	if len(literals) == 0 {
+		return append(out, 0)
+	}
+
+	var counts [256]uint32
+	maxSymbol := 0
+
+	for _, literal := range literals {
+		counts[literal]++
+		if int(literal) > maxSymbol {
+			maxSymbol = int(literal)
+		}
+	}
+
+	if counts[literals[0]] == uint32(len(literals)) {
+		return append(zstdLiteralsHeader(out, 1, len(literals)), literals[0])
+	}
+
+	var best []byte
+
+	if writer.huffman != nil && writer.huffman.codes(counts[:maxSymbol+1]) {
+		best = zstdHuffmanLiterals(literals, writer.huffman, nil)
+	}
+
+	if len(literals) >= zstdMinHuffmanLiterals && maxSymbol <= 128 {
+		tree, code := zstdHuffmanCode(counts[:maxSymbol+1])
+		if compressed := zstdHuffmanLiterals(literals, code, tree); compressed != nil && (best == nil || len(compressed) < len(best)) {
+			best = compressed
+
+			// Only a dictionary's frames send literals without a tree, so only they keep it
+			if writer.dictionary != 0 {
+				writer.blockHuffman = code
+			}
+		}
+	}
+
+	if best != nil {
+		return append(out, best...)
+	}
+
+	return append(zstdLiteralsHeader(out, 0, len(literals)), literals...)
+}
+
+// The header of raw (0) or RLE (1) literals
+func zstdLiteralsHeader(out []byte, literalsType uint32, size int) []byte {
+	switch {
+	case size < 32:
+		return append(out, byte(literalsType|uint32(size)<<3))
+	case size < 4096:
+		header := literalsType | 1<<2 | uint32(size)<<4
+		return append(out, byte(header), byte(header>>8))
+	default:
+		header := literalsType | 3<<2 | uint32(size)<<4
+		return append(out, byte(header), byte(header>>8), byte(header>>16))
+	}
+}
+
+// The literals section Huffman coded after tree, or with the reader's code when tree is nil - nil when that is no smaller
+func zstdHuffmanLiterals(literals []byte, code *zstdHuffmanCodes, tree []byte) []byte {
+	encode := func(segment []byte) []byte {
+		writer := zstdBitWriter{out: make([]byte, 0, len(segment)*int(code.maxBits)/8+8)}
+		for i := len(segment) - 1; i >= 0; i-- {
+			writer.add(uint64(code.code[segment[i]]), uint(code.lengths[segment[i]]))
+		}
+
+		return writer.close()
+	}
+
+	regenerated := len(literals)
+	streams := tree
+	sizeFormat := uint32(0)
+
+	if regenerated <= 1023 {
+		streams = append(streams, encode(literals)...)
+	} else {
+		segmentBytes := (regenerated + 3) / 4
+
+		var encoded [4][]byte
+		for i := range encoded {
+			start, end := i*segmentBytes, (i+1)*segmentBytes
+			if end > regenerated {
+				end = regenerated
+			}
+
+			encoded[i] = encode(literals[start:end])
+		}
+
+		for _, stream := range encoded[:3] {
+			if len(stream) > 0xFFFF {
+				return nil
+			}
+
+			streams = append(streams, byte(len(stream)), byte(len(stream)>>8))
+		}
+
+		for _, stream := range encoded {
+			streams = append(streams, stream...)
+		}
+
+		sizeFormat = 1
+	}
+
+	compressed := len(streams)
+
+	// Compressed (2), or treeless (3)
+	literalsType := uint32(2)
+	if tree == nil {
+		literalsType = 3
+	}
+
+	var header []byte
+	switch {
+	case compressed >= regenerated:
+		return nil
+	case sizeFormat == 0:
+		value := literalsType | uint32(regenerated)<<4 | uint32(compressed)<<14
+		header = []byte{byte(value), byte(value >> 8), byte(value >> 16)}
+	case regenerated <= 16383:
+		value := literalsType | 2<<2 | uint32(regenerated)<<4 | uint32(compressed)<<18
+		header = []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)}
+	default:
+		value := uint64(literalsType) | 3<<2 | uint64(regenerated)<<4 | uint64(compressed)<<22
+		header = []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24), byte(value >> 32)}
+	}
+
+	return append(header, streams...)
+}
+
+// A Huffman code as the writer sends symbols with it, a length of 0 for those it has no code for
+type zstdHuffmanCodes struct {
+	lengths []uint8
+	code    []uint16
+	maxBits uint8
+}
+
+// Whether every symbol counted has a code
+func (code *zstdHuffmanCodes) codes(counts []uint32) bool {
+	if len(counts) > len(code.lengths) {
+		return false
+	}
+
+	for symbol, count := range counts {
+		if count > 0 && code.lengths[symbol] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A Huffman code for the symbols counted, none of them over 128, and its tree as it is sent
+func zstdHuffmanCode(counts []uint32) ([]byte, *zstdHuffmanCodes) {
+	lengths := zstdHuffmanLengths(counts, zstdMaxHuffmanBits)
+
+	maxBits := uint8(0)
+	for _, length := range lengths {
+		if length > maxBits {
+			maxBits = length
+		}
+	}
+
+	weights := make([]uint8, len(lengths))
+	for symbol, length := range lengths {
+		if length > 0 {
+			weights[symbol] = maxBits + 1 - length
+		}
+	}
+
+	// Codes are given out as the reader builds its table, lowest weight first and then by symbol
+	codes := make([]uint16, len(lengths))
+	next := uint32(0)
+
+	for weight := uint8(1); weight <= maxBits; weight++ {
+		for symbol := range weights {
+			if weights[symbol] == weight {
+				codes[symbol] = uint16(next >> (weight - 1))
+				next += 1 << (weight - 1)
+			}
+		}
+	}
+
+	// The last symbol's weight is left for the reader to work out
+	tree := []byte{byte(127 + len(weights) - 1)}
+	for i := 0; i < len(weights)-1; i += 2 {
+		packed := weights[i] << 4
+		if i+1 < len(weights)-1 {
+			packed |= weights[i+1]
+		}
+
+		tree = append(tree, packed)
+	}
+
+	return tree, &zstdHuffmanCodes{lengths: lengths, code: codes, maxBits: maxBits}
+}
+
+/*
+	Code lengths for the symbols counted, 0 for those that never appear,
+	none longer than limit. Lengths over the limit are cut to it, which
+	overfills the code, and codes are then lengthened (the longest that
+	can be first, where it costs least) until it fits and shortened
+	while there is room, so the code is always exactly full
+*/
+func zstdHuffmanLengths(counts []uint32, limit uint8) []uint8 {
+	type node struct {
+		count  uint64
+		parent int
+	}
+
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool { return counts[symbols[i]] < counts[symbols[j]] })
+
+	leaves := len(symbols)
+	nodes := make([]node, leaves, 2*leaves-1)
+	for i, symbol := range symbols {
+		nodes[i].count = uint64(counts[symbol])
+	}
+
+	// Two queues in count order, the leaves and the nodes made from them
+	nextLeaf, nextNode := 0, leaves
+	smallest := func() int {
+		if nextLeaf < leaves && (nextNode >= len(nodes) || nodes[nextLeaf].count <= nodes[nextNode].count) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+
+		nextNode++
+		return nextNode - 1
+	}
+
+	for len(nodes) < 2*leaves-1 {
+		first, second := smallest(), smallest()
+		nodes = append(nodes, node{count: nodes[first].count + nodes[second].count})
+		nodes[first].parent = len(nodes) - 1
+		nodes[second].parent = len(nodes) - 1
+	}
+
+	depths := make([]uint8, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depths[i] = depths[nodes[i].parent] + 1
+	}
+
+	lengths := make([]uint8, len(counts))
+	kraft := 0
+	full := 1 << limit
+
+	for i, symbol := range symbols {
+		lengths[symbol] = depths[i]
+		if lengths[symbol] > limit {
+			lengths[symbol] = limit
+		}
+
+		kraft += 1 << (limit - lengths[symbol])
+	}
+
+	for kraft > full {
+		best := -1
+		for _, symbol := range symbols {
+			if lengths[symbol] < limit && (best < 0 || lengths[symbol] > lengths[best] || (lengths[symbol] == lengths[best] && counts[symbol] < counts[best])) {
+				best = symbol
+			}
+		}
+
+		lengths[best]++
+		kraft -= 1 << (limit - lengths[best])
+	}
+
+	for kraft < full {
+		best := -1
+		for _, symbol := range symbols {
+			if lengths[symbol] > 1 && 1<<(limit-lengths[symbol]) <= full-kraft && (best < 0 || counts[symbol] > counts[best]) {
+				best = symbol
+			}
+		}
+
+		kraft += 1 << (limit - lengths[best])
+		lengths[best]--
+	}
+
+	return lengths
+}
+
+// The sequences section, every code sent with the predefined tables
+func zstdEncodeSequences(out []byte, sequences []zstdSequence) []byte {
+	count := len(sequences)
+
+	switch {
+	case count < 128:
+		out = append(out, byte(count))
+	case count < 0x7F00:
+		out = append(out, byte(count>>8)+128, byte(count))
+	default:
+		out = append(out, 0xFF, byte(count-0x7F00), byte((count-0x7F00)>>8))
+	}
+
+	if count == 0 {
+		return out
+	}
+
+	out = append(out, 0)
+
+	literalLengths := zstdPredefinedTables.literalLengths
+	matchLengths := zstdPredefinedTables.matchLengths
+	offsets := zstdPredefinedTables.offsets
+
+	writer := zstdBitWriter{out: out}
+	var literalLengthState, matchLengthState, offsetState uint16
+
+	// Written backwards, the reader starts at the end
+	for i := count - 1; i >= 0; i-- {
+		sequence := sequences[i]
+
+		literalLengthCode := zstdLengthCode(sequence.literals, zstdLiteralLengthBaselines)
+		matchLengthCode := zstdLengthCode(sequence.matchLength, zstdMatchLengthBaselines)
+
+		offsetValue := sequence.offsetValue
+		offsetCode := uint8(bits.Len32(offsetValue) - 1)
+
+		if i == count-1 {
+			literalLengthState = literalLengths.firstState(literalLengthCode)
+			matchLengthState = matchLengths.firstState(matchLengthCode)
+			offsetState = offsets.firstState(offsetCode)
+		} else {
+			var value uint64
+			var valueBits uint
+
+			offsetState, value, valueBits = offsets.previousState(offsetCode, offsetState)
+			writer.add(value, valueBits)
+
+			matchLengthState, value, valueBits = matchLengths.previousState(matchLengthCode, matchLengthState)
+			writer.add(value, valueBits)
+
+			literalLengthState, value, valueBits = literalLengths.previousState(literalLengthCode, literalLengthState)
+			writer.add(value, valueBits)
+		}
+
+		writer.add(uint64(sequence.literals-zstdLiteralLengthBaselines[literalLengthCode]), uint(zstdLiteralLengthExtraBits[literalLengthCode]))
+		writer.add(uint64(sequence.matchLength-zstdMatchLengthBaselines[matchLengthCode]), uint(zstdMatchLengthExtraBits[matchLengthCode]))
+		writer.add(uint64(offsetValue-1<<offsetCode), uint(offsetCode))
+	}
+
+	writer.add(uint64(matchLengthState), zstdMatchLengthAccuracyLog)
+	writer.add(uint64(offsetState), zstdOffsetAccuracyLog)
+	writer.add(uint64(literalLengthState), zstdLiteralLengthAccuracyLog)
+
+	return writer.close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"fmt"
+)
+
+/*
+	The system policy (when an administrator installed one) and any policy
+	passed with --policy are both enforced, so a user supplied policy can
+	tighten the rules but never loosen them
+
+	Every violation is reported, not just the first, so a wrapper script
+	can be fixed in one pass
+*/
+func enforcePolicies(options *EncryptorOptions) error {
+	policies, err := loadPolicies(options)
+	if err != nil {
+		return err
+	}
+
+	// OpenPGP messages and JWEs are held to the policy as they are written, not as our own format would be
+	format := encryptor.OutputFormatEncryptor
+	if options.OpenPGP {
+		format = encryptor.OutputFormatOpenPGP
+	} else if options.JWE != "" {
+		format = encryptor.OutputFormatJWE
+	}
+
+	violations := 0
+	for _, policy := range policies {
+		for _, violation := range policy.OutputViolations(options.Operation, format, &options.Options) {
+			gLoggerInfo.Println("Policy violation:", violation)
+			violations++
+		}
+	}
+
+	if violations > 0 {
+		return fmt.Errorf("the operation violates %d policy rule(s)", violations)
+	}
+
+	return nil
+}
+
+// The system policy, if there is one, then --policy's
+func loadPolicies(options *EncryptorOptions) ([]encryptor.Policy, error) {
+	var policies []encryptor.Policy
+
+	systemPolicy, found, err := encryptor.LoadSystemPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		policies = append(policies, systemPolicy)
+	}
+
+	if options.PolicyFilename != "" {
+		policy, err := encryptor.LoadPolicy(options.PolicyFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+/*
+	--preview decrypts the first bytes of a file so the key and the file
+	can be confirmed before a decryption that may take hours. Nothing a
+	preview writes outlives it - piped, it goes to stdout, otherwise to a
+	temporary file that is deleted once the user is done looking at it
+	(or interrupts), so a preview never leaves plaintext lying around or
+	overwrites a target
+*/
+
+func runPreview(options *EncryptorOptions) error {
+	var source io.Reader = os.Stdin
+
+	if options.SourceFilename != StdioFilename {
+		file, err := os.Open(options.SourceFilename)
+		if err != nil {
+			return fmt.Errorf("could not open source file: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		source = file
+	}
+
+	if options.TargetFilename == StdioFilename {
+		_, err := encryptor.Preview(source, os.Stdout, options.PreviewBytes, &options.Options)
+		return err
+	}
+
+	// Waiting on the user needs a terminal that is not carrying the source
+	if options.SourceFilename == StdioFilename || !isTerminal(os.Stdin) {
+		return errors.New("a preview to a temporary file waits for Enter on a terminal, pipe stdout to see the preview instead")
+	}
+
+	return previewToTemporaryFile(source, options)
+}
+
+func previewToTemporaryFile(source io.Reader, options *EncryptorOptions) error {
+	file, err := encryptor.CreateTempFile("preview-*")
+	if err != nil {
+		return fmt.Errorf("could not create a temporary file for the preview: %w", err)
+	}
+
+	// Removed however we leave, an interrupt included
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	go func() {
+		<-interrupts
+		_ = file.Close()
+		_ = encryptor.RemoveTempFiles()
+		os.Exit(1)
+	}()
+
+	// The preview is the only temporary file we make, its session goes with it
+	defer func() {
+		signal.Stop(interrupts)
+		_ = encryptor.RemoveTempFiles()
+	}()
+
+	written, err := encryptor.Preview(source, file, options.PreviewBytes, &options.Options)
+
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing the preview file: %w", closeErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	gLoggerInfo.Printf("The first %d bytes of %s were decrypted to %s\n", written, options.SourceFilename, file.Name())
+	gLoggerInfo.Println("Press Enter when you are done with it, and it will be deleted")
+
+	_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return nil
+}
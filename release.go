@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// The release signing key, base64, built into release binaries with -ldflags "-X main.gReleaseKey=..."
+var gReleaseKey = ""
+
+// The latest release's manifest, a file or https URL, built in the same way with -X main.gLatestReleaseManifest=...
+var gLatestReleaseManifest = ""
+
+// encryptor verify-binary --manifest=<file or https URL> checks the running binary against a signed release manifest
+func runBinaryVerification(options *EncryptorOptions) error {
+	binaryFilename, err := runningBinaryFilename()
+	if err != nil {
+		return err
+	}
+
+	digest, err := encryptor.Hash(binaryFilename)
+	if err != nil {
+		return fmt.Errorf("could not hash the running binary: %w", err)
+	}
+
+	// Provenance first, so there is something to compare by hand whatever happens next
+	fmt.Println("binary:", binaryFilename)
+	fmt.Println("sha256:", digest)
+	fmt.Println("version:", gVersion, "commit:", gGitCommit, "go:", runtime.Version(), "platform:", runtime.GOOS+"/"+runtime.GOARCH)
+
+	if options.ReleaseManifest == "" {
+		return errors.New("no release manifest was given with --manifest, only the SHA256 above can be compared by hand")
+	}
+
+	publicKey, err := releasePublicKey(options)
+	if err != nil {
+		return err
+	}
+
+	verification, err := encryptor.VerifyRelease(binaryFilename, options.ReleaseManifest, publicKey)
+	if err != nil {
+		return err
+	}
+
+	manifest := verification.Manifest
+	fmt.Println("release:", manifest.Version, "commit:", manifest.GitCommit, "released:", manifest.Released.UTC().Format(time.RFC3339))
+	fmt.Println("release binary:", verification.Binary.Name)
+
+	// Development builds carry no version to compare
+	if gVersion != "0" && (manifest.Version != gVersion || manifest.GitCommit != gGitCommit) {
+		return fmt.Errorf("the binary is listed in release %s (commit %s) but says it is %s (commit %s)", manifest.Version, manifest.GitCommit, gVersion, gGitCommit)
+	}
+
+	fmt.Println("Verified: this binary is", verification.Binary.Name, "from release", manifest.Version)
+	return nil
+}
+
+func runningBinaryFilename() (string, error) {
+	binaryFilename, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("could not find the running binary: %w", err)
+	}
+
+	binaryFilename, err = filepath.EvalSymlinks(binaryFilename)
+	if err != nil {
+		return "", fmt.Errorf("could not find the running binary: %w", err)
+	}
+
+	return binaryFilename, nil
+}
+
+// --release-key overrides the key built in
+func releasePublicKey(options *EncryptorOptions) (ed25519.PublicKey, error) {
+	releaseKey := options.ReleaseKey
+	if releaseKey == "" {
+		releaseKey = gReleaseKey
+	}
+
+	if releaseKey == "" {
+		return nil, errors.New("this build has no release key built in, give the published one with --release-key")
+	}
+
+	return encryptor.ParseReleaseKey(releaseKey)
+}
+
+// The manifest an operation reads, if any - updates default to the latest release's
+func releaseManifestName(options *EncryptorOptions) string {
+	if options.ReleaseManifest != "" {
+		return options.ReleaseManifest
+	}
+
+	if options.Operation == encryptor.UpdateChecking || options.Operation == encryptor.SelfUpdating {
+		return gLatestReleaseManifest
+	}
+
+	return ""
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	Users who already run rclone have their remotes (and credentials)
+	defined in rclone.conf, so rather than configuring backends twice we
+	read that file and let them say remote:backups/file.enc
+
+	Only the subset of rclone we can act on is supported - local remotes,
+	aliases (which may point at other remotes), and the object stores we
+	already speak to: google cloud storage remotes become gs:// objects
+	and azureblob remotes az:// blobs. Remotes of any other type are
+	recognized and reported as unsupported rather than silently treated
+	as local filenames
+
+	A remote's credentials reach those backends the way their own are
+	found, through the environment: service_account_file becomes
+	GOOGLE_APPLICATION_CREDENTIALS (which Cloud KMS keys then use too),
+	an Azure service principal AZURE_TENANT_ID, AZURE_CLIENT_ID and
+	AZURE_CLIENT_SECRET, and a sas_url, or an account SAS signed with the
+	account's key, AZURE_STORAGE_SAS_TOKEN. Options that would send us
+	elsewhere (endpoint) or that we cannot honor are refused, and so is a
+	source and target whose remotes need different credentials
+
+	Uploads to gs:// and Azure objects resume a part that failed part way,
+	and are journaled so the next run of the same job carries on after the
+	process itself ends (see uploadjournal.go in the encryptor package) -
+	remotes resolve to the same objects, so they resume the same way
+*/
+
+type RcloneRemote struct {
+	Name    string
+	Type    string
+	Options map[string]string
+}
+
+// Aliases can point at aliases, but not forever
+const rcloneAliasDepthLimit = 8
+
+func defaultRcloneConfigFilename() string {
+	if fileName := os.Getenv("RCLONE_CONFIG"); fileName != "" {
+		return fileName
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(configDir, "rclone", "rclone.conf")
+}
+
+func loadRcloneConfig(fileName string) (map[string]RcloneRemote, error) {
+	remotes := map[string]RcloneRemote{}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return remotes, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	scanner := bufio.NewScanner(file)
+	current := ""
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		// rclone can encrypt its configuration, we cannot read that
+		if strings.HasPrefix(line, "RCLONE_ENCRYPT_V") {
+			return remotes, errors.New("encrypted rclone configurations are not supported")
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			remotes[current] = RcloneRemote{Name: current, Options: map[string]string{}}
+			continue
+		}
+
+		separator := strings.Index(line, "=")
+		if separator < 0 || current == "" {
+			return remotes, fmt.Errorf("malformed rclone configuration line: %q", line)
+		}
+
+		key := strings.TrimSpace(line[:separator])
+		value := strings.TrimSpace(line[separator+1:])
+
+		remote := remotes[current]
+		if key == "type" {
+			remote.Type = value
+		} else {
+			remote.Options[key] = value
+		}
+
+		remotes[current] = remote
+	}
+
+	if err := scanner.Err(); err != nil {
+		return remotes, fmt.Errorf("could not read rclone configuration: %w", err)
+	}
+
+	return remotes, nil
+}
+
+/*
+	Returns the path unchanged unless it starts with the name of a defined
+	remote - anything else (including Windows drive letters) is a plain
+	filename. Object store remotes also return the environment their
+	credentials need
+*/
+func resolveRemotePath(path string, remotes map[string]RcloneRemote) (string, map[string]string, error) {
+	for depth := 0; depth < rcloneAliasDepthLimit; depth++ {
+		separator := strings.Index(path, ":")
+		if separator < 0 {
+			return path, nil, nil
+		}
+
+		name, remotePath := path[:separator], path[separator+1:]
+
+		remote, ok := remotes[name]
+		if !ok {
+			return path, nil, nil
+		}
+
+		switch remote.Type {
+		case "local":
+			return remotePath, nil, nil
+		case "alias":
+			target := remote.Options["remote"]
+			if target == "" {
+				return "", nil, fmt.Errorf("alias remote %q does not specify a remote", name)
+			}
+
+			path = joinRemotePath(target, remotePath)
+		case "google cloud storage":
+			return resolveGCSRemote(remote, remotePath)
+		case "azureblob":
+			return resolveAzureBlobRemote(remote, remotePath)
+		default:
+			return "", nil, fmt.Errorf("remote %q is of type %q which is not supported, only local, alias, google cloud storage, and azureblob remotes are", name, remote.Type)
+		}
+	}
+
+	return "", nil, errors.New("too many levels of remote aliases resolving " + path)
+}
+
+// Options of object store remotes we cannot honor, better refused than quietly ignored
+var unsupportedRemoteOptions = []string{"endpoint", "anonymous", "service_account_credentials", "client_certificate_path", "use_emulator"}
+
+func checkRemoteOptions(remote RcloneRemote) error {
+	for _, option := range unsupportedRemoteOptions {
+		if value := remote.Options[option]; value != "" && value != "false" {
+			return fmt.Errorf("remote %q sets %s, which is not supported", remote.Name, option)
+		}
+	}
+
+	return nil
+}
+
+// remote:bucket/object, or remote:object when the remote names its bucket
+func resolveGCSRemote(remote RcloneRemote, remotePath string) (string, map[string]string, error) {
+	if err := checkRemoteOptions(remote); err != nil {
+		return "", nil, err
+	}
+
+	objectPath := strings.TrimPrefix(remotePath, "/")
+	if bucket := remote.Options["bucket"]; bucket != "" {
+		objectPath = joinRemotePath(bucket, objectPath)
+	}
+
+	if !strings.Contains(objectPath, "/") {
+		return "", nil, fmt.Errorf("%s:%s must name an object, %s:<bucket>/<object>", remote.Name, remotePath, remote.Name)
+	}
+
+	env := map[string]string{}
+	if fileName := remote.Options["service_account_file"]; fileName != "" {
+		env["GOOGLE_APPLICATION_CREDENTIALS"] = expandHome(fileName)
+	}
+
+	return "gs://" + objectPath, env, nil
+}
+
+// remote:container/blob, of the remote's account or the one its sas_url is for
+func resolveAzureBlobRemote(remote RcloneRemote, remotePath string) (string, map[string]string, error) {
+	if err := checkRemoteOptions(remote); err != nil {
+		return "", nil, err
+	}
+
+	env := map[string]string{}
+	account := remote.Options["account"]
+
+	if sasURL := remote.Options["sas_url"]; sasURL != "" {
+		parsed, err := url.Parse(sasURL)
+		if err != nil || parsed.Scheme != "https" || parsed.RawQuery == "" {
+			return "", nil, fmt.Errorf("remote %q has a sas_url that is not an https URL with a SAS token", remote.Name)
+		}
+
+		account = strings.SplitN(parsed.Hostname(), ".", 2)[0]
+		env["AZURE_STORAGE_SAS_TOKEN"] = parsed.RawQuery
+	} else if key := remote.Options["key"]; key != "" {
+		sas, err := azureAccountSAS(account, key, time.Now())
+		if err != nil {
+			return "", nil, fmt.Errorf("remote %q: %w", remote.Name, err)
+		}
+
+		env["AZURE_STORAGE_SAS_TOKEN"] = sas
+	} else {
+		for option, variable := range map[string]string{"tenant": "AZURE_TENANT_ID", "client_id": "AZURE_CLIENT_ID", "client_secret": "AZURE_CLIENT_SECRET", "msi_client_id": "AZURE_CLIENT_ID"} {
+			if value := remote.Options[option]; value != "" {
+				env[variable] = value
+			}
+		}
+	}
+
+	if account == "" {
+		return "", nil, fmt.Errorf("remote %q names no account (or sas_url)", remote.Name)
+	}
+
+	blobPath := strings.TrimPrefix(remotePath, "/")
+	if !strings.Contains(blobPath, "/") {
+		return "", nil, fmt.Errorf("%s:%s must name a blob, %s:<container>/<blob>", remote.Name, remotePath, remote.Name)
+	}
+
+	return "az://" + account + "/" + blobPath, env, nil
+}
+
+// Long enough for the largest job, short enough that a token which leaks does not outlive its use
+const azureAccountSASLifetime = 7 * 24 * time.Hour
+
+/*
+	An account SAS for the blob service, signed with the account's key
+	(HMAC-SHA256 of the string to sign of version 2020-12-06 and later) -
+	the key itself is never sent anywhere
+*/
+func azureAccountSAS(account string, key string, now time.Time) (string, error) {
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("the account key is not base64: %w", err)
+	}
+
+	const version = "2021-08-06"
+	permissions, services, resourceTypes, protocol := "racwdl", "b", "sco", "https"
+	start := now.Add(-5 * time.Minute).UTC().Format("2006-01-02T15:04:05Z")
+	expiry := now.Add(azureAccountSASLifetime).UTC().Format("2006-01-02T15:04:05Z")
+
+	stringToSign := strings.Join([]string{account, permissions, services, resourceTypes, start, expiry, "", protocol, version, ""}, "\n") + "\n"
+
+	mac := hmac.New(sha256.New, decodedKey)
+	mac.Write([]byte(stringToSign))
+
+	query := url.Values{}
+	query.Set("sv", version)
+	query.Set("ss", services)
+	query.Set("srt", resourceTypes)
+	query.Set("sp", permissions)
+	query.Set("st", start)
+	query.Set("se", expiry)
+	query.Set("spr", protocol)
+	query.Set("sig", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	return query.Encode(), nil
+}
+
+// rclone accepts ~ for the home directory in filenames it is given
+func expandHome(fileName string) string {
+	if fileName == "~" || strings.HasPrefix(fileName, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, strings.TrimPrefix(fileName, "~"))
+		}
+	}
+
+	return fileName
+}
+
+// rclone joins alias paths with a slash, except directly after the remote's colon
+func joinRemotePath(base string, path string) string {
+	if path == "" {
+		return base
+	}
+
+	if base == "" || strings.HasSuffix(base, ":") || strings.HasSuffix(base, "/") {
+		return base + path
+	}
+
+	return base + "/" + path
+}
+
+// Whether the path starts with something that could name a remote, single letters are left to Windows drives
+func hasRemotePrefix(path string) bool {
+	separator := strings.Index(path, ":")
+	if separator < 2 {
+		return false
+	}
+
+	return !strings.ContainsAny(path[:separator], "/\\")
+}
+
+/*
+	The configuration is only read when a filename could name a remote.
+	One given with --rclone-config must load, but the implicit one is
+	rclone's and may be anything (encrypted, or broken for reasons that
+	have nothing to do with us) - failing to read it means no remotes,
+	with a warning, rather than a failed job
+*/
+func resolveRemoteFilenames(options *EncryptorOptions) error {
+	if !hasRemotePrefix(options.SourceFilename) && !hasRemotePrefix(options.TargetFilename) {
+		return nil
+	}
+
+	configFilename := options.RcloneConfigFilename
+	explicit := configFilename != ""
+
+	if !explicit {
+		configFilename = defaultRcloneConfigFilename()
+	}
+
+	if configFilename == "" {
+		return nil
+	}
+
+	remotes, err := loadRcloneConfig(configFilename)
+	if err != nil {
+		if explicit {
+			return fmt.Errorf("could not load rclone configuration: %w", err)
+		}
+
+		// Most users have no rclone configuration at all, that needs no warning
+		if !os.IsNotExist(err) {
+			gLoggerInfo.Printf("Warning: rclone configuration %s was not read, remotes are not resolved: %s\n", configFilename, err.Error())
+		}
+
+		return nil
+	}
+
+	var sourceEnv, targetEnv map[string]string
+
+	options.SourceFilename, sourceEnv, err = resolveRemotePath(options.SourceFilename, remotes)
+	if err != nil {
+		return err
+	}
+
+	options.TargetFilename, targetEnv, err = resolveRemotePath(options.TargetFilename, remotes)
+	if err != nil {
+		return err
+	}
+
+	// The backends read credentials from the environment, both remotes share it
+	for variable, value := range targetEnv {
+		if other, ok := sourceEnv[variable]; ok && other != value {
+			return fmt.Errorf("the source and target remotes need different credentials (%s), copy through a local file", variable)
+		}
+	}
+
+	for _, env := range []map[string]string{sourceEnv, targetEnv} {
+		for variable, value := range env {
+			if err := os.Setenv(variable, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
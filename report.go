@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	report checks every encrypted file under a directory - scrubbed
+	without the key, decrypted and authenticated with it, and audited
+	against current parameters and the policies in force - and writes
+	the result as a report to keep with compliance evidence
+
+		encryptor report --keyfile=backup.key --sign=audit.key /archive report.html
+
+	The report is JSON unless the target ends in .html, or --report-format
+	says otherwise. With --sign the signature goes to <target>.sig, and
+	report --check --signer=<key> report.html checks it later. The exit
+	code is 1 if any file failed, once the report is written
+*/
+
+var errReportFailed = errors.New("files failed verification")
+
+func checkReport(options *EncryptorOptions) error {
+	if options.Operation != encryptor.Reporting {
+		if options.ReportFormat != "" {
+			return errors.New("--report-format is for the report command")
+		}
+
+		return nil
+	}
+
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename || isObjectURL(options.SourceFilename) {
+		return errors.New("report checks the encrypted files in a directory, or one file - give its name (or with --check, the report's)")
+	}
+
+	if options.OpenPGP || options.JWE != "" {
+		return errors.New("report checks files in our format, not --openpgp or --jwe")
+	}
+
+	if options.CheckChecksums {
+		if len(options.SignerKeys) == 0 {
+			return errors.New("report --check needs --signer, the key the report must be signed with")
+		}
+
+		if options.SigningKey != "" || options.ReportFormat != "" {
+			return errors.New("report --check checks a report as it was written, --sign and --report-format write one")
+		}
+
+		if options.TargetFilename != "" && options.TargetFilename != StdioFilename {
+			return errors.New("report --check reads a report, a target filename cannot be given")
+		}
+
+		options.TargetFilename = ""
+		return nil
+	}
+
+	if options.ReportFormat == "" {
+		options.ReportFormat = encryptor.ReportFormatJSON
+
+		extension := strings.ToLower(filepath.Ext(options.TargetFilename))
+		if extension == ".html" || extension == ".htm" {
+			options.ReportFormat = encryptor.ReportFormatHTML
+		}
+	}
+
+	if options.ReportFormat != encryptor.ReportFormatJSON && options.ReportFormat != encryptor.ReportFormatHTML {
+		return fmt.Errorf("unknown --report-format %q, use %s or %s", options.ReportFormat, encryptor.ReportFormatJSON, encryptor.ReportFormatHTML)
+	}
+
+	if options.DetachedSignature != "" && options.SigningKey == "" {
+		return errors.New("--detached-signature is where the report's signature is written, give --sign as well")
+	}
+
+	if options.TargetFilename == StdioFilename {
+		options.TargetFilename = ""
+	}
+
+	if options.SigningKey != "" && options.TargetFilename == "" && options.DetachedSignature == "" {
+		return errors.New("a report written to stdout needs --detached-signature to say where its signature goes")
+	}
+
+	return nil
+}
+
+func runReport(options *EncryptorOptions) error {
+	if options.CheckChecksums {
+		return runReportCheck(options)
+	}
+
+	signatureFilename := options.DetachedSignature
+	if signatureFilename == "" && options.SigningKey != "" {
+		signatureFilename = options.TargetFilename + ".sig"
+	}
+
+	// Found out before every file is read, not after
+	for _, fileName := range []string{options.TargetFilename, signatureFilename} {
+		if _, err := os.Stat(fileName); fileName != "" && err == nil && !options.ForceOperation {
+			return fmt.Errorf("%s: %w", fileName, encryptor.ErrTargetExists)
+		}
+	}
+
+	policies, err := loadPolicies(options)
+	if err != nil {
+		return err
+	}
+
+	// Without key material files are scrubbed and audited, which needs none
+	identities := len(options.SSHIdentities) + len(options.X25519Identities) + len(options.RSAIdentities)
+
+	reportOptions := encryptor.ReportOptions{
+		Authenticate:  options.KeyHex != "" || options.Password != "" || identities > 0,
+		SamplePercent: options.ScrubSamplePercent,
+		Policies:      policies,
+		Verifier:      "encryptor " + gVersion + " (commit " + gGitCommit + ")",
+	}
+
+	report, err := encryptor.ReportVerification(options.SourceFilename, &reportOptions, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	data, signature, err := encryptor.RenderReport(&report, options.ReportFormat, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	if options.TargetFilename == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(options.TargetFilename, data, 0644)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not write report: %w", err)
+	}
+
+	if signature != "" {
+		err = os.WriteFile(signatureFilename, []byte(signature+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("could not write report signature: %w", err)
+		}
+	}
+
+	printReportSummary(&report)
+
+	if report.Summary.Failed > 0 {
+		return fmt.Errorf("%w, %d of %d files", errReportFailed, report.Summary.Failed, report.Summary.Files)
+	}
+
+	return nil
+}
+
+// report --check --signer=<key> report.html, the signature is <report>.sig unless --detached-signature names it
+func runReportCheck(options *EncryptorOptions) error {
+	data, err := os.ReadFile(options.SourceFilename)
+	if err != nil {
+		return fmt.Errorf("could not read report: %w", err)
+	}
+
+	signatureFilename := options.DetachedSignature
+	if signatureFilename == "" {
+		signatureFilename = options.SourceFilename + ".sig"
+	}
+
+	signature, err := os.ReadFile(signatureFilename)
+	if err != nil {
+		return fmt.Errorf("could not read report signature: %w", err)
+	}
+
+	err = encryptor.VerifyReportSignature(data, string(signature), options.SignerKeys)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Signature verified:", options.SourceFilename, "is the report as it was signed")
+	return nil
+}
+
+// The report may be on stdout, so what is said about it goes to stderr
+func printReportSummary(report *encryptor.VerificationReport) {
+	for _, file := range report.Files {
+		if file.Passed {
+			continue
+		}
+
+		reasons := file.Violations
+		if file.Error != "" {
+			reasons = append([]string{file.Error}, reasons...)
+		}
+
+		gLoggerInfo.Println("FAILED", file.FileName+":", strings.Join(reasons, "; "))
+	}
+
+	gLoggerInfo.Printf("reported on %d files: %d passed, %d failed, %d skipped, %d chunks verified, %d findings, %d policy violations\n",
+		report.Summary.Files, report.Summary.Passed, report.Summary.Failed, report.Summary.Skipped,
+		report.Summary.ChunksVerified, report.Summary.Findings, report.Summary.Violations)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	serve-file serves the plaintext of one encrypted file over HTTP,
+	decrypting only the chunks each request asks for, so a media player
+	can stream and seek through an encrypted archive and a download tool
+	can fetch it in parallel ranges and resume, all without the file
+	being decrypted to disk
+
+		encryptor serve-file --keyfile=backup.key --listen=:8080 movie.mkv.enc
+
+	Every request must carry the token, as a bearer token or as ?token=
+	in the URL for players that cannot set headers. It comes from
+	--token-file or $ENCRYPTOR_SERVE_TOKEN, and without either a random
+	one is made up and printed with the URL. The server speaks plain
+	HTTP and listens on localhost unless told otherwise - put it behind
+	a TLS proxy before serving it to a network
+
+	Chunks are authenticated as they are served, but the footer and
+	signature cover the whole file and are not (see filereader.go), so
+	run encryptor --verify first when the file's origin is in doubt.
+	The server runs until it is interrupted
+*/
+
+const defaultListenAddress = "127.0.0.1:8080"
+const serveTokenEnvironmentVariable = "ENCRYPTOR_SERVE_TOKEN"
+
+// Long enough for a slow client to send its headers, downloads themselves may take as long as they take
+const serveReadHeaderTimeout = 30 * time.Second
+
+const serveShutdownTimeout = 5 * time.Second
+
+func checkFileServing(options *EncryptorOptions) error {
+	if options.Operation != encryptor.FileServing {
+		return nil
+	}
+
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename || isObjectURL(options.SourceFilename) {
+		return errors.New("serve-file serves an encrypted file, give its name")
+	}
+
+	if options.TargetFilename != "" && options.TargetFilename != StdioFilename {
+		return errors.New("serve-file serves the plaintext over HTTP, a target filename cannot be given")
+	}
+
+	options.TargetFilename = ""
+
+	if options.OpenPGP || options.JWE != "" {
+		return errors.New("serve-file serves files in our format, not --openpgp or --jwe")
+	}
+
+	if len(options.SignerKeys) > 0 || options.DetachedSignature != "" {
+		return errors.New("a signature covers the whole file, which serve-file never reads at once - check it with --verify --signer first")
+	}
+
+	return nil
+}
+
+func runFileServing(options *EncryptorOptions) error {
+	token, generated, err := serveToken(options)
+	if err != nil {
+		return err
+	}
+
+	reader, err := encryptor.OpenFileReader(options.SourceFilename, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	defer func(reader *encryptor.FileReader) {
+		_ = reader.Close()
+	}(reader)
+
+	stats, err := os.Stat(options.SourceFilename)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", options.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", options.ListenAddress, err)
+	}
+
+	name := servedName(options.SourceFilename)
+
+	server := &http.Server{
+		Handler:           fileServingHandler(reader, name, stats.ModTime(), token),
+		ReadHeaderTimeout: serveReadHeaderTimeout,
+	}
+
+	// Interrupted is how a server is meant to stop, so it is not an error
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	go func() {
+		<-interrupts
+		ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+
+		_ = server.Shutdown(ctx)
+	}()
+
+	location := "http://" + displayAddress(listener.Addr().String()) + "/" + name
+	if generated {
+		location += "?token=" + token
+	}
+
+	gLoggerInfo.Printf("Serving %d bytes of %s at %s\n", reader.Size(), options.SourceFilename, location)
+	if !generated {
+		gLoggerInfo.Println("Requests must carry the token, as Authorization: Bearer <token> or ?token=<token>")
+	}
+
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// The token, and whether it was made up here rather than given
+func serveToken(options *EncryptorOptions) (string, bool, error) {
+	token := os.Getenv(serveTokenEnvironmentVariable)
+	_ = os.Unsetenv(serveTokenEnvironmentVariable)
+
+	if options.TokenFilename != "" {
+		var err error
+		if token, err = encryptor.LoadPasswordFile(options.TokenFilename); err != nil {
+			return "", false, fmt.Errorf("could not read --token-file: %w", err)
+		}
+
+		warnIfReadableByOthers("token file", options.TokenFilename)
+	}
+
+	if token != "" {
+		return token, false, nil
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", false, fmt.Errorf("could not make up a token: %w", err)
+	}
+
+	return hex.EncodeToString(random), true, nil
+}
+
+// The plaintext's name, which players and browsers take the type from
+func servedName(sourceFilename string) string {
+	name := filepath.Base(sourceFilename)
+	if trimmed := strings.TrimSuffix(name, ".enc"); trimmed != "" {
+		name = trimmed
+	}
+
+	return name
+}
+
+// Every interface is reachable as localhost, a URL to [::] is not much use to anyone
+func displayAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// The plaintext at any path, ranges and conditional requests are http.ServeContent's
+func fileServingHandler(reader *encryptor.FileReader, name string, modified time.Time, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "only GET and HEAD are served", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !hasServeToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a token is needed, as Authorization: Bearer <token> or ?token=<token>", http.StatusUnauthorized)
+			return
+		}
+
+		// Plaintext is not to be kept by caches along the way
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+
+		http.ServeContent(w, r, name, modified, io.NewSectionReader(reader, 0, reader.Size()))
+	})
+}
+
+func hasServeToken(r *http.Request, token string) bool {
+	given := r.URL.Query().Get("token")
+
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		given = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	shred overwrites a file, or the files under a directory, and unlinks
+	it - for the plaintext left behind once it is encrypted
+
+		encryptor --keyfile=backup.key payroll.csv payroll.csv.enc && encryptor shred payroll.csv
+
+	A directory is only shredded with --force, and --dry-run lists what
+	would be shredded without touching anything. Where overwriting cannot
+	reach every copy of the data (see shred.go in the encryptor package)
+	a warning says so on stderr
+
+	Under a policy with ForbidUnverifiedDelete nothing is shredded until
+	every file has been shown safe to lose - it is an encrypted file
+	itself, or <name>.enc beside it decrypts (with the key, password, or
+	identities given) to exactly its bytes. Each file that is not is a
+	policy violation, and the job stops before overwriting anything
+*/
+
+func checkShred(options *EncryptorOptions) error {
+	if options.Operation != encryptor.Shredding {
+		if options.ShredPasses != encryptor.DefaultShredPasses || len(options.ShredInclude) > 0 || len(options.ShredExclude) > 0 || options.DryRun {
+			return errors.New("--passes, --include, --exclude, and --dry-run are for the shred command")
+		}
+
+		return nil
+	}
+
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename || isObjectURL(options.SourceFilename) {
+		return errors.New("shred overwrites a file or a directory of them, give its name")
+	}
+
+	// Stdout stands in for a missing target when it is piped, shred writes nothing there
+	if options.TargetFilename != "" && options.TargetFilename != StdioFilename {
+		return errors.New("shred takes one file or directory, shred each in turn")
+	}
+
+	options.TargetFilename = ""
+
+	if options.ShredPasses < 1 || options.ShredPasses > encryptor.ShredPassesMax {
+		return fmt.Errorf("--passes must be between 1 and %d", encryptor.ShredPassesMax)
+	}
+
+	stats, err := os.Lstat(options.SourceFilename)
+	if err != nil {
+		return err
+	}
+
+	if !stats.IsDir() && (len(options.ShredInclude) > 0 || len(options.ShredExclude) > 0) {
+		return errors.New("--include and --exclude choose the files shredded in a directory, give one")
+	}
+
+	if stats.IsDir() && !options.ForceOperation && !options.DryRun {
+		return fmt.Errorf("shred destroys every file under %s, give --force to go ahead (or --dry-run to see what would go)", options.SourceFilename)
+	}
+
+	return checkUnverifiedDeletes(options)
+}
+
+func checkUnverifiedDeletes(options *EncryptorOptions) error {
+	policies, err := loadPolicies(options)
+	if err != nil {
+		return err
+	}
+
+	forbidden := false
+	for _, policy := range policies {
+		forbidden = forbidden || policy.ForbidUnverifiedDelete
+	}
+
+	if !forbidden {
+		return nil
+	}
+
+	listing, err := encryptor.Shred(options.SourceFilename, &encryptor.ShredOptions{Include: options.ShredInclude, Exclude: options.ShredExclude, DryRun: true})
+	if err != nil {
+		return err
+	}
+
+	violations := 0
+	for _, fileName := range listing.Files {
+		if err := verifiedEncryptedCopy(fileName, options); err != nil {
+			gLoggerInfo.Println("Policy violation:", fileName, "may not be deleted unverified,", err.Error())
+			violations++
+		}
+	}
+
+	if violations > 0 {
+		return fmt.Errorf("the operation violates %d policy rule(s)", violations)
+	}
+
+	return nil
+}
+
+// nil when the file is encrypted itself, or its .enc decrypts to exactly its bytes
+func verifiedEncryptedCopy(fileName string, options *EncryptorOptions) error {
+	if _, err := encryptor.ReadHeader(fileName); err == nil {
+		return nil
+	}
+
+	copyName := fileName + ".enc"
+
+	reader, err := encryptor.OpenFileReader(copyName, &options.Options)
+	if err != nil {
+		return fmt.Errorf("%s could not be decrypted: %w", copyName, err)
+	}
+
+	defer func(reader *encryptor.FileReader) {
+		_ = reader.Close()
+	}(reader)
+
+	decrypted, err := encryptor.HashReader(io.NewSectionReader(reader, 0, reader.Size()))
+	if err != nil {
+		return fmt.Errorf("%s could not be decrypted: %w", copyName, err)
+	}
+
+	original, err := encryptor.Hash(fileName)
+	if err != nil {
+		return err
+	}
+
+	if decrypted != original {
+		return fmt.Errorf("%s does not decrypt to it", copyName)
+	}
+
+	return nil
+}
+
+func runShred(options *EncryptorOptions) error {
+	shredOptions := encryptor.ShredOptions{
+		Passes:  options.ShredPasses,
+		Include: options.ShredInclude,
+		Exclude: options.ShredExclude,
+		DryRun:  options.DryRun,
+	}
+
+	report, err := encryptor.Shred(options.SourceFilename, &shredOptions)
+
+	for _, warning := range report.Warnings {
+		gLoggerInfo.Println("Warning:", warning)
+	}
+
+	for _, fileName := range report.Skipped {
+		gLoggerInfo.Println("Skipped", fileName, "- only regular files are shredded, links are never followed")
+	}
+
+	// The list is the output of a dry run, so it can be read by a script
+	if options.DryRun {
+		for _, fileName := range report.Files {
+			fmt.Println(fileName)
+		}
+
+		gLoggerInfo.Printf("Would shred %d files, %d bytes\n", len(report.Files), report.Bytes)
+		return err
+	}
+
+	if err != nil {
+		if len(report.Files) > 0 {
+			gLoggerInfo.Printf("%d files, %d bytes, were shredded before the error\n", len(report.Files), report.Bytes)
+		}
+
+		return err
+	}
+
+	gLoggerInfo.Printf("Shredded %d files, %d bytes, with %d passes each\n", len(report.Files), report.Bytes, options.ShredPasses)
+	return nil
+}
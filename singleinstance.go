@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+	--single-instance is for cron, where a backup that runs longer than
+	its interval would otherwise be started again over itself - two jobs
+	reading the same source and writing the same target. The job takes a
+	lock on a file named after its identity (the operation, source, and
+	target, as absolute paths) and if another process holds it the job is
+	skipped, exiting with exitAlreadyRunning rather than failing
+
+	The lock is the operating system's (flock, LockFileEx), not the lock
+	file existing, so a job that crashes or is killed never leaves a stale
+	lock behind - the file itself is left in place and reused
+*/
+
+// EX_TEMPFAIL from sysexits.h, a run that was skipped and not one that failed
+const exitAlreadyRunning = 75
+
+var errAlreadyRunning = errors.New("the same job is already running")
+
+// Held until the process exits, the lock goes with it
+var gInstanceLock *os.File
+
+// The same operation on the same source and target, however the paths were written
+func jobIdentity(options *EncryptorOptions) string {
+	absolute := func(fileName string) string {
+		if fileName == "" || fileName == StdioFilename {
+			return fileName
+		}
+
+		if path, err := filepath.Abs(fileName); err == nil {
+			return filepath.Clean(path)
+		}
+
+		return fileName
+	}
+
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", options.Operation, absolute(options.SourceFilename), absolute(options.TargetFilename))))
+
+	return hex.EncodeToString(digest[:16])
+}
+
+// In the user's cache directory, or the temporary directory when there is none
+func instanceLockFilename(options *EncryptorOptions) string {
+	lockDir := filepath.Join(os.TempDir(), "encryptor-locks")
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		lockDir = filepath.Join(cacheDir, "encryptor", "locks")
+	}
+
+	return filepath.Join(lockDir, jobIdentity(options)+".lock")
+}
+
+// errAlreadyRunning when another process holds the job's lock
+func acquireInstanceLock(fileName string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %w", err)
+	}
+
+	err = lockFile(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	// Only a note for whoever looks at the file, the lock is what counts
+	_ = file.Truncate(0)
+	_, _ = file.WriteAt([]byte(fmt.Sprintln(os.Getpid())), 0)
+
+	return file, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// TBD: advisory locks are only implemented where flock or LockFileEx exist
+func lockFile(file *os.File) error {
+	return errors.New("--single-instance is not supported on this platform")
+}
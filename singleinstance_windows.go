@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+func lockFile(file *os.File) error {
+	var overlapped windows.Overlapped
+
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errAlreadyRunning
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not lock %s: %w", file.Name(), err)
+	}
+
+	return nil
+}
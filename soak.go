@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/*
+	soak burns in a new backup disk, or a machine suspected of flaky RAM,
+	with the pipeline as the load - round after round of synthetic data
+	written to the directory given, read back, encrypted, decrypted, and
+	compared with what was written (see soak.go in the encryptor package)
+
+		encryptor soak --size=100G --hours=4 /mnt/new-backup-disk
+
+	Each round is reported on stderr as it ends, and every mismatch found
+	is reported as ECC memory reports errors, by word and flipped bits.
+	An interrupt stops the soak after removing what the round wrote. The
+	exit code is 1 if any round failed
+*/
+
+var errSoakFailed = errors.New("the soak found errors")
+
+func checkSoak(options *EncryptorOptions) error {
+	if options.Operation != encryptor.Soaking {
+		if options.SoakSizeBytes != 0 || options.SoakHours != 0 {
+			return errors.New("--size and --hours are for the soak command")
+		}
+
+		return nil
+	}
+
+	if options.SourceFilename == "" || options.SourceFilename == StdioFilename || isObjectURL(options.SourceFilename) {
+		return errors.New("soak writes to a directory on the device being tested, give its name")
+	}
+
+	// Stdout stands in for a missing target when it is piped, soak writes nothing there
+	if options.TargetFilename != "" && options.TargetFilename != StdioFilename {
+		return errors.New("soak tests one directory, a target filename cannot be given")
+	}
+
+	options.TargetFilename = ""
+
+	if options.SoakSizeBytes <= 0 {
+		return errors.New("soak needs --size, how much data to write each round, e.g. --size=100G")
+	}
+
+	if options.SoakHours < 0 {
+		return errors.New("--hours cannot be negative, 0 runs one round")
+	}
+
+	stats, err := os.Stat(options.SourceFilename)
+	if err != nil {
+		return err
+	}
+
+	if !stats.IsDir() {
+		return fmt.Errorf("%s is not a directory, soak writes its files in one", options.SourceFilename)
+	}
+
+	return nil
+}
+
+func runSoak(options *EncryptorOptions) error {
+	stop := make(chan struct{})
+
+	// Interrupted is how a long soak is cut short, the round running cleans up after itself
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	go func() {
+		<-interrupts
+		gLoggerInfo.Println("Stopping, removing what this round wrote")
+		close(stop)
+	}()
+
+	soakOptions := encryptor.SoakOptions{
+		SizeBytes: options.SoakSizeBytes,
+		Duration:  time.Duration(options.SoakHours * float64(time.Hour)),
+		Progress:  printSoakRound,
+		Stop:      stop,
+	}
+
+	duration := "one round"
+	if soakOptions.Duration > 0 {
+		duration = soakOptions.Duration.String()
+	}
+
+	gLoggerInfo.Printf("Soaking %s with %d bytes a round, for %s\n", options.SourceFilename, soakOptions.SizeBytes, duration)
+
+	report, err := encryptor.Soak(options.SourceFilename, &soakOptions, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	for _, mismatch := range report.Mismatches {
+		gLoggerInfo.Printf("MISMATCH round %d, %s, word at offset %d: expected %016x, found %016x (%d bits flipped)\n",
+			mismatch.Round, mismatch.Stage, mismatch.Offset, mismatch.Expected, mismatch.Found, mismatch.Bits)
+	}
+
+	for _, message := range report.Errors {
+		gLoggerInfo.Println("ERROR", message)
+	}
+
+	gLoggerInfo.Printf("soaked for %v: %d rounds, %d failed, %d bytes written and read back, %d bytes encrypted and decrypted, %d single bit and %d multi-bit word errors\n",
+		report.Elapsed.Round(time.Second), report.Rounds, report.FailedRounds, report.BytesWritten, report.BytesEncrypted, report.SingleBitWords, report.MultiBitWords)
+
+	if report.SingleBitWords > 0 && report.MultiBitWords == 0 {
+		gLoggerInfo.Println("Only single bits flipped, which points at memory - run a memory test (e.g. memtest86+) before trusting this machine")
+	} else if report.MultiBitWords > 0 {
+		gLoggerInfo.Println("Whole words came back wrong, which points at storage - check the disk's SMART data and its cable before trusting it")
+	}
+
+	if report.Stopped {
+		gLoggerInfo.Println("The soak was stopped before it finished")
+	}
+
+	if report.FailedRounds > 0 {
+		return fmt.Errorf("%w, %d of %d rounds failed", errSoakFailed, report.FailedRounds, report.Rounds)
+	}
+
+	return nil
+}
+
+func printSoakRound(round encryptor.SoakRound) {
+	status := "ok"
+	if round.Err != "" {
+		status = "FAILED: " + round.Err
+	} else if round.Mismatches > 0 {
+		status = fmt.Sprintf("FAILED: %d words mismatched", round.Mismatches)
+	}
+
+	gLoggerInfo.Printf("round %d: %d bytes, write and read back %v, encrypt %v, decrypt and compare %v - %s\n",
+		round.Round, round.Bytes, round.WriteTime.Round(time.Millisecond), round.EncryptTime.Round(time.Millisecond), round.DecryptTime.Round(time.Millisecond), status)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	A filename of "-" is stdin (as the source) or stdout (as the target) so
+	encryptor can sit in a shell pipeline
+
+		tar cz dir | encryptor -p pw - - | aws s3 cp - s3://bucket/dir.tgz.enc
+
+	Pipes cannot be seeked or stat'ed, so these jobs use the stream API
+	rather than the concurrent pipeline, and the files they write are in
+	the streamed format (which the pipeline decrypts like any other file)
+
+	gs:// objects in Google Cloud Storage and az:// blobs in Azure Blob
+	Storage are streamed the same way, read with ranged reads kept in
+	flight ahead of the job and written by uploads that a failed job
+	leaves unfinished, so nothing of it appears
+*/
+
+const StdioFilename = "-"
+
+func usesStdio(options *EncryptorOptions) bool {
+	return options.SourceFilename == StdioFilename || options.TargetFilename == StdioFilename
+}
+
+func usesObjectStorage(options *EncryptorOptions) bool {
+	return isObjectURL(options.SourceFilename) || isObjectURL(options.TargetFilename)
+}
+
+// gs:// objects, Azure blobs, and http(s):// sources
+func isObjectURL(name string) bool {
+	return encryptor.IsGCSURL(name) || encryptor.IsAzureBlobURL(name) || encryptor.IsHTTPURL(name)
+}
+
+// Nil on error, rather than a nil reader of either type
+func openObjectReader(name string, options *encryptor.Options) (io.Reader, error) {
+	if encryptor.IsAzureBlobURL(name) {
+		reader, err := encryptor.NewAzureBlobReader(name, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return reader, nil
+	}
+
+	if encryptor.IsHTTPURL(name) {
+		reader, err := encryptor.NewHTTPReader(name, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return reader, nil
+	}
+
+	reader, err := encryptor.NewGCSReader(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Written by an upload that only finishes on Close, Abort leaves nothing behind
+type objectWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+func openObjectWriter(name string, options *encryptor.Options) (objectWriter, error) {
+	if encryptor.IsAzureBlobURL(name) {
+		writer, err := encryptor.NewAzureBlobWriter(name, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return writer, nil
+	}
+
+	writer, err := encryptor.NewGCSWriter(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// Missing filenames mean stdin and stdout, but only when they are not a terminal
+func defaultStdioFilenames(options *EncryptorOptions) {
+	if options.SourceFilename == "" && !isTerminal(os.Stdin) {
+		options.SourceFilename = StdioFilename
+	}
+
+	if options.TargetFilename == "" && options.SourceFilename != "" && options.Operation != encryptor.Verification && options.Operation != encryptor.ProofVerifying && !isTerminal(os.Stdout) {
+		options.TargetFilename = StdioFilename
+	}
+}
+
+func isTerminal(file *os.File) bool {
+	stats, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stats.Mode()&os.ModeCharDevice != 0
+}
+
+func runStdioJob(options *EncryptorOptions) (err error) {
+	var source io.Reader = os.Stdin
+	var target io.Writer = os.Stdout
+
+	// A target cut short by --max-output-size is removed (once closed), never left looking like a whole file
+	var targetFilename string
+	defer func() {
+		if targetFilename != "" && errors.Is(err, encryptor.ErrOutputTooLarge) {
+			_ = os.Remove(targetFilename)
+		}
+	}()
+
+	if isObjectURL(options.SourceFilename) {
+		reader, err := openObjectReader(options.SourceFilename, &options.Options)
+		if err != nil {
+			return err
+		}
+
+		source = reader
+	} else if options.SourceFilename != StdioFilename {
+		file, err := os.Open(options.SourceFilename)
+		if err != nil {
+			return fmt.Errorf("could not open source file: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		source = file
+	}
+
+	if isObjectURL(options.TargetFilename) {
+		writer, err := openObjectWriter(options.TargetFilename, &options.Options)
+		if err != nil {
+			return err
+		}
+
+		// The object only appears if the job succeeds, a failed job's upload is cancelled
+		defer func(writer objectWriter) {
+			if err != nil {
+				_ = writer.Abort()
+			} else {
+				err = writer.Close()
+			}
+		}(writer)
+
+		target = writer
+	} else if options.TargetFilename != StdioFilename {
+		_, statErr := os.Stat(options.TargetFilename)
+		if statErr == nil && !options.ForceOperation {
+			return encryptor.ErrTargetExists
+		}
+
+		file, err := os.Create(options.TargetFilename)
+		if err != nil {
+			return fmt.Errorf("could not open file for writing: %w", err)
+		}
+
+		// Because the close is for a file we are writing to, it can fail the job
+		defer func(file *os.File) {
+			closeErr := file.Close()
+			if err == nil && closeErr != nil {
+				err = fmt.Errorf("error closing file we were writing to: %w", closeErr)
+			}
+		}(file)
+
+		target = file
+		targetFilename = file.Name()
+	}
+
+	if options.Operation == encryptor.Decryption {
+		reader, err := encryptor.NewDecryptReader(source, &options.Options)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(target, reader)
+		return err
+	}
+
+	writer, err := encryptor.NewEncryptWriter(target, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, source)
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// Verification writes nothing, so only the source can be stdin
+func runVerification(options *EncryptorOptions) error {
+	if options.Sequential {
+		return runMediaVerification(options)
+	}
+
+	var err error
+	name := options.SourceFilename
+
+	if options.SourceFilename == StdioFilename {
+		name = "stdin"
+		err = encryptor.VerifyReader(os.Stdin, &options.Options)
+	} else if isObjectURL(options.SourceFilename) {
+		var reader io.Reader
+		if reader, err = openObjectReader(options.SourceFilename, &options.Options); err == nil {
+			err = encryptor.VerifyReader(reader, &options.Options)
+		}
+	} else {
+		err = encryptor.Verify(options.SourceFilename, &options.Options)
+	}
+
+	if err == nil {
+		gLoggerInfo.Println("Verified", name)
+	}
+
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+)
+
+/*
+	--temp-dir moves every temporary file encryptor makes - a preview's
+	plaintext, the files handed to the TPM and PKCS#11 tools - out of the
+	system's temporary directory, e.g. onto an encrypted volume or a
+	tmpfs, and crash reports with them. Each run's files are kept in a
+	session directory only the user can read (see tempfiles.go in the
+	encryptor package)
+
+	A run that crashes or is killed cannot clean up after itself, so every
+	run starts by removing the sessions of runs that are no longer
+	running. Failing to remove them is only a warning, the job does not
+	depend on it
+*/
+
+func setupTempDir(options *EncryptorOptions) error {
+	err := encryptor.SetTempDir(options.TempDirectory)
+	if err != nil {
+		return err
+	}
+
+	removed, err := encryptor.CleanStaleTempFiles()
+	if removed > 0 {
+		gLoggerInfo.Printf("Removed the temporary files of earlier runs that did not finish (%d) from %s\n", removed, encryptor.TempDir())
+	}
+
+	if err != nil {
+		gLoggerInfo.Println("Warning:", err)
+	}
+
+	return nil
+}
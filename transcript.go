@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+/*
+	--transcript writes a record of a file job to a sidecar file as JSON,
+	so that months later a decryption or an audit can tell exactly how a
+	file was produced or read: every effective option (defaults included,
+	as they stood once the command line, the environment, and the files
+	named on it were resolved), the header the job wrote or read, this
+	build's version, when the job ran and how it ended, and facts about
+	the machine that are not secret. Keys, passwords, and PINs are never
+	written - only whether one was given, and the key's fingerprint
+
+	Like a certificate of verification it is written whether the job
+	succeeded or failed, before --post-cmd runs so the hook can ship it,
+	and an existing transcript is only replaced with --force
+*/
+
+type Transcript struct {
+	Encryptor      TranscriptBuild
+	Operation      string
+	Source         string
+	Target         string                         `json:",omitempty"`
+	Options        map[string]interface{}         // By field name, see transcriptOptions
+	KeyFingerprint string                         `json:",omitempty"` // Of the key, jobs with a password or recipients have none
+	HeaderRead     *encryptor.EncryptedFileHeader `json:",omitempty"` // The source's, for jobs that read our format
+	HeaderWritten  *encryptor.EncryptedFileHeader `json:",omitempty"` // The target's, for encryption to a file
+	TreeHash       string                         `json:",omitempty"` // --tree-hash, the Merkle root of the plaintext
+	Started        time.Time
+	Finished       time.Time
+	Seconds        float64
+	Succeeded      bool
+	Error          string `json:",omitempty"`
+	Environment    TranscriptEnvironment
+}
+
+type TranscriptBuild struct {
+	Version   string
+	GitCommit string
+	GoVersion string
+	FIPS      string
+}
+
+type TranscriptEnvironment struct {
+	Hostname           string
+	Platform           string
+	CPUs               int
+	GOMAXPROCS         int
+	WorkingDirectory   string
+	CryptoAcceleration encryptor.CryptoAcceleration
+}
+
+const transcriptRedacted = "(given)"
+
+// Written only as whether they were given
+var transcriptSecrets = map[string]bool{"KeyHex": true, "Password": true, "PKCS11PIN": true}
+
+// Recorded on their own in the transcript
+var transcriptRecordedApart = map[string]bool{"SourceFilename": true, "TargetFilename": true, "Operation": true}
+
+// Found out before the job runs, not after
+func checkTranscript(options *EncryptorOptions) error {
+	if options.TranscriptFilename == "" {
+		return nil
+	}
+
+	if options.Operation == encryptor.FileHashing || options.Operation == encryptor.Scrubbing || options.Operation == encryptor.Shredding || options.Operation == encryptor.Soaking {
+		return errors.New("--transcript records file jobs such as encryption, decryption, and verification, not hash, scrub, shred, or soak")
+	}
+
+	if _, err := os.Stat(options.TranscriptFilename); err == nil && !options.ForceOperation {
+		return fmt.Errorf("transcript %s: %w", options.TranscriptFilename, encryptor.ErrTargetExists)
+	}
+
+	return nil
+}
+
+// Nil without --transcript, otherwise everything known before the job runs
+func startTranscript(options *EncryptorOptions) *Transcript {
+	if options.TranscriptFilename == "" {
+		return nil
+	}
+
+	transcript := &Transcript{
+		Encryptor: TranscriptBuild{
+			Version:   gVersion,
+			GitCommit: gGitCommit,
+			GoVersion: runtime.Version(),
+			FIPS:      fipsStatus(options),
+		},
+		Operation:   operationName(options.Operation),
+		Source:      options.SourceFilename,
+		Target:      options.TargetFilename,
+		Options:     transcriptOptions(options),
+		Started:     time.Now(),
+		Environment: transcriptEnvironment(),
+	}
+
+	// A password's fingerprint can be guessed from, only a key's is recorded
+	if options.KeyHex != "" && !encryptor.UsesRecipients(options.Operation, options.SourceFilename, &options.Options) {
+		transcript.KeyFingerprint, _ = encryptor.KeyFingerprint(&options.Options)
+	}
+
+	// Unreadable headers are the job's to report
+	readsOurFormat := options.Operation != encryptor.Encryption && options.Operation != encryptor.EmailWrapping && !options.OpenPGP && options.JWE == ""
+	if readsOurFormat && options.SourceFilename != StdioFilename && !isObjectURL(options.SourceFilename) {
+		if header, err := encryptor.ReadHeader(options.SourceFilename); err == nil {
+			transcript.HeaderRead = &header
+		}
+	}
+
+	return transcript
+}
+
+// Completes the transcript with how the job ended and writes it, nil does nothing
+func finishTranscript(transcript *Transcript, options *EncryptorOptions, jobErr error) error {
+	if transcript == nil {
+		return nil
+	}
+
+	transcript.Finished = time.Now()
+	transcript.Seconds = transcript.Finished.Sub(transcript.Started).Seconds()
+	transcript.Succeeded = jobErr == nil
+
+	if jobErr != nil {
+		transcript.Error = jobErr.Error()
+	}
+
+	writesOurFormat := options.Operation == encryptor.Encryption && !options.OpenPGP && options.JWE == ""
+	if jobErr == nil && writesOurFormat && writesTargetFile(options) {
+		if header, err := encryptor.ReadHeader(options.TargetFilename); err == nil {
+			transcript.HeaderWritten = &header
+		}
+	}
+
+	if jobErr == nil && options.TreeHash != nil {
+		transcript.TreeHash = options.TreeHash.Root
+	}
+
+	data, err := json.MarshalIndent(transcript, "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not serialize transcript: %w", err)
+	}
+
+	err = os.WriteFile(options.TranscriptFilename, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write transcript: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Every option by its field name, found by reflection so options added
+	later are recorded without being listed here. The library's options
+	are flattened in, callbacks and what the job fills in are left out,
+	and durations are written as 1m30s rather than nanoseconds
+*/
+func transcriptOptions(options *EncryptorOptions) map[string]interface{} {
+	values := map[string]interface{}{}
+	addTranscriptOptions(values, reflect.ValueOf(*options))
+
+	return values
+}
+
+func addTranscriptOptions(values map[string]interface{}, options reflect.Value) {
+	for i := 0; i < options.NumField(); i++ {
+		field, value := options.Type().Field(i), options.Field(i)
+
+		switch {
+		case field.Anonymous:
+			addTranscriptOptions(values, value)
+		case field.PkgPath != "" || transcriptRecordedApart[field.Name]:
+		case value.Kind() == reflect.Func || value.Kind() == reflect.Ptr:
+		case transcriptSecrets[field.Name]:
+			values[field.Name] = ""
+			if !value.IsZero() {
+				values[field.Name] = transcriptRedacted
+			}
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			values[field.Name] = time.Duration(value.Int()).String()
+		default:
+			values[field.Name] = value.Interface()
+		}
+	}
+}
+
+func transcriptEnvironment() TranscriptEnvironment {
+	hostname, _ := os.Hostname()
+	directory, _ := os.Getwd()
+
+	return TranscriptEnvironment{
+		Hostname:           hostname,
+		Platform:           runtime.GOOS + "/" + runtime.GOARCH,
+		CPUs:               runtime.NumCPU(),
+		GOMAXPROCS:         runtime.GOMAXPROCS(0),
+		WorkingDirectory:   directory,
+		CryptoAcceleration: encryptor.GetCryptoAcceleration(),
+	}
+}
+
+// As the job is asked for on the command line
+func operationName(operation encryptor.OperationEnum) string {
+	for name, subcommand := range subcommands {
+		if subcommand == operation {
+			return name
+		}
+	}
+
+	switch operation {
+	case encryptor.Encryption:
+		return "encrypt"
+	case encryptor.Decryption:
+		return "decrypt"
+	case encryptor.Verification:
+		return "verify"
+	case encryptor.Previewing:
+		return "preview"
+	}
+
+	return strconv.Itoa(int(operation))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+	encryptor hash --tree-hash file prints the Merkle root of the file's
+	--chunksize chunks, and with --tree-proof=START-END a JSON proof of
+	those bytes in its place, for systems that verify ranges of huge files
+	without reading all of them. Encrypting or decrypting with --tree-hash
+	logs the plaintext's root, over the file's own chunks, which is the
+	root hash --tree-hash gives the plaintext at the same chunk size
+
+	encryptor prove --tree-proof=START-END archive.enc proof.json decrypts
+	the archive without writing it and writes a proof of those bytes that
+	carries their chunks, and encryptor verify-proof --tree-root=ROOT
+	proof.json checks one - an auditor holding only the root checks a
+	sample of an archive with neither the key nor the rest of the data.
+	A proof from hash --tree-proof carries no chunks, they are read from
+	the file given after it
+*/
+
+func runMerkleTreeHash(options *EncryptorOptions) error {
+	tree, err := encryptor.MerkleTreeHash(options.SourceFilename, int64(options.ChunkSizeMB)*1024*1024, uint(options.Readers))
+	if err != nil {
+		return err
+	}
+
+	if options.TreeProofRange == "" {
+		// Use fmt.Print because the output is a contract, as for a file's hash
+		fmt.Print(tree.Root)
+		return nil
+	}
+
+	start, end, err := parseTreeProofRange(options.TreeProofRange)
+	if err != nil {
+		return err
+	}
+
+	proof, err := encryptor.ProveMerkleRange(&tree, start, end)
+	if err != nil {
+		return err
+	}
+
+	return writeMerkleProof(os.Stdout, proof)
+}
+
+func runRangeProof(options *EncryptorOptions) error {
+	start, end, err := parseTreeProofRange(options.TreeProofRange)
+	if err != nil {
+		return err
+	}
+
+	proof, err := encryptor.ProveEncryptedRange(options.SourceFilename, start, end, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	if options.TargetFilename == "" || options.TargetFilename == StdioFilename {
+		return writeMerkleProof(os.Stdout, proof)
+	}
+
+	if _, err := os.Stat(options.TargetFilename); err == nil && !options.ForceOperation {
+		return encryptor.ErrTargetExists
+	}
+
+	file, err := os.Create(options.TargetFilename)
+	if err != nil {
+		return fmt.Errorf("could not create proof: %w", err)
+	}
+
+	err = writeMerkleProof(file, proof)
+
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing proof: %w", closeErr)
+	}
+
+	if err == nil {
+		gLoggerInfo.Printf("Proved bytes %d-%d in %d chunks against tree hash %s\n", proof.Start, proof.End, len(proof.Chunks), proof.Root)
+	}
+
+	return err
+}
+
+func writeMerkleProof(w io.Writer, proof encryptor.MerkleRangeProof) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(proof)
+}
+
+// The source is the proof, the target the file it was proven from when the proof does not carry its chunks
+func runProofVerification(options *EncryptorOptions) error {
+	if options.TreeRoot == "" {
+		return errors.New("give the root the file is known by with --tree-root, a proof is only as good as the root it is checked against")
+	}
+
+	var reader io.Reader = os.Stdin
+
+	if options.SourceFilename == "" {
+		return errors.New("give the proof to verify")
+	} else if options.SourceFilename != StdioFilename {
+		file, err := os.Open(options.SourceFilename)
+		if err != nil {
+			return fmt.Errorf("could not open proof: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		reader = file
+	}
+
+	var proof encryptor.MerkleRangeProof
+
+	err := json.NewDecoder(reader).Decode(&proof)
+	if err != nil {
+		return fmt.Errorf("could not read proof: %w", err)
+	}
+
+	var source io.ReaderAt
+
+	if options.TargetFilename != "" && options.TargetFilename != StdioFilename {
+		file, err := os.Open(options.TargetFilename)
+		if err != nil {
+			return fmt.Errorf("could not open the proven file: %w", err)
+		}
+
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+
+		source = file
+	}
+
+	err = encryptor.VerifyMerkleRangeProof(proof, options.TreeRoot, source)
+	if err != nil {
+		return err
+	}
+
+	gLoggerInfo.Printf("Verified bytes %d-%d in %d chunks against tree hash %s\n", proof.Start, proof.End, len(proof.Chunks), proof.Root)
+	return nil
+}
+
+// START-END, each a byte offset or a size such as 1GB, END exclusive
+func parseTreeProofRange(proofRange string) (int64, int64, error) {
+	separator := strings.Index(proofRange, "-")
+	if separator < 0 {
+		return 0, 0, fmt.Errorf("--tree-proof %q is not a range, give START-END", proofRange)
+	}
+
+	start, err := encryptor.ParseByteSize(proofRange[:separator])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := encryptor.ParseByteSize(proofRange[separator+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if end <= start {
+		return 0, 0, errors.New("--tree-proof must end after it starts")
+	}
+
+	return start, end, nil
+}
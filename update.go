@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encryptor/pkg/encryptor"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Nothing is ever checked or updated unless asked for - --check-update
+	only reads the latest release's signed manifest, and self-update
+	replaces the running binary with the one that manifest lists for this
+	platform, once its SHA256 matches. Both honor --offline, a manifest or
+	binary that would be fetched over the network is refused
+*/
+
+// encryptor --check-update says whether a newer release than this binary exists
+func runUpdateCheck(options *EncryptorOptions) error {
+	manifest, _, err := readLatestRelease(options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("version:", gVersion, "commit:", gGitCommit)
+	fmt.Println("latest release:", manifest.Version, "commit:", manifest.GitCommit, "released:", manifest.Released.UTC().Format(time.RFC3339))
+
+	switch {
+	case gVersion == "0":
+		fmt.Println("This is a development build, the latest release is", manifest.Version)
+	case compareVersions(manifest.Version, gVersion) > 0:
+		fmt.Println("A newer release is available:", manifest.Version, "(update with encryptor self-update)")
+	default:
+		fmt.Println("This is the latest release")
+	}
+
+	return nil
+}
+
+// encryptor self-update replaces the running binary with the latest release's, --force reinstalls the same release
+func runSelfUpdate(options *EncryptorOptions) error {
+	manifest, manifestName, err := readLatestRelease(options)
+	if err != nil {
+		return err
+	}
+
+	if gVersion != "0" && compareVersions(manifest.Version, gVersion) <= 0 && !options.ForceOperation {
+		fmt.Println("encryptor", gVersion, "is already the latest release, --force reinstalls it")
+		return nil
+	}
+
+	binary, ok := encryptor.ReleaseBinaryFor(&manifest, runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", manifest.Version, runtime.GOOS, runtime.GOARCH)
+	}
+
+	binaryFilename, err := runningBinaryFilename()
+	if err != nil {
+		return err
+	}
+
+	err = encryptor.InstallReleaseBinary(binaryFilename, manifestName, binary, &options.Options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Updated", binaryFilename, "from", gVersion, "to", manifest.Version, "("+binary.Name+", sha256:", binary.SHA256+")")
+	return nil
+}
+
+func readLatestRelease(options *EncryptorOptions) (encryptor.ReleaseManifest, string, error) {
+	manifestName := releaseManifestName(options)
+	if manifestName == "" {
+		return encryptor.ReleaseManifest{}, "", errors.New("this build does not know where releases are published, give the latest release's manifest with --manifest")
+	}
+
+	publicKey, err := releasePublicKey(options)
+	if err != nil {
+		return encryptor.ReleaseManifest{}, "", err
+	}
+
+	manifest, err := encryptor.ReadReleaseManifest(manifestName, publicKey)
+	if err != nil {
+		return encryptor.ReleaseManifest{}, "", err
+	}
+
+	return manifest, manifestName, nil
+}
+
+// Dotted versions compared part by part, numerically where both parts are numbers (1.10 is newer than 1.9)
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bParts := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+
+		aNumber, aErr := strconv.Atoi(aPart)
+		bNumber, bErr := strconv.Atoi(bPart)
+
+		switch {
+		case aErr == nil && bErr == nil && aNumber != bNumber:
+			if aNumber > bNumber {
+				return 1
+			}
+
+			return -1
+		case (aErr != nil || bErr != nil) && aPart != bPart:
+			return strings.Compare(aPart, bPart)
+		}
+	}
+
+	return 0
+}